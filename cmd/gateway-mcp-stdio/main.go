@@ -0,0 +1,136 @@
+// Command gateway-mcp-stdio bridges an MCP stdio client to the gateway's
+// authenticated /mcp endpoint, so desktop agents that only speak stdio can use
+// the gateway tool catalog under a gateway user's policy.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	endpoint := flag.String("url", "https://127.0.0.1:8080/mcp", "gateway MCP endpoint")
+	token := flag.String("token", os.Getenv("DKST_GATEWAY_TOKEN"), "gateway session token (default $DKST_GATEWAY_TOKEN)")
+	userID := flag.String("user", "", "log in as this gateway user instead of using -token; password is read from $DKST_GATEWAY_PASSWORD")
+	insecure := flag.Bool("insecure", false, "accept the gateway's self-signed certificate")
+	timeout := flag.Duration("timeout", 5*time.Minute, "per-message timeout")
+	flag.Parse()
+
+	client := &http.Client{Timeout: *timeout}
+	if *insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	sessionToken := strings.TrimSpace(*token)
+	if strings.TrimSpace(*userID) != "" {
+		loggedIn, err := login(client, *endpoint, strings.TrimSpace(*userID), os.Getenv("DKST_GATEWAY_PASSWORD"))
+		if err != nil {
+			fatal(err)
+		}
+		sessionToken = loggedIn
+	}
+	if sessionToken == "" {
+		fatal(fmt.Errorf("a session token (-token or $DKST_GATEWAY_TOKEN) or -user is required"))
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	writer := bufio.NewWriter(os.Stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if message := bytes.TrimSpace(line); len(message) > 0 {
+			reply, forwardErr := forward(client, *endpoint, sessionToken, message)
+			if forwardErr != nil {
+				reply = errorReply(message, forwardErr)
+			}
+			if len(reply) > 0 {
+				writer.Write(bytes.TrimSpace(reply))
+				writer.WriteByte('\n')
+				writer.Flush()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func forward(client *http.Client, endpoint, token string, message []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// errorReply turns a transport failure into a JSON-RPC error so the stdio
+// client sees a reply for its request instead of hanging.
+func errorReply(message []byte, cause error) []byte {
+	var request struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(message, &request) != nil || len(request.ID) == 0 {
+		fmt.Fprintln(os.Stderr, "gateway-mcp-stdio:", cause)
+		return nil
+	}
+	reply, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      request.ID,
+		"error":   map[string]interface{}{"code": -32000, "message": cause.Error()},
+	})
+	return reply
+}
+
+func login(client *http.Client, endpoint, userID, password string) (string, error) {
+	loginURL := strings.TrimSuffix(strings.TrimSuffix(endpoint, "/"), "/mcp") + "/api/login"
+	payload, _ := json.Marshal(map[string]interface{}{"id": userID, "password": password, "remember_me": true})
+	resp, err := client.Post(loginURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Token string `json:"token"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(result.Token) == "" {
+		return "", fmt.Errorf("login failed: %s", result.Error)
+	}
+	return result.Token, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "gateway-mcp-stdio:", err)
+	os.Exit(2)
+}
@@ -0,0 +1,159 @@
+// Command retrieval-eval scores memory search against a labelled JSONL set
+// and prints recall@k and MRR for each fusion strategy, with and without the
+// reranker. It opens the memory database the way the app does, schema
+// upgrades included, so point -db at a copy while the app is running.
+//
+// Each line of the set is a case such as
+//
+//	{"id": "pet-name", "user_id": "alice", "query": "what is my dog called", "relevant_memory_ids": [12, 40]}
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"dinkisstyle-chat/internal/core"
+	"dinkisstyle-chat/internal/evalharness"
+	"dinkisstyle-chat/internal/mcp"
+)
+
+func main() {
+	dbPath := flag.String("db", core.GetMemoryDatabasePath(), "memory database to search")
+	casesFile := flag.String("cases", "", "labelled JSONL set (required)")
+	defaultUser := flag.String("user", "", "user id for cases that do not name one")
+	kList := flag.String("k", "1,5,10", "comma separated cutoffs for recall@k")
+	fusions := flag.String("fusion", "rrf,weighted", "comma separated fusion strategies to compare")
+	recencyBoost := flag.Float64("recency-boost", 0, "recency boost for every run")
+	hitCountBoost := flag.Float64("hit-boost", 0, "hit count boost for every run")
+	rerankModel := flag.String("rerank-model", "", "reranker model id under assets/rerankers; also runs each strategy reranked")
+	verbose := flag.Bool("v", false, "print the ranked ids of every case")
+	flag.Parse()
+
+	ks, err := parseCutoffs(*kList)
+	if err != nil {
+		fatal(err)
+	}
+	if strings.TrimSpace(*casesFile) == "" {
+		fatal(fmt.Errorf("-cases is required"))
+	}
+	cases, err := evalharness.LoadRetrievalCases(*casesFile)
+	if err != nil {
+		fatal(err)
+	}
+	if len(cases) == 0 {
+		fatal(fmt.Errorf("%s has no cases", *casesFile))
+	}
+
+	reranker := core.RerankerModelConfig{ModelID: strings.TrimSpace(*rerankModel), Enabled: strings.TrimSpace(*rerankModel) != ""}
+	if err := core.LoadRetrievalModels(reranker); err != nil {
+		fmt.Fprintln(os.Stderr, "retrieval-eval: embedding model unavailable, vector hits use the hashed fallback:", err)
+	}
+	if err := mcp.InitDB(*dbPath); err != nil {
+		fatal(err)
+	}
+	defer mcp.CloseDB()
+
+	depth := ks[len(ks)-1]
+	fmt.Printf("%-18s", "run")
+	for _, k := range ks {
+		fmt.Printf(" %9s", "recall@"+strconv.Itoa(k))
+	}
+	fmt.Printf(" %7s %6s\n", "MRR", "cases")
+	for _, fusion := range strings.Split(*fusions, ",") {
+		fusion = strings.TrimSpace(fusion)
+		if fusion != mcp.RetrievalFusionRRF && fusion != mcp.RetrievalFusionWeighted {
+			fatal(fmt.Errorf("unknown fusion %q", fusion))
+		}
+		variants := []bool{false}
+		if reranker.Enabled {
+			variants = append(variants, true)
+		}
+		for _, rerank := range variants {
+			cfg := mcp.DefaultRetrievalConfig()
+			cfg.Fusion = fusion
+			cfg.RecencyBoost = *recencyBoost
+			cfg.HitCountBoost = *hitCountBoost
+			cfg.DisableRerank = !rerank
+			mcp.SetRetrievalConfig(cfg)
+
+			name := fusion
+			if rerank {
+				name += "+rerank"
+			}
+			scores := make([]evalharness.RetrievalScore, 0, len(cases))
+			for _, item := range cases {
+				userID := firstNonEmpty(item.UserID, *defaultUser)
+				ranked, err := rankMemoryIDs(userID, item.Query, depth)
+				if err != nil {
+					fatal(fmt.Errorf("case %s: %w", item.ID, err))
+				}
+				score := evalharness.ScoreRetrieval(ranked, item.Relevant, ks)
+				scores = append(scores, score)
+				if *verbose {
+					fmt.Printf("  [%s] %s rr=%.3f ranked=%v relevant=%v\n", name, item.ID, score.ReciprocalRank, ranked, item.Relevant)
+				}
+			}
+			summary := evalharness.SummarizeRetrieval(scores, ks)
+			fmt.Printf("%-18s", name)
+			for _, k := range ks {
+				fmt.Printf(" %9.3f", summary.RecallAt[k])
+			}
+			fmt.Printf(" %7.3f %6d\n", summary.MRR, summary.Cases)
+		}
+	}
+}
+
+// rankMemoryIDs runs the gateway's memory search and keeps the first chunk
+// of each memory, so ranks count memories rather than chunks.
+func rankMemoryIDs(userID, query string, depth int) ([]int64, error) {
+	// Chunks of one memory can fill several slots; search a little deeper.
+	matches, err := mcp.SearchMemoryChunkMatches(userID, query, depth*3)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]bool, len(matches))
+	ranked := make([]int64, 0, depth)
+	for _, match := range matches {
+		if seen[match.ID] {
+			continue
+		}
+		seen[match.ID] = true
+		ranked = append(ranked, match.ID)
+		if len(ranked) >= depth {
+			break
+		}
+	}
+	return ranked, nil
+}
+
+func parseCutoffs(value string) ([]int, error) {
+	var ks []int
+	for _, part := range strings.Split(value, ",") {
+		k, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || k <= 0 {
+			return nil, fmt.Errorf("invalid cutoff %q", part)
+		}
+		if len(ks) > 0 && k <= ks[len(ks)-1] {
+			return nil, fmt.Errorf("cutoffs must be increasing: %s", value)
+		}
+		ks = append(ks, k)
+	}
+	return ks, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if trimmed := strings.TrimSpace(value); trimmed != "" {
+			return trimmed
+		}
+	}
+	return ""
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "retrieval-eval:", err)
+	os.Exit(2)
+}
@@ -77,6 +77,9 @@
             "setting.llmMode.desc": "OpenAI 호환 모드와 LM Studio 모드 중 선택하세요.",
             "setting.llmMode.option.standard": "OpenAI 호환",
             "setting.llmMode.option.stateful": "LM Studio",
+            "setting.llmMode.option.responses": "OpenAI Responses",
+            "setting.llmMode.option.ollama": "Ollama",
+            "setting.llmMode.option.anthropic": "Anthropic Messages",
             "setting.contextStrategy.label": "배경 / 문맥 메모리",
             "setting.contextStrategy.desc": "현재 모드에서 대화 문맥을 유지하는 방식을 선택합니다.",
             "setting.contextStrategy.option.retrieval": "FTS5 + Vector",
@@ -159,9 +162,19 @@
             "tool.webEvidenceSummary": "검색 {searches}회 · 출처 {sources}개",
             "tool.noQueryDetails": "상세 쿼리 없음",
             "tool.unknownError": "알 수 없는 오류",
+            "tool.approvalRequired": "{tool} 실행 승인이 필요합니다",
+            "tool.approve": "승인",
+            "tool.reject": "거절",
+            "tool.approvalApproved": "승인됨",
+            "tool.approvalRejected": "거절됨",
+            "tool.approvalTimeout": "시간 초과로 거절됨",
+            "tool.approvalCancelled": "요청이 취소됨",
+            "tool.approvalExpired": "더 이상 유효하지 않은 승인 요청입니다",
             "progress.processingPrompt": "프롬프트 처리 중",
             "progress.loadingModel": "모델 로드 중",
             "progress.modelLoaded": "모델 로드 완료",
+            "progress.waitingForModelLoad": "모델 로드 대기 중",
+            "progress.retryingUpstream": "LLM 서버 재연결 중",
             "background.savedTurnTitle": "대화 제목 생성 중...",
             "background.serverChatContinuing": "서버 응답 재개 중...",
             "setting.enableTTS.label": "TTS 활성화",
@@ -221,6 +234,43 @@
             "setting.cert.label": "HTTPS 인증서",
             "setting.cert.desc": "이 기기에서 서버를 신뢰하도록 인증서를 다운로드하세요.",
             "action.downloadCert": "인증서 다운로드",
+            "setting.apiKeys.label": "API 키",
+            "setting.apiKeys.desc": "스크립트와 자동화용 키입니다. Authorization: Bearer 헤더로 보내세요.",
+            "setting.apiKeys.namePlaceholder": "키 이름",
+            "setting.apiKeys.noExpiry": "만료 없음",
+            "setting.apiKeys.expires30": "30일",
+            "setting.apiKeys.expires90": "90일",
+            "setting.apiKeys.expires365": "1년",
+            "setting.apiKeys.empty": "발급된 키가 없습니다.",
+            "setting.apiKeys.lastUsed": "마지막 사용: {time}",
+            "setting.apiKeys.neverUsed": "사용 기록 없음",
+            "setting.apiKeys.expiresAt": "만료: {time}",
+            "setting.apiKeys.created": "새 키입니다. 지금만 볼 수 있으니 복사해 두세요.",
+            "setting.apiKeys.confirmRevoke": "API 키 \"{name}\"을(를) 폐기할까요? 이 키를 쓰는 스크립트는 바로 거부됩니다.",
+            "action.createApiKey": "키 발급",
+            "action.revokeApiKey": "폐기",
+            "setting.memoryBrowser.label": "기억 관리",
+            "setting.memoryBrowser.desc": "저장된 기억과 프로필을 검색하고 고치거나 고정·삭제합니다.",
+            "setting.memoryBrowser.searchPlaceholder": "기억 검색",
+            "setting.memoryBrowser.allTiers": "모든 등급",
+            "setting.memoryBrowser.allPins": "고정 여부 전체",
+            "setting.memoryBrowser.pinnedOnly": "고정됨",
+            "setting.memoryBrowser.unpinnedOnly": "고정 안 됨",
+            "setting.memoryBrowser.empty": "저장된 기억이 없습니다.",
+            "setting.memoryBrowser.meta": "{tier} · {type} · 조회 {hits}회 · {time}",
+            "setting.memoryBrowser.page": "{from}-{to} / {total}",
+            "setting.memoryBrowser.editPrompt": "기억 내용을 고치세요.",
+            "setting.memoryBrowser.confirmDelete": "선택한 기억 {count}개를 삭제할까요?",
+            "setting.memoryBrowser.profileLabel": "프로필",
+            "setting.memoryBrowser.profileEmpty": "저장된 프로필이 없습니다.",
+            "setting.memoryBrowser.profilePrompt": "\"{key}\"의 새 값을 입력하세요.",
+            "setting.memoryBrowser.confirmDeleteFact": "프로필 \"{key}\"을(를) 삭제할까요?",
+            "action.pinMemory": "고정",
+            "action.unpinMemory": "고정 해제",
+            "action.editMemory": "편집",
+            "action.deleteSelectedMemories": "선택 삭제",
+            "action.previousPage": "이전",
+            "action.nextPage": "다음",
             "chat.welcome": "반가워요! 대화할 준비가 되었습니다.",
             "chat.instruction": "설정(⚙️)에서 엔진을 구성할 수 있습니다.",
             "chat.startup.welcomeTitle": "환영합니다.",
@@ -341,6 +391,9 @@
             "setting.llmMode.desc": "Select between OpenAI Compatible or LM Studio",
             "setting.llmMode.option.standard": "OpenAI Compatible",
             "setting.llmMode.option.stateful": "LM Studio (Recommended)",
+            "setting.llmMode.option.responses": "OpenAI Responses",
+            "setting.llmMode.option.ollama": "Ollama",
+            "setting.llmMode.option.anthropic": "Anthropic Messages",
             "setting.contextStrategy.label": "Background / Context Memory",
             "setting.contextStrategy.desc": "Choose how the app keeps conversational context for the current connection mode.",
             "setting.contextStrategy.option.retrieval": "FTS5 + Vector",
@@ -423,9 +476,19 @@
             "tool.webEvidenceSummary": "{searches} searches · {sources} sources",
             "tool.noQueryDetails": "No query details",
             "tool.unknownError": "Unknown error",
+            "tool.approvalRequired": "{tool} needs your approval",
+            "tool.approve": "Approve",
+            "tool.reject": "Reject",
+            "tool.approvalApproved": "Approved",
+            "tool.approvalRejected": "Rejected",
+            "tool.approvalTimeout": "Rejected after timeout",
+            "tool.approvalCancelled": "Request cancelled",
+            "tool.approvalExpired": "This approval request is no longer valid",
             "progress.processingPrompt": "Processing Prompt",
             "progress.loadingModel": "Loading Model",
             "progress.modelLoaded": "Model Loaded",
+            "progress.waitingForModelLoad": "Waiting for model load",
+            "progress.retryingUpstream": "Reconnecting to the LLM server",
             "background.savedTurnTitle": "Generating saved turn titles...",
             "setting.enableTTS.label": "Enable TTS",
             "setting.enableTTS.desc": "Play responses as audio.",
@@ -484,6 +547,43 @@
             "setting.cert.label": "HTTPS Certificate",
             "setting.cert.desc": "Download the certificate to trust this server on this device.",
             "action.downloadCert": "Download cert.pem",
+            "setting.apiKeys.label": "API Keys",
+            "setting.apiKeys.desc": "Keys for scripts and automations. Send them as Authorization: Bearer.",
+            "setting.apiKeys.namePlaceholder": "Key name",
+            "setting.apiKeys.noExpiry": "No expiry",
+            "setting.apiKeys.expires30": "30 days",
+            "setting.apiKeys.expires90": "90 days",
+            "setting.apiKeys.expires365": "1 year",
+            "setting.apiKeys.empty": "No keys issued.",
+            "setting.apiKeys.lastUsed": "Last used {time}",
+            "setting.apiKeys.neverUsed": "Never used",
+            "setting.apiKeys.expiresAt": "Expires {time}",
+            "setting.apiKeys.created": "New key. It is shown only once, so copy it now.",
+            "setting.apiKeys.confirmRevoke": "Revoke API key \"{name}\"? Scripts using it are rejected immediately.",
+            "action.createApiKey": "Create key",
+            "action.revokeApiKey": "Revoke",
+            "setting.memoryBrowser.label": "Memory Browser",
+            "setting.memoryBrowser.desc": "Search, edit, pin and delete your stored memories and profile facts.",
+            "setting.memoryBrowser.searchPlaceholder": "Search memories",
+            "setting.memoryBrowser.allTiers": "All tiers",
+            "setting.memoryBrowser.allPins": "Pinned or not",
+            "setting.memoryBrowser.pinnedOnly": "Pinned",
+            "setting.memoryBrowser.unpinnedOnly": "Not pinned",
+            "setting.memoryBrowser.empty": "No memories stored.",
+            "setting.memoryBrowser.meta": "{tier} · {type} · {hits} hits · {time}",
+            "setting.memoryBrowser.page": "{from}-{to} of {total}",
+            "setting.memoryBrowser.editPrompt": "Edit the memory text.",
+            "setting.memoryBrowser.confirmDelete": "Delete {count} selected memories?",
+            "setting.memoryBrowser.profileLabel": "Profile",
+            "setting.memoryBrowser.profileEmpty": "No profile facts stored.",
+            "setting.memoryBrowser.profilePrompt": "Enter a new value for \"{key}\".",
+            "setting.memoryBrowser.confirmDeleteFact": "Delete profile fact \"{key}\"?",
+            "action.pinMemory": "Pin",
+            "action.unpinMemory": "Unpin",
+            "action.editMemory": "Edit",
+            "action.deleteSelectedMemories": "Delete selected",
+            "action.previousPage": "Previous",
+            "action.nextPage": "Next",
             "chat.welcome": "Hello! I am ready to chat. Configure settings using the gear icon.",
             "chat.instruction": "You can configure settings in the top right menu.",
             "chat.startup.welcomeTitle": "Welcome.",
@@ -222,7 +222,9 @@
                 const raw = String(event?.data || '').trim();
                 if (!raw) return null;
                 try {
-                    return JSON.parse(raw);
+                    const parsed = JSON.parse(raw);
+                    const unwrap = global.DKSTStreamProtocol?.unwrapEnvelope;
+                    return typeof unwrap === 'function' ? unwrap(parsed) : parsed;
                 } catch (err) {
                     console.warn('Failed to parse SSE payload:', err, raw);
                     return null;
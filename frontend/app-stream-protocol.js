@@ -23,6 +23,24 @@
         return null;
     }
 
+    // The server wraps every event as { schema_version, request_id, turn_id,
+    // seq, type, payload }. Callers keep working with the bare payload; the
+    // envelope type fills in payloads that have none, except provider chunks.
+    function unwrapEnvelope(parsed) {
+        if (!parsed || typeof parsed !== 'object' || !parsed.schema_version || !('payload' in parsed)) {
+            return parsed;
+        }
+        if (parsed.type === 'stream.done') return { type: 'stream.done' };
+        const payload = parsed.payload;
+        if (!payload || typeof payload !== 'object' || Array.isArray(payload)) {
+            return { type: parsed.type || 'message', data: payload };
+        }
+        if (!payload.type && parsed.type && parsed.type !== 'completion.chunk') {
+            return { ...payload, type: parsed.type };
+        }
+        return payload;
+    }
+
     function parseEventBlock(rawBlock, parseErrorMessage) {
         const lines = String(rawBlock || '').split(/\r\n|\n|\r/);
         let eventName = 'message';
@@ -52,7 +70,8 @@
         if (data === '[DONE]') return { type: 'stream.done' };
 
         try {
-            const parsed = JSON.parse(data);
+            const parsed = unwrapEnvelope(JSON.parse(data));
+            if (parsed?.type === 'stream.done') return parsed;
             if (!parsed || typeof parsed !== 'object' || Array.isArray(parsed)) {
                 throw new TypeError('stream payload must be a JSON object');
             }
@@ -124,6 +143,7 @@
 
     global.DKSTStreamProtocol = {
         SSEParser,
-        parseEventBlock
+        parseEventBlock,
+        unwrapEnvelope
     };
 })(window);
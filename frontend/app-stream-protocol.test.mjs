@@ -53,3 +53,26 @@ test('normalizes a JSON named error event to the canonical error field', () => {
         { type: 'error', message: 'upstream failed', error: { message: 'upstream failed' } }
     ]);
 });
+
+test('unwraps versioned event envelopes', () => {
+    const parser = new SSEParser();
+    const envelope = (type, payload, seq) => `id: ${seq}\ndata: ${JSON.stringify({ schema_version: 1, request_id: 'req-1', turn_id: 't1', seq, type, payload })}\n\n`;
+    const events = parser.parse(encoder.encode(
+        envelope('message.delta', { type: 'message.delta', content: '안녕' }, 1) +
+        envelope('completion.chunk', { choices: [{ delta: { content: 'hi' } }] }, 2) +
+        envelope('stream.done', {}, 3)
+    ));
+    assert.deepEqual(events, [
+        { type: 'message.delta', content: '안녕' },
+        { choices: [{ delta: { content: 'hi' } }] },
+        { type: 'stream.done' }
+    ]);
+});
+
+test('keeps an enveloped plain error as an error event', () => {
+    const parser = new SSEParser();
+    const data = JSON.stringify({ schema_version: 1, seq: 4, type: 'error', payload: { message: 'upstream failed' } });
+    assert.deepEqual(parser.parse(encoder.encode(`id: 4\nevent: error\ndata: ${data}\n\n`)), [
+        { type: 'error', message: 'upstream failed', error: { message: 'upstream failed' } }
+    ]);
+});
@@ -748,6 +748,17 @@ function handleModelLoadEvent(json, ctx) {
     }
 }
 
+/**
+ * handleUpstreamRetryEvent: Show that the server is waiting to retry the upstream
+ */
+function handleUpstreamRetryEvent(json, ctx) {
+    ctx.waitingOnUpstream = true;
+    const label = json.reason === 'model_loading'
+        ? t('progress.waitingForModelLoad')
+        : `${t('progress.retryingUpstream')} (${json.attempt}/${json.max_attempts})`;
+    renderProgressDock(label, null, 'model-loading', true);
+}
+
 /**
  * handleErrorEvent: Show generative errors in bubble or tool card
  */
@@ -893,6 +904,11 @@ async function handleStreamEvent(json, ctx) {
         throw parseError;
     }
 
+    if (ctx.waitingOnUpstream && eventType !== 'upstream.retry') {
+        ctx.waitingOnUpstream = false;
+        hideProgressDock();
+    }
+
     if (json.response_id) { AppState.chat.stateful.lastResponseId = json.response_id; }
 
     if (json.error) {
@@ -1006,6 +1022,10 @@ async function handleStreamEvent(json, ctx) {
             setToolCardState(elementId, 'success', getWebEvidenceSummary(elementId) || t('tool.executionFinished'));
         } else if (eventType === 'tool_call.failure') {
             setToolCardState(elementId, 'failure', json.reason || t('tool.unknownError'));
+        } else if (eventType === 'tool_call.approval_required') {
+            renderToolApprovalPrompt(elementId, json);
+        } else if (eventType === 'tool_call.approval_resolved') {
+            resolveToolApprovalPrompt(json);
         }
     }
     else if (eventType === 'chat.end') { handleChatEndEvent(json, ctx); }
@@ -1019,6 +1039,7 @@ async function handleStreamEvent(json, ctx) {
     }
     else if (eventType === 'prompt_processing.progress') { renderProgressDock(t('progress.processingPrompt'), json.progress * 100, 'prompt-processing', false); }
     else if (eventType.startsWith('model_load.')) { handleModelLoadEvent(json, ctx); }
+    else if (eventType === 'upstream.retry') { handleUpstreamRetryEvent(json, ctx); }
     else if (eventType === 'error') { handleErrorEvent(json, ctx); }
 
     if (contentToAdd) {
@@ -1493,6 +1514,8 @@ function fetchModels() {
 }
 
 function openSettingsModal() {
+    loadApiKeys();
+    loadMemoryBrowser(0);
     return modelController.openSettingsModal();
 }
 
@@ -1822,6 +1845,276 @@ async function downloadCertificate() {
     }
 }
 
+// API Keys
+function formatApiKeyTime(value) {
+    return value ? new Date(value).toLocaleString() : '';
+}
+
+async function loadApiKeys() {
+    const listEl = document.getElementById('api-key-list');
+    if (!listEl) return;
+    const adminScope = document.querySelector('.api-key-admin-scope');
+    if (adminScope) {
+        adminScope.style.display = AppState.session.currentUser?.role === 'admin' ? '' : 'none';
+    }
+    try {
+        const response = await fetch('/api/api-keys', buildSessionFetchOptions());
+        if (!response.ok) throw new Error(`HTTP ${response.status}`);
+        const data = await response.json();
+        const keys = Array.isArray(data.keys) ? data.keys : [];
+        if (keys.length === 0) {
+            listEl.innerHTML = `<p class="setting-desc">${escapeHtml(t('setting.apiKeys.empty'))}</p>`;
+            return;
+        }
+        listEl.innerHTML = keys.map((key) => {
+            const lastUsed = key.last_used_at
+                ? t('setting.apiKeys.lastUsed').replace('{time}', formatApiKeyTime(key.last_used_at))
+                : t('setting.apiKeys.neverUsed');
+            const expires = key.expires_at
+                ? ` · ${t('setting.apiKeys.expiresAt').replace('{time}', formatApiKeyTime(key.expires_at))}`
+                : '';
+            return `
+            <div class="user-item">
+                <span>
+                    ${escapeHtml(key.name)} <code>${escapeHtml(key.key_prefix)}…</code>
+                    <span class="setting-desc" style="display: block;">${escapeHtml((key.scopes || []).join(', '))} · ${escapeHtml(lastUsed + expires)}</span>
+                </span>
+                <button class="icon-btn" data-name="${escapeAttr(key.name)}" onclick="revokeApiKey(${Number(key.id)}, this.dataset.name)" title="${escapeAttr(t('action.revokeApiKey'))}">
+                    <span class="material-icons-round">delete</span>
+                </button>
+            </div>`;
+        }).join('');
+    } catch (e) {
+        console.error('[API Keys] Load failed:', e);
+    }
+}
+
+async function createApiKey() {
+    const nameInput = document.getElementById('api-key-name');
+    const name = (nameInput?.value || '').trim();
+    if (!name) {
+        nameInput?.focus();
+        return;
+    }
+    const scopes = Array.from(document.querySelectorAll('#api-key-scopes input:checked')).map((input) => input.value);
+    const expiresInDays = Number(document.getElementById('api-key-expiry')?.value || 0);
+    try {
+        const response = await fetch('/api/api-keys', buildSessionFetchOptions({
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ name, scopes, expires_in_days: expiresInDays })
+        }));
+        if (!response.ok) throw new Error((await response.text()).trim() || `HTTP ${response.status}`);
+        const data = await response.json();
+        const createdEl = document.getElementById('api-key-created');
+        if (createdEl) {
+            createdEl.value = data.key;
+            createdEl.title = t('setting.apiKeys.created');
+            createdEl.style.display = '';
+            createdEl.select();
+        }
+        alert(t('setting.apiKeys.created'));
+        if (nameInput) nameInput.value = '';
+        loadApiKeys();
+    } catch (e) {
+        console.error('[API Keys] Create failed:', e);
+        alert('Error: ' + e.message);
+    }
+}
+
+async function revokeApiKey(id, name) {
+    if (!confirm(t('setting.apiKeys.confirmRevoke').replace('{name}', name))) return;
+    try {
+        const response = await fetch(`/api/api-keys?id=${encodeURIComponent(id)}`, buildSessionFetchOptions({ method: 'DELETE' }));
+        if (!response.ok) throw new Error(`HTTP ${response.status}`);
+        loadApiKeys();
+    } catch (e) {
+        console.error('[API Keys] Revoke failed:', e);
+        alert('Error: ' + e.message);
+    }
+}
+
+// Memory Browser
+const MEMORY_BROWSER_PAGE_SIZE = 20;
+const memoryBrowserState = { offset: 0, total: 0, count: 0, searching: false };
+
+async function loadMemoryBrowser(offset = memoryBrowserState.offset) {
+    const listEl = document.getElementById('memory-browser-list');
+    if (!listEl) return;
+    const query = (document.getElementById('memory-browser-search')?.value || '').trim();
+    const params = new URLSearchParams({ limit: String(MEMORY_BROWSER_PAGE_SIZE), offset: String(Math.max(0, offset)) });
+    const tier = document.getElementById('memory-browser-tier')?.value || '';
+    const pinned = document.getElementById('memory-browser-pinned')?.value || '';
+    if (tier) params.set('tier', tier);
+    if (pinned) params.set('pinned', pinned);
+    if (query) params.set('q', query);
+    try {
+        const response = await fetch(`${query ? '/api/memories/search' : '/api/memories'}?${params}`, buildSessionFetchOptions());
+        if (!response.ok) throw new Error((await response.text()).trim() || `HTTP ${response.status}`);
+        const data = await response.json();
+        const items = Array.isArray(data.items) ? data.items : [];
+        memoryBrowserState.offset = Number(data.offset) || 0;
+        memoryBrowserState.count = items.length;
+        memoryBrowserState.searching = !!query;
+        memoryBrowserState.total = query ? memoryBrowserState.offset + items.length : Number(data.total) || 0;
+        renderMemoryBrowser(items);
+    } catch (e) {
+        console.error('[Memory Browser] Load failed:', e);
+    }
+    loadMemoryBrowserFacts();
+}
+
+function renderMemoryBrowser(items) {
+    const listEl = document.getElementById('memory-browser-list');
+    const pageEl = document.getElementById('memory-browser-page');
+    const { offset, total, count, searching } = memoryBrowserState;
+    if (pageEl) {
+        pageEl.textContent = count === 0 ? '' : t('setting.memoryBrowser.page')
+            .replace('{from}', String(offset + 1))
+            .replace('{to}', String(offset + count))
+            .replace('{total}', searching ? '…' : String(total));
+    }
+    const prevBtn = document.getElementById('memory-browser-prev');
+    const nextBtn = document.getElementById('memory-browser-next');
+    if (prevBtn) prevBtn.disabled = offset === 0;
+    if (nextBtn) nextBtn.disabled = searching ? count < MEMORY_BROWSER_PAGE_SIZE : offset + count >= total;
+    if (items.length === 0) {
+        listEl.innerHTML = `<p class="setting-desc">${escapeHtml(t('setting.memoryBrowser.empty'))}</p>`;
+        return;
+    }
+    listEl.innerHTML = items.map((memory) => {
+        const text = String(memory.full_text || '');
+        const preview = text.length > 240 ? `${text.slice(0, 240)}…` : text;
+        const meta = t('setting.memoryBrowser.meta')
+            .replace('{tier}', memory.memory_tier || 'ephemeral')
+            .replace('{type}', memory.memory_type || '')
+            .replace('{hits}', String(Number(memory.hit_count) || 0))
+            .replace('{time}', formatApiKeyTime(memory.created_at));
+        const tierOptions = ['core', 'working', 'ephemeral'].map((tier) =>
+            `<option value="${tier}" ${tier === memory.memory_tier ? 'selected' : ''}>${tier}</option>`).join('');
+        return `
+            <div class="user-item">
+                <input type="checkbox" class="memory-browser-select" value="${Number(memory.id)}">
+                <span style="flex: 1; min-width: 0; white-space: pre-wrap; word-break: break-word;">
+                    ${escapeHtml(preview)}
+                    <span class="setting-desc" style="display: block;">${escapeHtml(meta)}</span>
+                </span>
+                <select onchange="updateMemoryFromBrowser(${Number(memory.id)}, { tier: this.value })">${tierOptions}</select>
+                <button class="icon-btn" onclick="updateMemoryFromBrowser(${Number(memory.id)}, { pinned: ${!memory.pinned} })"
+                    title="${escapeAttr(t(memory.pinned ? 'action.unpinMemory' : 'action.pinMemory'))}">
+                    <span class="material-icons-round" style="opacity: ${memory.pinned ? 1 : 0.4};">push_pin</span>
+                </button>
+                <button class="icon-btn" data-text="${escapeAttr(text)}" onclick="editMemoryFromBrowser(${Number(memory.id)}, this.dataset.text)"
+                    title="${escapeAttr(t('action.editMemory'))}">
+                    <span class="material-icons-round">edit</span>
+                </button>
+            </div>`;
+    }).join('');
+}
+
+function pageMemoryBrowser(direction) {
+    loadMemoryBrowser(memoryBrowserState.offset + direction * MEMORY_BROWSER_PAGE_SIZE);
+}
+
+async function updateMemoryFromBrowser(id, changes) {
+    try {
+        const response = await fetch(`/api/memories?id=${encodeURIComponent(id)}`, buildSessionFetchOptions({
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(changes)
+        }));
+        if (!response.ok) throw new Error((await response.text()).trim() || `HTTP ${response.status}`);
+        loadMemoryBrowser();
+    } catch (e) {
+        console.error('[Memory Browser] Update failed:', e);
+        alert('Error: ' + e.message);
+    }
+}
+
+function editMemoryFromBrowser(id, text) {
+    const edited = prompt(t('setting.memoryBrowser.editPrompt'), text || '');
+    if (edited === null || !edited.trim() || edited.trim() === String(text || '').trim()) return;
+    updateMemoryFromBrowser(id, { full_text: edited });
+}
+
+async function deleteSelectedMemories() {
+    const ids = Array.from(document.querySelectorAll('.memory-browser-select:checked')).map((input) => Number(input.value));
+    if (ids.length === 0) return;
+    if (!confirm(t('setting.memoryBrowser.confirmDelete').replace('{count}', String(ids.length)))) return;
+    try {
+        const response = await fetch('/api/memories', buildSessionFetchOptions({
+            method: 'DELETE',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ ids })
+        }));
+        if (!response.ok) throw new Error((await response.text()).trim() || `HTTP ${response.status}`);
+        loadMemoryBrowser();
+    } catch (e) {
+        console.error('[Memory Browser] Delete failed:', e);
+        alert('Error: ' + e.message);
+    }
+}
+
+async function loadMemoryBrowserFacts() {
+    const listEl = document.getElementById('memory-browser-facts');
+    if (!listEl) return;
+    try {
+        const response = await fetch('/api/memories/profile-facts', buildSessionFetchOptions());
+        if (!response.ok) throw new Error(`HTTP ${response.status}`);
+        const data = await response.json();
+        const facts = Array.isArray(data.items) ? data.items : [];
+        if (facts.length === 0) {
+            listEl.innerHTML = `<p class="setting-desc">${escapeHtml(t('setting.memoryBrowser.profileEmpty'))}</p>`;
+            return;
+        }
+        listEl.innerHTML = facts.map((fact) => `
+            <div class="user-item">
+                <span style="flex: 1; min-width: 0; word-break: break-word;">
+                    <strong>${escapeHtml(fact.fact_key)}</strong>: ${escapeHtml(fact.fact_value)}
+                    <span class="setting-desc" style="display: block;">${escapeHtml(fact.category)} · ${escapeHtml(formatApiKeyTime(fact.updated_at))}</span>
+                </span>
+                <button class="icon-btn" data-key="${escapeAttr(fact.fact_key)}" data-value="${escapeAttr(fact.fact_value)}" data-category="${escapeAttr(fact.category)}"
+                    onclick="editProfileFactFromBrowser(this.dataset.key, this.dataset.value, this.dataset.category)" title="${escapeAttr(t('action.editMemory'))}">
+                    <span class="material-icons-round">edit</span>
+                </button>
+                <button class="icon-btn" data-key="${escapeAttr(fact.fact_key)}" onclick="deleteProfileFactFromBrowser(${Number(fact.id)}, this.dataset.key)" title="Delete">
+                    <span class="material-icons-round">delete</span>
+                </button>
+            </div>`).join('');
+    } catch (e) {
+        console.error('[Memory Browser] Profile load failed:', e);
+    }
+}
+
+async function editProfileFactFromBrowser(key, value, category) {
+    const edited = prompt(t('setting.memoryBrowser.profilePrompt').replace('{key}', key), value || '');
+    if (edited === null || !edited.trim() || edited.trim() === String(value || '').trim()) return;
+    try {
+        const response = await fetch('/api/memories/profile-facts', buildSessionFetchOptions({
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ key, value: edited, category })
+        }));
+        if (!response.ok) throw new Error((await response.text()).trim() || `HTTP ${response.status}`);
+        loadMemoryBrowserFacts();
+    } catch (e) {
+        console.error('[Memory Browser] Profile update failed:', e);
+        alert('Error: ' + e.message);
+    }
+}
+
+async function deleteProfileFactFromBrowser(id, key) {
+    if (!confirm(t('setting.memoryBrowser.confirmDeleteFact').replace('{key}', key))) return;
+    try {
+        const response = await fetch(`/api/memories/profile-facts?id=${encodeURIComponent(id)}`, buildSessionFetchOptions({ method: 'DELETE' }));
+        if (!response.ok) throw new Error(`HTTP ${response.status}`);
+        loadMemoryBrowserFacts();
+    } catch (e) {
+        console.error('[Memory Browser] Profile delete failed:', e);
+        alert('Error: ' + e.message);
+    }
+}
+
 // Chat State
 // Audio State
 // DOM Elements
@@ -4622,6 +4915,16 @@ function applyCurrentChatSessionEvent(entry) {
             }
             if (AppState.session.replay.currentAssistantId) setToolCardState(AppState.session.replay.currentAssistantId, 'failure', payload.reason || t('tool.unknownError'), null, payload.tool || '');
             break;
+        case 'tool_call.approval_required': {
+            const approvalAssistantId = isLocalActiveTurn
+                ? AppState.chat.activeLocalAssistantId
+                : AppState.session.replay.currentAssistantId;
+            if (approvalAssistantId) renderToolApprovalPrompt(approvalAssistantId, payload);
+            break;
+        }
+        case 'tool_call.approval_resolved':
+            resolveToolApprovalPrompt(payload);
+            break;
         case 'prompt_processing.progress':
             if (isLocalActiveTurn) {
                 renderProgressDock(t('progress.processingPrompt'), (payload.progress || 0) * 100, 'prompt-processing', false);
@@ -7227,6 +7530,70 @@ function getActiveToolCard(elementId) {
     return document.getElementById(msgEl.dataset.activeToolCard);
 }
 
+// Side-effecting tools paused by the "ask" approval policy render an inline
+// prompt; the chat turn resumes once a decision is posted back.
+function renderToolApprovalPrompt(elementId, payload) {
+    const { toolsHost } = getAssistantMessageParts(elementId);
+    if (!toolsHost || !payload || !payload.approval_id) return;
+    if (toolsHost.querySelector(`[data-approval-id="${CSS.escape(payload.approval_id)}"]`)) return;
+
+    const prompt = document.createElement('div');
+    prompt.className = 'tool-approval-prompt';
+    prompt.dataset.approvalId = payload.approval_id;
+    const argsText = payload.arguments ? JSON.stringify(payload.arguments, null, 2) : '{}';
+    prompt.innerHTML = `
+        <div class="tool-approval-title">${escapeHtml(t('tool.approvalRequired').replace('{tool}', formatToolDisplayName(payload.tool || 'Tool')))}</div>
+        <pre class="tool-approval-args">${escapeHtml(argsText)}</pre>
+        <div class="tool-approval-actions">
+            <button type="button" class="tool-approval-btn is-reject" data-decision="reject">${escapeHtml(t('tool.reject'))}</button>
+            <button type="button" class="tool-approval-btn is-approve" data-decision="approve">${escapeHtml(t('tool.approve'))}</button>
+        </div>
+        <div class="tool-approval-status"></div>
+    `;
+    prompt.querySelectorAll('.tool-approval-btn').forEach((button) => {
+        button.addEventListener('click', () => submitToolApprovalDecision(payload.approval_id, button.dataset.decision));
+    });
+    toolsHost.appendChild(prompt);
+    if (payload.expires_at && Date.now() > Number(payload.expires_at)) {
+        resolveToolApprovalPrompt({ approval_id: payload.approval_id, decision: 'expired' });
+    }
+}
+
+function resolveToolApprovalPrompt(payload) {
+    if (!payload || !payload.approval_id) return;
+    const prompt = document.querySelector(`.tool-approval-prompt[data-approval-id="${CSS.escape(payload.approval_id)}"]`);
+    if (!prompt) return;
+    const labels = {
+        approved: 'tool.approvalApproved',
+        rejected: 'tool.approvalRejected',
+        timeout: 'tool.approvalTimeout',
+        cancelled: 'tool.approvalCancelled',
+        expired: 'tool.approvalExpired'
+    };
+    prompt.classList.add('is-resolved', `is-${payload.decision || 'expired'}`);
+    prompt.querySelectorAll('.tool-approval-btn').forEach((button) => { button.disabled = true; });
+    const statusEl = prompt.querySelector('.tool-approval-status');
+    if (statusEl) statusEl.textContent = t(labels[payload.decision] || labels.expired);
+}
+
+async function submitToolApprovalDecision(approvalId, decision) {
+    const prompt = document.querySelector(`.tool-approval-prompt[data-approval-id="${CSS.escape(approvalId)}"]`);
+    if (prompt) prompt.querySelectorAll('.tool-approval-btn').forEach((button) => { button.disabled = true; });
+    try {
+        const response = await fetch('/api/chat-session/tool-approvals', buildSessionFetchOptions({
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ approval_id: approvalId, decision })
+        }));
+        if (!response.ok) {
+            resolveToolApprovalPrompt({ approval_id: approvalId, decision: 'expired' });
+        }
+    } catch (e) {
+        console.warn('Failed to submit tool approval decision:', e);
+        if (prompt) prompt.querySelectorAll('.tool-approval-btn').forEach((button) => { button.disabled = false; });
+    }
+}
+
 function setToolCardState(elementId, state, summary = '', args = null, toolName = '', replaceArguments = false) {
     let card = getActiveToolCard(elementId);
     if (!card && state === 'running') {
@@ -3,30 +3,30 @@
  * Copyright (C) 2026 DINKI'ssTyle. All rights reserved.
  */
 
-const CACHE_NAME = 'dkst-chat-v50';
+const CACHE_NAME = 'dkst-chat-v54';
 const ASSETS = [
     '/',
     '/index.html',
     '/login.html',
     '/web.html',
-    '/web.html?v=33',
+    '/web.html?v=35',
     '/fonts.css?v=2',
     '/style.css?v=14',
     '/icons.css?v=4',
     '/app-utils.js?v=3',
-    '/app-i18n.js?v=9',
+    '/app-i18n.js?v=12',
     '/app-saved-library.js?v=1',
     '/app-models.js?v=1',
     '/supertonic3.js?v=3',
     '/app-tts.js?v=13',
     '/vendor/supertonic3-worker.js',
-    '/app-session.js?v=2',
-    '/app-stream-protocol.js?v=1',
+    '/app-session.js?v=3',
+    '/app-stream-protocol.js?v=2',
     '/app-chat-streaming.js?v=1',
     '/app-chat-ui.js?v=1',
     '/app-progress-ui.js?v=1',
     '/app-mic.js?v=2',
-    '/app.js?v=35',
+    '/app.js?v=38',
     '/icons.css',
     '/public/icon-512.png',
     '/site.webmanifest',
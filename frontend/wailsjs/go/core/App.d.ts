@@ -79,8 +79,18 @@ export function GetSystemPrompts():Promise<Array<promptkit.SystemPrompt>>;
 
 export function GetTTSConfig():Promise<core.ServerTTSConfig>;
 
+export function GetToolSwitches():Promise<Array<mcp.ToolSwitch>>;
+
+export function GetUserAllowedCommands(arg1:string):Promise<Array<string>>;
+
+export function GetUserAllowedDirectories(arg1:string):Promise<Array<string>>;
+
 export function GetUserApiToken(arg1:string):Promise<string>;
 
+export function GetUserCommandJail(arg1:string):Promise<boolean>;
+
+export function GetUserCommandMode(arg1:string):Promise<string>;
+
 export function GetUserDetail(arg1:string):Promise<Record<string, any>>;
 
 export function GetUserDisabledTools(arg1:string):Promise<Array<string>>;
@@ -91,6 +101,10 @@ export function GetUserDisallowedDirectories(arg1:string):Promise<Array<string>>
 
 export function GetUserMemoryRetentionConfig(arg1:string):Promise<mcp.MemoryRetentionConfig>;
 
+export function GetUserRetrievalConfig(arg1:string):Promise<mcp.RetrievalConfig>;
+
+export function GetUserToolApproval(arg1:string):Promise<string>;
+
 export function GetUsers():Promise<Array<Record<string, string>>>;
 
 export function GetVoiceStyles():Promise<Array<string>>;
@@ -157,8 +171,18 @@ export function SetTTSConfig(arg1:string,arg2:number):Promise<void>;
 
 export function SetTTSThreads(arg1:number):Promise<void>;
 
+export function SetToolEnabled(arg1:string,arg2:boolean):Promise<void>;
+
+export function SetUserAllowedCommands(arg1:string,arg2:Array<string>):Promise<void>;
+
+export function SetUserAllowedDirectories(arg1:string,arg2:Array<string>):Promise<void>;
+
 export function SetUserApiToken(arg1:string,arg2:string):Promise<void>;
 
+export function SetUserCommandJail(arg1:string,arg2:boolean):Promise<void>;
+
+export function SetUserCommandMode(arg1:string,arg2:string):Promise<void>;
+
 export function SetUserDisabledTools(arg1:string,arg2:Array<string>):Promise<void>;
 
 export function SetUserDisallowedCommands(arg1:string,arg2:Array<string>):Promise<void>;
@@ -167,6 +191,10 @@ export function SetUserDisallowedDirectories(arg1:string,arg2:Array<string>):Pro
 
 export function SetUserMemoryRetentionConfig(arg1:string,arg2:mcp.MemoryRetentionConfig):Promise<void>;
 
+export function SetUserRetrievalConfig(arg1:string,arg2:mcp.RetrievalConfig):Promise<void>;
+
+export function SetUserToolApproval(arg1:string,arg2:string):Promise<void>;
+
 export function Show():Promise<void>;
 
 export function ShowAbout():Promise<void>;
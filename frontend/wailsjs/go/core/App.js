@@ -150,10 +150,30 @@ export function GetTTSConfig() {
   return window['go']['core']['App']['GetTTSConfig']();
 }
 
+export function GetToolSwitches() {
+  return window['go']['core']['App']['GetToolSwitches']();
+}
+
+export function GetUserAllowedCommands(arg1) {
+  return window['go']['core']['App']['GetUserAllowedCommands'](arg1);
+}
+
+export function GetUserAllowedDirectories(arg1) {
+  return window['go']['core']['App']['GetUserAllowedDirectories'](arg1);
+}
+
 export function GetUserApiToken(arg1) {
   return window['go']['core']['App']['GetUserApiToken'](arg1);
 }
 
+export function GetUserCommandJail(arg1) {
+  return window['go']['core']['App']['GetUserCommandJail'](arg1);
+}
+
+export function GetUserCommandMode(arg1) {
+  return window['go']['core']['App']['GetUserCommandMode'](arg1);
+}
+
 export function GetUserDetail(arg1) {
   return window['go']['core']['App']['GetUserDetail'](arg1);
 }
@@ -174,6 +194,14 @@ export function GetUserMemoryRetentionConfig(arg1) {
   return window['go']['core']['App']['GetUserMemoryRetentionConfig'](arg1);
 }
 
+export function GetUserRetrievalConfig(arg1) {
+  return window['go']['core']['App']['GetUserRetrievalConfig'](arg1);
+}
+
+export function GetUserToolApproval(arg1) {
+  return window['go']['core']['App']['GetUserToolApproval'](arg1);
+}
+
 export function GetUsers() {
   return window['go']['core']['App']['GetUsers']();
 }
@@ -306,10 +334,30 @@ export function SetTTSThreads(arg1) {
   return window['go']['core']['App']['SetTTSThreads'](arg1);
 }
 
+export function SetToolEnabled(arg1,arg2) {
+  return window['go']['core']['App']['SetToolEnabled'](arg1,arg2);
+}
+
+export function SetUserAllowedCommands(arg1,arg2) {
+  return window['go']['core']['App']['SetUserAllowedCommands'](arg1,arg2);
+}
+
+export function SetUserAllowedDirectories(arg1,arg2) {
+  return window['go']['core']['App']['SetUserAllowedDirectories'](arg1,arg2);
+}
+
 export function SetUserApiToken(arg1, arg2) {
   return window['go']['core']['App']['SetUserApiToken'](arg1, arg2);
 }
 
+export function SetUserCommandJail(arg1,arg2) {
+  return window['go']['core']['App']['SetUserCommandJail'](arg1,arg2);
+}
+
+export function SetUserCommandMode(arg1,arg2) {
+  return window['go']['core']['App']['SetUserCommandMode'](arg1,arg2);
+}
+
 export function SetUserDisabledTools(arg1, arg2) {
   return window['go']['core']['App']['SetUserDisabledTools'](arg1, arg2);
 }
@@ -326,6 +374,14 @@ export function SetUserMemoryRetentionConfig(arg1, arg2) {
   return window['go']['core']['App']['SetUserMemoryRetentionConfig'](arg1, arg2);
 }
 
+export function SetUserRetrievalConfig(arg1, arg2) {
+  return window['go']['core']['App']['SetUserRetrievalConfig'](arg1, arg2);
+}
+
+export function SetUserToolApproval(arg1,arg2) {
+  return window['go']['core']['App']['SetUserToolApproval'](arg1,arg2);
+}
+
 export function Show() {
   return window['go']['core']['App']['Show']();
 }
@@ -245,6 +245,56 @@ export namespace mcp {
 	        this.ephemeralDays = source["ephemeralDays"];
 	    }
 	}
+	export class RetrievalConfig {
+	    fusion: string;
+	    rrfK: number;
+	    ftsWeight: number;
+	    vectorWeight: number;
+	    recencyBoost: number;
+	    recencyHalfLifeDays: number;
+	    hitCountBoost: number;
+	    rerankTopN: number;
+	    disableRerank: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new RetrievalConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.fusion = source["fusion"];
+	        this.rrfK = source["rrfK"];
+	        this.ftsWeight = source["ftsWeight"];
+	        this.vectorWeight = source["vectorWeight"];
+	        this.recencyBoost = source["recencyBoost"];
+	        this.recencyHalfLifeDays = source["recencyHalfLifeDays"];
+	        this.hitCountBoost = source["hitCountBoost"];
+	        this.rerankTopN = source["rerankTopN"];
+	        this.disableRerank = source["disableRerank"];
+	    }
+	}
+	export class ToolSwitch {
+	    name: string;
+	    default: boolean;
+	    override?: boolean;
+	    enabled: boolean;
+	    available: boolean;
+	    reason?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ToolSwitch(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.name = source["name"];
+	        this.default = source["default"];
+	        this.override = source["override"];
+	        this.enabled = source["enabled"];
+	        this.available = source["available"];
+	        this.reason = source["reason"];
+	    }
+	}
 
 }
 
@@ -0,0 +1,366 @@
+package chatharness
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/promptkit"
+)
+
+// OpenAI finish_reason values.
+const (
+	FinishReasonStop          = "stop"
+	FinishReasonLength        = "length"
+	FinishReasonToolCalls     = "tool_calls"
+	FinishReasonContentFilter = "content_filter"
+)
+
+// ChatCompletion is the body of a non-streaming /v1/chat/completions answer.
+type ChatCompletion struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   CompletionUsage    `json:"usage"`
+}
+
+type CompletionChoice struct {
+	Index        int               `json:"index"`
+	Message      CompletionMessage `json:"message"`
+	Logprobs     *struct{}         `json:"logprobs"`
+	FinishReason string            `json:"finish_reason"`
+}
+
+// CompletionMessage keeps content and refusal as explicit nulls, as OpenAI
+// does for an answer made only of tool calls.
+type CompletionMessage struct {
+	Role      string               `json:"role"`
+	Content   *string              `json:"content"`
+	Refusal   *string              `json:"refusal"`
+	ToolCalls []CompletionToolCall `json:"tool_calls,omitempty"`
+}
+
+// ChatCompletionChunk is one streamed chat.completion.chunk event.
+type ChatCompletionChunk struct {
+	ID      string                  `json:"id"`
+	Object  string                  `json:"object"`
+	Created int64                   `json:"created"`
+	Model   string                  `json:"model"`
+	Choices []CompletionChunkChoice `json:"choices"`
+	Usage   *CompletionUsage        `json:"usage,omitempty"`
+}
+
+type CompletionChunkChoice struct {
+	Index        int             `json:"index"`
+	Delta        CompletionDelta `json:"delta"`
+	Logprobs     *struct{}       `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+type CompletionDelta struct {
+	Role      string               `json:"role,omitempty"`
+	Content   *string              `json:"content,omitempty"`
+	ToolCalls []CompletionToolCall `json:"tool_calls,omitempty"`
+}
+
+// CompletionToolCall is a function call; Index is set only in chunks.
+type CompletionToolCall struct {
+	Index    *int                   `json:"index,omitempty"`
+	ID       string                 `json:"id"`
+	Type     string                 `json:"type"`
+	Function CompletionFunctionCall `json:"function"`
+}
+
+type CompletionFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type CompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// CompletionError is the OpenAI error body.
+type CompletionError struct {
+	Error CompletionErrorDetail `json:"error"`
+}
+
+type CompletionErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// CompletionFinishReason maps an upstream stop reason (Chat Completions
+// finish_reason, Anthropic stop_reason, Ollama done_reason or a Responses
+// status) to the OpenAI value.
+func CompletionFinishReason(upstream string, hasToolCalls bool) string {
+	if hasToolCalls {
+		return FinishReasonToolCalls
+	}
+	switch strings.TrimSpace(strings.ToLower(upstream)) {
+	case "length", "max_tokens", "max_output_tokens", "incomplete":
+		return FinishReasonLength
+	case "content_filter", "refusal":
+		return FinishReasonContentFilter
+	default:
+		return FinishReasonStop
+	}
+}
+
+type CompletionRequestInput struct {
+	Body        []byte
+	EndpointRaw string
+	TokenRaw    string
+	LLMMode     string
+	// GatewayTools are app tools offered next to the client's own tools.
+	GatewayTools []promptkit.ToolDefinition
+}
+
+// CompletionRequest is a validated /v1/chat/completions request ready for
+// the upstream, which is always asked to stream.
+type CompletionRequest struct {
+	PreparedRequest
+	// LLMMode is the mode used upstream: LM Studio's stateful API takes no
+	// message history, so it is served by its Chat Completions endpoint.
+	LLMMode        string
+	Stream         bool
+	IncludeUsage   bool
+	ResponseFormat *ResponseFormat
+	// GatewayToolNames are the app tools added to the request; calls to any
+	// other tool go back to the client.
+	GatewayToolNames map[string]bool
+}
+
+// PrepareCompletionRequest checks an OpenAI Chat Completions request and
+// translates it for the upstream. Unlike PrepareRequest it keeps the
+// client's tools and adds no app instructions. Errors describe an invalid
+// request.
+func PrepareCompletionRequest(input CompletionRequestInput) (CompletionRequest, error) {
+	request := CompletionRequest{LLMMode: strings.TrimSpace(strings.ToLower(input.LLMMode))}
+	if request.LLMMode == "stateful" || request.LLMMode == "" {
+		request.LLMMode = "standard"
+	}
+	request.Endpoint = sanitizeEndpoint(input.EndpointRaw)
+	request.Token = sanitizeToken(input.TokenRaw)
+	request.UpstreamURL = buildUpstreamURL(request.Endpoint, request.LLMMode)
+
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(input.Body, &reqMap); err != nil || reqMap == nil {
+		return request, errors.New("request body must be a JSON object")
+	}
+	request.ModelID = extractModelID(reqMap)
+	if request.ModelID == "" {
+		return request, errors.New("model is required")
+	}
+	if messages, _ := reqMap["messages"].([]interface{}); len(messages) == 0 {
+		return request, errors.New("messages must be a non-empty array")
+	}
+	if n, ok := reqMap["n"].(float64); ok && n != 1 {
+		return request, errors.New("only n=1 is supported")
+	}
+	request.Stream, _ = reqMap["stream"].(bool)
+	if options, ok := reqMap["stream_options"].(map[string]interface{}); ok && request.Stream {
+		request.IncludeUsage, _ = options["include_usage"].(bool)
+	}
+	format, err := ParseResponseFormat(reqMap)
+	if err != nil {
+		return request, err
+	}
+	request.ResponseFormat = format
+	request.InitialUserInputText = extractChatInputText(reqMap)
+
+	removeLegacyMCPIntegration(reqMap)
+	if format != nil {
+		format.Apply(reqMap, request.LLMMode)
+	} else if len(input.GatewayTools) > 0 {
+		request.GatewayToolNames = AddGatewayTools(reqMap, input.GatewayTools)
+	}
+	reqMap["stream"] = true
+	delete(reqMap, "stream_options")
+	if request.LLMMode == "standard" {
+		// Usage arrives in a last chunk only when asked for.
+		reqMap["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+
+	request.Body, err = json.Marshal(reqMap)
+	if err != nil {
+		return request, fmt.Errorf("marshal request: %w", err)
+	}
+	request.ReqMap = reqMap
+	return request, nil
+}
+
+// CompletionWriter answers one /v1/chat/completions request: streamed
+// chat.completion.chunk events ending in [DONE], or a single
+// chat.completion body when the client did not ask to stream.
+type CompletionWriter struct {
+	ID      string
+	Model   string
+	Created int64
+	// Hold collects content instead of streaming it, so an answer can be
+	// checked and replaced before the client sees it.
+	Hold bool
+
+	w            http.ResponseWriter
+	stream       bool
+	includeUsage bool
+	started      bool
+	content      strings.Builder
+}
+
+func NewCompletionWriter(w http.ResponseWriter, model string, stream, includeUsage bool) *CompletionWriter {
+	return &CompletionWriter{
+		ID:           newCompletionID(),
+		Model:        model,
+		Created:      time.Now().Unix(),
+		w:            w,
+		stream:       stream,
+		includeUsage: includeUsage,
+	}
+}
+
+func newCompletionID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	}
+	return "chatcmpl-" + hex.EncodeToString(buf)
+}
+
+// Content is the answer written so far.
+func (c *CompletionWriter) Content() string {
+	return c.content.String()
+}
+
+// SetContent replaces a held answer, for example with its repaired or
+// extracted JSON document.
+func (c *CompletionWriter) SetContent(content string) {
+	c.content.Reset()
+	c.content.WriteString(content)
+}
+
+// WriteContent adds answer text, streaming it unless the answer is held.
+func (c *CompletionWriter) WriteContent(delta string) {
+	if delta == "" {
+		return
+	}
+	c.content.WriteString(delta)
+	if c.stream && !c.Hold {
+		c.writeChunk(CompletionDelta{Content: &delta}, nil, nil)
+	}
+}
+
+// Finish ends the answer with the client's tool calls, the OpenAI
+// finish_reason and the token usage.
+func (c *CompletionWriter) Finish(toolCalls []ProviderToolCall, finishReason string, usage CompletionUsage) {
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	calls := make([]CompletionToolCall, 0, len(toolCalls))
+	for i, call := range toolCalls {
+		arguments := strings.TrimSpace(call.Arguments)
+		if arguments == "" {
+			arguments = "{}"
+		}
+		calls = append(calls, CompletionToolCall{
+			ID:       call.ID,
+			Type:     "function",
+			Function: CompletionFunctionCall{Name: call.Name, Arguments: arguments},
+		})
+		if c.stream {
+			index := i
+			calls[i].Index = &index
+		}
+	}
+
+	if !c.stream {
+		message := CompletionMessage{Role: "assistant", ToolCalls: calls}
+		if content := c.content.String(); content != "" || len(calls) == 0 {
+			message.Content = &content
+		}
+		c.writeJSON(http.StatusOK, ChatCompletion{
+			ID:      c.ID,
+			Object:  "chat.completion",
+			Created: c.Created,
+			Model:   c.Model,
+			Choices: []CompletionChoice{{Message: message, FinishReason: finishReason}},
+			Usage:   usage,
+		})
+		return
+	}
+
+	if content := c.content.String(); c.Hold && content != "" {
+		c.writeChunk(CompletionDelta{Content: &content}, nil, nil)
+	}
+	if len(calls) > 0 {
+		c.writeChunk(CompletionDelta{ToolCalls: calls}, nil, nil)
+	}
+	c.writeChunk(CompletionDelta{}, &finishReason, nil)
+	if c.includeUsage {
+		c.writeChunk(CompletionDelta{}, nil, &usage)
+	}
+	c.writeLine("data: [DONE]")
+}
+
+// Fail reports an error: as an HTTP error before anything was written, or
+// as an error event once the stream has started.
+func (c *CompletionWriter) Fail(status int, errorType, message string) {
+	body := CompletionError{Error: CompletionErrorDetail{Message: message, Type: errorType}}
+	if !c.started {
+		c.writeJSON(status, body)
+		return
+	}
+	if data, err := json.Marshal(body); err == nil {
+		c.writeLine("data: " + string(data))
+	}
+}
+
+// writeChunk sends one chunk, preceded by the role chunk that opens every
+// OpenAI stream. A usage chunk has no choices.
+func (c *CompletionWriter) writeChunk(delta CompletionDelta, finishReason *string, usage *CompletionUsage) {
+	if !c.started {
+		c.started = true
+		c.w.Header().Set("Content-Type", "text/event-stream")
+		c.w.Header().Set("Cache-Control", "no-cache")
+		c.w.Header().Set("Connection", "keep-alive")
+		empty := ""
+		c.writeChunk(CompletionDelta{Role: "assistant", Content: &empty}, nil, nil)
+	}
+	chunk := ChatCompletionChunk{
+		ID:      c.ID,
+		Object:  "chat.completion.chunk",
+		Created: c.Created,
+		Model:   c.Model,
+		Choices: []CompletionChunkChoice{{Delta: delta, FinishReason: finishReason}},
+		Usage:   usage,
+	}
+	if usage != nil {
+		chunk.Choices = []CompletionChunkChoice{}
+	}
+	if data, err := json.Marshal(chunk); err == nil {
+		c.writeLine("data: " + string(data))
+	}
+}
+
+func (c *CompletionWriter) writeLine(line string) {
+	fmt.Fprintf(c.w, "%s\n\n", line)
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *CompletionWriter) writeJSON(status int, body interface{}) {
+	c.started = true
+	c.w.Header().Set("Content-Type", "application/json")
+	c.w.WriteHeader(status)
+	json.NewEncoder(c.w).Encode(body)
+}
@@ -0,0 +1,189 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dinkisstyle-chat/internal/promptkit"
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+func loadCompletionSchema(t *testing.T, name string) *toolruntime.Schema {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", "completion", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := toolruntime.CompileSchema(raw)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return schema
+}
+
+// TestCompletionWriterGolden pins the wire format against golden files and
+// checks every body and chunk against the OpenAI response schemas.
+func TestCompletionWriterGolden(t *testing.T) {
+	completionSchema := loadCompletionSchema(t, "chat.completion.schema.json")
+	chunkSchema := loadCompletionSchema(t, "chat.completion.chunk.schema.json")
+	toolCalls := []ProviderToolCall{
+		{ID: "call_1", Name: "lookup_order", Arguments: `{"order_id":"A-17"}`},
+		{ID: "call_2", Name: "get_weather", Arguments: ""},
+	}
+	usage := CompletionUsage{PromptTokens: 21, CompletionTokens: 5}
+	tests := []struct {
+		golden       string
+		stream       bool
+		includeUsage bool
+		hold         bool
+		deltas       []string
+		toolCalls    []ProviderToolCall
+		finish       string
+	}{
+		{golden: "completion_text.golden", deltas: []string{"Hel", "lo"}, finish: FinishReasonStop},
+		{golden: "completion_tool_calls.golden", toolCalls: toolCalls, finish: FinishReasonToolCalls},
+		{golden: "stream_text.golden", stream: true, includeUsage: true, deltas: []string{"Hel", "lo"}, finish: FinishReasonLength},
+		{golden: "stream_tool_calls.golden", stream: true, deltas: []string{"Checking."}, toolCalls: toolCalls, finish: FinishReasonToolCalls},
+		{golden: "stream_held.golden", stream: true, hold: true, deltas: []string{`{"a"`, `:1}`}, finish: FinishReasonStop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			writer := NewCompletionWriter(recorder, "local-model", tt.stream, tt.includeUsage)
+			writer.ID, writer.Created, writer.Hold = "chatcmpl-test", 1760000000, tt.hold
+			for _, delta := range tt.deltas {
+				writer.WriteContent(delta)
+			}
+			writer.Finish(tt.toolCalls, tt.finish, usage)
+
+			got := recorder.Body.String()
+			want, err := os.ReadFile(filepath.Join("testdata", "completion", tt.golden))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Fatalf("output differs from %s:\n%s", tt.golden, got)
+			}
+
+			if !tt.stream {
+				if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+					t.Fatalf("Content-Type = %q", contentType)
+				}
+				if err := completionSchema.Validate(json.RawMessage(got)); err != nil {
+					t.Fatalf("chat.completion does not match the schema: %v", err)
+				}
+				return
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "text/event-stream" {
+				t.Fatalf("Content-Type = %q", contentType)
+			}
+			events := strings.Split(strings.TrimSuffix(got, "\n\n"), "\n\n")
+			if events[len(events)-1] != "data: [DONE]" {
+				t.Fatalf("stream does not end with [DONE]: %q", events[len(events)-1])
+			}
+			for _, event := range events[:len(events)-1] {
+				data, ok := strings.CutPrefix(event, "data: ")
+				if !ok {
+					t.Fatalf("event %q is not a data line", event)
+				}
+				if err := chunkSchema.Validate(json.RawMessage(data)); err != nil {
+					t.Fatalf("chunk %s does not match the schema: %v", data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompletionWriterFail(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	NewCompletionWriter(recorder, "m", true, false).Fail(http.StatusBadRequest, "invalid_request_error", "model is required")
+	if recorder.Code != http.StatusBadRequest || recorder.Body.String() != `{"error":{"message":"model is required","type":"invalid_request_error","param":null,"code":null}}`+"\n" {
+		t.Fatalf("error before streaming = %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	writer := NewCompletionWriter(recorder, "m", true, false)
+	writer.WriteContent("partial")
+	writer.Fail(http.StatusBadGateway, "api_error", "upstream closed")
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK || !strings.HasSuffix(body, "data: {\"error\":{\"message\":\"upstream closed\",\"type\":\"api_error\",\"param\":null,\"code\":null}}\n\n") {
+		t.Fatalf("error after streaming = %d %s", recorder.Code, body)
+	}
+}
+
+func TestCompletionFinishReason(t *testing.T) {
+	for _, tt := range []struct {
+		upstream  string
+		toolCalls bool
+		want      string
+	}{
+		{"stop", false, FinishReasonStop},
+		{"", false, FinishReasonStop},
+		{"end_turn", false, FinishReasonStop},
+		{"completed", false, FinishReasonStop},
+		{"length", false, FinishReasonLength},
+		{"max_tokens", false, FinishReasonLength},
+		{"max_output_tokens", false, FinishReasonLength},
+		{"content_filter", false, FinishReasonContentFilter},
+		{"tool_use", true, FinishReasonToolCalls},
+		{"stop", true, FinishReasonToolCalls},
+	} {
+		if got := CompletionFinishReason(tt.upstream, tt.toolCalls); got != tt.want {
+			t.Errorf("CompletionFinishReason(%q, %v) = %q, want %q", tt.upstream, tt.toolCalls, got, tt.want)
+		}
+	}
+}
+
+func TestPrepareCompletionRequest(t *testing.T) {
+	body := `{"model":"m","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"where is my order?"}],"tools":[{"type":"function","function":{"name":"lookup_order","parameters":{"type":"object"}}},{"type":"function","function":{"name":"get_current_time","parameters":{"type":"object"}}}]}`
+	gatewayTools := []promptkit.ToolDefinition{
+		{Name: "get_current_time", InputSchema: json.RawMessage(`{"type":"object"}`)},
+		{Name: "search_web", InputSchema: json.RawMessage(`{"type":"object","properties":{"query":{"type":"string"}}}`)},
+	}
+	request, err := PrepareCompletionRequest(CompletionRequestInput{
+		Body:         []byte(body),
+		EndpointRaw:  "http://127.0.0.1:1234/v1",
+		TokenRaw:     "Bearer secret",
+		LLMMode:      "stateful",
+		GatewayTools: gatewayTools,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.LLMMode != "standard" || request.UpstreamURL != "http://127.0.0.1:1234/v1/chat/completions" || request.Token != "secret" {
+		t.Fatalf("stateful mode must use the Chat Completions endpoint: %+v", request)
+	}
+	if !request.Stream || !request.IncludeUsage || request.ModelID != "m" {
+		t.Fatalf("request options = %+v", request)
+	}
+	if len(request.GatewayToolNames) != 1 || !request.GatewayToolNames["search_web"] {
+		t.Fatalf("gateway tools = %v; client tools must keep their names", request.GatewayToolNames)
+	}
+	var tools []string
+	for _, tool := range request.ReqMap["tools"].([]interface{}) {
+		tools = append(tools, tool.(map[string]interface{})["function"].(map[string]interface{})["name"].(string))
+	}
+	if strings.Join(tools, ",") != "lookup_order,get_current_time,search_web" {
+		t.Fatalf("upstream tools = %v", tools)
+	}
+	if options, _ := request.ReqMap["stream_options"].(map[string]interface{}); options["include_usage"] != true {
+		t.Fatalf("upstream must report usage: %v", request.ReqMap["stream_options"])
+	}
+
+	for _, invalid := range []string{
+		`[]`,
+		`{"messages":[{"role":"user","content":"hi"}]}`,
+		`{"model":"m","messages":[]}`,
+		`{"model":"m","n":2,"messages":[{"role":"user","content":"hi"}]}`,
+		`{"model":"m","messages":[{"role":"user","content":"hi"}],"response_format":{"type":"yaml"}}`,
+	} {
+		if _, err := PrepareCompletionRequest(CompletionRequestInput{Body: []byte(invalid), LLMMode: "standard"}); err == nil {
+			t.Errorf("PrepareCompletionRequest(%s) must fail", invalid)
+		}
+	}
+}
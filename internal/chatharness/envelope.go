@@ -0,0 +1,201 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EventSchemaVersion is the version of EventEnvelope sent to clients. Bump it
+// when the envelope fields change meaning.
+const EventSchemaVersion = 1
+
+// Envelope types for payloads that carry no "type" of their own.
+const (
+	EventTypeCompletionChunk = "completion.chunk"
+	EventTypeStreamDone      = "stream.done"
+	EventTypeError           = "error"
+)
+
+// EventEnvelope wraps every SSE event sent by /api/chat and the chat session
+// event stream. Seq increases by one per event of a /api/chat response; on
+// the session stream it is chat_events.event_seq.
+type EventEnvelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	RequestID     string          `json:"request_id,omitempty"`
+	TurnID        string          `json:"turn_id,omitempty"`
+	Seq           int64           `json:"seq"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// NewEnvelope encodes payload into an envelope of eventType.
+func NewEnvelope(eventType string, payload interface{}) (EventEnvelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return EventEnvelope{}, err
+	}
+	return EventEnvelope{SchemaVersion: EventSchemaVersion, Type: eventType, Payload: data}, nil
+}
+
+// WriteEnvelope writes env as one SSE event. An empty id leaves the client's
+// last event ID unchanged, so only resumable events should set it.
+func WriteEnvelope(w io.Writer, eventName, id string, env EventEnvelope) error {
+	if env.SchemaVersion == 0 {
+		env.SchemaVersion = EventSchemaVersion
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	var block strings.Builder
+	if id = strings.TrimSpace(id); id != "" {
+		block.WriteString("id: " + id + "\n")
+	}
+	if eventName = strings.TrimSpace(eventName); eventName != "" {
+		block.WriteString("event: " + eventName + "\n")
+	}
+	block.WriteString("data: " + string(data) + "\n\n")
+	_, err = io.WriteString(w, block.String())
+	return err
+}
+
+// EnvelopePayload turns the data of a raw SSE event into an envelope type and
+// payload: JSON objects keep their own "type" (Chat Completions chunks become
+// completion.chunk), [DONE] becomes stream.done, and plain text becomes an
+// error message when the event is named error.
+func EnvelopePayload(eventName, data string) (string, json.RawMessage) {
+	data = strings.TrimSpace(data)
+	if data == "[DONE]" {
+		return EventTypeStreamDone, json.RawMessage(`{}`)
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &object); err == nil && object != nil {
+		var eventType string
+		if rawType, ok := object["type"]; ok {
+			_ = json.Unmarshal(rawType, &eventType)
+		}
+		if eventType == "" {
+			if _, ok := object["choices"]; ok {
+				eventType = EventTypeCompletionChunk
+			} else if eventName != "" {
+				eventType = eventName
+			} else if _, ok := object["error"]; ok {
+				eventType = EventTypeError
+			}
+		}
+		return eventType, json.RawMessage(data)
+	}
+	text, _ := json.Marshal(data)
+	if eventName == EventTypeError {
+		return EventTypeError, json.RawMessage(`{"message":` + string(text) + `}`)
+	}
+	return eventName, text
+}
+
+// EventSequencer numbers the events of one /api/chat response and enforces
+// the terminal-event and tool-call guards. It is safe for concurrent use.
+type EventSequencer struct {
+	RequestID string
+	TurnID    string
+
+	mu         sync.Mutex
+	seq        int64
+	roundEnded bool
+	completed  bool
+	toolCalls  map[string]bool
+}
+
+func NewEventSequencer(requestID, turnID string) *EventSequencer {
+	return &EventSequencer{
+		RequestID: strings.TrimSpace(requestID),
+		TurnID:    strings.TrimSpace(turnID),
+		toolCalls: make(map[string]bool),
+	}
+}
+
+// BeginRound starts a new upstream round, which may end with its own
+// chat.end.
+func (s *EventSequencer) BeginRound() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.roundEnded = false
+	s.mu.Unlock()
+}
+
+// Next assigns the next sequence number to an event. It reports false for a
+// duplicate terminal event: a second chat.end in the same round, or anything
+// terminal after request.complete. Dropped events do not consume a number.
+func (s *EventSequencer) Next(eventType string, payload json.RawMessage) (EventEnvelope, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch eventType {
+	case "chat.end":
+		if s.roundEnded || s.completed {
+			return EventEnvelope{}, false
+		}
+		s.roundEnded = true
+	case "request.complete":
+		if s.completed {
+			return EventEnvelope{}, false
+		}
+		s.completed = true
+	}
+	s.seq++
+	return EventEnvelope{
+		SchemaVersion: EventSchemaVersion,
+		RequestID:     s.RequestID,
+		TurnID:        s.TurnID,
+		Seq:           s.seq,
+		Type:          eventType,
+		Payload:       payload,
+	}, true
+}
+
+// ClaimToolCall reports whether a call may run. A provider that replays the
+// same call ID with the same name and arguments within one request gets
+// false for the repeat. The name and arguments are part of the key because
+// some adapters number calls per round (call_0, call_1, ...). Calls without
+// an ID cannot be told apart and are always allowed.
+func (s *EventSequencer) ClaimToolCall(callID, name, arguments string) bool {
+	callID = strings.TrimSpace(callID)
+	if s == nil || callID == "" {
+		return true
+	}
+	key := callID + "\x00" + strings.TrimSpace(name) + "\x00" + strings.TrimSpace(arguments)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.toolCalls[key] {
+		return false
+	}
+	s.toolCalls[key] = true
+	return true
+}
+
+// FormatSessionEventID is the SSE id of a persisted chat event. It carries
+// the session so a resume never applies one session's sequence to another.
+func FormatSessionEventID(sessionID int64, eventSeq int) string {
+	return fmt.Sprintf("%d-%d", sessionID, eventSeq)
+}
+
+// ParseSessionEventID reads a Last-Event-ID written by FormatSessionEventID.
+func ParseSessionEventID(id string) (int64, int, bool) {
+	sessionPart, seqPart, found := strings.Cut(strings.TrimSpace(id), "-")
+	if !found {
+		return 0, 0, false
+	}
+	sessionID, err := strconv.ParseInt(sessionPart, 10, 64)
+	if err != nil || sessionID <= 0 {
+		return 0, 0, false
+	}
+	eventSeq, err := strconv.Atoi(seqPart)
+	if err != nil || eventSeq < 0 {
+		return 0, 0, false
+	}
+	return sessionID, eventSeq, true
+}
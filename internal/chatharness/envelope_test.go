@@ -0,0 +1,139 @@
+package chatharness
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnvelopePayload(t *testing.T) {
+	tests := []struct {
+		eventName string
+		data      string
+		wantType  string
+		wantData  string
+	}{
+		{"", `{"type":"message.delta","content":"hi"}`, "message.delta", `{"type":"message.delta","content":"hi"}`},
+		{"", `{"choices":[{"delta":{"content":"hi"}}]}`, EventTypeCompletionChunk, `{"choices":[{"delta":{"content":"hi"}}]}`},
+		{"", "[DONE]", EventTypeStreamDone, `{}`},
+		{"error", "upstream failed", EventTypeError, `{"message":"upstream failed"}`},
+		{"", `{"error":{"message":"boom"}}`, EventTypeError, `{"error":{"message":"boom"}}`},
+		{"progress", `{"step":1}`, "progress", `{"step":1}`},
+	}
+	for _, tt := range tests {
+		gotType, gotData := EnvelopePayload(tt.eventName, tt.data)
+		if gotType != tt.wantType || string(gotData) != tt.wantData {
+			t.Errorf("EnvelopePayload(%q, %q) = %q, %s; want %q, %s", tt.eventName, tt.data, gotType, gotData, tt.wantType, tt.wantData)
+		}
+	}
+}
+
+func TestEventSequencerGuards(t *testing.T) {
+	events := NewEventSequencer("req-1", "turn-1")
+	next := func(eventType string) (int64, bool) {
+		env, ok := events.Next(eventType, json.RawMessage(`{}`))
+		return env.Seq, ok
+	}
+
+	events.BeginRound()
+	if seq, ok := next("message.delta"); !ok || seq != 1 {
+		t.Fatalf("first event = %d, %v", seq, ok)
+	}
+	if seq, ok := next("chat.end"); !ok || seq != 2 {
+		t.Fatalf("chat.end = %d, %v", seq, ok)
+	}
+	if _, ok := next("chat.end"); ok {
+		t.Fatal("duplicate chat.end in one round must be dropped")
+	}
+	events.BeginRound()
+	if seq, ok := next("chat.end"); !ok || seq != 3 {
+		t.Fatalf("chat.end of a new round = %d, %v", seq, ok)
+	}
+	if _, ok := next("request.complete"); !ok {
+		t.Fatal("request.complete must be sent once")
+	}
+	events.BeginRound()
+	for _, eventType := range []string{"request.complete", "chat.end"} {
+		if _, ok := next(eventType); ok {
+			t.Fatalf("%s after request.complete must be dropped", eventType)
+		}
+	}
+	if seq, ok := next("generation.finished"); !ok || seq != 5 {
+		t.Fatalf("non-terminal event after completion = %d, %v", seq, ok)
+	}
+}
+
+func TestEventSequencerClaimsToolCallsOnce(t *testing.T) {
+	events := NewEventSequencer("req-1", "")
+	if !events.ClaimToolCall("call_0", "get_time", `{}`) {
+		t.Fatal("first call must run")
+	}
+	if events.ClaimToolCall("call_0", "get_time", `{}`) {
+		t.Fatal("replayed call ID must not run again")
+	}
+	if !events.ClaimToolCall("call_0", "search_web", `{"query":"go"}`) {
+		t.Fatal("per-round call numbering must not block a different call")
+	}
+	if !events.ClaimToolCall("", "get_time", `{}`) || !events.ClaimToolCall("", "get_time", `{}`) {
+		t.Fatal("calls without ID must always run")
+	}
+}
+
+func TestSSEEmitterWrapsEvents(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	emitter, err := NewSSEEmitter(recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emitter.Sequence(NewEventSequencer("req-1", "turn-1"))
+	emitter.EmitRaw(`data: {"type":"chat.end","result":{}}`)
+	emitter.EmitRaw(`data: {"type":"chat.end","result":{}}`)
+	emitter.EmitRaw(": keep-alive")
+	emitter.SendError("boom")
+
+	reader := bufio.NewReader(strings.NewReader(recorder.Body.String()))
+	var envelopes []EventEnvelope
+	var names []string
+	for {
+		block, err := ReadSSEBlock(reader)
+		if err != nil {
+			break
+		}
+		if block.Data == "" {
+			names = append(names, block.Raw)
+			continue
+		}
+		var env EventEnvelope
+		if err := json.Unmarshal([]byte(block.Data), &env); err != nil {
+			t.Fatalf("event is not an envelope: %q", block.Data)
+		}
+		if !strings.HasPrefix(block.Raw, "id: ") {
+			t.Fatalf("event without id: %q", block.Raw)
+		}
+		envelopes = append(envelopes, env)
+		names = append(names, block.EventName+"/"+env.Type)
+	}
+	want := []string{"/chat.end", ": keep-alive", "/completion.chunk", "error/error"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", names, want)
+	}
+	for i, env := range envelopes {
+		if env.SchemaVersion != EventSchemaVersion || env.RequestID != "req-1" || env.TurnID != "turn-1" || env.Seq != int64(i+1) {
+			t.Fatalf("envelope %d = %+v", i, env)
+		}
+	}
+}
+
+func TestSessionEventIDRoundTrip(t *testing.T) {
+	sessionID, seq, ok := ParseSessionEventID(FormatSessionEventID(42, 7))
+	if !ok || sessionID != 42 || seq != 7 {
+		t.Fatalf("round trip = %d, %d, %v", sessionID, seq, ok)
+	}
+	for _, id := range []string{"", "7", "x-1", "0-3", "4-x"} {
+		if _, _, ok := ParseSessionEventID(id); ok {
+			t.Fatalf("ParseSessionEventID(%q) must fail", id)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package chatharness
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	LLMModeOllama    = "ollama"
+	LLMModeAnthropic = "anthropic"
+	LLMModeResponses = "responses"
+)
+
+// ProviderAdapter speaks one provider wire format. The orchestration loop keeps
+// its working request in OpenAI Chat Completions shape across tool rounds;
+// the adapter encodes that request on dispatch and decodes the provider
+// stream into the same message.delta / reasoning.* / tool_call.* / chat.end
+// events the LM Studio stateful path produces.
+type ProviderAdapter interface {
+	Mode() string
+	// Path is appended to the sanitized endpoint (without /v1).
+	Path() string
+	SetHeaders(header http.Header, token string)
+	EncodeRequest(body []byte) ([]byte, error)
+	NewDecoder(stream io.Reader) ProviderEventDecoder
+}
+
+// ProviderEventDecoder returns the events decoded from the next unit of the
+// provider stream (one NDJSON line or one SSE block). It returns io.EOF once
+// the stream is exhausted.
+type ProviderEventDecoder interface {
+	Next() ([]ProviderEvent, error)
+}
+
+// ProviderEvent is one normalized stream event. Payload renders it in the
+// event contract shared with LM Studio's /api/v1/chat.
+type ProviderEvent struct {
+	Type         string
+	Content      string
+	CallID       string
+	Tool         string
+	Arguments    string
+	StopReason   string
+	ResponseID   string
+	InputTokens  int
+	OutputTokens int
+}
+
+func (e ProviderEvent) Payload() map[string]interface{} {
+	payload := map[string]interface{}{"type": e.Type}
+	switch e.Type {
+	case "message.delta", "reasoning.delta":
+		payload["content"] = e.Content
+	case "tool_call.start":
+		payload["tool"] = e.Tool
+		payload["call_id"] = e.CallID
+	case "tool_call.arguments":
+		payload["tool"] = e.Tool
+		payload["call_id"] = e.CallID
+		var arguments interface{} = map[string]interface{}{}
+		if strings.TrimSpace(e.Arguments) != "" {
+			if err := json.Unmarshal([]byte(e.Arguments), &arguments); err != nil {
+				arguments = e.Arguments
+			}
+		}
+		payload["arguments"] = arguments
+	case "chat.end":
+		result := map[string]interface{}{
+			"stats": map[string]interface{}{
+				"input_tokens":        e.InputTokens,
+				"total_output_tokens": e.OutputTokens,
+			},
+		}
+		if e.StopReason != "" {
+			result["stop_reason"] = e.StopReason
+		}
+		if e.ResponseID != "" {
+			result["response_id"] = e.ResponseID
+		}
+		payload["result"] = result
+	case "error":
+		payload["error"] = map[string]interface{}{"message": e.Content}
+	}
+	return payload
+}
+
+// AdapterFor returns the adapter of a native provider mode, or nil for the
+// built-in "standard" and "stateful" paths.
+func AdapterFor(llmMode string) ProviderAdapter {
+	switch strings.TrimSpace(strings.ToLower(llmMode)) {
+	case LLMModeOllama:
+		return ollamaAdapter{}
+	case LLMModeAnthropic:
+		return anthropicAdapter{}
+	case LLMModeResponses:
+		return responsesAdapter{}
+	default:
+		return nil
+	}
+}
+
+// NormalizedStream re-encodes decoded provider events as SSE data blocks so
+// the chat loop reads every provider through the same SSE block reader.
+func NormalizedStream(adapter ProviderAdapter, stream io.Reader) io.Reader {
+	return &normalizedStream{decoder: adapter.NewDecoder(stream)}
+}
+
+type normalizedStream struct {
+	decoder ProviderEventDecoder
+	pending bytes.Buffer
+	err     error
+}
+
+func (s *normalizedStream) Read(p []byte) (int, error) {
+	for s.pending.Len() == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		events, err := s.decoder.Next()
+		for _, event := range events {
+			data, marshalErr := json.Marshal(event.Payload())
+			if marshalErr != nil {
+				continue
+			}
+			s.pending.WriteString("data: ")
+			s.pending.Write(data)
+			s.pending.WriteString("\n\n")
+		}
+		if err != nil {
+			s.err = err
+		}
+	}
+	return s.pending.Read(p)
+}
+
+// reasoningState tracks whether a reasoning segment is open so providers that
+// only stream thinking deltas still produce start/end pairs.
+type reasoningState struct {
+	open bool
+}
+
+func (r *reasoningState) delta(text string) []ProviderEvent {
+	if text == "" {
+		return nil
+	}
+	var events []ProviderEvent
+	if !r.open {
+		r.open = true
+		events = append(events, ProviderEvent{Type: "reasoning.start"})
+	}
+	return append(events, ProviderEvent{Type: "reasoning.delta", Content: text})
+}
+
+func (r *reasoningState) close() []ProviderEvent {
+	if !r.open {
+		return nil
+	}
+	r.open = false
+	return []ProviderEvent{{Type: "reasoning.end"}}
+}
+
+// chatMessage is the subset of an OpenAI Chat Completions message that the
+// gateway produces: text or multi-part content, assistant tool_calls, and
+// role "tool" results.
+type chatMessage struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content"`
+	ToolCalls  []chatToolCall  `json:"tool_calls"`
+	ToolCallID string          `json:"tool_call_id"`
+}
+
+type chatToolCall struct {
+	ID       string `json:"id"`
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// arguments decodes the call arguments, which OpenAI sends as a JSON string.
+func (c chatToolCall) arguments() map[string]interface{} {
+	raw := c.Function.Arguments
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err == nil {
+		raw = json.RawMessage(encoded)
+	}
+	arguments := map[string]interface{}{}
+	if len(bytes.TrimSpace(raw)) > 0 {
+		_ = json.Unmarshal(raw, &arguments)
+	}
+	return arguments
+}
+
+// argumentsJSON returns the call arguments as a JSON object string.
+func (c chatToolCall) argumentsJSON() string {
+	encoded, err := json.Marshal(c.arguments())
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+type chatImage struct {
+	MediaType string
+	Data      string
+}
+
+// contentParts splits message content into its text and inline images.
+// Remote image URLs are dropped; local providers cannot fetch them.
+func contentParts(raw json.RawMessage) (string, []chatImage) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil
+	}
+	var texts []string
+	var images []chatImage
+	for _, part := range parts {
+		switch part.Type {
+		case "text", "input_text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if image, ok := parseDataURL(part.ImageURL.URL); ok {
+				images = append(images, image)
+			}
+		}
+	}
+	return strings.Join(texts, "\n"), images
+}
+
+func parseDataURL(url string) (chatImage, bool) {
+	if !strings.HasPrefix(url, "data:") {
+		return chatImage{}, false
+	}
+	header, data, found := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !found || !strings.HasSuffix(header, ";base64") {
+		return chatImage{}, false
+	}
+	return chatImage{MediaType: strings.TrimSuffix(header, ";base64"), Data: data}, true
+}
+
+// chatTools extracts name, description and parameters from OpenAI tools.
+func chatTools(raw interface{}) []map[string]interface{} {
+	items, _ := raw.([]interface{})
+	tools := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		tool, _ := item.(map[string]interface{})
+		function, _ := tool["function"].(map[string]interface{})
+		if name, _ := function["name"].(string); strings.TrimSpace(name) != "" {
+			tools = append(tools, function)
+		}
+	}
+	return tools
+}
+
+func decodeChatRequest(body []byte) (map[string]interface{}, []chatMessage, error) {
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(body, &reqMap); err != nil {
+		return nil, nil, fmt.Errorf("decode chat request: %w", err)
+	}
+	var envelope struct {
+		Messages []chatMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, nil, fmt.Errorf("decode chat messages: %w", err)
+	}
+	return reqMap, envelope.Messages, nil
+}
+
+func copyFields(dst, src map[string]interface{}, keys ...string) {
+	for _, key := range keys {
+		if value, ok := src[key]; ok && value != nil {
+			dst[key] = value
+		}
+	}
+}
+
+// lineReader yields lines of any length, without the trailing newline.
+type lineReader struct {
+	reader *bufio.Reader
+}
+
+func newLineReader(stream io.Reader) *lineReader {
+	return &lineReader{reader: bufio.NewReader(stream)}
+}
+
+func (l *lineReader) next() (string, error) {
+	line, err := l.reader.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// nextSSEData returns the data of the next SSE block. event: lines repeat the
+// JSON "type" field and comments are keep-alives, so both are skipped.
+func (l *lineReader) nextSSEData() (string, error) {
+	var data []string
+	for {
+		line, err := l.next()
+		if err != nil {
+			if err == io.EOF && len(data) > 0 {
+				return strings.Join(data, "\n"), nil
+			}
+			return "", err
+		}
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				return strings.Join(data, "\n"), nil
+			}
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeFixture(t *testing.T, adapter ProviderAdapter, name string) []string {
+	t.Helper()
+	file, err := os.Open(filepath.Join("testdata", "providers", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decoder := adapter.NewDecoder(file)
+	var events []string
+	for {
+		batch, err := decoder.Next()
+		for _, event := range batch {
+			encoded, marshalErr := json.Marshal(event.Payload())
+			if marshalErr != nil {
+				t.Fatal(marshalErr)
+			}
+			events = append(events, string(encoded))
+		}
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestProviderAdaptersNormalizeRecordedStreams(t *testing.T) {
+	cases := []struct {
+		mode    string
+		fixture string
+		want    []string
+	}{
+		{LLMModeOllama, "ollama_tool_call.ndjson", []string{
+			`{"type":"reasoning.start"}`,
+			`{"content":"The user wants the","type":"reasoning.delta"}`,
+			`{"content":" current time.","type":"reasoning.delta"}`,
+			`{"type":"reasoning.end"}`,
+			`{"call_id":"call_1","tool":"get_current_time","type":"tool_call.start"}`,
+			`{"arguments":{},"call_id":"call_1","tool":"get_current_time","type":"tool_call.arguments"}`,
+			`{"call_id":"call_2","tool":"search_web","type":"tool_call.start"}`,
+			`{"arguments":{"query":"서울 날씨"},"call_id":"call_2","tool":"search_web","type":"tool_call.arguments"}`,
+			`{"result":{"stats":{"input_tokens":812,"total_output_tokens":41},"stop_reason":"stop"},"type":"chat.end"}`,
+		}},
+		{LLMModeOllama, "ollama_answer.ndjson", []string{
+			`{"content":"지금은","type":"message.delta"}`,
+			`{"content":" 오후 6시 14분입니다.","type":"message.delta"}`,
+			`{"result":{"stats":{"input_tokens":1034,"total_output_tokens":12},"stop_reason":"stop"},"type":"chat.end"}`,
+		}},
+		{LLMModeOllama, "ollama_error.ndjson", []string{
+			`{"error":{"message":"model \"llama9\" not found, try pulling it first"},"type":"error"}`,
+		}},
+		{LLMModeAnthropic, "anthropic_tool_call.sse", []string{
+			`{"type":"reasoning.start"}`,
+			`{"content":"Need the time first.","type":"reasoning.delta"}`,
+			`{"type":"reasoning.end"}`,
+			`{"content":"Checking.","type":"message.delta"}`,
+			`{"call_id":"toolu_01A","tool":"search_web","type":"tool_call.start"}`,
+			`{"arguments":{"query":"서울 날씨"},"call_id":"toolu_01A","tool":"search_web","type":"tool_call.arguments"}`,
+			`{"call_id":"toolu_01B","tool":"get_current_time","type":"tool_call.start"}`,
+			`{"arguments":{},"call_id":"toolu_01B","tool":"get_current_time","type":"tool_call.arguments"}`,
+			`{"result":{"stats":{"input_tokens":655,"total_output_tokens":58},"stop_reason":"tool_use"},"type":"chat.end"}`,
+		}},
+		{LLMModeAnthropic, "anthropic_error.sse", []string{
+			`{"error":{"message":"Overloaded"},"type":"error"}`,
+		}},
+		{LLMModeResponses, "responses_tool_call.sse", []string{
+			`{"type":"reasoning.start"}`,
+			`{"content":"Look up the weather","type":"reasoning.delta"}`,
+			`{"content":" in Seoul.","type":"reasoning.delta"}`,
+			`{"type":"reasoning.end"}`,
+			`{"call_id":"call_a1","tool":"search_web","type":"tool_call.start"}`,
+			`{"arguments":{"query":"서울 날씨"},"call_id":"call_a1","tool":"search_web","type":"tool_call.arguments"}`,
+			`{"call_id":"call_a2","tool":"get_current_time","type":"tool_call.start"}`,
+			`{"arguments":{},"call_id":"call_a2","tool":"get_current_time","type":"tool_call.arguments"}`,
+			`{"result":{"response_id":"resp_7f3a","stats":{"input_tokens":903,"total_output_tokens":37},"stop_reason":"completed"},"type":"chat.end"}`,
+		}},
+		{LLMModeResponses, "responses_answer.sse", []string{
+			`{"content":"서울은 맑고","type":"message.delta"}`,
+			`{"content":" 18도입니다.","type":"message.delta"}`,
+			`{"result":{"response_id":"resp_8b21","stats":{"input_tokens":1210,"total_output_tokens":9},"stop_reason":"completed"},"type":"chat.end"}`,
+		}},
+		{LLMModeResponses, "responses_error.sse", []string{
+			`{"error":{"message":"model crashed while generating"},"type":"error"}`,
+		}},
+	}
+	for _, tc := range cases {
+		got := decodeFixture(t, AdapterFor(tc.mode), tc.fixture)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s events:\n%s\nwant:\n%s", tc.fixture, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+func TestNormalizedStreamFeedsToolCallsIntoProviderEvents(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "providers", "anthropic_tool_call.sse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	raw, err := io.ReadAll(NormalizedStream(AdapterFor(LLMModeAnthropic), file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls []ProviderToolCall
+	for _, block := range strings.Split(strings.TrimSpace(string(raw)), "\n\n") {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(block, "data: ")), &event); err != nil {
+			t.Fatalf("block %q is not an SSE data event: %v", block, err)
+		}
+		if event["type"] == "tool_call.arguments" {
+			call, _, ok := ParseProviderToolArgumentsEvent(event, "")
+			if !ok {
+				t.Fatalf("unparseable tool event %v", event)
+			}
+			calls = append(calls, call)
+		}
+	}
+	want := []ProviderToolCall{
+		{ID: "toolu_01A", Name: "search_web", Arguments: `{"query":"서울 날씨"}`},
+		{ID: "toolu_01B", Name: "get_current_time", Arguments: `{}`},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %#v", calls)
+	}
+}
+
+const toolRoundRequest = `{
+	"model": "local-model",
+	"stream": true,
+	"temperature": 0.2,
+	"max_tokens": 2048,
+	"stop": "</end>",
+	"parallel_tool_calls": false,
+	"tools": [{"type": "function", "function": {"name": "search_web", "description": "Search the web", "parameters": {"type": "object", "properties": {"query": {"type": "string"}}}}}],
+	"tool_choice": "auto",
+	"messages": [
+		{"role": "system", "content": "Answer in Korean."},
+		{"role": "user", "content": [{"type": "text", "text": "이 사진 어디야?"}, {"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0K"}}]},
+		{"role": "assistant", "content": null, "tool_calls": [{"id": "call_9", "type": "function", "function": {"name": "search_web", "arguments": "{\"query\":\"남산타워\"}"}}]},
+		{"role": "tool", "tool_call_id": "call_9", "content": "N Seoul Tower is in Yongsan-gu."}
+	]
+}`
+
+func TestOllamaAdapterEncodesToolRound(t *testing.T) {
+	encoded, err := AdapterFor(LLMModeOllama).EncodeRequest([]byte(toolRoundRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"model":  "local-model",
+		"stream": true,
+		"options": map[string]interface{}{
+			"temperature": 0.2,
+			"num_predict": 2048.0,
+			"stop":        "</end>",
+		},
+		"messages": []interface{}{
+			map[string]interface{}{"role": "system", "content": "Answer in Korean."},
+			map[string]interface{}{"role": "user", "content": "이 사진 어디야?", "images": []interface{}{"iVBORw0K"}},
+			map[string]interface{}{"role": "assistant", "content": "", "tool_calls": []interface{}{
+				map[string]interface{}{"function": map[string]interface{}{"name": "search_web", "arguments": map[string]interface{}{"query": "남산타워"}}},
+			}},
+			map[string]interface{}{"role": "tool", "content": "N Seoul Tower is in Yongsan-gu.", "tool_name": "search_web"},
+		},
+		"tools": []interface{}{map[string]interface{}{"type": "function", "function": map[string]interface{}{
+			"name": "search_web", "description": "Search the web",
+			"parameters": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"query": map[string]interface{}{"type": "string"}}},
+		}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.MarshalIndent(got, "", "  ")
+		t.Fatalf("ollama request:\n%s", gotJSON)
+	}
+}
+
+func TestAnthropicAdapterEncodesToolRound(t *testing.T) {
+	encoded, err := AdapterFor(LLMModeAnthropic).EncodeRequest([]byte(toolRoundRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"model":          "local-model",
+		"stream":         true,
+		"temperature":    0.2,
+		"max_tokens":     2048.0,
+		"stop_sequences": []interface{}{"</end>"},
+		"system":         "Answer in Korean.",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "base64", "media_type": "image/png", "data": "iVBORw0K"}},
+				map[string]interface{}{"type": "text", "text": "이 사진 어디야?"},
+			}},
+			map[string]interface{}{"role": "assistant", "content": []interface{}{
+				map[string]interface{}{"type": "tool_use", "id": "call_9", "name": "search_web", "input": map[string]interface{}{"query": "남산타워"}},
+			}},
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "tool_result", "tool_use_id": "call_9", "content": "N Seoul Tower is in Yongsan-gu."},
+			}},
+		},
+		"tools": []interface{}{map[string]interface{}{
+			"name": "search_web", "description": "Search the web",
+			"input_schema": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"query": map[string]interface{}{"type": "string"}}},
+		}},
+		"tool_choice": map[string]interface{}{"type": "auto", "disable_parallel_tool_use": true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.MarshalIndent(got, "", "  ")
+		t.Fatalf("anthropic request:\n%s", gotJSON)
+	}
+}
+
+func encodeResponsesRequest(t *testing.T, reqMap map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	body, err := json.Marshal(reqMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := AdapterFor(LLMModeResponses).EncodeRequest(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestResponsesAdapterEncodesToolRound(t *testing.T) {
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal([]byte(toolRoundRequest), &reqMap); err != nil {
+		t.Fatal(err)
+	}
+	reqMap["reasoning_effort"] = "low"
+	got := encodeResponsesRequest(t, reqMap)
+	want := map[string]interface{}{
+		"model":               "local-model",
+		"stream":              true,
+		"temperature":         0.2,
+		"max_output_tokens":   2048.0,
+		"instructions":        "Answer in Korean.",
+		"reasoning":           map[string]interface{}{"effort": "low", "summary": "auto"},
+		"parallel_tool_calls": false,
+		"tool_choice":         "auto",
+		"input": []interface{}{
+			map[string]interface{}{"type": "message", "role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "input_text", "text": "이 사진 어디야?"},
+				map[string]interface{}{"type": "input_image", "image_url": "data:image/png;base64,iVBORw0K"},
+			}},
+			map[string]interface{}{"type": "function_call", "call_id": "call_9", "name": "search_web", "arguments": `{"query":"남산타워"}`},
+			map[string]interface{}{"type": "function_call_output", "call_id": "call_9", "output": "N Seoul Tower is in Yongsan-gu."},
+		},
+		"tools": []interface{}{map[string]interface{}{
+			"type": "function", "name": "search_web", "description": "Search the web",
+			"parameters": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"query": map[string]interface{}{"type": "string"}}},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.MarshalIndent(got, "", "  ")
+		t.Fatalf("responses request:\n%s", gotJSON)
+	}
+}
+
+func TestResponsesAdapterSendsOnlyItemsAfterChainedResponse(t *testing.T) {
+	reqMap := map[string]interface{}{
+		"model": "local-model",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "system", "content": "Answer in Korean."},
+			map[string]interface{}{"role": "user", "content": "서울 날씨 알려줘"},
+		},
+	}
+	ChainResponse(reqMap, "resp_7f3a")
+	reqMap["messages"] = append(reqMap["messages"].([]interface{}),
+		map[string]interface{}{"role": "assistant", "content": nil, "tool_calls": []interface{}{
+			map[string]interface{}{"id": "call_a1", "type": "function", "function": map[string]interface{}{"name": "search_web", "arguments": `{"query":"서울 날씨"}`}},
+		}},
+		map[string]interface{}{"role": "tool", "tool_call_id": "call_a1", "content": "맑음, 18도"},
+	)
+	got := encodeResponsesRequest(t, reqMap)
+	if got["previous_response_id"] != "resp_7f3a" || got["instructions"] != "Answer in Korean." {
+		t.Fatalf("chained request lost its state: %#v", got)
+	}
+	wantInput := []interface{}{
+		map[string]interface{}{"type": "function_call_output", "call_id": "call_a1", "output": "맑음, 18도"},
+	}
+	if !reflect.DeepEqual(got["input"], wantInput) {
+		t.Fatalf("chained input = %#v", got["input"])
+	}
+	if _, leaked := got[responseChainOffsetKey]; leaked {
+		t.Fatal("chain offset was sent upstream")
+	}
+
+	// A chain restored from the saved session has no offset: the history the
+	// client resends up to the last answer is already stored upstream.
+	restored := encodeResponsesRequest(t, map[string]interface{}{
+		"model":                "local-model",
+		"previous_response_id": "resp_8b21",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "서울 날씨 알려줘"},
+			map[string]interface{}{"role": "assistant", "content": "서울은 맑고 18도입니다."},
+			map[string]interface{}{"role": "user", "content": "내일은?"},
+		},
+	})
+	wantInput = []interface{}{
+		map[string]interface{}{"type": "message", "role": "user", "content": []interface{}{
+			map[string]interface{}{"type": "input_text", "text": "내일은?"},
+		}},
+	}
+	if !reflect.DeepEqual(restored["input"], wantInput) {
+		t.Fatalf("restored chain input = %#v", restored["input"])
+	}
+}
+
+func TestPrepareRequestTargetsAdapterPath(t *testing.T) {
+	for mode, want := range map[string]string{
+		LLMModeOllama:    "http://127.0.0.1:11434/api/chat",
+		LLMModeAnthropic: "http://127.0.0.1:11434/v1/messages",
+		LLMModeResponses: "http://127.0.0.1:11434/v1/responses",
+		"standard":       "http://127.0.0.1:11434/v1/chat/completions",
+	} {
+		prepared, err := PrepareRequest(RequestInput{
+			Body:        []byte(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`),
+			EndpointRaw: "http://127.0.0.1:11434/v1",
+			LLMMode:     mode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prepared.UpstreamURL != want {
+			t.Errorf("%s upstream = %s, want %s", mode, prepared.UpstreamURL, want)
+		}
+	}
+}
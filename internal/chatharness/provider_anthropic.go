@@ -0,0 +1,290 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicVersion          = "2023-06-01"
+	anthropicDefaultMaxTokens = 4096
+)
+
+// anthropicAdapter speaks the Anthropic Messages API as served by local
+// compatible servers: content blocks, tool_use / tool_result, and SSE events
+// named after the block lifecycle.
+type anthropicAdapter struct{}
+
+func (anthropicAdapter) Mode() string { return LLMModeAnthropic }
+
+func (anthropicAdapter) Path() string { return "/v1/messages" }
+
+func (anthropicAdapter) SetHeaders(header http.Header, token string) {
+	header.Set("Content-Type", "application/json")
+	header.Set("anthropic-version", anthropicVersion)
+	if token != "" {
+		header.Set("x-api-key", token)
+		header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func (anthropicAdapter) EncodeRequest(body []byte) ([]byte, error) {
+	reqMap, messages, err := decodeChatRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{"stream": true, "max_tokens": anthropicDefaultMaxTokens}
+	copyFields(out, reqMap, "model", "stream", "temperature", "top_p", "top_k", "thinking", "metadata")
+	for _, key := range []string{"max_tokens", "max_completion_tokens"} {
+		if value, ok := reqMap[key]; ok && value != nil {
+			out["max_tokens"] = value
+		}
+	}
+	switch stop := reqMap["stop"].(type) {
+	case string:
+		out["stop_sequences"] = []string{stop}
+	case []interface{}:
+		out["stop_sequences"] = stop
+	}
+
+	var system []string
+	var encoded []map[string]interface{}
+	// Messages must alternate user/assistant, so tool results and adjacent
+	// turns of the same role are merged into one message.
+	appendBlocks := func(role string, blocks []interface{}) {
+		if len(blocks) == 0 {
+			return
+		}
+		if last := len(encoded) - 1; last >= 0 && encoded[last]["role"] == role {
+			encoded[last]["content"] = append(encoded[last]["content"].([]interface{}), blocks...)
+			return
+		}
+		encoded = append(encoded, map[string]interface{}{"role": role, "content": blocks})
+	}
+	for _, message := range messages {
+		text, images := contentParts(message.Content)
+		switch message.Role {
+		case "system", "developer":
+			if strings.TrimSpace(text) != "" {
+				system = append(system, text)
+			}
+		case "tool":
+			appendBlocks("user", []interface{}{map[string]interface{}{
+				"type":        "tool_result",
+				"tool_use_id": message.ToolCallID,
+				"content":     text,
+			}})
+		case "assistant":
+			var blocks []interface{}
+			if strings.TrimSpace(text) != "" {
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+			}
+			for _, call := range message.ToolCalls {
+				blocks = append(blocks, map[string]interface{}{
+					"type":  "tool_use",
+					"id":    call.ID,
+					"name":  call.Function.Name,
+					"input": call.arguments(),
+				})
+			}
+			appendBlocks("assistant", blocks)
+		default:
+			var blocks []interface{}
+			for _, image := range images {
+				blocks = append(blocks, map[string]interface{}{
+					"type": "image",
+					"source": map[string]interface{}{
+						"type":       "base64",
+						"media_type": image.MediaType,
+						"data":       image.Data,
+					},
+				})
+			}
+			if strings.TrimSpace(text) != "" || len(blocks) == 0 {
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+			}
+			appendBlocks("user", blocks)
+		}
+	}
+	if len(system) > 0 {
+		out["system"] = strings.Join(system, "\n\n")
+	}
+	out["messages"] = encoded
+
+	if tools := chatTools(reqMap["tools"]); len(tools) > 0 {
+		encodedTools := make([]interface{}, 0, len(tools))
+		for _, function := range tools {
+			schema := function["parameters"]
+			if schema == nil {
+				schema = map[string]interface{}{"type": "object"}
+			}
+			encodedTools = append(encodedTools, map[string]interface{}{
+				"name":         function["name"],
+				"description":  function["description"],
+				"input_schema": schema,
+			})
+		}
+		out["tools"] = encodedTools
+		toolChoice := map[string]interface{}{"type": "auto"}
+		if parallel, ok := reqMap["parallel_tool_calls"].(bool); ok && !parallel {
+			toolChoice["disable_parallel_tool_use"] = true
+		}
+		out["tool_choice"] = toolChoice
+	}
+	return json.Marshal(out)
+}
+
+func (anthropicAdapter) NewDecoder(stream io.Reader) ProviderEventDecoder {
+	return &anthropicDecoder{lines: newLineReader(stream), blocks: make(map[int]*anthropicBlock)}
+}
+
+type anthropicBlock struct {
+	kind      string
+	id        string
+	name      string
+	arguments strings.Builder
+}
+
+type anthropicDecoder struct {
+	lines        *lineReader
+	blocks       map[int]*anthropicBlock
+	reasoning    reasoningState
+	inputTokens  int
+	outputTokens int
+	stopReason   string
+	done         bool
+}
+
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message struct {
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	} `json:"message"`
+	ContentBlock struct {
+		Type     string `json:"type"`
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		Text     string `json:"text"`
+		Thinking string `json:"thinking"`
+	} `json:"content_block"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		Thinking    string `json:"thinking"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (d *anthropicDecoder) Next() ([]ProviderEvent, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	data, err := d.lines.nextSSEData()
+	if err == io.EOF {
+		d.done = true
+		return d.reasoning.close(), io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.decode(data)
+}
+
+func (d *anthropicDecoder) decode(data string) ([]ProviderEvent, error) {
+	var event anthropicStreamEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return nil, fmt.Errorf("decode anthropic stream event: %w", err)
+	}
+	switch event.Type {
+	case "message_start":
+		d.inputTokens = event.Message.Usage.InputTokens
+		d.outputTokens = event.Message.Usage.OutputTokens
+	case "content_block_start":
+		block := &anthropicBlock{kind: event.ContentBlock.Type, id: event.ContentBlock.ID, name: event.ContentBlock.Name}
+		d.blocks[event.Index] = block
+		switch block.kind {
+		case "thinking":
+			return d.reasoning.delta(event.ContentBlock.Thinking), nil
+		case "tool_use":
+			events := d.reasoning.close()
+			return append(events, ProviderEvent{Type: "tool_call.start", Tool: block.name, CallID: block.id}), nil
+		case "text":
+			events := d.reasoning.close()
+			if event.ContentBlock.Text != "" {
+				events = append(events, ProviderEvent{Type: "message.delta", Content: event.ContentBlock.Text})
+			}
+			return events, nil
+		}
+	case "content_block_delta":
+		switch event.Delta.Type {
+		case "text_delta":
+			events := d.reasoning.close()
+			return append(events, ProviderEvent{Type: "message.delta", Content: event.Delta.Text}), nil
+		case "thinking_delta":
+			return d.reasoning.delta(event.Delta.Thinking), nil
+		case "input_json_delta":
+			if block := d.blocks[event.Index]; block != nil {
+				block.arguments.WriteString(event.Delta.PartialJSON)
+			}
+		}
+	case "content_block_stop":
+		block := d.blocks[event.Index]
+		delete(d.blocks, event.Index)
+		if block == nil {
+			return nil, nil
+		}
+		switch block.kind {
+		case "thinking":
+			return d.reasoning.close(), nil
+		case "tool_use":
+			arguments := strings.TrimSpace(block.arguments.String())
+			if arguments == "" {
+				arguments = "{}"
+			}
+			return []ProviderEvent{{Type: "tool_call.arguments", Tool: block.name, CallID: block.id, Arguments: arguments}}, nil
+		}
+	case "message_delta":
+		if event.Delta.StopReason != "" {
+			d.stopReason = event.Delta.StopReason
+		}
+		if event.Usage.OutputTokens > 0 {
+			d.outputTokens = event.Usage.OutputTokens
+		}
+		if event.Usage.InputTokens > 0 {
+			d.inputTokens = event.Usage.InputTokens
+		}
+	case "message_stop":
+		d.done = true
+		events := d.reasoning.close()
+		return append(events, ProviderEvent{
+			Type:         "chat.end",
+			StopReason:   d.stopReason,
+			InputTokens:  d.inputTokens,
+			OutputTokens: d.outputTokens,
+		}), nil
+	case "error":
+		d.done = true
+		message := event.Error.Message
+		if message == "" {
+			message = event.Error.Type
+		}
+		return append(d.reasoning.close(), ProviderEvent{Type: "error", Content: message}), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,193 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ollamaAdapter speaks Ollama's native /api/chat: NDJSON streaming, tool
+// calls with object arguments, and a separate thinking channel.
+type ollamaAdapter struct{}
+
+func (ollamaAdapter) Mode() string { return LLMModeOllama }
+
+func (ollamaAdapter) Path() string { return "/api/chat" }
+
+func (ollamaAdapter) SetHeaders(header http.Header, token string) {
+	header.Set("Content-Type", "application/json")
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func (ollamaAdapter) EncodeRequest(body []byte) ([]byte, error) {
+	reqMap, messages, err := decodeChatRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{"stream": true}
+	copyFields(out, reqMap, "model", "stream", "keep_alive", "think", "format")
+
+	options := map[string]interface{}{}
+	copyFields(options, reqMap, "temperature", "top_p", "top_k", "seed", "stop", "repeat_penalty")
+	for _, key := range []string{"max_tokens", "max_completion_tokens"} {
+		if value, ok := reqMap[key]; ok && value != nil {
+			options["num_predict"] = value
+		}
+	}
+	if existing, ok := reqMap["options"].(map[string]interface{}); ok {
+		for key, value := range existing {
+			options[key] = value
+		}
+	}
+	if len(options) > 0 {
+		out["options"] = options
+	}
+
+	toolNames := map[string]string{}
+	encoded := make([]map[string]interface{}, 0, len(messages))
+	for _, message := range messages {
+		text, images := contentParts(message.Content)
+		entry := map[string]interface{}{"role": message.Role, "content": text}
+		if len(images) > 0 {
+			data := make([]string, 0, len(images))
+			for _, image := range images {
+				data = append(data, image.Data)
+			}
+			entry["images"] = data
+		}
+		if len(message.ToolCalls) > 0 {
+			calls := make([]interface{}, 0, len(message.ToolCalls))
+			for _, call := range message.ToolCalls {
+				toolNames[call.ID] = call.Function.Name
+				calls = append(calls, map[string]interface{}{
+					"function": map[string]interface{}{
+						"name":      call.Function.Name,
+						"arguments": call.arguments(),
+					},
+				})
+			}
+			entry["tool_calls"] = calls
+		}
+		if message.Role == "tool" {
+			if name := toolNames[message.ToolCallID]; name != "" {
+				entry["tool_name"] = name
+			}
+		}
+		encoded = append(encoded, entry)
+	}
+	out["messages"] = encoded
+
+	if tools := chatTools(reqMap["tools"]); len(tools) > 0 {
+		wrapped := make([]interface{}, 0, len(tools))
+		for _, function := range tools {
+			wrapped = append(wrapped, map[string]interface{}{"type": "function", "function": function})
+		}
+		out["tools"] = wrapped
+	}
+	return json.Marshal(out)
+}
+
+func (ollamaAdapter) NewDecoder(stream io.Reader) ProviderEventDecoder {
+	return &ollamaDecoder{lines: newLineReader(stream)}
+}
+
+type ollamaDecoder struct {
+	lines     *lineReader
+	reasoning reasoningState
+	calls     int
+	done      bool
+}
+
+type ollamaChunk struct {
+	Message struct {
+		Content   string `json:"content"`
+		Thinking  string `json:"thinking"`
+		ToolCalls []struct {
+			ID       string `json:"id"`
+			Function struct {
+				Name      string          `json:"name"`
+				Arguments json.RawMessage `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	Error           string `json:"error"`
+}
+
+func (d *ollamaDecoder) Next() ([]ProviderEvent, error) {
+	for {
+		if d.done {
+			return nil, io.EOF
+		}
+		line, err := d.lines.next()
+		if err != nil {
+			if err == io.EOF {
+				// A stream cut before done:true still has to close reasoning.
+				d.done = true
+				return d.reasoning.close(), io.EOF
+			}
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var chunk ollamaChunk
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			return nil, fmt.Errorf("decode ollama stream line: %w", err)
+		}
+		return d.events(chunk), nil
+	}
+}
+
+func (d *ollamaDecoder) events(chunk ollamaChunk) []ProviderEvent {
+	if chunk.Error != "" {
+		d.done = true
+		return append(d.reasoning.close(), ProviderEvent{Type: "error", Content: chunk.Error})
+	}
+	events := d.reasoning.delta(chunk.Message.Thinking)
+	if chunk.Message.Content != "" || len(chunk.Message.ToolCalls) > 0 {
+		events = append(events, d.reasoning.close()...)
+	}
+	if chunk.Message.Content != "" {
+		events = append(events, ProviderEvent{Type: "message.delta", Content: chunk.Message.Content})
+	}
+	for _, call := range chunk.Message.ToolCalls {
+		d.calls++
+		callID := strings.TrimSpace(call.ID)
+		if callID == "" {
+			// Ollama does not assign call IDs; role "tool" results are
+			// matched by tool_name, so a stable synthetic ID is enough.
+			callID = fmt.Sprintf("call_%d", d.calls)
+		}
+		arguments := strings.TrimSpace(string(call.Function.Arguments))
+		var encoded string
+		if err := json.Unmarshal(call.Function.Arguments, &encoded); err == nil {
+			arguments = encoded
+		}
+		if arguments == "" || arguments == "null" {
+			arguments = "{}"
+		}
+		events = append(events,
+			ProviderEvent{Type: "tool_call.start", Tool: call.Function.Name, CallID: callID},
+			ProviderEvent{Type: "tool_call.arguments", Tool: call.Function.Name, CallID: callID, Arguments: arguments},
+		)
+	}
+	if chunk.Done {
+		d.done = true
+		events = append(events, d.reasoning.close()...)
+		events = append(events, ProviderEvent{
+			Type:         "chat.end",
+			StopReason:   chunk.DoneReason,
+			InputTokens:  chunk.PromptEvalCount,
+			OutputTokens: chunk.EvalCount,
+		})
+	}
+	return events
+}
@@ -0,0 +1,342 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// responseChainOffsetKey records, inside the working request, how many
+// messages the response named by previous_response_id already stored. It is
+// only read by the Responses adapter and never sent upstream.
+const responseChainOffsetKey = "response_chain_offset"
+
+// ChainResponse continues responseID from the next dispatch of reqMap. The
+// messages present now were stored server-side with that response, so the
+// Responses adapter only sends the ones appended afterwards.
+func ChainResponse(reqMap map[string]interface{}, responseID string) {
+	if reqMap == nil || !IsValidResponseID(responseID) {
+		return
+	}
+	messages, _ := reqMap["messages"].([]interface{})
+	reqMap["previous_response_id"] = strings.TrimSpace(responseID)
+	reqMap[responseChainOffsetKey] = len(messages)
+}
+
+// ChainsResponses reports whether llmMode keeps conversation state upstream
+// and chains requests with previous_response_id.
+func ChainsResponses(llmMode string) bool {
+	switch strings.TrimSpace(strings.ToLower(llmMode)) {
+	case "stateful", LLMModeResponses:
+		return true
+	default:
+		return false
+	}
+}
+
+// responsesAdapter speaks the OpenAI Responses API (/v1/responses) served by
+// llama.cpp, vLLM and newer LM Studio builds: input items with
+// function_call / function_call_output, reasoning summaries, and server-side
+// state chained through previous_response_id.
+type responsesAdapter struct{}
+
+func (responsesAdapter) Mode() string { return LLMModeResponses }
+
+func (responsesAdapter) Path() string { return "/v1/responses" }
+
+func (responsesAdapter) SetHeaders(header http.Header, token string) {
+	header.Set("Content-Type", "application/json")
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func (responsesAdapter) EncodeRequest(body []byte) ([]byte, error) {
+	reqMap, messages, err := decodeChatRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{"stream": true}
+	copyFields(out, reqMap, "model", "stream", "temperature", "top_p", "store", "metadata", "user", "text")
+	for _, key := range []string{"max_tokens", "max_completion_tokens", "max_output_tokens"} {
+		if value, ok := reqMap[key]; ok && value != nil {
+			out["max_output_tokens"] = value
+		}
+	}
+	reasoning := map[string]interface{}{}
+	if existing, ok := reqMap["reasoning"].(map[string]interface{}); ok {
+		for key, value := range existing {
+			reasoning[key] = value
+		}
+	}
+	if effort, _ := reqMap["reasoning_effort"].(string); strings.TrimSpace(effort) != "" {
+		reasoning["effort"] = strings.TrimSpace(effort)
+	}
+	if len(reasoning) > 0 {
+		if _, ok := reasoning["summary"]; !ok {
+			reasoning["summary"] = "auto"
+		}
+		out["reasoning"] = reasoning
+	}
+
+	// Instructions are not carried over by previous_response_id, so system
+	// messages are sent on every request.
+	var instructions []string
+	for _, message := range messages {
+		if message.Role == "system" || message.Role == "developer" {
+			if text, _ := contentParts(message.Content); strings.TrimSpace(text) != "" {
+				instructions = append(instructions, text)
+			}
+		}
+	}
+	if len(instructions) > 0 {
+		out["instructions"] = strings.Join(instructions, "\n\n")
+	}
+	if previous, _ := reqMap["previous_response_id"].(string); IsValidResponseID(previous) {
+		out["previous_response_id"] = strings.TrimSpace(previous)
+		messages = unchainedMessages(messages, reqMap[responseChainOffsetKey])
+	}
+
+	input := make([]interface{}, 0, len(messages))
+	for _, message := range messages {
+		text, images := contentParts(message.Content)
+		switch message.Role {
+		case "system", "developer":
+		case "tool":
+			input = append(input, map[string]interface{}{
+				"type":    "function_call_output",
+				"call_id": message.ToolCallID,
+				"output":  text,
+			})
+		case "assistant":
+			if strings.TrimSpace(text) != "" {
+				input = append(input, map[string]interface{}{
+					"type":    "message",
+					"role":    "assistant",
+					"content": []interface{}{map[string]interface{}{"type": "output_text", "text": text}},
+				})
+			}
+			for _, call := range message.ToolCalls {
+				input = append(input, map[string]interface{}{
+					"type":      "function_call",
+					"call_id":   call.ID,
+					"name":      call.Function.Name,
+					"arguments": call.argumentsJSON(),
+				})
+			}
+		default:
+			content := []interface{}{map[string]interface{}{"type": "input_text", "text": text}}
+			for _, image := range images {
+				content = append(content, map[string]interface{}{
+					"type":      "input_image",
+					"image_url": "data:" + image.MediaType + ";base64," + image.Data,
+				})
+			}
+			input = append(input, map[string]interface{}{"type": "message", "role": "user", "content": content})
+		}
+	}
+	out["input"] = input
+
+	if tools := chatTools(reqMap["tools"]); len(tools) > 0 {
+		encodedTools := make([]interface{}, 0, len(tools))
+		for _, function := range tools {
+			tool := map[string]interface{}{"type": "function"}
+			copyFields(tool, function, "name", "description", "parameters", "strict")
+			encodedTools = append(encodedTools, tool)
+		}
+		out["tools"] = encodedTools
+		copyFields(out, reqMap, "tool_choice", "parallel_tool_calls")
+	}
+	return json.Marshal(out)
+}
+
+// unchainedMessages drops the messages already stored with the previous
+// response. Without a recorded offset (a chain restored from the saved
+// session) everything up to the last assistant message is stored. Assistant
+// messages after the offset are outputs of the previous response itself.
+func unchainedMessages(messages []chatMessage, rawOffset interface{}) []chatMessage {
+	offset := -1
+	if value, ok := rawOffset.(float64); ok && value >= 0 && int(value) <= len(messages) {
+		offset = int(value)
+	}
+	if offset < 0 {
+		offset = 0
+		for index, message := range messages {
+			if message.Role == "assistant" {
+				offset = index + 1
+			}
+		}
+	}
+	pending := make([]chatMessage, 0, len(messages)-offset)
+	for _, message := range messages[offset:] {
+		if message.Role != "assistant" {
+			pending = append(pending, message)
+		}
+	}
+	return pending
+}
+
+func (responsesAdapter) NewDecoder(stream io.Reader) ProviderEventDecoder {
+	return &responsesDecoder{lines: newLineReader(stream), calls: make(map[string]*responsesCall)}
+}
+
+type responsesCall struct {
+	callID    string
+	name      string
+	arguments strings.Builder
+}
+
+type responsesDecoder struct {
+	lines      *lineReader
+	calls      map[string]*responsesCall
+	reasoning  reasoningState
+	responseID string
+	done       bool
+}
+
+type responsesItem struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type responsesObject struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Usage  struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	IncompleteDetails struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type responsesStreamEvent struct {
+	Type     string          `json:"type"`
+	Delta    string          `json:"delta"`
+	ItemID   string          `json:"item_id"`
+	Item     responsesItem   `json:"item"`
+	Response responsesObject `json:"response"`
+	Message  string          `json:"message"`
+	Code     string          `json:"code"`
+	Error    struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (d *responsesDecoder) Next() ([]ProviderEvent, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	data, err := d.lines.nextSSEData()
+	if err == io.EOF {
+		d.done = true
+		return d.reasoning.close(), io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(data) == "[DONE]" {
+		return nil, nil
+	}
+	var event responsesStreamEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return nil, fmt.Errorf("decode responses stream event: %w", err)
+	}
+	return d.decode(event), nil
+}
+
+func (d *responsesDecoder) decode(event responsesStreamEvent) []ProviderEvent {
+	switch event.Type {
+	case "response.created", "response.in_progress":
+		if IsValidResponseID(event.Response.ID) {
+			d.responseID = strings.TrimSpace(event.Response.ID)
+		}
+	case "response.output_text.delta":
+		events := d.reasoning.close()
+		if event.Delta == "" {
+			return events
+		}
+		return append(events, ProviderEvent{Type: "message.delta", Content: event.Delta})
+	case "response.reasoning_summary_text.delta", "response.reasoning_text.delta":
+		return d.reasoning.delta(event.Delta)
+	case "response.output_item.added":
+		if event.Item.Type != "function_call" {
+			return nil
+		}
+		call := &responsesCall{callID: firstNonEmpty(event.Item.CallID, event.Item.ID), name: event.Item.Name}
+		call.arguments.WriteString(event.Item.Arguments)
+		d.calls[event.Item.ID] = call
+		return append(d.reasoning.close(), ProviderEvent{Type: "tool_call.start", Tool: call.name, CallID: call.callID})
+	case "response.function_call_arguments.delta":
+		if call := d.calls[event.ItemID]; call != nil {
+			call.arguments.WriteString(event.Delta)
+		}
+	case "response.output_item.done":
+		switch event.Item.Type {
+		case "reasoning":
+			return d.reasoning.close()
+		case "function_call":
+			call := d.calls[event.Item.ID]
+			delete(d.calls, event.Item.ID)
+			if call == nil {
+				call = &responsesCall{callID: firstNonEmpty(event.Item.CallID, event.Item.ID), name: event.Item.Name}
+			}
+			arguments := strings.TrimSpace(event.Item.Arguments)
+			if arguments == "" {
+				arguments = strings.TrimSpace(call.arguments.String())
+			}
+			if arguments == "" {
+				arguments = "{}"
+			}
+			return []ProviderEvent{{
+				Type:      "tool_call.arguments",
+				Tool:      firstNonEmpty(event.Item.Name, call.name),
+				CallID:    call.callID,
+				Arguments: arguments,
+			}}
+		}
+	case "response.completed", "response.incomplete":
+		d.done = true
+		if IsValidResponseID(event.Response.ID) {
+			d.responseID = strings.TrimSpace(event.Response.ID)
+		}
+		stopReason := event.Response.Status
+		if event.Response.IncompleteDetails.Reason != "" {
+			stopReason = event.Response.IncompleteDetails.Reason
+		}
+		return append(d.reasoning.close(), ProviderEvent{
+			Type:         "chat.end",
+			StopReason:   stopReason,
+			ResponseID:   d.responseID,
+			InputTokens:  event.Response.Usage.InputTokens,
+			OutputTokens: event.Response.Usage.OutputTokens,
+		})
+	case "response.failed", "error":
+		d.done = true
+		message := firstNonEmpty(event.Response.Error.Message, event.Message, event.Error.Message, event.Response.Error.Code, event.Code)
+		if message == "" {
+			message = "response failed"
+		}
+		return append(d.reasoning.close(), ProviderEvent{Type: "error", Content: message})
+	}
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
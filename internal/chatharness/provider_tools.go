@@ -139,6 +139,22 @@ func (a *ChatToolAccumulator) addFunction(index int, rawID interface{}, rawFunct
 	return strings.TrimSpace(call.Name) != "" || strings.TrimSpace(call.Arguments) != "" || strings.TrimSpace(call.ID) != ""
 }
 
+// AddCall records a complete call, as decoded by a native provider adapter,
+// after the calls already accumulated.
+func (a *ChatToolAccumulator) AddCall(call ProviderToolCall) {
+	if a == nil || strings.TrimSpace(call.Name) == "" {
+		return
+	}
+	call.Index = len(a.calls)
+	for {
+		if _, taken := a.calls[call.Index]; !taken {
+			break
+		}
+		call.Index++
+	}
+	a.calls[call.Index] = &call
+}
+
 func (a *ChatToolAccumulator) HasCalls() bool {
 	return a != nil && len(a.calls) > 0
 }
@@ -114,3 +114,14 @@ func TestParseProviderToolArgumentsEventMarshalsArgumentObject(t *testing.T) {
 		t.Fatalf("parsed arguments have wrong type: %#v", parsed)
 	}
 }
+
+func TestChatToolAccumulatorAddCallKeepsProviderOrder(t *testing.T) {
+	accumulator := NewChatToolAccumulator()
+	accumulator.AddCall(ProviderToolCall{ID: "toolu_01A", Name: "search_web", Arguments: `{"query":"a"}`})
+	accumulator.AddCall(ProviderToolCall{Name: " "})
+	accumulator.AddCall(ProviderToolCall{ID: "toolu_01B", Name: "get_current_time"})
+	calls := accumulator.Calls()
+	if len(calls) != 2 || calls[0].ID != "toolu_01A" || calls[1].ID != "toolu_01B" || calls[1].Index != 1 || calls[1].Arguments != "{}" {
+		t.Fatalf("unexpected calls: %#v", calls)
+	}
+}
@@ -27,6 +27,9 @@ type RequestInput struct {
 	UserProfileFacts  string
 	SkillInstructions string
 	Tools             []promptkit.ToolDefinition
+	// ResponseFormat, when set, replaces the runtime, memory and skill
+	// instructions: they would compete with the requested output format.
+	ResponseFormat *ResponseFormat
 }
 
 type PreparedRequest struct {
@@ -66,7 +69,14 @@ func PrepareRequest(input RequestInput) (PreparedRequest, error) {
 	compactTaskInstructions := promptkit.BuildCompactTaskInstructions(prepared.InitialUserInputText)
 	shouldInjectRuntime := input.EnableTools || includeRetrievalMemory || strings.TrimSpace(input.SkillInstructions) != "" || compactTaskInstructions != ""
 
-	if shouldInjectRuntime {
+	if input.ResponseFormat != nil {
+		input.ResponseFormat.Apply(reqMap, input.LLMMode)
+		newBody, err := json.Marshal(reqMap)
+		if err != nil {
+			return prepared, fmt.Errorf("marshal request with response format: %w", err)
+		}
+		prepared.Body = newBody
+	} else if shouldInjectRuntime {
 		if useNativeTools {
 			ensureChatCompletionTools(reqMap, input.Tools)
 			applyToolTurnOutputBudget(reqMap)
@@ -131,7 +141,16 @@ func sanitizeToken(tokenRaw string) string {
 	return token
 }
 
+// UpstreamURL is the chat URL PrepareRequest would dispatch to for
+// endpointRaw, used when a request moves to another upstream.
+func UpstreamURL(endpointRaw string, llmMode string) string {
+	return buildUpstreamURL(sanitizeEndpoint(endpointRaw), llmMode)
+}
+
 func buildUpstreamURL(endpoint string, llmMode string) string {
+	if adapter := AdapterFor(llmMode); adapter != nil {
+		return endpoint + adapter.Path()
+	}
 	if llmMode == "stateful" {
 		return endpoint + "/api/v1/chat"
 	}
@@ -208,22 +227,14 @@ func removeProviderToolControls(reqMap map[string]interface{}) bool {
 
 func ensureChatCompletionTools(reqMap map[string]interface{}, definitions []promptkit.ToolDefinition) {
 	tools := make([]interface{}, 0, len(definitions))
+	parallelSafe := false
 	for _, definition := range definitions {
-		if strings.TrimSpace(definition.Name) == "" {
-			continue
-		}
-		var parameters interface{}
-		if err := json.Unmarshal(definition.InputSchema, &parameters); err != nil {
+		tool, ok := chatCompletionTool(definition)
+		if !ok {
 			continue
 		}
-		tools = append(tools, map[string]interface{}{
-			"type": "function",
-			"function": map[string]interface{}{
-				"name":        definition.Name,
-				"description": definition.Description,
-				"parameters":  parameters,
-			},
-		})
+		parallelSafe = parallelSafe || definition.ParallelSafe
+		tools = append(tools, tool)
 	}
 	if len(tools) == 0 {
 		delete(reqMap, "tools")
@@ -231,7 +242,55 @@ func ensureChatCompletionTools(reqMap map[string]interface{}, definitions []prom
 	}
 	reqMap["tools"] = tools
 	reqMap["tool_choice"] = "auto"
-	reqMap["parallel_tool_calls"] = false
+	// The gateway runs ParallelSafe calls concurrently and serializes the
+	// rest, so several calls per round are only worth asking for when at
+	// least one advertised tool can actually run in parallel.
+	reqMap["parallel_tool_calls"] = parallelSafe
+}
+
+// AddGatewayTools appends app tools to the tools a client sent, skipping
+// names the client already defined, and returns the names it added.
+func AddGatewayTools(reqMap map[string]interface{}, definitions []promptkit.ToolDefinition) map[string]bool {
+	tools, _ := reqMap["tools"].([]interface{})
+	clientNames := map[string]bool{}
+	for _, tool := range tools {
+		entry, _ := tool.(map[string]interface{})
+		function, _ := entry["function"].(map[string]interface{})
+		if name, _ := function["name"].(string); name != "" {
+			clientNames[name] = true
+		}
+	}
+	added := map[string]bool{}
+	for _, definition := range definitions {
+		tool, ok := chatCompletionTool(definition)
+		if !ok || clientNames[definition.Name] {
+			continue
+		}
+		tools = append(tools, tool)
+		added[definition.Name] = true
+	}
+	if len(tools) > 0 {
+		reqMap["tools"] = tools
+	}
+	return added
+}
+
+func chatCompletionTool(definition promptkit.ToolDefinition) (map[string]interface{}, bool) {
+	if strings.TrimSpace(definition.Name) == "" {
+		return nil, false
+	}
+	var parameters interface{}
+	if err := json.Unmarshal(definition.InputSchema, &parameters); err != nil {
+		return nil, false
+	}
+	return map[string]interface{}{
+		"type": "function",
+		"function": map[string]interface{}{
+			"name":        definition.Name,
+			"description": definition.Description,
+			"parameters":  parameters,
+		},
+	}, true
 }
 
 func buildEnvironmentInfo() string {
@@ -812,3 +812,64 @@ func TestBulkToolTestRequestKeepsFollowupRunning(t *testing.T) {
 		}
 	}
 }
+
+func TestPrepareRequestAllowsParallelCallsOnlyForParallelSafeCatalog(t *testing.T) {
+	definitions := append(testToolDefinitions(), promptkit.ToolDefinition{
+		Name:         "search_web",
+		Description:  "Search the web",
+		InputSchema:  json.RawMessage(`{"type":"object","properties":{"query":{"type":"string"}}}`),
+		ParallelSafe: true,
+	})
+	prepared, err := PrepareRequest(RequestInput{
+		Body:        []byte(`{"model":"test","messages":[{"role":"user","content":"news?"}],"parallel_tool_calls":false,"stream":true}`),
+		LLMMode:     "standard",
+		EnableTools: true,
+		Tools:       definitions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepared.ReqMap["parallel_tool_calls"] != true {
+		t.Fatalf("parallel tool calls were not enabled for a ParallelSafe catalog: %#v", prepared.ReqMap["parallel_tool_calls"])
+	}
+}
+
+func TestMultiCallFollowupKeepsEveryToolResultInProviderOrder(t *testing.T) {
+	req, _, err := PrepareToolFollowupRequest(ToolFollowupInput{
+		LLMMode:           "standard",
+		ToolName:          "search_web",
+		ToolCallID:        "call_b",
+		OriginalUserText:  "news and memory",
+		ParallelToolCalls: true,
+		ProviderTools:     []interface{}{map[string]interface{}{"type": "function"}},
+		ToolCalls: []ToolCallOutcome{
+			{ID: "call_b", Name: "search_web", Arguments: `{"query":"news"}`, Result: "search result"},
+			{ID: "call_a", Name: "read_memory_context", Arguments: "", Result: "memory result"},
+		},
+		ReqMap: map[string]interface{}{
+			"model":    "test",
+			"messages": []interface{}{map[string]interface{}{"role": "user", "content": "news and memory"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req["parallel_tool_calls"] != true {
+		t.Fatalf("follow-up dropped parallel tool calls: %#v", req["parallel_tool_calls"])
+	}
+	messages := req["messages"].([]interface{})
+	if len(messages) != 4 {
+		t.Fatalf("expected user, assistant and two tool messages, got %#v", messages)
+	}
+	assistant := messages[1].(map[string]interface{})
+	calls := assistant["tool_calls"].([]interface{})
+	if len(calls) != 2 || calls[1].(map[string]interface{})["function"].(map[string]interface{})["arguments"] != "{}" {
+		t.Fatalf("assistant message did not carry every tool call: %#v", calls)
+	}
+	for index, wantID := range []string{"call_b", "call_a"} {
+		message := messages[index+2].(map[string]interface{})
+		if message["role"] != "tool" || message["tool_call_id"] != wantID {
+			t.Fatalf("tool message %d = %#v, want tool_call_id %s", index, message, wantID)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+// Response format types of an OpenAI Chat Completions request.
+const (
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// MaxStructuredOutputRepairs bounds the repair rounds run when an answer does
+// not match the requested response format.
+const MaxStructuredOutputRepairs = 2
+
+// ResponseFormat is the structured output a client asked for through
+// response_format. Schema is set only for json_schema.
+type ResponseFormat struct {
+	Type   string
+	Name   string
+	Schema json.RawMessage
+	Strict bool
+
+	schemaValue interface{}
+	compiled    *toolruntime.Schema
+}
+
+// ParseResponseFormat reads response_format from a Chat Completions request.
+// It returns nil when the field is absent or asks for plain text.
+func ParseResponseFormat(reqMap map[string]interface{}) (*ResponseFormat, error) {
+	raw, exists := reqMap["response_format"]
+	if !exists || raw == nil {
+		return nil, nil
+	}
+	spec, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("response_format must be an object")
+	}
+	formatType, _ := spec["type"].(string)
+	switch strings.TrimSpace(formatType) {
+	case "text":
+		return nil, nil
+	case ResponseFormatJSONObject:
+		return &ResponseFormat{Type: ResponseFormatJSONObject}, nil
+	case ResponseFormatJSONSchema:
+	default:
+		return nil, fmt.Errorf("response_format type %q is not supported", formatType)
+	}
+
+	definition, ok := spec["json_schema"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("response_format.json_schema is required")
+	}
+	format := &ResponseFormat{Type: ResponseFormatJSONSchema}
+	format.Name, _ = definition["name"].(string)
+	format.Strict, _ = definition["strict"].(bool)
+	format.schemaValue = definition["schema"]
+	if format.schemaValue == nil {
+		// OpenAI treats a missing schema as "any JSON value".
+		format.schemaValue = map[string]interface{}{}
+	}
+	var err error
+	if format.Schema, err = json.Marshal(format.schemaValue); err != nil {
+		return nil, fmt.Errorf("response_format.json_schema.schema: %w", err)
+	}
+	if format.compiled, err = toolruntime.CompileSchema(format.Schema); err != nil {
+		return nil, fmt.Errorf("response_format.json_schema.schema: %w", err)
+	}
+	return format, nil
+}
+
+// NativeFor reports whether llmMode hands the format to the provider, which
+// then constrains decoding itself. Anthropic and LM Studio's stateful API
+// have no equivalent, so their answers are validated and repaired here.
+func (f *ResponseFormat) NativeFor(llmMode string) bool {
+	switch strings.TrimSpace(strings.ToLower(llmMode)) {
+	case LLMModeAnthropic, "stateful":
+		return false
+	}
+	return true
+}
+
+// Apply moves the format into the field the provider reads, or removes it
+// and adds an instruction when the provider has none.
+func (f *ResponseFormat) Apply(reqMap map[string]interface{}, llmMode string) {
+	switch strings.TrimSpace(strings.ToLower(llmMode)) {
+	case LLMModeOllama:
+		delete(reqMap, "response_format")
+		if f.Type == ResponseFormatJSONSchema {
+			reqMap["format"] = f.schemaValue
+		} else {
+			reqMap["format"] = "json"
+		}
+	case LLMModeResponses:
+		delete(reqMap, "response_format")
+		textFormat := map[string]interface{}{"type": f.Type}
+		if f.Type == ResponseFormatJSONSchema {
+			name := strings.TrimSpace(f.Name)
+			if name == "" {
+				name = "response"
+			}
+			textFormat["name"] = name
+			textFormat["schema"] = f.schemaValue
+			textFormat["strict"] = f.Strict
+		}
+		reqMap["text"] = map[string]interface{}{"format": textFormat}
+	case LLMModeAnthropic, "stateful":
+		delete(reqMap, "response_format")
+		injectStructuredOutputInstructions(reqMap, f.instructions())
+	}
+}
+
+func (f *ResponseFormat) instructions() string {
+	instructions := "Respond with a single JSON value and nothing else: no markdown fences, no commentary."
+	if f.Type == ResponseFormatJSONSchema {
+		return instructions + "\nThe JSON must match this JSON Schema:\n" + string(f.Schema)
+	}
+	return instructions + "\nThe value must be a JSON object."
+}
+
+// injectStructuredOutputInstructions appends to the system prompt without
+// the history truncation promptkit.InjectPrompt applies to chat turns.
+func injectStructuredOutputInstructions(reqMap map[string]interface{}, instructions string) {
+	if systemPrompt, ok := reqMap["system_prompt"].(string); ok {
+		reqMap["system_prompt"] = strings.TrimSpace(systemPrompt + "\n\n" + instructions)
+		return
+	}
+	messages, ok := reqMap["messages"].([]interface{})
+	if !ok {
+		if _, stateful := reqMap["input"]; stateful {
+			reqMap["system_prompt"] = instructions
+		}
+		return
+	}
+	for _, message := range messages {
+		entry, _ := message.(map[string]interface{})
+		if role, _ := entry["role"].(string); role != "system" {
+			continue
+		}
+		if content, ok := entry["content"].(string); ok {
+			entry["content"] = strings.TrimSpace(content + "\n\n" + instructions)
+			return
+		}
+	}
+	reqMap["messages"] = append([]interface{}{
+		map[string]interface{}{"role": "system", "content": instructions},
+	}, messages...)
+}
+
+// Validate returns the JSON document in answer when it matches the format.
+// Models without constrained decoding often wrap JSON in a markdown fence or
+// a sentence, so the outermost object or array in the answer is checked.
+func (f *ResponseFormat) Validate(answer string) (string, error) {
+	document := ExtractJSONDocument(answer)
+	if document == "" {
+		return "", errors.New("answer does not contain a JSON value")
+	}
+	if f.Type == ResponseFormatJSONObject {
+		if !strings.HasPrefix(document, "{") {
+			return "", errors.New("answer must be a JSON object")
+		}
+		return document, nil
+	}
+	if err := f.compiled.Validate(json.RawMessage(document)); err != nil {
+		return "", err
+	}
+	return document, nil
+}
+
+// ExtractJSONDocument returns the JSON value in a model answer, unwrapping
+// a markdown fence or surrounding prose, or "" when there is none.
+func ExtractJSONDocument(answer string) string {
+	text := strings.TrimSpace(answer)
+	if fenced, ok := strings.CutPrefix(text, "```"); ok {
+		if newline := strings.IndexByte(fenced, '\n'); newline >= 0 {
+			fenced = fenced[newline+1:]
+		}
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(fenced), "```"))
+	}
+	if json.Valid([]byte(text)) {
+		return text
+	}
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return ""
+	}
+	closer := "}"
+	if text[start] == '[' {
+		closer = "]"
+	}
+	end := strings.LastIndex(text, closer)
+	if end < start {
+		return ""
+	}
+	if candidate := text[start : end+1]; json.Valid([]byte(candidate)) {
+		return candidate
+	}
+	return ""
+}
+
+type StructuredOutputRepairInput struct {
+	LLMMode        string
+	ModelID        string
+	LastResponseID string
+	ReqMap         map[string]interface{}
+	Format         *ResponseFormat
+	Answer         string
+	Problem        error
+}
+
+// PrepareStructuredOutputRepairRequest asks the model to return its previous
+// answer again in the requested format, the same way a malformed tool call
+// is corrected.
+func PrepareStructuredOutputRepairRequest(input StructuredOutputRepairInput) (map[string]interface{}, []byte, error) {
+	prompt := fmt.Sprintf(`[APP FORMAT CORRECTION — NOT A USER MESSAGE]
+Your previous answer did not match the required response format.
+Problem: %s
+%s
+
+Previous answer:
+%s`, compactText(input.Problem.Error(), 400), input.Format.instructions(), compactText(input.Answer, 2000))
+
+	reqMap := input.ReqMap
+	if strings.EqualFold(strings.TrimSpace(input.LLMMode), "stateful") {
+		reqMap = map[string]interface{}{
+			"model":       input.ModelID,
+			"input":       prompt,
+			"stream":      true,
+			"temperature": 0.1,
+		}
+		if IsValidResponseID(input.LastResponseID) {
+			reqMap["previous_response_id"] = strings.TrimSpace(input.LastResponseID)
+		}
+	} else {
+		if reqMap == nil {
+			reqMap = map[string]interface{}{"model": input.ModelID}
+		}
+		messages, _ := reqMap["messages"].([]interface{})
+		messages = append(messages,
+			map[string]interface{}{"role": "assistant", "content": input.Answer},
+			map[string]interface{}{"role": "user", "content": prompt},
+		)
+		reqMap["messages"] = messages
+		reqMap["stream"] = true
+		reqMap["temperature"] = 0.1
+	}
+	body, err := json.Marshal(reqMap)
+	return reqMap, body, err
+}
+
+// IsAnswerDelta reports whether an SSE data line carries visible answer
+// text: an app message.delta event or a Chat Completions chunk with content.
+func IsAnswerDelta(line string) bool {
+	data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+	if !ok {
+		return false
+	}
+	var event struct {
+		Type    string `json:"type"`
+		Choices []struct {
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+		return false
+	}
+	if event.Type == "message.delta" {
+		return true
+	}
+	for _, choice := range event.Choices {
+		if choice.Delta.Content != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const weatherResponseFormat = `{"type":"json_schema","json_schema":{"name":"weather","strict":true,"schema":{"type":"object","properties":{"city":{"type":"string"},"celsius":{"type":"number"}},"required":["city","celsius"],"additionalProperties":false}}}`
+
+func mustParseResponseFormat(t *testing.T, raw string) *ResponseFormat {
+	t.Helper()
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"response_format":`+raw+`}`), &reqMap); err != nil {
+		t.Fatal(err)
+	}
+	format, err := ParseResponseFormat(reqMap)
+	if err != nil {
+		t.Fatalf("ParseResponseFormat(%s): %v", raw, err)
+	}
+	return format
+}
+
+func TestParseResponseFormat(t *testing.T) {
+	if format := mustParseResponseFormat(t, `{"type":"text"}`); format != nil {
+		t.Fatalf("text format = %#v, want nil", format)
+	}
+	if format, err := ParseResponseFormat(map[string]interface{}{}); format != nil || err != nil {
+		t.Fatalf("absent format = %#v, %v", format, err)
+	}
+	if format := mustParseResponseFormat(t, `{"type":"json_object"}`); format.Type != ResponseFormatJSONObject {
+		t.Fatalf("json_object format = %#v", format)
+	}
+	format := mustParseResponseFormat(t, weatherResponseFormat)
+	if format.Type != ResponseFormatJSONSchema || format.Name != "weather" || !format.Strict || !strings.Contains(string(format.Schema), `"celsius"`) {
+		t.Fatalf("json_schema format = %#v", format)
+	}
+
+	for _, raw := range []string{
+		`"json"`,
+		`{"type":"yaml"}`,
+		`{"type":"json_schema"}`,
+		`{"type":"json_schema","json_schema":{"name":"x","schema":{"type":"strange"}}}`,
+	} {
+		var reqMap map[string]interface{}
+		json.Unmarshal([]byte(`{"response_format":`+raw+`}`), &reqMap)
+		if _, err := ParseResponseFormat(reqMap); err == nil {
+			t.Errorf("ParseResponseFormat(%s) must fail", raw)
+		}
+	}
+}
+
+func TestPrepareRequestAppliesResponseFormatPerMode(t *testing.T) {
+	body := `{"model":"test","messages":[{"role":"system","content":"Base."},{"role":"user","content":"weather in Seoul?"}],"response_format":` + weatherResponseFormat + `,"stream":true}`
+	format := mustParseResponseFormat(t, weatherResponseFormat)
+	tests := []struct {
+		mode  string
+		check func(t *testing.T, reqMap map[string]interface{}, system string)
+	}{
+		{"standard", func(t *testing.T, reqMap map[string]interface{}, system string) {
+			if _, ok := reqMap["response_format"].(map[string]interface{}); !ok {
+				t.Fatal("response_format must be forwarded")
+			}
+		}},
+		{LLMModeOllama, func(t *testing.T, reqMap map[string]interface{}, system string) {
+			schema, ok := reqMap["format"].(map[string]interface{})
+			if !ok || schema["type"] != "object" {
+				t.Fatalf("ollama format = %#v", reqMap["format"])
+			}
+		}},
+		{LLMModeResponses, func(t *testing.T, reqMap map[string]interface{}, system string) {
+			textFormat := reqMap["text"].(map[string]interface{})["format"].(map[string]interface{})
+			if textFormat["type"] != "json_schema" || textFormat["name"] != "weather" || textFormat["strict"] != true {
+				t.Fatalf("responses text.format = %#v", textFormat)
+			}
+		}},
+		{LLMModeAnthropic, func(t *testing.T, reqMap map[string]interface{}, system string) {
+			if !strings.HasPrefix(system, "Base.\n\n") || !strings.Contains(system, `"celsius"`) {
+				t.Fatalf("schema instructions missing from system prompt: %q", system)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			prepared, err := PrepareRequest(RequestInput{
+				Body:            []byte(body),
+				LLMMode:         tt.mode,
+				ContextStrategy: "retrieval",
+				EnableTools:     true,
+				EnableMemory:    true,
+				MemorySnapshot:  "User likes Fahrenheit.",
+				Tools:           testToolDefinitions(),
+				ResponseFormat:  format,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reqMap map[string]interface{}
+			if err := json.Unmarshal(prepared.Body, &reqMap); err != nil {
+				t.Fatal(err)
+			}
+			if _, exists := reqMap["tools"]; exists {
+				t.Fatal("tools must not be added to a structured request")
+			}
+			if tt.mode != "standard" {
+				if _, exists := reqMap["response_format"]; exists {
+					t.Fatal("response_format must be translated for the provider")
+				}
+			}
+			system := reqMap["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+			if strings.Contains(system, "Fahrenheit") || strings.Contains(system, "get_current_time") {
+				t.Fatalf("runtime instructions injected into a structured request: %q", system)
+			}
+			tt.check(t, reqMap, system)
+		})
+	}
+}
+
+func TestResponseFormatValidate(t *testing.T) {
+	format := mustParseResponseFormat(t, weatherResponseFormat)
+	tests := []struct {
+		answer  string
+		want    string
+		wantErr string
+	}{
+		{`{"city":"Seoul","celsius":21.5}`, `{"city":"Seoul","celsius":21.5}`, ""},
+		{"```json\n{\"city\":\"Seoul\",\"celsius\":21}\n```", `{"city":"Seoul","celsius":21}`, ""},
+		{`Here you go: {"city":"Seoul","celsius":21} Enjoy!`, `{"city":"Seoul","celsius":21}`, ""},
+		{`{"city":"Seoul","celsius":"warm"}`, "", "/celsius: must be a number"},
+		{`{"city":"Seoul"}`, "", "/celsius: is required"},
+		{`It is warm in Seoul.`, "", "does not contain a JSON value"},
+	}
+	for _, tt := range tests {
+		got, err := format.Validate(tt.answer)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate(%q) error = %v, want %q", tt.answer, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Validate(%q) = %q, %v; want %q", tt.answer, got, err, tt.want)
+		}
+	}
+
+	// Structured answers follow plain JSON Schema: empty strings and nulls
+	// are valid unless the schema itself rules them out.
+	tags := mustParseResponseFormat(t, `{"type":"json_schema","json_schema":{"name":"tags","schema":{"type":"object","properties":{"name":{"type":"string"},"note":{"type":["string","null"]},"tags":{"type":"array","items":{"type":"string"}},"code":{"type":"string","minLength":1}},"required":["name","note","tags"]}}}`)
+	for _, answer := range []string{`{"name":"","note":null,"tags":[""]}`, `{"name":"","note":"","tags":[],"code":"x"}`} {
+		if got, err := tags.Validate(answer); err != nil || got != answer {
+			t.Errorf("Validate(%q) = %q, %v; want the answer back", answer, got, err)
+		}
+	}
+	if _, err := tags.Validate(`{"name":"","note":null,"tags":[],"code":""}`); err == nil || !strings.Contains(err.Error(), "/code: must be at least 1 characters") {
+		t.Errorf("minLength must still apply, got %v", err)
+	}
+
+	object := mustParseResponseFormat(t, `{"type":"json_object"}`)
+	if _, err := object.Validate(`[1,2]`); err == nil {
+		t.Error("json_object must reject an array")
+	}
+}
+
+func TestPrepareStructuredOutputRepairRequest(t *testing.T) {
+	format := mustParseResponseFormat(t, weatherResponseFormat)
+	reqMap := map[string]interface{}{
+		"model":    "test",
+		"messages": []interface{}{map[string]interface{}{"role": "user", "content": "weather?"}},
+	}
+	repaired, _, err := PrepareStructuredOutputRepairRequest(StructuredOutputRepairInput{
+		LLMMode: LLMModeAnthropic,
+		ModelID: "test",
+		ReqMap:  reqMap,
+		Format:  format,
+		Answer:  "It is 21 degrees.",
+		Problem: errors.New("answer does not contain a JSON value"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := repaired["messages"].([]interface{})
+	if len(messages) != 3 || messages[1].(map[string]interface{})["content"] != "It is 21 degrees." {
+		t.Fatalf("repair messages = %#v", messages)
+	}
+	prompt := messages[2].(map[string]interface{})["content"].(string)
+	if !strings.Contains(prompt, "does not contain a JSON value") || !strings.Contains(prompt, `"celsius"`) {
+		t.Fatalf("repair prompt = %q", prompt)
+	}
+
+	stateful, _, err := PrepareStructuredOutputRepairRequest(StructuredOutputRepairInput{
+		LLMMode:        "stateful",
+		ModelID:        "test",
+		LastResponseID: "resp_0123456789abcdef",
+		Format:         format,
+		Answer:         "{}",
+		Problem:        errors.New("/city: is required"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stateful["previous_response_id"] != "resp_0123456789abcdef" || !strings.Contains(stateful["input"].(string), "/city: is required") {
+		t.Fatalf("stateful repair request = %#v", stateful)
+	}
+}
+
+func TestIsAnswerDelta(t *testing.T) {
+	for line, want := range map[string]bool{
+		`data: {"type":"message.delta","content":"{"}`:              true,
+		`data: {"choices":[{"delta":{"content":"{\"a\""}}]}`:        true,
+		`data: {"choices":[{"delta":{"reasoning_content":"hmm"}}]}`: false,
+		`data: {"choices":[{"delta":{},"finish_reason":"stop"}]}`:   false,
+		`data: {"type":"chat.end","result":{}}`:                     false,
+		`data: [DONE]`:                                              false,
+		`: keep-alive`:                                              false,
+	} {
+		if got := IsAnswerDelta(line); got != want {
+			t.Errorf("IsAnswerDelta(%s) = %v, want %v", line, got, want)
+		}
+	}
+}
@@ -9,3 +9,18 @@ func IsValidResponseID(id string) bool {
 	id = strings.TrimSpace(id)
 	return strings.HasPrefix(id, "resp_") && len(id) > len("resp_")
 }
+
+// IsUnknownPreviousResponseError reports whether an upstream error body says
+// the chained previous_response_id is no longer stored (or was never valid),
+// so the request can be retried without it.
+func IsUnknownPreviousResponseError(errorMsg string) bool {
+	lower := strings.ToLower(errorMsg)
+	if strings.Contains(lower, "could not find stored response for previous_response_id") ||
+		strings.Contains(lower, "previous_response_not_found") {
+		return true
+	}
+	if strings.Contains(lower, "previous_response_id") && strings.Contains(lower, "must start with") {
+		return true
+	}
+	return strings.Contains(lower, "previous response") && strings.Contains(lower, "not found")
+}
@@ -37,3 +37,17 @@ func TestPrepareToolFollowupRequestOmitsInvalidResponseID(t *testing.T) {
 		t.Fatal("invalid previous_response_id was forwarded")
 	}
 }
+
+func TestIsUnknownPreviousResponseError(t *testing.T) {
+	for message, want := range map[string]bool{
+		`{"error":"Could not find stored response for previous_response_id resp_1"}`:                                 true,
+		`{"error":{"message":"previous_response_id must start with 'resp_'"}}`:                                       true,
+		`{"error":{"message":"Previous response with id 'resp_1' not found.","code":"previous_response_not_found"}}`: true,
+		`{"error":{"message":"Response with id resp_1 not found"}}`:                                                  false,
+		`{"error":{"message":"context_length_exceeded"}}`:                                                            false,
+	} {
+		if got := IsUnknownPreviousResponseError(message); got != want {
+			t.Errorf("IsUnknownPreviousResponseError(%s) = %v, want %v", message, got, want)
+		}
+	}
+}
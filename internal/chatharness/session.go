@@ -193,7 +193,8 @@ func shouldUpdateSessionMessageSnapshot(eventType string) bool {
 
 func shouldPersistChatEvent(eventType string) bool {
 	switch strings.TrimSpace(eventType) {
-	case "skill.applied", "chat.end", "request.complete", "request.cancelled", "session.cleared", "generation.finished":
+	case "skill.applied", "chat.end", "request.complete", "request.cancelled", "session.cleared", "generation.finished",
+		"tool_call.approval_required", "tool_call.approval_resolved":
 		return true
 	default:
 		return false
@@ -574,7 +575,9 @@ func payloadInt64(value interface{}) (int64, bool) {
 	return 0, false
 }
 
-func extractFinalAssistantContent(payloadMap map[string]interface{}) string {
+// ExtractFinalAssistantContent reads the complete assistant message LM Studio
+// repeats in a chat.end payload.
+func ExtractFinalAssistantContent(payloadMap map[string]interface{}) string {
 	if payloadMap == nil {
 		return ""
 	}
@@ -602,13 +605,14 @@ func extractFinalAssistantContent(payloadMap map[string]interface{}) string {
 			}
 		}
 	}
-	if finalContent, ok := payloadMap["final_assistant_content"].(string); ok && finalContent != "" {
+	if finalContent, ok := payloadMap["final_assistant_content"].(string); ok && strings.TrimSpace(finalContent) != "" {
 		return finalContent
 	}
 	return ""
 }
 
-func extractReasoningContent(payloadMap map[string]interface{}) string {
+// ExtractReasoningContent joins the reasoning items of a chat.end payload.
+func ExtractReasoningContent(payloadMap map[string]interface{}) string {
 	if payloadMap == nil {
 		return ""
 	}
@@ -731,10 +735,10 @@ func updateMessageSnapshot(snapshot *SessionUISnapshot, turnID, role, eventType
 			msg.AssistantContent += content
 		}
 	case "chat.end", "request.complete":
-		if finalContent := extractFinalAssistantContent(payloadMap); finalContent != "" {
+		if finalContent := ExtractFinalAssistantContent(payloadMap); finalContent != "" {
 			msg.AssistantContent = finalContent
 		}
-		if reasoningContent := extractReasoningContent(payloadMap); reasoningContent != "" {
+		if reasoningContent := ExtractReasoningContent(payloadMap); reasoningContent != "" {
 			msg.ReasoningContent = reasoningContent
 		}
 		if totalMS, ok := payloadInt64(payloadMap["total_elapsed_ms"]); ok && totalMS > 0 {
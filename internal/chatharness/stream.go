@@ -1,15 +1,21 @@
 package chatharness
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type SSEEmitter struct {
 	w       http.ResponseWriter
 	flusher http.Flusher
 	active  bool
+	events  *EventSequencer
 }
 
 func NewSSEEmitter(w http.ResponseWriter) (*SSEEmitter, error) {
@@ -31,6 +37,14 @@ func (e *SSEEmitter) SetupHeaders() {
 	e.w.Header().Set("Access-Control-Allow-Origin", "*")
 }
 
+// Sequence wraps every following event in an EventEnvelope numbered by
+// events, dropping the duplicates it rejects.
+func (e *SSEEmitter) Sequence(events *EventSequencer) {
+	if e != nil {
+		e.events = events
+	}
+}
+
 func (e *SSEEmitter) Active() bool {
 	return e != nil && e.active
 }
@@ -39,7 +53,17 @@ func (e *SSEEmitter) EmitRaw(payload string) error {
 	if e == nil || !e.active {
 		return nil
 	}
-	if _, err := fmt.Fprintf(e.w, "%s\n\n", payload); err != nil {
+	var err error
+	if block, ok := e.envelopeBlock(payload); ok {
+		env, fresh := e.events.Next(EnvelopePayload(block.EventName, block.Data))
+		if !fresh {
+			return nil
+		}
+		err = WriteEnvelope(e.w, block.EventName, strconv.FormatInt(env.Seq, 10), env)
+	} else {
+		_, err = fmt.Fprintf(e.w, "%s\n\n", payload)
+	}
+	if err != nil {
 		e.active = false
 		return err
 	}
@@ -47,6 +71,27 @@ func (e *SSEEmitter) EmitRaw(payload string) error {
 	return nil
 }
 
+// envelopeBlock parses payload when events are sequenced. Comment-only
+// blocks such as keep-alives are written unchanged.
+func (e *SSEEmitter) envelopeBlock(payload string) (SSEBlock, bool) {
+	if e.events == nil {
+		return SSEBlock{}, false
+	}
+	block, err := ReadSSEBlock(bufio.NewReader(strings.NewReader(payload)))
+	if err != nil {
+		return SSEBlock{}, false
+	}
+	if strings.TrimSpace(block.Data) == "" {
+		// Some providers send bare JSON lines; they are forwarded as data.
+		raw := strings.TrimSpace(block.Raw)
+		if !strings.HasPrefix(raw, "{") {
+			return SSEBlock{}, false
+		}
+		block.Data = raw
+	}
+	return block, true
+}
+
 func (e *SSEEmitter) EmitDataJSON(payload interface{}) error {
 	if payload == nil {
 		return nil
@@ -69,8 +114,74 @@ func (e *SSEEmitter) SendError(msg string) {
 		},
 	}
 	_ = e.EmitDataJSON(payload)
-	if e != nil && e.active {
-		_, _ = fmt.Fprintf(e.w, "event: error\ndata: %s\n\n", msg)
-		e.flusher.Flush()
+	_ = e.EmitRaw(fmt.Sprintf("event: error\ndata: %s", msg))
+}
+
+// SSEBlock is one server-sent event from an upstream stream. Raw keeps the
+// original lines, including comments and bare JSON lines some providers
+// send without a data: field.
+type SSEBlock struct {
+	EventName string
+	Data      string
+	Raw       string
+}
+
+// ReadSSEBlock reads the next blank-line-terminated event. Multi-line data
+// fields are joined with newlines; io.EOF is returned only when no fields
+// remain.
+func ReadSSEBlock(reader *bufio.Reader) (SSEBlock, error) {
+	var (
+		block      SSEBlock
+		rawLines   []string
+		dataLines  []string
+		eventName  string
+		haveFields bool
+	)
+
+	flush := func() SSEBlock {
+		block.EventName = strings.TrimSpace(eventName)
+		block.Data = strings.Join(dataLines, "\n")
+		block.Raw = strings.Join(rawLines, "\n")
+		return block
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return SSEBlock{}, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if haveFields || len(rawLines) > 0 {
+				return flush(), nil
+			}
+			if errors.Is(err, io.EOF) {
+				return SSEBlock{}, io.EOF
+			}
+			continue
+		}
+
+		rawLines = append(rawLines, line)
+		haveFields = true
+
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			eventName = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			dataLine := strings.TrimPrefix(line, "data:")
+			if strings.HasPrefix(dataLine, " ") {
+				dataLine = dataLine[1:]
+			}
+			dataLines = append(dataLines, dataLine)
+		case strings.HasPrefix(line, ":"):
+			// SSE comment/heartbeat; preserve in Raw only.
+		default:
+			// Some providers emit raw JSON lines instead of proper SSE fields.
+		}
+
+		if errors.Is(err, io.EOF) {
+			return flush(), nil
+		}
 	}
 }
@@ -30,7 +30,9 @@ func ParseFunctionParameterToolCall(raw string) (ProviderToolCall, bool) {
 			args[key] = parseFunctionParameterValue(value)
 		}
 	}
-	if name == "" || len(args) == 0 {
+	// An empty function body is a call without arguments; a body with no
+	// recognizable parameters is not a call.
+	if name == "" || (len(args) == 0 && strings.TrimSpace(match[2]) != "") {
 		return ProviderToolCall{}, false
 	}
 	arguments, err := json.Marshal(args)
@@ -0,0 +1,562 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NormalizeRelaxedToolArgsJSON repairs the almost-JSON some local models emit
+// for tool arguments: Gemma-style <|"|> quote tokens and bare object keys. It
+// returns compact JSON, or false when the text still does not parse.
+func NormalizeRelaxedToolArgsJSON(raw string) (string, bool) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return "", false
+	}
+
+	trimmed = strings.NewReplacer(
+		`<|"|>`, `"`,
+		`<|'|>`, `'`,
+	).Replace(trimmed)
+
+	trimmed = quoteRelaxedJSONKeys(trimmed)
+
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(trimmed), &parsed); err != nil {
+		return "", false
+	}
+	bytes, err := json.Marshal(parsed)
+	if err != nil {
+		return "", false
+	}
+	return string(bytes), true
+}
+
+var (
+	relaxedJSONStringPattern = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+	relaxedJSONKeyPattern    = regexp.MustCompile(`([{\[,]\s*)([A-Za-z_][A-Za-z0-9_]*)\s*:`)
+)
+
+// quoteRelaxedJSONKeys quotes bare object keys outside string literals, so a
+// value such as "a,b:c" is left alone.
+func quoteRelaxedJSONKeys(raw string) string {
+	var out strings.Builder
+	last := 0
+	for _, loc := range relaxedJSONStringPattern.FindAllStringIndex(raw, -1) {
+		out.WriteString(relaxedJSONKeyPattern.ReplaceAllString(raw[last:loc[0]], `$1"$2":`))
+		out.WriteString(raw[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	out.WriteString(relaxedJSONKeyPattern.ReplaceAllString(raw[last:], `$1"$2":`))
+	return out.String()
+}
+
+// NormalizeBufferedToolMatch unwraps a {"name", "arguments"} style wrapper
+// (and its tool/tool_name/parameters/params aliases) from buffered tool
+// arguments. The final result reports whether such a wrapper was found;
+// otherwise toolName is returned with the arguments as given.
+func NormalizeBufferedToolMatch(toolName string, toolArgsStr string) (string, string, interface{}, bool) {
+	toolName = strings.TrimSpace(toolName)
+	toolArgsStr = strings.TrimSpace(toolArgsStr)
+
+	if toolArgsStr != "" && !json.Valid([]byte(toolArgsStr)) {
+		if normalized, ok := NormalizeRelaxedToolArgsJSON(toolArgsStr); ok {
+			toolArgsStr = normalized
+		}
+	}
+
+	var wrapper struct {
+		Name          string      `json:"name"`
+		Tool          string      `json:"tool"`
+		ToolName      string      `json:"tool_name"`
+		Arguments     interface{} `json:"arguments"`
+		ToolArguments interface{} `json:"tool_arguments"`
+		Parameters    interface{} `json:"parameters"`
+		Params        interface{} `json:"params"`
+	}
+	if err := json.Unmarshal([]byte(toolArgsStr), &wrapper); err == nil {
+		wrapperName := strings.TrimSpace(wrapper.Name)
+		if wrapperName == "" {
+			wrapperName = strings.TrimSpace(wrapper.Tool)
+		}
+		if wrapperName == "" {
+			wrapperName = strings.TrimSpace(wrapper.ToolName)
+		}
+		wrapperArguments := wrapper.Arguments
+		if wrapperArguments == nil {
+			wrapperArguments = wrapper.ToolArguments
+		}
+		if wrapperArguments == nil {
+			wrapperArguments = wrapper.Parameters
+		}
+		if wrapperArguments == nil {
+			wrapperArguments = wrapper.Params
+		}
+		if wrapperName != "" {
+			if wrapperArguments == nil {
+				wrapperArguments = map[string]interface{}{}
+			}
+			argumentBytes, marshalErr := json.Marshal(wrapperArguments)
+			if marshalErr == nil {
+				return wrapperName, string(argumentBytes), wrapperArguments, true
+			}
+		}
+	}
+
+	var args interface{}
+	if err := json.Unmarshal([]byte(toolArgsStr), &args); err == nil {
+		return toolName, toolArgsStr, args, false
+	}
+	return toolName, toolArgsStr, nil, false
+}
+
+// ParseJSONToolCall recognizes a bare or ```json fenced wrapper object such as
+// {"name":"search_web","arguments":{"query":"..."}}.
+func ParseJSONToolCall(raw string) (string, string, interface{}, bool) {
+	trimmed := strings.TrimSpace(raw)
+	if strings.HasPrefix(trimmed, "```") {
+		match := regexp.MustCompile("(?is)^```(?:json)?\\s*([\\s\\S]*?)\\s*```").FindStringSubmatch(trimmed)
+		if len(match) < 2 {
+			return "", "", nil, false
+		}
+		trimmed = strings.TrimSpace(match[1])
+	}
+	if !strings.HasPrefix(trimmed, "{") || !strings.HasSuffix(trimmed, "}") {
+		return "", "", nil, false
+	}
+	name, argumentsJSON, arguments, wrapper := NormalizeBufferedToolMatch("", trimmed)
+	if !wrapper || strings.TrimSpace(name) == "" || arguments == nil {
+		return "", "", nil, false
+	}
+	return name, argumentsJSON, arguments, true
+}
+
+// ParseXMLLikeToolCall recognizes <tool_name>...</tool_name> calls, optionally
+// inside <tool_call>. The body may be JSON, <arg_key>/<arg_value> pairs, one
+// tag per argument, or plain text for tools with an implicit query argument.
+func ParseXMLLikeToolCall(raw string) (string, string, interface{}, bool) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return "", "", nil, false
+	}
+
+	for {
+		wrapperMatch := regexp.MustCompile(`(?s)^<tool_call>\s*([\s\S]*?)\s*</tool_call>\s*$`).FindStringSubmatch(trimmed)
+		if len(wrapperMatch) < 2 {
+			break
+		}
+		unwrapped := strings.TrimSpace(wrapperMatch[1])
+		if unwrapped == "" || unwrapped == trimmed {
+			break
+		}
+		trimmed = unwrapped
+	}
+
+	toolOpen := regexp.MustCompile(`(?s)<([a-zA-Z_][a-zA-Z0-9_]*)\b[^>]*>`)
+	openMatch := toolOpen.FindStringSubmatch(trimmed)
+	if len(openMatch) < 2 {
+		return "", "", nil, false
+	}
+
+	toolName := strings.TrimSpace(openMatch[1])
+	switch toolName {
+	case "tool_call", "remark", "think", "arg_key", "arg_value":
+		return "", "", nil, false
+	}
+
+	// Match the closing tag on the original text: lowercasing can change the
+	// byte length of non-ASCII text and shift the index.
+	closeMatches := regexp.MustCompile(`(?i)</`+regexp.QuoteMeta(toolName)+`>`).FindAllStringIndex(trimmed, -1)
+	if len(closeMatches) == 0 {
+		return "", "", nil, false
+	}
+	closeIdx := closeMatches[len(closeMatches)-1][0]
+
+	bodyStart := strings.Index(trimmed, ">")
+	if bodyStart < 0 || bodyStart >= closeIdx {
+		return "", "", nil, false
+	}
+	body := trimmed[bodyStart+1 : closeIdx]
+	body = strings.TrimSpace(body)
+	if body == "" {
+		emptyArgs := map[string]interface{}{}
+		return toolName, `{}`, emptyArgs, true
+	}
+	if body != "" {
+		var jsonArgs interface{}
+		if err := json.Unmarshal([]byte(body), &jsonArgs); err == nil {
+			argBytes, marshalErr := json.Marshal(jsonArgs)
+			if marshalErr == nil {
+				return toolName, string(argBytes), jsonArgs, true
+			}
+		}
+	}
+
+	argPattern := regexp.MustCompile(`(?s)<arg_key>\s*([^<]+?)\s*</arg_key>\s*<arg_value>\s*([\s\S]*?)\s*</arg_value>`)
+	argMatches := argPattern.FindAllStringSubmatch(body, -1)
+	args := map[string]interface{}{}
+	for _, match := range argMatches {
+		if len(match) < 3 {
+			continue
+		}
+		key := strings.TrimSpace(match[1])
+		value := strings.TrimSpace(match[2])
+		if key == "" {
+			continue
+		}
+		args[key] = value
+	}
+
+	if len(args) == 0 {
+		tagArgPattern := regexp.MustCompile(`(?s)<([a-zA-Z_][a-zA-Z0-9_]*)>\s*([^<]*?)\s*</([a-zA-Z_][a-zA-Z0-9_]*)>`)
+		for _, match := range tagArgPattern.FindAllStringSubmatch(body, -1) {
+			if len(match) < 4 || !strings.EqualFold(strings.TrimSpace(match[1]), strings.TrimSpace(match[3])) {
+				continue
+			}
+			key := strings.TrimSpace(match[1])
+			value := strings.TrimSpace(match[2])
+			if key != "" && value != "" {
+				args[key] = value
+			}
+		}
+	}
+	if len(args) == 0 {
+		if !strings.Contains(body, "<") && !strings.Contains(body, ">") {
+			if argsJSON, implicitArgs, ok := BuildImplicitToolArgs(toolName, body, ""); ok {
+				return toolName, argsJSON, implicitArgs, true
+			}
+		}
+		return "", "", nil, false
+	}
+
+	argBytes, err := json.Marshal(args)
+	if err != nil {
+		return "", "", nil, false
+	}
+	return toolName, string(argBytes), args, true
+}
+
+// BuildImplicitToolArgs maps the free text a model put inside a tool tag to the
+// single argument the built-in tool expects, falling back to userText.
+func BuildImplicitToolArgs(toolName string, explicitText string, userText string) (string, interface{}, bool) {
+	trimmedExplicit := strings.TrimSpace(explicitText)
+	trimmedUser := strings.TrimSpace(userText)
+	queryText := trimmedExplicit
+	if queryText == "" {
+		queryText = trimmedUser
+	}
+	switch strings.TrimSpace(toolName) {
+	case "search_memory", "search_web", "search_web_multi", "naver_search", "namu_wiki", "read_help":
+		if queryText == "" {
+			return "", nil, false
+		}
+		args := map[string]interface{}{"query": queryText}
+		argBytes, err := json.Marshal(args)
+		if err != nil {
+			return "", nil, false
+		}
+		return string(argBytes), args, true
+	case "save_user_fact":
+		if queryText == "" {
+			return "", nil, false
+		}
+		args := map[string]interface{}{"fact_key": "user_fact", "fact_value": queryText}
+		argBytes, err := json.Marshal(args)
+		if err != nil {
+			return "", nil, false
+		}
+		return string(argBytes), args, true
+	case "delete_user_fact":
+		if queryText == "" {
+			return "", nil, false
+		}
+		args := map[string]interface{}{"fact_key": queryText}
+		argBytes, err := json.Marshal(args)
+		if err != nil {
+			return "", nil, false
+		}
+		return string(argBytes), args, true
+	case "read_web_page":
+		if queryText == "" {
+			return "", nil, false
+		}
+		args := map[string]interface{}{"url": queryText}
+		argBytes, err := json.Marshal(args)
+		if err != nil {
+			return "", nil, false
+		}
+		return string(argBytes), args, true
+	case "read_buffered_source":
+		if queryText == "" {
+			args := map[string]interface{}{}
+			argBytes, err := json.Marshal(args)
+			if err != nil {
+				return "", nil, false
+			}
+			return string(argBytes), args, true
+		}
+		args := map[string]interface{}{"query": queryText}
+		argBytes, err := json.Marshal(args)
+		if err != nil {
+			return "", nil, false
+		}
+		return string(argBytes), args, true
+	case "get_current_time", "get_current_location":
+		args := map[string]interface{}{}
+		argBytes, err := json.Marshal(args)
+		if err != nil {
+			return "", nil, false
+		}
+		return string(argBytes), args, true
+	default:
+		return "", nil, false
+	}
+}
+
+// ParseBareToolCallTag recognizes <tool_call>name</tool_call> and
+// <tool_call>name: query</tool_call> for built-in tools with implicit
+// arguments.
+func ParseBareToolCallTag(raw string, userText string) (string, string, interface{}, bool) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return "", "", nil, false
+	}
+	match := regexp.MustCompile(`(?s)<tool_call>\s*([\s\S]*?)\s*</tool_call>`).FindStringSubmatch(trimmed)
+	if len(match) < 2 {
+		return "", "", nil, false
+	}
+	inner := strings.TrimSpace(match[1])
+	if inner == "" {
+		return "", "", nil, false
+	}
+
+	toolName := ""
+	explicitQuery := ""
+	if explicit := regexp.MustCompile(`(?s)^([a-zA-Z_][a-zA-Z0-9_]*)(?:\s*[:=]\s*|\s+query\s*[:=]\s*)(.+)$`).FindStringSubmatch(inner); len(explicit) >= 3 {
+		toolName = strings.TrimSpace(explicit[1])
+		explicitQuery = strings.TrimSpace(explicit[2])
+	} else if compact := regexp.MustCompile(`(?s)^(search_memory|search_web|naver_search|namu_wiki|read_buffered_source|read_help)\s*query\s*[:=]\s*(.+)$`).FindStringSubmatch(inner); len(compact) >= 3 {
+		toolName = strings.TrimSpace(compact[1])
+		explicitQuery = strings.TrimSpace(compact[2])
+	} else {
+		toolName = inner
+	}
+	if toolName == "" {
+		return "", "", nil, false
+	}
+	argsJSON, args, ok := BuildImplicitToolArgs(toolName, explicitQuery, userText)
+	if !ok {
+		return "", "", nil, false
+	}
+	return toolName, argsJSON, args, true
+}
+
+// ParsePromptToolMarkup is the entry point for completed textual tool calls in
+// prompt-tool mode. It tries each recovery format in turn and returns the
+// tool name, its arguments as JSON and decoded.
+func ParsePromptToolMarkup(raw string) (string, string, interface{}, bool) {
+	trimmed := strings.TrimSpace(raw)
+	if call, ok := ParseFunctionParameterToolCall(trimmed); ok {
+		var arguments interface{}
+		if err := json.Unmarshal([]byte(call.Arguments), &arguments); err == nil {
+			return call.Name, call.Arguments, arguments, true
+		}
+	}
+	if name, argumentsJSON, arguments, ok := ParseJSONToolCall(trimmed); ok {
+		return name, argumentsJSON, arguments, true
+	}
+	if name, argumentsJSON, arguments, ok := ParseToolCodeCall(trimmed); ok {
+		return name, argumentsJSON, arguments, true
+	}
+	if strings.HasPrefix(strings.ToLower(trimmed), "<tool_call>") {
+		match := regexp.MustCompile(`(?s)^\s*<tool_call>\s*([\s\S]*?)\s*</tool_call>\s*$`).FindStringSubmatch(raw)
+		if len(match) < 2 {
+			return "", "", nil, false
+		}
+		name, argumentsJSON, arguments, _ := NormalizeBufferedToolMatch("", strings.TrimSpace(match[1]))
+		if strings.TrimSpace(name) == "" || arguments == nil {
+			return "", "", nil, false
+		}
+		return name, argumentsJSON, arguments, true
+	}
+	if name, argumentsJSON, arguments, ok := ParseXMLLikeToolCall(raw); ok {
+		return name, argumentsJSON, arguments, true
+	}
+	if name, argumentsJSON, arguments, ok := ParseFunctionLikeToolCall(raw); ok {
+		return name, argumentsJSON, arguments, true
+	}
+	return "", "", nil, false
+}
+
+// stripLeadingPromptToolArtifacts is a final defense for an already-completed
+// textual tool wrapper. Streaming paths should quarantine these before they
+// reach the answer, but keeping them out of request.complete and persisted
+// assistant history prevents an upstream format variation from resurfacing as
+// a visible fenced JSON block.
+
+// ParseToolCodeCall recognizes <tool_code>name(key="value")</tool_code>, with
+// or without a print(...) wrapper.
+func ParseToolCodeCall(raw string) (string, string, interface{}, bool) {
+	trimmed := strings.TrimSpace(raw)
+	match := regexp.MustCompile(`(?is)^\s*(?:<tool_code>|<\|tool_code\|>)\s*([\s\S]*?)\s*(?:</tool_code>|<\|/tool_code\|>)\s*$`).FindStringSubmatch(trimmed)
+	if len(match) < 2 {
+		return "", "", nil, false
+	}
+	body := strings.TrimSpace(match[1])
+	if printMatch := regexp.MustCompile(`(?is)^print\s*\(([\s\S]*)\)\s*$`).FindStringSubmatch(body); len(printMatch) >= 2 {
+		body = strings.TrimSpace(printMatch[1])
+	}
+	return ParseFunctionLikeToolCall(body)
+}
+
+// ParseFunctionLikeToolCall recognizes Python-style keyword calls such as
+// read_web_page(url="https://go.dev"). Positional arguments are rejected.
+func ParseFunctionLikeToolCall(raw string) (string, string, interface{}, bool) {
+	match := regexp.MustCompile(`(?s)^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\(([\s\S]*)\)\s*$`).FindStringSubmatch(raw)
+	if len(match) < 3 {
+		return "", "", nil, false
+	}
+	toolName := strings.TrimSpace(match[1])
+	inner := strings.TrimSpace(match[2])
+	args := map[string]interface{}{}
+	if inner != "" {
+		parts, ok := SplitFunctionLikeArguments(inner)
+		if !ok {
+			return "", "", nil, false
+		}
+		keyPattern := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+		for _, part := range parts {
+			assignment := topLevelAssignmentIndex(part)
+			if assignment < 0 {
+				return "", "", nil, false
+			}
+			key := strings.TrimSpace(part[:assignment])
+			if !keyPattern.MatchString(key) {
+				return "", "", nil, false
+			}
+			value, ok := parseFunctionLikeValue(strings.TrimSpace(part[assignment+1:]))
+			if !ok {
+				return "", "", nil, false
+			}
+			args[key] = value
+		}
+	}
+	argumentsJSON, err := json.Marshal(args)
+	if err != nil {
+		return "", "", nil, false
+	}
+	return toolName, string(argumentsJSON), args, true
+}
+
+// SplitFunctionLikeArguments splits call arguments on top-level commas,
+// respecting quotes and brackets. It fails on unbalanced input or an empty
+// argument.
+func SplitFunctionLikeArguments(raw string) ([]string, bool) {
+	parts := []string{}
+	start := 0
+	quote := byte(0)
+	escaped := false
+	depth := 0
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if quote != 0 {
+			if escaped {
+				escaped = false
+				continue
+			}
+			if ch == '\\' {
+				escaped = true
+				continue
+			}
+			if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch ch {
+		case '\'', '"':
+			quote = ch
+		case '{', '[', '(':
+			depth++
+		case '}', ']', ')':
+			depth--
+			if depth < 0 {
+				return nil, false
+			}
+		case ',':
+			if depth == 0 {
+				part := strings.TrimSpace(raw[start:i])
+				if part == "" {
+					return nil, false
+				}
+				parts = append(parts, part)
+				start = i + 1
+			}
+		}
+	}
+	if quote != 0 || escaped || depth != 0 {
+		return nil, false
+	}
+	last := strings.TrimSpace(raw[start:])
+	if last == "" {
+		return nil, false
+	}
+	return append(parts, last), true
+}
+
+func topLevelAssignmentIndex(raw string) int {
+	quote := byte(0)
+	escaped := false
+	depth := 0
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if quote != 0 {
+			if escaped {
+				escaped = false
+			} else if ch == '\\' {
+				escaped = true
+			} else if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch ch {
+		case '\'', '"':
+			quote = ch
+		case '{', '[', '(':
+			depth++
+		case '}', ']', ')':
+			depth--
+		case '=':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parseFunctionLikeValue(raw string) (interface{}, bool) {
+	if raw == "" {
+		return nil, false
+	}
+	if strings.HasPrefix(raw, `"`) {
+		value, err := strconv.Unquote(raw)
+		return value, err == nil
+	}
+	if strings.HasPrefix(raw, "'") && strings.HasSuffix(raw, "'") && len(raw) >= 2 {
+		inner := raw[1 : len(raw)-1]
+		inner = strings.NewReplacer(`\\`, `\`, `\'`, `'`, `\n`, "\n", `\t`, "\t").Replace(inner)
+		return inner, true
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err == nil {
+		return value, true
+	}
+	if strings.ContainsAny(raw, ",()") {
+		return nil, false
+	}
+	return raw, true
+}
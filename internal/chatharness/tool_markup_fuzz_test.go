@@ -0,0 +1,224 @@
+package chatharness
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var fuzzToolNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// addCapturedSeeds seeds f with the captured LM Studio and llama.cpp outputs
+// in testdata whose names match pattern.
+func addCapturedSeeds(f *testing.F, pattern string, extra ...string) {
+	f.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", pattern))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(data))
+	}
+	for _, seed := range extra {
+		f.Add(seed)
+	}
+}
+
+// checkParsedToolCall asserts the contract every recovery parser shares: a
+// recognized call has a trimmed, non-empty name and JSON arguments that
+// decode to the returned value. JSON wrappers may carry any name string; the
+// caller checks it against the registered tools.
+func checkParsedToolCall(t *testing.T, raw, name, argumentsJSON string, arguments interface{}) {
+	t.Helper()
+	if name == "" || name != strings.TrimSpace(name) {
+		t.Fatalf("%q: invalid tool name %q", raw, name)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(argumentsJSON), &decoded); err != nil {
+		t.Fatalf("%q: arguments are not JSON: %s", raw, argumentsJSON)
+	}
+	if arguments == nil {
+		t.Fatalf("%q: arguments value missing for %s", raw, argumentsJSON)
+	}
+	// Invalid UTF-8 is replaced when arguments are encoded, so only valid
+	// input must decode back to the same value.
+	if utf8.ValidString(raw) && !reflect.DeepEqual(decoded, arguments) {
+		t.Fatalf("%q: arguments %s do not match value %#v", raw, argumentsJSON, arguments)
+	}
+}
+
+func FuzzParsePromptToolMarkup(f *testing.F) {
+	addCapturedSeeds(f, "toolmarkup/*.txt",
+		`<tool_call>{"name":"get_current_time","arguments":{}}</tool_call>`,
+		`<get_current_time></get_current_time>`,
+		`<tool_call><tool_call>x</tool_call></tool_call>`,
+	)
+	f.Fuzz(func(t *testing.T, raw string) {
+		name, argumentsJSON, arguments, ok := ParsePromptToolMarkup(raw)
+		if ok {
+			checkParsedToolCall(t, raw, name, argumentsJSON, arguments)
+		}
+	})
+}
+
+func FuzzParseXMLLikeToolCall(f *testing.F) {
+	addCapturedSeeds(f, "toolmarkup/*.txt",
+		`<search_web>ȺȺȺȺȺ</search_web>`,
+		`<read_memory><memory_id>216</memory_id></read_memory>`,
+		`<think>x</think>`,
+	)
+	f.Fuzz(func(t *testing.T, raw string) {
+		name, argumentsJSON, arguments, ok := ParseXMLLikeToolCall(raw)
+		if !ok {
+			return
+		}
+		checkParsedToolCall(t, raw, name, argumentsJSON, arguments)
+		if !fuzzToolNamePattern.MatchString(name) {
+			t.Fatalf("%q: tag name %q is not an identifier", raw, name)
+		}
+		switch name {
+		case "tool_call", "remark", "think", "arg_key", "arg_value":
+			t.Fatalf("%q: reserved tag %q parsed as a tool", raw, name)
+		}
+	})
+}
+
+func FuzzParseFunctionLikeToolCall(f *testing.F) {
+	addCapturedSeeds(f, "toolmarkup/*function_like.txt",
+		`get_current_time()`,
+		`search_web(query='it\'s', limit=3, safe=true)`,
+		`f(a=(1, 2), b=[3, 4])`,
+		`f(a="unterminated)`,
+	)
+	f.Fuzz(func(t *testing.T, raw string) {
+		name, argumentsJSON, arguments, ok := ParseFunctionLikeToolCall(raw)
+		if !ok {
+			return
+		}
+		checkParsedToolCall(t, raw, name, argumentsJSON, arguments)
+		if !fuzzToolNamePattern.MatchString(name) {
+			t.Fatalf("%q: function name %q is not an identifier", raw, name)
+		}
+		if _, isObject := arguments.(map[string]interface{}); !isObject {
+			t.Fatalf("%q: arguments %T are not an object", raw, arguments)
+		}
+	})
+}
+
+func FuzzSplitFunctionLikeArguments(f *testing.F) {
+	for _, seed := range []string{
+		`source_id="src_18c83936c25763f0", query="게시글의 주요 내용과 운영자의 사과/해명 내용을 요약해 주세요."`,
+		`a=1, b='x,y', c=[1, 2], d={"k": "v,w"}`,
+		`a="\"", b=2`,
+		`a=(1,`,
+		`,`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		parts, ok := SplitFunctionLikeArguments(raw)
+		if !ok {
+			return
+		}
+		if len(parts) == 0 {
+			t.Fatalf("%q: no parts", raw)
+		}
+		offset := 0
+		for _, part := range parts {
+			if part == "" || part != strings.TrimSpace(part) {
+				t.Fatalf("%q: part %q is empty or untrimmed", raw, part)
+			}
+			index := strings.Index(raw[offset:], part)
+			if index < 0 {
+				t.Fatalf("%q: part %q is not in order", raw, part)
+			}
+			offset += index + len(part)
+		}
+		// Parts end at top level, so splitting them again is stable.
+		again, ok := SplitFunctionLikeArguments(strings.Join(parts, ", "))
+		if !ok || !reflect.DeepEqual(again, parts) {
+			t.Fatalf("%q: re-split %q = %q, %v", raw, parts, again, ok)
+		}
+	})
+}
+
+func FuzzNormalizeRelaxedToolArgsJSON(f *testing.F) {
+	addCapturedSeeds(f, "toolmarkup/lmstudio_gemma_relaxed_args.txt",
+		`{query:<|"|>오늘 서울 날씨<|"|>}`,
+		`{query:"a,b:c", "note":"{x:1}"}`,
+		`[{a:1},{b:[2,3]}]`,
+		`{"a":"\"",b:2}`,
+	)
+	f.Fuzz(func(t *testing.T, raw string) {
+		normalized, ok := NormalizeRelaxedToolArgsJSON(raw)
+		if !ok {
+			return
+		}
+		if !json.Valid([]byte(normalized)) {
+			t.Fatalf("%q: normalized to invalid JSON %q", raw, normalized)
+		}
+		if again, ok := NormalizeRelaxedToolArgsJSON(normalized); !ok || again != normalized {
+			t.Fatalf("%q: normalizing %q again gave %q, %v", raw, normalized, again, ok)
+		}
+	})
+}
+
+func FuzzReadSSEBlock(f *testing.F) {
+	addCapturedSeeds(f, "toolmarkup/*.sse")
+	addCapturedSeeds(f, "providers/*.sse",
+		"data: a\ndata: b\n\n",
+		"event: error\r\ndata: boom",
+		"\n\n\n: ping\n\n{\"raw\":true}\n",
+	)
+	f.Fuzz(func(t *testing.T, raw string) {
+		var wantLines []string
+		for _, line := range strings.Split(raw, "\n") {
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				wantLines = append(wantLines, line)
+			}
+		}
+
+		reader := bufio.NewReader(strings.NewReader(raw))
+		var gotLines []string
+		for blocks := 0; ; blocks++ {
+			if blocks > len(raw) {
+				t.Fatalf("%q: reader did not reach EOF", raw)
+			}
+			block, err := ReadSSEBlock(reader)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%q: %v", raw, err)
+			}
+			if block.Raw == "" {
+				t.Fatalf("%q: empty block", raw)
+			}
+			var data []string
+			for _, line := range strings.Split(block.Raw, "\n") {
+				if value, found := strings.CutPrefix(line, "data:"); found {
+					data = append(data, strings.TrimPrefix(value, " "))
+				}
+			}
+			if block.Data != strings.Join(data, "\n") {
+				t.Fatalf("%q: data %q does not match raw %q", raw, block.Data, block.Raw)
+			}
+			gotLines = append(gotLines, strings.Split(block.Raw, "\n")...)
+		}
+		if !reflect.DeepEqual(gotLines, wantLines) {
+			t.Fatalf("%q: blocks kept lines %q, want %q", raw, gotLines, wantLines)
+		}
+	})
+}
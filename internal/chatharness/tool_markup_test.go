@@ -0,0 +1,276 @@
+package chatharness
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeBufferedToolMatchUnwrapsAppToolCall(t *testing.T) {
+	name, argumentsJSON, _, wrapper := NormalizeBufferedToolMatch("", `{"name":"search_web","arguments":{"query":"latest news"}}`)
+	if !wrapper {
+		t.Fatal("canonical app tool call was not recognized as a wrapper")
+	}
+	if name != "search_web" {
+		t.Fatalf("got tool name %q", name)
+	}
+	if argumentsJSON != `{"query":"latest news"}` {
+		t.Fatalf("wrapper was forwarded instead of arguments: %s", argumentsJSON)
+	}
+}
+
+func TestParseJSONToolCallAcceptsLocalModelAliases(t *testing.T) {
+	tests := []struct {
+		raw  string
+		name string
+		args string
+	}{
+		{`{"tool":"search_web","arguments":{"query":"MCP 도구 검증 테스트"}}`, "search_web", `{"query":"MCP 도구 검증 테스트"}`},
+		{`{"tool":"read_buffered_source","parameters":{"source_id":"src_123","query":"Engine 핵심 기능"}}`, "read_buffered_source", `{"query":"Engine 핵심 기능","source_id":"src_123"}`},
+		{"```json\n{\"name\":\"get_current_time\",\"arguments\":{}}\n```", "get_current_time", `{}`},
+		{"```json\n{\"tool\":\"get_current_location\",\"params\":{}}\n```\n도구를 실행하겠습니다.", "get_current_location", `{}`},
+		{`{"thought":"next","tool_name":"read_help","tool_arguments":{"query":"도구"}}`, "read_help", `{"query":"도구"}`},
+	}
+	for _, test := range tests {
+		name, argumentsJSON, arguments, ok := ParseJSONToolCall(test.raw)
+		if !ok || name != test.name || argumentsJSON != test.args || arguments == nil {
+			t.Fatalf("ParseJSONToolCall(%q) = name=%q args=%q parsed=%#v ok=%v", test.raw, name, argumentsJSON, arguments, ok)
+		}
+	}
+}
+
+func TestParseToolCodeCallAcceptsPrintedFunctionSyntax(t *testing.T) {
+	raw := `<tool_code>
+print(read_buffered_source(source_id="src_18c835144500", query="What is Engine? Features, installation, usage examples, architecture"))
+</tool_code>`
+	name, argumentsJSON, arguments, ok := ParsePromptToolMarkup(raw)
+	if !ok || name != "read_buffered_source" || arguments == nil {
+		t.Fatalf("tool_code wrapper was not parsed: name=%q args=%q parsed=%#v ok=%v", name, argumentsJSON, arguments, ok)
+	}
+	if argumentsJSON != `{"query":"What is Engine? Features, installation, usage examples, architecture","source_id":"src_18c835144500"}` {
+		t.Fatalf("unexpected tool_code arguments: %s", argumentsJSON)
+	}
+}
+
+func TestParseXMLLikeToolCallAcceptsToolSpecificJSON(t *testing.T) {
+	name, argumentsJSON, arguments, ok := ParseXMLLikeToolCall(`<get_current_time>{}</get_current_time>`)
+	if name != "get_current_time" || argumentsJSON != `{}` || arguments == nil || !ok {
+		t.Fatalf("unexpected no-arg tool parse: name=%q args=%q parsed=%#v ok=%v", name, argumentsJSON, arguments, ok)
+	}
+
+	name, argumentsJSON, _, _ = ParseXMLLikeToolCall(`<execute_command>{"command":"uptime"}</execute_command>`)
+	if name != "execute_command" || argumentsJSON != `{"command":"uptime"}` {
+		t.Fatalf("unexpected command parse: name=%q args=%q", name, argumentsJSON)
+	}
+}
+
+func TestParseXMLLikeToolCallAcceptsEmptyNoArgumentElement(t *testing.T) {
+	name, argumentsJSON, arguments, ok := ParseXMLLikeToolCall(`<get_current_time></get_current_time>`)
+	if name != "get_current_time" || argumentsJSON != `{}` || arguments == nil || !ok {
+		t.Fatalf("unexpected empty-element parse: name=%q args=%q parsed=%#v ok=%v", name, argumentsJSON, arguments, ok)
+	}
+}
+
+func TestParseXMLLikeToolCallAcceptsRawTextBody(t *testing.T) {
+	name, argumentsJSON, arguments, ok := ParseXMLLikeToolCall(`<search_memory>나를 주인님이라고 부르기로 한거</search_memory>`)
+	if !ok || name != "search_memory" || argumentsJSON != `{"query":"나를 주인님이라고 부르기로 한거"}` || arguments == nil {
+		t.Fatalf("unexpected raw-text XML tool parse: name=%q args=%q ok=%v", name, argumentsJSON, ok)
+	}
+
+	name, argumentsJSON, _, ok = ParseXMLLikeToolCall(`<save_user_fact>나를 주인님이라고 부르기로 한거</save_user_fact>`)
+	if !ok || name != "save_user_fact" || argumentsJSON != `{"fact_key":"user_fact","fact_value":"나를 주인님이라고 부르기로 한거"}` {
+		t.Fatalf("unexpected raw-text save_user_fact parse: name=%q args=%q ok=%v", name, argumentsJSON, ok)
+	}
+}
+
+func TestParsePromptToolMarkupAcceptsLegacyWrapper(t *testing.T) {
+	name, argumentsJSON, _, ok := ParsePromptToolMarkup(`<tool_call>{"name":"get_current_time","arguments":{}}</tool_call>`)
+	if !ok || name != "get_current_time" || argumentsJSON != `{}` {
+		t.Fatalf("legacy wrapper was not normalized: name=%q args=%q ok=%v", name, argumentsJSON, ok)
+	}
+}
+
+func TestParsePromptToolMarkupAcceptsQwenFunctionParameterWrapper(t *testing.T) {
+	raw := `<tool_call><function=read_web_page><parameter=url>https://go.dev/doc/go1.25</parameter></function></tool_call>`
+	name, argumentsJSON, arguments, ok := ParsePromptToolMarkup(raw)
+	if !ok || name != "read_web_page" {
+		t.Fatalf("Qwen function/parameter wrapper was not parsed: name=%q args=%q ok=%v", name, argumentsJSON, ok)
+	}
+	args, _ := arguments.(map[string]interface{})
+	if args["url"] != "https://go.dev/doc/go1.25" {
+		t.Fatalf("Qwen wrapper arguments were not preserved: %#v", args)
+	}
+}
+
+func TestParsePromptToolMarkupCapturedOutputs(t *testing.T) {
+	tests := []struct {
+		file string
+		name string
+		args string
+	}{
+		{"lmstudio_gemma_tool_code.txt", "read_buffered_source", `{"query":"What is Engine? Features, installation, usage examples, architecture","source_id":"src_18c835144500"}`},
+		{"lmstudio_gemma_relaxed_args.txt", "search_web", `{"query":"오늘 서울 날씨"}`},
+		{"lmstudio_json_fence.txt", "read_buffered_source", `{"query":"채팅창 테마 변경 방법","source_id":"src_18c8710db44f8328"}`},
+		{"lmstudio_execute_command.txt", "execute_command", `{"command":"sysctl -n kern.boottime"}`},
+		{"lmstudio_arg_key_value.txt", "search_memory", `{"query":"주말 일정"}`},
+		{"llamacpp_qwen_function_parameter.txt", "read_web_page", `{"url":"https://go.dev/doc/go1.25"}`},
+		{"llamacpp_hermes_tool_call.txt", "get_current_time", `{}`},
+		{"llamacpp_function_like.txt", "read_buffered_source", `{"query":"게시글의 주요 내용과 운영자의 사과/해명 내용을 요약해 주세요.","source_id":"src_18c83936c25763f0"}`},
+		{"llamacpp_search_memory_text.txt", "search_memory", `{"query":"나를 주인님이라고 부르기로 한거"}`},
+		{"llamacpp_tool_parameters_alias.txt", "read_buffered_source", `{"query":"Engine 핵심 기능","source_id":"src_123"}`},
+	}
+	for _, tt := range tests {
+		raw, err := os.ReadFile(filepath.Join("testdata", "toolmarkup", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, argumentsJSON, _, ok := ParsePromptToolMarkup(string(raw))
+		if !ok || name != tt.name || canonicalJSON(t, argumentsJSON) != tt.args {
+			t.Errorf("%s: name=%q args=%s ok=%v, want %q %s", tt.file, name, argumentsJSON, ok, tt.name, tt.args)
+		}
+	}
+}
+
+func TestNormalizeRelaxedToolArgsJSONKeepsStringValues(t *testing.T) {
+	got, ok := NormalizeRelaxedToolArgsJSON(`{query:"a,b:c", "note":"{x:1}"}`)
+	if !ok || got != `{"note":"{x:1}","query":"a,b:c"}` {
+		t.Fatalf("NormalizeRelaxedToolArgsJSON = %s, %v", got, ok)
+	}
+}
+
+func TestParseXMLLikeToolCallWithNonASCIIBody(t *testing.T) {
+	// Ⱥ lowercases to a longer UTF-8 sequence; the body must not shift.
+	name, argumentsJSON, _, ok := ParseXMLLikeToolCall(`<search_web>ȺȺȺȺȺ</search_web>`)
+	if !ok || name != "search_web" || argumentsJSON != `{"query":"ȺȺȺȺȺ"}` {
+		t.Fatalf("name=%q args=%s ok=%v", name, argumentsJSON, ok)
+	}
+}
+
+// toolCallRenderings are the textual forms local models use for one call.
+// Each returns false when the call cannot be written in that form.
+var toolCallRenderings = map[string]func(name string, args map[string]interface{}) (string, bool){
+	"json wrapper": func(name string, args map[string]interface{}) (string, bool) {
+		data, _ := json.Marshal(map[string]interface{}{"name": name, "arguments": args})
+		return string(data), true
+	},
+	"json fence": func(name string, args map[string]interface{}) (string, bool) {
+		data, _ := json.MarshalIndent(map[string]interface{}{"tool": name, "parameters": args}, "", "  ")
+		return "```json\n" + string(data) + "\n```", true
+	},
+	"hermes tool_call": func(name string, args map[string]interface{}) (string, bool) {
+		data, _ := json.Marshal(map[string]interface{}{"name": name, "arguments": args})
+		return "<tool_call>\n" + string(data) + "\n</tool_call>", true
+	},
+	"xml tag": func(name string, args map[string]interface{}) (string, bool) {
+		data, _ := json.Marshal(args)
+		return "<" + name + ">" + string(data) + "</" + name + ">", true
+	},
+	"function call": func(name string, args map[string]interface{}) (string, bool) {
+		return renderFunctionLikeCall(name, args), true
+	},
+	"tool_code": func(name string, args map[string]interface{}) (string, bool) {
+		return "<tool_code>\nprint(" + renderFunctionLikeCall(name, args) + ")\n</tool_code>", true
+	},
+	"qwen function/parameter": func(name string, args map[string]interface{}) (string, bool) {
+		var out strings.Builder
+		out.WriteString("<tool_call>\n<function=" + name + ">\n")
+		for _, key := range sortedKeys(args) {
+			value, isString := args[key].(string)
+			if !isString || strings.ContainsAny(value, "<>") || json.Valid([]byte(strings.TrimSpace(value))) {
+				return "", false
+			}
+			out.WriteString("<parameter=" + key + ">\n" + value + "\n</parameter>\n")
+		}
+		out.WriteString("</function>\n</tool_call>")
+		return out.String(), true
+	},
+}
+
+func renderFunctionLikeCall(name string, args map[string]interface{}) string {
+	parts := make([]string, 0, len(args))
+	for _, key := range sortedKeys(args) {
+		value := args[key]
+		if text, ok := value.(string); ok {
+			parts = append(parts, key+"="+strconv.Quote(text))
+			continue
+		}
+		data, _ := json.Marshal(value)
+		parts = append(parts, key+"="+string(data))
+	}
+	return name + "(" + strings.Join(parts, ", ") + ")"
+}
+
+func sortedKeys(args map[string]interface{}) []string {
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// randomToolCall builds a call with identifier-like names and arguments that
+// mix plain text, Korean, quoting and bracket characters, numbers and bools.
+func randomToolCall(rng *rand.Rand) (string, map[string]interface{}) {
+	names := []string{"search_web", "read_buffered_source", "get_current_time", "execute_command", "read_web_page", "save_user_fact"}
+	name := names[rng.Intn(len(names))]
+	if rng.Intn(3) == 0 {
+		name = fmt.Sprintf("tool_%d", rng.Intn(1000))
+	}
+	words := []string{"go", "날씨", "서울", "a,b", "x=1", "(draft)", `say "hi"`, "it's", `C:\tmp`, "{json}", "[1, 2]", "line\nbreak", "https://go.dev/doc"}
+	args := map[string]interface{}{}
+	for i, count := 0, rng.Intn(4); i < count; i++ {
+		key := fmt.Sprintf("arg_%d", i)
+		switch rng.Intn(5) {
+		case 0:
+			args[key] = float64(rng.Intn(10000))
+		case 1:
+			args[key] = rng.Intn(2) == 0
+		default:
+			parts := make([]string, 1+rng.Intn(3))
+			for j := range parts {
+				parts[j] = words[rng.Intn(len(words))]
+			}
+			args[key] = strings.Join(parts, " ")
+		}
+	}
+	return name, args
+}
+
+func TestParsePromptToolMarkupRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		name, args := randomToolCall(rng)
+		for format, render := range toolCallRenderings {
+			raw, ok := render(name, args)
+			if !ok {
+				continue
+			}
+			gotName, argumentsJSON, _, ok := ParsePromptToolMarkup(raw)
+			if !ok || gotName != name {
+				t.Fatalf("%s: %q parsed as name=%q ok=%v", format, raw, gotName, ok)
+			}
+			var gotArgs map[string]interface{}
+			if err := json.Unmarshal([]byte(argumentsJSON), &gotArgs); err != nil || !reflect.DeepEqual(gotArgs, args) {
+				t.Fatalf("%s: %q parsed arguments %s, want %#v", format, raw, argumentsJSON, args)
+			}
+		}
+	}
+}
+
+func canonicalJSON(t *testing.T, raw string) string {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return raw
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -802,6 +802,14 @@ func ExecuteCommandBudgetFamily(command string) string {
 	return fields[0]
 }
 
+// ToolCallOutcome is one executed native call from a multi-call round.
+type ToolCallOutcome struct {
+	ID        string
+	Name      string
+	Arguments string
+	Result    string
+}
+
 type ToolFollowupInput struct {
 	LLMMode                    string
 	ModelID                    string
@@ -819,6 +827,10 @@ type ToolFollowupInput struct {
 	RequireFreshnessCrossCheck bool
 	SingleSearchRefinement     bool
 	ProviderTools              []interface{}
+	ParallelToolCalls          bool
+	// ToolCalls replaces the single ToolName/ToolCallID pair when the model
+	// issued several native calls in one round. Order follows the provider.
+	ToolCalls []ToolCallOutcome
 }
 
 func PrepareToolFollowupRequest(input ToolFollowupInput) (map[string]interface{}, []byte, error) {
@@ -844,12 +856,40 @@ func PrepareToolFollowupRequest(input ToolFollowupInput) (map[string]interface{}
 			}
 			reqMap["tools"] = tools
 			reqMap["tool_choice"] = "auto"
-			reqMap["parallel_tool_calls"] = false
+			reqMap["parallel_tool_calls"] = input.ParallelToolCalls
 		} else if _, hasTools := reqMap["tools"]; hasTools {
 			reqMap["tool_choice"] = "auto"
 		}
 		msgs, _ := reqMap["messages"].([]interface{})
-		if strings.TrimSpace(input.ToolCallID) != "" {
+		if len(input.ToolCalls) > 0 {
+			toolCalls := make([]interface{}, 0, len(input.ToolCalls))
+			for _, call := range input.ToolCalls {
+				arguments := strings.TrimSpace(call.Arguments)
+				if arguments == "" {
+					arguments = "{}"
+				}
+				toolCalls = append(toolCalls, map[string]interface{}{
+					"id":   strings.TrimSpace(call.ID),
+					"type": "function",
+					"function": map[string]interface{}{
+						"name":      call.Name,
+						"arguments": arguments,
+					},
+				})
+			}
+			msgs = append(msgs, map[string]interface{}{
+				"role":       "assistant",
+				"content":    nil,
+				"tool_calls": toolCalls,
+			})
+			for _, call := range input.ToolCalls {
+				msgs = append(msgs, map[string]interface{}{
+					"role":         "tool",
+					"tool_call_id": strings.TrimSpace(call.ID),
+					"content":      compactToolResult(call.Name, call.Result, input.OriginalUserText, input.CompletedTools, input.AvailableTools, true, input.FinalAnswerOnly, input.RequireFreshnessCrossCheck),
+				})
+			}
+		} else if strings.TrimSpace(input.ToolCallID) != "" {
 			arguments := strings.TrimSpace(input.ToolArguments)
 			if arguments == "" {
 				arguments = "{}"
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/mcp"
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+// API key scopes. A session token from /api/login carries all of them.
+const (
+	APIKeyScopeChat        = "chat"
+	APIKeyScopeTTS         = "tts"
+	APIKeyScopeMemoryRead  = toolruntime.ScopeMemoryRead
+	APIKeyScopeMemoryWrite = toolruntime.ScopeMemoryWrite
+	APIKeyScopeAdmin       = toolruntime.ScopeAdmin
+)
+
+var apiKeyScopes = []string{APIKeyScopeChat, APIKeyScopeTTS, APIKeyScopeMemoryRead, APIKeyScopeMemoryWrite, APIKeyScopeAdmin}
+
+// apiKeyTokenPrefix marks gateway API keys so AuthMiddleware can tell them
+// from session tokens without a second lookup.
+const apiKeyTokenPrefix = "dkc_"
+
+// apiKeyScopesHeader carries the scopes of the API key that authenticated a
+// request. AuthMiddleware always overwrites it, so clients cannot set it.
+const apiKeyScopesHeader = "X-API-Key-Scopes"
+
+func isAPIKeyToken(token string) bool {
+	return strings.HasPrefix(token, apiKeyTokenPrefix)
+}
+
+// normalizeAPIKeyScopes validates requested scopes and returns them in
+// canonical order without duplicates.
+func normalizeAPIKeyScopes(requested []string) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, scope := range requested {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope == "" {
+			continue
+		}
+		known := false
+		for _, candidate := range apiKeyScopes {
+			known = known || candidate == scope
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		wanted[scope] = true
+	}
+	scopes := make([]string, 0, len(wanted))
+	for _, scope := range apiKeyScopes {
+		if wanted[scope] {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// CreateAPIKey issues a key for id and returns it with its stored entry. The
+// key itself is only available here; the database keeps its hash.
+func (am *AuthManager) CreateAPIKey(id, name string, scopes []string, expiresAt *time.Time) (string, mcp.APIKeyEntry, error) {
+	am.mu.RLock()
+	user := am.users[id]
+	am.mu.RUnlock()
+	if user == nil {
+		return "", mcp.APIKeyEntry{}, fmt.Errorf("user %s not found", id)
+	}
+	scopes, err := normalizeAPIKeyScopes(scopes)
+	if err != nil {
+		return "", mcp.APIKeyEntry{}, err
+	}
+	for _, scope := range scopes {
+		if scope == APIKeyScopeAdmin && user.Role != "admin" {
+			return "", mcp.APIKeyEntry{}, errors.New("only admins can issue admin keys")
+		}
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", mcp.APIKeyEntry{}, errors.New("name is required")
+	}
+
+	key := apiKeyTokenPrefix + generateToken()
+	entry := mcp.APIKeyEntry{
+		UserID:    id,
+		Name:      name,
+		KeyPrefix: key[:len(apiKeyTokenPrefix)+8],
+		KeyHash:   hashToken(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	if entry.ID, err = mcp.InsertAPIKey(entry); err != nil {
+		return "", mcp.APIKeyEntry{}, err
+	}
+	return key, entry, nil
+}
+
+func (am *AuthManager) ListAPIKeys(id string) ([]mcp.APIKeyEntry, error) {
+	return mcp.ListAPIKeys(id)
+}
+
+// RevokeAPIKey deletes one of id's keys; revoking an unknown key fails.
+func (am *AuthManager) RevokeAPIKey(id string, keyID int64) error {
+	deleted, err := mcp.DeleteAPIKey(id, keyID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ValidateAPIKey resolves a key to its user and scopes. Expired keys are
+// rejected but kept so the owner still sees them in the list.
+func (am *AuthManager) ValidateAPIKey(key string) (*User, []string, bool) {
+	entry, err := mcp.GetAPIKeyByHash(hashToken(key))
+	if err != nil {
+		return nil, nil, false
+	}
+	now := time.Now()
+	if entry.ExpiresAt != nil && now.After(*entry.ExpiresAt) {
+		return nil, nil, false
+	}
+	_ = mcp.TouchAPIKey(entry.ID, now)
+
+	am.mu.RLock()
+	user := am.users[entry.UserID]
+	am.mu.RUnlock()
+	return user, entry.Scopes, user != nil
+}
+
+// requiredAPIKeyScope is the scope an API key needs for r. Routes that are
+// not chat, TTS or memory need the admin scope, and so do tool approvals:
+// approving a paused call would let a chat key run a host command.
+func requiredAPIKeyScope(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/api/chat-session/tool-approvals":
+		return APIKeyScopeAdmin
+	case path == "/api/chat", path == "/api/v1/chat", path == "/v1/chat/completions", path == "/mcp",
+		path == "/api/models", path == "/api/prompts", strings.HasPrefix(path, "/api/chat-session/"):
+		return APIKeyScopeChat
+	case path == "/api/tts" || strings.HasPrefix(path, "/api/tts/"):
+		return APIKeyScopeTTS
+	case strings.HasPrefix(path, "/api/memor"):
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return APIKeyScopeMemoryRead
+		}
+		return APIKeyScopeMemoryWrite
+	default:
+		return APIKeyScopeAdmin
+	}
+}
+
+// requestHasScope reports whether r may use scope. Requests authenticated
+// with a session token have every scope their role allows.
+func requestHasScope(r *http.Request, scope string) bool {
+	scopes := r.Header.Get(apiKeyScopesHeader)
+	if scopes == "" {
+		return true
+	}
+	for _, granted := range strings.Fields(scopes) {
+		if granted == scope || granted == APIKeyScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScopes returns the scopes of the API key behind r, or nil for a
+// session login, in the form toolruntime.ExecutionContext.Scopes expects.
+func requestScopes(r *http.Request) []string {
+	scopes := r.Header.Get(apiKeyScopesHeader)
+	if scopes == "" {
+		return nil
+	}
+	return append([]string{}, strings.Fields(scopes)...)
+}
+
+// handleAPIKeys lists (GET), creates (POST) and revokes (DELETE ?id=) the
+// caller's API keys.
+func handleAPIKeys(authMgr *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			keys, err := authMgr.ListAPIKeys(userID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys, "scopes": apiKeyScopes})
+		case http.MethodPost:
+			var req struct {
+				Name          string   `json:"name"`
+				Scopes        []string `json:"scopes"`
+				ExpiresInDays int      `json:"expires_in_days"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if req.ExpiresInDays < 0 {
+				http.Error(w, "expires_in_days must not be negative", http.StatusBadRequest)
+				return
+			}
+			var expiresAt *time.Time
+			if req.ExpiresInDays > 0 {
+				at := time.Now().UTC().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+				expiresAt = &at
+			}
+			key, entry, err := authMgr.CreateAPIKey(userID, req.Name, req.Scopes, expiresAt)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"key": key, "api_key": entry})
+		case http.MethodDelete:
+			keyID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid key id", http.StatusBadRequest)
+				return
+			}
+			if err := authMgr.RevokeAPIKey(userID, keyID); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					http.Error(w, "API key not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dinkisstyle-chat/internal/mcp"
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+func newAPIKeyTestAuth(t *testing.T) *AuthManager {
+	t.Helper()
+	if err := mcp.InitDB(filepath.Join(t.TempDir(), "api-keys.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mcp.CloseDB)
+	auth := NewAuthManager(filepath.Join(t.TempDir(), "users.json"))
+	if err := auth.AddUser("agent", "secret", "user"); err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func serveWithToken(mux http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	mux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	auth := newAPIKeyTestAuth(t)
+	mux := createServerMux(&App{authMgr: auth}, auth)
+
+	key, entry, err := auth.CreateAPIKey("agent", "ci", []string{"chat", "chat", "memory:read"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, apiKeyTokenPrefix) || !strings.HasPrefix(key, entry.KeyPrefix) || strings.Join(entry.Scopes, " ") != "chat memory:read" {
+		t.Fatalf("key = %q, entry = %+v", key, entry)
+	}
+	if entry.KeyHash == key {
+		t.Fatal("the key must be stored hashed")
+	}
+
+	if recorder := serveWithToken(mux, http.MethodGet, "/api/chat-session/current", key); recorder.Code == http.StatusUnauthorized || recorder.Code == http.StatusForbidden {
+		t.Fatalf("chat route with a chat key = %d %s", recorder.Code, recorder.Body.String())
+	}
+	for _, path := range []string{"/api/api-keys", "/api/tts", "/api/chat-session/tool-approvals"} {
+		if recorder := serveWithToken(mux, http.MethodGet, path, key); recorder.Code != http.StatusForbidden {
+			t.Fatalf("%s with a chat key = %d, want 403", path, recorder.Code)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/chat", nil)
+	request.Header.Set(apiKeyScopesHeader, "chat")
+	if requestHasScope(request, APIKeyScopeMemoryRead) {
+		t.Fatal("a chat-only key must not read memory")
+	}
+	request.Header.Del(apiKeyScopesHeader)
+	if !requestHasScope(request, APIKeyScopeAdmin) {
+		t.Fatal("session requests keep every scope")
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	auth := newAPIKeyTestAuth(t)
+	mux := createServerMux(&App{authMgr: auth}, auth)
+
+	if _, _, err := auth.CreateAPIKey("agent", "root", []string{"admin"}, nil); err == nil {
+		t.Fatal("a non-admin user must not issue admin keys")
+	}
+	if _, _, err := auth.CreateAPIKey("agent", "ci", []string{"sudo"}, nil); err == nil {
+		t.Fatal("unknown scopes must be rejected")
+	}
+
+	past := time.Now().Add(-time.Minute)
+	expired, _, err := auth.CreateAPIKey("agent", "old", []string{"chat"}, &past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder := serveWithToken(mux, http.MethodGet, "/api/chat-session/current", expired); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expired key = %d, want 401", recorder.Code)
+	}
+
+	key, entry, err := auth.CreateAPIKey("agent", "ci", []string{"chat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := auth.ValidateAPIKey(key); !ok {
+		t.Fatal("fresh key was rejected")
+	}
+
+	session, err := auth.Authenticate("agent", "secret", false, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := serveWithToken(mux, http.MethodGet, "/api/api-keys", session)
+	if recorder.Code != http.StatusOK || strings.Contains(recorder.Body.String(), entry.KeyHash) || strings.Contains(recorder.Body.String(), key) {
+		t.Fatalf("list = %d %s", recorder.Code, recorder.Body.String())
+	}
+	var listed struct {
+		Keys []mcp.APIKeyEntry `json:"keys"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Keys) != 2 || listed.Keys[0].LastUsedAt == nil && listed.Keys[1].LastUsedAt == nil {
+		t.Fatalf("listed keys = %+v", listed.Keys)
+	}
+
+	path := "/api/api-keys?id=" + strconv.FormatInt(entry.ID, 10)
+	if recorder := serveWithToken(mux, http.MethodDelete, path, session); recorder.Code != http.StatusOK {
+		t.Fatalf("revoke = %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := serveWithToken(mux, http.MethodDelete, path, session); recorder.Code != http.StatusNotFound {
+		t.Fatalf("second revoke = %d, want 404", recorder.Code)
+	}
+	if recorder := serveWithToken(mux, http.MethodGet, "/api/chat-session/current", key); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked key = %d, want 401", recorder.Code)
+	}
+}
+
+func TestAPIKeyScopesGateMCPTools(t *testing.T) {
+	auth := newAPIKeyTestAuth(t)
+	mux := createServerMux(&App{authMgr: auth, enableTools: true}, auth)
+	memoryID, err := mcp.InsertMemory("agent", "User: I play the cello\nAssistant: nice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readKey, _, err := auth.CreateAPIKey("agent", "reader", []string{"chat", "memory:read"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postMCP := func(key, message string) string {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/mcp", strings.NewReader(message))
+		request.Header.Set("Authorization", "Bearer "+key)
+		request.Header.Set("Content-Type", "application/json")
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("/mcp = %d %s", recorder.Code, recorder.Body.String())
+		}
+		return recorder.Body.String()
+	}
+
+	listed := postMCP(readKey, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	if !strings.Contains(listed, `"search_memory"`) {
+		t.Fatalf("memory:read key must list search_memory: %s", listed)
+	}
+	for _, name := range []string{"delete_memory", "save_user_fact", "delete_user_fact", "execute_command", "send_keys"} {
+		if strings.Contains(listed, `"`+name+`"`) {
+			t.Errorf("memory:read key lists %s", name)
+		}
+	}
+
+	reply := postMCP(readKey, `{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"delete_memory","arguments":{"memory_id":`+strconv.FormatInt(memoryID, 10)+`}}}`)
+	if !strings.Contains(reply, `"isError":true`) || !strings.Contains(reply, "memory:write scope") {
+		t.Fatalf("delete_memory with a memory:read key = %s", reply)
+	}
+	if _, err := mcp.ReadMemory("agent", memoryID); err != nil {
+		t.Fatalf("memory was deleted through a memory:read key: %v", err)
+	}
+}
+
+func TestAPIKeyChatScopeRefusesSideEffectingTools(t *testing.T) {
+	auth := newAPIKeyTestAuth(t)
+	ran := map[string]bool{}
+	var ranMu sync.Mutex
+	for name, metadata := range map[string]toolruntime.Metadata{
+		"scope_test_skill_run":  {Category: "skill", SideEffecting: true},
+		"scope_test__write_doc": {Category: "external", SideEffecting: true},
+	} {
+		name := name
+		if err := toolruntime.Default.Register(toolruntime.Definition{
+			Name:        name,
+			InputSchema: json.RawMessage(`{"type":"object"}`),
+			Metadata:    metadata,
+		}, func(context.Context, toolruntime.ExecutionContext, json.RawMessage) (toolruntime.Result, error) {
+			ranMu.Lock()
+			ran[name] = true
+			ranMu.Unlock()
+			return toolruntime.Result{Content: "ran"}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { toolruntime.Default.Unregister(name) })
+	}
+	mcp.SetToolOverrides(map[string]bool{"read_terminal_tail": true})
+	t.Cleanup(func() { mcp.SetToolOverrides(nil) })
+	refused := []string{"execute_command", "send_keys", "read_terminal_tail", "scope_test_skill_run", "scope_test__write_doc"}
+
+	upstream := &fakeChatCompletionsUpstream{replies: [][]string{{
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"scope_test__write_doc","arguments":"{}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+	}}}
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	mux := createServerMux(&App{authMgr: auth, llmEndpoint: server.URL, llmMode: "standard", enableTools: true}, auth)
+	chatKey, _, err := auth.CreateAPIKey("agent", "chat only", []string{"chat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postMCP := func(message string) string {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/mcp", strings.NewReader(message))
+		request.Header.Set("Authorization", "Bearer "+chatKey)
+		request.Header.Set("Content-Type", "application/json")
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("/mcp = %d %s", recorder.Code, recorder.Body.String())
+		}
+		return recorder.Body.String()
+	}
+	listed := postMCP(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	for _, name := range refused {
+		if strings.Contains(listed, `"`+name+`"`) {
+			t.Errorf("chat key lists %s over /mcp", name)
+		}
+	}
+	for _, name := range []string{"scope_test_skill_run", "scope_test__write_doc"} {
+		reply := postMCP(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"` + name + `","arguments":{}}}`)
+		if !strings.Contains(reply, `"isError":true`) || !strings.Contains(reply, "admin scope") {
+			t.Errorf("%s over /mcp with a chat key = %s", name, reply)
+		}
+	}
+
+	recorder := postChatCompletions(t, mux, chatKey, `{"model":"local","messages":[{"role":"user","content":"write the doc"}]}`, map[string]string{"X-Gateway-Tools": "true"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("chat = %d %s", recorder.Code, recorder.Body.String())
+	}
+	offered, _ := json.Marshal(upstream.requests[0]["tools"])
+	for _, name := range refused {
+		if strings.Contains(string(offered), `"`+name+`"`) {
+			t.Errorf("chat key was offered %s in chat", name)
+		}
+	}
+	// A call to a tool the key was not offered goes back to the client
+	// instead of running on the gateway.
+	if len(upstream.requests) != 1 || !strings.Contains(recorder.Body.String(), `"finish_reason":"tool_calls"`) {
+		t.Fatalf("unoffered tool call was not handed back: %d rounds, %s", len(upstream.requests), recorder.Body.String())
+	}
+	ranMu.Lock()
+	defer ranMu.Unlock()
+	if len(ran) != 0 {
+		t.Fatalf("side-effecting tools ran for a chat key: %v", ran)
+	}
+}
@@ -8,9 +8,13 @@ package core
 import (
 	"bytes"
 	"context"
+	"dinkisstyle-chat/internal/chatharness"
 	"dinkisstyle-chat/internal/config"
 	"dinkisstyle-chat/internal/mcp"
+	"dinkisstyle-chat/internal/orchestrator"
 	"dinkisstyle-chat/internal/promptkit"
+	"dinkisstyle-chat/internal/toolruntime"
+	"dinkisstyle-chat/internal/upstream"
 	"embed"
 	"encoding/json"
 	"fmt"
@@ -42,7 +46,7 @@ type App struct {
 	port                string
 	llmEndpoint         string
 	llmApiToken         string
-	llmMode             string // "standard" or "stateful"
+	llmMode             string // "standard", "stateful", "responses", "ollama" or "anthropic"
 	enableTTS           bool
 	enableTools         bool
 	enableDebugTrace    bool
@@ -54,6 +58,12 @@ type App struct {
 	alwaysShowWelcome   bool
 	serverUILanguageMux sync.RWMutex
 	serverUILanguage    string
+	mcpServers          []toolruntime.ExternalServerConfig
+	// upstreams routes chat and model requests when config.json lists
+	// several LLM servers; empty keeps the single llmEndpoint.
+	upstreams *upstream.Router
+	// upstreamRetry governs retries of a round before anything streamed.
+	upstreamRetry orchestrator.RetryPolicy
 
 	// Server-side Model Cache
 	modelCache     []byte
@@ -66,22 +76,40 @@ type App struct {
 
 // AppConfig holds the persistent application configuration
 type AppConfig struct {
-	Port              string               `json:"port"`
-	LLMEndpoint       string               `json:"llmEndpoint"`
-	LLMApiToken       string               `json:"llmApiToken"`
-	LLMMode           string               `json:"llmMode"`
-	EnableTTS         bool                 `json:"enableTTS"`
-	EnableTools       *bool                `json:"enableTools,omitempty"`
-	TTS               ServerTTSConfig      `json:"tts"`
-	Embedding         EmbeddingModelConfig `json:"embedding"`
-	StartOnBoot       bool                 `json:"startOnBoot"`
-	MinimizeToTray    bool                 `json:"minimizeToTray"`
-	AutoStartServer   bool                 `json:"autoStartServer"`
-	CertDomain        string               `json:"certDomain"`
-	DebugTraceEnabled bool                 `json:"debugTraceEnabled"`
-	WelcomeDismissed  bool                 `json:"welcomeDismissed"`
-	AlwaysShowWelcome bool                 `json:"alwaysShowWelcome"`
-	ServerUILanguage  string               `json:"serverUILanguage"`
+	Port              string                             `json:"port"`
+	LLMEndpoint       string                             `json:"llmEndpoint"`
+	LLMApiToken       string                             `json:"llmApiToken"`
+	LLMMode           string                             `json:"llmMode"`
+	EnableTTS         bool                               `json:"enableTTS"`
+	EnableTools       *bool                              `json:"enableTools,omitempty"`
+	TTS               ServerTTSConfig                    `json:"tts"`
+	Embedding         EmbeddingModelConfig               `json:"embedding"`
+	StartOnBoot       bool                               `json:"startOnBoot"`
+	MinimizeToTray    bool                               `json:"minimizeToTray"`
+	AutoStartServer   bool                               `json:"autoStartServer"`
+	CertDomain        string                             `json:"certDomain"`
+	DebugTraceEnabled bool                               `json:"debugTraceEnabled"`
+	WelcomeDismissed  bool                               `json:"welcomeDismissed"`
+	AlwaysShowWelcome bool                               `json:"alwaysShowWelcome"`
+	ServerUILanguage  string                             `json:"serverUILanguage"`
+	MCPServers        []toolruntime.ExternalServerConfig `json:"mcpServers,omitempty"`
+	// Upstreams lists named LLM servers routed by model id; see upstream.Config.
+	Upstreams []upstream.Config `json:"upstreams,omitempty"`
+	// UpstreamRetry tunes retries of transient upstream failures; see
+	// orchestrator.RetryPolicy.
+	UpstreamRetry orchestrator.RetryPolicy `json:"upstreamRetry,omitzero"`
+	// Command limits for execute_command; zero keeps the built-in defaults.
+	CommandTimeoutSeconds int `json:"commandTimeoutSeconds,omitempty"`
+	CommandMaxOutputBytes int `json:"commandMaxOutputBytes,omitempty"`
+	// ToolStates overrides the built-in tool switches; see mcp.ToolSwitches.
+	ToolStates map[string]bool `json:"toolStates,omitempty"`
+	// Retrieval is the default hybrid search fusion and boost policy; users
+	// may override it. See mcp.RetrievalConfig.
+	Retrieval mcp.RetrievalConfig `json:"retrieval,omitzero"`
+	// Reranker enables the optional cross-encoder stage of hybrid search.
+	Reranker RerankerModelConfig `json:"reranker,omitzero"`
+	// MemoryExtraction controls how finished chat turns are remembered.
+	MemoryExtraction MemoryExtractionConfig `json:"memoryExtraction,omitzero"`
 }
 
 type WelcomeState struct {
@@ -319,11 +347,16 @@ func NewApp(assets embed.FS) *App {
 		}
 		return a.authMgr.ResolveUserMemoryRetentionConfig(userID), true
 	})
+	mcp.SetUserRetrievalConfigProvider(func(userID string) (mcp.RetrievalConfig, bool) {
+		return a.authMgr.ResolveUserRetrievalConfig(userID)
+	})
 	a.loadConfig()
 	setDebugTraceCollectorEnabled(a.enableDebugTrace)
 	mcp.SetTraceHook(func(ev mcp.TraceEvent) {
 		AddDebugTrace(ev.Source, ev.Stage, ev.Message, ev.Details)
 	})
+	mcp.SetToolFetchCache(toolruntime.CachedFetch)
+	mcp.SetMemoryChangeHook(toolruntime.DefaultResultCache.InvalidateUser)
 	return a
 }
 
@@ -343,6 +376,10 @@ func (a *App) loadConfig() {
 	a.enableTools = true
 	a.llmMode = "stateful"
 	a.certDomain = "localhost"
+	a.mcpServers = nil
+	a.upstreams = nil
+	mcp.SetCommandLimits(mcp.CommandLimits{})
+	mcp.SetToolOverrides(nil)
 	ttsConfig = ServerTTSConfig{
 		Engine:     "supertonic",
 		VoiceStyle: "F1.json",
@@ -394,6 +431,17 @@ func (a *App) loadConfig() {
 	if cfg.CertDomain != "" {
 		a.certDomain = cfg.CertDomain
 	}
+	a.mcpServers = cfg.MCPServers
+	for index := range cfg.Upstreams {
+		cfg.Upstreams[index].Mode = normalizeLLMMode(cfg.Upstreams[index].Mode)
+	}
+	a.upstreams = upstream.NewRouter(cfg.Upstreams)
+	a.upstreamRetry = cfg.UpstreamRetry
+	mcp.SetCommandLimits(mcp.CommandLimits{
+		Timeout:        time.Duration(cfg.CommandTimeoutSeconds) * time.Second,
+		MaxOutputBytes: cfg.CommandMaxOutputBytes,
+	})
+	mcp.SetToolOverrides(cfg.ToolStates)
 
 	fmt.Printf("[loadConfig] Loaded Config from %s\n", cfgPath)
 	fmt.Printf("   -> Port: %s, Endpoint: %s, Mode: %s\n", a.port, a.llmEndpoint, a.llmMode)
@@ -422,6 +470,9 @@ func (a *App) loadConfig() {
 	}
 	embeddingConfig = normalizeEmbeddingConfig(cfg.Embedding)
 	applyEmbeddingRuntimeConfig()
+	mcp.SetRetrievalConfig(cfg.Retrieval)
+	applyRerankerRuntimeConfig(cfg.Reranker)
+	applyMemoryExtractionConfig(cfg.MemoryExtraction)
 }
 
 func (a *App) saveConfig() {
@@ -450,6 +501,7 @@ func (a *App) saveConfig() {
 	cfg.ServerUILanguage = a.GetServerUILanguage()
 	cfg.TTS = ttsConfig
 	cfg.Embedding = currentEmbeddingModelConfig()
+	cfg.ToolStates = mcp.ToolOverrides()
 
 	data, err = json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
@@ -467,6 +519,7 @@ func (a *App) Startup(ctx context.Context) {
 	a.ctx = ctx
 	globalApp = a
 	a.startRetentionMaintenanceLoop()
+	a.startMemoryExtractionWorker()
 
 	// Setup paths for non-Windows
 	a.CheckAndSetupPaths()
@@ -477,6 +530,8 @@ func (a *App) Startup(ctx context.Context) {
 
 	// Reload config now that paths are set up and files potentially copied
 	a.loadConfig()
+	toolruntime.External.Start(ctx, a.mcpServers)
+	go a.upstreams.Run(ctx, upstream.DefaultProbeInterval)
 	if a.enableDebugTrace {
 		wruntime.WindowSetMinSize(ctx, config.DebugWindowWidth, config.NormalWindowHeight)
 		wruntime.WindowSetSize(ctx, config.DebugWindowWidth, config.NormalWindowHeight)
@@ -535,6 +590,7 @@ func (a *App) startRetentionMaintenanceLoop() {
 func (a *App) Shutdown(ctx context.Context) {
 	fmt.Println("Shutting down application...")
 	a.StopServer()
+	toolruntime.External.Stop()
 	QuitSystemTray()
 }
 
@@ -621,7 +677,7 @@ func (a *App) SetLLMApiToken(token string) {
 	a.saveConfig()
 }
 
-// SetLLMMode sets the LLM Mode (standard/stateful)
+// SetLLMMode sets the LLM Mode (standard/stateful/responses/ollama/anthropic)
 func (a *App) SetLLMMode(mode string) {
 	a.serverMux.Lock()
 	defer a.serverMux.Unlock()
@@ -1062,8 +1118,8 @@ func (a *App) StartServer(port string) error {
 
 	// Redirect Handler: Redirects HTTP to HTTPS on the SAME port
 	redirectHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Allow API endpoints to work on HTTP for local/web clients.
-		if strings.HasPrefix(r.URL.Path, "/api/") {
+		// Allow API and MCP endpoints to work on HTTP for local/web clients.
+		if strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/mcp" {
 			loggingMux.ServeHTTP(w, r)
 			return
 		}
@@ -1294,6 +1350,16 @@ func (a *App) SetUserMemoryRetentionConfig(id string, cfg mcp.MemoryRetentionCon
 	return a.authMgr.SetUserMemoryRetentionConfig(id, cfg)
 }
 
+// GetUserRetrievalConfig returns the hybrid search policy for a user.
+func (a *App) GetUserRetrievalConfig(id string) (mcp.RetrievalConfig, error) {
+	return a.authMgr.GetUserRetrievalConfig(id)
+}
+
+// SetUserRetrievalConfig updates the hybrid search policy for a user.
+func (a *App) SetUserRetrievalConfig(id string, cfg mcp.RetrievalConfig) error {
+	return a.authMgr.SetUserRetrievalConfig(id, cfg)
+}
+
 // SetUserDisabledTools sets the list of disabled tools for a specific user (exposed to Wails)
 func (a *App) SetUserDisabledTools(id string, tools []string) error {
 	return a.authMgr.SetUserDisabledTools(id, tools)
@@ -1324,6 +1390,56 @@ func (a *App) GetUserDisallowedDirectories(id string) ([]string, error) {
 	return a.authMgr.GetUserDisallowedDirectories(id)
 }
 
+// SetUserAllowedCommands sets the execute_command allow-list for a specific user (exposed to Wails)
+func (a *App) SetUserAllowedCommands(id string, cmds []string) error {
+	return a.authMgr.SetUserAllowedCommands(id, cmds)
+}
+
+// GetUserAllowedCommands returns the execute_command allow-list for a specific user (exposed to Wails)
+func (a *App) GetUserAllowedCommands(id string) ([]string, error) {
+	return a.authMgr.GetUserAllowedCommands(id)
+}
+
+// SetUserAllowedDirectories sets the execute_command directory allow-list for a specific user (exposed to Wails)
+func (a *App) SetUserAllowedDirectories(id string, dirs []string) error {
+	return a.authMgr.SetUserAllowedDirectories(id, dirs)
+}
+
+// GetUserAllowedDirectories returns the execute_command directory allow-list for a specific user (exposed to Wails)
+func (a *App) GetUserAllowedDirectories(id string) ([]string, error) {
+	return a.authMgr.GetUserAllowedDirectories(id)
+}
+
+// SetUserCommandMode sets the execute_command mode for a specific user (exposed to Wails)
+func (a *App) SetUserCommandMode(id string, mode string) error {
+	return a.authMgr.SetUserCommandMode(id, mode)
+}
+
+// GetUserCommandMode returns the execute_command mode for a specific user (exposed to Wails)
+func (a *App) GetUserCommandMode(id string) (string, error) {
+	return a.authMgr.GetUserCommandMode(id)
+}
+
+// SetUserCommandJail toggles the Linux command jail for a specific user (exposed to Wails)
+func (a *App) SetUserCommandJail(id string, enabled bool) error {
+	return a.authMgr.SetUserCommandJail(id, enabled)
+}
+
+// GetUserCommandJail reports whether the Linux command jail is on for a specific user (exposed to Wails)
+func (a *App) GetUserCommandJail(id string) (bool, error) {
+	return a.authMgr.GetUserCommandJail(id)
+}
+
+// SetUserToolApproval sets the side-effecting tool approval policy for a specific user (exposed to Wails)
+func (a *App) SetUserToolApproval(id string, mode string) error {
+	return a.authMgr.SetUserToolApproval(id, mode)
+}
+
+// GetUserToolApproval returns the side-effecting tool approval policy for a specific user (exposed to Wails)
+func (a *App) GetUserToolApproval(id string) (string, error) {
+	return a.authMgr.GetUserToolApproval(id)
+}
+
 // GetVoiceStyles returns a list of available voice style files (JSON)
 func (a *App) GetVoiceStyles() []string {
 	var styles []string
@@ -1530,8 +1646,9 @@ func (a *App) CheckHealth() HealthCheckResult {
 
 func normalizeLLMMode(mode string) string {
 	mode = strings.TrimSpace(strings.ToLower(mode))
-	if mode == "stateful" {
-		return "stateful"
+	switch mode {
+	case "stateful", chatharness.LLMModeOllama, chatharness.LLMModeAnthropic, chatharness.LLMModeResponses:
+		return mode
 	}
 	return "standard"
 }
@@ -1563,10 +1680,28 @@ func (a *App) currentLLMRequestConfig() (string, string, string) {
 
 // FetchAndCacheModels fetches models from the LLM server and caches them
 func (a *App) FetchAndCacheModels() ([]byte, error) {
+	if a.upstreams.Enabled() {
+		return a.FetchAndCacheUpstreamModels(context.Background())
+	}
 	endpoint, token, mode := a.currentLLMRequestConfig()
 	return a.FetchAndCacheModelsWithConfig(endpoint, token, mode)
 }
 
+// FetchAndCacheUpstreamModels merges the model lists of every configured
+// upstream, de-duplicated by id, into one OpenAI-style list.
+func (a *App) FetchAndCacheUpstreamModels(ctx context.Context) ([]byte, error) {
+	models, err := a.upstreams.Models(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bodyBytes, err := json.Marshal(map[string]interface{}{"object": "list", "data": models})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode models: %v", err)
+	}
+	a.storeModelCache(bodyBytes)
+	return bodyBytes, nil
+}
+
 func (a *App) FetchAndCacheModelsWithConfig(endpoint, token, mode string) ([]byte, error) {
 	endpoint = normalizeLLMEndpoint(endpoint)
 	token = sanitizeLLMToken(token)
@@ -1586,7 +1721,10 @@ func (a *App) FetchAndCacheModelsWithConfig(endpoint, token, mode string) ([]byt
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	if token != "" {
+	if adapter := chatharness.AdapterFor(mode); adapter != nil {
+		// Ollama and Anthropic-compatible servers both list models on /v1/models.
+		adapter.SetHeaders(req.Header, token)
+	} else if token != "" {
 		req.Header.Set("Authorization", "Bearer "+token)
 	} else {
 		req.Header.Set("Authorization", "Bearer lm-studio")
@@ -1608,6 +1746,11 @@ func (a *App) FetchAndCacheModelsWithConfig(endpoint, token, mode string) ([]byt
 	}
 
 	// Success - Update Cache
+	a.storeModelCache(bodyBytes)
+	return bodyBytes, nil
+}
+
+func (a *App) storeModelCache(bodyBytes []byte) {
 	a.modelCacheMux.Lock()
 	a.modelCache = bodyBytes
 	a.modelCacheTime = time.Now()
@@ -1620,8 +1763,6 @@ func (a *App) FetchAndCacheModelsWithConfig(endpoint, token, mode string) ([]byt
 	} else {
 		fmt.Printf("[FetchAndCacheModels] Models cached to %s\n", cachePath)
 	}
-
-	return bodyBytes, nil
 }
 
 // LoadModel sends a request to load a specific model
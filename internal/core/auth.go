@@ -41,9 +41,18 @@ type UserSettings struct {
 	TTSConfig             *ServerTTSConfig           `json:"tts_config,omitempty"`
 	EmbeddingConfig       *EmbeddingModelConfig      `json:"embedding_config,omitempty"`
 	MemoryRetention       *mcp.MemoryRetentionConfig `json:"memory_retention,omitempty"`
+	Retrieval             *mcp.RetrievalConfig       `json:"retrieval,omitempty"`
 	DisabledTools         []string                   `json:"disabled_tools,omitempty"`
 	DisallowedCommands    []string                   `json:"disallowed_commands,omitempty"`
 	DisallowedDirectories []string                   `json:"disallowed_directories,omitempty"`
+	// Allow-lists and sandbox options for execute_command. Any allow or deny
+	// list forces argv mode; see mcp.CommandPolicy.
+	AllowedCommands    []string `json:"allowed_commands,omitempty"`
+	AllowedDirectories []string `json:"allowed_directories,omitempty"`
+	CommandMode        *string  `json:"command_mode,omitempty"`
+	CommandJail        *bool    `json:"command_jail,omitempty"`
+	// ToolApproval gates SideEffecting tools: always, ask or never.
+	ToolApproval *string `json:"tool_approval,omitempty"`
 }
 
 // User represents a user account
@@ -193,6 +202,12 @@ func normalizePersistedSettings(settings UserSettings) UserSettings {
 	if settings.DisallowedDirectories == nil {
 		settings.DisallowedDirectories = []string{}
 	}
+	if settings.AllowedCommands == nil {
+		settings.AllowedCommands = []string{}
+	}
+	if settings.AllowedDirectories == nil {
+		settings.AllowedDirectories = []string{}
+	}
 	return settings
 }
 
@@ -410,6 +425,9 @@ func (am *AuthManager) DeleteUser(id string) error {
 	if err := mcp.DeleteAuthSessionsByUser(id); err != nil {
 		return err
 	}
+	if err := mcp.DeleteAPIKeysByUser(id); err != nil {
+		return err
+	}
 
 	// Save while still holding lock
 	return am.saveUsersLocked()
@@ -653,6 +671,52 @@ func (am *AuthManager) SetUserMemoryRetentionConfig(id string, cfg mcp.MemoryRet
 	return am.saveUsersLocked()
 }
 
+func (am *AuthManager) GetUserRetrievalConfig(id string) (mcp.RetrievalConfig, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return mcp.RetrievalConfig{}, fmt.Errorf("user not found")
+	}
+	if user.Settings.Retrieval == nil {
+		return mcp.GetRetrievalConfig(), nil
+	}
+	return *user.Settings.Retrieval, nil
+}
+
+// ResolveUserRetrievalConfig reports the user's own retrieval policy; ok is
+// false when the user follows the server default.
+func (am *AuthManager) ResolveUserRetrievalConfig(id string) (mcp.RetrievalConfig, bool) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	user, exists := am.users[id]
+	if !exists || user.Settings.Retrieval == nil {
+		return mcp.RetrievalConfig{}, false
+	}
+	return *user.Settings.Retrieval, true
+}
+
+func (am *AuthManager) SetUserRetrievalConfig(id string, cfg mcp.RetrievalConfig) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	switch strings.ToLower(strings.TrimSpace(cfg.Fusion)) {
+	case "", mcp.RetrievalFusionRRF, mcp.RetrievalFusionWeighted:
+	default:
+		return fmt.Errorf("unknown fusion %q", cfg.Fusion)
+	}
+	normalized := mcp.NormalizeRetrievalConfig(cfg)
+	user.Settings.Retrieval = &normalized
+
+	return am.saveUsersLocked()
+}
+
 // SetUserDisabledTools sets the list of disabled tools for a specific user
 func (am *AuthManager) SetUserDisabledTools(id string, tools []string) error {
 	am.mu.Lock()
@@ -750,11 +814,26 @@ func AuthMiddleware(am *AuthManager, next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		user, valid := am.ValidateSession(token)
+		r.Header.Del(apiKeyScopesHeader)
+		var user *User
+		var valid bool
+		if isAPIKeyToken(token) {
+			var scopes []string
+			user, scopes, valid = am.ValidateAPIKey(token)
+			if valid {
+				r.Header.Set(apiKeyScopesHeader, strings.Join(scopes, " "))
+			}
+		} else {
+			user, valid = am.ValidateSession(token)
+		}
 		if !valid {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if !requestHasScope(r, requiredAPIKeyScope(r)) {
+			http.Error(w, "Forbidden: API key lacks the "+requiredAPIKeyScope(r)+" scope", http.StatusForbidden)
+			return
+		}
 
 		// Store user in context (simplified - just header)
 		r.Header.Set("X-User-ID", user.ID)
@@ -833,3 +912,165 @@ func (am *AuthManager) GetUserDisallowedDirectories(id string) ([]string, error)
 	}
 	return user.Settings.DisallowedDirectories, nil
 }
+
+// SetUserAllowedCommands sets the execute_command allow-list for a specific user
+func (am *AuthManager) SetUserAllowedCommands(id string, cmds []string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	user.Settings.AllowedCommands = cmds
+	return am.saveUsersLocked()
+}
+
+// GetUserAllowedCommands returns the execute_command allow-list for a specific user
+func (am *AuthManager) GetUserAllowedCommands(id string) ([]string, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	if user.Settings.AllowedCommands == nil {
+		return []string{}, nil
+	}
+	return user.Settings.AllowedCommands, nil
+}
+
+// SetUserAllowedDirectories sets the directories execute_command may touch for a specific user
+func (am *AuthManager) SetUserAllowedDirectories(id string, dirs []string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	user.Settings.AllowedDirectories = dirs
+	return am.saveUsersLocked()
+}
+
+// GetUserAllowedDirectories returns the directories execute_command may touch for a specific user
+func (am *AuthManager) GetUserAllowedDirectories(id string) ([]string, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	if user.Settings.AllowedDirectories == nil {
+		return []string{}, nil
+	}
+	return user.Settings.AllowedDirectories, nil
+}
+
+// SetUserCommandMode sets the execute_command mode ("shell" or "argv") for a specific user
+func (am *AuthManager) SetUserCommandMode(id string, mode string) error {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode != "" && mode != mcp.CommandModeShell && mode != mcp.CommandModeArgv {
+		return fmt.Errorf("invalid command mode: %s", mode)
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	if mode == "" {
+		user.Settings.CommandMode = nil
+	} else {
+		user.Settings.CommandMode = &mode
+	}
+	return am.saveUsersLocked()
+}
+
+// GetUserCommandMode returns the execute_command mode for a specific user
+func (am *AuthManager) GetUserCommandMode(id string) (string, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return "", fmt.Errorf("user not found")
+	}
+
+	if user.Settings.CommandMode == nil {
+		return mcp.CommandModeShell, nil
+	}
+	return mcp.EffectiveCommandMode(*user.Settings.CommandMode), nil
+}
+
+// SetUserCommandJail enables the Linux namespace/seccomp jail for a specific user's commands
+func (am *AuthManager) SetUserCommandJail(id string, enabled bool) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	user.Settings.CommandJail = &enabled
+	return am.saveUsersLocked()
+}
+
+// GetUserCommandJail reports whether a specific user's commands run in the Linux jail
+func (am *AuthManager) GetUserCommandJail(id string) (bool, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return false, fmt.Errorf("user not found")
+	}
+
+	return user.Settings.CommandJail != nil && *user.Settings.CommandJail, nil
+}
+
+// SetUserToolApproval sets the side-effecting tool approval policy ("always", "ask" or "never") for a specific user
+func (am *AuthManager) SetUserToolApproval(id string, mode string) error {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode != "" && !isToolApprovalMode(mode) {
+		return fmt.Errorf("invalid tool approval mode: %s", mode)
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	if mode == "" {
+		user.Settings.ToolApproval = nil
+	} else {
+		user.Settings.ToolApproval = &mode
+	}
+	return am.saveUsersLocked()
+}
+
+// GetUserToolApproval returns the side-effecting tool approval policy for a specific user
+func (am *AuthManager) GetUserToolApproval(id string) (string, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	user, exists := am.users[id]
+	if !exists {
+		return "", fmt.Errorf("user not found")
+	}
+
+	return toolApprovalModeOf(user.Settings), nil
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/orchestrator"
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+const mcpEndpointMaxBodyBytes = 4 << 20
+
+var gatewayMCPServer = toolruntime.NewMCPServer(toolruntime.Default)
+
+// userToolExecutionContext resolves the same per-user tool policy that the chat
+// loop applies, so tools served outside chat obey identical restrictions.
+func userToolExecutionContext(app *App, authMgr *AuthManager, userID, requestID, locationInfo string) (toolruntime.ExecutionContext, bool) {
+	enableTools := app.enableTools
+	execCtx := toolruntime.ExecutionContext{
+		RequestID:    requestID,
+		UserID:       userID,
+		LocationInfo: locationInfo,
+	}
+	authMgr.mu.RLock()
+	user := authMgr.users[userID]
+	authMgr.mu.RUnlock()
+	if user == nil {
+		return execCtx, enableTools
+	}
+	if user.Settings.EnableTools != nil {
+		enableTools = *user.Settings.EnableTools
+	}
+	execCtx.EnableMemory = true
+	if user.Settings.EnableMemory != nil {
+		execCtx.EnableMemory = *user.Settings.EnableMemory
+	}
+	execCtx.DisabledTools = expandDisabledToolAliases(user.Settings.DisabledTools)
+	execCtx.DisallowedCommands = user.Settings.DisallowedCommands
+	execCtx.DisallowedDirectories = user.Settings.DisallowedDirectories
+	applyCommandSandboxSettings(&execCtx, user.Settings)
+	applyToolApprovalSettings(&execCtx, user.Settings)
+	return execCtx, enableTools
+}
+
+// registryTools runs the chat loop's tool calls on the default registry,
+// batching the calls of one round over parallelToolWorkers.
+func registryTools(execCtx toolruntime.ExecutionContext) orchestrator.Tools {
+	return orchestrator.ToolsFunc(func(ctx context.Context, turn int, calls []chatharness.ProviderToolCall) []orchestrator.ToolResult {
+		batch := make([]toolruntime.BatchCall, 0, len(calls))
+		for _, call := range calls {
+			batch = append(batch, toolruntime.BatchCall{ID: call.ID, Name: call.Name, Arguments: json.RawMessage(call.Arguments)})
+		}
+		results := make([]orchestrator.ToolResult, 0, len(calls))
+		for index, result := range toolruntime.Default.CallBatch(ctx, execCtx, batch, parallelToolWorkers) {
+			results = append(results, orchestrator.ToolResult{
+				ToolCallOutcome: chatharness.ToolCallOutcome{
+					ID:        result.ID,
+					Name:      result.Name,
+					Arguments: calls[index].Arguments,
+					Result:    result.Result.Content,
+				},
+				Err:     result.Err,
+				Elapsed: result.Elapsed,
+			})
+		}
+		return results
+	})
+}
+
+// applyCommandSandboxSettings copies the user's execute_command allow-lists,
+// execution mode and jail flag into the execution context.
+func applyCommandSandboxSettings(execCtx *toolruntime.ExecutionContext, settings UserSettings) {
+	execCtx.AllowedCommands = settings.AllowedCommands
+	execCtx.AllowedDirectories = settings.AllowedDirectories
+	if settings.CommandMode != nil {
+		execCtx.CommandMode = *settings.CommandMode
+	}
+	if settings.CommandJail != nil {
+		execCtx.CommandJail = *settings.CommandJail
+	}
+}
+
+// handleMCP serves the gateway tool catalog over the MCP streamable HTTP
+// transport. Every POST carries one JSON-RPC message; replies are plain JSON
+// because the gateway never initiates server-to-client messages.
+func handleMCP(app *App, authMgr *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+		case http.MethodGet, http.MethodDelete:
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := r.Header.Get("X-User-ID")
+		requestID := strings.TrimSpace(r.Header.Get("X-Client-Turn-Id"))
+		if requestID == "" {
+			requestID = fmt.Sprintf("mcp-%d", time.Now().UnixNano())
+		}
+		execCtx, enableTools := userToolExecutionContext(app, authMgr, userID, requestID, r.Header.Get("X-User-Location"))
+		// Memory tools read stored memories, so API keys need memory:read;
+		// the registry checks the stricter per-tool scopes.
+		execCtx.EnableMemory = execCtx.EnableMemory && requestHasScope(r, APIKeyScopeMemoryRead)
+		execCtx.Scopes = requestScopes(r)
+		if !enableTools {
+			http.Error(w, "Tools are disabled for this user", http.StatusForbidden)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, mcpEndpointMaxBodyBytes+1))
+		if err != nil || len(body) > mcpEndpointMaxBodyBytes {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		start := time.Now()
+		reply := gatewayMCPServer.HandleMessage(r.Context(), execCtx, body)
+		AddDebugTrace("mcp_server", "message", "Handled MCP message", map[string]interface{}{
+			"user":       userID,
+			"request_id": requestID,
+			"bytes":      len(body),
+			"elapsed_ms": time.Since(start).Milliseconds(),
+		})
+		if reply == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(reply)
+	}
+}
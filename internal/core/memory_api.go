@@ -0,0 +1,407 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/mcp"
+)
+
+// profileFactSourceUser marks profile facts written from the memory API.
+const profileFactSourceUser = "user"
+
+// handleMemories lists, reads, edits and bulk-deletes the caller's
+// memories. GET with ?id= reads one memory with its provenance.
+func handleMemories() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			if rawID := r.URL.Query().Get("id"); rawID != "" {
+				memoryID, err := strconv.ParseInt(rawID, 10, 64)
+				if err != nil {
+					http.Error(w, "Invalid memory id", http.StatusBadRequest)
+					return
+				}
+				memory, err := mcp.ReadMemory(userID, memoryID)
+				if err != nil {
+					writeMemoryAPIError(w, "handleMemories", userID, err)
+					return
+				}
+				provenance, err := mcp.ListMemoryProvenance(userID, memoryID)
+				if err != nil {
+					writeMemoryAPIError(w, "handleMemories", userID, err)
+					return
+				}
+				if provenance == nil {
+					provenance = []mcp.MemoryProvenanceEntry{}
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"memory": memory, "provenance": provenance})
+				return
+			}
+			filter, err := parseMemoryListFilter(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			items, total, err := mcp.ListMemories(userID, filter)
+			if err != nil {
+				writeMemoryAPIError(w, "handleMemories", userID, err)
+				return
+			}
+			if items == nil {
+				items = []mcp.MemoryEntry{}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "total": total, "limit": filter.Limit, "offset": filter.Offset})
+		case http.MethodPatch:
+			memoryID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid memory id", http.StatusBadRequest)
+				return
+			}
+			var req struct {
+				FullText   *string  `json:"full_text"`
+				MemoryType *string  `json:"memory_type"`
+				Tier       *string  `json:"tier"`
+				Pinned     *bool    `json:"pinned"`
+				Importance *float64 `json:"importance"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			memory, err := mcp.UpdateMemory(userID, memoryID, mcp.MemoryUpdate{
+				FullText:   req.FullText,
+				MemoryType: req.MemoryType,
+				Tier:       req.Tier,
+				Pinned:     req.Pinned,
+				Importance: req.Importance,
+			})
+			if err != nil {
+				writeMemoryAPIError(w, "handleMemories", userID, err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"memory": memory})
+		case http.MethodDelete:
+			ids, err := parseBulkIDs(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			deleted, err := mcp.DeleteMemories(userID, ids)
+			if err != nil {
+				writeMemoryAPIError(w, "handleMemories", userID, err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleMemorySearch runs the hybrid memory search for the memory browser.
+// It takes the same filters as the listing.
+func handleMemorySearch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		queryStr := strings.TrimSpace(r.URL.Query().Get("q"))
+		if queryStr == "" {
+			http.Error(w, "q is required", http.StatusBadRequest)
+			return
+		}
+		filter, err := parseMemoryListFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		items, err := mcp.SearchMemoryEntries(userID, queryStr, filter)
+		if err != nil {
+			writeMemoryAPIError(w, "handleMemorySearch", userID, err)
+			return
+		}
+		if items == nil {
+			items = []mcp.MemoryEntry{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "limit": filter.Limit, "offset": filter.Offset})
+	}
+}
+
+// handleProfileFacts lists, writes and bulk-deletes the caller's profile
+// facts. Writes go through the same concept matching as the model's.
+func handleProfileFacts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			facts, err := mcp.GetUserProfileFacts(userID)
+			if err != nil {
+				writeMemoryAPIError(w, "handleProfileFacts", userID, err)
+				return
+			}
+			category := strings.TrimSpace(r.URL.Query().Get("category"))
+			items := []mcp.UserProfileFact{}
+			for _, fact := range facts {
+				if category == "" || fact.Category == category {
+					items = append(items, fact)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+		case http.MethodPut:
+			var req struct {
+				Key      string `json:"key"`
+				Value    string `json:"value"`
+				Category string `json:"category"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if strings.TrimSpace(req.Key) == "" || strings.TrimSpace(req.Value) == "" {
+				http.Error(w, "key and value are required", http.StatusBadRequest)
+				return
+			}
+			fact, err := mcp.SaveUserProfileFact(userID, req.Key, req.Value, req.Category, profileFactSourceUser, mcp.ProfileFactRef{})
+			if err != nil {
+				writeMemoryAPIError(w, "handleProfileFacts", userID, err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"fact": fact})
+		case http.MethodDelete:
+			ids, err := parseBulkIDs(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			deleted, err := mcp.DeleteUserProfileFacts(userID, ids)
+			if err != nil {
+				writeMemoryAPIError(w, "handleProfileFacts", userID, err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// parseMemoryListFilter reads tier, type, pinned, from, to, min_hits,
+// max_hits, limit and offset from the query string. Dates are YYYY-MM-DD
+// or RFC 3339; "to" includes the whole day when given as a date.
+func parseMemoryListFilter(r *http.Request) (mcp.MemoryListFilter, error) {
+	query := r.URL.Query()
+	filter := mcp.MemoryListFilter{
+		Tier:       query.Get("tier"),
+		MemoryType: query.Get("type"),
+	}
+	if raw := query.Get("pinned"); raw != "" {
+		pinned, err := strconv.ParseBool(raw)
+		if err != nil {
+			return filter, fmt.Errorf("invalid pinned %q", raw)
+		}
+		filter.Pinned = &pinned
+	}
+	for _, bound := range []struct {
+		name   string
+		target *time.Time
+		endOf  bool
+	}{{"from", &filter.CreatedAfter, false}, {"to", &filter.CreatedBefore, true}} {
+		raw := strings.TrimSpace(query.Get(bound.name))
+		if raw == "" {
+			continue
+		}
+		if at, err := time.Parse(time.RFC3339, raw); err == nil {
+			*bound.target = at
+			continue
+		}
+		day, err := time.Parse(time.DateOnly, raw)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s %q", bound.name, raw)
+		}
+		if bound.endOf {
+			day = day.AddDate(0, 0, 1)
+		}
+		*bound.target = day
+	}
+	for _, number := range []struct {
+		name   string
+		target *int
+	}{{"min_hits", &filter.MinHitCount}, {"limit", &filter.Limit}, {"offset", &filter.Offset}} {
+		if raw := query.Get(number.name); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil || value < 0 {
+				return filter, fmt.Errorf("invalid %s %q", number.name, raw)
+			}
+			*number.target = value
+		}
+	}
+	if raw := query.Get("max_hits"); raw != "" {
+		maxHits, err := strconv.Atoi(raw)
+		if err != nil || maxHits < 0 {
+			return filter, fmt.Errorf("invalid max_hits %q", raw)
+		}
+		filter.MaxHitCount = &maxHits
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 50
+	}
+	filter.Limit = min(filter.Limit, 200)
+	return filter, nil
+}
+
+// parseBulkIDs takes the ids of a bulk delete from a {"ids": [...]} body,
+// or a single ?id= when there is no body.
+func parseBulkIDs(r *http.Request) ([]int64, error) {
+	if rawID := r.URL.Query().Get("id"); rawID != "" {
+		id, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", rawID)
+		}
+		return []int64{id}, nil
+	}
+	var req struct {
+		IDs []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
+		return nil, fmt.Errorf("ids are required")
+	}
+	return req.IDs, nil
+}
+
+func writeMemoryAPIError(w http.ResponseWriter, handler, userID string, err error) {
+	switch {
+	case errors.Is(err, mcp.ErrMemoryNotFound), errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, mcp.ErrInvalidMemoryRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("[%s] Memory request failed for %s: %v", handler, userID, err)
+		http.Error(w, "Memory request failed", http.StatusInternalServerError)
+	}
+}
+
+// handleProfileFactHistory lists every value a profile fact has held,
+// including those stored under other keys of the same concept.
+func handleProfileFactHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		factKey := strings.TrimSpace(r.URL.Query().Get("key"))
+		if factKey == "" {
+			http.Error(w, "key is required", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		versions, err := mcp.GetUserProfileFactTimeline(userID, factKey)
+		if err != nil {
+			log.Printf("[handleProfileFactHistory] Failed to load history of %q for %s: %v", factKey, userID, err)
+			http.Error(w, "Failed to load profile fact history", http.StatusInternalServerError)
+			return
+		}
+		if versions == nil {
+			versions = []mcp.UserProfileFactVersion{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"key": factKey, "versions": versions})
+	}
+}
+
+// handleProfileFactRevert makes an earlier version of a profile fact its
+// current value.
+func handleProfileFactRevert() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			VersionID int64 `json:"version_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.VersionID <= 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fact, err := mcp.RevertUserProfileFact(userID, req.VersionID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Profile fact version not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("[handleProfileFactRevert] Failed to revert version %d for %s: %v", req.VersionID, userID, err)
+			http.Error(w, "Failed to revert profile fact", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"fact": fact})
+	}
+}
+
+// handleProfileFactConflicts lists current profile facts whose keys name
+// the same concept. Only the newest of each group reaches the prompt.
+func handleProfileFactConflicts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		conflicts, err := mcp.FindUserProfileFactConflicts(userID)
+		if err != nil {
+			log.Printf("[handleProfileFactConflicts] Failed to check profile facts for %s: %v", userID, err)
+			http.Error(w, "Failed to check profile facts", http.StatusInternalServerError)
+			return
+		}
+		if conflicts == nil {
+			conflicts = []mcp.ProfileFactConflict{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"conflicts": conflicts})
+	}
+}
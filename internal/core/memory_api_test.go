@@ -0,0 +1,105 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"dinkisstyle-chat/internal/mcp"
+)
+
+func serveMemoryAPI(t *testing.T, handler http.HandlerFunc, method, target, body string) (int, map[string]json.RawMessage) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("X-User-ID", "alice")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	var decoded map[string]json.RawMessage
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, target, err, rec.Body.String())
+		}
+	}
+	return rec.Code, decoded
+}
+
+func TestMemoryAPI(t *testing.T) {
+	if err := mcp.InitDB(filepath.Join(t.TempDir(), "memory-api.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mcp.CloseDB)
+
+	first, err := mcp.InsertMemory("alice", "User: I play the cello\nAssistant: nice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := mcp.InsertMemory("alice", "User: I live near the river\nAssistant: ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := serveMemoryAPI(t, handleMemories(), http.MethodGet, "/api/memories?limit=1", "")
+	if code != http.StatusOK || string(body["total"]) != "2" || string(body["limit"]) != "1" {
+		t.Fatalf("list: %d %v", code, body)
+	}
+	for _, target := range []string{"/api/memories?tier=forever", "/api/memories?from=yesterday", "/api/memories?max_hits=-1"} {
+		if code, _ := serveMemoryAPI(t, handleMemories(), http.MethodGet, target, ""); code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d, want 400", target, code)
+		}
+	}
+
+	id := strconv.FormatInt(first, 10)
+	code, body = serveMemoryAPI(t, handleMemories(), http.MethodPatch, "/api/memories?id="+id, `{"full_text":"Alice plays the viola.","pinned":true,"tier":"core"}`)
+	if code != http.StatusOK {
+		t.Fatalf("edit: status %d", code)
+	}
+	var edited mcp.MemoryEntry
+	if err := json.Unmarshal(body["memory"], &edited); err != nil || edited.FullText != "Alice plays the viola." || !edited.Pinned || edited.MemoryTier != "core" {
+		t.Fatalf("edited memory = %+v %v", edited, err)
+	}
+	code, body = serveMemoryAPI(t, handleMemorySearch(), http.MethodGet, "/api/memories/search?q=viola&pinned=true", "")
+	var found []mcp.MemoryEntry
+	if code != http.StatusOK || json.Unmarshal(body["items"], &found) != nil || len(found) != 1 || found[0].ID != first {
+		t.Fatalf("search: %d %+v", code, found)
+	}
+	code, body = serveMemoryAPI(t, handleMemories(), http.MethodGet, "/api/memories?id="+id, "")
+	if code != http.StatusOK || !strings.Contains(string(body["provenance"]), `"edit"`) {
+		t.Fatalf("read: %d %v", code, body)
+	}
+	if code, _ := serveMemoryAPI(t, handleMemories(), http.MethodPatch, "/api/memories?id=9999", `{"pinned":true}`); code != http.StatusNotFound {
+		t.Fatalf("editing a missing memory: status %d", code)
+	}
+
+	code, body = serveMemoryAPI(t, handleMemories(), http.MethodDelete, "/api/memories", `{"ids":[`+id+`,`+strconv.FormatInt(second, 10)+`]}`)
+	if code != http.StatusOK || string(body["deleted"]) != "2" {
+		t.Fatalf("bulk delete: %d %v", code, body)
+	}
+
+	code, body = serveMemoryAPI(t, handleProfileFacts(), http.MethodPut, "/api/memories/profile-facts", `{"key":"car","value":"Volvo","category":"vehicle"}`)
+	if code != http.StatusOK {
+		t.Fatalf("put fact: status %d", code)
+	}
+	serveMemoryAPI(t, handleProfileFacts(), http.MethodPut, "/api/memories/profile-facts", `{"key":"vehicle","value":"Saab","category":"vehicle"}`)
+	code, body = serveMemoryAPI(t, handleProfileFactHistory(), http.MethodGet, "/api/memories/profile-facts/history?key=car", "")
+	var versions []mcp.UserProfileFactVersion
+	if code != http.StatusOK || json.Unmarshal(body["versions"], &versions) != nil || len(versions) != 2 || versions[1].FactValue != "Volvo" {
+		t.Fatalf("history: %d %+v", code, versions)
+	}
+	code, body = serveMemoryAPI(t, handleProfileFactRevert(), http.MethodPost, "/api/memories/profile-facts/revert", `{"version_id":`+strconv.FormatInt(versions[1].ID, 10)+`}`)
+	if code != http.StatusOK || !strings.Contains(string(body["fact"]), `"Volvo"`) {
+		t.Fatalf("revert: %d %v", code, body)
+	}
+	code, body = serveMemoryAPI(t, handleProfileFacts(), http.MethodGet, "/api/memories/profile-facts?category=vehicle", "")
+	var facts []mcp.UserProfileFact
+	if code != http.StatusOK || json.Unmarshal(body["items"], &facts) != nil || len(facts) != 1 || facts[0].FactKey != "car" {
+		t.Fatalf("facts: %d %+v", code, facts)
+	}
+	code, body = serveMemoryAPI(t, handleProfileFacts(), http.MethodDelete, "/api/memories/profile-facts?id="+strconv.FormatInt(facts[0].ID, 10), "")
+	if code != http.StatusOK || string(body["deleted"]) != "1" {
+		t.Fatalf("delete fact: %d %v", code, body)
+	}
+}
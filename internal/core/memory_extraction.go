@@ -0,0 +1,312 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/mcp"
+)
+
+const (
+	memoryExtractionJobType        = "memory_extraction"
+	memoryExtractionCandidateLimit = 8
+	memoryExtractionMaxTurnChars   = 4000
+	memoryExtractionPollInterval   = time.Minute
+)
+
+// MemoryExtractionConfig controls how finished chat turns become memories.
+// It is read from config.json only.
+type MemoryExtractionConfig struct {
+	// Disabled stores every turn as a raw User/Assistant transcript, the
+	// behavior before extraction existed.
+	Disabled bool `json:"disabled"`
+	// KeepRawTranscripts also stores the raw transcript next to the
+	// extracted facts.
+	KeepRawTranscripts bool `json:"keepRawTranscripts"`
+}
+
+var memoryExtractionState = struct {
+	mu   sync.RWMutex
+	cfg  MemoryExtractionConfig
+	wake chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+var memoryExtractionLLMRequest = internalLLMRequest{
+	TraceSource:  "memory-extraction",
+	Label:        "memory extraction",
+	SystemPrompt: "You turn chat turns into long-term memory entries. Return only valid JSON in the form {\"facts\":[...]}. No markdown fences. No explanations.",
+	MaxTokens:    1200,
+}
+
+func applyMemoryExtractionConfig(cfg MemoryExtractionConfig) {
+	memoryExtractionState.mu.Lock()
+	defer memoryExtractionState.mu.Unlock()
+	memoryExtractionState.cfg = cfg
+}
+
+func currentMemoryExtractionConfig() MemoryExtractionConfig {
+	memoryExtractionState.mu.RLock()
+	defer memoryExtractionState.mu.RUnlock()
+	return memoryExtractionState.cfg
+}
+
+// chatTurnMemory is a finished chat turn waiting to be remembered.
+type chatTurnMemory struct {
+	UserID        string
+	ModelID       string
+	LLMMode       string
+	UserText      string
+	AssistantText string
+	SessionID     int64
+	TurnID        string
+}
+
+// memoryExtractionPayload is the request_payload_json of an extraction job.
+// Credentials are not stored; they are read from the user at run time.
+type memoryExtractionPayload struct {
+	UserText      string `json:"user_text"`
+	AssistantText string `json:"assistant_text"`
+	SessionID     int64  `json:"session_id,omitempty"`
+	TurnID        string `json:"turn_id,omitempty"`
+}
+
+// rememberChatTurn queues turn for fact extraction, or stores it as a raw
+// transcript when extraction is disabled.
+func rememberChatTurn(turn chatTurnMemory) {
+	cfg := currentMemoryExtractionConfig()
+	if cfg.Disabled || cfg.KeepRawTranscripts {
+		storeRawChatTurn(turn.UserID, turn.UserText, turn.AssistantText)
+	}
+	if cfg.Disabled {
+		return
+	}
+
+	payload, _ := json.Marshal(memoryExtractionPayload{
+		UserText:      turn.UserText,
+		AssistantText: turn.AssistantText,
+		SessionID:     turn.SessionID,
+		TurnID:        turn.TurnID,
+	})
+	jobID, err := mcp.EnqueueBackgroundJob(turn.UserID, memoryExtractionJobType, turn.LLMMode, turn.ModelID, string(payload))
+	if err != nil {
+		log.Printf("[AsyncMemory] ❌ Failed to queue memory extraction for %s: %v", turn.UserID, err)
+		if !cfg.KeepRawTranscripts {
+			storeRawChatTurn(turn.UserID, turn.UserText, turn.AssistantText)
+		}
+		return
+	}
+	log.Printf("[AsyncMemory] Queued memory extraction job %d for user %s", jobID, turn.UserID)
+	wakeMemoryExtractionWorker()
+}
+
+func wakeMemoryExtractionWorker() {
+	select {
+	case memoryExtractionState.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startMemoryExtractionWorker runs queued extraction jobs one at a time.
+// Jobs interrupted by a previous shutdown are picked up again.
+func (a *App) startMemoryExtractionWorker() {
+	go func() {
+		if requeued, err := mcp.RequeueInterruptedBackgroundJobs(memoryExtractionJobType); err != nil {
+			log.Printf("[AsyncMemory] Failed to requeue interrupted extraction jobs: %v", err)
+		} else if requeued > 0 {
+			log.Printf("[AsyncMemory] Requeued %d interrupted extraction jobs", requeued)
+		}
+
+		ticker := time.NewTicker(memoryExtractionPollInterval)
+		defer ticker.Stop()
+		for {
+			runQueuedMemoryExtractions(a.ctx)
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+			case <-memoryExtractionState.wake:
+			}
+		}
+	}()
+}
+
+func runQueuedMemoryExtractions(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, ok, err := mcp.ClaimNextBackgroundJob(memoryExtractionJobType)
+		if err != nil {
+			log.Printf("[AsyncMemory] Failed to claim extraction job: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		processMemoryExtractionJob(ctx, job)
+	}
+}
+
+func processMemoryExtractionJob(ctx context.Context, job mcp.BackgroundJob) {
+	var payload memoryExtractionPayload
+	if err := json.Unmarshal([]byte(job.RequestPayloadJSON), &payload); err != nil {
+		_ = mcp.FailBackgroundJob(job.ID, "invalid payload: "+err.Error())
+		return
+	}
+
+	applied, err := extractChatTurnMemories(ctx, job, payload)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Shutting down; the job stays running and is requeued on start.
+			return
+		}
+		log.Printf("[AsyncMemory] ❌ Memory extraction job %d failed for %s: %v", job.ID, job.UserID, err)
+		// Nothing is lost when the model is unreachable or unreadable: the
+		// turn is kept as a raw transcript instead.
+		if !currentMemoryExtractionConfig().KeepRawTranscripts {
+			storeRawChatTurn(job.UserID, payload.UserText, payload.AssistantText)
+		}
+		_ = mcp.FailBackgroundJob(job.ID, err.Error())
+		return
+	}
+
+	summary, _ := json.Marshal(applied)
+	if err := mcp.CompleteBackgroundJob(job.ID, string(summary)); err != nil {
+		log.Printf("[AsyncMemory] Failed to complete extraction job %d: %v", job.ID, err)
+	}
+	log.Printf("[AsyncMemory] ✅ Extraction job %d stored %d facts for user %s", job.ID, len(applied), job.UserID)
+}
+
+func extractChatTurnMemories(ctx context.Context, job mcp.BackgroundJob, payload memoryExtractionPayload) ([]mcp.AppliedMemoryFact, error) {
+	offered, err := mcp.LoadMemoryExtractionContext(job.UserID, compactText(payload.UserText, 400), memoryExtractionCandidateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("load known memories: %w", err)
+	}
+
+	raw := callInternalLLM(ctx, memoryExtractionLLMRequest, buildMemoryExtractionPrompt(payload, offered), memoryExtractionLLMOptions(job))
+	if raw == "" {
+		return nil, errors.New("the extraction model returned no answer")
+	}
+	facts, err := parseExtractedMemoryFacts(raw)
+	if err != nil {
+		AddDebugTrace("memory-extraction", "parse.failed", "Failed to parse memory extraction JSON", map[string]interface{}{
+			"raw_response": compactText(raw, 220),
+			"__payload":    raw,
+		})
+		return nil, err
+	}
+
+	provenance := mcp.MemoryProvenance{SessionID: payload.SessionID, TurnID: payload.TurnID, JobID: job.ID}
+	if provenance.EventIDs, err = mcp.ChatEventIDsForTurn(job.UserID, payload.SessionID, payload.TurnID); err != nil {
+		log.Printf("[AsyncMemory] Failed to read chat events of turn %s: %v", payload.TurnID, err)
+	}
+	return mcp.ApplyExtractedMemoryFacts(job.UserID, facts, offered, provenance)
+}
+
+// memoryExtractionLLMOptions runs extraction on the user's secondary model,
+// falling back to the model that answered the turn.
+func memoryExtractionLLMOptions(job mcp.BackgroundJob) savedTurnTitleOptions {
+	opts := savedTurnTitleOptions{ModelID: job.ModelID, LLMMode: job.LLMMode, Temperature: 0.1}
+	if globalApp == nil || globalApp.authMgr == nil {
+		return opts
+	}
+	globalApp.authMgr.mu.RLock()
+	defer globalApp.authMgr.mu.RUnlock()
+	if user := globalApp.authMgr.users[job.UserID]; user != nil {
+		if user.Settings.SecondaryModel != nil {
+			opts.SecondaryModel = strings.TrimSpace(*user.Settings.SecondaryModel)
+		}
+		if user.Settings.ApiToken != nil {
+			opts.APIToken = strings.TrimSpace(*user.Settings.ApiToken)
+		}
+	}
+	return opts
+}
+
+func buildMemoryExtractionPrompt(payload memoryExtractionPayload, offered mcp.MemoryExtractionContext) string {
+	var known strings.Builder
+	for _, memory := range offered.Memories {
+		fmt.Fprintf(&known, "[m%d] (%s) %s\n", memory.ID, memory.MemoryType, compactText(memory.FullText, 300))
+	}
+	if known.Len() == 0 {
+		known.WriteString("(none)\n")
+	}
+	var profile strings.Builder
+	for _, fact := range offered.ProfileFacts {
+		fmt.Fprintf(&profile, "[p:%s] %s (%s)\n", fact.FactKey, compactText(fact.FactValue, 200), fact.Category)
+	}
+	if profile.Len() == 0 {
+		profile.WriteString("(none)\n")
+	}
+
+	return fmt.Sprintf(`Extract what is worth remembering about the user from this chat turn.
+
+Rules:
+- One atomic, self-contained fact per entry, written in the language of the conversation.
+- Skip greetings, questions, the assistant's general knowledge and anything only true for this conversation.
+- Respond as JSON only in this exact shape: {"facts":[...]}. Use {"facts":[]} when nothing is worth keeping.
+
+Each fact has:
+- "kind": "profile" for a stable personal attribute (name, birthday, car, pet_name, ...) with a short snake_case "key", a "value" and a "category" (identity, preference, work, family, vehicle or general); otherwise "memory".
+- "text": the fact as one sentence.
+- "type": fact, preference, event, plan, relationship or instruction.
+- "tier": core (identity, lasting preferences), working (projects, plans) or ephemeral (short-lived details).
+- "importance" and "confidence": numbers from 0 to 1.
+- "action": "new"; "update" when it refines a known entry; "contradict" when a known entry is no longer true; "duplicate" when it is already known. For update, contradict and duplicate set "target" to the known entry, such as "m12" or "p:car".
+
+Known memories:
+%s
+Known profile facts:
+%s
+User:
+%s
+
+Assistant:
+%s`,
+		known.String(),
+		profile.String(),
+		compactText(payload.UserText, memoryExtractionMaxTurnChars),
+		compactText(payload.AssistantText, memoryExtractionMaxTurnChars),
+	)
+}
+
+// parseExtractedMemoryFacts reads {"facts":[...]} or a bare array from the
+// model answer.
+func parseExtractedMemoryFacts(raw string) ([]mcp.ExtractedMemoryFact, error) {
+	document := chatharness.ExtractJSONDocument(raw)
+	if document == "" {
+		return nil, errors.New("the extraction answer does not contain JSON")
+	}
+	var facts []mcp.ExtractedMemoryFact
+	if strings.HasPrefix(document, "[") {
+		if err := json.Unmarshal([]byte(document), &facts); err != nil {
+			return nil, fmt.Errorf("decode extracted facts: %w", err)
+		}
+		return facts, nil
+	}
+	var wrapped struct {
+		Facts *[]mcp.ExtractedMemoryFact `json:"facts"`
+	}
+	if err := json.Unmarshal([]byte(document), &wrapped); err != nil {
+		return nil, fmt.Errorf("decode extracted facts: %w", err)
+	}
+	if wrapped.Facts == nil {
+		return nil, errors.New("the extraction answer has no facts array")
+	}
+	return *wrapped.Facts, nil
+}
+
+// storeRawChatTurn saves a turn verbatim as a raw_interaction memory.
+func storeRawChatTurn(userID, userText, assistantText string) {
+	fullContext := fmt.Sprintf("User: %s\nAssistant: %s", userText, assistantText)
+	id, err := mcp.InsertMemory(userID, fullContext)
+	if err != nil {
+		log.Printf("[AsyncMemory] ❌ Failed to insert raw memory to DB: %v", err)
+	} else {
+		log.Printf("[AsyncMemory] ✅ Saved raw interaction to DB (ID: %d) for user %s", id, userID)
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dinkisstyle-chat/internal/mcp"
+)
+
+func TestParseExtractedMemoryFacts(t *testing.T) {
+	for _, raw := range []string{
+		`{"facts":[{"text":"Alice owns a cat.","type":"fact"}]}`,
+		"```json\n{\"facts\": [{\"text\": \"Alice owns a cat.\"}]}\n```",
+		`Here you go: [{"text":"Alice owns a cat."}]`,
+	} {
+		facts, err := parseExtractedMemoryFacts(raw)
+		if err != nil || len(facts) != 1 || facts[0].Text != "Alice owns a cat." {
+			t.Fatalf("parse %q = %+v, %v", raw, facts, err)
+		}
+	}
+	if facts, err := parseExtractedMemoryFacts(`{"facts":[]}`); err != nil || len(facts) != 0 {
+		t.Fatalf("an empty list is a valid answer, got %+v %v", facts, err)
+	}
+	for _, raw := range []string{"no memories here", `{"title":"x"}`} {
+		if _, err := parseExtractedMemoryFacts(raw); err == nil {
+			t.Fatalf("parse %q must fail", raw)
+		}
+	}
+}
+
+func TestMemoryExtractionJob(t *testing.T) {
+	if err := mcp.InitDB(filepath.Join(t.TempDir(), "extraction.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mcp.CloseDB)
+
+	reply, _ := json.Marshal(map[string]interface{}{
+		"choices": []interface{}{map[string]interface{}{"delta": map[string]interface{}{
+			"content": `{"facts":[{"kind":"profile","key":"pet_name","value":"Nabi","category":"family","confidence":0.9},{"text":"Alice is moving to Busan in May.","type":"plan","tier":"working","importance":0.7,"confidence":0.8}]}`,
+		}}},
+	})
+	upstream := &fakeChatCompletionsUpstream{replies: [][]string{{string(reply)}, {`{"choices":[{"delta":{"content":"sorry, I cannot"}}]}`}}}
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	auth := NewAuthManager(filepath.Join(t.TempDir(), "users.json"))
+	if err := auth.AddUser("alice", "secret", "user"); err != nil {
+		t.Fatal(err)
+	}
+	secondary := "small-model"
+	auth.users["alice"].Settings.SecondaryModel = &secondary
+	previous := globalApp
+	globalApp = &App{authMgr: auth, llmEndpoint: server.URL, llmMode: "standard"}
+	t.Cleanup(func() { globalApp = previous })
+
+	session, err := mcp.UpsertChatSession(mcp.ChatSessionEntry{UserID: "alice", SessionKey: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := mcp.AppendChatEvent("alice", session.ID, "system", "request.complete", "", "turn-9", "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rememberChatTurn(chatTurnMemory{
+		UserID:        "alice",
+		ModelID:       "chat-model",
+		LLMMode:       "standard",
+		UserText:      "My cat Nabi and I are moving to Busan in May.",
+		AssistantText: "Good luck with the move!",
+		SessionID:     session.ID,
+		TurnID:        "turn-9",
+	})
+	runQueuedMemoryExtractions(context.Background())
+
+	if len(upstream.requests) != 1 || upstream.requests[0]["model"] != "small-model" {
+		t.Fatalf("extraction requests = %+v, want one on the secondary model", upstream.requests)
+	}
+	facts, err := mcp.GetUserProfileFacts("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(facts) != 1 || facts[0].FactKey != "pet_name" || facts[0].FactValue != "Nabi" {
+		t.Fatalf("profile facts = %+v", facts)
+	}
+	matches, err := mcp.SearchMemoryChunkMatches("alice", "Busan", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].MemoryType != "plan" || strings.HasPrefix(matches[0].FullText, "User:") {
+		t.Fatalf("memories = %+v, want only the extracted plan", matches)
+	}
+	provenance, err := mcp.ListMemoryProvenance("alice", matches[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provenance) != 1 || provenance[0].TurnID != "turn-9" || len(provenance[0].EventIDs) != 1 || provenance[0].EventIDs[0] != event.ID {
+		t.Fatalf("provenance = %+v", provenance)
+	}
+
+	// An answer that is not JSON keeps the turn as a raw transcript.
+	rememberChatTurn(chatTurnMemory{UserID: "alice", ModelID: "chat-model", UserText: "I collect vinyl records.", AssistantText: "Nice hobby."})
+	runQueuedMemoryExtractions(context.Background())
+	matches, err = mcp.SearchMemoryChunkMatches("alice", "vinyl records", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].MemoryType != "raw_interaction" {
+		t.Fatalf("memories after a failed extraction = %+v", matches)
+	}
+}
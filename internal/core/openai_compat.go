@@ -0,0 +1,229 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/orchestrator"
+	"dinkisstyle-chat/internal/promptkit"
+	"dinkisstyle-chat/internal/toolruntime"
+	"dinkisstyle-chat/internal/upstream"
+)
+
+// handleOpenAIChatCompletions serves /v1/chat/completions as a plain OpenAI
+// endpoint for SDK clients. Unlike handleChat it adds no memory, skills or
+// chat session and keeps the client's tools: their calls are returned with
+// finish_reason "tool_calls". App tools are offered as well, and run here,
+// only when the client sends X-Gateway-Tools: true.
+func handleOpenAIChatCompletions(w http.ResponseWriter, r *http.Request, app *App, authMgr *AuthManager) {
+	if r.Method != http.MethodPost {
+		chatharness.NewCompletionWriter(w, "", false, false).Fail(http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		chatharness.NewCompletionWriter(w, "", false, false).Fail(http.StatusBadRequest, "invalid_request_error", "Failed to read request")
+		return
+	}
+
+	userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+	endpointRaw, tokenRaw, llmMode := app.llmEndpoint, app.llmApiToken, app.llmMode
+	authMgr.mu.RLock()
+	if user := authMgr.users[userID]; user != nil {
+		if user.Settings.ApiToken != nil {
+			tokenRaw = *user.Settings.ApiToken
+		}
+		if user.Settings.LLMMode != nil {
+			llmMode = *user.Settings.LLMMode
+		}
+	}
+	authMgr.mu.RUnlock()
+	clientModel := requestedChatModel(body)
+	var activeUpstream upstream.Target
+	var failoverUpstreams []upstream.Target
+	if targets := app.upstreams.Route(clientModel); len(targets) > 0 {
+		activeUpstream = targets[0]
+		endpointRaw, tokenRaw, llmMode = activeUpstream.Endpoint, activeUpstream.Token, activeUpstream.Mode
+		for _, target := range targets[1:] {
+			// Failover resends the prepared request, so only upstreams
+			// speaking the same wire format qualify.
+			if target.Mode == llmMode {
+				failoverUpstreams = append(failoverUpstreams, target)
+			}
+		}
+		body = replaceChatModel(body, activeUpstream.Model)
+	}
+
+	toolExecCtx, enableTools := userToolExecutionContext(app, authMgr, userID, "", r.Header.Get("X-User-Location"))
+	toolExecCtx.EnableMemory = toolExecCtx.EnableMemory && requestHasScope(r, APIKeyScopeMemoryRead)
+	toolExecCtx.Scopes = requestScopes(r)
+	var gatewayTools []promptkit.ToolDefinition
+	if enableTools && strings.EqualFold(strings.TrimSpace(r.Header.Get("X-Gateway-Tools")), "true") {
+		for _, definition := range toolruntime.Default.List(toolExecCtx) {
+			gatewayTools = append(gatewayTools, promptkit.ToolDefinition{
+				Name:         definition.Name,
+				Description:  definition.Description,
+				InputSchema:  definition.InputSchema,
+				ParallelSafe: definition.Metadata.ParallelSafe,
+			})
+		}
+	}
+
+	request, err := chatharness.PrepareCompletionRequest(chatharness.CompletionRequestInput{
+		Body:         body,
+		EndpointRaw:  endpointRaw,
+		TokenRaw:     tokenRaw,
+		LLMMode:      llmMode,
+		GatewayTools: gatewayTools,
+	})
+	writer := chatharness.NewCompletionWriter(w, clientModel, request.Stream, request.IncludeUsage)
+	if err != nil {
+		writer.Fail(http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	format := request.ResponseFormat
+	writer.Hold = format != nil && !format.NativeFor(request.LLMMode)
+	toolExecCtx.RequestID = writer.ID
+	AddDebugTrace("chat", "openai.request", "Prepared OpenAI-compatible chat request", map[string]interface{}{
+		"user":          userID,
+		"mode":          request.LLMMode,
+		"model":         request.ModelID,
+		"upstream":      activeUpstream.Name,
+		"failovers":     len(failoverUpstreams),
+		"stream":        request.Stream,
+		"gateway_tools": len(request.GatewayToolNames),
+		"format":        format != nil,
+	})
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	var upstreamError string
+	providerTools, _ := request.ReqMap["tools"].([]interface{})
+	transport := &orchestrator.HTTPTransport{URL: request.UpstreamURL, Token: request.Token, Adapter: chatharness.AdapterFor(request.LLMMode)}
+	round := &orchestrator.ChatRound{
+		Sink: orchestrator.SinkFuncs{RecordFunc: func(role, eventType string, payload interface{}) {
+			event, _ := payload.(map[string]interface{})
+			switch eventType {
+			case "message.delta":
+				content, _ := event["content"].(string)
+				writer.WriteContent(content)
+			case "response_format.repair":
+				writer.SetContent("")
+			case "tool_call.failure":
+				log.Printf("[openai] Gateway tool %v failed: %v", event["tool"], event["reason"])
+			case "error":
+				upstreamError = upstreamEventMessage(event)
+			}
+		}},
+		Passthrough: func(name string) bool {
+			return !request.GatewayToolNames[name]
+		},
+		PromptTools:       gatewayTools,
+		ProviderTools:     providerTools,
+		ParallelToolCalls: request.ReqMap["parallel_tool_calls"] != false,
+		Native:            transport.Adapter != nil,
+		LLMMode:           request.LLMMode,
+		ModelID:           request.ModelID,
+		ReqMap:            request.ReqMap,
+		Body:              request.Body,
+		OriginalUserText:  request.InitialUserInputText,
+		Format:            format,
+		HoldAnswer:        writer.Hold,
+		TurnID:            writer.ID,
+		Started:           time.Now(),
+		Transport:         transport,
+		Trace:             AddDebugTrace,
+	}
+	if len(request.GatewayToolNames) > 0 {
+		round.Tools = registryTools(toolExecCtx)
+	}
+	round.Failover = func(err error) (string, bool) {
+		if len(failoverUpstreams) == 0 || !upstreamUnavailable(err) {
+			return "", false
+		}
+		app.upstreams.MarkFailure(activeUpstream.Name, err)
+		failed := activeUpstream
+		activeUpstream, failoverUpstreams = failoverUpstreams[0], failoverUpstreams[1:]
+		transport.URL = chatharness.UpstreamURL(activeUpstream.Endpoint, request.LLMMode)
+		transport.Token = activeUpstream.Token
+		log.Printf("[openai] Upstream %s failed (%v), failing over to %s", failed.Name, err, activeUpstream.Name)
+		AddDebugTrace("chat", "upstream.failover", "Retrying OpenAI-compatible request on the next upstream", map[string]interface{}{
+			"from":  failed.Name,
+			"to":    activeUpstream.Name,
+			"model": activeUpstream.Model,
+			"error": compactText(err.Error(), 180),
+		})
+		return activeUpstream.Model, true
+	}
+	engine := orchestrator.Engine{
+		Transport: &orchestrator.RetryTransport{
+			Transport: transport,
+			Policy:    app.upstreamRetry,
+			OnRetry: func(attempt orchestrator.RetryAttempt) {
+				log.Printf("[openai] Upstream attempt %d failed (%v), retrying in %s", attempt.Attempt, attempt.Err, attempt.Delay)
+			},
+		},
+	}
+
+	if err := engine.Run(ctx, round.Body, round); err != nil {
+		status, errorType := http.StatusBadGateway, "api_error"
+		var statusErr *orchestrator.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 {
+			status, errorType = statusErr.StatusCode, "invalid_request_error"
+		}
+		log.Printf("[openai] Upstream request failed: %v", err)
+		writer.Fail(status, errorType, err.Error())
+		return
+	}
+	if upstreamError != "" {
+		writer.Fail(http.StatusBadGateway, "api_error", upstreamError)
+		return
+	}
+	if writer.Hold && len(round.ToolCalls) == 0 {
+		document, problem := format.Validate(writer.Content())
+		if problem != nil {
+			writer.Fail(http.StatusBadGateway, "api_error", fmt.Sprintf("answer does not match response_format after %d repairs: %v", round.StructuredRepairs(), problem))
+			return
+		}
+		writer.SetContent(document)
+	}
+
+	usage := chatharness.CompletionUsage{
+		PromptTokens:     round.Usage.PromptTokens,
+		CompletionTokens: round.Usage.CompletionTokens,
+	}
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		// Not every upstream reports usage; estimate it the way stateful
+		// budgets are estimated.
+		messages, _ := json.Marshal(request.ReqMap["messages"])
+		usage.PromptTokens = orchestrator.EstimateTokens(string(messages))
+		usage.CompletionTokens = orchestrator.EstimateTokens(round.Content + round.Reasoning)
+	}
+	writer.Finish(round.ToolCalls, chatharness.CompletionFinishReason(round.FinishReason, len(round.ToolCalls) > 0), usage)
+}
+
+// upstreamEventMessage reads the message of an app "error" event.
+func upstreamEventMessage(event map[string]interface{}) string {
+	if detail, ok := event["error"].(map[string]interface{}); ok {
+		if message, _ := detail["message"].(string); message != "" {
+			return message
+		}
+	}
+	if message, _ := event["error"].(string); message != "" {
+		return message
+	}
+	if message, _ := event["message"].(string); message != "" {
+		return message
+	}
+	return "upstream reported an error"
+}
@@ -0,0 +1,242 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"dinkisstyle-chat/internal/mcp"
+	"dinkisstyle-chat/internal/orchestrator"
+	"dinkisstyle-chat/internal/upstream"
+)
+
+// fakeChatCompletionsUpstream streams one scripted reply per request and
+// records the request bodies it received.
+type fakeChatCompletionsUpstream struct {
+	mu       sync.Mutex
+	replies  [][]string
+	requests []map[string]interface{}
+}
+
+func (f *fakeChatCompletionsUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&request)
+	f.mu.Lock()
+	reply := f.replies[len(f.requests)]
+	f.requests = append(f.requests, request)
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, chunk := range reply {
+		fmt.Fprintf(w, "data: %s\n\n", chunk)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func newOpenAICompatServer(t *testing.T, upstream http.Handler) (http.Handler, string) {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	return newOpenAICompatApp(t, &App{llmEndpoint: server.URL, llmMode: "standard", enableTools: true})
+}
+
+// newOpenAICompatApp serves app with a logged-in user and returns the mux
+// and that user's session token.
+func newOpenAICompatApp(t *testing.T, app *App) (http.Handler, string) {
+	t.Helper()
+	if err := mcp.InitDB(filepath.Join(t.TempDir(), "openai-compat.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mcp.CloseDB)
+	auth := NewAuthManager(filepath.Join(t.TempDir(), "users.json"))
+	if err := auth.AddUser("agent", "secret", "user"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.Authenticate("agent", "secret", false, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.authMgr = auth
+	return createServerMux(app, auth), token
+}
+
+func postChatCompletions(t *testing.T, mux http.Handler, token, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+token)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	mux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestOpenAIChatCompletionsNonStreaming(t *testing.T) {
+	upstream := &fakeChatCompletionsUpstream{replies: [][]string{{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":2,"total_tokens":14}}`,
+	}}}
+	mux, token := newOpenAICompatServer(t, upstream)
+
+	recorder := postChatCompletions(t, mux, token, `{"model":"local","messages":[{"role":"user","content":"hi"}]}`, nil)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d %q: %s", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body.String())
+	}
+	var completion struct {
+		Object  string
+		Model   string
+		Choices []struct {
+			Message struct {
+				Role    string
+				Content *string
+			}
+			FinishReason string `json:"finish_reason"`
+		}
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		}
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if completion.Object != "chat.completion" || completion.Model != "local" || len(completion.Choices) != 1 {
+		t.Fatalf("completion = %s", recorder.Body.String())
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Content == nil || *choice.Message.Content != "Hello" || choice.FinishReason != "stop" {
+		t.Fatalf("choice = %s", recorder.Body.String())
+	}
+	if completion.Usage.PromptTokens != 12 || completion.Usage.CompletionTokens != 2 || completion.Usage.TotalTokens != 14 {
+		t.Fatalf("usage = %+v", completion.Usage)
+	}
+	sent := upstream.requests[0]
+	if sent["stream"] != true || sent["stream_options"].(map[string]interface{})["include_usage"] != true {
+		t.Fatalf("upstream request = %v", sent)
+	}
+	if messages := sent["messages"].([]interface{}); len(messages) != 1 {
+		t.Fatalf("app instructions were added to the client's messages: %v", messages)
+	}
+}
+
+func TestOpenAIChatCompletionsReturnsClientToolCalls(t *testing.T) {
+	upstream := &fakeChatCompletionsUpstream{replies: [][]string{{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_7","type":"function","function":{"name":"lookup_order","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"order_id\":\"A-17\"}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+	}}}
+	mux, token := newOpenAICompatServer(t, upstream)
+	body := `{"model":"local","stream":true,"messages":[{"role":"user","content":"where is A-17?"}],"tools":[{"type":"function","function":{"name":"lookup_order","parameters":{"type":"object","properties":{"order_id":{"type":"string"}}}}}]}`
+
+	recorder := postChatCompletions(t, mux, token, body, nil)
+	if recorder.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	stream := recorder.Body.String()
+	if !strings.HasSuffix(stream, "data: [DONE]\n\n") {
+		t.Fatalf("stream does not end with [DONE]: %s", stream)
+	}
+	for _, want := range []string{
+		`"tool_calls":[{"index":0,"id":"call_7","type":"function","function":{"name":"lookup_order","arguments":"{\"order_id\":\"A-17\"}"}}]`,
+		`"finish_reason":"tool_calls"`,
+	} {
+		if !strings.Contains(stream, want) {
+			t.Fatalf("stream is missing %s:\n%s", want, stream)
+		}
+	}
+	if len(upstream.requests) != 1 {
+		t.Fatalf("client tool was not handed back: %d upstream rounds", len(upstream.requests))
+	}
+	tools, _ := upstream.requests[0]["tools"].([]interface{})
+	if len(tools) != 1 {
+		t.Fatalf("gateway tools were offered without X-Gateway-Tools: %v", tools)
+	}
+}
+
+func TestOpenAIChatCompletionsRunsGatewayTools(t *testing.T) {
+	upstream := &fakeChatCompletionsUpstream{replies: [][]string{
+		{
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_current_time","arguments":"{}"}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		},
+		{
+			`{"choices":[{"index":0,"delta":{"content":"It is noon."}}]}`,
+			`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		},
+	}}
+	mux, token := newOpenAICompatServer(t, upstream)
+
+	recorder := postChatCompletions(t, mux, token, `{"model":"local","messages":[{"role":"user","content":"what time is it?"}]}`, map[string]string{"X-Gateway-Tools": "true"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `"content":"It is noon."`) || !strings.Contains(body, `"finish_reason":"stop"`) || strings.Contains(body, "tool_calls") {
+		t.Fatalf("gateway tool call leaked to the client: %s", body)
+	}
+	if len(upstream.requests) != 2 {
+		t.Fatalf("upstream rounds = %d, want 2", len(upstream.requests))
+	}
+	messages := upstream.requests[1]["messages"].([]interface{})
+	last := messages[len(messages)-1].(map[string]interface{})
+	if last["role"] != "tool" || last["tool_call_id"] != "call_1" {
+		t.Fatalf("follow-up did not carry the tool result: %v", last)
+	}
+}
+
+func TestOpenAIChatCompletionsFailsOverToTheNextUpstream(t *testing.T) {
+	var primaryHits int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		primaryHits++
+		http.Error(w, `{"error":{"message":"overloaded"}}`, http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(primary.Close)
+	backup := &fakeChatCompletionsUpstream{replies: [][]string{{
+		`{"choices":[{"index":0,"delta":{"content":"from backup"}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+	}}}
+	backupServer := httptest.NewServer(backup)
+	t.Cleanup(backupServer.Close)
+	router := upstream.NewRouter([]upstream.Config{
+		{Name: "primary", Endpoint: primary.URL, Models: []string{"local"}},
+		{Name: "backup", Endpoint: backupServer.URL, Models: []string{"local"}},
+	})
+	mux, token := newOpenAICompatApp(t, &App{upstreams: router, upstreamRetry: orchestrator.RetryPolicy{MaxAttempts: 1}})
+
+	recorder := postChatCompletions(t, mux, token, `{"model":"local","messages":[{"role":"user","content":"hi"}]}`, nil)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"content":"from backup"`) {
+		t.Fatalf("failover = %d %s", recorder.Code, recorder.Body.String())
+	}
+	if primaryHits != 1 || len(backup.requests) != 1 || backup.requests[0]["model"] != "local" {
+		t.Fatalf("primary hits = %d, backup requests = %v", primaryHits, backup.requests)
+	}
+	if targets := router.Route("local"); targets[0].Name != "backup" {
+		t.Fatalf("failed upstream was not marked unhealthy: %+v", targets)
+	}
+}
+
+func TestOpenAIChatCompletionsErrors(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.Error(w, `{"error":{"message":"model not loaded"}}`, http.StatusNotFound)
+	})
+	mux, token := newOpenAICompatServer(t, upstream)
+
+	recorder := postChatCompletions(t, mux, token, `{"model":"local","messages":[]}`, nil)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), `"type":"invalid_request_error"`) {
+		t.Fatalf("invalid request = %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = postChatCompletions(t, mux, token, `{"model":"local","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), "model not loaded") {
+		t.Fatalf("upstream error = %d %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"dinkisstyle-chat/internal/mcp"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+const (
+	defaultRerankerModelID  = "bge-reranker-v2-m3"
+	rerankerModelName       = "model.onnx"
+	rerankerMaxTokens       = 512
+	rerankerMaxQueryTokens  = 128
+	rerankerOutputLogitName = "logits"
+)
+
+// RerankerModelConfig selects the cross-encoder that rescores the top hybrid
+// search candidates. It is read from config.json only and is off by default;
+// the model directory holds model.onnx and a unigram tokenizer.json.
+type RerankerModelConfig struct {
+	ModelID string `json:"modelId"`
+	Enabled bool   `json:"enabled"`
+}
+
+// rerankerRuntimeState holds the loaded reranker. Searches score under the
+// read lock, so a swap waits for in-flight ONNX runs before the previous
+// session is destroyed.
+var rerankerRuntimeState = struct {
+	mu      sync.RWMutex
+	runtime *rerankerRuntime
+}{}
+
+// rerankerRuntime scores (query, passage) pairs with an XLM-R style
+// cross-encoder: <s> query </s></s> passage </s> -> one relevance logit.
+type rerankerRuntime struct {
+	modelID   string
+	session   *ort.DynamicAdvancedSession
+	tokenizer *unigramTokenizer
+}
+
+func normalizeRerankerConfig(cfg RerankerModelConfig) RerankerModelConfig {
+	cfg.ModelID = strings.TrimSpace(cfg.ModelID)
+	if cfg.ModelID == "" {
+		cfg.ModelID = defaultRerankerModelID
+	}
+	return cfg
+}
+
+// applyRerankerRuntimeConfig loads or unloads the reranker and installs it
+// as the mcp retrieval reranker. A missing model only logs; search keeps the
+// fused order.
+func applyRerankerRuntimeConfig(cfg RerankerModelConfig) {
+	cfg = normalizeRerankerConfig(cfg)
+	var rt *rerankerRuntime
+	if cfg.Enabled {
+		loaded, err := loadRerankerRuntime(cfg)
+		if err != nil {
+			log.Printf("[Reranker] %s is not available: %v", cfg.ModelID, err)
+		}
+		rt = loaded
+	}
+
+	rerankerRuntimeState.mu.Lock()
+	previous := rerankerRuntimeState.runtime
+	rerankerRuntimeState.runtime = rt
+	rerankerRuntimeState.mu.Unlock()
+	if rt == nil {
+		mcp.SetRetrievalReranker(nil)
+	} else {
+		mcp.SetRetrievalReranker(scoreWithRerankerRuntime)
+		log.Printf("[Reranker] %s is ready", cfg.ModelID)
+	}
+	if previous != nil {
+		_ = previous.Close()
+	}
+}
+
+// scoreWithRerankerRuntime is the installed mcp reranker. It looks the
+// runtime up on every call instead of capturing one, so a search that
+// started before a swap never runs on a destroyed session.
+func scoreWithRerankerRuntime(query string, passages []string) ([]float64, error) {
+	rerankerRuntimeState.mu.RLock()
+	defer rerankerRuntimeState.mu.RUnlock()
+	if rerankerRuntimeState.runtime == nil {
+		return nil, fmt.Errorf("reranker is not loaded")
+	}
+	return rerankerRuntimeState.runtime.Score(query, passages)
+}
+
+func loadRerankerRuntime(cfg RerankerModelConfig) (*rerankerRuntime, error) {
+	modelDir := getRerankerModelInstallDir(cfg.ModelID)
+	if err := InitializeONNXRuntime(); err != nil {
+		return nil, fmt.Errorf("ONNX Runtime init failed: %w", err)
+	}
+	tokenizer, err := loadUnigramTokenizer(filepath.Join(modelDir, "tokenizer.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tokenizer.json: %w", err)
+	}
+	session, err := ort.NewDynamicAdvancedSession(
+		filepath.Join(modelDir, rerankerModelName),
+		[]string{"input_ids", "attention_mask"},
+		[]string{rerankerOutputLogitName},
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reranker model: %w", err)
+	}
+	return &rerankerRuntime{modelID: cfg.ModelID, session: session, tokenizer: tokenizer}, nil
+}
+
+func (r *rerankerRuntime) Close() error {
+	if r == nil || r.session == nil {
+		return nil
+	}
+	return r.session.Destroy()
+}
+
+// encodePair builds the cross-encoder input for one pair, truncating the
+// passage so the pair fits rerankerMaxTokens.
+func (r *rerankerRuntime) encodePair(queryIDs []int64, passage string) []int64 {
+	passageIDs := r.tokenizer.Encode(passage, rerankerMaxTokens-len(queryIDs))
+	ids := make([]int64, 0, len(queryIDs)+len(passageIDs))
+	ids = append(ids, queryIDs...)
+	// Encode wraps text in <s> ... </s>; XLM-R pairs separate the two parts
+	// with </s></s>, so the passage's <s> becomes the second separator.
+	ids = append(ids, int64(r.tokenizer.eosID))
+	return append(ids, passageIDs[1:]...)
+}
+
+// Score returns one relevance logit per passage, in passage order.
+func (r *rerankerRuntime) Score(query string, passages []string) ([]float64, error) {
+	if len(passages) == 0 {
+		return nil, nil
+	}
+	queryIDs := r.tokenizer.Encode(query, rerankerMaxQueryTokens)
+	pairs := make([][]int64, len(passages))
+	width := 0
+	for i, passage := range passages {
+		pairs[i] = r.encodePair(queryIDs, passage)
+		width = max(width, len(pairs[i]))
+	}
+
+	inputIDs := make([]int64, len(pairs)*width)
+	attentionMask := make([]int64, len(pairs)*width)
+	for i, pair := range pairs {
+		row := i * width
+		for j := 0; j < width; j++ {
+			if j < len(pair) {
+				inputIDs[row+j] = pair[j]
+				attentionMask[row+j] = 1
+			} else {
+				inputIDs[row+j] = int64(r.tokenizer.padID)
+			}
+		}
+	}
+
+	shape := ort.NewShape(int64(len(pairs)), int64(width))
+	inputIDsTensor, err := ort.NewTensor(shape, inputIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer inputIDsTensor.Destroy()
+	attentionMaskTensor, err := ort.NewTensor(shape, attentionMask)
+	if err != nil {
+		return nil, err
+	}
+	defer attentionMaskTensor.Destroy()
+
+	outputs := []ort.Value{nil}
+	if err := r.session.Run([]ort.Value{inputIDsTensor, attentionMaskTensor}, outputs); err != nil {
+		return nil, err
+	}
+	if outputs[0] == nil {
+		return nil, fmt.Errorf("reranker returned no logits")
+	}
+	defer outputs[0].Destroy()
+
+	outputTensor, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, fmt.Errorf("reranker returned unexpected output type")
+	}
+	data := outputTensor.GetData()
+	if len(data) == 0 || len(data)%len(pairs) != 0 {
+		return nil, fmt.Errorf("unexpected reranker output shape: %v", outputTensor.GetShape())
+	}
+	// Single-logit models emit [n,1]; two-class models emit [n,2] and the
+	// last column is the relevant class.
+	stride := len(data) / len(pairs)
+	scores := make([]float64, len(pairs))
+	for i := range scores {
+		scores[i] = float64(data[i*stride+stride-1])
+	}
+	return scores, nil
+}
+
+// LoadRetrievalModels loads the default embedding model and the given
+// reranker outside the app, so tools such as cmd/retrieval-eval search
+// memory the way the gateway does. It reports an embedding model that could
+// not be loaded; search then falls back to the built-in hashed embedding.
+func LoadRetrievalModels(reranker RerankerModelConfig) error {
+	applyEmbeddingRuntimeConfig()
+	applyRerankerRuntimeConfig(reranker)
+	if info := getEmbeddingRuntimeInfo(); !info.Ready {
+		return fmt.Errorf("%s", info.Message)
+	}
+	return nil
+}
@@ -11,15 +11,16 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"database/sql"
 	"dinkisstyle-chat/internal/chatharness"
 	"dinkisstyle-chat/internal/mcp"
+	"dinkisstyle-chat/internal/orchestrator"
 	"dinkisstyle-chat/internal/promptkit"
+	"dinkisstyle-chat/internal/skillkit"
 	"dinkisstyle-chat/internal/toolruntime"
-	"encoding/hex"
+	"dinkisstyle-chat/internal/upstream"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -82,12 +83,7 @@ const (
 	recentContextOlderUserBudget    = 220
 	recentContextOlderAssistBudget  = 300
 	recentContextStatefulBudget     = 900
-	webEvidenceToolBudget           = 4
-	webSearchProviderBudget         = 3
-	bufferedSourceReadBudget        = 2
-	deepWebEvidenceToolBudget       = 8
-	deepWebSearchProviderBudget     = 4
-	deepBufferedSourceReadBudget    = 4
+	parallelToolWorkers             = 4
 )
 
 type savedTurnTitleTask struct {
@@ -178,1137 +174,635 @@ func lastRunes(input string, limit int) string {
 	return strings.TrimSpace(string(runes[len(runes)-limit:]))
 }
 
-var reasoningLoopSentencePattern = regexp.MustCompile(`[^.!?。！？]+[.!?。！？]+`)
+func currentChatCancelKey(userID string) string {
+	return strings.TrimSpace(userID) + ":default"
+}
 
-func detectReasoningRunawayRepetition(text string) (string, string, bool) {
-	sectionText := text
-	sectionRunes := []rune(sectionText)
-	if len(sectionRunes) > 8000 {
-		sectionText = string(sectionRunes[len(sectionRunes)-8000:])
+func registerCurrentChatCancel(userID string, cancel context.CancelFunc) {
+	if cancel == nil || strings.TrimSpace(userID) == "" {
+		return
 	}
+	currentChatCancels.Store(currentChatCancelKey(userID), cancel)
+}
 
-	normalized := strings.Join(strings.Fields(text), " ")
-	runes := []rune(normalized)
-	if len(runes) < 140 {
-		return "", "", false
-	}
-	if len(runes) > 6000 {
-		runes = runes[len(runes)-6000:]
-		normalized = string(runes)
+func unregisterCurrentChatCancel(userID string) {
+	if strings.TrimSpace(userID) == "" {
+		return
 	}
+	currentChatCancels.Delete(currentChatCancelKey(userID))
+}
 
-	if snippet, ok := detectRepeatedSuffixRunes(runes, 6, 180, 9); ok {
-		return compactText(snippet, 80), "chunk-loop", true
-	}
-	if snippet, ok := detectRepeatedSuffixRunes(runes, 50, 260, 6); ok {
-		return compactText(snippet, 120), "long-chunk-loop", true
-	}
-	if snippet, ok := detectRepeatedSuffixRunes(runes, 240, 1200, 3); ok {
-		return compactText(snippet, 160), "section-loop", true
+func cancelCurrentChat(userID string) bool {
+	if strings.TrimSpace(userID) == "" {
+		return false
 	}
-	if snippet, ok := detectRepeatedReasoningSection(sectionText); ok {
-		return compactText(snippet, 160), "repeated-section", true
+	value, ok := currentChatCancels.Load(currentChatCancelKey(userID))
+	if !ok {
+		return false
 	}
-
-	words := strings.Fields(normalized)
-	if len(words) >= 12 {
-		lastWord := strings.ToLower(words[len(words)-1])
-		if len([]rune(lastWord)) >= 2 && len([]rune(lastWord)) <= 30 {
-			count := 1
-			for i := len(words) - 2; i >= 0; i-- {
-				if strings.ToLower(words[i]) != lastWord {
-					break
-				}
-				count++
-			}
-			if count >= 12 {
-				return lastWord, "word-loop", true
-			}
-		}
+	cancel, ok := value.(context.CancelFunc)
+	if !ok || cancel == nil {
+		return false
 	}
+	cancel()
+	return true
+}
 
-	return "", "", false
+type savedTurnTitleOptions struct {
+	ModelID        string
+	SecondaryModel string
+	APIToken       string
+	Temperature    float64
+	LLMMode        string
 }
 
-func detectRepeatedReasoningSection(text string) (string, bool) {
-	seen := make(map[string]int)
-	addCandidate := func(candidate string) (string, bool) {
-		segment := strings.Join(strings.Fields(candidate), " ")
-		if len([]rune(segment)) < 36 {
-			return "", false
-		}
-		key := strings.ToLower(segment)
-		seen[key]++
-		if seen[key] >= 4 {
-			return segment, true
-		}
-		return "", false
+func defaultContextStrategyForMode(mode string) string {
+	if strings.EqualFold(strings.TrimSpace(mode), "stateful") {
+		return "retrieval"
 	}
+	return "history"
+}
 
-	for _, line := range strings.Split(text, "\n") {
-		if snippet, ok := addCandidate(line); ok {
-			return snippet, true
+func normalizeContextStrategyForMode(mode, raw string) string {
+	mode = strings.TrimSpace(strings.ToLower(mode))
+	strategy := strings.TrimSpace(strings.ToLower(raw))
+	if mode == "stateful" {
+		switch strategy {
+		case "retrieval", "stateful", "none":
+			return strategy
+		default:
+			return "stateful"
 		}
 	}
-
-	for _, sentence := range reasoningLoopSentencePattern.FindAllString(strings.Join(strings.Fields(text), " "), -1) {
-		if snippet, ok := addCandidate(sentence); ok {
-			return snippet, true
-		}
+	switch strategy {
+	case "retrieval", "history", "none":
+		return strategy
+	default:
+		return "history"
 	}
-
-	return "", false
 }
 
-func detectRepeatedSuffixRunes(runes []rune, minUnit, maxUnit, minRepeats int) (string, bool) {
-	if minUnit <= 0 || maxUnit < minUnit || minRepeats < 2 {
-		return "", false
-	}
-	for unitLen := minUnit; unitLen <= maxUnit && unitLen*minRepeats <= len(runes); unitLen++ {
-		unitStart := len(runes) - unitLen
-		unit := string(runes[unitStart:])
-		repeats := 1
-		for start := unitStart - unitLen; start >= 0; start -= unitLen {
-			if string(runes[start:start+unitLen]) != unit {
-				break
-			}
-			repeats++
-		}
-		if repeats >= minRepeats {
-			return unit, true
-		}
-	}
-	return "", false
+type chatSessionToolHistorySnapshot struct {
+	Tool   string `json:"tool"`
+	Detail string `json:"detail"`
 }
 
-func detectReasoningPayloadRunawayRepetition(payloadMap map[string]interface{}) (string, string, bool) {
-	reasoningContent := extractReasoningContent(payloadMap)
-	if strings.TrimSpace(reasoningContent) == "" {
-		return "", "", false
-	}
-	return detectReasoningRunawayRepetition(reasoningContent)
+type chatSessionToolCardSnapshot struct {
+	State    string                           `json:"state"`
+	Summary  string                           `json:"summary"`
+	Args     interface{}                      `json:"args,omitempty"`
+	ToolName string                           `json:"tool_name"`
+	History  []chatSessionToolHistorySnapshot `json:"history,omitempty"`
 }
 
-func normalizeRelaxedToolArgsJSON(raw string) (string, bool) {
-	trimmed := strings.TrimSpace(raw)
-	if trimmed == "" {
-		return "", false
-	}
-
-	trimmed = strings.NewReplacer(
-		`<|"|>`, `"`,
-		`<|'|>`, `'`,
-	).Replace(trimmed)
+type chatSessionMessageSnapshot struct {
+	TurnID                  string `json:"turn_id"`
+	UserContent             string `json:"user_content,omitempty"`
+	AssistantContent        string `json:"assistant_content,omitempty"`
+	ReasoningContent        string `json:"reasoning_content,omitempty"`
+	ReasoningDurationMS     int64  `json:"reasoning_duration_ms,omitempty"`
+	ReasoningAccumulatedMS  int64  `json:"reasoning_accumulated_ms,omitempty"`
+	ReasoningCurrentPhaseMS int64  `json:"reasoning_current_phase_ms,omitempty"`
+}
 
-	keyPattern := regexp.MustCompile(`([{\[,]\s*)([A-Za-z_][A-Za-z0-9_]*)\s*:`)
-	trimmed = keyPattern.ReplaceAllString(trimmed, `$1"$2":`)
+type chatSessionReasoningSnapshot struct {
+	State          string `json:"state,omitempty"`
+	Content        string `json:"content,omitempty"`
+	DurationMS     int64  `json:"duration_ms,omitempty"`
+	AccumulatedMS  int64  `json:"accumulated_ms,omitempty"`
+	CurrentPhaseMS int64  `json:"current_phase_ms,omitempty"`
+}
 
-	var parsed interface{}
-	if err := json.Unmarshal([]byte(trimmed), &parsed); err != nil {
-		return "", false
-	}
-	bytes, err := json.Marshal(parsed)
-	if err != nil {
-		return "", false
-	}
-	return string(bytes), true
+type chatSessionTurnSnapshot struct {
+	TurnID           string                       `json:"turn_id"`
+	Status           string                       `json:"status,omitempty"`
+	UserContent      string                       `json:"user_content,omitempty"`
+	AssistantContent string                       `json:"assistant_content,omitempty"`
+	Reasoning        chatSessionReasoningSnapshot `json:"reasoning,omitempty"`
+	Tool             *chatSessionToolCardSnapshot `json:"tool,omitempty"`
 }
 
-func normalizeBufferedToolMatch(toolName string, toolArgsStr string) (string, string, interface{}, bool) {
-	toolName = strings.TrimSpace(toolName)
-	toolArgsStr = strings.TrimSpace(toolArgsStr)
+type chatSessionUISnapshot struct {
+	ToolCards    map[string]chatSessionToolCardSnapshot `json:"tool_cards"`
+	Messages     []chatSessionMessageSnapshot           `json:"messages,omitempty"`
+	Turns        []chatSessionTurnSnapshot              `json:"turns,omitempty"`
+	LastEventSeq int                                    `json:"last_event_seq,omitempty"`
+}
 
-	if toolArgsStr != "" && !json.Valid([]byte(toolArgsStr)) {
-		if normalized, ok := normalizeRelaxedToolArgsJSON(toolArgsStr); ok {
-			toolArgsStr = normalized
-		}
-	}
+func cleanSavedTurnTitleContext(input string, limit int) string {
+	input = strings.ReplaceAll(input, "\r\n", "\n")
+	input = strings.ReplaceAll(input, "\r", "\n")
+	input = regexp.MustCompile("```[\\s\\S]*?```").ReplaceAllString(input, " ")
+	input = regexp.MustCompile(`(?i)<\|channel(?:\||>)?\s*thought[\s\S]*?(?:<channel\|>|<\/channel\|>|<\|channel(?:\||>)?\s*(?:message|final|instruction|response)|$)`).ReplaceAllString(input, " ")
+	input = regexp.MustCompile("<think>[\\s\\S]*?</think>").ReplaceAllString(input, " ")
+	input = regexp.MustCompile(`!\[([^\]]*)\]\([^)]+\)`).ReplaceAllString(input, "$1")
+	input = regexp.MustCompile(`\[([^\]]+)\]\([^)]+\)`).ReplaceAllString(input, "$1")
+	input = regexp.MustCompile(`(?m)^\s*#{1,6}\s*`).ReplaceAllString(input, "")
+	input = regexp.MustCompile(`(?m)^\s*[-*+]\s+`).ReplaceAllString(input, "")
+	input = regexp.MustCompile(`(?m)^\s*\d+[.)]\s+`).ReplaceAllString(input, "")
+	input = regexp.MustCompile(`(?m)^\s*>+\s*`).ReplaceAllString(input, "")
+	input = strings.NewReplacer(
+		"|", " ",
+		"`", "",
+		"**", "",
+		"__", "",
+		"~~", "",
+		"---", " ",
+		"***", " ",
+	).Replace(input)
+	input = regexp.MustCompile(`\s+`).ReplaceAllString(strings.TrimSpace(input), " ")
+	return compactText(input, limit)
+}
 
-	var wrapper struct {
-		Name          string      `json:"name"`
-		Tool          string      `json:"tool"`
-		ToolName      string      `json:"tool_name"`
-		Arguments     interface{} `json:"arguments"`
-		ToolArguments interface{} `json:"tool_arguments"`
-		Parameters    interface{} `json:"parameters"`
-		Params        interface{} `json:"params"`
+func parseChatSessionUISnapshot(raw string) chatSessionUISnapshot {
+	snapshot := chatSessionUISnapshot{
+		ToolCards: map[string]chatSessionToolCardSnapshot{},
+		Messages:  []chatSessionMessageSnapshot{},
+		Turns:     []chatSessionTurnSnapshot{},
 	}
-	if err := json.Unmarshal([]byte(toolArgsStr), &wrapper); err == nil {
-		wrapperName := strings.TrimSpace(wrapper.Name)
-		if wrapperName == "" {
-			wrapperName = strings.TrimSpace(wrapper.Tool)
-		}
-		if wrapperName == "" {
-			wrapperName = strings.TrimSpace(wrapper.ToolName)
-		}
-		wrapperArguments := wrapper.Arguments
-		if wrapperArguments == nil {
-			wrapperArguments = wrapper.ToolArguments
-		}
-		if wrapperArguments == nil {
-			wrapperArguments = wrapper.Parameters
-		}
-		if wrapperArguments == nil {
-			wrapperArguments = wrapper.Params
-		}
-		if wrapperName != "" {
-			if wrapperArguments == nil {
-				wrapperArguments = map[string]interface{}{}
-			}
-			argumentBytes, marshalErr := json.Marshal(wrapperArguments)
-			if marshalErr == nil {
-				return wrapperName, string(argumentBytes), wrapperArguments, true
-			}
-		}
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "{}" {
+		return snapshot
 	}
-
-	var args interface{}
-	if err := json.Unmarshal([]byte(toolArgsStr), &args); err == nil {
-		return toolName, toolArgsStr, args, false
+	if err := json.Unmarshal([]byte(raw), &snapshot); err != nil {
+		return chatSessionUISnapshot{ToolCards: map[string]chatSessionToolCardSnapshot{}, Messages: []chatSessionMessageSnapshot{}, Turns: []chatSessionTurnSnapshot{}}
 	}
-	return toolName, toolArgsStr, nil, false
-}
-
-func parseJSONToolCall(raw string) (string, string, interface{}, bool) {
-	trimmed := strings.TrimSpace(raw)
-	if strings.HasPrefix(trimmed, "```") {
-		match := regexp.MustCompile("(?is)^```(?:json)?\\s*([\\s\\S]*?)\\s*```").FindStringSubmatch(trimmed)
-		if len(match) < 2 {
-			return "", "", nil, false
-		}
-		trimmed = strings.TrimSpace(match[1])
+	if snapshot.ToolCards == nil {
+		snapshot.ToolCards = map[string]chatSessionToolCardSnapshot{}
 	}
-	if !strings.HasPrefix(trimmed, "{") || !strings.HasSuffix(trimmed, "}") {
-		return "", "", nil, false
+	if snapshot.Messages == nil {
+		snapshot.Messages = []chatSessionMessageSnapshot{}
 	}
-	name, argumentsJSON, arguments, wrapper := normalizeBufferedToolMatch("", trimmed)
-	if !wrapper || strings.TrimSpace(name) == "" || arguments == nil {
-		return "", "", nil, false
+	if snapshot.Turns == nil {
+		snapshot.Turns = []chatSessionTurnSnapshot{}
 	}
-	return name, argumentsJSON, arguments, true
-}
-
-func looksLikeJSONToolCallPrefix(raw string) bool {
-	trimmed := strings.ToLower(strings.TrimSpace(raw))
-	return strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "```json")
+	hydrateLegacyChatSessionViews(&snapshot)
+	return snapshot
 }
 
-func looksLikeJSONToolCallPossiblePrefix(raw string) bool {
-	trimmed := strings.ToLower(strings.TrimSpace(raw))
-	if trimmed == "" {
-		return false
-	}
-	for _, marker := range []string{"```json", "{"} {
-		if strings.HasPrefix(marker, trimmed) {
-			return true
-		}
+func encodeChatSessionUISnapshot(snapshot chatSessionUISnapshot) string {
+	if snapshot.ToolCards == nil {
+		snapshot.ToolCards = map[string]chatSessionToolCardSnapshot{}
 	}
-	return false
-}
-
-func parseXMLLikeToolCall(raw string) (string, string, interface{}, bool) {
-	trimmed := strings.TrimSpace(raw)
-	if trimmed == "" {
-		return "", "", nil, false
+	if snapshot.Messages == nil {
+		snapshot.Messages = []chatSessionMessageSnapshot{}
 	}
-
-	for {
-		wrapperMatch := regexp.MustCompile(`(?s)^<tool_call>\s*([\s\S]*?)\s*</tool_call>\s*$`).FindStringSubmatch(trimmed)
-		if len(wrapperMatch) < 2 {
-			break
-		}
-		unwrapped := strings.TrimSpace(wrapperMatch[1])
-		if unwrapped == "" || unwrapped == trimmed {
-			break
-		}
-		trimmed = unwrapped
+	if snapshot.Turns == nil {
+		snapshot.Turns = []chatSessionTurnSnapshot{}
 	}
-
-	toolOpen := regexp.MustCompile(`(?s)<([a-zA-Z_][a-zA-Z0-9_]*)\b[^>]*>`)
-	openMatch := toolOpen.FindStringSubmatch(trimmed)
-	if len(openMatch) < 2 {
-		return "", "", nil, false
+	hydrateLegacyChatSessionViews(&snapshot)
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return "{}"
 	}
+	return string(bytes)
+}
 
-	toolName := strings.TrimSpace(openMatch[1])
-	switch toolName {
-	case "tool_call", "remark", "think", "arg_key", "arg_value":
-		return "", "", nil, false
+func hydrateLegacyChatSessionViews(snapshot *chatSessionUISnapshot) {
+	if snapshot == nil {
+		return
 	}
-
-	closeTag := fmt.Sprintf("</%s>", toolName)
-	closeIdx := strings.LastIndex(strings.ToLower(trimmed), strings.ToLower(closeTag))
-	if closeIdx < 0 {
-		return "", "", nil, false
+	if snapshot.ToolCards == nil {
+		snapshot.ToolCards = map[string]chatSessionToolCardSnapshot{}
 	}
-
-	bodyStart := strings.Index(trimmed, ">")
-	if bodyStart < 0 || bodyStart >= closeIdx {
-		return "", "", nil, false
+	if snapshot.Messages == nil {
+		snapshot.Messages = []chatSessionMessageSnapshot{}
 	}
-	body := trimmed[bodyStart+1 : closeIdx]
-	body = strings.TrimSpace(body)
-	if body == "" {
-		emptyArgs := map[string]interface{}{}
-		return toolName, `{}`, emptyArgs, true
+	if snapshot.Turns == nil {
+		snapshot.Turns = []chatSessionTurnSnapshot{}
 	}
-	if body != "" {
-		var jsonArgs interface{}
-		if err := json.Unmarshal([]byte(body), &jsonArgs); err == nil {
-			argBytes, marshalErr := json.Marshal(jsonArgs)
-			if marshalErr == nil {
-				return toolName, string(argBytes), jsonArgs, true
+	if len(snapshot.Turns) == 0 && (len(snapshot.Messages) > 0 || len(snapshot.ToolCards) > 0) {
+		for _, msg := range snapshot.Messages {
+			turn := chatSessionTurnSnapshot{
+				TurnID:           msg.TurnID,
+				UserContent:      msg.UserContent,
+				AssistantContent: msg.AssistantContent,
+				Reasoning: chatSessionReasoningSnapshot{
+					Content:        msg.ReasoningContent,
+					DurationMS:     msg.ReasoningDurationMS,
+					AccumulatedMS:  msg.ReasoningAccumulatedMS,
+					CurrentPhaseMS: msg.ReasoningCurrentPhaseMS,
+				},
 			}
-		}
-	}
-
-	argPattern := regexp.MustCompile(`(?s)<arg_key>\s*([^<]+?)\s*</arg_key>\s*<arg_value>\s*([\s\S]*?)\s*</arg_value>`)
-	argMatches := argPattern.FindAllStringSubmatch(body, -1)
-	args := map[string]interface{}{}
-	for _, match := range argMatches {
-		if len(match) < 3 {
-			continue
-		}
-		key := strings.TrimSpace(match[1])
-		value := strings.TrimSpace(match[2])
-		if key == "" {
-			continue
-		}
-		args[key] = value
-	}
-
-	if len(args) == 0 {
-		tagArgPattern := regexp.MustCompile(`(?s)<([a-zA-Z_][a-zA-Z0-9_]*)>\s*([^<]*?)\s*</([a-zA-Z_][a-zA-Z0-9_]*)>`)
-		for _, match := range tagArgPattern.FindAllStringSubmatch(body, -1) {
-			if len(match) < 4 || !strings.EqualFold(strings.TrimSpace(match[1]), strings.TrimSpace(match[3])) {
-				continue
+			if tool, ok := snapshot.ToolCards[msg.TurnID]; ok {
+				toolCopy := tool
+				turn.Tool = &toolCopy
 			}
-			key := strings.TrimSpace(match[1])
-			value := strings.TrimSpace(match[2])
-			if key != "" && value != "" {
-				args[key] = value
+			if strings.TrimSpace(turn.AssistantContent) != "" || strings.TrimSpace(turn.Reasoning.Content) != "" || turn.Tool != nil {
+				turn.Status = "completed"
 			}
+			snapshot.Turns = append(snapshot.Turns, turn)
 		}
 	}
-	if len(args) == 0 {
-		if !strings.Contains(body, "<") && !strings.Contains(body, ">") {
-			if argsJSON, implicitArgs, ok := buildImplicitToolArgs(toolName, body, ""); ok {
-				return toolName, argsJSON, implicitArgs, true
+	if len(snapshot.Messages) == 0 && len(snapshot.Turns) > 0 {
+		for _, turn := range snapshot.Turns {
+			snapshot.Messages = append(snapshot.Messages, chatSessionMessageSnapshot{
+				TurnID:                  turn.TurnID,
+				UserContent:             turn.UserContent,
+				AssistantContent:        turn.AssistantContent,
+				ReasoningContent:        turn.Reasoning.Content,
+				ReasoningDurationMS:     turn.Reasoning.DurationMS,
+				ReasoningAccumulatedMS:  turn.Reasoning.AccumulatedMS,
+				ReasoningCurrentPhaseMS: turn.Reasoning.CurrentPhaseMS,
+			})
+			if turn.Tool != nil {
+				snapshot.ToolCards[turn.TurnID] = *turn.Tool
 			}
 		}
-		return "", "", nil, false
 	}
-
-	argBytes, err := json.Marshal(args)
-	if err != nil {
-		return "", "", nil, false
-	}
-	return toolName, string(argBytes), args, true
 }
 
-func buildImplicitToolArgs(toolName string, explicitText string, userText string) (string, interface{}, bool) {
-	trimmedExplicit := strings.TrimSpace(explicitText)
-	trimmedUser := strings.TrimSpace(userText)
-	queryText := trimmedExplicit
-	if queryText == "" {
-		queryText = trimmedUser
-	}
-	switch strings.TrimSpace(toolName) {
-	case "search_memory", "search_web", "search_web_multi", "naver_search", "namu_wiki", "read_help":
-		if queryText == "" {
-			return "", nil, false
-		}
-		args := map[string]interface{}{"query": queryText}
-		argBytes, err := json.Marshal(args)
-		if err != nil {
-			return "", nil, false
-		}
-		return string(argBytes), args, true
-	case "save_user_fact":
-		if queryText == "" {
-			return "", nil, false
-		}
-		args := map[string]interface{}{"fact_key": "user_fact", "fact_value": queryText}
-		argBytes, err := json.Marshal(args)
-		if err != nil {
-			return "", nil, false
-		}
-		return string(argBytes), args, true
-	case "delete_user_fact":
-		if queryText == "" {
-			return "", nil, false
-		}
-		args := map[string]interface{}{"fact_key": queryText}
-		argBytes, err := json.Marshal(args)
-		if err != nil {
-			return "", nil, false
-		}
-		return string(argBytes), args, true
-	case "read_web_page":
-		if queryText == "" {
-			return "", nil, false
-		}
-		args := map[string]interface{}{"url": queryText}
-		argBytes, err := json.Marshal(args)
-		if err != nil {
-			return "", nil, false
-		}
-		return string(argBytes), args, true
-	case "read_buffered_source":
-		if queryText == "" {
-			args := map[string]interface{}{}
-			argBytes, err := json.Marshal(args)
-			if err != nil {
-				return "", nil, false
-			}
-			return string(argBytes), args, true
-		}
-		args := map[string]interface{}{"query": queryText}
-		argBytes, err := json.Marshal(args)
-		if err != nil {
-			return "", nil, false
-		}
-		return string(argBytes), args, true
-	case "get_current_time", "get_current_location":
-		args := map[string]interface{}{}
-		argBytes, err := json.Marshal(args)
-		if err != nil {
-			return "", nil, false
-		}
-		return string(argBytes), args, true
-	default:
-		return "", nil, false
+func deriveLastSessionFromChatSession(entry mcp.ChatSessionEntry) (map[string]interface{}, bool) {
+	snapshot := parseChatSessionUISnapshot(entry.UIStateJSON)
+	if len(snapshot.Messages) == 0 {
+		return nil, false
 	}
-}
 
-func parseBareToolCallTag(raw string, userText string) (string, string, interface{}, bool) {
-	trimmed := strings.TrimSpace(raw)
-	if trimmed == "" {
-		return "", "", nil, false
-	}
-	match := regexp.MustCompile(`(?s)<tool_call>\s*([\s\S]*?)\s*</tool_call>`).FindStringSubmatch(trimmed)
-	if len(match) < 2 {
-		return "", "", nil, false
-	}
-	inner := strings.TrimSpace(match[1])
-	if inner == "" {
-		return "", "", nil, false
+	for i := len(snapshot.Messages) - 1; i >= 0; i-- {
+		item := snapshot.Messages[i]
+		userText := strings.TrimSpace(item.UserContent)
+		assistantText := strings.TrimSpace(item.AssistantContent)
+		if userText == "" || assistantText == "" {
+			continue
+		}
+		return map[string]interface{}{
+			"has_session":       true,
+			"user_message":      userText,
+			"assistant_message": assistantText,
+			"mode":              strings.TrimSpace(entry.LLMMode),
+			"updated_at":        entry.UpdatedAt,
+		}, true
 	}
 
-	toolName := ""
-	explicitQuery := ""
-	if explicit := regexp.MustCompile(`(?s)^([a-zA-Z_][a-zA-Z0-9_]*)(?:\s*[:=]\s*|\s+query\s*[:=]\s*)(.+)$`).FindStringSubmatch(inner); len(explicit) >= 3 {
-		toolName = strings.TrimSpace(explicit[1])
-		explicitQuery = strings.TrimSpace(explicit[2])
-	} else if compact := regexp.MustCompile(`(?s)^(search_memory|search_web|naver_search|namu_wiki|read_buffered_source|read_help)\s*query\s*[:=]\s*(.+)$`).FindStringSubmatch(inner); len(compact) >= 3 {
-		toolName = strings.TrimSpace(compact[1])
-		explicitQuery = strings.TrimSpace(compact[2])
-	} else {
-		toolName = inner
-	}
-	if toolName == "" {
-		return "", "", nil, false
-	}
-	argsJSON, args, ok := buildImplicitToolArgs(toolName, explicitQuery, userText)
-	if !ok {
-		return "", "", nil, false
-	}
-	return toolName, argsJSON, args, true
+	return nil, false
 }
 
-func looksLikeToolMarkup(raw string) bool {
-	trimmed := strings.ToLower(strings.TrimSpace(raw))
-	if trimmed == "" {
-		return false
-	}
-	if _, _, _, ok := parseJSONToolCall(raw); ok {
-		return true
-	}
-	hasToolName := strings.Contains(trimmed, `"tool"`) ||
-		strings.Contains(trimmed, `"name"`) ||
-		strings.Contains(trimmed, `"tool_name"`)
-	hasToolArguments := strings.Contains(trimmed, `"arguments"`) ||
-		strings.Contains(trimmed, `"tool_arguments"`) ||
-		strings.Contains(trimmed, `"parameters"`) ||
-		strings.Contains(trimmed, `"params"`)
-	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "```json")) && hasToolName && hasToolArguments {
-		return true
+func summarizeLastSessionSnapshot(snapshot chatSessionUISnapshot) string {
+	if len(snapshot.Messages) == 0 {
+		return "messages=0"
 	}
-	markers := []string{
-		"<tool_call",
-		"</tool_call",
-		"<tool_code",
-		"</tool_code",
-		"<|tool_code|>",
-		"<|/tool_code|>",
-		"<execute_command",
-		"</execute_command",
-		"<search_memory",
-		"</search_memory",
-		"<read_memory",
-		"</read_memory",
-		"<read_memory_context",
-		"</read_memory_context",
-		"<read_buffered_source",
-		"</read_buffered_source",
-		"<read_help",
-		"</read_help",
-		"<search_web",
-		"</search_web",
-		"<naver_search",
-		"</naver_search",
-		"<namu_wiki",
-		"</namu_wiki",
-		"<arg_key",
-		"</arg_key",
-		"<arg_value",
-		"</arg_value",
-		"<query>",
-		"</query>",
-		"<source_id>",
-		"</source_id>",
-	}
-	for _, marker := range markers {
-		if strings.Contains(trimmed, marker) {
-			return true
-		}
+	parts := make([]string, 0, min(3, len(snapshot.Messages)))
+	for i := len(snapshot.Messages) - 1; i >= 0 && len(parts) < 3; i-- {
+		item := snapshot.Messages[i]
+		parts = append(parts, fmt.Sprintf("turn=%s user=%d assistant=%d reasoning=%d",
+			strings.TrimSpace(item.TurnID),
+			len([]rune(strings.TrimSpace(item.UserContent))),
+			len([]rune(strings.TrimSpace(item.AssistantContent))),
+			len([]rune(strings.TrimSpace(item.ReasoningContent))),
+		))
 	}
-	return false
+	return fmt.Sprintf("messages=%d last=[%s]", len(snapshot.Messages), strings.Join(parts, "; "))
 }
 
-func classifyPromptToolMarkup(raw string, tools []promptkit.ToolDefinition) (recognized bool, possiblePrefix bool) {
-	trimmed := strings.ToLower(strings.TrimSpace(raw))
-	if trimmed == "" {
-		return false, false
-	}
-	markers := []string{"<tool_call>", "<tool_code>", "<|tool_code|>"}
-	for _, tool := range tools {
-		name := strings.ToLower(strings.TrimSpace(tool.Name))
-		if name != "" {
-			markers = append(markers, "<"+name+">", name+"(", name+" (")
-		}
-	}
-	for _, marker := range markers {
-		if strings.HasPrefix(trimmed, marker) {
-			return true, true
-		}
-		if strings.HasPrefix(marker, trimmed) {
-			possiblePrefix = true
-		}
+func deriveLastSessionFromChatEvents(userID string, entry mcp.ChatSessionEntry) (map[string]interface{}, bool) {
+	events, err := mcp.ListChatEvents(userID, entry.ID, 0, 2000)
+	if err != nil || len(events) == 0 {
+		return nil, false
 	}
-	return false, possiblePrefix
-}
 
-// classifyPromptToolStreamCandidate applies the same quarantine decision to
-// both OpenAI-style deltas and LM Studio's custom message.delta events. JSON
-// wrappers need special handling because their first chunks ("`", "```", or
-// "{") do not yet contain a tool name and cannot be parsed as a complete call.
-func classifyPromptToolStreamCandidate(raw string, tools []promptkit.ToolDefinition) (startBuffering bool, holdPrefix bool) {
-	recognized, possiblePrefix := classifyPromptToolMarkup(raw, tools)
-	if recognized || looksLikeJSONToolCallPrefix(raw) {
-		return true, false
+	type turnSnapshot struct {
+		user      string
+		assistant string
 	}
-	return false, possiblePrefix || looksLikeJSONToolCallPossiblePrefix(raw)
-}
 
-func hasPromptToolClosingTag(raw string, tools []promptkit.ToolDefinition) bool {
-	lower := strings.ToLower(raw)
-	if strings.Contains(lower, "</tool_call>") {
-		return true
-	}
-	if strings.Contains(lower, "</tool_code>") || strings.Contains(lower, "<|/tool_code|>") {
-		return true
-	}
-	for _, tool := range tools {
-		name := strings.ToLower(strings.TrimSpace(tool.Name))
-		if name != "" && strings.Contains(lower, "</"+name+">") {
-			return true
-		}
-		trimmed := strings.TrimSpace(lower)
-		if name != "" && (strings.HasPrefix(trimmed, name+"(") || strings.HasPrefix(trimmed, name+" (")) && strings.HasSuffix(trimmed, ")") {
-			return true
-		}
-	}
-	return false
-}
+	byTurn := make(map[string]*turnSnapshot)
+	order := make([]string, 0, len(events))
 
-func isRegisteredPromptTool(name string, tools []promptkit.ToolDefinition) bool {
-	name = strings.TrimSpace(name)
-	if name == "" {
-		return false
-	}
-	for _, tool := range tools {
-		if strings.EqualFold(strings.TrimSpace(tool.Name), name) {
-			return true
+	ensureTurn := func(turnID string) *turnSnapshot {
+		key := strings.TrimSpace(turnID)
+		if key == "" {
+			return nil
 		}
-	}
-	return false
-}
-
-func parsePromptToolMarkup(raw string) (string, string, interface{}, bool) {
-	trimmed := strings.TrimSpace(raw)
-	if call, ok := chatharness.ParseFunctionParameterToolCall(trimmed); ok {
-		var arguments interface{}
-		if err := json.Unmarshal([]byte(call.Arguments), &arguments); err == nil {
-			return call.Name, call.Arguments, arguments, true
+		if existing, ok := byTurn[key]; ok {
+			return existing
 		}
+		next := &turnSnapshot{}
+		byTurn[key] = next
+		order = append(order, key)
+		return next
 	}
-	if name, argumentsJSON, arguments, ok := parseJSONToolCall(trimmed); ok {
-		return name, argumentsJSON, arguments, true
-	}
-	if name, argumentsJSON, arguments, ok := parseToolCodeCall(trimmed); ok {
-		return name, argumentsJSON, arguments, true
-	}
-	if strings.HasPrefix(strings.ToLower(trimmed), "<tool_call>") {
-		match := regexp.MustCompile(`(?s)^\s*<tool_call>\s*([\s\S]*?)\s*</tool_call>\s*$`).FindStringSubmatch(raw)
-		if len(match) < 2 {
-			return "", "", nil, false
-		}
-		name, argumentsJSON, arguments, _ := normalizeBufferedToolMatch("", strings.TrimSpace(match[1]))
-		if strings.TrimSpace(name) == "" || arguments == nil {
-			return "", "", nil, false
+
+	for _, event := range events {
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(event.PayloadJSON)), &payload); err != nil {
+			payload = map[string]interface{}{}
 		}
-		return name, argumentsJSON, arguments, true
-	}
-	if name, argumentsJSON, arguments, ok := parseXMLLikeToolCall(raw); ok {
-		return name, argumentsJSON, arguments, true
-	}
-	if name, argumentsJSON, arguments, ok := parseFunctionLikeToolCall(raw); ok {
-		return name, argumentsJSON, arguments, true
-	}
-	return "", "", nil, false
-}
 
-// stripLeadingPromptToolArtifacts is a final defense for an already-completed
-// textual tool wrapper. Streaming paths should quarantine these before they
-// reach the answer, but keeping them out of request.complete and persisted
-// assistant history prevents an upstream format variation from resurfacing as
-// a visible fenced JSON block.
-func stripLeadingPromptToolArtifacts(raw string, tools []promptkit.ToolDefinition) (string, bool) {
-	remaining := strings.TrimSpace(raw)
-	changed := false
-	for remaining != "" {
-		consumed := 0
-		candidate := ""
-		if match := regexp.MustCompile("(?is)^```(?:json)?\\s*([\\s\\S]*?)\\s*```\\s*").FindStringIndex(remaining); len(match) == 2 && match[0] == 0 {
-			candidate = remaining[:match[1]]
-			consumed = match[1]
-		} else if strings.HasPrefix(remaining, "{") {
-			decoder := json.NewDecoder(strings.NewReader(remaining))
-			var value json.RawMessage
-			if err := decoder.Decode(&value); err == nil {
-				consumed = int(decoder.InputOffset())
-				candidate = remaining[:consumed]
+		turnID := strings.TrimSpace(event.TurnID)
+		if turnID == "" {
+			if raw, ok := payload["turn_id"].(string); ok {
+				turnID = strings.TrimSpace(raw)
 			}
 		}
-		if consumed <= 0 || candidate == "" {
-			break
-		}
-		toolName, _, _, ok := parsePromptToolMarkup(candidate)
-		if !ok || !isRegisteredPromptTool(toolName, tools) {
-			break
+		turn := ensureTurn(turnID)
+		if turn == nil {
+			continue
 		}
-		remaining = strings.TrimSpace(remaining[consumed:])
-		changed = true
-	}
-	return remaining, changed
-}
-
-func parseToolCodeCall(raw string) (string, string, interface{}, bool) {
-	trimmed := strings.TrimSpace(raw)
-	match := regexp.MustCompile(`(?is)^\s*(?:<tool_code>|<\|tool_code\|>)\s*([\s\S]*?)\s*(?:</tool_code>|<\|/tool_code\|>)\s*$`).FindStringSubmatch(trimmed)
-	if len(match) < 2 {
-		return "", "", nil, false
-	}
-	body := strings.TrimSpace(match[1])
-	if printMatch := regexp.MustCompile(`(?is)^print\s*\(([\s\S]*)\)\s*$`).FindStringSubmatch(body); len(printMatch) >= 2 {
-		body = strings.TrimSpace(printMatch[1])
-	}
-	return parseFunctionLikeToolCall(body)
-}
 
-func parseFunctionLikeToolCall(raw string) (string, string, interface{}, bool) {
-	match := regexp.MustCompile(`(?s)^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\(([\s\S]*)\)\s*$`).FindStringSubmatch(raw)
-	if len(match) < 3 {
-		return "", "", nil, false
-	}
-	toolName := strings.TrimSpace(match[1])
-	inner := strings.TrimSpace(match[2])
-	args := map[string]interface{}{}
-	if inner != "" {
-		parts, ok := splitFunctionLikeArguments(inner)
-		if !ok {
-			return "", "", nil, false
-		}
-		keyPattern := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
-		for _, part := range parts {
-			assignment := topLevelAssignmentIndex(part)
-			if assignment < 0 {
-				return "", "", nil, false
+		switch event.EventType {
+		case "message.created":
+			if event.Role == "user" {
+				if content, ok := payload["content"].(string); ok && strings.TrimSpace(content) != "" {
+					turn.user = strings.TrimSpace(content)
+				}
 			}
-			key := strings.TrimSpace(part[:assignment])
-			if !keyPattern.MatchString(key) {
-				return "", "", nil, false
+		case "message.delta":
+			if fullContent, ok := payload["full_content"].(string); ok && strings.TrimSpace(fullContent) != "" {
+				turn.assistant = strings.TrimSpace(fullContent)
+			} else if content, ok := payload["content"].(string); ok && strings.TrimSpace(content) != "" {
+				turn.assistant += content
+				turn.assistant = strings.TrimSpace(turn.assistant)
 			}
-			value, ok := parseFunctionLikeValue(strings.TrimSpace(part[assignment+1:]))
-			if !ok {
-				return "", "", nil, false
+		case "chat.end", "request.complete":
+			if content := chatharness.ExtractFinalAssistantContent(payload); strings.TrimSpace(content) != "" {
+				turn.assistant = strings.TrimSpace(content)
 			}
-			args[key] = value
 		}
 	}
-	argumentsJSON, err := json.Marshal(args)
-	if err != nil {
-		return "", "", nil, false
-	}
-	return toolName, string(argumentsJSON), args, true
-}
 
-func splitFunctionLikeArguments(raw string) ([]string, bool) {
-	parts := []string{}
-	start := 0
-	quote := byte(0)
-	escaped := false
-	depth := 0
-	for i := 0; i < len(raw); i++ {
-		ch := raw[i]
-		if quote != 0 {
-			if escaped {
-				escaped = false
-				continue
-			}
-			if ch == '\\' {
-				escaped = true
-				continue
-			}
-			if ch == quote {
-				quote = 0
-			}
+	for i := len(order) - 1; i >= 0; i-- {
+		turn := byTurn[order[i]]
+		if turn == nil {
 			continue
 		}
-		switch ch {
-		case '\'', '"':
-			quote = ch
-		case '{', '[', '(':
-			depth++
-		case '}', ']', ')':
-			depth--
-			if depth < 0 {
-				return nil, false
-			}
-		case ',':
-			if depth == 0 {
-				part := strings.TrimSpace(raw[start:i])
-				if part == "" {
-					return nil, false
-				}
-				parts = append(parts, part)
-				start = i + 1
-			}
-		}
-	}
-	if quote != 0 || escaped || depth != 0 {
-		return nil, false
-	}
-	last := strings.TrimSpace(raw[start:])
-	if last == "" {
-		return nil, false
-	}
-	return append(parts, last), true
-}
-
-func topLevelAssignmentIndex(raw string) int {
-	quote := byte(0)
-	escaped := false
-	depth := 0
-	for i := 0; i < len(raw); i++ {
-		ch := raw[i]
-		if quote != 0 {
-			if escaped {
-				escaped = false
-			} else if ch == '\\' {
-				escaped = true
-			} else if ch == quote {
-				quote = 0
-			}
+		if strings.TrimSpace(turn.user) == "" || strings.TrimSpace(turn.assistant) == "" {
 			continue
 		}
-		switch ch {
-		case '\'', '"':
-			quote = ch
-		case '{', '[', '(':
-			depth++
-		case '}', ']', ')':
-			depth--
-		case '=':
-			if depth == 0 {
-				return i
-			}
-		}
+		return map[string]interface{}{
+			"has_session":       true,
+			"user_message":      strings.TrimSpace(turn.user),
+			"assistant_message": strings.TrimSpace(turn.assistant),
+			"mode":              strings.TrimSpace(entry.LLMMode),
+			"updated_at":        entry.UpdatedAt,
+		}, true
 	}
-	return -1
+
+	return nil, false
 }
 
-func parseFunctionLikeValue(raw string) (interface{}, bool) {
-	if raw == "" {
-		return nil, false
-	}
-	if strings.HasPrefix(raw, `"`) {
-		value, err := strconv.Unquote(raw)
-		return value, err == nil
-	}
-	if strings.HasPrefix(raw, "'") && strings.HasSuffix(raw, "'") && len(raw) >= 2 {
-		inner := raw[1 : len(raw)-1]
-		inner = strings.NewReplacer(`\\`, `\`, `\'`, `'`, `\n`, "\n", `\t`, "\t").Replace(inner)
-		return inner, true
-	}
-	var value interface{}
-	if err := json.Unmarshal([]byte(raw), &value); err == nil {
-		return value, true
-	}
-	if strings.ContainsAny(raw, ",()") {
-		return nil, false
+func cleanContentForStatefulSummaryServer(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return ""
 	}
-	return raw, true
+	cleaned := regexp.MustCompile(`(?i)<\|channel(?:\||>)?\s*thought[\s\S]*?(?:<channel\|>|<\/channel\|>|<\|channel(?:\||>)?\s*(?:message|final|instruction|response)|$)`).ReplaceAllString(text, "")
+	cleaned = regexp.MustCompile(`<think>[\s\S]*?</think>`).ReplaceAllString(cleaned, "")
+	return strings.TrimSpace(
+		regexp.MustCompile(`\s+`).ReplaceAllString(
+			cleaned,
+			" ",
+		),
+	)
 }
 
-func normalizeModelChannelMarkup(raw string) string {
-	replacer := strings.NewReplacer(
-		"<|channel>", "<|channel|>",
-		"<channel|>", "<|channel|>",
-	)
-	return replacer.Replace(raw)
+type recentContextTurn struct {
+	User      string
+	Assistant string
 }
 
-func sanitizeLeakedModelChannelContent(raw string) (string, bool) {
-	normalized := normalizeModelChannelMarkup(raw)
-	if !strings.Contains(normalized, "<|channel|>") {
-		return raw, false
+func cleanRecentContextText(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return ""
 	}
-
-	cleaned := normalized
-	thoughtBlock := regexp.MustCompile(`(?is)<\|channel\|>\s*thought\b[\s\S]*?(?=(<\|channel\|>\s*(?:final|assistant|response)\b)|$)`)
-	cleaned = thoughtBlock.ReplaceAllString(cleaned, "")
-
-	channelMarkers := regexp.MustCompile(`(?is)<\|channel\|>\s*(?:thought|final|assistant|response)\b`)
-	cleaned = channelMarkers.ReplaceAllString(cleaned, "")
-	cleaned = strings.ReplaceAll(cleaned, "<|message|>", "")
-	cleaned = strings.ReplaceAll(cleaned, "<|end|>", "")
-	cleaned = strings.TrimSpace(cleaned)
-
-	return cleaned, cleaned != strings.TrimSpace(raw)
+	cleaned := regexp.MustCompile(`(?i)<\|channel(?:\||>)?\s*thought[\s\S]*?(?:<channel\|>|<\/channel\|>|<\|channel(?:\||>)?\s*(?:message|final|instruction|response)|$)`).ReplaceAllString(text, "")
+	cleaned = regexp.MustCompile(`<think>[\s\S]*?</think>`).ReplaceAllString(cleaned, "")
+	cleaned = strings.ReplaceAll(cleaned, "\r\n", "\n")
+	cleaned = strings.ReplaceAll(cleaned, "\r", "\n")
+	lines := strings.Split(cleaned, "\n")
+	normalized := make([]string, 0, len(lines))
+	blankCount := 0
+	for _, line := range lines {
+		trimmed := strings.TrimRight(line, " \t")
+		if strings.TrimSpace(trimmed) == "" {
+			blankCount++
+			if blankCount > 1 {
+				continue
+			}
+			normalized = append(normalized, "")
+			continue
+		}
+		blankCount = 0
+		normalized = append(normalized, trimmed)
+	}
+	return strings.TrimSpace(strings.Join(normalized, "\n"))
 }
 
-func looksLikeChannelToolMarkup(raw string) bool {
-	normalized := normalizeModelChannelMarkup(strings.ToLower(strings.TrimSpace(raw)))
-	if !strings.Contains(normalized, "<|channel|>") {
+func isRecentContextSignalLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
 		return false
 	}
-	if strings.Contains(normalized, "<|tool_code|>") || strings.Contains(normalized, "to=") {
+	lower := strings.ToLower(trimmed)
+	if strings.HasPrefix(trimmed, "```") ||
+		strings.HasPrefix(trimmed, "$ ") ||
+		strings.HasPrefix(trimmed, "> ") ||
+		strings.HasPrefix(trimmed, "# ") ||
+		strings.HasPrefix(trimmed, "at ") {
 		return true
 	}
-	return strings.Contains(normalized, "{") && strings.Contains(normalized, "}")
-}
-
-func buildAssistantContentHash(input string) string {
-	sum := sha256.Sum256([]byte(input))
-	return hex.EncodeToString(sum[:8])
-}
-
-func currentChatCancelKey(userID string) string {
-	return strings.TrimSpace(userID) + ":default"
+	if strings.Contains(lower, "error") ||
+		strings.Contains(lower, "exception") ||
+		strings.Contains(lower, "traceback") ||
+		strings.Contains(lower, "panic") ||
+		strings.Contains(lower, "failed") ||
+		strings.Contains(lower, "warning") {
+		return true
+	}
+	if regexp.MustCompile(`(?:^|[\s(])(?:npm|pnpm|yarn|bun|go|python|node|git|curl|sql)\b`).MatchString(trimmed) {
+		return true
+	}
+	if regexp.MustCompile(`(?:/|\.go\b|\.ts\b|\.js\b|\.json\b|\.md\b|\.yaml\b|\.yml\b|:\d+)`).MatchString(trimmed) {
+		return true
+	}
+	return false
 }
 
-func registerCurrentChatCancel(userID string, cancel context.CancelFunc) {
-	if cancel == nil || strings.TrimSpace(userID) == "" {
-		return
+func compactRecentTurnContent(text string, limit int) string {
+	cleaned := cleanRecentContextText(text)
+	if cleaned == "" || limit <= 0 {
+		return ""
+	}
+	if len([]rune(cleaned)) <= limit {
+		return cleaned
 	}
-	currentChatCancels.Store(currentChatCancelKey(userID), cancel)
-}
 
-func unregisterCurrentChatCancel(userID string) {
-	if strings.TrimSpace(userID) == "" {
-		return
+	lines := strings.Split(cleaned, "\n")
+	signalLines := make([]string, 0, 4)
+	seen := map[string]struct{}{}
+	for _, line := range lines {
+		if !isRecentContextSignalLine(line) {
+			continue
+		}
+		trimmed := compactText(strings.TrimSpace(line), 180)
+		if trimmed == "" {
+			continue
+		}
+		if _, ok := seen[trimmed]; ok {
+			continue
+		}
+		seen[trimmed] = struct{}{}
+		signalLines = append(signalLines, trimmed)
+		if len(signalLines) >= 4 {
+			break
+		}
 	}
-	currentChatCancels.Delete(currentChatCancelKey(userID))
-}
 
-func cancelCurrentChat(userID string) bool {
-	if strings.TrimSpace(userID) == "" {
-		return false
+	headBudget := max(120, limit/3)
+	tailBudget := max(80, limit/5)
+	head := firstRunes(cleaned, headBudget)
+	tail := lastRunes(cleaned, tailBudget)
+
+	parts := []string{}
+	if head != "" {
+		parts = append(parts, head)
 	}
-	value, ok := currentChatCancels.Load(currentChatCancelKey(userID))
-	if !ok {
-		return false
+	if len(signalLines) > 0 {
+		parts = append(parts, "Key lines:\n"+strings.Join(signalLines, "\n"))
 	}
-	cancel, ok := value.(context.CancelFunc)
-	if !ok || cancel == nil {
-		return false
+	if tail != "" && tail != head {
+		parts = append(parts, tail)
 	}
-	cancel()
-	return true
-}
 
-type savedTurnTitleOptions struct {
-	ModelID        string
-	SecondaryModel string
-	APIToken       string
-	Temperature    float64
-	LLMMode        string
-}
+	compacted := strings.Join(parts, "\n...\n")
+	if len([]rune(compacted)) <= limit {
+		return compacted + "\n... (middle omitted)"
+	}
 
-func defaultContextStrategyForMode(mode string) string {
-	if strings.EqualFold(strings.TrimSpace(mode), "stateful") {
-		return "retrieval"
+	reducedHead := firstRunes(cleaned, max(90, limit/4))
+	reducedTail := lastRunes(cleaned, max(60, limit/7))
+	reducedSignals := signalLines
+	if len(reducedSignals) > 2 {
+		reducedSignals = reducedSignals[:2]
 	}
-	return "history"
+	parts = []string{reducedHead}
+	if len(reducedSignals) > 0 {
+		parts = append(parts, "Key lines:\n"+strings.Join(reducedSignals, "\n"))
+	}
+	if reducedTail != "" && reducedTail != reducedHead {
+		parts = append(parts, reducedTail)
+	}
+	return compactText(strings.Join(parts, "\n...\n"), limit)
 }
 
-func normalizeContextStrategyForMode(mode, raw string) string {
-	mode = strings.TrimSpace(strings.ToLower(mode))
-	strategy := strings.TrimSpace(strings.ToLower(raw))
-	if mode == "stateful" {
-		switch strategy {
-		case "retrieval", "stateful", "none":
-			return strategy
-		default:
-			return "stateful"
+func formatRecentContextTurns(turns []recentContextTurn, maxTurns int, totalBudget int) (string, int) {
+	if maxTurns <= 0 {
+		maxTurns = recentContextDefaultTurns
+	}
+	filtered := make([]recentContextTurn, 0, len(turns))
+	for _, turn := range turns {
+		userText := strings.TrimSpace(turn.User)
+		assistantText := strings.TrimSpace(turn.Assistant)
+		if userText == "" && assistantText == "" {
+			continue
 		}
+		filtered = append(filtered, recentContextTurn{
+			User:      userText,
+			Assistant: assistantText,
+		})
 	}
-	switch strategy {
-	case "retrieval", "history", "none":
-		return strategy
-	default:
-		return "history"
+	if len(filtered) == 0 {
+		return "", 0
+	}
+	if len(filtered) > maxTurns {
+		filtered = filtered[len(filtered)-maxTurns:]
 	}
-}
 
-type chatSessionToolHistorySnapshot struct {
-	Tool   string `json:"tool"`
-	Detail string `json:"detail"`
-}
+	entries := make([]string, 0, len(filtered))
+	for i, turn := range filtered {
+		label := fmt.Sprintf("Turn -%d", len(filtered)-i)
+		isLatest := i == len(filtered)-1
+		chunk := make([]string, 0, 2)
+		if turn.User != "" {
+			if isLatest {
+				chunk = append(chunk, fmt.Sprintf("User: %s", compactRecentTurnContent(turn.User, recentContextLatestUserBudget)))
+			} else {
+				chunk = append(chunk, fmt.Sprintf("User: %s", compactText(cleanContentForStatefulSummaryServer(turn.User), recentContextOlderUserBudget)))
+			}
+		}
+		if turn.Assistant != "" {
+			if isLatest {
+				chunk = append(chunk, fmt.Sprintf("Assistant: %s", compactRecentTurnContent(turn.Assistant, recentContextLatestAssistBudget)))
+			} else {
+				chunk = append(chunk, fmt.Sprintf("Assistant: %s", compactText(cleanContentForStatefulSummaryServer(turn.Assistant), recentContextOlderAssistBudget)))
+			}
+		}
+		if len(chunk) == 0 {
+			continue
+		}
+		entries = append(entries, label+"\n"+strings.Join(chunk, "\n"))
+	}
 
-type chatSessionToolCardSnapshot struct {
-	State    string                           `json:"state"`
-	Summary  string                           `json:"summary"`
-	Args     interface{}                      `json:"args,omitempty"`
-	ToolName string                           `json:"tool_name"`
-	History  []chatSessionToolHistorySnapshot `json:"history,omitempty"`
+	rendered := strings.TrimSpace(strings.Join(entries, "\n\n"))
+	if totalBudget > 0 && len([]rune(rendered)) > totalBudget {
+		return compactRecentTurnContent(rendered, totalBudget), len(filtered)
+	}
+	return rendered, len(filtered)
 }
 
-type chatSessionMessageSnapshot struct {
-	TurnID                  string `json:"turn_id"`
-	UserContent             string `json:"user_content,omitempty"`
-	AssistantContent        string `json:"assistant_content,omitempty"`
-	ReasoningContent        string `json:"reasoning_content,omitempty"`
-	ReasoningDurationMS     int64  `json:"reasoning_duration_ms,omitempty"`
-	ReasoningAccumulatedMS  int64  `json:"reasoning_accumulated_ms,omitempty"`
-	ReasoningCurrentPhaseMS int64  `json:"reasoning_current_phase_ms,omitempty"`
-}
+func summarizeChatSessionForReset(existingSummary string, snapshot chatSessionUISnapshot) string {
+	lines := make([]string, 0, 16)
+	if strings.TrimSpace(existingSummary) != "" {
+		lines = append(lines, "Previous summary:")
+		lines = append(lines, strings.TrimSpace(existingSummary))
+		lines = append(lines, "")
+		lines = append(lines, "Recent turns:")
+	}
 
-type chatSessionReasoningSnapshot struct {
-	State          string `json:"state,omitempty"`
-	Content        string `json:"content,omitempty"`
-	DurationMS     int64  `json:"duration_ms,omitempty"`
-	AccumulatedMS  int64  `json:"accumulated_ms,omitempty"`
-	CurrentPhaseMS int64  `json:"current_phase_ms,omitempty"`
-}
+	start := 0
+	if len(snapshot.Messages) > 12 {
+		start = len(snapshot.Messages) - 12
+	}
+	index := 1
+	for _, msg := range snapshot.Messages[start:] {
+		userText := cleanContentForStatefulSummaryServer(msg.UserContent)
+		if userText != "" {
+			lines = append(lines, fmt.Sprintf("%d. User: %s", index, compactText(userText, 320)))
+			index++
+		}
+		assistantText := cleanContentForStatefulSummaryServer(msg.AssistantContent)
+		if assistantText != "" {
+			lines = append(lines, fmt.Sprintf("%d. Assistant: %s", index, compactText(assistantText, 320)))
+			index++
+		}
+	}
 
-type chatSessionTurnSnapshot struct {
-	TurnID           string                       `json:"turn_id"`
-	Status           string                       `json:"status,omitempty"`
-	UserContent      string                       `json:"user_content,omitempty"`
-	AssistantContent string                       `json:"assistant_content,omitempty"`
-	Reasoning        chatSessionReasoningSnapshot `json:"reasoning,omitempty"`
-	Tool             *chatSessionToolCardSnapshot `json:"tool,omitempty"`
+	summary := strings.TrimSpace(strings.Join(lines, "\n"))
+	if len(summary) > 1800 {
+		summary = summary[len(summary)-1800:]
+	}
+	return strings.TrimSpace(summary)
 }
 
-type chatSessionUISnapshot struct {
-	ToolCards    map[string]chatSessionToolCardSnapshot `json:"tool_cards"`
-	Messages     []chatSessionMessageSnapshot           `json:"messages,omitempty"`
-	Turns        []chatSessionTurnSnapshot              `json:"turns,omitempty"`
-	LastEventSeq int                                    `json:"last_event_seq,omitempty"`
+func buildRecentContextFromSnapshot(snapshot chatSessionUISnapshot, maxTurns int) (string, int) {
+	turns := make([]recentContextTurn, 0, len(snapshot.Messages))
+	for _, msg := range snapshot.Messages {
+		userText := cleanRecentContextText(msg.UserContent)
+		assistantText := cleanRecentContextText(msg.AssistantContent)
+		if userText == "" && assistantText == "" {
+			continue
+		}
+		turns = append(turns, recentContextTurn{
+			User:      userText,
+			Assistant: assistantText,
+		})
+	}
+	return formatRecentContextTurns(turns, maxTurns, 2200)
 }
 
-func cleanSavedTurnTitleContext(input string, limit int) string {
-	input = strings.ReplaceAll(input, "\r\n", "\n")
-	input = strings.ReplaceAll(input, "\r", "\n")
-	input = regexp.MustCompile("```[\\s\\S]*?```").ReplaceAllString(input, " ")
-	input = regexp.MustCompile(`(?i)<\|channel(?:\||>)?\s*thought[\s\S]*?(?:<channel\|>|<\/channel\|>|<\|channel(?:\||>)?\s*(?:message|final|instruction|response)|$)`).ReplaceAllString(input, " ")
-	input = regexp.MustCompile("<think>[\\s\\S]*?</think>").ReplaceAllString(input, " ")
-	input = regexp.MustCompile(`!\[([^\]]*)\]\([^)]+\)`).ReplaceAllString(input, "$1")
-	input = regexp.MustCompile(`\[([^\]]+)\]\([^)]+\)`).ReplaceAllString(input, "$1")
-	input = regexp.MustCompile(`(?m)^\s*#{1,6}\s*`).ReplaceAllString(input, "")
-	input = regexp.MustCompile(`(?m)^\s*[-*+]\s+`).ReplaceAllString(input, "")
-	input = regexp.MustCompile(`(?m)^\s*\d+[.)]\s+`).ReplaceAllString(input, "")
-	input = regexp.MustCompile(`(?m)^\s*>+\s*`).ReplaceAllString(input, "")
-	input = strings.NewReplacer(
-		"|", " ",
-		"`", "",
-		"**", "",
-		"__", "",
-		"~~", "",
-		"---", " ",
-		"***", " ",
-	).Replace(input)
-	input = regexp.MustCompile(`\s+`).ReplaceAllString(strings.TrimSpace(input), " ")
-	return compactText(input, limit)
-}
-
-func parseChatSessionUISnapshot(raw string) chatSessionUISnapshot {
-	snapshot := chatSessionUISnapshot{
-		ToolCards: map[string]chatSessionToolCardSnapshot{},
-		Messages:  []chatSessionMessageSnapshot{},
-		Turns:     []chatSessionTurnSnapshot{},
-	}
-	raw = strings.TrimSpace(raw)
-	if raw == "" || raw == "{}" {
-		return snapshot
-	}
-	if err := json.Unmarshal([]byte(raw), &snapshot); err != nil {
-		return chatSessionUISnapshot{ToolCards: map[string]chatSessionToolCardSnapshot{}, Messages: []chatSessionMessageSnapshot{}, Turns: []chatSessionTurnSnapshot{}}
-	}
-	if snapshot.ToolCards == nil {
-		snapshot.ToolCards = map[string]chatSessionToolCardSnapshot{}
-	}
-	if snapshot.Messages == nil {
-		snapshot.Messages = []chatSessionMessageSnapshot{}
-	}
-	if snapshot.Turns == nil {
-		snapshot.Turns = []chatSessionTurnSnapshot{}
-	}
-	hydrateLegacyChatSessionViews(&snapshot)
-	return snapshot
-}
-
-func encodeChatSessionUISnapshot(snapshot chatSessionUISnapshot) string {
-	if snapshot.ToolCards == nil {
-		snapshot.ToolCards = map[string]chatSessionToolCardSnapshot{}
-	}
-	if snapshot.Messages == nil {
-		snapshot.Messages = []chatSessionMessageSnapshot{}
-	}
-	if snapshot.Turns == nil {
-		snapshot.Turns = []chatSessionTurnSnapshot{}
-	}
-	hydrateLegacyChatSessionViews(&snapshot)
-	bytes, err := json.Marshal(snapshot)
-	if err != nil {
-		return "{}"
-	}
-	return string(bytes)
-}
-
-func hydrateLegacyChatSessionViews(snapshot *chatSessionUISnapshot) {
-	if snapshot == nil {
-		return
-	}
-	if snapshot.ToolCards == nil {
-		snapshot.ToolCards = map[string]chatSessionToolCardSnapshot{}
-	}
-	if snapshot.Messages == nil {
-		snapshot.Messages = []chatSessionMessageSnapshot{}
-	}
-	if snapshot.Turns == nil {
-		snapshot.Turns = []chatSessionTurnSnapshot{}
-	}
-	if len(snapshot.Turns) == 0 && (len(snapshot.Messages) > 0 || len(snapshot.ToolCards) > 0) {
-		for _, msg := range snapshot.Messages {
-			turn := chatSessionTurnSnapshot{
-				TurnID:           msg.TurnID,
-				UserContent:      msg.UserContent,
-				AssistantContent: msg.AssistantContent,
-				Reasoning: chatSessionReasoningSnapshot{
-					Content:        msg.ReasoningContent,
-					DurationMS:     msg.ReasoningDurationMS,
-					AccumulatedMS:  msg.ReasoningAccumulatedMS,
-					CurrentPhaseMS: msg.ReasoningCurrentPhaseMS,
-				},
-			}
-			if tool, ok := snapshot.ToolCards[msg.TurnID]; ok {
-				toolCopy := tool
-				turn.Tool = &toolCopy
-			}
-			if strings.TrimSpace(turn.AssistantContent) != "" || strings.TrimSpace(turn.Reasoning.Content) != "" || turn.Tool != nil {
-				turn.Status = "completed"
-			}
-			snapshot.Turns = append(snapshot.Turns, turn)
-		}
-	}
-	if len(snapshot.Messages) == 0 && len(snapshot.Turns) > 0 {
-		for _, turn := range snapshot.Turns {
-			snapshot.Messages = append(snapshot.Messages, chatSessionMessageSnapshot{
-				TurnID:                  turn.TurnID,
-				UserContent:             turn.UserContent,
-				AssistantContent:        turn.AssistantContent,
-				ReasoningContent:        turn.Reasoning.Content,
-				ReasoningDurationMS:     turn.Reasoning.DurationMS,
-				ReasoningAccumulatedMS:  turn.Reasoning.AccumulatedMS,
-				ReasoningCurrentPhaseMS: turn.Reasoning.CurrentPhaseMS,
-			})
-			if turn.Tool != nil {
-				snapshot.ToolCards[turn.TurnID] = *turn.Tool
-			}
-		}
-	}
-}
-
-func deriveLastSessionFromChatSession(entry mcp.ChatSessionEntry) (map[string]interface{}, bool) {
-	snapshot := parseChatSessionUISnapshot(entry.UIStateJSON)
-	if len(snapshot.Messages) == 0 {
-		return nil, false
-	}
-
-	for i := len(snapshot.Messages) - 1; i >= 0; i-- {
-		item := snapshot.Messages[i]
-		userText := strings.TrimSpace(item.UserContent)
-		assistantText := strings.TrimSpace(item.AssistantContent)
-		if userText == "" || assistantText == "" {
-			continue
-		}
-		return map[string]interface{}{
-			"has_session":       true,
-			"user_message":      userText,
-			"assistant_message": assistantText,
-			"mode":              strings.TrimSpace(entry.LLMMode),
-			"updated_at":        entry.UpdatedAt,
-		}, true
-	}
-
-	return nil, false
-}
-
-func summarizeLastSessionSnapshot(snapshot chatSessionUISnapshot) string {
-	if len(snapshot.Messages) == 0 {
-		return "messages=0"
-	}
-	parts := make([]string, 0, min(3, len(snapshot.Messages)))
-	for i := len(snapshot.Messages) - 1; i >= 0 && len(parts) < 3; i-- {
-		item := snapshot.Messages[i]
-		parts = append(parts, fmt.Sprintf("turn=%s user=%d assistant=%d reasoning=%d",
-			strings.TrimSpace(item.TurnID),
-			len([]rune(strings.TrimSpace(item.UserContent))),
-			len([]rune(strings.TrimSpace(item.AssistantContent))),
-			len([]rune(strings.TrimSpace(item.ReasoningContent))),
-		))
+func buildRecentContextFromEvents(userID string, entry mcp.ChatSessionEntry, maxTurns int) (string, int) {
+	if entry.ID <= 0 {
+		return "", 0
 	}
-	return fmt.Sprintf("messages=%d last=[%s]", len(snapshot.Messages), strings.Join(parts, "; "))
-}
-
-func deriveLastSessionFromChatEvents(userID string, entry mcp.ChatSessionEntry) (map[string]interface{}, bool) {
-	events, err := mcp.ListChatEvents(userID, entry.ID, 0, 2000)
+	events, err := mcp.ListChatEvents(userID, entry.ID, 0, 400)
 	if err != nil || len(events) == 0 {
-		return nil, false
+		return "", 0
 	}
 
 	type turnSnapshot struct {
 		user      string
 		assistant string
 	}
-
 	byTurn := make(map[string]*turnSnapshot)
 	order := make([]string, 0, len(events))
-
 	ensureTurn := func(turnID string) *turnSnapshot {
 		key := strings.TrimSpace(turnID)
 		if key == "" {
@@ -1328,7 +822,6 @@ func deriveLastSessionFromChatEvents(userID string, entry mcp.ChatSessionEntry)
 		if err := json.Unmarshal([]byte(strings.TrimSpace(event.PayloadJSON)), &payload); err != nil {
 			payload = map[string]interface{}{}
 		}
-
 		turnID := strings.TrimSpace(event.TurnID)
 		if turnID == "" {
 			if raw, ok := payload["turn_id"].(string); ok {
@@ -1339,7 +832,6 @@ func deriveLastSessionFromChatEvents(userID string, entry mcp.ChatSessionEntry)
 		if turn == nil {
 			continue
 		}
-
 		switch event.EventType {
 		case "message.created":
 			if event.Role == "user" {
@@ -1351,2315 +843,1865 @@ func deriveLastSessionFromChatEvents(userID string, entry mcp.ChatSessionEntry)
 			if fullContent, ok := payload["full_content"].(string); ok && strings.TrimSpace(fullContent) != "" {
 				turn.assistant = strings.TrimSpace(fullContent)
 			} else if content, ok := payload["content"].(string); ok && strings.TrimSpace(content) != "" {
-				turn.assistant += content
-				turn.assistant = strings.TrimSpace(turn.assistant)
+				turn.assistant = strings.TrimSpace(turn.assistant + content)
 			}
 		case "chat.end", "request.complete":
-			if content := extractFinalAssistantContent(payload); strings.TrimSpace(content) != "" {
+			if content := chatharness.ExtractFinalAssistantContent(payload); strings.TrimSpace(content) != "" {
 				turn.assistant = strings.TrimSpace(content)
 			}
 		}
 	}
 
-	for i := len(order) - 1; i >= 0; i-- {
-		turn := byTurn[order[i]]
+	turns := make([]recentContextTurn, 0, len(order))
+	for _, turnID := range order {
+		turn := byTurn[turnID]
 		if turn == nil {
 			continue
 		}
-		if strings.TrimSpace(turn.user) == "" || strings.TrimSpace(turn.assistant) == "" {
+		userText := cleanRecentContextText(turn.user)
+		assistantText := cleanRecentContextText(turn.assistant)
+		if userText == "" && assistantText == "" {
 			continue
 		}
-		return map[string]interface{}{
-			"has_session":       true,
-			"user_message":      strings.TrimSpace(turn.user),
-			"assistant_message": strings.TrimSpace(turn.assistant),
-			"mode":              strings.TrimSpace(entry.LLMMode),
-			"updated_at":        entry.UpdatedAt,
-		}, true
+		turns = append(turns, recentContextTurn{
+			User:      userText,
+			Assistant: assistantText,
+		})
 	}
-
-	return nil, false
+	return formatRecentContextTurns(turns, maxTurns, 2200)
 }
 
-func estimateStatefulTokens(text string) int {
-	trimmed := strings.TrimSpace(text)
-	if trimmed == "" {
-		return 0
+func getRecentConversationContext(userID string) (string, int, string) {
+	entry, err := mcp.GetCurrentChatSession(userID)
+	if err != nil {
+		return "", 0, ""
 	}
-	runeCount := len([]rune(trimmed))
-	return (runeCount + 3) / 4
-}
-
-func cleanContentForStatefulSummaryServer(text string) string {
-	if strings.TrimSpace(text) == "" {
-		return ""
+	snapshot := parseChatSessionUISnapshot(entry.UIStateJSON)
+	if text, turns := buildRecentContextFromSnapshot(snapshot, 4); strings.TrimSpace(text) != "" {
+		return text, turns, "ui_snapshot"
 	}
-	cleaned := regexp.MustCompile(`(?i)<\|channel(?:\||>)?\s*thought[\s\S]*?(?:<channel\|>|<\/channel\|>|<\|channel(?:\||>)?\s*(?:message|final|instruction|response)|$)`).ReplaceAllString(text, "")
-	cleaned = regexp.MustCompile(`<think>[\s\S]*?</think>`).ReplaceAllString(cleaned, "")
-	return strings.TrimSpace(
-		regexp.MustCompile(`\s+`).ReplaceAllString(
-			cleaned,
-			" ",
-		),
-	)
+	if text, turns := buildRecentContextFromEvents(userID, entry, 4); strings.TrimSpace(text) != "" {
+		return text, turns, "chat_events"
+	}
+	return "", 0, ""
 }
 
-type recentContextTurn struct {
-	User      string
-	Assistant string
+func computeServerStatefulRisk(turnCount, estimatedChars, lastInputTokens int, nextUserText string, turnLimit, charBudget, tokenBudget int) (float64, string) {
+	if turnLimit <= 0 {
+		turnLimit = 8
+	}
+	if charBudget <= 0 {
+		charBudget = 32000
+	}
+	if tokenBudget <= 0 {
+		tokenBudget = 30000
+	}
+	projectedChars := estimatedChars + len([]rune(strings.TrimSpace(nextUserText)))
+	projectedTokens := lastInputTokens + orchestrator.EstimateTokens(nextUserText)
+	turnFactor := math.Min(1, float64(turnCount)/math.Max(float64(turnLimit), 1))
+	charFactor := math.Min(1, float64(projectedChars)/math.Max(float64(charBudget), 1))
+	tokenFactor := math.Min(1, float64(projectedTokens)/math.Max(float64(tokenBudget), 1))
+	score := math.Round((turnFactor*20+charFactor*15+tokenFactor*65)*100) / 100
+	level := "low"
+	if score >= 0.9 {
+		level = "critical"
+	} else if score >= 0.7 {
+		level = "high"
+	} else if score >= 0.45 {
+		level = "medium"
+	}
+	return score, level
 }
 
-func cleanRecentContextText(text string) string {
-	if strings.TrimSpace(text) == "" {
-		return ""
+func extractChatInputText(reqMap map[string]interface{}) string {
+	if reqMap == nil {
+		return ""
 	}
-	cleaned := regexp.MustCompile(`(?i)<\|channel(?:\||>)?\s*thought[\s\S]*?(?:<channel\|>|<\/channel\|>|<\|channel(?:\||>)?\s*(?:message|final|instruction|response)|$)`).ReplaceAllString(text, "")
-	cleaned = regexp.MustCompile(`<think>[\s\S]*?</think>`).ReplaceAllString(cleaned, "")
-	cleaned = strings.ReplaceAll(cleaned, "\r\n", "\n")
-	cleaned = strings.ReplaceAll(cleaned, "\r", "\n")
-	lines := strings.Split(cleaned, "\n")
-	normalized := make([]string, 0, len(lines))
-	blankCount := 0
-	for _, line := range lines {
-		trimmed := strings.TrimRight(line, " \t")
-		if strings.TrimSpace(trimmed) == "" {
-			blankCount++
-			if blankCount > 1 {
+	if input, ok := reqMap["input"].(string); ok {
+		return strings.TrimSpace(input)
+	}
+	if items, ok := reqMap["input"].([]interface{}); ok {
+		var parts []string
+		for _, item := range items {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
 				continue
 			}
-			normalized = append(normalized, "")
-			continue
+			itemType, _ := obj["type"].(string)
+			switch itemType {
+			case "text":
+				if content, ok := obj["content"].(string); ok && strings.TrimSpace(content) != "" {
+					parts = append(parts, strings.TrimSpace(content))
+				}
+			case "input_text":
+				if text, ok := obj["text"].(string); ok && strings.TrimSpace(text) != "" {
+					parts = append(parts, strings.TrimSpace(text))
+				}
+			}
 		}
-		blankCount = 0
-		normalized = append(normalized, trimmed)
-	}
-	return strings.TrimSpace(strings.Join(normalized, "\n"))
-}
-
-func isRecentContextSignalLine(line string) bool {
-	trimmed := strings.TrimSpace(line)
-	if trimmed == "" {
-		return false
-	}
-	lower := strings.ToLower(trimmed)
-	if strings.HasPrefix(trimmed, "```") ||
-		strings.HasPrefix(trimmed, "$ ") ||
-		strings.HasPrefix(trimmed, "> ") ||
-		strings.HasPrefix(trimmed, "# ") ||
-		strings.HasPrefix(trimmed, "at ") {
-		return true
-	}
-	if strings.Contains(lower, "error") ||
-		strings.Contains(lower, "exception") ||
-		strings.Contains(lower, "traceback") ||
-		strings.Contains(lower, "panic") ||
-		strings.Contains(lower, "failed") ||
-		strings.Contains(lower, "warning") {
-		return true
-	}
-	if regexp.MustCompile(`(?:^|[\s(])(?:npm|pnpm|yarn|bun|go|python|node|git|curl|sql)\b`).MatchString(trimmed) {
-		return true
+		return strings.TrimSpace(strings.Join(parts, "\n"))
 	}
-	if regexp.MustCompile(`(?:/|\.go\b|\.ts\b|\.js\b|\.json\b|\.md\b|\.yaml\b|\.yml\b|:\d+)`).MatchString(trimmed) {
-		return true
+	if messages, ok := reqMap["messages"].([]interface{}); ok {
+		for i := len(messages) - 1; i >= 0; i-- {
+			msg, ok := messages[i].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			role, _ := msg["role"].(string)
+			if role != "user" {
+				continue
+			}
+			if content, ok := msg["content"].(string); ok {
+				return strings.TrimSpace(content)
+			}
+		}
 	}
-	return false
+	return ""
 }
 
-func compactRecentTurnContent(text string, limit int) string {
-	cleaned := cleanRecentContextText(text)
-	if cleaned == "" || limit <= 0 {
-		return ""
-	}
-	if len([]rune(cleaned)) <= limit {
-		return cleaned
+func compactToolSnapshotDetail(toolName string, args interface{}, summary string) string {
+	if s, ok := args.(string); ok && strings.TrimSpace(s) != "" {
+		return compactText(strings.TrimSpace(s), 220)
 	}
+	if argsMap, ok := args.(map[string]interface{}); ok {
+		normalizedTool := strings.ToLower(strings.TrimSpace(toolName))
+		if normalizedTool == "" {
+			normalizedTool = strings.ToLower(strings.TrimSpace(extractStringValue(argsMap, []string{"tool", "tool_name"})))
+		}
+		queryLike := extractStringValue(argsMap, []string{"query", "keyword", "title", "input", "prompt", "text"})
+		url := extractStringValue(argsMap, []string{"url"})
+		sourceID := extractStringValue(argsMap, []string{"source_id"})
+		command := extractStringValue(argsMap, []string{"command"})
+		memoryID := extractStringValue(argsMap, []string{"memory_id"})
 
-	lines := strings.Split(cleaned, "\n")
-	signalLines := make([]string, 0, 4)
-	seen := map[string]struct{}{}
-	for _, line := range lines {
-		if !isRecentContextSignalLine(line) {
-			continue
+		switch normalizedTool {
+		case "search_web", "search_web_multi", "namu_wiki", "naver_search":
+			if normalizedTool == "search_web_multi" {
+				if queries, ok := argsMap["queries"].([]interface{}); ok && len(queries) > 0 {
+					parts := make([]string, 0, len(queries))
+					for _, query := range queries {
+						if text, ok := query.(string); ok && strings.TrimSpace(text) != "" {
+							parts = append(parts, strings.TrimSpace(text))
+						}
+					}
+					if len(parts) > 0 {
+						return compactText("병렬 검색어: "+strings.Join(parts, " | "), 220)
+					}
+				}
+			}
+			if queryLike != "" {
+				return compactText("검색어: "+queryLike, 220)
+			}
+		case "read_web_page":
+			if url != "" {
+				return compactText("페이지 읽기: "+url, 220)
+			}
+		case "read_buffered_source":
+			if queryLike != "" {
+				return compactText("버퍼 문서 읽기: "+queryLike, 220)
+			}
+			if sourceID != "" {
+				return compactText("버퍼 문서 읽기: "+sourceID, 220)
+			}
+		case "read_help":
+			if queryLike != "" {
+				return compactText("도움말 읽기: "+queryLike, 220)
+			}
+			return "도움말 읽기"
+		case "search_memory":
+			if queryLike != "" {
+				return compactText("메모리 검색: "+queryLike, 220)
+			}
+		case "read_memory":
+			if memoryID != "" {
+				return compactText("메모리 읽기: "+memoryID, 220)
+			}
+		case "delete_memory":
+			if memoryID != "" {
+				return compactText("메모리 삭제: "+memoryID, 220)
+			}
+		case "execute_command":
+			if command != "" {
+				return compactText("명령어 실행: "+command, 220)
+			}
+		case "get_current_location":
+			return "사용자 위치를 확인했습니다."
+		case "get_current_time":
+			return "현재 시간을 확인했습니다."
 		}
-		trimmed := compactText(strings.TrimSpace(line), 180)
-		if trimmed == "" {
-			continue
+
+		for _, key := range []string{"query", "url", "text", "prompt", "input", "title"} {
+			if value := extractStringValue(argsMap, []string{key}); value != "" {
+				return compactText(value, 220)
+			}
 		}
-		if _, ok := seen[trimmed]; ok {
-			continue
+		if bytes, err := json.Marshal(argsMap); err == nil {
+			return compactText(strings.TrimSpace(string(bytes)), 220)
 		}
-		seen[trimmed] = struct{}{}
-		signalLines = append(signalLines, trimmed)
-		if len(signalLines) >= 4 {
-			break
+	}
+	if args != nil {
+		if bytes, err := json.Marshal(args); err == nil {
+			return compactText(strings.TrimSpace(string(bytes)), 220)
 		}
 	}
+	return compactText(strings.TrimSpace(summary), 220)
+}
 
-	headBudget := max(120, limit/3)
-	tailBudget := max(80, limit/5)
-	head := firstRunes(cleaned, headBudget)
-	tail := lastRunes(cleaned, tailBudget)
-
-	parts := []string{}
-	if head != "" {
-		parts = append(parts, head)
+func hasMeaningfulChatSessionToolSnapshot(card chatSessionToolCardSnapshot) bool {
+	if strings.TrimSpace(card.Summary) != "" {
+		return true
 	}
-	if len(signalLines) > 0 {
-		parts = append(parts, "Key lines:\n"+strings.Join(signalLines, "\n"))
+	if name := strings.TrimSpace(card.ToolName); name != "" && !strings.EqualFold(name, "Tool") {
+		return true
 	}
-	if tail != "" && tail != head {
-		parts = append(parts, tail)
+	if card.Args != nil {
+		if bytes, err := json.Marshal(card.Args); err != nil {
+			return true
+		} else {
+			serialized := strings.TrimSpace(string(bytes))
+			if serialized != "" && serialized != "{}" && serialized != "[]" && serialized != "null" {
+				return true
+			}
+		}
 	}
-
-	compacted := strings.Join(parts, "\n...\n")
-	if len([]rune(compacted)) <= limit {
-		return compacted + "\n... (middle omitted)"
+	for _, entry := range card.History {
+		if strings.TrimSpace(entry.Tool) != "" || strings.TrimSpace(entry.Detail) != "" {
+			return true
+		}
 	}
+	return false
+}
 
-	reducedHead := firstRunes(cleaned, max(90, limit/4))
-	reducedTail := lastRunes(cleaned, max(60, limit/7))
-	reducedSignals := signalLines
-	if len(reducedSignals) > 2 {
-		reducedSignals = reducedSignals[:2]
+func extractStringValue(obj map[string]interface{}, keys []string) string {
+	for _, key := range keys {
+		if value, ok := obj[key].(string); ok && strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
 	}
-	parts = []string{reducedHead}
-	if len(reducedSignals) > 0 {
-		parts = append(parts, "Key lines:\n"+strings.Join(reducedSignals, "\n"))
+	return ""
+}
+
+func updateChatSessionToolSnapshot(snapshot *chatSessionUISnapshot, turnID, eventType string, payload interface{}) {
+	if snapshot == nil || strings.TrimSpace(turnID) == "" {
+		return
 	}
-	if reducedTail != "" && reducedTail != reducedHead {
-		parts = append(parts, reducedTail)
+	if snapshot.ToolCards == nil {
+		snapshot.ToolCards = map[string]chatSessionToolCardSnapshot{}
 	}
-	return compactText(strings.Join(parts, "\n...\n"), limit)
-}
 
-func formatRecentContextTurns(turns []recentContextTurn, maxTurns int, totalBudget int) (string, int) {
-	if maxTurns <= 0 {
-		maxTurns = recentContextDefaultTurns
+	card := snapshot.ToolCards[turnID]
+	payloadMap, _ := payload.(map[string]interface{})
+	if payloadMap == nil {
+		payloadMap = map[string]interface{}{}
 	}
-	filtered := make([]recentContextTurn, 0, len(turns))
-	for _, turn := range turns {
-		userText := strings.TrimSpace(turn.User)
-		assistantText := strings.TrimSpace(turn.Assistant)
-		if userText == "" && assistantText == "" {
-			continue
+
+	toolName, _ := payloadMap["tool"].(string)
+	summary, _ := payloadMap["reason"].(string)
+	args := payloadMap["arguments"]
+	if toolObj, ok := payloadMap["tool"].(map[string]interface{}); ok {
+		if v, ok := toolObj["tool_name"].(string); ok && strings.TrimSpace(v) != "" {
+			toolName = strings.TrimSpace(v)
+		}
+		if v, ok := toolObj["summary"].(string); ok {
+			summary = strings.TrimSpace(v)
+		}
+		if v, exists := toolObj["args"]; exists {
+			args = v
 		}
-		filtered = append(filtered, recentContextTurn{
-			User:      userText,
-			Assistant: assistantText,
-		})
-	}
-	if len(filtered) == 0 {
-		return "", 0
-	}
-	if len(filtered) > maxTurns {
-		filtered = filtered[len(filtered)-maxTurns:]
 	}
 
-	entries := make([]string, 0, len(filtered))
-	for i, turn := range filtered {
-		label := fmt.Sprintf("Turn -%d", len(filtered)-i)
-		isLatest := i == len(filtered)-1
-		chunk := make([]string, 0, 2)
-		if turn.User != "" {
-			if isLatest {
-				chunk = append(chunk, fmt.Sprintf("User: %s", compactRecentTurnContent(turn.User, recentContextLatestUserBudget)))
-			} else {
-				chunk = append(chunk, fmt.Sprintf("User: %s", compactText(cleanContentForStatefulSummaryServer(turn.User), recentContextOlderUserBudget)))
+	switch eventType {
+	case "tool_call.start":
+		card.State = "running"
+		card.ToolName = strings.TrimSpace(toolName)
+		card.Summary = ""
+	case "tool_call.arguments":
+		card.State = "running"
+		if strings.TrimSpace(toolName) != "" {
+			card.ToolName = strings.TrimSpace(toolName)
+		}
+		card.Args = args
+		detail := compactToolSnapshotDetail(card.ToolName, args, summary)
+		if detail != "" {
+			entry := chatSessionToolHistorySnapshot{
+				Tool:   strings.TrimSpace(card.ToolName),
+				Detail: detail,
+			}
+			if entry.Tool == "" {
+				entry.Tool = "Tool"
+			}
+			last := chatSessionToolHistorySnapshot{}
+			if len(card.History) > 0 {
+				last = card.History[len(card.History)-1]
+			}
+			if last.Tool != entry.Tool || last.Detail != entry.Detail {
+				card.History = append(card.History, entry)
 			}
 		}
-		if turn.Assistant != "" {
-			if isLatest {
-				chunk = append(chunk, fmt.Sprintf("Assistant: %s", compactRecentTurnContent(turn.Assistant, recentContextLatestAssistBudget)))
-			} else {
-				chunk = append(chunk, fmt.Sprintf("Assistant: %s", compactText(cleanContentForStatefulSummaryServer(turn.Assistant), recentContextOlderAssistBudget)))
+	case "tool_call.success":
+		card.State = "success"
+		if strings.TrimSpace(toolName) != "" {
+			card.ToolName = strings.TrimSpace(toolName)
+		}
+		card.Summary = ""
+	case "tool_call.failure":
+		card.State = "failure"
+		if strings.TrimSpace(toolName) != "" {
+			card.ToolName = strings.TrimSpace(toolName)
+		}
+		card.Summary = strings.TrimSpace(summary)
+	case "chat.end", "request.complete":
+		if toolObj, ok := payloadMap["tool"].(map[string]interface{}); ok {
+			card.State = strings.TrimSpace(extractStringValue(toolObj, []string{"state"}))
+			card.Summary = strings.TrimSpace(extractStringValue(toolObj, []string{"summary"}))
+			if strings.TrimSpace(toolName) != "" {
+				card.ToolName = strings.TrimSpace(toolName)
+			}
+			card.Args = args
+			if historyRaw, ok := toolObj["history"].([]interface{}); ok {
+				history := make([]chatSessionToolHistorySnapshot, 0, len(historyRaw))
+				for _, raw := range historyRaw {
+					item, _ := raw.(map[string]interface{})
+					if item == nil {
+						continue
+					}
+					entry := chatSessionToolHistorySnapshot{
+						Tool:   strings.TrimSpace(extractStringValue(item, []string{"tool"})),
+						Detail: strings.TrimSpace(extractStringValue(item, []string{"detail"})),
+					}
+					if entry.Tool != "" || entry.Detail != "" {
+						history = append(history, entry)
+					}
+				}
+				card.History = history
 			}
+			if card.State == "" {
+				card.State = "success"
+			}
+			if card.ToolName == "" {
+				card.ToolName = "Tool"
+			}
+			break
 		}
-		if len(chunk) == 0 {
-			continue
+		if extracted := extractToolCardSnapshotFromPayload(payloadMap); extracted != nil {
+			card = *extracted
 		}
-		entries = append(entries, label+"\n"+strings.Join(chunk, "\n"))
 	}
-
-	rendered := strings.TrimSpace(strings.Join(entries, "\n\n"))
-	if totalBudget > 0 && len([]rune(rendered)) > totalBudget {
-		return compactRecentTurnContent(rendered, totalBudget), len(filtered)
+	if hasMeaningfulChatSessionToolSnapshot(card) {
+		snapshot.ToolCards[turnID] = card
+	} else {
+		delete(snapshot.ToolCards, turnID)
 	}
-	return rendered, len(filtered)
 }
 
-func summarizeChatSessionForReset(existingSummary string, snapshot chatSessionUISnapshot) string {
-	lines := make([]string, 0, 16)
-	if strings.TrimSpace(existingSummary) != "" {
-		lines = append(lines, "Previous summary:")
-		lines = append(lines, strings.TrimSpace(existingSummary))
-		lines = append(lines, "")
-		lines = append(lines, "Recent turns:")
+func ensureChatSessionMessageSnapshot(snapshot *chatSessionUISnapshot, turnID string) *chatSessionMessageSnapshot {
+	if snapshot == nil || strings.TrimSpace(turnID) == "" {
+		return nil
 	}
-
-	start := 0
-	if len(snapshot.Messages) > 12 {
-		start = len(snapshot.Messages) - 12
+	if snapshot.Messages == nil {
+		snapshot.Messages = []chatSessionMessageSnapshot{}
 	}
-	index := 1
-	for _, msg := range snapshot.Messages[start:] {
-		userText := cleanContentForStatefulSummaryServer(msg.UserContent)
-		if userText != "" {
-			lines = append(lines, fmt.Sprintf("%d. User: %s", index, compactText(userText, 320)))
-			index++
-		}
-		assistantText := cleanContentForStatefulSummaryServer(msg.AssistantContent)
-		if assistantText != "" {
-			lines = append(lines, fmt.Sprintf("%d. Assistant: %s", index, compactText(assistantText, 320)))
-			index++
+	for i := range snapshot.Messages {
+		if snapshot.Messages[i].TurnID == turnID {
+			return &snapshot.Messages[i]
 		}
 	}
-
-	summary := strings.TrimSpace(strings.Join(lines, "\n"))
-	if len(summary) > 1800 {
-		summary = summary[len(summary)-1800:]
-	}
-	return strings.TrimSpace(summary)
+	snapshot.Messages = append(snapshot.Messages, chatSessionMessageSnapshot{TurnID: turnID})
+	return &snapshot.Messages[len(snapshot.Messages)-1]
 }
 
-func buildRecentContextFromSnapshot(snapshot chatSessionUISnapshot, maxTurns int) (string, int) {
-	turns := make([]recentContextTurn, 0, len(snapshot.Messages))
-	for _, msg := range snapshot.Messages {
-		userText := cleanRecentContextText(msg.UserContent)
-		assistantText := cleanRecentContextText(msg.AssistantContent)
-		if userText == "" && assistantText == "" {
-			continue
+func payloadInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	case json.Number:
+		n, err := v.Int64()
+		if err == nil {
+			return n, true
+		}
+		f, ferr := v.Float64()
+		if ferr == nil {
+			return int64(f), true
+		}
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return 0, false
+		}
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return n, true
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return int64(f), true
 		}
-		turns = append(turns, recentContextTurn{
-			User:      userText,
-			Assistant: assistantText,
-		})
 	}
-	return formatRecentContextTurns(turns, maxTurns, 2200)
+	return 0, false
 }
 
-func buildRecentContextFromEvents(userID string, entry mcp.ChatSessionEntry, maxTurns int) (string, int) {
-	if entry.ID <= 0 {
-		return "", 0
+func extractToolCardSnapshotFromPayload(payloadMap map[string]interface{}) *chatSessionToolCardSnapshot {
+	if payloadMap == nil {
+		return nil
 	}
-	events, err := mcp.ListChatEvents(userID, entry.ID, 0, 400)
-	if err != nil || len(events) == 0 {
-		return "", 0
+	resultMap, _ := payloadMap["result"].(map[string]interface{})
+	if resultMap == nil {
+		return nil
+	}
+	outputList, _ := resultMap["output"].([]interface{})
+	if len(outputList) == 0 {
+		return nil
 	}
 
-	type turnSnapshot struct {
-		user      string
-		assistant string
+	card := chatSessionToolCardSnapshot{
+		State:   "success",
+		History: []chatSessionToolHistorySnapshot{},
 	}
-	byTurn := make(map[string]*turnSnapshot)
-	order := make([]string, 0, len(events))
-	ensureTurn := func(turnID string) *turnSnapshot {
-		key := strings.TrimSpace(turnID)
-		if key == "" {
-			return nil
+	for _, raw := range outputList {
+		item, _ := raw.(map[string]interface{})
+		if item == nil {
+			continue
 		}
-		if existing, ok := byTurn[key]; ok {
-			return existing
+		if itemType, _ := item["type"].(string); itemType != "tool_call" {
+			continue
 		}
-		next := &turnSnapshot{}
-		byTurn[key] = next
-		order = append(order, key)
-		return next
-	}
-
-	for _, event := range events {
-		var payload map[string]interface{}
-		if err := json.Unmarshal([]byte(strings.TrimSpace(event.PayloadJSON)), &payload); err != nil {
-			payload = map[string]interface{}{}
+		toolName, _ := item["tool"].(string)
+		if strings.TrimSpace(toolName) != "" {
+			card.ToolName = strings.TrimSpace(toolName)
 		}
-		turnID := strings.TrimSpace(event.TurnID)
-		if turnID == "" {
-			if raw, ok := payload["turn_id"].(string); ok {
-				turnID = strings.TrimSpace(raw)
+		if args := item["arguments"]; args != nil {
+			card.Args = args
+			detail := compactToolSnapshotDetail(card.ToolName, args, "")
+			if detail != "" {
+				entry := chatSessionToolHistorySnapshot{
+					Tool:   strings.TrimSpace(card.ToolName),
+					Detail: detail,
+				}
+				if entry.Tool == "" {
+					entry.Tool = "Tool"
+				}
+				last := chatSessionToolHistorySnapshot{}
+				if len(card.History) > 0 {
+					last = card.History[len(card.History)-1]
+				}
+				if last.Tool != entry.Tool || last.Detail != entry.Detail {
+					card.History = append(card.History, entry)
+				}
 			}
 		}
-		turn := ensureTurn(turnID)
-		if turn == nil {
-			continue
+		if output, ok := item["output"].(string); ok && strings.TrimSpace(output) == "" {
+			card.State = "failure"
 		}
-		switch event.EventType {
-		case "message.created":
-			if event.Role == "user" {
-				if content, ok := payload["content"].(string); ok && strings.TrimSpace(content) != "" {
-					turn.user = strings.TrimSpace(content)
-				}
+	}
+
+	if strings.TrimSpace(card.ToolName) == "" && len(card.History) == 0 {
+		return nil
+	}
+	if card.State == "" {
+		card.State = "success"
+	}
+	return &card
+}
+
+func updateChatSessionMessageSnapshot(snapshot *chatSessionUISnapshot, turnID, role, eventType string, payload interface{}) {
+	if snapshot == nil || strings.TrimSpace(turnID) == "" {
+		return
+	}
+	msg := ensureChatSessionMessageSnapshot(snapshot, turnID)
+	if msg == nil {
+		return
+	}
+	payloadMap, _ := payload.(map[string]interface{})
+	if payloadMap == nil {
+		payloadMap = map[string]interface{}{}
+	}
+
+	switch eventType {
+	case "reasoning.start":
+		msg.ReasoningCurrentPhaseMS = 0
+		msg.ReasoningDurationMS = msg.ReasoningAccumulatedMS
+	case "message.created":
+		if role == "user" {
+			if content, ok := payloadMap["content"].(string); ok {
+				msg.UserContent = content
 			}
-		case "message.delta":
-			if fullContent, ok := payload["full_content"].(string); ok && strings.TrimSpace(fullContent) != "" {
-				turn.assistant = strings.TrimSpace(fullContent)
-			} else if content, ok := payload["content"].(string); ok && strings.TrimSpace(content) != "" {
-				turn.assistant = strings.TrimSpace(turn.assistant + content)
+		}
+	case "message.delta":
+		if fullContent, ok := payloadMap["full_content"].(string); ok {
+			msg.AssistantContent = fullContent
+		} else if content, ok := payloadMap["content"].(string); ok && content != "" {
+			msg.AssistantContent += content
+		}
+	case "chat.end", "request.complete":
+		if finalContent := chatharness.ExtractFinalAssistantContent(payloadMap); finalContent != "" {
+			msg.AssistantContent = finalContent
+		}
+		if reasoningContent := chatharness.ExtractReasoningContent(payloadMap); reasoningContent != "" {
+			msg.ReasoningContent = reasoningContent
+		}
+		if totalMS, ok := payloadInt64(payloadMap["total_elapsed_ms"]); ok && totalMS > 0 {
+			msg.ReasoningDurationMS = totalMS
+			msg.ReasoningAccumulatedMS = totalMS
+			msg.ReasoningCurrentPhaseMS = 0
+		} else if elapsedMS, ok := payloadInt64(payloadMap["elapsed_ms"]); ok && elapsedMS > 0 {
+			msg.ReasoningDurationMS = elapsedMS
+			msg.ReasoningAccumulatedMS = elapsedMS
+			msg.ReasoningCurrentPhaseMS = 0
+		}
+	case "reasoning.delta":
+		if content, ok := payloadMap["content"].(string); ok && content != "" {
+			msg.ReasoningContent += content
+		} else if content, ok := payloadMap["reasoning_content"].(string); ok && content != "" {
+			msg.ReasoningContent += content
+		} else if text, ok := payloadMap["text"].(string); ok && text != "" {
+			msg.ReasoningContent += text
+		}
+		if totalMS, ok := payloadInt64(payloadMap["total_elapsed_ms"]); ok && totalMS > 0 {
+			msg.ReasoningDurationMS = totalMS
+			if totalMS >= msg.ReasoningAccumulatedMS {
+				msg.ReasoningCurrentPhaseMS = totalMS - msg.ReasoningAccumulatedMS
 			}
-		case "chat.end", "request.complete":
-			if content := extractFinalAssistantContent(payload); strings.TrimSpace(content) != "" {
-				turn.assistant = strings.TrimSpace(content)
+			AddDebugTrace("chat", "reasoning.snapshot", "Updated reasoning snapshot from total elapsed", map[string]interface{}{
+				"turn_id":                   turnID,
+				"event_type":                eventType,
+				"payload_elapsed_ms":        payloadMap["elapsed_ms"],
+				"payload_total_elapsed_ms":  payloadMap["total_elapsed_ms"],
+				"snapshot_duration_ms":      msg.ReasoningDurationMS,
+				"snapshot_accumulated_ms":   msg.ReasoningAccumulatedMS,
+				"snapshot_current_phase_ms": msg.ReasoningCurrentPhaseMS,
+			})
+			break
+		}
+		if elapsedMS, ok := payloadInt64(payloadMap["elapsed_ms"]); ok && elapsedMS > 0 {
+			if elapsedMS > msg.ReasoningCurrentPhaseMS {
+				msg.ReasoningCurrentPhaseMS = elapsedMS
 			}
+			msg.ReasoningDurationMS = msg.ReasoningAccumulatedMS + msg.ReasoningCurrentPhaseMS
+			AddDebugTrace("chat", "reasoning.snapshot", "Updated reasoning snapshot from segment elapsed", map[string]interface{}{
+				"turn_id":                   turnID,
+				"event_type":                eventType,
+				"payload_elapsed_ms":        payloadMap["elapsed_ms"],
+				"payload_total_elapsed_ms":  payloadMap["total_elapsed_ms"],
+				"snapshot_duration_ms":      msg.ReasoningDurationMS,
+				"snapshot_accumulated_ms":   msg.ReasoningAccumulatedMS,
+				"snapshot_current_phase_ms": msg.ReasoningCurrentPhaseMS,
+			})
 		}
-	}
-
-	turns := make([]recentContextTurn, 0, len(order))
-	for _, turnID := range order {
-		turn := byTurn[turnID]
-		if turn == nil {
-			continue
+	case "reasoning.end":
+		if totalMS, ok := payloadInt64(payloadMap["total_elapsed_ms"]); ok && totalMS > 0 {
+			msg.ReasoningDurationMS = totalMS
+			msg.ReasoningAccumulatedMS = totalMS
+			msg.ReasoningCurrentPhaseMS = 0
+			AddDebugTrace("chat", "reasoning.snapshot", "Finalized reasoning snapshot from total elapsed", map[string]interface{}{
+				"turn_id":                   turnID,
+				"event_type":                eventType,
+				"payload_elapsed_ms":        payloadMap["elapsed_ms"],
+				"payload_total_elapsed_ms":  payloadMap["total_elapsed_ms"],
+				"snapshot_duration_ms":      msg.ReasoningDurationMS,
+				"snapshot_accumulated_ms":   msg.ReasoningAccumulatedMS,
+				"snapshot_current_phase_ms": msg.ReasoningCurrentPhaseMS,
+			})
+			break
 		}
-		userText := cleanRecentContextText(turn.user)
-		assistantText := cleanRecentContextText(turn.assistant)
-		if userText == "" && assistantText == "" {
-			continue
+		if elapsedMS, ok := payloadInt64(payloadMap["elapsed_ms"]); ok && elapsedMS > 0 {
+			if elapsedMS > msg.ReasoningCurrentPhaseMS {
+				msg.ReasoningCurrentPhaseMS = elapsedMS
+			}
 		}
-		turns = append(turns, recentContextTurn{
-			User:      userText,
-			Assistant: assistantText,
+		msg.ReasoningAccumulatedMS += msg.ReasoningCurrentPhaseMS
+		msg.ReasoningCurrentPhaseMS = 0
+		msg.ReasoningDurationMS = msg.ReasoningAccumulatedMS
+		AddDebugTrace("chat", "reasoning.snapshot", "Finalized reasoning snapshot from segment elapsed", map[string]interface{}{
+			"turn_id":                   turnID,
+			"event_type":                eventType,
+			"payload_elapsed_ms":        payloadMap["elapsed_ms"],
+			"payload_total_elapsed_ms":  payloadMap["total_elapsed_ms"],
+			"snapshot_duration_ms":      msg.ReasoningDurationMS,
+			"snapshot_accumulated_ms":   msg.ReasoningAccumulatedMS,
+			"snapshot_current_phase_ms": msg.ReasoningCurrentPhaseMS,
 		})
 	}
-	return formatRecentContextTurns(turns, maxTurns, 2200)
 }
 
-func getRecentConversationContext(userID string) (string, int, string) {
-	entry, err := mcp.GetCurrentChatSession(userID)
-	if err != nil {
-		return "", 0, ""
-	}
-	snapshot := parseChatSessionUISnapshot(entry.UIStateJSON)
-	if text, turns := buildRecentContextFromSnapshot(snapshot, 4); strings.TrimSpace(text) != "" {
-		return text, turns, "ui_snapshot"
+func normalizeSavedTurnTemperature(temp float64) float64 {
+	if temp < 0 {
+		return 0
 	}
-	if text, turns := buildRecentContextFromEvents(userID, entry, 4); strings.TrimSpace(text) != "" {
-		return text, turns, "chat_events"
+	if temp > 2 {
+		return 2
 	}
-	return "", 0, ""
+	return temp
 }
 
-func computeServerStatefulRisk(turnCount, estimatedChars, lastInputTokens int, nextUserText string, turnLimit, charBudget, tokenBudget int) (float64, string) {
-	if turnLimit <= 0 {
-		turnLimit = 8
+func parseSavedTurnTitleOptionsFromBody(r *http.Request) (savedTurnTitleOptions, error) {
+	var opts savedTurnTitleOptions
+	if r == nil || r.Body == nil {
+		return opts, nil
 	}
-	if charBudget <= 0 {
-		charBudget = 32000
+
+	rawBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		return opts, err
 	}
-	if tokenBudget <= 0 {
-		tokenBudget = 30000
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(rawBody))
+
+	if len(bytes.TrimSpace(rawBody)) == 0 {
+		return opts, nil
 	}
-	projectedChars := estimatedChars + len([]rune(strings.TrimSpace(nextUserText)))
-	projectedTokens := lastInputTokens + estimateStatefulTokens(nextUserText)
-	turnFactor := math.Min(1, float64(turnCount)/math.Max(float64(turnLimit), 1))
-	charFactor := math.Min(1, float64(projectedChars)/math.Max(float64(charBudget), 1))
-	tokenFactor := math.Min(1, float64(projectedTokens)/math.Max(float64(tokenBudget), 1))
-	score := math.Round((turnFactor*20+charFactor*15+tokenFactor*65)*100) / 100
-	level := "low"
-	if score >= 0.9 {
-		level = "critical"
-	} else if score >= 0.7 {
-		level = "high"
-	} else if score >= 0.45 {
-		level = "medium"
+
+	var payload struct {
+		ModelID        string   `json:"model_id"`
+		SecondaryModel string   `json:"secondary_model"`
+		APIToken       string   `json:"api_token"`
+		Temperature    *float64 `json:"temperature"`
+		LLMMode        string   `json:"llm_mode"`
 	}
-	return score, level
+	if err := json.Unmarshal(rawBody, &payload); err != nil {
+		return opts, nil
+	}
+
+	opts.ModelID = strings.TrimSpace(payload.ModelID)
+	opts.SecondaryModel = strings.TrimSpace(payload.SecondaryModel)
+	opts.APIToken = strings.TrimSpace(payload.APIToken)
+	opts.LLMMode = strings.TrimSpace(payload.LLMMode)
+	if payload.Temperature != nil {
+		opts.Temperature = normalizeSavedTurnTemperature(*payload.Temperature)
+	}
+	return opts, nil
 }
 
-func extractChatInputText(reqMap map[string]interface{}) string {
-	if reqMap == nil {
+func parseSavedTurnTitleFromJSON(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
 		return ""
 	}
-	if input, ok := reqMap["input"].(string); ok {
-		return strings.TrimSpace(input)
-	}
-	if items, ok := reqMap["input"].([]interface{}); ok {
-		var parts []string
-		for _, item := range items {
-			obj, ok := item.(map[string]interface{})
-			if !ok {
-				continue
-			}
-			itemType, _ := obj["type"].(string)
-			switch itemType {
-			case "text":
-				if content, ok := obj["content"].(string); ok && strings.TrimSpace(content) != "" {
-					parts = append(parts, strings.TrimSpace(content))
-				}
-			case "input_text":
-				if text, ok := obj["text"].(string); ok && strings.TrimSpace(text) != "" {
-					parts = append(parts, strings.TrimSpace(text))
-				}
-			}
-		}
-		return strings.TrimSpace(strings.Join(parts, "\n"))
-	}
-	if messages, ok := reqMap["messages"].([]interface{}); ok {
-		for i := len(messages) - 1; i >= 0; i-- {
-			msg, ok := messages[i].(map[string]interface{})
-			if !ok {
-				continue
-			}
-			role, _ := msg["role"].(string)
-			if role != "user" {
-				continue
-			}
-			if content, ok := msg["content"].(string); ok {
-				return strings.TrimSpace(content)
-			}
-		}
-	}
-	return ""
-}
 
-func compactToolSnapshotDetail(toolName string, args interface{}, summary string) string {
-	if s, ok := args.(string); ok && strings.TrimSpace(s) != "" {
-		return compactText(strings.TrimSpace(s), 220)
+	candidates := []string{raw}
+	if strings.HasPrefix(raw, "```") {
+		raw = strings.TrimPrefix(raw, "```json")
+		raw = strings.TrimPrefix(raw, "```JSON")
+		raw = strings.TrimPrefix(raw, "```")
+		raw = strings.TrimSuffix(raw, "```")
+		raw = strings.TrimSpace(raw)
+		candidates = append([]string{raw}, candidates...)
+	}
+	if match := regexp.MustCompile(`(?s)\{.*\}`).FindString(raw); match != "" && match != raw {
+		candidates = append([]string{match}, candidates...)
 	}
-	if argsMap, ok := args.(map[string]interface{}); ok {
-		normalizedTool := strings.ToLower(strings.TrimSpace(toolName))
-		if normalizedTool == "" {
-			normalizedTool = strings.ToLower(strings.TrimSpace(extractStringValue(argsMap, []string{"tool", "tool_name"})))
-		}
-		queryLike := extractStringValue(argsMap, []string{"query", "keyword", "title", "input", "prompt", "text"})
-		url := extractStringValue(argsMap, []string{"url"})
-		sourceID := extractStringValue(argsMap, []string{"source_id"})
-		command := extractStringValue(argsMap, []string{"command"})
-		memoryID := extractStringValue(argsMap, []string{"memory_id"})
 
-		switch normalizedTool {
-		case "search_web", "search_web_multi", "namu_wiki", "naver_search":
-			if normalizedTool == "search_web_multi" {
-				if queries, ok := argsMap["queries"].([]interface{}); ok && len(queries) > 0 {
-					parts := make([]string, 0, len(queries))
-					for _, query := range queries {
-						if text, ok := query.(string); ok && strings.TrimSpace(text) != "" {
-							parts = append(parts, strings.TrimSpace(text))
-						}
-					}
-					if len(parts) > 0 {
-						return compactText("병렬 검색어: "+strings.Join(parts, " | "), 220)
-					}
-				}
-			}
-			if queryLike != "" {
-				return compactText("검색어: "+queryLike, 220)
-			}
-		case "read_web_page":
-			if url != "" {
-				return compactText("페이지 읽기: "+url, 220)
-			}
-		case "read_buffered_source":
-			if queryLike != "" {
-				return compactText("버퍼 문서 읽기: "+queryLike, 220)
-			}
-			if sourceID != "" {
-				return compactText("버퍼 문서 읽기: "+sourceID, 220)
-			}
-		case "read_help":
-			if queryLike != "" {
-				return compactText("도움말 읽기: "+queryLike, 220)
-			}
-			return "도움말 읽기"
-		case "search_memory":
-			if queryLike != "" {
-				return compactText("메모리 검색: "+queryLike, 220)
-			}
-		case "read_memory":
-			if memoryID != "" {
-				return compactText("메모리 읽기: "+memoryID, 220)
-			}
-		case "delete_memory":
-			if memoryID != "" {
-				return compactText("메모리 삭제: "+memoryID, 220)
-			}
-		case "execute_command":
-			if command != "" {
-				return compactText("명령어 실행: "+command, 220)
-			}
-		case "get_current_location":
-			return "사용자 위치를 확인했습니다."
-		case "get_current_time":
-			return "현재 시간을 확인했습니다."
+	for _, candidate := range candidates {
+		var payload struct {
+			Title string `json:"title"`
 		}
-
-		for _, key := range []string{"query", "url", "text", "prompt", "input", "title"} {
-			if value := extractStringValue(argsMap, []string{key}); value != "" {
-				return compactText(value, 220)
+		if err := json.Unmarshal([]byte(candidate), &payload); err == nil {
+			title := strings.TrimSpace(payload.Title)
+			if title != "" {
+				return title
 			}
 		}
-		if bytes, err := json.Marshal(argsMap); err == nil {
-			return compactText(strings.TrimSpace(string(bytes)), 220)
-		}
 	}
-	if args != nil {
-		if bytes, err := json.Marshal(args); err == nil {
-			return compactText(strings.TrimSpace(string(bytes)), 220)
-		}
-	}
-	return compactText(strings.TrimSpace(summary), 220)
-}
 
-func isWebEvidenceTool(toolName string) bool {
-	switch strings.TrimSpace(toolName) {
-	case "search_web", "search_web_multi", "naver_search", "namu_wiki", "read_web_page", "read_buffered_source":
-		return true
-	default:
-		return false
-	}
+	return ""
 }
 
-func availableToolNames(tools []promptkit.ToolDefinition) []string {
-	names := make([]string, 0, len(tools))
-	for _, tool := range tools {
-		if name := strings.TrimSpace(tool.Name); name != "" {
-			names = append(names, name)
-		}
+func compactToolResult(toolName, result string) string {
+	result = strings.TrimSpace(result)
+	if result == "" {
+		return fmt.Sprintf("Tool Result (%s): [empty]\nUse this result to answer the user directly. Do not repeat the same tool call unless the user explicitly asked for a refresh.", toolName)
 	}
-	return names
+
+	return fmt.Sprintf("Tool Result (%s):\n%s\n\nUse this result to answer the user directly. Do not repeat the same or near-identical tool call unless the user explicitly asked for a refresh.", toolName, compactText(result, 1200))
 }
 
-func completedToolNames(tools []promptkit.ToolDefinition, usage map[string]int) []string {
-	names := make([]string, 0, len(usage))
-	for _, name := range availableToolNames(tools) {
-		if usage[name] > 0 {
-			names = append(names, name)
-		}
+func extractExecuteCommandFromArgsJSON(argsJSON string) string {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(argsJSON), &payload); err != nil {
+		return ""
 	}
-	return names
+	command, _ := payload["command"].(string)
+	return strings.TrimSpace(command)
 }
 
-func isWebSearchProviderTool(toolName string) bool {
-	switch strings.TrimSpace(toolName) {
-	case "search_web", "search_web_multi", "naver_search", "namu_wiki":
-		return true
-	default:
-		return false
+func executeCommandBudgetFamily(command string) string {
+	normalized := strings.ToLower(strings.TrimSpace(command))
+	if normalized == "" {
+		return ""
 	}
-}
 
-func totalToolUsageFor(tools map[string]int, predicate func(string) bool) int {
-	total := 0
-	for toolName, count := range tools {
-		if predicate(toolName) {
-			total += count
-		}
+	switch {
+	case strings.Contains(normalized, "physmem"), strings.Contains(normalized, "vm_stat"), strings.Contains(normalized, "pages free"), strings.Contains(normalized, "pages active"), strings.Contains(normalized, "pages inactive"), strings.Contains(normalized, "rss"), strings.Contains(normalized, "memory_usage"):
+		return "memory"
+	case strings.Contains(normalized, "pwd"), strings.Contains(normalized, "cwd"), strings.Contains(normalized, "current directory"), strings.Contains(normalized, "current working directory"):
+		return "path"
+	case strings.Contains(normalized, "whoami"), strings.Contains(normalized, "id"):
+		return "identity"
+	case strings.Contains(normalized, "date"), strings.Contains(normalized, "time"):
+		return "time"
 	}
-	return total
-}
 
-func webEvidenceBudgetMessage(total int) string {
-	if total <= 0 {
-		total = webEvidenceToolBudget
+	fields := strings.Fields(normalized)
+	if len(fields) == 0 {
+		return normalized
 	}
-	return fmt.Sprintf("Web evidence budget reached after %d tool calls. Stop searching or reading more sources in this answer. If the evidence already returned is strong enough, answer from it. If it is weak, conflicting, or off-topic, say that you could not verify the answer well enough and ask whether to continue with deeper research.", total)
+	return fields[0]
 }
 
-func isDeepWebResearchRequest(text string) bool {
-	normalized := strings.ToLower(strings.Join(strings.Fields(strings.TrimSpace(text)), " "))
-	if normalized == "" {
-		return false
+// getActiveCertPaths returns the paths to the active certificate and key pair.
+func getActiveCertPaths(appDataDir string, certDomain string) (string, string, bool) {
+	certDir := filepath.Join(appDataDir, certDirName)
+	candidates := []struct {
+		cert     string
+		key      string
+		specific bool
+	}{
+		{filepath.Join(certDir, certDomain+".crt"), filepath.Join(certDir, certDomain+".key"), true},
+		{filepath.Join(certDir, certDomain+".pem"), filepath.Join(certDir, certDomain+".key"), true},
+		{filepath.Join(appDataDir, certDomain+".crt"), filepath.Join(appDataDir, certDomain+".key"), true},
+		{filepath.Join(appDataDir, certDomain+".pem"), filepath.Join(appDataDir, certDomain+".key"), true},
+		{filepath.Join(certDir, "cert.pem"), filepath.Join(certDir, "key.pem"), false},
+		{filepath.Join(appDataDir, "cert.pem"), filepath.Join(appDataDir, "key.pem"), false},
 	}
-	deepSignals := []string{
-		"deep research",
-		"source comparison",
-		"compare sources",
-		"multiple sources",
-		"thorough research",
-		"dig deeper",
-		"깊게 조사",
-		"자세히 조사",
-		"철저히 조사",
-		"여러 출처",
-		"출처 비교",
-		"교차검증",
-		"교차 검증",
-		"검증해서",
-		"근거를 비교",
-	}
-	for _, signal := range deepSignals {
-		if strings.Contains(normalized, signal) {
-			return true
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate.cert); err == nil {
+			if _, err := os.Stat(candidate.key); err == nil {
+				return candidate.cert, candidate.key, candidate.specific
+			}
 		}
 	}
-	return false
+	return filepath.Join(certDir, "cert.pem"), filepath.Join(certDir, "key.pem"), false
 }
 
-func hasMeaningfulChatSessionToolSnapshot(card chatSessionToolCardSnapshot) bool {
-	if strings.TrimSpace(card.Summary) != "" {
-		return true
-	}
-	if name := strings.TrimSpace(card.ToolName); name != "" && !strings.EqualFold(name, "Tool") {
-		return true
-	}
-	if card.Args != nil {
-		if bytes, err := json.Marshal(card.Args); err != nil {
-			return true
-		} else {
-			serialized := strings.TrimSpace(string(bytes))
-			if serialized != "" && serialized != "{}" && serialized != "[]" && serialized != "null" {
-				return true
+// ensureSelfSignedCert check if certificate and key exist in AppDataDir, if not create them.
+func ensureSelfSignedCert(appDataDir string, certDomain string) (string, string, error) {
+	certPath, keyPath, isDomainSpecific := getActiveCertPaths(appDataDir, certDomain)
+
+	// If we have a domain-specific cert, we use it.
+	// Unless we are forcing regeneration via a direct call (GenerateCertificate).
+	if isDomainSpecific {
+		// Validating existing certificate CN
+		certData, err := os.ReadFile(certPath)
+		if err == nil {
+			block, _ := pem.Decode(certData)
+			if block != nil && block.Type == "CERTIFICATE" {
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err == nil {
+					if cert.Subject.CommonName == certDomain {
+						// Found valid domain cert, return it.
+						return certPath, keyPath, nil
+					}
+				}
 			}
 		}
 	}
-	for _, entry := range card.History {
-		if strings.TrimSpace(entry.Tool) != "" || strings.TrimSpace(entry.Detail) != "" {
-			return true
-		}
-	}
-	return false
-}
 
-func hasMeaningfulTurnToolSnapshot(card chatharness.SessionToolCardSnapshot) bool {
-	if strings.TrimSpace(card.Summary) != "" {
-		return true
+	// Default/Fallback names if not domain specific
+	if certPath == filepath.Join(appDataDir, certDirName, "cert.pem") || certPath == filepath.Join(appDataDir, "cert.pem") {
+		certPath = filepath.Join(appDataDir, certDirName, certDomain+".crt")
+		keyPath = filepath.Join(appDataDir, certDirName, certDomain+".key")
 	}
-	if name := strings.TrimSpace(card.ToolName); name != "" && !strings.EqualFold(name, "Tool") {
-		return true
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create cert directory: %v", err)
 	}
-	if card.Args != nil {
-		if bytes, err := json.Marshal(card.Args); err != nil {
-			return true
-		} else {
-			serialized := strings.TrimSpace(string(bytes))
-			if serialized != "" && serialized != "{}" && serialized != "[]" && serialized != "null" {
-				return true
-			}
-		}
-	}
-	for _, entry := range card.History {
-		if strings.TrimSpace(entry.Tool) != "" || strings.TrimSpace(entry.Detail) != "" {
-			return true
-		}
-	}
-	return false
-}
 
-func extractStringValue(obj map[string]interface{}, keys []string) string {
-	for _, key := range keys {
-		if value, ok := obj[key].(string); ok && strings.TrimSpace(value) != "" {
-			return strings.TrimSpace(value)
-		}
+	log.Printf("[HTTPS] Generating self-signed certificate for %s...", certDomain)
+
+	// Generate a new private key
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate private key: %v", err)
 	}
-	return ""
-}
 
-func updateChatSessionToolSnapshot(snapshot *chatSessionUISnapshot, turnID, eventType string, payload interface{}) {
-	if snapshot == nil || strings.TrimSpace(turnID) == "" {
-		return
+	// Create a certificate template
+	notBefore := time.Now()
+	notAfter := notBefore.Add(365 * 24 * time.Hour) // 1 year validity
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate serial number: %v", err)
 	}
-	if snapshot.ToolCards == nil {
-		snapshot.ToolCards = map[string]chatSessionToolCardSnapshot{}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"DINKI'ssTyle Local LLM Gateway"},
+			CommonName:   certDomain,
+		},
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
 	}
 
-	card := snapshot.ToolCards[turnID]
-	payloadMap, _ := payload.(map[string]interface{})
-	if payloadMap == nil {
-		payloadMap = map[string]interface{}{}
+	// Add local IP and localhost to SANs (match server.go/Make_Cert.py)
+	template.IPAddresses = append(template.IPAddresses, net.ParseIP("127.0.0.1"), net.ParseIP("::1"))
+	template.DNSNames = append(template.DNSNames, "localhost")
+	if certDomain != "localhost" && certDomain != "127.0.0.1" {
+		template.DNSNames = append(template.DNSNames, certDomain)
 	}
 
-	toolName, _ := payloadMap["tool"].(string)
-	summary, _ := payloadMap["reason"].(string)
-	args := payloadMap["arguments"]
-	if toolObj, ok := payloadMap["tool"].(map[string]interface{}); ok {
-		if v, ok := toolObj["tool_name"].(string); ok && strings.TrimSpace(v) != "" {
-			toolName = strings.TrimSpace(v)
-		}
-		if v, ok := toolObj["summary"].(string); ok {
-			summary = strings.TrimSpace(v)
-		}
-		if v, exists := toolObj["args"]; exists {
-			args = v
-		}
+	// Create the certificate
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create certificate: %v", err)
 	}
 
-	switch eventType {
-	case "tool_call.start":
-		card.State = "running"
-		card.ToolName = strings.TrimSpace(toolName)
-		card.Summary = ""
-	case "tool_call.arguments":
-		card.State = "running"
-		if strings.TrimSpace(toolName) != "" {
-			card.ToolName = strings.TrimSpace(toolName)
-		}
-		card.Args = args
-		detail := compactToolSnapshotDetail(card.ToolName, args, summary)
-		if detail != "" {
-			entry := chatSessionToolHistorySnapshot{
-				Tool:   strings.TrimSpace(card.ToolName),
-				Detail: detail,
-			}
-			if entry.Tool == "" {
-				entry.Tool = "Tool"
-			}
-			last := chatSessionToolHistorySnapshot{}
-			if len(card.History) > 0 {
-				last = card.History[len(card.History)-1]
-			}
-			if last.Tool != entry.Tool || last.Detail != entry.Detail {
-				card.History = append(card.History, entry)
-			}
-		}
-	case "tool_call.success":
-		card.State = "success"
-		if strings.TrimSpace(toolName) != "" {
-			card.ToolName = strings.TrimSpace(toolName)
-		}
-		card.Summary = ""
-	case "tool_call.failure":
-		card.State = "failure"
-		if strings.TrimSpace(toolName) != "" {
-			card.ToolName = strings.TrimSpace(toolName)
-		}
-		card.Summary = strings.TrimSpace(summary)
-	case "chat.end", "request.complete":
-		if toolObj, ok := payloadMap["tool"].(map[string]interface{}); ok {
-			card.State = strings.TrimSpace(extractStringValue(toolObj, []string{"state"}))
-			card.Summary = strings.TrimSpace(extractStringValue(toolObj, []string{"summary"}))
-			if strings.TrimSpace(toolName) != "" {
-				card.ToolName = strings.TrimSpace(toolName)
-			}
-			card.Args = args
-			if historyRaw, ok := toolObj["history"].([]interface{}); ok {
-				history := make([]chatSessionToolHistorySnapshot, 0, len(historyRaw))
-				for _, raw := range historyRaw {
-					item, _ := raw.(map[string]interface{})
-					if item == nil {
-						continue
-					}
-					entry := chatSessionToolHistorySnapshot{
-						Tool:   strings.TrimSpace(extractStringValue(item, []string{"tool"})),
-						Detail: strings.TrimSpace(extractStringValue(item, []string{"detail"})),
-					}
-					if entry.Tool != "" || entry.Detail != "" {
-						history = append(history, entry)
-					}
-				}
-				card.History = history
-			}
-			if card.State == "" {
-				card.State = "success"
-			}
-			if card.ToolName == "" {
-				card.ToolName = "Tool"
-			}
-			break
-		}
-		if extracted := extractToolCardSnapshotFromPayload(payloadMap); extracted != nil {
-			card = *extracted
-		}
+	// Write PEM cert
+	certOut, err := os.Create(certPath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open cert for writing: %v", err)
 	}
-	if hasMeaningfulChatSessionToolSnapshot(card) {
-		snapshot.ToolCards[turnID] = card
-	} else {
-		delete(snapshot.ToolCards, turnID)
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+		return "", "", fmt.Errorf("failed to write data to cert: %v", err)
 	}
-}
+	certOut.Close()
 
-func ensureChatSessionMessageSnapshot(snapshot *chatSessionUISnapshot, turnID string) *chatSessionMessageSnapshot {
-	if snapshot == nil || strings.TrimSpace(turnID) == "" {
-		return nil
+	// Write PEM key (PKCS#8 style to match Make_Cert.py)
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open key for writing: %v", err)
 	}
-	if snapshot.Messages == nil {
-		snapshot.Messages = []chatSessionMessageSnapshot{}
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to marshal private key: %v", err)
 	}
-	for i := range snapshot.Messages {
-		if snapshot.Messages[i].TurnID == turnID {
-			return &snapshot.Messages[i]
-		}
+	if err := pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}); err != nil {
+		return "", "", fmt.Errorf("failed to write data to key: %v", err)
 	}
-	snapshot.Messages = append(snapshot.Messages, chatSessionMessageSnapshot{TurnID: turnID})
-	return &snapshot.Messages[len(snapshot.Messages)-1]
+	keyOut.Close()
+
+	// Write DER cert (Android-friendly, matching Make_Cert.py)
+	derPath := strings.TrimSuffix(certPath, filepath.Ext(certPath)) + ".der.crt"
+	os.WriteFile(derPath, derBytes, 0644)
+
+	log.Printf("[HTTPS] Certificate generated at %s (and .der.crt)", certPath)
+	return certPath, keyPath, nil
 }
 
-func payloadInt64(value interface{}) (int64, bool) {
-	switch v := value.(type) {
-	case int:
-		return int64(v), true
-	case int8:
-		return int64(v), true
-	case int16:
-		return int64(v), true
-	case int32:
-		return int64(v), true
-	case int64:
-		return v, true
-	case float32:
-		return int64(v), true
-	case float64:
-		return int64(v), true
-	case json.Number:
-		n, err := v.Int64()
-		if err == nil {
-			return n, true
-		}
-		f, ferr := v.Float64()
-		if ferr == nil {
-			return int64(f), true
-		}
-	case string:
-		if strings.TrimSpace(v) == "" {
-			return 0, false
-		}
-		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
-			return n, true
-		}
-		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
-			return int64(f), true
-		}
-	}
-	return 0, false
+// preloadUserMemory has been removed as it was part of the legacy file-based memory system.
+// System context is now managed exclusively through the new SQLite Agentic RAG system and tools.
+
+// internalLLMRequest describes a background completion the gateway makes on
+// its own behalf. Label names it in debug traces.
+type internalLLMRequest struct {
+	TraceSource  string
+	Label        string
+	SystemPrompt string
+	MaxTokens    int
 }
 
-func extractFinalAssistantContent(payloadMap map[string]interface{}) string {
-	if payloadMap == nil {
-		return ""
-	}
-	resultMap, _ := payloadMap["result"].(map[string]interface{})
-	if resultMap != nil {
-		outputList, _ := resultMap["output"].([]interface{})
-		if len(outputList) > 0 {
-			var builder strings.Builder
-			for _, raw := range outputList {
-				item, _ := raw.(map[string]interface{})
-				if item == nil {
-					continue
-				}
-				if itemType, _ := item["type"].(string); itemType != "message" {
-					continue
-				}
-				content, _ := item["content"].(string)
-				if strings.TrimSpace(content) == "" {
-					continue
-				}
-				builder.WriteString(content)
-			}
-			if builder.Len() > 0 {
-				return builder.String()
-			}
-		}
-	}
-	if finalContent, ok := payloadMap["final_assistant_content"].(string); ok && strings.TrimSpace(finalContent) != "" {
-		return finalContent
-	}
-	return ""
+var savedTurnTitleLLMRequest = internalLLMRequest{
+	TraceSource:  "saved-turn-title",
+	Label:        "saved turn title",
+	SystemPrompt: "You are a master at writing concise saved-chat titles. Return only valid JSON in the form {\"title\":\"...\"}. No markdown fences. No explanations.",
+	MaxTokens:    120,
 }
 
-func extractReasoningContent(payloadMap map[string]interface{}) string {
-	if payloadMap == nil {
-		return ""
-	}
-	resultMap, _ := payloadMap["result"].(map[string]interface{})
-	if resultMap == nil {
+// callLLMInternal makes a background request to the LLM for summary/validation
+func callLLMInternal(ctx context.Context, prompt string, opts savedTurnTitleOptions) string {
+	return callInternalLLM(ctx, savedTurnTitleLLMRequest, prompt, opts)
+}
+
+// callInternalLLM sends prompt to the secondary model (or opts.ModelID) and
+// returns the streamed assistant text, or "" when the call failed.
+func callInternalLLM(ctx context.Context, request internalLLMRequest, prompt string, opts savedTurnTitleOptions) string {
+	source := request.TraceSource
+	if globalApp == nil || (globalApp.llmEndpoint == "" && !globalApp.upstreams.Enabled()) {
+		AddDebugTrace(source, "llm.skipped", fmt.Sprintf("Skipped %s request because LLM endpoint is empty", request.Label), nil)
 		return ""
 	}
-	outputList, _ := resultMap["output"].([]interface{})
-	if len(outputList) == 0 {
-		return ""
+
+	endpoint := strings.TrimRight(globalApp.llmEndpoint, "/")
+	endpoint = strings.TrimSuffix(endpoint, "/v1")
+
+	modelID := strings.TrimSpace(opts.SecondaryModel)
+	if modelID == "" {
+		modelID = strings.TrimSpace(opts.ModelID)
 	}
-	parts := make([]string, 0, len(outputList))
-	for _, raw := range outputList {
-		item, _ := raw.(map[string]interface{})
-		if item == nil {
-			continue
+	if modelID == "" {
+		modelID = "local-model"
+	}
+
+	llmMode := strings.TrimSpace(opts.LLMMode)
+	if llmMode == "" {
+		llmMode = strings.TrimSpace(globalApp.llmMode)
+	}
+	if llmMode == "" {
+		llmMode = "standard"
+	}
+
+	apiToken := strings.TrimSpace(opts.APIToken)
+	if apiToken == "" {
+		apiToken = strings.TrimSpace(globalApp.llmApiToken)
+	}
+	if targets := globalApp.upstreams.Route(modelID); len(targets) > 0 {
+		endpoint, apiToken, llmMode, modelID = targets[0].Endpoint, targets[0].Token, targets[0].Mode, targets[0].Model
+	}
+	apiToken = sanitizeLLMToken(apiToken)
+
+	systemPrompt := request.SystemPrompt
+	var (
+		reqURL  string
+		payload map[string]interface{}
+	)
+	if llmMode == "stateful" {
+		reqURL = fmt.Sprintf("%s/api/v1/chat", endpoint)
+		payload = map[string]interface{}{
+			"model":         modelID,
+			"temperature":   normalizeSavedTurnTemperature(opts.Temperature),
+			"stream":        true,
+			"system_prompt": systemPrompt,
+			"input":         prompt,
 		}
-		if itemType, _ := item["type"].(string); itemType != "reasoning" {
-			continue
+	} else {
+		reqURL = fmt.Sprintf("%s/v1/chat/completions", endpoint)
+		if adapter := chatharness.AdapterFor(llmMode); adapter != nil {
+			reqURL = endpoint + adapter.Path()
 		}
-		content, _ := item["content"].(string)
-		if strings.TrimSpace(content) == "" {
-			continue
+		payload = map[string]interface{}{
+			"model":       modelID,
+			"temperature": normalizeSavedTurnTemperature(opts.Temperature),
+			"max_tokens":  request.MaxTokens,
+			"messages": []map[string]interface{}{
+				{"role": "system", "content": systemPrompt},
+				{"role": "user", "content": prompt},
+			},
+			"stream": true,
 		}
-		parts = append(parts, content)
 	}
-	return strings.Join(parts, "\n\n")
-}
 
-func extractToolCardSnapshotFromPayload(payloadMap map[string]interface{}) *chatSessionToolCardSnapshot {
-	if payloadMap == nil {
-		return nil
+	AddDebugTrace(source, "llm.request", fmt.Sprintf("Prepared %s LLM request", request.Label), map[string]interface{}{
+		"model":       modelID,
+		"mode":        llmMode,
+		"temperature": normalizeSavedTurnTemperature(opts.Temperature),
+		"endpoint":    reqURL,
+		"has_api_key": apiToken != "",
+		"__payload":   payload,
+	})
+
+	jsonPayload, _ := json.Marshal(payload)
+	adapter := chatharness.AdapterFor(llmMode)
+	if adapter != nil {
+		encoded, err := adapter.EncodeRequest(jsonPayload)
+		if err != nil {
+			AddDebugTrace(source, "llm.error", fmt.Sprintf("Failed to encode %s request", request.Label), map[string]interface{}{
+				"error": err,
+			})
+			return ""
+		}
+		jsonPayload = encoded
 	}
-	resultMap, _ := payloadMap["result"].(map[string]interface{})
-	if resultMap == nil {
-		return nil
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	outputList, _ := resultMap["output"].([]interface{})
-	if len(outputList) == 0 {
-		return nil
+
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		AddDebugTrace(source, "llm.error", fmt.Sprintf("Failed to build %s request", request.Label), map[string]interface{}{
+			"error": err,
+		})
+		return ""
 	}
 
-	card := chatSessionToolCardSnapshot{
-		State:   "success",
-		History: []chatSessionToolHistorySnapshot{},
+	req.Header.Set("Content-Type", "application/json")
+	if adapter != nil {
+		adapter.SetHeaders(req.Header, apiToken)
+	} else if apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	} else {
+		req.Header.Set("Authorization", "Bearer lm-studio")
 	}
-	for _, raw := range outputList {
-		item, _ := raw.(map[string]interface{})
-		if item == nil {
+
+	client := &http.Client{Timeout: 2 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		AddDebugTrace(source, "llm.error", fmt.Sprintf("The %s request failed", request.Label), map[string]interface{}{
+			"error": err,
+		})
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		AddDebugTrace(source, "llm.error", fmt.Sprintf("The %s request returned non-OK status", request.Label), map[string]interface{}{
+			"status_code": resp.StatusCode,
+			"__payload":   string(bodyBytes),
+		})
+		return ""
+	}
+
+	var (
+		contentBuilder strings.Builder
+		lastChunk      map[string]interface{}
+	)
+	var stream io.Reader = resp.Body
+	if adapter != nil {
+		stream = chatharness.NormalizedStream(adapter, resp.Body)
+	}
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || !strings.HasPrefix(line, "data: ") {
 			continue
 		}
-		if itemType, _ := item["type"].(string); itemType != "tool_call" {
+		dataStr := strings.TrimPrefix(line, "data: ")
+		if dataStr == "[DONE]" {
+			break
+		}
+
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(dataStr), &chunk); err != nil {
 			continue
 		}
-		toolName, _ := item["tool"].(string)
-		if strings.TrimSpace(toolName) != "" {
-			card.ToolName = strings.TrimSpace(toolName)
+		lastChunk = chunk
+
+		if msgType, ok := chunk["type"].(string); ok && msgType == "message.delta" {
+			if content, ok := chunk["content"].(string); ok && content != "" {
+				contentBuilder.WriteString(content)
+			}
+			continue
 		}
-		if args := item["arguments"]; args != nil {
-			card.Args = args
-			detail := compactToolSnapshotDetail(card.ToolName, args, "")
-			if detail != "" {
-				entry := chatSessionToolHistorySnapshot{
-					Tool:   strings.TrimSpace(card.ToolName),
-					Detail: detail,
-				}
-				if entry.Tool == "" {
-					entry.Tool = "Tool"
-				}
-				last := chatSessionToolHistorySnapshot{}
-				if len(card.History) > 0 {
-					last = card.History[len(card.History)-1]
-				}
-				if last.Tool != entry.Tool || last.Detail != entry.Detail {
-					card.History = append(card.History, entry)
+
+		if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
+			if choice, ok := choices[0].(map[string]interface{}); ok {
+				if delta, ok := choice["delta"].(map[string]interface{}); ok {
+					if content, ok := delta["content"].(string); ok && content != "" {
+						contentBuilder.WriteString(content)
+					}
+				} else if msg, ok := choice["message"].(map[string]interface{}); ok {
+					if content, ok := msg["content"].(string); ok && content != "" {
+						contentBuilder.WriteString(content)
+					}
 				}
 			}
 		}
-		if output, ok := item["output"].(string); ok && strings.TrimSpace(output) == "" {
-			card.State = "failure"
-		}
+	}
+	if err := scanner.Err(); err != nil {
+		AddDebugTrace(source, "llm.error", fmt.Sprintf("Failed while reading %s stream", request.Label), map[string]interface{}{
+			"error": err,
+		})
+		return ""
 	}
 
-	if strings.TrimSpace(card.ToolName) == "" && len(card.History) == 0 {
-		return nil
+	rawContent := strings.TrimSpace(contentBuilder.String())
+	AddDebugTrace(source, "llm.response", fmt.Sprintf("Received %s LLM response", request.Label), map[string]interface{}{
+		"model":       modelID,
+		"mode":        llmMode,
+		"content":     compactText(rawContent, 220),
+		"content_len": len([]rune(rawContent)),
+		"__payload":   lastChunk,
+	})
+	if rawContent != "" {
+		return rawContent
 	}
-	if card.State == "" {
-		card.State = "success"
+
+	AddDebugTrace(source, "llm.empty", fmt.Sprintf("The %s response did not contain assistant content", request.Label), map[string]interface{}{
+		"model": modelID,
+		"mode":  llmMode,
+	})
+	return ""
+}
+
+func savedTurnTitleTaskKey(userID string, turnID int64) string {
+	return fmt.Sprintf("%s:%d", strings.TrimSpace(userID), turnID)
+}
+
+func isSavedTurnTitleProcessing(userID string, turnID int64) bool {
+	_, ok := savedTurnTitleTasks.Load(savedTurnTitleTaskKey(userID, turnID))
+	return ok
+}
+
+func markSavedTurnEntriesProcessing(userID string, entries []mcp.SavedTurnEntry) []mcp.SavedTurnEntry {
+	for i := range entries {
+		entries[i].Processing = isSavedTurnTitleProcessing(userID, entries[i].ID)
 	}
-	return &card
+	return entries
 }
 
-func updateChatSessionMessageSnapshot(snapshot *chatSessionUISnapshot, turnID, role, eventType string, payload interface{}) {
-	if snapshot == nil || strings.TrimSpace(turnID) == "" {
-		return
+func startSavedTurnTitleTask(userID string, turnID int64, fn func(ctx context.Context)) bool {
+	key := savedTurnTitleTaskKey(userID, turnID)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	task := &savedTurnTitleTask{cancel: cancel}
+	if _, loaded := savedTurnTitleTasks.LoadOrStore(key, task); loaded {
+		cancel()
+		return false
 	}
-	msg := ensureChatSessionMessageSnapshot(snapshot, turnID)
-	if msg == nil {
-		return
+
+	go func() {
+		defer func() {
+			cancel()
+			savedTurnTitleTasks.Delete(key)
+		}()
+		fn(ctx)
+	}()
+	return true
+}
+
+func cancelSavedTurnTitleTask(userID string, turnID int64) bool {
+	value, ok := savedTurnTitleTasks.Load(savedTurnTitleTaskKey(userID, turnID))
+	if !ok {
+		return false
 	}
-	payloadMap, _ := payload.(map[string]interface{})
-	if payloadMap == nil {
-		payloadMap = map[string]interface{}{}
+	task, ok := value.(*savedTurnTitleTask)
+	if !ok || task == nil || task.cancel == nil {
+		return false
 	}
+	task.cancel()
+	return true
+}
 
-	switch eventType {
-	case "reasoning.start":
-		msg.ReasoningCurrentPhaseMS = 0
-		msg.ReasoningDurationMS = msg.ReasoningAccumulatedMS
-	case "message.created":
-		if role == "user" {
-			if content, ok := payloadMap["content"].(string); ok {
-				msg.UserContent = content
-			}
-		}
-	case "message.delta":
-		if fullContent, ok := payloadMap["full_content"].(string); ok {
-			msg.AssistantContent = fullContent
-		} else if content, ok := payloadMap["content"].(string); ok && content != "" {
-			msg.AssistantContent += content
-		}
-	case "chat.end", "request.complete":
-		if finalContent := extractFinalAssistantContent(payloadMap); finalContent != "" {
-			msg.AssistantContent = finalContent
-		}
-		if reasoningContent := extractReasoningContent(payloadMap); reasoningContent != "" {
-			msg.ReasoningContent = reasoningContent
-		}
-		if totalMS, ok := payloadInt64(payloadMap["total_elapsed_ms"]); ok && totalMS > 0 {
-			msg.ReasoningDurationMS = totalMS
-			msg.ReasoningAccumulatedMS = totalMS
-			msg.ReasoningCurrentPhaseMS = 0
-		} else if elapsedMS, ok := payloadInt64(payloadMap["elapsed_ms"]); ok && elapsedMS > 0 {
-			msg.ReasoningDurationMS = elapsedMS
-			msg.ReasoningAccumulatedMS = elapsedMS
-			msg.ReasoningCurrentPhaseMS = 0
-		}
-	case "reasoning.delta":
-		if content, ok := payloadMap["content"].(string); ok && content != "" {
-			msg.ReasoningContent += content
-		} else if content, ok := payloadMap["reasoning_content"].(string); ok && content != "" {
-			msg.ReasoningContent += content
-		} else if text, ok := payloadMap["text"].(string); ok && text != "" {
-			msg.ReasoningContent += text
-		}
-		if totalMS, ok := payloadInt64(payloadMap["total_elapsed_ms"]); ok && totalMS > 0 {
-			msg.ReasoningDurationMS = totalMS
-			if totalMS >= msg.ReasoningAccumulatedMS {
-				msg.ReasoningCurrentPhaseMS = totalMS - msg.ReasoningAccumulatedMS
-			}
-			AddDebugTrace("chat", "reasoning.snapshot", "Updated reasoning snapshot from total elapsed", map[string]interface{}{
-				"turn_id":                   turnID,
-				"event_type":                eventType,
-				"payload_elapsed_ms":        payloadMap["elapsed_ms"],
-				"payload_total_elapsed_ms":  payloadMap["total_elapsed_ms"],
-				"snapshot_duration_ms":      msg.ReasoningDurationMS,
-				"snapshot_accumulated_ms":   msg.ReasoningAccumulatedMS,
-				"snapshot_current_phase_ms": msg.ReasoningCurrentPhaseMS,
-			})
-			break
-		}
-		if elapsedMS, ok := payloadInt64(payloadMap["elapsed_ms"]); ok && elapsedMS > 0 {
-			if elapsedMS > msg.ReasoningCurrentPhaseMS {
-				msg.ReasoningCurrentPhaseMS = elapsedMS
-			}
-			msg.ReasoningDurationMS = msg.ReasoningAccumulatedMS + msg.ReasoningCurrentPhaseMS
-			AddDebugTrace("chat", "reasoning.snapshot", "Updated reasoning snapshot from segment elapsed", map[string]interface{}{
-				"turn_id":                   turnID,
-				"event_type":                eventType,
-				"payload_elapsed_ms":        payloadMap["elapsed_ms"],
-				"payload_total_elapsed_ms":  payloadMap["total_elapsed_ms"],
-				"snapshot_duration_ms":      msg.ReasoningDurationMS,
-				"snapshot_accumulated_ms":   msg.ReasoningAccumulatedMS,
-				"snapshot_current_phase_ms": msg.ReasoningCurrentPhaseMS,
-			})
-		}
-	case "reasoning.end":
-		if totalMS, ok := payloadInt64(payloadMap["total_elapsed_ms"]); ok && totalMS > 0 {
-			msg.ReasoningDurationMS = totalMS
-			msg.ReasoningAccumulatedMS = totalMS
-			msg.ReasoningCurrentPhaseMS = 0
-			AddDebugTrace("chat", "reasoning.snapshot", "Finalized reasoning snapshot from total elapsed", map[string]interface{}{
-				"turn_id":                   turnID,
-				"event_type":                eventType,
-				"payload_elapsed_ms":        payloadMap["elapsed_ms"],
-				"payload_total_elapsed_ms":  payloadMap["total_elapsed_ms"],
-				"snapshot_duration_ms":      msg.ReasoningDurationMS,
-				"snapshot_accumulated_ms":   msg.ReasoningAccumulatedMS,
-				"snapshot_current_phase_ms": msg.ReasoningCurrentPhaseMS,
-			})
-			break
-		}
-		if elapsedMS, ok := payloadInt64(payloadMap["elapsed_ms"]); ok && elapsedMS > 0 {
-			if elapsedMS > msg.ReasoningCurrentPhaseMS {
-				msg.ReasoningCurrentPhaseMS = elapsedMS
-			}
-		}
-		msg.ReasoningAccumulatedMS += msg.ReasoningCurrentPhaseMS
-		msg.ReasoningCurrentPhaseMS = 0
-		msg.ReasoningDurationMS = msg.ReasoningAccumulatedMS
-		AddDebugTrace("chat", "reasoning.snapshot", "Finalized reasoning snapshot from segment elapsed", map[string]interface{}{
-			"turn_id":                   turnID,
-			"event_type":                eventType,
-			"payload_elapsed_ms":        payloadMap["elapsed_ms"],
-			"payload_total_elapsed_ms":  payloadMap["total_elapsed_ms"],
-			"snapshot_duration_ms":      msg.ReasoningDurationMS,
-			"snapshot_accumulated_ms":   msg.ReasoningAccumulatedMS,
-			"snapshot_current_phase_ms": msg.ReasoningCurrentPhaseMS,
-		})
-	}
-}
-
-func normalizeSavedTurnTemperature(temp float64) float64 {
-	if temp < 0 {
-		return 0
-	}
-	if temp > 2 {
-		return 2
+func savedTurnQueuedStatus(started bool) string {
+	if started {
+		return "processing"
 	}
-	return temp
+	return "noop"
 }
 
-func parseSavedTurnTitleOptionsFromBody(r *http.Request) (savedTurnTitleOptions, error) {
-	var opts savedTurnTitleOptions
-	if r == nil || r.Body == nil {
-		return opts, nil
-	}
-
-	rawBody, err := io.ReadAll(r.Body)
+func recordSavedTurnAutoTitleFailure(userID string, turnID int64, reason string, extra map[string]interface{}) {
+	failures, err := mcp.IncrementSavedTurnAutoTitleFailures(userID, turnID)
 	if err != nil {
-		return opts, err
-	}
-	r.Body.Close()
-	r.Body = io.NopCloser(bytes.NewReader(rawBody))
-
-	if len(bytes.TrimSpace(rawBody)) == 0 {
-		return opts, nil
+		log.Printf("[saved-turn-title] Failed to increment auto title failure for %s turn %d: %v", userID, turnID, err)
+		AddDebugTrace("saved-turn-title", "db.error", "Failed to increment automatic title failure count", map[string]interface{}{
+			"user_id": userID,
+			"turn_id": turnID,
+			"reason":  reason,
+			"error":   err,
+		})
+		return
 	}
 
-	var payload struct {
-		ModelID        string   `json:"model_id"`
-		SecondaryModel string   `json:"secondary_model"`
-		APIToken       string   `json:"api_token"`
-		Temperature    *float64 `json:"temperature"`
-		LLMMode        string   `json:"llm_mode"`
+	details := map[string]interface{}{
+		"user_id":       userID,
+		"turn_id":       turnID,
+		"reason":        reason,
+		"failure_count": failures,
+		"auto_disabled": failures >= 3,
 	}
-	if err := json.Unmarshal(rawBody, &payload); err != nil {
-		return opts, nil
+	for key, value := range extra {
+		details[key] = value
 	}
 
-	opts.ModelID = strings.TrimSpace(payload.ModelID)
-	opts.SecondaryModel = strings.TrimSpace(payload.SecondaryModel)
-	opts.APIToken = strings.TrimSpace(payload.APIToken)
-	opts.LLMMode = strings.TrimSpace(payload.LLMMode)
-	if payload.Temperature != nil {
-		opts.Temperature = normalizeSavedTurnTemperature(*payload.Temperature)
+	stage := "retry.scheduled"
+	message := "Automatic saved turn title retry remains enabled"
+	if failures >= 3 {
+		stage = "retry.disabled"
+		message = "Disabled automatic saved turn title retries after repeated failures"
 	}
-	return opts, nil
+	AddDebugTrace("saved-turn-title", stage, message, details)
 }
 
-func parseSavedTurnTitleFromJSON(raw string) string {
-	raw = strings.TrimSpace(raw)
-	if raw == "" {
-		return ""
-	}
-
-	candidates := []string{raw}
-	if strings.HasPrefix(raw, "```") {
-		raw = strings.TrimPrefix(raw, "```json")
-		raw = strings.TrimPrefix(raw, "```JSON")
-		raw = strings.TrimPrefix(raw, "```")
-		raw = strings.TrimSuffix(raw, "```")
-		raw = strings.TrimSpace(raw)
-		candidates = append([]string{raw}, candidates...)
-	}
-	if match := regexp.MustCompile(`(?s)\{.*\}`).FindString(raw); match != "" && match != raw {
-		candidates = append([]string{match}, candidates...)
-	}
-
-	for _, candidate := range candidates {
-		var payload struct {
-			Title string `json:"title"`
-		}
-		if err := json.Unmarshal([]byte(candidate), &payload); err == nil {
-			title := strings.TrimSpace(payload.Title)
-			if title != "" {
-				return title
-			}
-		}
-	}
-
-	return ""
+type ServerTTSConfig struct {
+	Engine      string  `json:"engine"`
+	VoiceStyle  string  `json:"voiceStyle"`
+	Speed       float32 `json:"speed"`
+	Threads     int     `json:"threads"`
+	OSVoiceURI  string  `json:"osVoiceURI,omitempty"`
+	OSVoiceName string  `json:"osVoiceName,omitempty"`
+	OSVoiceLang string  `json:"osVoiceLang,omitempty"`
+	OSRate      float32 `json:"osRate,omitempty"`
+	OSPitch     float32 `json:"osPitch,omitempty"`
 }
 
-func compactToolResult(toolName, result string) string {
-	result = strings.TrimSpace(result)
-	if result == "" {
-		return fmt.Sprintf("Tool Result (%s): [empty]\nUse this result to answer the user directly. Do not repeat the same tool call unless the user explicitly asked for a refresh.", toolName)
-	}
-
-	return fmt.Sprintf("Tool Result (%s):\n%s\n\nUse this result to answer the user directly. Do not repeat the same or near-identical tool call unless the user explicitly asked for a refresh.", toolName, compactText(result, 1200))
-}
+// createServerMux creates the HTTP handler mux for the server
+func createServerMux(app *App, authMgr *AuthManager) *http.ServeMux {
+	globalApp = app // Initialize the global instance for all handlers
+	mux := http.NewServeMux()
 
-func extractExecuteCommandFromArgsJSON(argsJSON string) string {
-	var payload map[string]interface{}
-	if err := json.Unmarshal([]byte(argsJSON), &payload); err != nil {
-		return ""
-	}
-	command, _ := payload["command"].(string)
-	return strings.TrimSpace(command)
-}
+	// Public endpoints (no auth required)
+	mux.HandleFunc("/api/login", handleLogin(authMgr))
+	mux.HandleFunc("/api/logout", handleLogout(authMgr))
+	mux.HandleFunc("/api/logout-all-sessions", AuthMiddleware(authMgr, handleLogoutAllSessions(authMgr)))
+	mux.HandleFunc("/api/api-keys", AuthMiddleware(authMgr, handleAPIKeys(authMgr)))
+	mux.HandleFunc("/api/auth/check", handleAuthCheck(authMgr))
+	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.CheckHealth())
+	})
 
-func executeCommandBudgetFamily(command string) string {
-	normalized := strings.ToLower(strings.TrimSpace(command))
-	if normalized == "" {
-		return ""
-	}
+	// Protected API endpoints
+	mux.HandleFunc("/api/chat", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		handleChat(w, r, app, authMgr)
+	}))
+	mux.HandleFunc("/api/chat-session/current", AuthMiddleware(authMgr, handleCurrentChatSession()))
+	mux.HandleFunc("/api/chat-session/events", AuthMiddleware(authMgr, handleChatSessionEvents()))
+	mux.HandleFunc("/api/chat-session/events/stream", AuthMiddleware(authMgr, handleChatSessionEventsStream()))
+	mux.HandleFunc("/api/chat-session/stop", AuthMiddleware(authMgr, handleStopCurrentChat()))
+	mux.HandleFunc("/api/chat-session/clear", AuthMiddleware(authMgr, handleClearCurrentChat()))
+	mux.HandleFunc("/api/chat-session/tool-approvals", AuthMiddleware(authMgr, handleToolApprovals()))
+	mux.HandleFunc("/api/tts", AuthMiddleware(authMgr, handleTTS))
+	mux.HandleFunc("/api/tts/on-device/status", AuthMiddleware(authMgr, handleOnDeviceTTSStatus(app)))
+	mux.HandleFunc("/api/tts/on-device/assets/", AuthMiddleware(authMgr, handleOnDeviceTTSAsset()))
+	mux.HandleFunc("/__tts-model/supertonic-3/", handleOnDeviceTTSAsset())
+	mux.HandleFunc("/api/last-session", AuthMiddleware(authMgr, handleLastSession()))
+	mux.HandleFunc("/api/saved-turns", AuthMiddleware(authMgr, handleSavedTurns()))
+	mux.HandleFunc("/api/saved-turns/title-refresh", AuthMiddleware(authMgr, handleSavedTurnTitleRefresh()))
+	mux.HandleFunc("/api/memories", AuthMiddleware(authMgr, handleMemories()))
+	mux.HandleFunc("/api/memories/search", AuthMiddleware(authMgr, handleMemorySearch()))
+	mux.HandleFunc("/api/memories/profile-facts", AuthMiddleware(authMgr, handleProfileFacts()))
+	mux.HandleFunc("/api/memories/profile-facts/history", AuthMiddleware(authMgr, handleProfileFactHistory()))
+	mux.HandleFunc("/api/memories/profile-facts/revert", AuthMiddleware(authMgr, handleProfileFactRevert()))
+	mux.HandleFunc("/api/memories/profile-facts/conflicts", AuthMiddleware(authMgr, handleProfileFactConflicts()))
 
-	switch {
-	case strings.Contains(normalized, "physmem"), strings.Contains(normalized, "vm_stat"), strings.Contains(normalized, "pages free"), strings.Contains(normalized, "pages active"), strings.Contains(normalized, "pages inactive"), strings.Contains(normalized, "rss"), strings.Contains(normalized, "memory_usage"):
-		return "memory"
-	case strings.Contains(normalized, "pwd"), strings.Contains(normalized, "cwd"), strings.Contains(normalized, "current directory"), strings.Contains(normalized, "current working directory"):
-		return "path"
-	case strings.Contains(normalized, "whoami"), strings.Contains(normalized, "id"):
-		return "identity"
-	case strings.Contains(normalized, "date"), strings.Contains(normalized, "time"):
-		return "time"
-	}
-
-	fields := strings.Fields(normalized)
-	if len(fields) == 0 {
-		return normalized
-	}
-	return fields[0]
-}
+	// Certificate Download Endpoint
+	mux.HandleFunc("/api/cert/download", func(w http.ResponseWriter, r *http.Request) {
+		certPath, _, _ := getActiveCertPaths(GetAppDataDir(), app.GetCertDomain())
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			http.Error(w, "Certificate not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(certPath)))
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		http.ServeFile(w, r, certPath)
+	})
 
-// getActiveCertPaths returns the paths to the active certificate and key pair.
-func getActiveCertPaths(appDataDir string, certDomain string) (string, string, bool) {
-	certDir := filepath.Join(appDataDir, certDirName)
-	candidates := []struct {
-		cert     string
-		key      string
-		specific bool
-	}{
-		{filepath.Join(certDir, certDomain+".crt"), filepath.Join(certDir, certDomain+".key"), true},
-		{filepath.Join(certDir, certDomain+".pem"), filepath.Join(certDir, certDomain+".key"), true},
-		{filepath.Join(appDataDir, certDomain+".crt"), filepath.Join(appDataDir, certDomain+".key"), true},
-		{filepath.Join(appDataDir, certDomain+".pem"), filepath.Join(appDataDir, certDomain+".key"), true},
-		{filepath.Join(certDir, "cert.pem"), filepath.Join(certDir, "key.pem"), false},
-		{filepath.Join(appDataDir, "cert.pem"), filepath.Join(appDataDir, "key.pem"), false},
-	}
-	for _, candidate := range candidates {
-		if _, err := os.Stat(candidate.cert); err == nil {
-			if _, err := os.Stat(candidate.key); err == nil {
-				return candidate.cert, candidate.key, candidate.specific
+	mux.HandleFunc("/api/config", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var newCfg struct {
+				ApiEndpoint         string                `json:"api_endpoint"`
+				ApiToken            *string               `json:"api_token"`
+				SecondaryModel      *string               `json:"secondary_model"`
+				LLMMode             string                `json:"llm_mode"`
+				ContextStrategy     *string               `json:"context_strategy"`
+				EnableTools         *bool                 `json:"enable_tools"`
+				EnableMemory        *bool                 `json:"enable_memory"`
+				StatefulTurnLimit   *int                  `json:"stateful_turn_limit"`
+				StatefulCharBudget  *int                  `json:"stateful_char_budget"`
+				StatefulTokenBudget *int                  `json:"stateful_token_budget"`
+				EmbeddingConfig     *EmbeddingModelConfig `json:"embedding_config"`
 			}
-		}
-	}
-	return filepath.Join(certDir, "cert.pem"), filepath.Join(certDir, "key.pem"), false
-}
+			if err := json.NewDecoder(r.Body).Decode(&newCfg); err == nil {
+				enableToolsUpdate := newCfg.EnableTools
+				// Check for authenticated user
+				userID := r.Header.Get("X-User-ID")
+				var user *User
+				if userID != "" {
+					authMgr.mu.Lock()
+					user = authMgr.users[userID]
+					authMgr.mu.Unlock()
+				}
 
-// ensureSelfSignedCert check if certificate and key exist in AppDataDir, if not create them.
-func ensureSelfSignedCert(appDataDir string, certDomain string) (string, string, error) {
-	certPath, keyPath, isDomainSpecific := getActiveCertPaths(appDataDir, certDomain)
+				if user != nil {
+					// User-specific save
+					updated := false
+					if newCfg.ApiEndpoint != "" {
+						cleanEndpoint := strings.TrimSuffix(strings.TrimSpace(newCfg.ApiEndpoint), "/")
+						cleanEndpoint = strings.TrimSuffix(cleanEndpoint, "/v1")
+						user.Settings.ApiEndpoint = &cleanEndpoint
+						updated = true
+					}
+					if newCfg.ApiToken != nil {
+						token := strings.TrimSpace(*newCfg.ApiToken)
+						if strings.HasPrefix(strings.ToLower(token), "bearer ") {
+							token = strings.TrimSpace(token[7:])
+						}
+						user.Settings.ApiToken = &token
+						updated = true
+					}
+					if newCfg.SecondaryModel != nil {
+						model := strings.TrimSpace(*newCfg.SecondaryModel)
+						user.Settings.SecondaryModel = &model
+						updated = true
+					}
+					if newCfg.LLMMode != "" {
+						user.Settings.LLMMode = &newCfg.LLMMode
+						updated = true
+					}
+					if newCfg.ContextStrategy != nil {
+						value := normalizeContextStrategyForMode(newCfg.LLMMode, *newCfg.ContextStrategy)
+						if newCfg.LLMMode == "" && user.Settings.LLMMode != nil {
+							value = normalizeContextStrategyForMode(*user.Settings.LLMMode, *newCfg.ContextStrategy)
+						}
+						user.Settings.ContextStrategy = &value
+						updated = true
+					}
+					if enableToolsUpdate != nil {
+						user.Settings.EnableTools = enableToolsUpdate
+						updated = true
+					}
+					if newCfg.EnableMemory != nil {
+						user.Settings.EnableMemory = newCfg.EnableMemory
+						updated = true
+					}
+					if newCfg.StatefulTurnLimit != nil {
+						value := *newCfg.StatefulTurnLimit
+						if value < 1 {
+							value = 1
+						}
+						user.Settings.StatefulTurnLimit = &value
+						updated = true
+					}
+					if newCfg.StatefulCharBudget != nil {
+						value := *newCfg.StatefulCharBudget
+						if value < 1000 {
+							value = 1000
+						}
+						user.Settings.StatefulCharBudget = &value
+						updated = true
+					}
+					if newCfg.StatefulTokenBudget != nil {
+						value := *newCfg.StatefulTokenBudget
+						if value < 1000 {
+							value = 1000
+						}
+						user.Settings.StatefulTokenBudget = &value
+						updated = true
+					}
+					if newCfg.EmbeddingConfig != nil {
+						if user.Settings.EmbeddingConfig == nil {
+							user.Settings.EmbeddingConfig = &EmbeddingModelConfig{}
+						}
+						*user.Settings.EmbeddingConfig = normalizeEmbeddingConfig(*newCfg.EmbeddingConfig)
+						updated = true
+					}
 
-	// If we have a domain-specific cert, we use it.
-	// Unless we are forcing regeneration via a direct call (GenerateCertificate).
-	if isDomainSpecific {
-		// Validating existing certificate CN
-		certData, err := os.ReadFile(certPath)
-		if err == nil {
-			block, _ := pem.Decode(certData)
-			if block != nil && block.Type == "CERTIFICATE" {
-				cert, err := x509.ParseCertificate(block.Bytes)
-				if err == nil {
-					if cert.Subject.CommonName == certDomain {
-						// Found valid domain cert, return it.
-						return certPath, keyPath, nil
+					if updated {
+						if err := authMgr.SaveUsers(); err != nil {
+							log.Printf("[handleConfig] Failed to save user settings: %v", err)
+						} else {
+							log.Printf("[handleConfig] Saved settings for user %s", userID)
+						}
+					}
+				} else {
+					// Global config save (Admin or fallback) - Only if no user context or explicitly desired?
+					// For now, keeping legacy behavior for unauthenticated or admin might be confusing.
+					// Let's assume if X-User-ID is missing (local mode) we save global.
+					// If X-User-ID is present, we ONLY save to user.
+					if userID == "" {
+						if newCfg.ApiEndpoint != "" {
+							cleanEndpoint := strings.TrimSuffix(strings.TrimSpace(newCfg.ApiEndpoint), "/")
+							cleanEndpoint = strings.TrimSuffix(cleanEndpoint, "/v1")
+							app.SetLLMEndpoint(cleanEndpoint)
+						}
+						if newCfg.ApiToken != nil {
+							token := strings.TrimSpace(*newCfg.ApiToken)
+							if strings.HasPrefix(strings.ToLower(token), "bearer ") {
+								token = strings.TrimSpace(token[7:])
+							}
+							app.SetLLMApiToken(token)
+						}
+						if newCfg.LLMMode != "" {
+							app.SetLLMMode(newCfg.LLMMode)
+						}
+						if enableToolsUpdate != nil {
+							app.SetEnableTools(*enableToolsUpdate)
+						}
+						if newCfg.EnableMemory != nil {
+							// Global memory toggle is removed, handled per-user
+						}
+						if newCfg.EmbeddingConfig != nil {
+							app.SetEmbeddingModelConfig(*newCfg.EmbeddingConfig)
+						}
 					}
 				}
 			}
 		}
-	}
-
-	// Default/Fallback names if not domain specific
-	if certPath == filepath.Join(appDataDir, certDirName, "cert.pem") || certPath == filepath.Join(appDataDir, "cert.pem") {
-		certPath = filepath.Join(appDataDir, certDirName, certDomain+".crt")
-		keyPath = filepath.Join(appDataDir, certDirName, certDomain+".key")
-	}
-	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
-		return "", "", fmt.Errorf("failed to create cert directory: %v", err)
-	}
-
-	log.Printf("[HTTPS] Generating self-signed certificate for %s...", certDomain)
-
-	// Generate a new private key
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate private key: %v", err)
-	}
-
-	// Create a certificate template
-	notBefore := time.Now()
-	notAfter := notBefore.Add(365 * 24 * time.Hour) // 1 year validity
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate serial number: %v", err)
-	}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
 
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"DINKI'ssTyle Local LLM Gateway"},
-			CommonName:   certDomain,
-		},
-		NotBefore: notBefore,
-		NotAfter:  notAfter,
+		// Prepare response (Merge global + user)
+		resp := map[string]interface{}{
+			"llm_endpoint":          app.llmEndpoint,
+			"llm_mode":              app.llmMode,
+			"context_strategy":      defaultContextStrategyForMode(app.llmMode),
+			"secondary_model":       "",
+			"enable_tts":            app.enableTTS,
+			"enable_tools":          app.enableTools,
+			"enable_memory":         false, // Global default is false, overridden by user settings below
+			"stateful_turn_limit":   8,
+			"stateful_char_budget":  32000,
+			"stateful_token_budget": 30000,
+			"tts_config":            ttsConfig,
+			"embedding_config":      currentEmbeddingModelConfig(),
+			"has_token":             app.llmApiToken != "",
+		}
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-	}
+		// Overlay User Settings
+		userID := r.Header.Get("X-User-ID")
+		if userID != "" {
+			authMgr.mu.RLock()
+			user := authMgr.users[userID]
+			authMgr.mu.RUnlock()
 
-	// Add local IP and localhost to SANs (match server.go/Make_Cert.py)
-	template.IPAddresses = append(template.IPAddresses, net.ParseIP("127.0.0.1"), net.ParseIP("::1"))
-	template.DNSNames = append(template.DNSNames, "localhost")
-	if certDomain != "localhost" && certDomain != "127.0.0.1" {
-		template.DNSNames = append(template.DNSNames, certDomain)
-	}
+			if user != nil {
+				if user.Settings.LLMMode != nil {
+					resp["llm_mode"] = *user.Settings.LLMMode
+					resp["context_strategy"] = defaultContextStrategyForMode(*user.Settings.LLMMode)
+				}
+				if user.Settings.ContextStrategy != nil {
+					modeValue, _ := resp["llm_mode"].(string)
+					resp["context_strategy"] = normalizeContextStrategyForMode(modeValue, *user.Settings.ContextStrategy)
+				}
+				if user.Settings.SecondaryModel != nil {
+					resp["secondary_model"] = *user.Settings.SecondaryModel
+				}
+				if user.Settings.EnableTools != nil {
+					resp["enable_tools"] = *user.Settings.EnableTools
+				}
+				if user.Settings.EnableMemory != nil {
+					resp["enable_memory"] = *user.Settings.EnableMemory
+				}
+				if user.Settings.StatefulTurnLimit != nil {
+					resp["stateful_turn_limit"] = *user.Settings.StatefulTurnLimit
+				}
+				if user.Settings.StatefulCharBudget != nil {
+					resp["stateful_char_budget"] = *user.Settings.StatefulCharBudget
+				}
+				if user.Settings.StatefulTokenBudget != nil {
+					resp["stateful_token_budget"] = *user.Settings.StatefulTokenBudget
+				}
+				if user.Settings.EmbeddingConfig != nil {
+					resp["embedding_config"] = *user.Settings.EmbeddingConfig
+				}
+				if user.Settings.ApiToken != nil && *user.Settings.ApiToken != "" {
+					resp["has_token"] = true
+				}
+				// Note: We don't return the actul token for security, just has_token status
+				// If the user wants to clear it, they send empty string.
+				// But we assume if they set it, they know it.
+			}
+		}
 
-	// Create the certificate
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create certificate: %v", err)
-	}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	mux.HandleFunc("/api/tts/styles", AuthMiddleware(authMgr, handleTTSStyles))
+	mux.HandleFunc("/v1/chat/completions", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		handleOpenAIChatCompletions(w, r, app, authMgr)
+	}))
+	mux.HandleFunc("/api/v1/chat", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		handleChat(w, r, app, authMgr)
+	}))
+	mux.HandleFunc("/api/models", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		handleModels(w, r, app, authMgr)
+	}))
+	mux.HandleFunc("/api/models/unload", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		handleModelUnload(w, r, app, authMgr)
+	}))
+	mux.HandleFunc("/mcp", AuthMiddleware(authMgr, handleMCP(app, authMgr)))
+	mux.HandleFunc("/api/prompts", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.GetSystemPrompts())
+	}))
 
-	// Write PEM cert
-	certOut, err := os.Create(certPath)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to open cert for writing: %v", err)
-	}
-	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		return "", "", fmt.Errorf("failed to write data to cert: %v", err)
-	}
-	certOut.Close()
+	// Admin-only endpoints
+	mux.HandleFunc("/api/users", AdminMiddleware(authMgr, handleUsers(authMgr)))
+	mux.HandleFunc("/api/users/add", AdminMiddleware(authMgr, handleAddUser(authMgr)))
+	mux.HandleFunc("/api/users/delete", AdminMiddleware(authMgr, handleDeleteUser(authMgr)))
+	mux.HandleFunc("/api/mcp/servers", AdminMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(toolruntime.External.Statuses())
+	}))
+	mux.HandleFunc("/api/upstreams", AdminMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.upstreams.Statuses())
+	}))
+	mux.HandleFunc("/api/tools", AdminMiddleware(authMgr, handleToolSwitches(app, authMgr)))
 
-	// Write PEM key (PKCS#8 style to match Make_Cert.py)
-	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to open key for writing: %v", err)
-	}
-	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	// Static file server for frontend (embedded)
+	frontendFS, err := fs.Sub(app.assets, "frontend")
 	if err != nil {
-		return "", "", fmt.Errorf("unable to marshal private key: %v", err)
-	}
-	if err := pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}); err != nil {
-		return "", "", fmt.Errorf("failed to write data to key: %v", err)
-	}
-	keyOut.Close()
-
-	// Write DER cert (Android-friendly, matching Make_Cert.py)
-	derPath := strings.TrimSuffix(certPath, filepath.Ext(certPath)) + ".der.crt"
-	os.WriteFile(derPath, derBytes, 0644)
-
-	log.Printf("[HTTPS] Certificate generated at %s (and .der.crt)", certPath)
-	return certPath, keyPath, nil
-}
-
-// preloadUserMemory has been removed as it was part of the legacy file-based memory system.
-// System context is now managed exclusively through the new SQLite Agentic RAG system and tools.
-
-// callLLMInternal makes a background request to the LLM for summary/validation
-func callLLMInternal(ctx context.Context, prompt string, opts savedTurnTitleOptions) string {
-	if globalApp == nil || globalApp.llmEndpoint == "" {
-		AddDebugTrace("saved-turn-title", "llm.skipped", "Skipped title generation request because LLM endpoint is empty", nil)
-		return ""
-	}
-
-	endpoint := strings.TrimRight(globalApp.llmEndpoint, "/")
-	endpoint = strings.TrimSuffix(endpoint, "/v1")
-
-	modelID := strings.TrimSpace(opts.SecondaryModel)
-	if modelID == "" {
-		modelID = strings.TrimSpace(opts.ModelID)
-	}
-	if modelID == "" {
-		modelID = "local-model"
+		log.Fatal("Failed to get frontend FS:", err)
 	}
+	_ = mime.AddExtensionType(".mjs", "application/javascript; charset=utf-8")
+	_ = mime.AddExtensionType(".wasm", "application/wasm")
+	webFS := http.FileServer(http.FS(frontendFS))
 
-	llmMode := strings.TrimSpace(opts.LLMMode)
-	if llmMode == "" {
-		llmMode = strings.TrimSpace(globalApp.llmMode)
-	}
-	if llmMode == "" {
-		llmMode = "standard"
-	}
+	// Serve web.html at root (Chat UI for web)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" || r.URL.Path == "/index.html" {
+			// Serve web.html from embedded FS
+			f, err := frontendFS.Open("web.html")
+			if err != nil {
+				http.Error(w, "web.html not found", http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
 
-	systemPrompt := "You are a master at writing concise saved-chat titles. Return only valid JSON in the form {\"title\":\"...\"}. No markdown fences. No explanations."
-	var (
-		reqURL  string
-		payload map[string]interface{}
-	)
-	if llmMode == "stateful" {
-		reqURL = fmt.Sprintf("%s/api/v1/chat", endpoint)
-		payload = map[string]interface{}{
-			"model":         modelID,
-			"temperature":   normalizeSavedTurnTemperature(opts.Temperature),
-			"stream":        true,
-			"system_prompt": systemPrompt,
-			"input":         prompt,
+			stat, _ := f.Stat()
+			http.ServeContent(w, r, "web.html", stat.ModTime(), f.(io.ReadSeeker))
+			return
 		}
-	} else {
-		reqURL = fmt.Sprintf("%s/v1/chat/completions", endpoint)
-		payload = map[string]interface{}{
-			"model":       modelID,
-			"temperature": normalizeSavedTurnTemperature(opts.Temperature),
-			"max_tokens":  120,
-			"messages": []map[string]interface{}{
-				{"role": "system", "content": systemPrompt},
-				{"role": "user", "content": prompt},
-			},
-			"stream": true,
+		switch strings.ToLower(filepath.Ext(r.URL.Path)) {
+		case ".mjs", ".js":
+			w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		case ".wasm":
+			w.Header().Set("Content-Type", "application/wasm")
 		}
-	}
-
-	AddDebugTrace("saved-turn-title", "llm.request", "Prepared saved turn title LLM request", map[string]interface{}{
-		"model":       modelID,
-		"mode":        llmMode,
-		"temperature": normalizeSavedTurnTemperature(opts.Temperature),
-		"endpoint":    reqURL,
-		"has_api_key": strings.TrimSpace(opts.APIToken) != "" || strings.TrimSpace(globalApp.llmApiToken) != "",
-		"__payload":   payload,
+		webFS.ServeHTTP(w, r)
 	})
 
-	jsonPayload, _ := json.Marshal(payload)
-	if ctx == nil {
-		ctx = context.Background()
-	}
+	return mux
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		AddDebugTrace("saved-turn-title", "llm.error", "Failed to build title request", map[string]interface{}{
-			"error": err,
-		})
-		return ""
-	}
+// handleLogin processes login requests
+func handleLogin(am *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	req.Header.Set("Content-Type", "application/json")
-	if opts.APIToken != "" || globalApp.llmApiToken != "" {
-		token := strings.TrimSpace(opts.APIToken)
-		if token == "" {
-			token = strings.TrimSpace(globalApp.llmApiToken)
+		var req struct {
+			ID         string `json:"id"`
+			Password   string `json:"password"`
+			RememberMe bool   `json:"remember_me"`
 		}
-		if strings.HasPrefix(strings.ToLower(token), "bearer ") {
-			token = token[7:]
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
 		}
-		req.Header.Set("Authorization", "Bearer "+token)
-	} else {
-		req.Header.Set("Authorization", "Bearer lm-studio")
-	}
 
-	client := &http.Client{Timeout: 2 * time.Minute}
-	resp, err := client.Do(req)
-	if err != nil {
-		AddDebugTrace("saved-turn-title", "llm.error", "Title request failed", map[string]interface{}{
-			"error": err,
+		token, err := am.Authenticate(req.ID, req.Password, req.RememberMe, r.UserAgent(), getClientAddress(r))
+		if err != nil || token == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+			return
+		}
+
+		// Set session cookie
+		maxAge := 0
+		if req.RememberMe {
+			maxAge = 86400 * 30 // 30 days
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "session",
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   r.TLS != nil,
+			MaxAge:   maxAge,
 		})
-		return ""
-	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		AddDebugTrace("saved-turn-title", "llm.error", "Title request returned non-OK status", map[string]interface{}{
-			"status_code": resp.StatusCode,
-			"__payload":   string(bodyBytes),
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "ok",
+			"token":  token,
 		})
-		return ""
 	}
+}
 
-	var (
-		contentBuilder strings.Builder
-		lastChunk      map[string]interface{}
-	)
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		dataStr := strings.TrimPrefix(line, "data: ")
-		if dataStr == "[DONE]" {
-			break
+// handleLogout processes logout requests
+func handleLogout(am *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err == nil {
+			am.InvalidateSession(cookie.Value)
 		}
 
-		var chunk map[string]interface{}
-		if err := json.Unmarshal([]byte(dataStr), &chunk); err != nil {
-			continue
+		http.SetCookie(w, &http.Cookie{
+			Name:     "session",
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   r.TLS != nil,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
+
+func handleLogoutAllSessions(am *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		lastChunk = chunk
 
-		if msgType, ok := chunk["type"].(string); ok && msgType == "message.delta" {
-			if content, ok := chunk["content"].(string); ok && content != "" {
-				contentBuilder.WriteString(content)
-			}
-			continue
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
 
-		if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
-			if choice, ok := choices[0].(map[string]interface{}); ok {
-				if delta, ok := choice["delta"].(map[string]interface{}); ok {
-					if content, ok := delta["content"].(string); ok && content != "" {
-						contentBuilder.WriteString(content)
-					}
-				} else if msg, ok := choice["message"].(map[string]interface{}); ok {
-					if content, ok := msg["content"].(string); ok && content != "" {
-						contentBuilder.WriteString(content)
-					}
-				}
-			}
+		if err := am.InvalidateAllSessionsForUser(userID); err != nil {
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
 		}
-	}
-	if err := scanner.Err(); err != nil {
-		AddDebugTrace("saved-turn-title", "llm.error", "Failed while reading title stream", map[string]interface{}{
-			"error": err,
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "session",
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   r.TLS != nil,
 		})
-		return ""
-	}
 
-	rawContent := strings.TrimSpace(contentBuilder.String())
-	AddDebugTrace("saved-turn-title", "llm.response", "Received saved turn title LLM response", map[string]interface{}{
-		"model":       modelID,
-		"mode":        llmMode,
-		"content":     compactText(rawContent, 220),
-		"content_len": len([]rune(rawContent)),
-		"__payload":   lastChunk,
-	})
-	if rawContent != "" {
-		return rawContent
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
-
-	AddDebugTrace("saved-turn-title", "llm.empty", "Title response did not contain assistant content", map[string]interface{}{
-		"model": modelID,
-		"mode":  llmMode,
-	})
-	return ""
 }
 
-func savedTurnTitleTaskKey(userID string, turnID int64) string {
-	return fmt.Sprintf("%s:%d", strings.TrimSpace(userID), turnID)
-}
+// handleAuthCheck checks if user is authenticated
+func handleAuthCheck(am *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := extractSessionTokenFromRequest(r)
+		if token == "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"authenticated": false})
+			return
+		}
 
-func isSavedTurnTitleProcessing(userID string, turnID int64) bool {
-	_, ok := savedTurnTitleTasks.Load(savedTurnTitleTaskKey(userID, turnID))
-	return ok
-}
+		user, valid := am.ValidateSession(token)
+		if !valid {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"authenticated": false})
+			return
+		}
 
-func markSavedTurnEntriesProcessing(userID string, entries []mcp.SavedTurnEntry) []mcp.SavedTurnEntry {
-	for i := range entries {
-		entries[i].Processing = isSavedTurnTitleProcessing(userID, entries[i].ID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"authenticated": true,
+			"user_id":       user.ID,
+			"role":          user.Role,
+		})
 	}
-	return entries
 }
 
-func startSavedTurnTitleTask(userID string, turnID int64, fn func(ctx context.Context)) bool {
-	key := savedTurnTitleTaskKey(userID, turnID)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	task := &savedTurnTitleTask{cancel: cancel}
-	if _, loaded := savedTurnTitleTasks.LoadOrStore(key, task); loaded {
-		cancel()
-		return false
+// handleUsers returns list of users
+func handleUsers(am *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(am.GetUsers())
 	}
-
-	go func() {
-		defer func() {
-			cancel()
-			savedTurnTitleTasks.Delete(key)
-		}()
-		fn(ctx)
-	}()
-	return true
 }
 
-func cancelSavedTurnTitleTask(userID string, turnID int64) bool {
-	value, ok := savedTurnTitleTasks.Load(savedTurnTitleTaskKey(userID, turnID))
-	if !ok {
-		return false
-	}
-	task, ok := value.(*savedTurnTitleTask)
-	if !ok || task == nil || task.cancel == nil {
-		return false
-	}
-	task.cancel()
-	return true
-}
+// handleAddUser adds a new user
+func handleAddUser(am *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-func savedTurnQueuedStatus(started bool) string {
-	if started {
-		return "processing"
-	}
-	return "noop"
-}
+		var req struct {
+			ID       string `json:"id"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
 
-func recordSavedTurnAutoTitleFailure(userID string, turnID int64, reason string, extra map[string]interface{}) {
-	failures, err := mcp.IncrementSavedTurnAutoTitleFailures(userID, turnID)
-	if err != nil {
-		log.Printf("[saved-turn-title] Failed to increment auto title failure for %s turn %d: %v", userID, turnID, err)
-		AddDebugTrace("saved-turn-title", "db.error", "Failed to increment automatic title failure count", map[string]interface{}{
-			"user_id": userID,
-			"turn_id": turnID,
-			"reason":  reason,
-			"error":   err,
-		})
-		return
-	}
+		if req.Role == "" {
+			req.Role = "user"
+		}
 
-	details := map[string]interface{}{
-		"user_id":       userID,
-		"turn_id":       turnID,
-		"reason":        reason,
-		"failure_count": failures,
-		"auto_disabled": failures >= 3,
-	}
-	for key, value := range extra {
-		details[key] = value
-	}
+		if err := am.AddUser(req.ID, req.Password, req.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	stage := "retry.scheduled"
-	message := "Automatic saved turn title retry remains enabled"
-	if failures >= 3 {
-		stage = "retry.disabled"
-		message = "Disabled automatic saved turn title retries after repeated failures"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
-	AddDebugTrace("saved-turn-title", stage, message, details)
-}
-
-type ServerTTSConfig struct {
-	Engine      string  `json:"engine"`
-	VoiceStyle  string  `json:"voiceStyle"`
-	Speed       float32 `json:"speed"`
-	Threads     int     `json:"threads"`
-	OSVoiceURI  string  `json:"osVoiceURI,omitempty"`
-	OSVoiceName string  `json:"osVoiceName,omitempty"`
-	OSVoiceLang string  `json:"osVoiceLang,omitempty"`
-	OSRate      float32 `json:"osRate,omitempty"`
-	OSPitch     float32 `json:"osPitch,omitempty"`
 }
 
-// createServerMux creates the HTTP handler mux for the server
-func createServerMux(app *App, authMgr *AuthManager) *http.ServeMux {
-	globalApp = app // Initialize the global instance for all handlers
-	mux := http.NewServeMux()
+// handleDeleteUser removes a user
+func handleDeleteUser(am *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	// Public endpoints (no auth required)
-	mux.HandleFunc("/api/login", handleLogin(authMgr))
-	mux.HandleFunc("/api/logout", handleLogout(authMgr))
-	mux.HandleFunc("/api/logout-all-sessions", AuthMiddleware(authMgr, handleLogoutAllSessions(authMgr)))
-	mux.HandleFunc("/api/auth/check", handleAuthCheck(authMgr))
-	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(app.CheckHealth())
-	})
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
 
-	// Protected API endpoints
-	mux.HandleFunc("/api/chat", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
-		handleChat(w, r, app, authMgr)
-	}))
-	mux.HandleFunc("/api/chat-session/current", AuthMiddleware(authMgr, handleCurrentChatSession()))
-	mux.HandleFunc("/api/chat-session/events", AuthMiddleware(authMgr, handleChatSessionEvents()))
-	mux.HandleFunc("/api/chat-session/events/stream", AuthMiddleware(authMgr, handleChatSessionEventsStream()))
-	mux.HandleFunc("/api/chat-session/stop", AuthMiddleware(authMgr, handleStopCurrentChat()))
-	mux.HandleFunc("/api/chat-session/clear", AuthMiddleware(authMgr, handleClearCurrentChat()))
-	mux.HandleFunc("/api/tts", AuthMiddleware(authMgr, handleTTS))
-	mux.HandleFunc("/api/tts/on-device/status", AuthMiddleware(authMgr, handleOnDeviceTTSStatus(app)))
-	mux.HandleFunc("/api/tts/on-device/assets/", AuthMiddleware(authMgr, handleOnDeviceTTSAsset()))
-	mux.HandleFunc("/__tts-model/supertonic-3/", handleOnDeviceTTSAsset())
-	mux.HandleFunc("/api/last-session", AuthMiddleware(authMgr, handleLastSession()))
-	mux.HandleFunc("/api/saved-turns", AuthMiddleware(authMgr, handleSavedTurns()))
-	mux.HandleFunc("/api/saved-turns/title-refresh", AuthMiddleware(authMgr, handleSavedTurnTitleRefresh()))
+		if err := am.DeleteUser(req.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	// Certificate Download Endpoint
-	mux.HandleFunc("/api/cert/download", func(w http.ResponseWriter, r *http.Request) {
-		certPath, _, _ := getActiveCertPaths(GetAppDataDir(), app.GetCertDomain())
-		if _, err := os.Stat(certPath); os.IsNotExist(err) {
-			http.Error(w, "Certificate not found", http.StatusNotFound)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
+
+func handleCurrentChatSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(certPath)))
-		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
-		http.ServeFile(w, r, certPath)
-	})
 
-	mux.HandleFunc("/api/config", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
-			var newCfg struct {
-				ApiEndpoint         string                `json:"api_endpoint"`
-				ApiToken            *string               `json:"api_token"`
-				SecondaryModel      *string               `json:"secondary_model"`
-				LLMMode             string                `json:"llm_mode"`
-				ContextStrategy     *string               `json:"context_strategy"`
-				EnableTools         *bool                 `json:"enable_tools"`
-				EnableMemory        *bool                 `json:"enable_memory"`
-				StatefulTurnLimit   *int                  `json:"stateful_turn_limit"`
-				StatefulCharBudget  *int                  `json:"stateful_char_budget"`
-				StatefulTokenBudget *int                  `json:"stateful_token_budget"`
-				EmbeddingConfig     *EmbeddingModelConfig `json:"embedding_config"`
+		w.Header().Set("Content-Type", "application/json")
+		entry, err := mcp.GetCurrentChatSession(userID)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Printf("[handleCurrentChatSession] Failed to load chat session for %s: %v", userID, err)
 			}
-			if err := json.NewDecoder(r.Body).Decode(&newCfg); err == nil {
-				enableToolsUpdate := newCfg.EnableTools
-				// Check for authenticated user
-				userID := r.Header.Get("X-User-ID")
-				var user *User
-				if userID != "" {
-					authMgr.mu.Lock()
-					user = authMgr.users[userID]
-					authMgr.mu.Unlock()
-				}
+			json.NewEncoder(w).Encode(map[string]interface{}{"has_session": false})
+			return
+		}
+		entry = normalizeStaleRunningSession(entry)
 
-				if user != nil {
-					// User-specific save
-					updated := false
-					if newCfg.ApiEndpoint != "" {
-						cleanEndpoint := strings.TrimSuffix(strings.TrimSpace(newCfg.ApiEndpoint), "/")
-						cleanEndpoint = strings.TrimSuffix(cleanEndpoint, "/v1")
-						user.Settings.ApiEndpoint = &cleanEndpoint
-						updated = true
-					}
-					if newCfg.ApiToken != nil {
-						token := strings.TrimSpace(*newCfg.ApiToken)
-						if strings.HasPrefix(strings.ToLower(token), "bearer ") {
-							token = strings.TrimSpace(token[7:])
-						}
-						user.Settings.ApiToken = &token
-						updated = true
-					}
-					if newCfg.SecondaryModel != nil {
-						model := strings.TrimSpace(*newCfg.SecondaryModel)
-						user.Settings.SecondaryModel = &model
-						updated = true
-					}
-					if newCfg.LLMMode != "" {
-						user.Settings.LLMMode = &newCfg.LLMMode
-						updated = true
-					}
-					if newCfg.ContextStrategy != nil {
-						value := normalizeContextStrategyForMode(newCfg.LLMMode, *newCfg.ContextStrategy)
-						if newCfg.LLMMode == "" && user.Settings.LLMMode != nil {
-							value = normalizeContextStrategyForMode(*user.Settings.LLMMode, *newCfg.ContextStrategy)
-						}
-						user.Settings.ContextStrategy = &value
-						updated = true
-					}
-					if enableToolsUpdate != nil {
-						user.Settings.EnableTools = enableToolsUpdate
-						updated = true
-					}
-					if newCfg.EnableMemory != nil {
-						user.Settings.EnableMemory = newCfg.EnableMemory
-						updated = true
-					}
-					if newCfg.StatefulTurnLimit != nil {
-						value := *newCfg.StatefulTurnLimit
-						if value < 1 {
-							value = 1
-						}
-						user.Settings.StatefulTurnLimit = &value
-						updated = true
-					}
-					if newCfg.StatefulCharBudget != nil {
-						value := *newCfg.StatefulCharBudget
-						if value < 1000 {
-							value = 1000
-						}
-						user.Settings.StatefulCharBudget = &value
-						updated = true
-					}
-					if newCfg.StatefulTokenBudget != nil {
-						value := *newCfg.StatefulTokenBudget
-						if value < 1000 {
-							value = 1000
-						}
-						user.Settings.StatefulTokenBudget = &value
-						updated = true
-					}
-					if newCfg.EmbeddingConfig != nil {
-						if user.Settings.EmbeddingConfig == nil {
-							user.Settings.EmbeddingConfig = &EmbeddingModelConfig{}
-						}
-						*user.Settings.EmbeddingConfig = normalizeEmbeddingConfig(*newCfg.EmbeddingConfig)
-						updated = true
-					}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"has_session": true,
+			"item":        entry,
+		})
+	}
+}
 
-					if updated {
-						if err := authMgr.SaveUsers(); err != nil {
-							log.Printf("[handleConfig] Failed to save user settings: %v", err)
-						} else {
-							log.Printf("[handleConfig] Saved settings for user %s", userID)
-						}
-					}
-				} else {
-					// Global config save (Admin or fallback) - Only if no user context or explicitly desired?
-					// For now, keeping legacy behavior for unauthenticated or admin might be confusing.
-					// Let's assume if X-User-ID is missing (local mode) we save global.
-					// If X-User-ID is present, we ONLY save to user.
-					if userID == "" {
-						if newCfg.ApiEndpoint != "" {
-							cleanEndpoint := strings.TrimSuffix(strings.TrimSpace(newCfg.ApiEndpoint), "/")
-							cleanEndpoint = strings.TrimSuffix(cleanEndpoint, "/v1")
-							app.SetLLMEndpoint(cleanEndpoint)
-						}
-						if newCfg.ApiToken != nil {
-							token := strings.TrimSpace(*newCfg.ApiToken)
-							if strings.HasPrefix(strings.ToLower(token), "bearer ") {
-								token = strings.TrimSpace(token[7:])
-							}
-							app.SetLLMApiToken(token)
-						}
-						if newCfg.LLMMode != "" {
-							app.SetLLMMode(newCfg.LLMMode)
-						}
-						if enableToolsUpdate != nil {
-							app.SetEnableTools(*enableToolsUpdate)
-						}
-						if newCfg.EnableMemory != nil {
-							// Global memory toggle is removed, handled per-user
-						}
-						if newCfg.EmbeddingConfig != nil {
-							app.SetEmbeddingModelConfig(*newCfg.EmbeddingConfig)
-						}
-					}
-				}
+func handleChatSessionEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := mcp.GetCurrentChatSession(userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"has_session": false,
+					"items":       []mcp.ChatEventEntry{},
+				})
+				return
 			}
+			http.Error(w, "Failed to load chat session", http.StatusInternalServerError)
+			return
 		}
+		session = normalizeStaleRunningSession(session)
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Cache-Control", "no-cache")
+		afterSeq := 0
+		if raw := strings.TrimSpace(r.URL.Query().Get("after_seq")); raw != "" {
+			if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+				afterSeq = parsed
+			}
+		}
+		limit := 200
+		if raw := strings.TrimSpace(r.URL.Query().Get("limit")); raw != "" {
+			if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+				limit = parsed
+			}
+		}
 
-		// Prepare response (Merge global + user)
-		resp := map[string]interface{}{
-			"llm_endpoint":          app.llmEndpoint,
-			"llm_mode":              app.llmMode,
-			"context_strategy":      defaultContextStrategyForMode(app.llmMode),
-			"secondary_model":       "",
-			"enable_tts":            app.enableTTS,
-			"enable_tools":          app.enableTools,
-			"enable_memory":         false, // Global default is false, overridden by user settings below
-			"stateful_turn_limit":   8,
-			"stateful_char_budget":  32000,
-			"stateful_token_budget": 30000,
-			"tts_config":            ttsConfig,
-			"embedding_config":      currentEmbeddingModelConfig(),
-			"has_token":             app.llmApiToken != "",
+		events, err := mcp.ListChatEvents(userID, session.ID, afterSeq, limit)
+		if err != nil {
+			http.Error(w, "Failed to load chat events", http.StatusInternalServerError)
+			return
+		}
+		totalCount, err := mcp.CountChatEvents(userID, session.ID)
+		if err != nil {
+			http.Error(w, "Failed to count chat events", http.StatusInternalServerError)
+			return
 		}
 
-		// Overlay User Settings
-		userID := r.Header.Get("X-User-ID")
-		if userID != "" {
-			authMgr.mu.RLock()
-			user := authMgr.users[userID]
-			authMgr.mu.RUnlock()
-
-			if user != nil {
-				if user.Settings.LLMMode != nil {
-					resp["llm_mode"] = *user.Settings.LLMMode
-					resp["context_strategy"] = defaultContextStrategyForMode(*user.Settings.LLMMode)
-				}
-				if user.Settings.ContextStrategy != nil {
-					modeValue, _ := resp["llm_mode"].(string)
-					resp["context_strategy"] = normalizeContextStrategyForMode(modeValue, *user.Settings.ContextStrategy)
-				}
-				if user.Settings.SecondaryModel != nil {
-					resp["secondary_model"] = *user.Settings.SecondaryModel
-				}
-				if user.Settings.EnableTools != nil {
-					resp["enable_tools"] = *user.Settings.EnableTools
-				}
-				if user.Settings.EnableMemory != nil {
-					resp["enable_memory"] = *user.Settings.EnableMemory
-				}
-				if user.Settings.StatefulTurnLimit != nil {
-					resp["stateful_turn_limit"] = *user.Settings.StatefulTurnLimit
-				}
-				if user.Settings.StatefulCharBudget != nil {
-					resp["stateful_char_budget"] = *user.Settings.StatefulCharBudget
-				}
-				if user.Settings.StatefulTokenBudget != nil {
-					resp["stateful_token_budget"] = *user.Settings.StatefulTokenBudget
-				}
-				if user.Settings.EmbeddingConfig != nil {
-					resp["embedding_config"] = *user.Settings.EmbeddingConfig
-				}
-				if user.Settings.ApiToken != nil && *user.Settings.ApiToken != "" {
-					resp["has_token"] = true
-				}
-				// Note: We don't return the actul token for security, just has_token status
-				// If the user wants to clear it, they send empty string.
-				// But we assume if they set it, they know it.
-			}
-		}
-
-		json.NewEncoder(w).Encode(resp)
-	}))
-	mux.HandleFunc("/api/tts/styles", AuthMiddleware(authMgr, handleTTSStyles))
-	mux.HandleFunc("/v1/chat/completions", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
-		// Pass authMgr to allow user settings lookup
-		handleChat(w, r, app, authMgr)
-	}))
-	mux.HandleFunc("/api/v1/chat", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
-		handleChat(w, r, app, authMgr)
-	}))
-	mux.HandleFunc("/api/models", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
-		handleModels(w, r, app, authMgr)
-	}))
-	mux.HandleFunc("/api/models/unload", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
-		handleModelUnload(w, r, app, authMgr)
-	}))
-	mux.HandleFunc("/api/prompts", AuthMiddleware(authMgr, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(app.GetSystemPrompts())
-	}))
-
-	// Admin-only endpoints
-	mux.HandleFunc("/api/users", AdminMiddleware(authMgr, handleUsers(authMgr)))
-	mux.HandleFunc("/api/users/add", AdminMiddleware(authMgr, handleAddUser(authMgr)))
-	mux.HandleFunc("/api/users/delete", AdminMiddleware(authMgr, handleDeleteUser(authMgr)))
-
-	// Static file server for frontend (embedded)
-	frontendFS, err := fs.Sub(app.assets, "frontend")
-	if err != nil {
-		log.Fatal("Failed to get frontend FS:", err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"has_session": true,
+			"session":     session,
+			"items":       events,
+			"total_count": totalCount,
+		})
 	}
-	_ = mime.AddExtensionType(".mjs", "application/javascript; charset=utf-8")
-	_ = mime.AddExtensionType(".wasm", "application/wasm")
-	webFS := http.FileServer(http.FS(frontendFS))
-
-	// Serve web.html at root (Chat UI for web)
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" || r.URL.Path == "/index.html" {
-			// Serve web.html from embedded FS
-			f, err := frontendFS.Open("web.html")
-			if err != nil {
-				http.Error(w, "web.html not found", http.StatusInternalServerError)
-				return
-			}
-			defer f.Close()
-
-			stat, _ := f.Stat()
-			http.ServeContent(w, r, "web.html", stat.ModTime(), f.(io.ReadSeeker))
-			return
-		}
-		switch strings.ToLower(filepath.Ext(r.URL.Path)) {
-		case ".mjs", ".js":
-			w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
-		case ".wasm":
-			w.Header().Set("Content-Type", "application/wasm")
-		}
-		webFS.ServeHTTP(w, r)
-	})
-
-	return mux
 }
 
-// handleLogin processes login requests
-func handleLogin(am *AuthManager) http.HandlerFunc {
+func handleStopCurrentChat() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-
-		var req struct {
-			ID         string `json:"id"`
-			Password   string `json:"password"`
-			RememberMe bool   `json:"remember_me"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		token, err := am.Authenticate(req.ID, req.Password, req.RememberMe, r.UserAgent(), getClientAddress(r))
-		if err != nil || token == "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
-			return
+		cancelled := cancelCurrentChat(userID)
+		sessionEntry, err := mcp.GetCurrentChatSession(userID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("[handleStopCurrentChat] Failed to load current session for %s: %v", userID, err)
 		}
-
-		// Set session cookie
-		maxAge := 0
-		if req.RememberMe {
-			maxAge = 86400 * 30 // 30 days
+		sessionEntry.UserID = userID
+		sessionEntry.SessionKey = "default"
+		sessionEntry.Status = "cancelled"
+		entry, err := mcp.UpsertChatSession(sessionEntry)
+		if err == nil && entry.ID != 0 {
+			_, _ = mcp.AppendChatEvent(userID, entry.ID, "system", "request.cancelled", "", "", `{"source":"remote_stop"}`)
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session",
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			Secure:   r.TLS != nil,
-			MaxAge:   maxAge,
-		})
-
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "ok",
-			"token":  token,
-		})
-	}
-}
-
-// handleLogout processes logout requests
-func handleLogout(am *AuthManager) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session")
-		if err == nil {
-			am.InvalidateSession(cookie.Value)
-		}
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session",
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			Secure:   r.TLS != nil,
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    "ok",
+			"cancelled": cancelled,
 		})
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
 }
 
-func handleLogoutAllSessions(am *AuthManager) http.HandlerFunc {
+func handleChatSessionEventsStream() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
 		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
 		if userID == "" {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-
-		if err := am.InvalidateAllSessionsForUser(userID); err != nil {
-			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session",
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			Secure:   r.TLS != nil,
-		})
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-	}
-}
-
-// handleAuthCheck checks if user is authenticated
-func handleAuthCheck(am *AuthManager) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		token := extractSessionTokenFromRequest(r)
-		if token == "" {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"authenticated": false})
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 			return
 		}
 
-		user, valid := am.ValidateSession(token)
-		if !valid {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"authenticated": false})
-			return
+		afterSeq := 0
+		if raw := strings.TrimSpace(r.URL.Query().Get("after_seq")); raw != "" {
+			if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+				afterSeq = parsed
+			}
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"authenticated": true,
-			"user_id":       user.ID,
-			"role":          user.Role,
-		})
-	}
-}
+		// EventSource reconnects with the id of the last chat_event it saw;
+		// it only applies while the same session is current.
+		resumeSessionID, resumeSeq, resuming := chatharness.ParseSessionEventID(r.Header.Get("Last-Event-ID"))
 
-// handleUsers returns list of users
-func handleUsers(am *AuthManager) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(am.GetUsers())
-	}
-}
-
-// handleAddUser adds a new user
-func handleAddUser(am *AuthManager) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		var req struct {
-			ID       string `json:"id"`
-			Password string `json:"password"`
-			Role     string `json:"role"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-
-		if req.Role == "" {
-			req.Role = "user"
-		}
-
-		if err := am.AddUser(req.ID, req.Password, req.Role); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-	}
-}
-
-// handleDeleteUser removes a user
-func handleDeleteUser(am *AuthManager) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		var req struct {
-			ID string `json:"id"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-
-		if err := am.DeleteUser(req.ID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-	}
-}
-
-func handleCurrentChatSession() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-		if userID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		entry, err := mcp.GetCurrentChatSession(userID)
-		if err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				log.Printf("[handleCurrentChatSession] Failed to load chat session for %s: %v", userID, err)
-			}
-			json.NewEncoder(w).Encode(map[string]interface{}{"has_session": false})
-			return
-		}
-		entry = normalizeStaleRunningSession(entry)
-
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"has_session": true,
-			"item":        entry,
-		})
-	}
-}
-
-func handleChatSessionEvents() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-		if userID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		session, err := mcp.GetCurrentChatSession(userID)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"has_session": false,
-					"items":       []mcp.ChatEventEntry{},
-				})
-				return
-			}
-			http.Error(w, "Failed to load chat session", http.StatusInternalServerError)
-			return
-		}
-		session = normalizeStaleRunningSession(session)
-
-		afterSeq := 0
-		if raw := strings.TrimSpace(r.URL.Query().Get("after_seq")); raw != "" {
-			if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
-				afterSeq = parsed
-			}
-		}
-		limit := 200
-		if raw := strings.TrimSpace(r.URL.Query().Get("limit")); raw != "" {
-			if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
-				limit = parsed
-			}
-		}
-
-		events, err := mcp.ListChatEvents(userID, session.ID, afterSeq, limit)
-		if err != nil {
-			http.Error(w, "Failed to load chat events", http.StatusInternalServerError)
-			return
-		}
-		totalCount, err := mcp.CountChatEvents(userID, session.ID)
-		if err != nil {
-			http.Error(w, "Failed to count chat events", http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"has_session": true,
-			"session":     session,
-			"items":       events,
-			"total_count": totalCount,
-		})
-	}
-}
-
-func handleStopCurrentChat() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-		if userID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		cancelled := cancelCurrentChat(userID)
-		sessionEntry, err := mcp.GetCurrentChatSession(userID)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			log.Printf("[handleStopCurrentChat] Failed to load current session for %s: %v", userID, err)
-		}
-		sessionEntry.UserID = userID
-		sessionEntry.SessionKey = "default"
-		sessionEntry.Status = "cancelled"
-		entry, err := mcp.UpsertChatSession(sessionEntry)
-		if err == nil && entry.ID != 0 {
-			_, _ = mcp.AppendChatEvent(userID, entry.ID, "system", "request.cancelled", "", "", `{"source":"remote_stop"}`)
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":    "ok",
-			"cancelled": cancelled,
-		})
-	}
-}
-
-func handleChatSessionEventsStream() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-		if userID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-			return
-		}
-
-		afterSeq := 0
-		if raw := strings.TrimSpace(r.URL.Query().Get("after_seq")); raw != "" {
-			if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
-				afterSeq = parsed
-			}
-		}
-
-		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		tick := time.NewTicker(350 * time.Millisecond)
 		defer tick.Stop()
@@ -3685,7 +2727,7 @@ func handleChatSessionEventsStream() http.HandlerFunc {
 			if session != nil {
 				payload["session"] = session
 			}
-			return writeSSEEvent(w, "session", payload)
+			return writeSessionSSEEvent(w, "session", afterSeq, payload)
 		}
 
 		sendPendingEvents := func(session mcp.ChatSessionEntry) error {
@@ -3698,7 +2740,12 @@ func handleChatSessionEventsStream() http.HandlerFunc {
 					return nil
 				}
 				for _, entry := range events {
-					if err := writeSSEEvent(w, "chat_event", entry); err != nil {
+					env, err := chatharness.NewEnvelope(entry.EventType, entry)
+					if err != nil {
+						return err
+					}
+					env.Seq, env.TurnID = int64(entry.EventSeq), entry.TurnID
+					if err := chatharness.WriteEnvelope(w, "chat_event", chatharness.FormatSessionEventID(session.ID, entry.EventSeq), env); err != nil {
 						return err
 					}
 					afterSeq = entry.EventSeq
@@ -3715,7 +2762,7 @@ func handleChatSessionEventsStream() http.HandlerFunc {
 			hasSession := err == nil
 			if err != nil && !errors.Is(err, sql.ErrNoRows) {
 				log.Printf("[handleChatSessionEventsStream] Failed to load session for %s: %v", userID, err)
-				if writeErr := writeSSEEvent(w, "error", map[string]string{"message": "failed to load chat session"}); writeErr != nil {
+				if writeErr := writeSessionSSEEvent(w, "error", afterSeq, map[string]string{"message": "failed to load chat session"}); writeErr != nil {
 					return
 				}
 				flusher.Flush()
@@ -3724,6 +2771,10 @@ func handleChatSessionEventsStream() http.HandlerFunc {
 
 			if hasSession {
 				session = normalizeStaleRunningSession(session)
+				if resuming && session.ID == resumeSessionID && resumeSeq > afterSeq {
+					afterSeq = resumeSeq
+				}
+				resuming = false
 			}
 
 			currentSessionID := int64(0)
@@ -3737,3294 +2788,1552 @@ func handleChatSessionEventsStream() http.HandlerFunc {
 				if session.ClearedAt.Valid {
 					currentClearedAt = session.ClearedAt.Time.UTC().Format(time.RFC3339Nano)
 				}
-			}
-
-			sessionChanged := !sentInitialSnapshot ||
-				hasSession != lastHasSession ||
-				currentSessionID != lastSessionID ||
-				currentUpdatedAt != lastSessionUpdatedAt ||
-				currentClearedAt != lastClearedAt ||
-				currentStatus != lastSessionStatus
-
-			if sessionChanged {
-				if lastHasSession && hasSession && (currentSessionID != lastSessionID || currentClearedAt != lastClearedAt) {
-					afterSeq = 0
-				}
-				if hasSession {
-					sessionCopy := session
-					if err := sendSessionSnapshot(&sessionCopy); err != nil {
-						return
-					}
-				} else {
-					if err := sendSessionSnapshot(nil); err != nil {
-						return
-					}
-				}
-				flusher.Flush()
-				sentInitialSnapshot = true
-				lastHasSession = hasSession
-				lastSessionID = currentSessionID
-				lastSessionUpdatedAt = currentUpdatedAt
-				lastClearedAt = currentClearedAt
-				lastSessionStatus = currentStatus
-			}
-
-			if hasSession {
-				if err := sendPendingEvents(session); err != nil {
-					log.Printf("[handleChatSessionEventsStream] Failed to send chat events for %s: %v", userID, err)
-					return
-				}
-			}
-
-			select {
-			case <-r.Context().Done():
-				return
-			case <-heartbeat.C:
-				if err := writeSSEEvent(w, "heartbeat", map[string]int64{"unix_ms": time.Now().UnixMilli()}); err != nil {
-					return
-				}
-				flusher.Flush()
-			case <-tick.C:
-			}
-		}
-	}
-}
-
-func handleClearCurrentChat() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-		if userID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		cancelCurrentChat(userID)
-
-		sessionEntry, err := mcp.GetCurrentChatSession(userID)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			log.Printf("[handleClearCurrentChat] Failed to load current session for %s: %v", userID, err)
-		}
-
-		now := time.Now()
-		sessionEntry.UserID = userID
-		sessionEntry.SessionKey = "default"
-		sessionEntry.Status = "idle"
-		sessionEntry.LastResponseID = ""
-		sessionEntry.SummaryText = ""
-		sessionEntry.TurnCount = 0
-		sessionEntry.EstimatedChars = 0
-		sessionEntry.LastInputTokens = 0
-		sessionEntry.LastOutputTokens = 0
-		sessionEntry.PeakInputTokens = 0
-		sessionEntry.RiskScore = 0
-		sessionEntry.RiskLevel = ""
-		sessionEntry.LastResetReason = "manual_clear_chat"
-		sessionEntry.UIStateJSON = "{}"
-		sessionEntry.ClearedAt = sql.NullTime{Time: now, Valid: true}
-
-		entry, err := mcp.UpsertChatSession(sessionEntry)
-		if err != nil {
-			log.Printf("[handleClearCurrentChat] Failed to upsert current session for %s: %v", userID, err)
-			http.Error(w, "Failed to clear current chat session", http.StatusInternalServerError)
-			return
-		}
-		if err := mcp.ClearChatSessionEvents(userID, entry.ID); err != nil {
-			log.Printf("[handleClearCurrentChat] Failed to clear chat events for %s: %v", userID, err)
-		}
-
-		clearPayload := map[string]interface{}{
-			"source":     "remote_clear",
-			"cleared_at": now.Format(time.RFC3339Nano),
-		}
-		if clearJSON, marshalErr := json.Marshal(clearPayload); marshalErr != nil {
-			log.Printf("[handleClearCurrentChat] Failed to encode clear event for %s: %v", userID, marshalErr)
-		} else if _, err := mcp.AppendChatEvent(userID, entry.ID, "system", "session.cleared", "", "", string(clearJSON)); err != nil {
-			log.Printf("[handleClearCurrentChat] Failed to append clear event for %s: %v", userID, err)
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status": "ok",
-		})
-	}
-}
-
-func handleLastSession() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-		if userID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-
-		switch r.Method {
-		case http.MethodGet:
-			entry, err := mcp.GetCurrentChatSession(userID)
-			if err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					log.Printf("[handleLastSession] Failed to load current chat session for user %s: %v", userID, err)
-				}
-				log.Printf("[handleLastSession] No current chat session for %s", userID)
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"has_session": false,
-				})
-				return
-			}
-
-			snapshot := parseChatSessionUISnapshot(entry.UIStateJSON)
-			log.Printf("[handleLastSession] Resolving last session for %s session_id=%d status=%s updated_at=%s snapshot=%s",
-				userID,
-				entry.ID,
-				strings.TrimSpace(entry.Status),
-				entry.UpdatedAt.Format(time.RFC3339Nano),
-				summarizeLastSessionSnapshot(snapshot),
-			)
-
-			payload, ok := deriveLastSessionFromChatSession(entry)
-			if !ok {
-				log.Printf("[handleLastSession] Snapshot fallback needed for %s session_id=%d", userID, entry.ID)
-				payload, ok = deriveLastSessionFromChatEvents(userID, entry)
-			}
-			if !ok {
-				log.Printf("[handleLastSession] No restorable last session for %s session_id=%d", userID, entry.ID)
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"has_session": false,
-				})
-				return
-			}
-
-			log.Printf("[handleLastSession] Restored last session for %s user_len=%d assistant_len=%d mode=%s",
-				userID,
-				len([]rune(strings.TrimSpace(fmt.Sprintf("%v", payload["user_message"])))),
-				len([]rune(strings.TrimSpace(fmt.Sprintf("%v", payload["assistant_message"])))),
-				strings.TrimSpace(fmt.Sprintf("%v", payload["mode"])),
-			)
-			json.NewEncoder(w).Encode(payload)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}
-}
-
-func buildSavedTurnLLMTitle(ctx context.Context, promptText, responseText string, opts savedTurnTitleOptions) string {
-	request := fmt.Sprintf(`Create a short title for this saved chat turn.
-
-Rules:
-- Use the main language of the saved content.
-- Aim for about 20 characters.
-- Make it specific and readable.
-- Respond as JSON only in this exact shape: {"title":"..."}
-
-Saved user prompt:
-%s
-
-Saved assistant response:
-%s`, cleanSavedTurnTitleContext(promptText, 320), cleanSavedTurnTitleContext(responseText, 1200))
-
-	AddDebugTrace("saved-turn-title", "parse.start", "Starting saved turn title generation", map[string]interface{}{
-		"model":           strings.TrimSpace(opts.ModelID),
-		"temperature":     normalizeSavedTurnTemperature(opts.Temperature),
-		"prompt_chars":    len([]rune(strings.TrimSpace(promptText))),
-		"response_chars":  len([]rune(strings.TrimSpace(responseText))),
-		"request_preview": compactText(request, 220),
-	})
-
-	rawResponse := callLLMInternal(ctx, request, opts)
-	title := parseSavedTurnTitleFromJSON(rawResponse)
-	title = strings.Trim(title, "\"'`")
-	title = strings.Join(strings.Fields(title), " ")
-	if title == "" {
-		AddDebugTrace("saved-turn-title", "parse.failed", "Failed to parse title JSON response", map[string]interface{}{
-			"raw_response": compactText(rawResponse, 220),
-			"__payload":    rawResponse,
-		})
-		return ""
-	}
-	runes := []rune(title)
-	if len(runes) > 24 {
-		title = strings.TrimSpace(string(runes[:24]))
-	}
-	AddDebugTrace("saved-turn-title", "parse.success", "Parsed saved turn title JSON", map[string]interface{}{
-		"title":        title,
-		"title_length": len([]rune(title)),
-	})
-	return title
-}
-
-func handleSavedTurns() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-		if userID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-
-		switch r.Method {
-		case http.MethodGet:
-			queryStr := strings.TrimSpace(r.URL.Query().Get("q"))
-			var (
-				entries []mcp.SavedTurnEntry
-				err     error
-			)
-			if queryStr == "" {
-				entries, err = mcp.ListSavedTurns(userID, 200)
-			} else {
-				entries, err = mcp.SearchSavedTurns(userID, queryStr, 200)
-			}
-			if err != nil {
-				log.Printf("[handleSavedTurns] Failed to load saved turns for %s: %v", userID, err)
-				http.Error(w, "Failed to load saved turns", http.StatusInternalServerError)
-				return
-			}
-			entries = markSavedTurnEntriesProcessing(userID, entries)
-			json.NewEncoder(w).Encode(map[string]interface{}{"items": entries})
-		case http.MethodPost:
-			var req struct {
-				PromptText     string   `json:"prompt_text"`
-				ResponseText   string   `json:"response_text"`
-				ModelID        string   `json:"model_id"`
-				SecondaryModel string   `json:"secondary_model"`
-				APIToken       string   `json:"api_token"`
-				LLMMode        string   `json:"llm_mode"`
-				Temperature    *float64 `json:"temperature"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				log.Printf("[handleSavedTurns] Invalid request JSON for %s: %v", userID, err)
-				http.Error(w, "Invalid request", http.StatusBadRequest)
-				return
-			}
-			req.PromptText = strings.TrimSpace(req.PromptText)
-			req.ResponseText = strings.TrimSpace(req.ResponseText)
-			log.Printf("[handleSavedTurns] Save request for %s prompt_len=%d response_len=%d prompt_preview=%q response_preview=%q",
-				userID,
-				len([]rune(req.PromptText)),
-				len([]rune(req.ResponseText)),
-				compactText(req.PromptText, 80),
-				compactText(req.ResponseText, 120),
-			)
-			if req.PromptText == "" || req.ResponseText == "" {
-				log.Printf("[handleSavedTurns] Rejecting save for %s because prompt/response is empty", userID)
-				http.Error(w, "Valid prompt_text and response_text are required", http.StatusBadRequest)
-				return
-			}
-			entry, err := mcp.SaveSavedTurn(userID, req.PromptText, req.ResponseText)
-			if err != nil {
-				log.Printf("[handleSavedTurns] Failed to save turn for %s: %v", userID, err)
-				http.Error(w, "Failed to save turn", http.StatusInternalServerError)
-				return
-			}
-
-			titleOpts := savedTurnTitleOptions{
-				ModelID:        strings.TrimSpace(req.ModelID),
-				SecondaryModel: strings.TrimSpace(req.SecondaryModel),
-				APIToken:       strings.TrimSpace(req.APIToken),
-				LLMMode:        strings.TrimSpace(req.LLMMode),
-			}
-			if req.Temperature != nil {
-				titleOpts.Temperature = normalizeSavedTurnTemperature(*req.Temperature)
-			}
-
-			started := startSavedTurnTitleTask(userID, entry.ID, func(ctx context.Context) {
-				title := buildSavedTurnLLMTitle(ctx, req.PromptText, req.ResponseText, titleOpts)
-				if errors.Is(ctx.Err(), context.Canceled) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
-					AddDebugTrace("saved-turn-title", "llm.cancelled", "Saved turn title generation stopped before completion", map[string]interface{}{
-						"user_id": userID,
-						"turn_id": entry.ID,
-						"error":   ctx.Err(),
-					})
-					return
-				}
-				if title == "" {
-					AddDebugTrace("saved-turn-title", "db.skipped", "Skipped DB update because no title was generated", map[string]interface{}{
-						"user_id": userID,
-						"turn_id": entry.ID,
-					})
-					recordSavedTurnAutoTitleFailure(userID, entry.ID, "empty_title", nil)
-					return
-				}
-				if latestEntry, err := mcp.GetSavedTurn(userID, entry.ID); err == nil && strings.TrimSpace(latestEntry.TitleSource) != "fallback" {
-					AddDebugTrace("saved-turn-title", "db.skipped", "Skipped DB update because title source changed while generating", map[string]interface{}{
-						"user_id":      userID,
-						"turn_id":      entry.ID,
-						"title_source": latestEntry.TitleSource,
-					})
-					return
-				}
-				if err := mcp.UpdateSavedTurnTitle(userID, entry.ID, title, "generated"); err != nil {
-					log.Printf("[handleSavedTurns] Failed to generate async title for %s turn %d: %v", userID, entry.ID, err)
-					AddDebugTrace("saved-turn-title", "db.error", "Failed to update saved turn title in DB", map[string]interface{}{
-						"user_id": userID,
-						"turn_id": entry.ID,
-						"title":   title,
-						"error":   err,
-					})
-					recordSavedTurnAutoTitleFailure(userID, entry.ID, "db_update_failed", map[string]interface{}{
-						"title": title,
-						"error": err,
-					})
-					return
-				}
-				AddDebugTrace("saved-turn-title", "db.updated", "Updated saved turn title in DB", map[string]interface{}{
-					"user_id":      userID,
-					"turn_id":      entry.ID,
-					"title":        title,
-					"title_source": "generated",
-				})
-			})
-
-			if started {
-				entry.Processing = true
-				AddDebugTrace("saved-turn-title", "llm.started", "Started saved turn title generation task", map[string]interface{}{
-					"user_id": userID,
-					"turn_id": entry.ID,
-				})
-			}
-
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"status":     "ok",
-				"processing": entry.Processing,
-				"item":       entry,
-			})
-		case http.MethodPatch:
-			var req struct {
-				ID    int64  `json:"id"`
-				Title string `json:"title"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				http.Error(w, "Invalid request", http.StatusBadRequest)
-				return
-			}
-			req.Title = strings.TrimSpace(req.Title)
-			if req.ID <= 0 || req.Title == "" {
-				http.Error(w, "Valid id and title are required", http.StatusBadRequest)
-				return
-			}
-			cancelSavedTurnTitleTask(userID, req.ID)
-			if err := mcp.UpdateSavedTurnTitle(userID, req.ID, req.Title, "manual"); err != nil {
-				log.Printf("[handleSavedTurns] Failed to update manual title for %s turn %d: %v", userID, req.ID, err)
-				http.Error(w, "Failed to update title", http.StatusInternalServerError)
-				return
-			}
-			entry, err := mcp.GetSavedTurn(userID, req.ID)
-			if err != nil {
-				log.Printf("[handleSavedTurns] Failed to load updated turn %d for %s: %v", req.ID, userID, err)
-				http.Error(w, "Failed to load updated turn", http.StatusInternalServerError)
-				return
-			}
-			AddDebugTrace("saved-turn-title", "db.updated", "Updated saved turn title manually", map[string]interface{}{
-				"user_id":      userID,
-				"turn_id":      req.ID,
-				"title":        req.Title,
-				"title_source": "manual",
-			})
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"status": "ok",
-				"item":   entry,
-			})
-		case http.MethodDelete:
-			idStr := strings.TrimSpace(r.URL.Query().Get("id"))
-			turnID, err := strconv.ParseInt(idStr, 10, 64)
-			if err != nil || turnID <= 0 {
-				http.Error(w, "Valid id is required", http.StatusBadRequest)
-				return
-			}
-			if err := mcp.DeleteSavedTurn(userID, turnID); err != nil {
-				log.Printf("[handleSavedTurns] Failed to delete turn %d for %s: %v", turnID, userID, err)
-				http.Error(w, "Failed to delete turn", http.StatusInternalServerError)
-				return
-			}
-			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}
-}
-
-func handleSavedTurnTitleRefresh() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-		if userID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		titleOpts, err := parseSavedTurnTitleOptionsFromBody(r)
-		if err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-
-		idStr := strings.TrimSpace(r.URL.Query().Get("id"))
-		var entry mcp.SavedTurnEntry
-		if idStr != "" {
-			turnID, parseErr := strconv.ParseInt(idStr, 10, 64)
-			if parseErr != nil || turnID <= 0 {
-				http.Error(w, "Valid id is required", http.StatusBadRequest)
-				return
-			}
-			entry, err = mcp.GetSavedTurn(userID, turnID)
-			if err != nil {
-				log.Printf("[handleSavedTurnTitleRefresh] Failed to load turn %d for %s: %v", turnID, userID, err)
-				http.Error(w, "Failed to load saved turn", http.StatusInternalServerError)
-				return
-			}
-			if strings.TrimSpace(entry.TitleSource) != "fallback" {
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"status":  "noop",
-					"updated": false,
-					"item":    entry,
-				})
-				return
-			}
-			if isSavedTurnTitleProcessing(userID, entry.ID) {
-				entry.Processing = true
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"status":     "processing",
-					"updated":    false,
-					"processing": true,
-					"item":       entry,
-				})
-				return
-			}
-		} else {
-			entry, err = mcp.GetNextSavedTurnPendingTitle(userID)
-			if err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					json.NewEncoder(w).Encode(map[string]interface{}{
-						"status":  "idle",
-						"updated": false,
-					})
-					return
-				}
-				log.Printf("[handleSavedTurnTitleRefresh] Failed to load pending title for %s: %v", userID, err)
-				http.Error(w, "Failed to load pending title", http.StatusInternalServerError)
-				return
-			}
-			if isSavedTurnTitleProcessing(userID, entry.ID) {
-				entry.Processing = true
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"status":     "processing",
-					"updated":    false,
-					"processing": true,
-					"item":       entry,
-				})
-				return
-			}
-		}
-
-		started := startSavedTurnTitleTask(userID, entry.ID, func(ctx context.Context) {
-			title := buildSavedTurnLLMTitle(ctx, entry.PromptText, entry.ResponseText, titleOpts)
-			if errors.Is(ctx.Err(), context.Canceled) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
-				AddDebugTrace("saved-turn-title", "llm.cancelled", "Manual title refresh task stopped before completion", map[string]interface{}{
-					"user_id": userID,
-					"turn_id": entry.ID,
-					"error":   ctx.Err(),
-				})
-				return
-			}
-			if title == "" {
-				AddDebugTrace("saved-turn-title", "db.skipped", "Manual title refresh produced no title", map[string]interface{}{
-					"user_id": userID,
-					"turn_id": entry.ID,
-				})
-				if idStr == "" {
-					recordSavedTurnAutoTitleFailure(userID, entry.ID, "empty_title", nil)
-				}
-				return
-			}
-			if latestEntry, err := mcp.GetSavedTurn(userID, entry.ID); err == nil && strings.TrimSpace(latestEntry.TitleSource) != "fallback" {
-				AddDebugTrace("saved-turn-title", "db.skipped", "Skipped manual refresh DB update because title source changed", map[string]interface{}{
-					"user_id":      userID,
-					"turn_id":      entry.ID,
-					"title_source": latestEntry.TitleSource,
-				})
-				return
-			}
-			if err := mcp.UpdateSavedTurnTitle(userID, entry.ID, title, "generated"); err != nil {
-				log.Printf("[handleSavedTurnTitleRefresh] Failed to update title for %s turn %d: %v", userID, entry.ID, err)
-				AddDebugTrace("saved-turn-title", "db.error", "Failed to update title during manual refresh", map[string]interface{}{
-					"user_id": userID,
-					"turn_id": entry.ID,
-					"title":   title,
-					"error":   err,
-				})
-				if idStr == "" {
-					recordSavedTurnAutoTitleFailure(userID, entry.ID, "db_update_failed", map[string]interface{}{
-						"title": title,
-						"error": err,
-					})
-				}
-				return
-			}
-			AddDebugTrace("saved-turn-title", "db.updated", "Updated saved turn title during manual refresh", map[string]interface{}{
-				"user_id":      userID,
-				"turn_id":      entry.ID,
-				"title":        title,
-				"title_source": "generated",
-			})
-		})
-
-		if started {
-			entry.Processing = true
-		}
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":     savedTurnQueuedStatus(started),
-			"updated":    false,
-			"processing": started,
-			"item":       entry,
-		})
-	}
-}
-
-func resolveModelAPIConfig(r *http.Request, app *App, authMgr *AuthManager, requestedMode string) (string, string, string) {
-	app.serverMux.Lock()
-	endpoint := app.llmEndpoint
-	token := app.llmApiToken
-	mode := app.llmMode
-	app.serverMux.Unlock()
-
-	userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
-	if userID != "" && authMgr != nil {
-		authMgr.mu.RLock()
-		user := authMgr.users[userID]
-		authMgr.mu.RUnlock()
-		if user != nil {
-			if user.Settings.ApiToken != nil {
-				token = *user.Settings.ApiToken
-			}
-			if user.Settings.LLMMode != nil && strings.TrimSpace(*user.Settings.LLMMode) != "" {
-				mode = *user.Settings.LLMMode
-			}
-		}
-	}
-
-	if strings.TrimSpace(requestedMode) != "" {
-		mode = requestedMode
-	}
-
-	return normalizeLLMEndpoint(endpoint), sanitizeLLMToken(token), normalizeLLMMode(mode)
-}
-
-// handleModels proxies model list requests to LLM server
-func handleModels(w http.ResponseWriter, r *http.Request, app *App, authMgr *AuthManager) {
-	// Add CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	if r.Method == http.MethodPost {
-		// Handle Model Load Request
-		var req struct {
-			Model string `json:"model"`
-			Mode  string `json:"mode"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-
-		if req.Model == "" {
-			http.Error(w, "Model ID required", http.StatusBadRequest)
-			return
-		}
-
-		endpoint, token, mode := resolveModelAPIConfig(r, app, authMgr, req.Mode)
-		if err := app.LoadModelWithConfig(req.Model, endpoint, token, mode); err != nil {
-			log.Printf("[handleModels] Load failed: %v", err)
-			http.Error(w, fmt.Sprintf("Failed to load model: %v", err), http.StatusBadGateway)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "Model loaded"})
-		return
-	}
-
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Try to fetch fresh models
-	endpoint, token, mode := resolveModelAPIConfig(r, app, authMgr, r.URL.Query().Get("mode"))
-	bodyBytes, err := app.FetchAndCacheModelsWithConfig(endpoint, token, mode)
-	if err != nil {
-		log.Printf("[handleModels] Fetch failed: %v", err)
-
-		// Fallback to cache if available
-		cached := app.GetCachedModels()
-		if cached != nil {
-			log.Printf("[handleModels] Returning cached models (fallback)")
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("X-Model-Source", "cache-fallback")
-			w.Write(cached)
-			return
-		}
-
-		// No cache and fetch failed
-		http.Error(w, fmt.Sprintf("Failed to fetch models: %v", err), http.StatusBadGateway)
-		return
-	}
-
-	// Success
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Model-Source", "live")
-	w.Write(bodyBytes)
-}
-
-func handleModelUnload(w http.ResponseWriter, r *http.Request, app *App, authMgr *AuthManager) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req struct {
-		InstanceID string `json:"instance_id"`
-		Mode       string `json:"mode"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	if strings.TrimSpace(req.InstanceID) == "" {
-		http.Error(w, "instance_id required", http.StatusBadRequest)
-		return
-	}
-
-	endpoint, token, mode := resolveModelAPIConfig(r, app, authMgr, req.Mode)
-	if err := app.UnloadModelWithConfig(req.InstanceID, endpoint, token, mode); err != nil {
-		log.Printf("[handleModelUnload] Unload failed: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to unload model: %v", err), http.StatusBadGateway)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "Model unloaded"})
-}
-
-// handleChat proxies chat requests to LM Studio with SSE streaming
-// handleChat proxies chat requests to LM Studio with SSE streaming
-func handleChat(w http.ResponseWriter, r *http.Request, app *App, authMgr *AuthManager) {
-	requestStart := time.Now()
-	requestElapsedMs := func() int64 {
-		return time.Since(requestStart).Milliseconds()
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	var llmURL string
-
-	// Default configuration (Global)
-	endpointRaw := app.llmEndpoint
-	tokenRaw := app.llmApiToken
-	llmMode := app.llmMode
-	contextStrategy := defaultContextStrategyForMode(llmMode)
-	enableTools := app.enableTools
-	enableMemory := false // Default to false (Secure by default for unauthenticated)
-
-	var disabledTools []string
-	var locationInfo string
-	var disallowedCmds []string
-	var disallowedDirs []string
-	serverStatefulTurnLimitValue := 8
-	serverStatefulCharBudgetValue := 32000
-	serverStatefulTokenBudgetValue := 30000
-
-	// Override with User Settings
-	userID := r.Header.Get("X-User-ID")
-	// Extract Client Location
-	locationInfo = r.Header.Get("X-User-Location")
-	clientTurnID := strings.TrimSpace(r.Header.Get("X-Client-Turn-Id"))
-	requestContextStrategy := strings.TrimSpace(r.Header.Get("X-Context-Strategy"))
-	statefulTurnCount := strings.TrimSpace(r.Header.Get("X-Stateful-Turn-Count"))
-	statefulEstChars := strings.TrimSpace(r.Header.Get("X-Stateful-Est-Chars"))
-	statefulSummaryChars := strings.TrimSpace(r.Header.Get("X-Stateful-Summary-Chars"))
-	statefulResetCount := strings.TrimSpace(r.Header.Get("X-Stateful-Reset-Count"))
-	statefulInputTokens := strings.TrimSpace(r.Header.Get("X-Stateful-Input-Tokens"))
-	statefulPeakInputTokens := strings.TrimSpace(r.Header.Get("X-Stateful-Peak-Input-Tokens"))
-	statefulTokenBudget := strings.TrimSpace(r.Header.Get("X-Stateful-Token-Budget"))
-	statefulRiskScore := strings.TrimSpace(r.Header.Get("X-Stateful-Risk-Score"))
-	statefulRiskLevel := strings.TrimSpace(r.Header.Get("X-Stateful-Risk-Level"))
-	statefulResetReason := strings.TrimSpace(r.Header.Get("X-Stateful-Reset-Reason"))
-
-	chatCtx, chatCancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer chatCancel()
-	if strings.TrimSpace(userID) != "" {
-		registerCurrentChatCancel(userID, chatCancel)
-		defer unregisterCurrentChatCancel(userID)
-	}
-
-	clientStreaming := true
-	var emitStreamChunk func(string)
-
-	if userID != "" {
-		authMgr.mu.RLock()
-		user := authMgr.users[userID]
-		authMgr.mu.RUnlock()
-		if user != nil {
-			if user.Settings.ApiToken != nil {
-				tokenRaw = *user.Settings.ApiToken
-			}
-			if user.Settings.LLMMode != nil {
-				llmMode = *user.Settings.LLMMode
-			}
-			contextStrategy = defaultContextStrategyForMode(llmMode)
-			if user.Settings.ContextStrategy != nil {
-				contextStrategy = normalizeContextStrategyForMode(llmMode, *user.Settings.ContextStrategy)
-			}
-			if user.Settings.EnableTools != nil {
-				enableTools = *user.Settings.EnableTools
-			}
-			if user.Settings.EnableMemory != nil {
-				enableMemory = *user.Settings.EnableMemory
-			} else {
-				enableMemory = true // Default to true for authenticated users
-			}
-			if user.Settings.DisabledTools != nil {
-				disabledTools = expandDisabledToolAliases(user.Settings.DisabledTools)
-			}
-			if user.Settings.DisallowedCommands != nil {
-				disallowedCmds = user.Settings.DisallowedCommands
-			}
-			if user.Settings.DisallowedDirectories != nil {
-				disallowedDirs = user.Settings.DisallowedDirectories
-			}
-			if user.Settings.StatefulTurnLimit != nil && *user.Settings.StatefulTurnLimit > 0 {
-				serverStatefulTurnLimitValue = *user.Settings.StatefulTurnLimit
-			}
-			if user.Settings.StatefulCharBudget != nil && *user.Settings.StatefulCharBudget > 0 {
-				serverStatefulCharBudgetValue = *user.Settings.StatefulCharBudget
-			}
-			if user.Settings.StatefulTokenBudget != nil && *user.Settings.StatefulTokenBudget > 0 {
-				serverStatefulTokenBudgetValue = *user.Settings.StatefulTokenBudget
-			}
-		}
-	}
-	if requestContextStrategy != "" {
-		contextStrategy = normalizeContextStrategyForMode(llmMode, requestContextStrategy)
-	}
-	toolExecCtx := toolruntime.ExecutionContext{
-		RequestID:             clientTurnID,
-		UserID:                userID,
-		EnableMemory:          enableMemory,
-		LocationInfo:          locationInfo,
-		DisabledTools:         disabledTools,
-		DisallowedCommands:    disallowedCmds,
-		DisallowedDirectories: disallowedDirs,
-	}
-	var promptTools []promptkit.ToolDefinition
-	if enableTools {
-		for _, definition := range toolruntime.Default.List(toolExecCtx) {
-			promptTools = append(promptTools, promptkit.ToolDefinition{
-				Name:        definition.Name,
-				Description: definition.Description,
-				InputSchema: definition.InputSchema,
-			})
-		}
-	}
-	log.Printf("[handleChat-DEBUG] userID=%s, enableMemory=%v, disabledTools=%v, Location=%s, DisallowedCmds=%v, DisallowedDirs=%v", userID, enableMemory, disabledTools, locationInfo, disallowedCmds, disallowedDirs)
-	AddDebugTrace("chat", "request.context", "Resolved chat execution context", map[string]interface{}{
-		"user":                userID,
-		"memory":              enableMemory,
-		"disabled_tools":      len(disabledTools),
-		"disallowed_cmds":     len(disallowedCmds),
-		"disallowed_dirs":     len(disallowedDirs),
-		"location":            compactText(locationInfo, 80),
-		"context_strategy":    contextStrategy,
-		"stateful_turns":      statefulTurnCount,
-		"stateful_chars":      statefulEstChars,
-		"summary_chars":       statefulSummaryChars,
-		"input_tokens":        statefulInputTokens,
-		"peak_tokens":         statefulPeakInputTokens,
-		"token_budget":        statefulTokenBudget,
-		"risk_score":          statefulRiskScore,
-		"risk_level":          statefulRiskLevel,
-		"server_turn_limit":   serverStatefulTurnLimitValue,
-		"server_char_budget":  serverStatefulCharBudgetValue,
-		"server_token_budget": serverStatefulTokenBudgetValue,
-	})
-	if statefulResetReason != "" {
-		AddDebugTrace("stateful", "reset", "Stateful conversation was compacted or reset", map[string]interface{}{
-			"user":         userID,
-			"reason":       statefulResetReason,
-			"turns_before": statefulTurnCount,
-			"chars_before": statefulEstChars,
-			"reset_count":  statefulResetCount,
-		})
-	}
-
-	var reqMap map[string]interface{}
-	// Always unmarshal body into reqMap to prevent nil panics later in the turn loop
-	json.Unmarshal(body, &reqMap)
-	initialUserInputText := extractChatInputText(reqMap)
-	incomingPreviousResponseID := extractStringValue(reqMap, []string{"previous_response_id"})
-	if llmMode == "stateful" && incomingPreviousResponseID != "" && !chatharness.IsValidResponseID(incomingPreviousResponseID) {
-		delete(reqMap, "previous_response_id")
-		body, _ = json.Marshal(reqMap)
-		incomingPreviousResponseID = ""
-	} else if llmMode == "stateful" && chatharness.IsValidResponseID(incomingPreviousResponseID) {
-		incomingPreviousResponseID = strings.TrimSpace(incomingPreviousResponseID)
-		reqMap["previous_response_id"] = incomingPreviousResponseID
-		body, _ = json.Marshal(reqMap)
-	}
-	hasPreviousResponseID := llmMode == "stateful" && chatharness.IsValidResponseID(incomingPreviousResponseID)
-	if !hasPreviousResponseID && llmMode == "stateful" && strings.TrimSpace(userID) != "" {
-		if existingSession, err := mcp.GetCurrentChatSession(userID); err == nil && chatharness.IsValidResponseID(existingSession.LastResponseID) {
-			hasPreviousResponseID = true
-		}
-	}
-	AddDebugTrace("chat", "request.received", "Incoming chat request", map[string]interface{}{
-		"user":       userID,
-		"body_bytes": len(body),
-		"messages":   lenInterfaceSlice(reqMap["messages"]),
-		"__payload":  prettyJSONForDebug(body),
-	})
-
-	memorySnapshot := ""
-	autoContext := ""
-	recentContext := ""
-	recentContextTurns := 0
-	recentContextSource := ""
-	memorySnapshotDebug := mcp.MemorySnapshotDebug{}
-	autoContextDebug := mcp.AutoSearchMemoryDebug{}
-	if enableMemory && contextStrategy == "retrieval" {
-		recentContext, recentContextTurns, recentContextSource = getRecentConversationContext(userID)
-		if hasPreviousResponseID {
-			recentContext = compactRecentTurnContent(recentContext, recentContextStatefulBudget)
-			recentContextSource += "+stateful_compact"
-		} else {
-			preferRecentContext := strings.TrimSpace(recentContext) != "" && chatharness.IsLikelyContextualFollowup(initialUserInputText)
-			if !preferRecentContext {
-				memorySnapshotDebug = mcp.GetMemorySnapshotDebug(userID)
-				memorySnapshot = memorySnapshotDebug.Text
-			}
-			if !preferRecentContext {
-				if messages, ok := reqMap["messages"].([]interface{}); ok && len(messages) > 0 {
-					for i := len(messages) - 1; i >= 0; i-- {
-						if m, ok := messages[i].(map[string]interface{}); ok {
-							if role, ok := m["role"].(string); ok && role == "user" {
-								if content, ok := m["content"].(string); ok {
-									autoContextDebug = mcp.AutoSearchMemoryDebugQuery(userID, content)
-									autoContext = compactText(autoContextDebug.Context, 1200)
-									break
-								}
-							}
-						}
-					}
-				}
-			} else {
-				recentContextSource += "+followup_priority"
-				AddDebugTrace("chat", "context.followup_priority", "Suppressed broad memory retrieval for a contextual follow-up", map[string]interface{}{
-					"user_input":           compactText(initialUserInputText, 180),
-					"recent_context_turns": recentContextTurns,
-				})
-			}
-		}
-	}
-
-	// Load structured user profile facts (always, not dependent on context strategy)
-	userProfileFacts := ""
-	if enableMemory && strings.TrimSpace(userID) != "" {
-		userProfileFacts = mcp.FormatUserProfileForPrompt(userID)
-		if strings.TrimSpace(userProfileFacts) != "" {
-			log.Printf("[handleChat] Loaded %d chars of user profile facts for %s", len(userProfileFacts), userID)
-		}
-	}
-	if contextStrategy == "retrieval" {
-		AddDebugTrace("chat", "context.retrieval", "Collected retrieval context for prompt injection", map[string]interface{}{
-			"user":                     userID,
-			"mode":                     llmMode,
-			"memory_enabled":           enableMemory,
-			"tools_enabled":            enableTools,
-			"recent_context_chars":     len([]rune(strings.TrimSpace(recentContext))),
-			"recent_context_empty":     strings.TrimSpace(recentContext) == "",
-			"recent_context_preview":   compactText(recentContext, 420),
-			"recent_context_turns":     recentContextTurns,
-			"recent_context_source":    recentContextSource,
-			"memory_snapshot_chars":    len([]rune(strings.TrimSpace(memorySnapshot))),
-			"active_context_chars":     len([]rune(strings.TrimSpace(autoContext))),
-			"memory_snapshot_empty":    strings.TrimSpace(memorySnapshot) == "",
-			"active_context_empty":     strings.TrimSpace(autoContext) == "",
-			"memory_snapshot_preview":  compactText(memorySnapshot, 320),
-			"active_context_preview":   compactText(autoContext, 320),
-			"recent_memories_count":    memorySnapshotDebug.MemoryCount,
-			"recent_saved_turns_count": memorySnapshotDebug.SavedTurnCount,
-			"retrieved_memories_count": autoContextDebug.RetrievedMemoriesCount,
-			"saved_turn_hits":          autoContextDebug.SavedTurnHits,
-			"chunk_match_count":        autoContextDebug.ChunkMatchCount,
-			"used_synthesis":           autoContextDebug.UsedSynthesis,
-			"__payload": map[string]interface{}{
-				"kind":                  "retrieval_context",
-				"context_strategy":      contextStrategy,
-				"recent_context":        recentContext,
-				"memory_snapshot":       memorySnapshot,
-				"memory_snapshot_full":  memorySnapshotDebug.RawText,
-				"active_context":        autoContext,
-				"active_context_full":   autoContextDebug.RawContext,
-				"memory_snapshot_debug": memorySnapshotDebug,
-				"active_context_debug":  autoContextDebug,
-				"recent_context_turns":  recentContextTurns,
-				"recent_context_source": recentContextSource,
-			},
-		})
-	}
-
-	skillCompilation := compileActiveSkills(initialUserInputText)
-	selectedSkillNames := make([]string, 0, len(skillCompilation.Selected))
-	selectedSkillEvents := make([]map[string]string, 0, len(skillCompilation.Selected))
-	for _, skill := range skillCompilation.Selected {
-		selectedSkillNames = append(selectedSkillNames, skill.Namespace)
-		selectedSkillEvents = append(selectedSkillEvents, map[string]string{
-			"namespace":    skill.Namespace,
-			"name":         skill.Name,
-			"display_name": skill.DisplayName,
-		})
-	}
-	AddDebugTrace("chat", "skills.selected", "Selected request-relevant skills", map[string]interface{}{
-		"discovered":        skillCompilation.Discovered,
-		"selected":          selectedSkillNames,
-		"selected_count":    len(selectedSkillNames),
-		"diagnostic_count":  len(skillCompilation.Diagnostics),
-		"instruction_chars": len([]rune(skillCompilation.Prompt)),
-	})
-
-	preparedRequest, err := chatharness.PrepareRequest(chatharness.RequestInput{
-		Body:              body,
-		EndpointRaw:       endpointRaw,
-		TokenRaw:          tokenRaw,
-		LLMMode:           llmMode,
-		ContextStrategy:   contextStrategy,
-		EnableTools:       enableTools,
-		EnableMemory:      enableMemory,
-		RecentContext:     recentContext,
-		MemorySnapshot:    memorySnapshot,
-		ActiveContext:     autoContext,
-		RetrievalInjected: strings.TrimSpace(recentContext) != "" || strings.TrimSpace(memorySnapshot) != "" || strings.TrimSpace(autoContext) != "",
-		UserProfileFacts:  userProfileFacts,
-		SkillInstructions: skillCompilation.Prompt,
-		Tools:             promptTools,
-	})
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to prepare chat request: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	if preparedRequest.IsStatefulFollowup {
-		log.Println("[handleChat] Detected follow-up stateful turn, skipping redundant system prompt (maintaining tools)")
-	}
-	if preparedRequest.InjectedPrompt {
-		log.Println("[handleChat] Injected or deduplicated System Prompt instructions")
-	}
-	if !enableTools {
-		log.Printf("[handleChat] App tools disabled (Mode=%s, ContextStrategy=%s)", llmMode, contextStrategy)
-	}
-
-	body = preparedRequest.Body
-	reqMap = preparedRequest.ReqMap
-	providerTools, _ := reqMap["tools"].([]interface{})
-	initialUserInputText = preparedRequest.InitialUserInputText
-	endpoint := preparedRequest.Endpoint
-	token := preparedRequest.Token
-	llmURL = preparedRequest.UpstreamURL
-	modelID := preparedRequest.ModelID
-	log.Printf("[handleChat] User: %s, Mode: %s, Endpoint: %s, URL: %s", userID, llmMode, endpoint, llmURL)
-	AddDebugTrace("chat", "request.prepared", "Prepared upstream LLM request", map[string]interface{}{
-		"user":                     userID,
-		"mode":                     llmMode,
-		"context_strategy":         contextStrategy,
-		"model":                    modelID,
-		"url":                      llmURL,
-		"body_bytes":               len(body),
-		"injected_prompt":          preparedRequest.InjectedPrompt,
-		"selected_skills":          selectedSkillNames,
-		"stateful_followup":        preparedRequest.IsStatefulFollowup,
-		"memory_snapshot_chars":    len([]rune(strings.TrimSpace(memorySnapshot))),
-		"active_context_chars":     len([]rune(strings.TrimSpace(autoContext))),
-		"memory_snapshot_preview":  compactText(memorySnapshot, 220),
-		"active_context_preview":   compactText(autoContext, 220),
-		"retrieved_memories_count": autoContextDebug.RetrievedMemoriesCount,
-		"saved_turn_hits":          autoContextDebug.SavedTurnHits,
-		"chunk_match_count":        autoContextDebug.ChunkMatchCount,
-		"__payload": map[string]interface{}{
-			"kind":                 "prepared_request_context",
-			"context_strategy":     contextStrategy,
-			"recent_context":       recentContext,
-			"memory_snapshot":      memorySnapshot,
-			"memory_snapshot_full": memorySnapshotDebug.RawText,
-			"active_context":       autoContext,
-			"active_context_full":  autoContextDebug.RawContext,
-		},
-		"stateful_turns": statefulTurnCount,
-		"stateful_chars": statefulEstChars,
-		"input_tokens":   statefulInputTokens,
-		"peak_tokens":    statefulPeakInputTokens,
-		"token_budget":   statefulTokenBudget,
-		"risk_score":     statefulRiskScore,
-		"risk_level":     statefulRiskLevel,
-	})
-
-	parseIntHeader := func(value string) int {
-		parsed, _ := strconv.Atoi(strings.TrimSpace(value))
-		return parsed
-	}
-
-	statefulTurnCountValue := 0
-	statefulEstimatedCharsValue := 0
-	statefulSummaryCharsValue := 0
-	statefulResetCountValue := 0
-	statefulLastInputTokensValue := 0
-	statefulPeakInputTokensValue := 0
-	statefulTokenBudgetValue := serverStatefulTokenBudgetValue
-	statefulRiskScoreValue := 0.0
-	statefulRiskLevelValue := "low"
-	statefulLastOutputTokensValue := 0
-	statefulSummaryText := ""
+			}
 
-	if strings.TrimSpace(statefulResetReason) != "" {
-		statefulResetCountValue = parseIntHeader(statefulResetCount)
-	}
+			sessionChanged := !sentInitialSnapshot ||
+				hasSession != lastHasSession ||
+				currentSessionID != lastSessionID ||
+				currentUpdatedAt != lastSessionUpdatedAt ||
+				currentClearedAt != lastClearedAt ||
+				currentStatus != lastSessionStatus
 
-	var (
-		chatSession           mcp.ChatSessionEntry
-		chatSessionOK         bool
-		sessionStatus         = "failed"
-		sessionLastResponseID string
-		sessionUIStateJSON    = "{}"
-		sessionUISnapshot     = chatharness.SessionUISnapshot{ToolCards: map[string]chatharness.SessionToolCardSnapshot{}, Messages: []chatharness.SessionMessageSnapshot{}}
-	)
-	if strings.TrimSpace(userID) != "" {
-		if existingSession, existingErr := mcp.GetCurrentChatSession(userID); existingErr == nil {
-			sessionUIStateJSON = existingSession.UIStateJSON
-			sessionUISnapshot = chatharness.ParseUISnapshot(existingSession.UIStateJSON)
-			statefulSummaryText = existingSession.SummaryText
-			if llmMode == "stateful" && statefulResetReason == "" {
-				statefulTurnCountValue = existingSession.TurnCount
-				statefulEstimatedCharsValue = existingSession.EstimatedChars
-				statefulLastInputTokensValue = existingSession.LastInputTokens
-				statefulLastOutputTokensValue = existingSession.LastOutputTokens
-				statefulPeakInputTokensValue = existingSession.PeakInputTokens
-				statefulTokenBudgetValue = serverStatefulTokenBudgetValue
-				if chatharness.IsValidResponseID(existingSession.LastResponseID) {
-					sessionLastResponseID = strings.TrimSpace(existingSession.LastResponseID)
-					if reqMap != nil {
-						reqMap["previous_response_id"] = sessionLastResponseID
-					}
+			if sessionChanged {
+				if lastHasSession && hasSession && (currentSessionID != lastSessionID || currentClearedAt != lastClearedAt) {
+					afterSeq = 0
 				}
-			}
-		}
-		if llmMode == "stateful" && statefulResetReason != "" && reqMap != nil {
-			delete(reqMap, "previous_response_id")
-			sessionLastResponseID = ""
-		}
-		if llmMode == "stateful" && statefulResetReason == "" {
-			projectedChars := statefulEstimatedCharsValue + len([]rune(strings.TrimSpace(initialUserInputText)))
-			projectedTokens := statefulLastInputTokensValue + estimateStatefulTokens(initialUserInputText)
-			shouldCompact := statefulTurnCountValue >= serverStatefulTurnLimitValue ||
-				projectedChars >= serverStatefulCharBudgetValue ||
-				projectedTokens >= serverStatefulTokenBudgetValue ||
-				statefulLastInputTokensValue >= serverStatefulTokenBudgetValue
-			if shouldCompact {
-				statefulSummaryText = summarizeChatSessionForReset(statefulSummaryText, chatSessionUISnapshot{
-					ToolCards:    map[string]chatSessionToolCardSnapshot{},
-					Messages:     nil,
-					LastEventSeq: sessionUISnapshot.LastEventSeq,
-				})
-				if len(sessionUISnapshot.Messages) > 0 {
-					converted := make([]chatSessionMessageSnapshot, 0, len(sessionUISnapshot.Messages))
-					for _, msg := range sessionUISnapshot.Messages {
-						converted = append(converted, chatSessionMessageSnapshot{
-							TurnID:                  msg.TurnID,
-							UserContent:             msg.UserContent,
-							AssistantContent:        msg.AssistantContent,
-							ReasoningContent:        msg.ReasoningContent,
-							ReasoningDurationMS:     msg.ReasoningDurationMS,
-							ReasoningAccumulatedMS:  msg.ReasoningAccumulatedMS,
-							ReasoningCurrentPhaseMS: msg.ReasoningCurrentPhaseMS,
-						})
+				if hasSession {
+					sessionCopy := session
+					if err := sendSessionSnapshot(&sessionCopy); err != nil {
+						return
+					}
+				} else {
+					if err := sendSessionSnapshot(nil); err != nil {
+						return
 					}
-					statefulSummaryText = summarizeChatSessionForReset(statefulSummaryText, chatSessionUISnapshot{
-						ToolCards:    map[string]chatSessionToolCardSnapshot{},
-						Messages:     converted,
-						LastEventSeq: sessionUISnapshot.LastEventSeq,
-					})
 				}
-				statefulResetReason = "auto_summary_reset"
-				statefulResetCountValue += 1
-				sessionLastResponseID = ""
-				statefulTurnCountValue = 0
-				statefulEstimatedCharsValue = len([]rune(statefulSummaryText))
-				statefulLastInputTokensValue = estimateStatefulTokens(statefulSummaryText)
-				statefulLastOutputTokensValue = 0
-				if statefulPeakInputTokensValue < statefulLastInputTokensValue {
-					statefulPeakInputTokensValue = statefulLastInputTokensValue
+				flusher.Flush()
+				sentInitialSnapshot = true
+				lastHasSession = hasSession
+				lastSessionID = currentSessionID
+				lastSessionUpdatedAt = currentUpdatedAt
+				lastClearedAt = currentClearedAt
+				lastSessionStatus = currentStatus
+			}
+
+			if hasSession {
+				if err := sendPendingEvents(session); err != nil {
+					log.Printf("[handleChatSessionEventsStream] Failed to send chat events for %s: %v", userID, err)
+					return
 				}
-				if reqMap != nil {
-					delete(reqMap, "previous_response_id")
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				if err := writeSessionSSEEvent(w, "heartbeat", afterSeq, map[string]int64{"unix_ms": time.Now().UnixMilli()}); err != nil {
+					return
 				}
-				AddDebugTrace("stateful", "reset", "Server-side automatic stateful compact triggered", map[string]interface{}{
-					"user":             userID,
-					"reason":           statefulResetReason,
-					"turn_count":       statefulTurnCountValue,
-					"projected_chars":  projectedChars,
-					"projected_tokens": projectedTokens,
-					"turn_limit":       serverStatefulTurnLimitValue,
-					"char_budget":      serverStatefulCharBudgetValue,
-					"token_budget":     serverStatefulTokenBudgetValue,
-				})
+				flusher.Flush()
+			case <-tick.C:
 			}
 		}
-		statefulSummaryCharsValue = len([]rune(statefulSummaryText))
-		statefulTokenBudgetValue = serverStatefulTokenBudgetValue
-		statefulRiskScoreValue, statefulRiskLevelValue = computeServerStatefulRisk(
-			statefulTurnCountValue,
-			statefulEstimatedCharsValue,
-			statefulLastInputTokensValue,
-			initialUserInputText,
-			serverStatefulTurnLimitValue,
-			serverStatefulCharBudgetValue,
-			serverStatefulTokenBudgetValue,
-		)
-		statefulTurnCount = strconv.Itoa(statefulTurnCountValue)
-		statefulEstChars = strconv.Itoa(statefulEstimatedCharsValue)
-		statefulSummaryChars = strconv.Itoa(statefulSummaryCharsValue)
-		statefulResetCount = strconv.Itoa(statefulResetCountValue)
-		statefulInputTokens = strconv.Itoa(statefulLastInputTokensValue)
-		statefulPeakInputTokens = strconv.Itoa(statefulPeakInputTokensValue)
-		statefulTokenBudget = strconv.Itoa(statefulTokenBudgetValue)
-		statefulRiskScore = strconv.FormatFloat(statefulRiskScoreValue, 'f', -1, 64)
-		statefulRiskLevel = statefulRiskLevelValue
-		if newBody, marshalErr := json.Marshal(reqMap); marshalErr == nil {
-			body = newBody
+	}
+}
+
+func handleClearCurrentChat() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
-		chatSession, err = mcp.UpsertChatSession(mcp.ChatSessionEntry{
-			UserID:           userID,
-			SessionKey:       "default",
-			Status:           "running",
-			LLMMode:          llmMode,
-			ModelID:          modelID,
-			LastResponseID:   sessionLastResponseID,
-			SummaryText:      statefulSummaryText,
-			TurnCount:        statefulTurnCountValue,
-			EstimatedChars:   statefulEstimatedCharsValue,
-			LastInputTokens:  statefulLastInputTokensValue,
-			LastOutputTokens: statefulLastOutputTokensValue,
-			PeakInputTokens:  statefulPeakInputTokensValue,
-			TokenBudget:      statefulTokenBudgetValue,
-			RiskScore:        statefulRiskScoreValue,
-			RiskLevel:        statefulRiskLevelValue,
-			LastResetReason:  statefulResetReason,
-			UIStateJSON:      sessionUIStateJSON,
-		})
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cancelCurrentChat(userID)
+
+		sessionEntry, err := mcp.GetCurrentChatSession(userID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("[handleClearCurrentChat] Failed to load current session for %s: %v", userID, err)
+		}
+
+		now := time.Now()
+		sessionEntry.UserID = userID
+		sessionEntry.SessionKey = "default"
+		sessionEntry.Status = "idle"
+		sessionEntry.LastResponseID = ""
+		sessionEntry.SummaryText = ""
+		sessionEntry.TurnCount = 0
+		sessionEntry.EstimatedChars = 0
+		sessionEntry.LastInputTokens = 0
+		sessionEntry.LastOutputTokens = 0
+		sessionEntry.PeakInputTokens = 0
+		sessionEntry.RiskScore = 0
+		sessionEntry.RiskLevel = ""
+		sessionEntry.LastResetReason = "manual_clear_chat"
+		sessionEntry.UIStateJSON = "{}"
+		sessionEntry.ClearedAt = sql.NullTime{Time: now, Valid: true}
+
+		entry, err := mcp.UpsertChatSession(sessionEntry)
 		if err != nil {
-			log.Printf("[chat-session] failed to initialize current session for %s: %v", userID, err)
-		} else {
-			chatSessionOK = true
-			sessionStatus = "running"
+			log.Printf("[handleClearCurrentChat] Failed to upsert current session for %s: %v", userID, err)
+			http.Error(w, "Failed to clear current chat session", http.StatusInternalServerError)
+			return
+		}
+		if err := mcp.ClearChatSessionEvents(userID, entry.ID); err != nil {
+			log.Printf("[handleClearCurrentChat] Failed to clear chat events for %s: %v", userID, err)
+		}
+
+		clearPayload := map[string]interface{}{
+			"source":     "remote_clear",
+			"cleared_at": now.Format(time.RFC3339Nano),
+		}
+		if clearJSON, marshalErr := json.Marshal(clearPayload); marshalErr != nil {
+			log.Printf("[handleClearCurrentChat] Failed to encode clear event for %s: %v", userID, marshalErr)
+		} else if _, err := mcp.AppendChatEvent(userID, entry.ID, "system", "session.cleared", "", "", string(clearJSON)); err != nil {
+			log.Printf("[handleClearCurrentChat] Failed to append clear event for %s: %v", userID, err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "ok",
+		})
+	}
+}
+
+func handleLastSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			entry, err := mcp.GetCurrentChatSession(userID)
+			if err != nil {
+				if !errors.Is(err, sql.ErrNoRows) {
+					log.Printf("[handleLastSession] Failed to load current chat session for user %s: %v", userID, err)
+				}
+				log.Printf("[handleLastSession] No current chat session for %s", userID)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"has_session": false,
+				})
+				return
+			}
+
+			snapshot := parseChatSessionUISnapshot(entry.UIStateJSON)
+			log.Printf("[handleLastSession] Resolving last session for %s session_id=%d status=%s updated_at=%s snapshot=%s",
+				userID,
+				entry.ID,
+				strings.TrimSpace(entry.Status),
+				entry.UpdatedAt.Format(time.RFC3339Nano),
+				summarizeLastSessionSnapshot(snapshot),
+			)
+
+			payload, ok := deriveLastSessionFromChatSession(entry)
+			if !ok {
+				log.Printf("[handleLastSession] Snapshot fallback needed for %s session_id=%d", userID, entry.ID)
+				payload, ok = deriveLastSessionFromChatEvents(userID, entry)
+			}
+			if !ok {
+				log.Printf("[handleLastSession] No restorable last session for %s session_id=%d", userID, entry.ID)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"has_session": false,
+				})
+				return
+			}
+
+			log.Printf("[handleLastSession] Restored last session for %s user_len=%d assistant_len=%d mode=%s",
+				userID,
+				len([]rune(strings.TrimSpace(fmt.Sprintf("%v", payload["user_message"])))),
+				len([]rune(strings.TrimSpace(fmt.Sprintf("%v", payload["assistant_message"])))),
+				strings.TrimSpace(fmt.Sprintf("%v", payload["mode"])),
+			)
+			json.NewEncoder(w).Encode(payload)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}
+}
+
+func buildSavedTurnLLMTitle(ctx context.Context, promptText, responseText string, opts savedTurnTitleOptions) string {
+	request := fmt.Sprintf(`Create a short title for this saved chat turn.
+
+Rules:
+- Use the main language of the saved content.
+- Aim for about 20 characters.
+- Make it specific and readable.
+- Respond as JSON only in this exact shape: {"title":"..."}
 
-	buildSessionState := func() chatharness.SessionPersistState {
-		return chatharness.SessionPersistState{
-			Status:           sessionStatus,
-			LLMMode:          llmMode,
-			ModelID:          modelID,
-			LastResponseID:   sessionLastResponseID,
-			SummaryText:      statefulSummaryText,
-			TurnCount:        statefulTurnCountValue,
-			EstimatedChars:   statefulEstimatedCharsValue,
-			LastInputTokens:  statefulLastInputTokensValue,
-			LastOutputTokens: statefulLastOutputTokensValue,
-			PeakInputTokens:  statefulPeakInputTokensValue,
-			TokenBudget:      statefulTokenBudgetValue,
-			RiskScore:        statefulRiskScoreValue,
-			RiskLevel:        statefulRiskLevelValue,
-			LastResetReason:  statefulResetReason,
-			UIStateJSON:      sessionUIStateJSON,
-		}
-	}
+Saved user prompt:
+%s
 
-	sessionTracker := chatharness.NewSessionTracker(userID, clientTurnID, chatSession, chatSessionOK, sessionUISnapshot, sessionUIStateJSON)
+Saved assistant response:
+%s`, cleanSavedTurnTitleContext(promptText, 320), cleanSavedTurnTitleContext(responseText, 1200))
 
-	appendChatEvent := func(role, eventType string, payload interface{}) {
-		sessionTracker.AppendEvent(buildSessionState(), role, eventType, payload)
-		sessionUISnapshot = sessionTracker.Snapshot
-		sessionUIStateJSON = sessionTracker.UIStateJSON
-	}
+	AddDebugTrace("saved-turn-title", "parse.start", "Starting saved turn title generation", map[string]interface{}{
+		"model":           strings.TrimSpace(opts.ModelID),
+		"temperature":     normalizeSavedTurnTemperature(opts.Temperature),
+		"prompt_chars":    len([]rune(strings.TrimSpace(promptText))),
+		"response_chars":  len([]rune(strings.TrimSpace(responseText))),
+		"request_preview": compactText(request, 220),
+	})
 
-	emitGenerationEvent := func(eventType string, payload map[string]interface{}) {
-		if payload == nil {
-			payload = map[string]interface{}{}
-		}
-		payload["type"] = eventType
-		appendChatEvent("system", eventType, payload)
+	rawResponse := callLLMInternal(ctx, request, opts)
+	title := parseSavedTurnTitleFromJSON(rawResponse)
+	title = strings.Trim(title, "\"'`")
+	title = strings.Join(strings.Fields(title), " ")
+	if title == "" {
+		AddDebugTrace("saved-turn-title", "parse.failed", "Failed to parse title JSON response", map[string]interface{}{
+			"raw_response": compactText(rawResponse, 220),
+			"__payload":    rawResponse,
+		})
+		return ""
+	}
+	runes := []rune(title)
+	if len(runes) > 24 {
+		title = strings.TrimSpace(string(runes[:24]))
 	}
+	AddDebugTrace("saved-turn-title", "parse.success", "Parsed saved turn title JSON", map[string]interface{}{
+		"title":        title,
+		"title_length": len([]rune(title)),
+	})
+	return title
+}
 
-	defer func() {
-		if !chatSessionOK {
+func handleSavedTurns() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		if chatCtx.Err() == context.Canceled && sessionStatus != "idle" {
-			sessionStatus = "cancelled"
-			appendChatEvent("system", "generation.finished", map[string]interface{}{
-				"type":    "generation.finished",
-				"phase":   "cancelled",
-				"turn_id": clientTurnID,
-			})
-		}
-		sessionTracker.Finalize(buildSessionState())
-	}()
 
-	appendChatEvent("system", "request.prepared", map[string]interface{}{
-		"mode":       llmMode,
-		"model":      modelID,
-		"url":        llmURL,
-		"body_bytes": len(body),
-	})
-	endLLMActivity := beginLLMActivity()
-	defer endLLMActivity()
-	emitGenerationEvent("generation.started", map[string]interface{}{
-		"phase": "queued",
-		"mode":  llmMode,
-		"model": modelID,
-	})
-	if statefulResetReason != "" {
-		appendChatEvent("system", "stateful.reset", map[string]interface{}{
-			"reason":         statefulResetReason,
-			"turn_count":     parseIntHeader(statefulTurnCount),
-			"estimatedChars": parseIntHeader(statefulEstChars),
-		})
-	}
-	if messages, ok := reqMap["messages"].([]interface{}); ok {
-		for i := len(messages) - 1; i >= 0; i-- {
-			msg, ok := messages[i].(map[string]interface{})
-			if !ok {
-				continue
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			queryStr := strings.TrimSpace(r.URL.Query().Get("q"))
+			var (
+				entries []mcp.SavedTurnEntry
+				err     error
+			)
+			if queryStr == "" {
+				entries, err = mcp.ListSavedTurns(userID, 200)
+			} else {
+				entries, err = mcp.SearchSavedTurns(userID, queryStr, 200)
+			}
+			if err != nil {
+				log.Printf("[handleSavedTurns] Failed to load saved turns for %s: %v", userID, err)
+				http.Error(w, "Failed to load saved turns", http.StatusInternalServerError)
+				return
 			}
-			if role, _ := msg["role"].(string); role == "user" {
-				appendChatEvent("user", "message.created", msg)
-				break
+			entries = markSavedTurnEntriesProcessing(userID, entries)
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": entries})
+		case http.MethodPost:
+			var req struct {
+				PromptText     string   `json:"prompt_text"`
+				ResponseText   string   `json:"response_text"`
+				ModelID        string   `json:"model_id"`
+				SecondaryModel string   `json:"secondary_model"`
+				APIToken       string   `json:"api_token"`
+				LLMMode        string   `json:"llm_mode"`
+				Temperature    *float64 `json:"temperature"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				log.Printf("[handleSavedTurns] Invalid request JSON for %s: %v", userID, err)
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			req.PromptText = strings.TrimSpace(req.PromptText)
+			req.ResponseText = strings.TrimSpace(req.ResponseText)
+			log.Printf("[handleSavedTurns] Save request for %s prompt_len=%d response_len=%d prompt_preview=%q response_preview=%q",
+				userID,
+				len([]rune(req.PromptText)),
+				len([]rune(req.ResponseText)),
+				compactText(req.PromptText, 80),
+				compactText(req.ResponseText, 120),
+			)
+			if req.PromptText == "" || req.ResponseText == "" {
+				log.Printf("[handleSavedTurns] Rejecting save for %s because prompt/response is empty", userID)
+				http.Error(w, "Valid prompt_text and response_text are required", http.StatusBadRequest)
+				return
+			}
+			entry, err := mcp.SaveSavedTurn(userID, req.PromptText, req.ResponseText)
+			if err != nil {
+				log.Printf("[handleSavedTurns] Failed to save turn for %s: %v", userID, err)
+				http.Error(w, "Failed to save turn", http.StatusInternalServerError)
+				return
 			}
-		}
-	} else if inputStr, ok := reqMap["input"].(string); ok && strings.TrimSpace(inputStr) != "" {
-		appendChatEvent("user", "message.created", map[string]interface{}{"content": inputStr})
-	}
 
-	emitter, err := chatharness.NewSSEEmitter(w)
-	if err != nil {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-		return
-	}
-	emitter.SetupHeaders()
-	if len(selectedSkillEvents) > 0 {
-		skillEvent := map[string]interface{}{
-			"type":    "skill.applied",
-			"turn_id": clientTurnID,
-			"skills":  selectedSkillEvents,
-		}
-		appendChatEvent("assistant", "skill.applied", skillEvent)
-		if clientStreaming {
-			if writeErr := emitter.EmitDataJSON(skillEvent); writeErr != nil {
-				clientStreaming = false
-				log.Printf("[handleChat] Client stream detached while reporting selected skills for %s: %v", userID, writeErr)
+			titleOpts := savedTurnTitleOptions{
+				ModelID:        strings.TrimSpace(req.ModelID),
+				SecondaryModel: strings.TrimSpace(req.SecondaryModel),
+				APIToken:       strings.TrimSpace(req.APIToken),
+				LLMMode:        strings.TrimSpace(req.LLMMode),
+			}
+			if req.Temperature != nil {
+				titleOpts.Temperature = normalizeSavedTurnTemperature(*req.Temperature)
 			}
-		}
-	}
-	emitStreamChunk = func(payload string) {
-		if !clientStreaming {
-			return
-		}
-		if writeErr := emitter.EmitRaw(payload); writeErr != nil {
-			clientStreaming = false
-			log.Printf("[handleChat] Client stream detached for %s: %v", userID, writeErr)
-			return
-		}
-	}
 
-	// Shared turn-state variables
-	fullResponse := ""
-	var messagesForMemory []map[string]interface{}
-	needsCorrection := false
-	var badContentCapture string
-	var lastResponseID string // Captured from chat.end for stateful chaining
-	reasoningActive := false
-	reasoningStartedAt := time.Time{}
-	reasoningAccumulatedMs := int64(0)
-	reasoningResponse := ""
-	reasoningRunawayDetected := false
-	reasoningRunawayMessage := ""
-	toolUsageCounts := make(map[string]int)
-	toolSignatureCounts := make(map[string]int)
-	webSearchEvidenceAttempts := 0
-	webEvidenceSources := make([]chatharness.WebEvidenceSource, 0, 6)
-	webEvidenceSourceURLs := make(map[string]bool)
-	executeCommandFamilyCounts := make(map[string]int)
-	webEvidenceBudget := webEvidenceToolBudget
-	webSearchProviderLimit := webSearchProviderBudget
-	bufferedSourceReadLimit := bufferedSourceReadBudget
-	bulkToolTestRequest := chatharness.IsBulkToolTestRequest(initialUserInputText)
-	if isDeepWebResearchRequest(initialUserInputText) || bulkToolTestRequest {
-		webEvidenceBudget = deepWebEvidenceToolBudget
-		webSearchProviderLimit = deepWebSearchProviderBudget
-		bufferedSourceReadLimit = deepBufferedSourceReadBudget
-	}
-	if bulkToolTestRequest {
-		// A complete catalog smoke test needs four provider tools, while
-		// search_web_multi consumes two provider slots by design.
-		webSearchProviderLimit = 6
-	}
-	previousResponseRetryUsed := false
-	reasoningOnlyFinalRecoveryUsed := false
-	discardStatefulResponseIDForTurn := false
-	generationFirstTokenEmitted := false
-	generationPhase := "queued"
-
-	emitCanonicalAssistantDelta := func(content string) {
-		if strings.TrimSpace(content) == "" {
-			return
-		}
-		if !generationFirstTokenEmitted {
-			generationFirstTokenEmitted = true
-			emitGenerationEvent("generation.first_token", map[string]interface{}{"phase": "answering"})
-		}
-		if generationPhase != "answering" {
-			generationPhase = "answering"
-			emitGenerationEvent("generation.phase", map[string]interface{}{"phase": generationPhase})
-		}
-		fullResponse += content
-		appendChatEvent("assistant", "message.delta", map[string]interface{}{
-			"type":         "message.delta",
-			"content":      content,
-			"full_content": fullResponse,
-		})
-		payload := map[string]interface{}{
-			"choices": []interface{}{
-				map[string]interface{}{
-					"delta": map[string]string{
-						"content": content,
-					},
-				},
-			},
-		}
-		if jsonBytes, err := json.Marshal(payload); err == nil {
-			emitStreamChunk(fmt.Sprintf("data: %s", string(jsonBytes)))
+			started := startSavedTurnTitleTask(userID, entry.ID, func(ctx context.Context) {
+				title := buildSavedTurnLLMTitle(ctx, req.PromptText, req.ResponseText, titleOpts)
+				if errors.Is(ctx.Err(), context.Canceled) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					AddDebugTrace("saved-turn-title", "llm.cancelled", "Saved turn title generation stopped before completion", map[string]interface{}{
+						"user_id": userID,
+						"turn_id": entry.ID,
+						"error":   ctx.Err(),
+					})
+					return
+				}
+				if title == "" {
+					AddDebugTrace("saved-turn-title", "db.skipped", "Skipped DB update because no title was generated", map[string]interface{}{
+						"user_id": userID,
+						"turn_id": entry.ID,
+					})
+					recordSavedTurnAutoTitleFailure(userID, entry.ID, "empty_title", nil)
+					return
+				}
+				if latestEntry, err := mcp.GetSavedTurn(userID, entry.ID); err == nil && strings.TrimSpace(latestEntry.TitleSource) != "fallback" {
+					AddDebugTrace("saved-turn-title", "db.skipped", "Skipped DB update because title source changed while generating", map[string]interface{}{
+						"user_id":      userID,
+						"turn_id":      entry.ID,
+						"title_source": latestEntry.TitleSource,
+					})
+					return
+				}
+				if err := mcp.UpdateSavedTurnTitle(userID, entry.ID, title, "generated"); err != nil {
+					log.Printf("[handleSavedTurns] Failed to generate async title for %s turn %d: %v", userID, entry.ID, err)
+					AddDebugTrace("saved-turn-title", "db.error", "Failed to update saved turn title in DB", map[string]interface{}{
+						"user_id": userID,
+						"turn_id": entry.ID,
+						"title":   title,
+						"error":   err,
+					})
+					recordSavedTurnAutoTitleFailure(userID, entry.ID, "db_update_failed", map[string]interface{}{
+						"title": title,
+						"error": err,
+					})
+					return
+				}
+				AddDebugTrace("saved-turn-title", "db.updated", "Updated saved turn title in DB", map[string]interface{}{
+					"user_id":      userID,
+					"turn_id":      entry.ID,
+					"title":        title,
+					"title_source": "generated",
+				})
+			})
+
+			if started {
+				entry.Processing = true
+				AddDebugTrace("saved-turn-title", "llm.started", "Started saved turn title generation task", map[string]interface{}{
+					"user_id": userID,
+					"turn_id": entry.ID,
+				})
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":     "ok",
+				"processing": entry.Processing,
+				"item":       entry,
+			})
+		case http.MethodPatch:
+			var req struct {
+				ID    int64  `json:"id"`
+				Title string `json:"title"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			req.Title = strings.TrimSpace(req.Title)
+			if req.ID <= 0 || req.Title == "" {
+				http.Error(w, "Valid id and title are required", http.StatusBadRequest)
+				return
+			}
+			cancelSavedTurnTitleTask(userID, req.ID)
+			if err := mcp.UpdateSavedTurnTitle(userID, req.ID, req.Title, "manual"); err != nil {
+				log.Printf("[handleSavedTurns] Failed to update manual title for %s turn %d: %v", userID, req.ID, err)
+				http.Error(w, "Failed to update title", http.StatusInternalServerError)
+				return
+			}
+			entry, err := mcp.GetSavedTurn(userID, req.ID)
+			if err != nil {
+				log.Printf("[handleSavedTurns] Failed to load updated turn %d for %s: %v", req.ID, userID, err)
+				http.Error(w, "Failed to load updated turn", http.StatusInternalServerError)
+				return
+			}
+			AddDebugTrace("saved-turn-title", "db.updated", "Updated saved turn title manually", map[string]interface{}{
+				"user_id":      userID,
+				"turn_id":      req.ID,
+				"title":        req.Title,
+				"title_source": "manual",
+			})
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "ok",
+				"item":   entry,
+			})
+		case http.MethodDelete:
+			idStr := strings.TrimSpace(r.URL.Query().Get("id"))
+			turnID, err := strconv.ParseInt(idStr, 10, 64)
+			if err != nil || turnID <= 0 {
+				http.Error(w, "Valid id is required", http.StatusBadRequest)
+				return
+			}
+			if err := mcp.DeleteSavedTurn(userID, turnID); err != nil {
+				log.Printf("[handleSavedTurns] Failed to delete turn %d for %s: %v", turnID, userID, err)
+				http.Error(w, "Failed to delete turn", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}
+}
 
-	emitReasoningRunaway := func(snippet, source string) bool {
-		if strings.TrimSpace(snippet) == "" {
-			return false
+func handleSavedTurnTitleRefresh() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		reasoningRunawayDetected = true
-		reasoningRunawayMessage = fmt.Sprintf("LMSTUDIO_RUNAWAY_REPETITION: repetitive reasoning detected (%s)", source)
-		appendChatEvent("assistant", "error", map[string]interface{}{
-			"type":             "error",
-			"error":            reasoningRunawayMessage,
-			"code":             "LMSTUDIO_RUNAWAY_REPETITION",
-			"phase":            "reasoning",
-			"snippet":          snippet,
-			"total_elapsed_ms": requestElapsedMs(),
-		})
-		if jsonBytes, err := json.Marshal(map[string]interface{}{
-			"error":   reasoningRunawayMessage,
-			"code":    "LMSTUDIO_RUNAWAY_REPETITION",
-			"phase":   "reasoning",
-			"snippet": snippet,
-		}); err == nil {
-			emitStreamChunk(fmt.Sprintf("data: %s", string(jsonBytes)))
-		}
-		AddDebugTrace("chat", "reasoning.loop", "Stopped stream due to repetitive reasoning", map[string]interface{}{
-			"snippet": compactText(snippet, 160),
-			"source":  source,
-		})
-		return true
-	}
 
-	recordReasoningDeltaAndCheckLoop := func(content string) bool {
-		if content == "" {
-			return false
-		}
-		reasoningResponse += content
-		if snippet, source, ok := detectReasoningRunawayRepetition(reasoningResponse); ok {
-			return emitReasoningRunaway(snippet, source)
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
-		return false
-	}
 
-	// --- TURN LOOP START ---
-	maxToolTurns := 10
-	if bulkToolTestRequest {
-		maxToolTurns = 24
-	}
-	for turn := 0; turn < maxToolTurns; turn++ {
-		turnStart := time.Now()
-		toolExecutedThisTurn := false
-		nativeToolLoopDetected := false
-		nativeToolLoopMessage := ""
-		reasoningResponse = ""
-		reasoningRunawayDetected = false
-		reasoningRunawayMessage = ""
-		pendingNativeToolName := ""
-		nativeExecuteCommandCount := 0
-		nativeExecuteCommandFamilyCounts := make(map[string]int)
-		nativeToolSignatureCounts := make(map[string]int)
-		var lastToolName string
-		var lastToolArgsStr string
-		var lastToolCallID string
-		var lastSavedBufferForTurn string
-		chatToolCalls := chatharness.NewChatToolAccumulator()
-
-		// Variables for tool execution (shared between Regex and JSON modes)
-		var toolName string
-		var toolArgsStr string
-
-		// Use r.Context() to propagate cancellation from frontend
-		// Note: 'body' must be updated if we loop
-		req, err := http.NewRequestWithContext(chatCtx, "POST", llmURL, bytes.NewReader(body))
+		titleOpts, err := parseSavedTurnTitleOptionsFromBody(r)
 		if err != nil {
-			http.Error(w, "Failed to create request", http.StatusInternalServerError)
+			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
 
-		req.Header.Set("Content-Type", "application/json")
-
-		// Check if token is effectively empty or just "bearer", OR IS A MASKED VALUE
-		token = strings.TrimSpace(token)
-		isMasked := strings.HasPrefix(token, "***") || strings.HasSuffix(token, "...")
-		if token != "" && !isMasked {
-			req.Header.Set("Authorization", "Bearer "+token)
-		} else {
-			// Default to lm-studio (standard, no hacks).
-			// If this fails with 401, we will handle the error response to guide the user.
-			log.Printf("[handleChat] Empty/Invalid/Masked Token detected ('%s'), using Default: lm-studio", token)
-			req.Header.Set("Authorization", "Bearer lm-studio")
-		}
+		w.Header().Set("Content-Type", "application/json")
 
-		client := &http.Client{Timeout: 5 * time.Minute}
-		AddDebugTrace("chat", "turn.start", "Dispatching upstream turn", map[string]interface{}{
-			"turn":       turn,
-			"model":      modelID,
-			"body_bytes": len(body),
-		})
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("LLM request failed: %v", err)
-			AddDebugTrace("chat", "turn.error", "Upstream request failed", map[string]interface{}{
-				"turn":       turn,
-				"elapsed_ms": time.Since(turnStart).Milliseconds(),
-				"error":      err.Error(),
-			})
-			if turn == 0 {
-				http.Error(w, fmt.Sprintf("LLM connection failed: %v", err), http.StatusBadGateway)
+		idStr := strings.TrimSpace(r.URL.Query().Get("id"))
+		var entry mcp.SavedTurnEntry
+		if idStr != "" {
+			turnID, parseErr := strconv.ParseInt(idStr, 10, 64)
+			if parseErr != nil || turnID <= 0 {
+				http.Error(w, "Valid id is required", http.StatusBadRequest)
+				return
 			}
-			return
-		}
-		// Close body at end of this turn
-		// We will close it explicitly after the scanner instead of using defer in a loop
-
-		if resp.StatusCode != http.StatusOK {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			errorMsg := string(bodyBytes)
-			log.Printf("LLM error response: %s", errorMsg)
-			AddDebugTrace("chat", "turn.error", "Upstream returned an error status", map[string]interface{}{
-				"turn":        turn,
-				"status_code": resp.StatusCode,
-				"elapsed_ms":  time.Since(turnStart).Milliseconds(),
-				"error":       compactText(errorMsg, 180),
-			})
-			if llmMode == "stateful" &&
-				!previousResponseRetryUsed &&
-				(strings.Contains(errorMsg, "Could not find stored response for previous_response_id") ||
-					(strings.Contains(errorMsg, "previous_response_id") && strings.Contains(errorMsg, "must start with"))) {
-				previousResponseRetryUsed = true
-				lastResponseID = ""
-				sessionLastResponseID = ""
-				discardStatefulResponseIDForTurn = false
-				statefulResetReason = "invalid_previous_response_id"
-				appendChatEvent("system", "stateful.reset", map[string]interface{}{
-					"reason": "invalid_previous_response_id",
+			entry, err = mcp.GetSavedTurn(userID, turnID)
+			if err != nil {
+				log.Printf("[handleSavedTurnTitleRefresh] Failed to load turn %d for %s: %v", turnID, userID, err)
+				http.Error(w, "Failed to load saved turn", http.StatusInternalServerError)
+				return
+			}
+			if strings.TrimSpace(entry.TitleSource) != "fallback" {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"status":  "noop",
+					"updated": false,
+					"item":    entry,
 				})
-				if reqMap != nil {
-					delete(reqMap, "previous_response_id")
-					if newBody, marshalErr := json.Marshal(reqMap); marshalErr == nil {
-						body = newBody
-					}
+				return
+			}
+			if isSavedTurnTitleProcessing(userID, entry.ID) {
+				entry.Processing = true
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"status":     "processing",
+					"updated":    false,
+					"processing": true,
+					"item":       entry,
+				})
+				return
+			}
+		} else {
+			entry, err = mcp.GetNextSavedTurnPendingTitle(userID)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"status":  "idle",
+						"updated": false,
+					})
+					return
 				}
-				chatSession.LastResponseID = ""
-				AddDebugTrace("stateful", "reset", "Retrying request without invalid previous_response_id", map[string]interface{}{
-					"user": userID,
-					"turn": turn,
+				log.Printf("[handleSavedTurnTitleRefresh] Failed to load pending title for %s: %v", userID, err)
+				http.Error(w, "Failed to load pending title", http.StatusInternalServerError)
+				return
+			}
+			if isSavedTurnTitleProcessing(userID, entry.ID) {
+				entry.Processing = true
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"status":     "processing",
+					"updated":    false,
+					"processing": true,
+					"item":       entry,
 				})
-				resp.Body.Close()
-				continue
+				return
 			}
+		}
 
-			// Check for specific LM Studio auth error
-			// We return a text starting with "LM_STUDIO_AUTH_ERROR:" so frontend can localize it.
-			if resp.StatusCode == http.StatusUnauthorized || strings.Contains(errorMsg, "invalid_api_key") || strings.Contains(errorMsg, "Malformed LM Studio API token") {
-				// Frontend will detect this prefix and show translated message
-				http.Error(w, "LM_STUDIO_AUTH_ERROR: "+errorMsg, resp.StatusCode)
+		started := startSavedTurnTitleTask(userID, entry.ID, func(ctx context.Context) {
+			title := buildSavedTurnLLMTitle(ctx, entry.PromptText, entry.ResponseText, titleOpts)
+			if errors.Is(ctx.Err(), context.Canceled) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				AddDebugTrace("saved-turn-title", "llm.cancelled", "Manual title refresh task stopped before completion", map[string]interface{}{
+					"user_id": userID,
+					"turn_id": entry.ID,
+					"error":   ctx.Err(),
+				})
 				return
 			}
-
-			// Check for Context Overflow Error
-			if strings.Contains(errorMsg, "Context size has been exceeded") ||
-				strings.Contains(errorMsg, "context_length_exceeded") ||
-				strings.Contains(errorMsg, "exceeds the available context size") ||
-				strings.Contains(errorMsg, "too many tokens") {
-				log.Printf("[handleChat] LM Studio Context Limit Reached. Informing user.")
-				emitter.SendError("LM_STUDIO_CONTEXT_ERROR: Context limit reached. Please clear the chat or use a larger context model.")
+			if title == "" {
+				AddDebugTrace("saved-turn-title", "db.skipped", "Manual title refresh produced no title", map[string]interface{}{
+					"user_id": userID,
+					"turn_id": entry.ID,
+				})
+				if idStr == "" {
+					recordSavedTurnAutoTitleFailure(userID, entry.ID, "empty_title", nil)
+				}
 				return
 			}
-
-			// Check for Non-Vision Model Error
-			if strings.Contains(errorMsg, "does not support image inputs") {
-				log.Printf("[handleChat] Non-Vision Model Error detected. Informing user.")
-				emitter.SendError("LM_STUDIO_VISION_ERROR: Model does not support images.")
+			if latestEntry, err := mcp.GetSavedTurn(userID, entry.ID); err == nil && strings.TrimSpace(latestEntry.TitleSource) != "fallback" {
+				AddDebugTrace("saved-turn-title", "db.skipped", "Skipped manual refresh DB update because title source changed", map[string]interface{}{
+					"user_id":      userID,
+					"turn_id":      entry.ID,
+					"title_source": latestEntry.TitleSource,
+				})
+				return
+			}
+			if err := mcp.UpdateSavedTurnTitle(userID, entry.ID, title, "generated"); err != nil {
+				log.Printf("[handleSavedTurnTitleRefresh] Failed to update title for %s turn %d: %v", userID, entry.ID, err)
+				AddDebugTrace("saved-turn-title", "db.error", "Failed to update title during manual refresh", map[string]interface{}{
+					"user_id": userID,
+					"turn_id": entry.ID,
+					"title":   title,
+					"error":   err,
+				})
+				if idStr == "" {
+					recordSavedTurnAutoTitleFailure(userID, entry.ID, "db_update_failed", map[string]interface{}{
+						"title": title,
+						"error": err,
+					})
+				}
 				return
 			}
+			AddDebugTrace("saved-turn-title", "db.updated", "Updated saved turn title during manual refresh", map[string]interface{}{
+				"user_id":      userID,
+				"turn_id":      entry.ID,
+				"title":        title,
+				"title_source": "generated",
+			})
+		})
 
-			emitter.SendError(fmt.Sprintf("LLM error: %s", errorMsg))
-			return
+		if started {
+			entry.Processing = true
 		}
-		AddDebugTrace("chat", "turn.response", "Upstream stream opened", map[string]interface{}{
-			"turn":        turn,
-			"status_code": resp.StatusCode,
-			"elapsed_ms":  time.Since(turnStart).Milliseconds(),
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     savedTurnQueuedStatus(started),
+			"updated":    false,
+			"processing": started,
+			"item":       entry,
 		})
+	}
+}
 
-		// Tool Pattern Logic
-		var toolPattern map[string]string = nil
-		var toolRegex = (*regexp.Regexp)(nil)
-
-		// Buffer for handling split tags (e.g., "<", "tool", "_call>")
-		var partialTagBuffer string
-
-		// Flag if we are in "buffering mode" (waiting for complete tool call)
-		isBuffering := false
-		var buffer string             // Declare buffer here
-		var bufferingThreshold = 8000 // Buffer size (increased for large JSON args)
+// resolveModelAPIConfig picks the server for a model request. With upstreams
+// configured the upstream serving modelID wins over the user's overrides.
+func resolveModelAPIConfig(r *http.Request, app *App, authMgr *AuthManager, requestedMode, modelID string) (string, string, string) {
+	if targets := app.upstreams.Route(modelID); len(targets) > 0 {
+		return targets[0].Endpoint, targets[0].Token, normalizeLLMMode(targets[0].Mode)
+	}
 
-		// Extract messages for Memory Analysis (if enabled)
-		if enableMemory {
-			log.Printf("[handleChat-DEBUG] Request Body Snippet: %s", string(body)[:min(len(body), 500)])
+	app.serverMux.Lock()
+	endpoint := app.llmEndpoint
+	token := app.llmApiToken
+	mode := app.llmMode
+	app.serverMux.Unlock()
 
-			var tmpBody struct {
-				Messages []map[string]interface{} `json:"messages"`
-				Input    interface{}              `json:"input"` // Flexible for any type
+	userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+	if userID != "" && authMgr != nil {
+		authMgr.mu.RLock()
+		user := authMgr.users[userID]
+		authMgr.mu.RUnlock()
+		if user != nil {
+			if user.Settings.ApiToken != nil {
+				token = *user.Settings.ApiToken
 			}
-			if err := json.Unmarshal(body, &tmpBody); err == nil {
-				if len(tmpBody.Messages) > 0 {
-					messagesForMemory = tmpBody.Messages
-					log.Printf("[handleChat-DEBUG] Extracted %d messages for memory", len(messagesForMemory))
-				} else if inputStr, ok := tmpBody.Input.(string); ok && inputStr != "" {
-					// Construct a single user message from Input
-					messagesForMemory = []map[string]interface{}{
-						{"role": "user", "content": inputStr},
-					}
-					log.Printf("[handleChat-DEBUG] Extracted 'input' string as user message for memory")
-				} else {
-					log.Printf("[handleChat-DEBUG] No valid 'messages' or 'input' string found in body")
-				}
-			} else {
-				log.Printf("[handleChat-DEBUG] Failed to extract messages for memory: %v", err)
+			if user.Settings.LLMMode != nil && strings.TrimSpace(*user.Settings.LLMMode) != "" {
+				mode = *user.Settings.LLMMode
 			}
 		}
+	}
 
-		reader := bufio.NewReader(resp.Body)
-		log.Println("[handleChat-DEBUG] Starting response scanner loop")
-	streamScanLoop:
-		for {
-			block, readErr := readUpstreamSSEBlock(reader)
-			if readErr != nil {
-				if errors.Is(readErr, io.EOF) {
-					break
-				}
-				log.Printf("[handleChat] Stream scanner error: %v", readErr)
-				break
-			}
-			line := block.Raw
-			dataStr := block.Data
-
-			// Log first few lines to debug stream format
-			if len(fullResponse) < 100 && len(fullResponse) > 0 {
-				// Don't log every line forever, just start
-			}
-
-			// CUSTOM PARSING LOGIC & SSE Handling
-			// We process every line to handle both standard OpenAI and the custom format seen in logs
-			trimmedLine := strings.TrimSpace(line)
-
-			// Skip empty lines or comment lines (unless we need event types, which we might for the custom format)
-			if trimmedLine == "" {
-				continue
-			}
-
-			// Check for data: prefix
-			if dataStr != "" {
-
-				// 1. Check for Standard OpenAI [DONE]
-				if dataStr == "[DONE]" {
-					log.Println("[handleChat-DEBUG] [DONE] signal received (Standard)")
-					if enableTools && chatToolCalls.HasCalls() {
-						continue
-					}
-					if enableTools && isBuffering && strings.TrimSpace(buffer) != "" {
-						if parsedTool, parsedArgsJSON, parsedArgs, ok := parsePromptToolMarkup(buffer); ok && isRegisteredPromptTool(parsedTool, promptTools) {
-							toolExecutedThisTurn = true
-							lastToolName = parsedTool
-							lastToolArgsStr = parsedArgsJSON
-							lastSavedBufferForTurn = fullResponse
-							startEvt := map[string]interface{}{"type": "tool_call.start", "tool": parsedTool}
-							startBytes, _ := json.Marshal(startEvt)
-							appendChatEvent("assistant", "tool_call.start", startEvt)
-							emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-							argsEvt := map[string]interface{}{"type": "tool_call.arguments", "tool": parsedTool, "arguments": parsedArgs}
-							argsBytes, _ := json.Marshal(argsEvt)
-							appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-							emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-							buffer = ""
-							isBuffering = false
-							toolPattern = nil
-							continue
-						}
-					}
-					if enableTools && isBuffering && looksLikeJSONToolCallPrefix(buffer) {
-						break streamScanLoop
-					}
-					// If buffering, flush any remaining buffer as content before sending DONE
-					if isBuffering && len(buffer) > 0 {
-						recognized, _ := classifyPromptToolMarkup(buffer, promptTools)
-						if enableTools && (recognized || looksLikeToolMarkup(buffer)) {
-							needsCorrection = true
-							if badContentCapture == "" {
-								badContentCapture = buffer
-							}
-							buffer = ""
-							emitStreamChunk(line)
-							continue
-						}
-						payload := map[string]interface{}{
-							"choices": []interface{}{
-								map[string]interface{}{
-									"delta": map[string]string{
-										"content": buffer,
-									},
-								},
-							},
-						}
-						jsonBytes, _ := json.Marshal(payload)
-						emitStreamChunk(fmt.Sprintf("data: %s", string(jsonBytes)))
-						fullResponse += buffer
-						buffer = ""
-					}
-
-					// Just forward the DONE
-					emitStreamChunk(line)
-					continue
-				}
-
-				// 2. Parse JSON
-				var chunk map[string]interface{}
-				hasNativeToolDelta := false
-				if err := json.Unmarshal([]byte(dataStr), &chunk); err == nil {
-					if enableTools {
-						hasNativeToolDelta = chatToolCalls.AddChunk(chunk)
-					}
-
-					// --- A. Handle Custom Format (type: "message.delta", etc) ---
-					if msgType, ok := chunk["type"].(string); ok {
-						if msgType == "message.delta" {
-							if content, ok := chunk["content"].(string); ok {
-								if enableTools {
-									candidate := content
-									if isBuffering && toolPattern != nil && (toolPattern["format"] == "text-tool" || toolPattern["format"] == "json-tool") {
-										buffer += content
-										candidate = buffer
-									} else if partialTagBuffer != "" {
-										candidate = partialTagBuffer + content
-									}
-
-									if !isBuffering {
-										startBuffering, holdPrefix := classifyPromptToolStreamCandidate(candidate, promptTools)
-										if !startBuffering && holdPrefix {
-											partialTagBuffer = candidate
-											continue
-										}
-										if startBuffering {
-											isBuffering = true
-											buffer = candidate
-											partialTagBuffer = ""
-											format := "text-tool"
-											if looksLikeJSONToolCallPrefix(candidate) {
-												format = "json-tool"
-											}
-											toolPattern = map[string]string{"format": format}
-										} else if partialTagBuffer != "" {
-											content = candidate
-											partialTagBuffer = ""
-										}
-									}
-
-									if isBuffering && toolPattern != nil && (toolPattern["format"] == "text-tool" || toolPattern["format"] == "json-tool") {
-										if parsedTool, parsedArgsJSON, parsedArgs, _ := parsePromptToolMarkup(buffer); isRegisteredPromptTool(parsedTool, promptTools) {
-											toolExecutedThisTurn = true
-											lastToolName = parsedTool
-											lastToolArgsStr = parsedArgsJSON
-											lastSavedBufferForTurn = fullResponse
-											generationPhase = "tool_call"
-											emitGenerationEvent("generation.phase", map[string]interface{}{"phase": generationPhase, "tool": parsedTool})
-
-											startEvt := map[string]interface{}{"type": "tool_call.start", "tool": parsedTool}
-											startBytes, _ := json.Marshal(startEvt)
-											appendChatEvent("assistant", "tool_call.start", startEvt)
-											emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-
-											argsEvt := map[string]interface{}{"type": "tool_call.arguments", "tool": parsedTool, "arguments": parsedArgs}
-											argsBytes, _ := json.Marshal(argsEvt)
-											appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-											emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-
-											buffer = ""
-											isBuffering = false
-											toolPattern = nil
-											continue
-										}
-										if toolPattern["format"] == "text-tool" && hasPromptToolClosingTag(buffer, promptTools) {
-											needsCorrection = true
-											badContentCapture = buffer
-											AddDebugTrace("chat", "tool.quarantine", "Suppressed malformed streamed tool markup", map[string]interface{}{
-												"snippet": compactText(buffer, 220),
-											})
-											buffer = ""
-											isBuffering = false
-											toolPattern = nil
-										}
-										if len(buffer) > bufferingThreshold {
-											needsCorrection = true
-											badContentCapture = buffer
-											AddDebugTrace("chat", "tool.quarantine", "Suppressed oversized streamed tool wrapper", map[string]interface{}{
-												"snippet": compactText(buffer, 220),
-											})
-											buffer = ""
-											isBuffering = false
-											toolPattern = nil
-										}
-										continue
-									}
-								}
-								if !generationFirstTokenEmitted {
-									generationFirstTokenEmitted = true
-									emitGenerationEvent("generation.first_token", map[string]interface{}{"phase": "answering"})
-								}
-								if generationPhase != "answering" {
-									generationPhase = "answering"
-									emitGenerationEvent("generation.phase", map[string]interface{}{"phase": generationPhase})
-								}
-								if reasoningActive {
-									totalReasoningMs := reasoningAccumulatedMs + time.Since(reasoningStartedAt).Milliseconds()
-									reasoningEndEvt := map[string]interface{}{
-										"type":             "reasoning.end",
-										"elapsed_ms":       time.Since(reasoningStartedAt).Milliseconds(),
-										"total_elapsed_ms": requestElapsedMs(),
-									}
-									appendChatEvent("assistant", "reasoning.end", reasoningEndEvt)
-									if reasoningEndBytes, err := json.Marshal(reasoningEndEvt); err == nil {
-										emitStreamChunk(fmt.Sprintf("data: %s", string(reasoningEndBytes)))
-									}
-									reasoningAccumulatedMs = totalReasoningMs
-									reasoningActive = false
-									reasoningStartedAt = time.Time{}
-								}
-								fullResponse += content
-
-								// 🔍 Self-Evolution for Custom Format
-								if enableTools && toolPattern == nil && len(content) > 5 {
-									lc := strings.ToLower(content)
-									if strings.Contains(lc, "<|") ||
-										strings.Contains(lc, "function") ||
-										strings.Contains(lc, "tool") ||
-										strings.Contains(lc, "execute") ||
-										(strings.Contains(lc, "{\"") && strings.Contains(lc, "args")) {
-										log.Printf("[handleChat] Invalid tool pattern detected in content (Custom Format): %s", content)
-										needsCorrection = true
-										badContentCapture = content // Capture the snippet for the prompt
-									}
-								}
+	if strings.TrimSpace(requestedMode) != "" {
+		mode = requestedMode
+	}
 
-								eventPayload := map[string]interface{}{}
-								for key, value := range chunk {
-									eventPayload[key] = value
-								}
-								eventPayload["full_content"] = fullResponse
+	return normalizeLLMEndpoint(endpoint), sanitizeLLMToken(token), normalizeLLMMode(mode)
+}
 
-								// Forward to client identical to source
-								appendChatEvent("assistant", "message.delta", eventPayload)
-								emitStreamChunk(line)
-								continue
-							}
-						} else if msgType == "reasoning.start" || msgType == "reasoning.delta" || msgType == "reasoning.end" {
-							eventPayload := map[string]interface{}{}
-							for key, value := range chunk {
-								eventPayload[key] = value
-							}
-							switch msgType {
-							case "reasoning.start":
-								generationPhase = "thinking"
-								emitGenerationEvent("generation.phase", map[string]interface{}{"phase": generationPhase})
-								reasoningActive = true
-								reasoningStartedAt = time.Now()
-								eventPayload["started_at"] = reasoningStartedAt.Format(time.RFC3339Nano)
-								eventPayload["total_elapsed_ms"] = requestElapsedMs()
-							case "reasoning.delta":
-								if !generationFirstTokenEmitted {
-									generationFirstTokenEmitted = true
-									emitGenerationEvent("generation.first_token", map[string]interface{}{"phase": "thinking"})
-								}
-								if generationPhase != "thinking" {
-									generationPhase = "thinking"
-									emitGenerationEvent("generation.phase", map[string]interface{}{"phase": generationPhase})
-								}
-								if !reasoningActive {
-									reasoningActive = true
-									reasoningStartedAt = time.Now()
-								}
-								eventPayload["elapsed_ms"] = time.Since(reasoningStartedAt).Milliseconds()
-								eventPayload["total_elapsed_ms"] = requestElapsedMs()
-								reasoningDeltaText, _ := eventPayload["content"].(string)
-								if reasoningDeltaText == "" {
-									reasoningDeltaText, _ = eventPayload["reasoning_content"].(string)
-								}
-								if reasoningDeltaText == "" {
-									reasoningDeltaText, _ = eventPayload["text"].(string)
-								}
-								if recordReasoningDeltaAndCheckLoop(reasoningDeltaText) {
-									break streamScanLoop
-								}
-							case "reasoning.end":
-								if !reasoningActive {
-									reasoningActive = true
-									reasoningStartedAt = time.Now()
-								}
-								totalReasoningMs := reasoningAccumulatedMs + time.Since(reasoningStartedAt).Milliseconds()
-								eventPayload["elapsed_ms"] = time.Since(reasoningStartedAt).Milliseconds()
-								eventPayload["total_elapsed_ms"] = requestElapsedMs()
-								reasoningAccumulatedMs = totalReasoningMs
-								reasoningActive = false
-								reasoningStartedAt = time.Time{}
-							}
-							appendChatEvent("assistant", msgType, eventPayload)
-							if payloadBytes, err := json.Marshal(eventPayload); err == nil {
-								emitStreamChunk(fmt.Sprintf("data: %s", string(payloadBytes)))
-							} else {
-								emitStreamChunk(line)
-							}
-							continue
-						} else if msgType == "tool_call.arguments" {
-							if !enableTools {
-								continue
-							}
-							eventPayload := map[string]interface{}{}
-							for key, value := range chunk {
-								eventPayload[key] = value
-							}
+// requestedChatModel returns the "model" field of a chat request body.
+func requestedChatModel(body []byte) string {
+	var request struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &request)
+	return strings.TrimSpace(request.Model)
+}
 
-							providerCall, parsedArgs, hasProviderCall := chatharness.ParseProviderToolArgumentsEvent(chunk, pendingNativeToolName)
-							normalizedTool := strings.TrimSpace(providerCall.Name)
-							argsJSON := providerCall.Arguments
-							if isRegisteredPromptTool(normalizedTool, promptTools) {
-								toolExecutedThisTurn = true
-								lastToolName = normalizedTool
-								lastToolArgsStr = argsJSON
-								lastSavedBufferForTurn = fullResponse
-								lastToolCallID = providerCall.ID
-								eventPayload["tool"] = normalizedTool
-								eventPayload["arguments"] = parsedArgs
-							} else if hasProviderCall {
-								needsCorrection = true
-								badContentCapture = fmt.Sprintf("Unknown app tool %q with arguments %s", normalizedTool, argsJSON)
-							}
-							toolSig := normalizedTool + ":" + compactText(strings.TrimSpace(argsJSON), 240)
-							nativeToolSignatureCounts[toolSig]++
-							if normalizedTool == "execute_command" {
-								nativeExecuteCommandCount++
-								commandText := chatharness.ExtractExecuteCommandFromArgsJSON(argsJSON)
-								commandFamily := chatharness.ExecuteCommandBudgetFamily(commandText)
-								if commandFamily != "" {
-									nativeExecuteCommandFamilyCounts[commandFamily]++
-								}
-								if nativeExecuteCommandCount > 5 {
-									nativeToolLoopDetected = true
-									nativeToolLoopMessage = "execute_command already ran many times in this answer. Use the latest command results you already received and answer the user directly."
-								} else if commandFamily != "" && nativeExecuteCommandFamilyCounts[commandFamily] > 3 {
-									nativeToolLoopDetected = true
-									nativeToolLoopMessage = fmt.Sprintf("Too many execute_command calls were used for the same task family (%s). Use the latest command results you already received and answer the user directly.", commandFamily)
-								}
-								if nativeToolLoopDetected {
-									appendChatEvent("assistant", "tool_call.failure", map[string]interface{}{
-										"type":   "tool_call.failure",
-										"tool":   normalizedTool,
-										"reason": nativeToolLoopMessage,
-									})
-									AddDebugTrace("chat", "tool.loop", "Stopped native execute_command due to tool budget", map[string]interface{}{
-										"turn":    turn,
-										"tool":    normalizedTool,
-										"family":  commandFamily,
-										"command": compactText(commandText, 180),
-										"count":   nativeExecuteCommandCount,
-									})
-									break
-								}
-							}
+// replaceChatModel rewrites the "model" field when routing substituted a
+// fallback upstream's model.
+func replaceChatModel(body []byte, model string) []byte {
+	if model == "" || model == requestedChatModel(body) {
+		return body
+	}
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(body, &reqMap); err != nil {
+		return body
+	}
+	reqMap["model"] = model
+	if encoded, err := json.Marshal(reqMap); err == nil {
+		return encoded
+	}
+	return body
+}
 
-							appendChatEvent("assistant", msgType, eventPayload)
-							emitStreamChunk(line)
-							continue
-						} else if msgType == "tool_call.name" || msgType == "tool_call.start" || msgType == "tool_call.success" || msgType == "tool_call.failure" {
-							if !enableTools {
-								continue
-							}
-							if msgType == "tool_call.name" {
-								if nativeToolName, _ := chunk["tool_name"].(string); strings.TrimSpace(nativeToolName) != "" {
-									pendingNativeToolName = strings.TrimSpace(nativeToolName)
-								} else if nativeToolName, _ := chunk["tool"].(string); strings.TrimSpace(nativeToolName) != "" {
-									pendingNativeToolName = strings.TrimSpace(nativeToolName)
-								}
-							}
-							appendChatEvent("assistant", msgType, chunk)
-							emitStreamChunk(line)
-							continue
-						} else if msgType == "chat.end" || msgType == "message.end" {
-							log.Printf("[handleChat-DEBUG] Custom End Signal Received: %s", msgType)
-							if snippet, source, ok := detectReasoningPayloadRunawayRepetition(chunk); ok {
-								emitReasoningRunaway(snippet, source)
-								break streamScanLoop
-							}
+// upstreamUnavailable reports a failure worth retrying on another upstream:
+// the connection failed or the server answered 5xx.
+func upstreamUnavailable(err error) bool {
+	var statusErr *orchestrator.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	}
+	return err != nil
+}
 
-							// Capture response_id for chaining in stateful mode.
-							if strings.TrimSpace(dataStr) != "" {
-								var endPayload map[string]interface{}
-								if err := json.Unmarshal([]byte(dataStr), &endPayload); err == nil {
-									if res, ok := endPayload["result"].(map[string]interface{}); ok {
-										if rid, ok := res["response_id"].(string); ok && chatharness.IsValidResponseID(rid) && !discardStatefulResponseIDForTurn {
-											lastResponseID = strings.TrimSpace(rid)
-											sessionLastResponseID = lastResponseID
-											log.Printf("[handleChat] Captured response_id for chaining: %s", lastResponseID)
-										}
-										if stats, ok := res["stats"].(map[string]interface{}); ok {
-											if inputTokens, ok := stats["input_tokens"].(float64); ok && inputTokens > 0 {
-												statefulLastInputTokensValue = int(inputTokens)
-												if statefulPeakInputTokensValue < statefulLastInputTokensValue {
-													statefulPeakInputTokensValue = statefulLastInputTokensValue
-												}
-											}
-											if outputTokens, ok := stats["total_output_tokens"].(float64); ok && outputTokens > 0 {
-												statefulLastOutputTokensValue = int(outputTokens)
-											}
-										}
-									}
-								}
-							}
+// handleModels proxies model list requests to LLM server
+func handleModels(w http.ResponseWriter, r *http.Request, app *App, authMgr *AuthManager) {
+	// Add CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 
-							// LM Studio repeats the complete assistant message in chat.end.
-							// A textual tool call may therefore appear here even when its
-							// message.delta chunks were already quarantined. Parse a call
-							// that only exists in the terminal payload, then suppress the
-							// intermediate end event so the client cannot render it as the
-							// final assistant answer.
-							endContent := extractFinalAssistantContent(chunk)
-							if enableTools && !toolExecutedThisTurn && strings.TrimSpace(endContent) != "" {
-								if parsedTool, parsedArgsJSON, parsedArgs, _ := parsePromptToolMarkup(endContent); isRegisteredPromptTool(parsedTool, promptTools) {
-									toolExecutedThisTurn = true
-									lastToolName = parsedTool
-									lastToolArgsStr = parsedArgsJSON
-									lastSavedBufferForTurn = fullResponse
-									generationPhase = "tool_call"
-									emitGenerationEvent("generation.phase", map[string]interface{}{"phase": generationPhase, "tool": parsedTool})
-
-									startEvt := map[string]interface{}{"type": "tool_call.start", "tool": parsedTool}
-									startBytes, _ := json.Marshal(startEvt)
-									appendChatEvent("assistant", "tool_call.start", startEvt)
-									emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-
-									argsEvt := map[string]interface{}{"type": "tool_call.arguments", "tool": parsedTool, "arguments": parsedArgs}
-									argsBytes, _ := json.Marshal(argsEvt)
-									appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-									emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-								} else {
-									recognized, possiblePrefix := classifyPromptToolMarkup(endContent, promptTools)
-									if recognized || possiblePrefix || looksLikeToolMarkup(endContent) {
-										needsCorrection = true
-										badContentCapture = endContent
-									}
-								}
-							}
-							if enableTools && (toolExecutedThisTurn || needsCorrection) {
-								AddDebugTrace("chat", "tool.end_suppressed", "Suppressed intermediate LM Studio end payload containing tool markup", map[string]interface{}{
-									"turn":    turn,
-									"snippet": compactText(endContent, 220),
-								})
-								continue
-							}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-							appendChatEvent("assistant", msgType, chunk)
-							// Forward
-							emitStreamChunk(line)
-							continue
-						} else if msgType == "error" {
-							appendChatEvent("system", msgType, chunk)
-							handledToolFormatError := false
-							if errPayload, ok := chunk["error"].(map[string]interface{}); ok {
-								errType, _ := errPayload["type"].(string)
-								errMessage, _ := errPayload["message"].(string)
-								if errType == "tool_format_generation_error" {
-									handledToolFormatError = true
-									discardStatefulResponseIDForTurn = true
-									lastResponseID = ""
-									sessionLastResponseID = ""
-									if pendingNativeToolName != "" {
-										if repairedArgs, repaired := chatharness.RepairMissingReadWebPageArguments(pendingNativeToolName, "{}", initialUserInputText); repaired {
-											toolExecutedThisTurn = true
-											lastToolName = pendingNativeToolName
-											lastToolArgsStr = repairedArgs
-											lastSavedBufferForTurn = fullResponse
-											var parsedArgs interface{}
-											_ = json.Unmarshal([]byte(repairedArgs), &parsedArgs)
-											argsEvt := map[string]interface{}{
-												"type":      "tool_call.arguments",
-												"tool":      pendingNativeToolName,
-												"arguments": parsedArgs,
-												"recovered": true,
-											}
-											argsBytes, _ := json.Marshal(argsEvt)
-											appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-											emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-											AddDebugTrace("chat", "tool.arguments_repaired", "Recovered explicit current-turn URL after native tool format error", map[string]interface{}{
-												"turn":  turn,
-												"tool":  pendingNativeToolName,
-												"args":  compactText(repairedArgs, 240),
-												"error": compactText(errMessage, 180),
-											})
-										} else {
-											needsCorrection = true
-											badContentCapture = fmt.Sprintf("Native tool call parse error for %s: %s", pendingNativeToolName, errMessage)
-											AddDebugTrace("chat", "tool.error", "Native tool format error queued for self-correction instead of executing empty arguments", map[string]interface{}{
-												"turn":  turn,
-												"tool":  pendingNativeToolName,
-												"error": compactText(errMessage, 180),
-											})
-										}
-									} else {
-										needsCorrection = true
-										badContentCapture = fmt.Sprintf("Native tool call parse error: %s", errMessage)
-										failureEvt := map[string]interface{}{
-											"type":   "tool_call.failure",
-											"tool":   "Tool",
-											"reason": errMessage,
-										}
-										failureBytes, _ := json.Marshal(failureEvt)
-										appendChatEvent("assistant", "tool_call.failure", failureEvt)
-										emitStreamChunk(fmt.Sprintf("data: %s", string(failureBytes)))
-										AddDebugTrace("chat", "tool.error", "Tool format generation error queued for self-correction", map[string]interface{}{
-											"turn":  turn,
-											"error": compactText(errMessage, 180),
-										})
-									}
-								}
-							}
-							if !handledToolFormatError {
-								emitStreamChunk(line)
-							}
-							continue
-						} else {
-							appendChatEvent("system", msgType, chunk)
-							// Forward other events (start, progress, etc)
-							emitStreamChunk(line)
-							continue
-						}
-					}
+	if r.Method == http.MethodPost {
+		// Handle Model Load Request
+		var req struct {
+			Model string `json:"model"`
+			Mode  string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
 
-					// Buffer JSON wrappers emitted as assistant content. They are parsed
-					// after the stream closes so no fragment can leak to the frontend.
-					if enableTools && isBuffering && toolPattern == nil && looksLikeJSONToolCallPrefix(buffer) {
-						var content string
-						if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
-							if choice, ok := choices[0].(map[string]interface{}); ok {
-								if delta, ok := choice["delta"].(map[string]interface{}); ok {
-									content, _ = delta["content"].(string)
-								} else if message, ok := choice["message"].(map[string]interface{}); ok {
-									content, _ = message["content"].(string)
-								}
-							}
-						}
-						buffer += content
-						if len(buffer) > bufferingThreshold {
-							needsCorrection = true
-							badContentCapture = buffer
-							buffer = ""
-							isBuffering = false
-						}
-						continue
-					}
+		if req.Model == "" {
+			http.Error(w, "Model ID required", http.StatusBadRequest)
+			return
+		}
 
-					// --- B. Handle Tool Pattern Logic (if enabled and buffering) ---
-					if enableTools && toolPattern != nil && isBuffering {
-						// Extract content for buffering
-						var content string
-						if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
-							if choice, ok := choices[0].(map[string]interface{}); ok {
-								if delta, ok := choice["delta"].(map[string]interface{}); ok {
-									if c, ok := delta["content"].(string); ok {
-										content = c
-									} else if rc, ok := delta["reasoning_content"].(string); ok {
-										content = rc
-									} else if r, ok := delta["reasoning"].(string); ok {
-										content = r
-									}
-								} else if message, ok := choice["message"].(map[string]interface{}); ok {
-									if c, ok := message["content"].(string); ok {
-										content = c
-									}
-								}
-							}
-						}
-						buffer += content
-
-						if toolPattern["format"] == "text-tool" {
-							if parsedTool, parsedArgsJSON, parsedArgs, ok := parsePromptToolMarkup(buffer); ok && isRegisteredPromptTool(parsedTool, promptTools) {
-								toolExecutedThisTurn = true
-								lastToolName = parsedTool
-								lastToolArgsStr = parsedArgsJSON
-								lastSavedBufferForTurn = fullResponse
-								startEvt := map[string]interface{}{"type": "tool_call.start", "tool": parsedTool}
-								startBytes, _ := json.Marshal(startEvt)
-								appendChatEvent("assistant", "tool_call.start", startEvt)
-								emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-								argsEvt := map[string]interface{}{"type": "tool_call.arguments", "tool": parsedTool, "arguments": parsedArgs}
-								argsBytes, _ := json.Marshal(argsEvt)
-								appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-								emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-								buffer = ""
-								isBuffering = false
-								toolPattern = nil
-								continue
-							}
-							if hasPromptToolClosingTag(buffer, promptTools) {
-								needsCorrection = true
-								badContentCapture = buffer
-								buffer = ""
-								isBuffering = false
-								toolPattern = nil
-							}
-							continue
-						}
+		endpoint, token, mode := resolveModelAPIConfig(r, app, authMgr, req.Mode, req.Model)
+		if err := app.LoadModelWithConfig(req.Model, endpoint, token, mode); err != nil {
+			log.Printf("[handleModels] Load failed: %v", err)
+			http.Error(w, fmt.Sprintf("Failed to load model: %v", err), http.StatusBadGateway)
+			return
+		}
 
-						// Check Regex
-						matches := toolRegex.FindStringSubmatch(buffer)
-						if len(matches) > 2 {
-							// Match Found! (Group 1: Tool Name, Group 2: Args)
-							toolName = matches[1]
-							toolArgsStr = matches[2]
-
-							// 🛠️ Command-R / GPT-OSS Name Extraction
-							// If the tool name (Group 1) looks like a Command-R prefix, try to extract real name from "to=..."
-							if strings.Contains(toolName, "<|channel|>") {
-								reName := regexp.MustCompile(`to=([a-zA-Z0-9_]+)`)
-								nameMatch := reName.FindStringSubmatch(toolName)
-								if len(nameMatch) > 1 {
-									toolName = nameMatch[1]
-									// If generic "functions", we expect the JSON to have the real name (handled by Smart Parsing below)
-								}
-							}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "Model loaded"})
+		return
+	}
 
-							toolName, toolArgsStr, parsedArgs, isWrapper := normalizeBufferedToolMatch(toolName, toolArgsStr)
-							if isWrapper {
-								log.Printf("[handleChat] Detected Wrapper JSON format. Extracted Tool: %s", toolName)
-							}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-							log.Printf("[handleChat] Custom Tool Pattern Matched! Tool: %s", toolName)
+	// Try to fetch fresh models
+	var bodyBytes []byte
+	var err error
+	if app.upstreams.Enabled() {
+		bodyBytes, err = app.FetchAndCacheUpstreamModels(r.Context())
+	} else {
+		endpoint, token, mode := resolveModelAPIConfig(r, app, authMgr, r.URL.Query().Get("mode"), "")
+		bodyBytes, err = app.FetchAndCacheModelsWithConfig(endpoint, token, mode)
+	}
+	if err != nil {
+		log.Printf("[handleModels] Fetch failed: %v", err)
 
-							// 🛠️ Mark for execution after stream ends
-							toolExecutedThisTurn = true
-							lastToolName = toolName
-							lastToolArgsStr = toolArgsStr
+		// Fallback to cache if available
+		cached := app.GetCachedModels()
+		if cached != nil {
+			log.Printf("[handleModels] Returning cached models (fallback)")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Model-Source", "cache-fallback")
+			w.Write(cached)
+			return
+		}
 
-							// 1. Emit start event
-							startEvt := map[string]string{
-								"type": "tool_call.start",
-								"tool": toolName,
-							}
-							generationPhase = "tool_call"
-							emitGenerationEvent("generation.phase", map[string]interface{}{
-								"phase": generationPhase,
-								"tool":  toolName,
-							})
-							startBytes, _ := json.Marshal(startEvt)
-							appendChatEvent("assistant", "tool_call.start", startEvt)
-							emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-
-							// 2. Emit arguments event
-							if isWrapper {
-								argsEvt := map[string]interface{}{
-									"type":      "tool_call.arguments",
-									"tool":      toolName,
-									"arguments": parsedArgs,
-								}
-								argsBytes, _ := json.Marshal(argsEvt)
-								appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-								emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-							} else {
-								argsEvt := map[string]interface{}{
-									"type": "tool_call.arguments",
-									"tool": toolName,
-								}
-								if parsedArgs != nil {
-									argsEvt["arguments"] = parsedArgs
-									argsBytes, _ := json.Marshal(argsEvt)
-									appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-									emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-								} else {
-									argsEvt["arguments"] = toolArgsStr
-									appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-									emitStreamChunk(fmt.Sprintf("data: {\"type\": \"tool_call.arguments\", \"tool\": \"%s\", \"arguments\": %s}", toolName, toolArgsStr))
-								}
-							}
+		// No cache and fetch failed
+		http.Error(w, fmt.Sprintf("Failed to fetch models: %v", err), http.StatusBadGateway)
+		return
+	}
 
-							// 3. Clear Buffer & Stop Buffering
-							buffer = ""
-							isBuffering = false
-							continue // Tool call handled, move to next line
-						}
+	// Success
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Model-Source", "live")
+	w.Write(bodyBytes)
+}
 
-						if parsedTool, parsedArgsJSON, parsedArgs, ok := parseXMLLikeToolCall(buffer); ok {
-							toolName = parsedTool
-							toolArgsStr = parsedArgsJSON
+func handleModelUnload(w http.ResponseWriter, r *http.Request, app *App, authMgr *AuthManager) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 
-							log.Printf("[handleChat] XML-like Tool Pattern Matched! Tool: %s", toolName)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-							toolExecutedThisTurn = true
-							lastToolName = toolName
-							lastToolArgsStr = toolArgsStr
+	var req struct {
+		InstanceID string `json:"instance_id"`
+		Mode       string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
 
-							startEvt := map[string]string{
-								"type": "tool_call.start",
-								"tool": toolName,
-							}
-							generationPhase = "tool_call"
-							emitGenerationEvent("generation.phase", map[string]interface{}{
-								"phase": generationPhase,
-								"tool":  toolName,
-							})
-							startBytes, _ := json.Marshal(startEvt)
-							appendChatEvent("assistant", "tool_call.start", startEvt)
-							emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-
-							argsEvt := map[string]interface{}{
-								"type":      "tool_call.arguments",
-								"tool":      toolName,
-								"arguments": parsedArgs,
-							}
-							argsBytes, _ := json.Marshal(argsEvt)
-							appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-							emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
+	if strings.TrimSpace(req.InstanceID) == "" {
+		http.Error(w, "instance_id required", http.StatusBadRequest)
+		return
+	}
 
-							buffer = ""
-							isBuffering = false
-							continue
-						}
+	endpoint, token, mode := resolveModelAPIConfig(r, app, authMgr, req.Mode, req.InstanceID)
+	if err := app.UnloadModelWithConfig(req.InstanceID, endpoint, token, mode); err != nil {
+		log.Printf("[handleModelUnload] Unload failed: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to unload model: %v", err), http.StatusBadGateway)
+		return
+	}
 
-						if parsedTool, parsedArgsJSON, parsedArgs, ok := parseBareToolCallTag(buffer, initialUserInputText); ok {
-							toolName = parsedTool
-							toolArgsStr = parsedArgsJSON
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "Model unloaded"})
+}
 
-							log.Printf("[handleChat] Bare <tool_call> Pattern Matched! Tool: %s", toolName)
+// handleChat proxies chat requests to LM Studio with SSE streaming
+// handleChat proxies chat requests to LM Studio with SSE streaming
+func handleChat(w http.ResponseWriter, r *http.Request, app *App, authMgr *AuthManager) {
+	requestStart := time.Now()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-							toolExecutedThisTurn = true
-							lastToolName = toolName
-							lastToolArgsStr = toolArgsStr
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
 
-							startEvt := map[string]string{
-								"type": "tool_call.start",
-								"tool": toolName,
-							}
-							generationPhase = "tool_call"
-							emitGenerationEvent("generation.phase", map[string]interface{}{
-								"phase": generationPhase,
-								"tool":  toolName,
-							})
-							startBytes, _ := json.Marshal(startEvt)
-							appendChatEvent("assistant", "tool_call.start", startEvt)
-							emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-
-							argsEvt := map[string]interface{}{
-								"type":      "tool_call.arguments",
-								"tool":      toolName,
-								"arguments": parsedArgs,
-							}
-							argsBytes, _ := json.Marshal(argsEvt)
-							appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-							emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
+	var llmURL string
 
-							buffer = ""
-							isBuffering = false
-							continue
-						}
+	// Default configuration (Global)
+	endpointRaw := app.llmEndpoint
+	tokenRaw := app.llmApiToken
+	llmMode := app.llmMode
+	contextStrategy := defaultContextStrategyForMode(llmMode)
+	enableTools := app.enableTools
+	enableMemory := false // Default to false (Secure by default for unauthenticated)
 
-						// If buffer too long, assume no match and flush
-						if len(buffer) > bufferingThreshold {
-							// 🔍 Self-Correction Check
-							lowerBuf := strings.ToLower(buffer)
-							if (strings.Contains(lowerBuf, "function") || strings.Contains(lowerBuf, "call") || strings.Contains(lowerBuf, "tool")) &&
-								(strings.Contains(lowerBuf, "{") && strings.Contains(lowerBuf, "}")) {
-								log.Printf("[handleChat] Invalid tool pattern detected in buffer: %s", buffer)
-								needsCorrection = true
-								badContentCapture = buffer
-							}
+	var disabledTools []string
+	var locationInfo string
+	var disallowedCmds []string
+	var disallowedDirs []string
+	var commandSettings UserSettings
+	serverStatefulTurnLimitValue := 8
+	serverStatefulCharBudgetValue := 32000
+	serverStatefulTokenBudgetValue := 30000
 
-							if looksLikeToolMarkup(buffer) {
-								AddDebugTrace("chat", "tool.quarantine", "Suppressed oversized raw tool markup buffer", map[string]interface{}{
-									"snippet": compactText(buffer, 220),
-								})
-							} else {
-								// Flush buffer as regular content
-								payload := map[string]interface{}{
-									"choices": []interface{}{
-										map[string]interface{}{
-											"delta": map[string]string{
-												"content": buffer,
-											},
-										},
-									},
-								}
-								jsonBytes, _ := json.Marshal(payload)
-								emitStreamChunk(fmt.Sprintf("data: %s", string(jsonBytes)))
-								fullResponse += buffer // Add to full response
-							}
-							buffer = ""
-						}
-						continue // Buffering logic handled, move to next line
-					}
+	// Override with User Settings
+	userID := r.Header.Get("X-User-ID")
+	// Extract Client Location
+	locationInfo = r.Header.Get("X-User-Location")
+	clientTurnID := strings.TrimSpace(r.Header.Get("X-Client-Turn-Id"))
+	requestContextStrategy := strings.TrimSpace(r.Header.Get("X-Context-Strategy"))
+	statefulTurnCount := strings.TrimSpace(r.Header.Get("X-Stateful-Turn-Count"))
+	statefulEstChars := strings.TrimSpace(r.Header.Get("X-Stateful-Est-Chars"))
+	statefulSummaryChars := strings.TrimSpace(r.Header.Get("X-Stateful-Summary-Chars"))
+	statefulResetCount := strings.TrimSpace(r.Header.Get("X-Stateful-Reset-Count"))
+	statefulInputTokens := strings.TrimSpace(r.Header.Get("X-Stateful-Input-Tokens"))
+	statefulPeakInputTokens := strings.TrimSpace(r.Header.Get("X-Stateful-Peak-Input-Tokens"))
+	statefulTokenBudget := strings.TrimSpace(r.Header.Get("X-Stateful-Token-Budget"))
+	statefulRiskScore := strings.TrimSpace(r.Header.Get("X-Stateful-Risk-Score"))
+	statefulRiskLevel := strings.TrimSpace(r.Header.Get("X-Stateful-Risk-Level"))
+	statefulResetReason := strings.TrimSpace(r.Header.Get("X-Stateful-Reset-Reason"))
 
-					// --- C. Handle Standard OpenAI Format (if not custom and not tool-buffered) ---
-					if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
-						if choice, ok := choices[0].(map[string]interface{}); ok {
-							if delta, ok := choice["delta"].(map[string]interface{}); ok {
-								reasoningText := ""
-								if rc, ok := delta["reasoning_content"].(string); ok {
-									reasoningText = rc
-								} else if r, ok := delta["reasoning"].(string); ok {
-									reasoningText = r
-								}
-								if reasoningText != "" {
-									if !reasoningActive {
-										reasoningActive = true
-										reasoningStartedAt = time.Now()
-										appendChatEvent("assistant", "reasoning.start", map[string]interface{}{
-											"type":             "reasoning.start",
-											"started_at":       reasoningStartedAt.Format(time.RFC3339Nano),
-											"total_elapsed_ms": requestElapsedMs(),
-										})
-									}
-									if recordReasoningDeltaAndCheckLoop(reasoningText) {
-										break streamScanLoop
-									}
-									appendChatEvent("assistant", "reasoning.delta", map[string]interface{}{
-										"type":             "reasoning.delta",
-										"content":          reasoningText,
-										"elapsed_ms":       time.Since(reasoningStartedAt).Milliseconds(),
-										"total_elapsed_ms": requestElapsedMs(),
-									})
-								}
-								if c, ok := delta["content"].(string); ok {
-									if cleaned, changed := sanitizeLeakedModelChannelContent(c); changed {
-										if strings.TrimSpace(cleaned) == "" {
-											continue
-										}
-										c = cleaned
-										AddDebugTrace("chat", "channel.quarantine", "Stripped leaked model channel markup from assistant content", map[string]interface{}{
-											"snippet": compactText(c, 220),
-										})
-									}
-									if enableTools && !isBuffering {
-										candidate := c
-										if partialTagBuffer != "" {
-											candidate = partialTagBuffer + c
-										}
-										recognized, possiblePrefix := classifyPromptToolMarkup(candidate, promptTools)
-										if !recognized && possiblePrefix {
-											partialTagBuffer = candidate
-											continue
-										}
-										if recognized {
-											isBuffering = true
-											buffer = candidate
-											partialTagBuffer = ""
-											toolPattern = map[string]string{"format": "text-tool"}
-											continue
-										}
-										if len(fullResponse) < 50 && looksLikeJSONToolCallPrefix(candidate) {
-											c = candidate
-											partialTagBuffer = ""
-										} else if len(fullResponse) < 50 && looksLikeJSONToolCallPossiblePrefix(candidate) {
-											partialTagBuffer = candidate
-											continue
-										} else if partialTagBuffer != "" {
-											c = candidate
-											partialTagBuffer = ""
-										}
-									}
-									if enableTools && toolPattern == nil && !isBuffering && len(fullResponse) < 50 && looksLikeJSONToolCallPrefix(c) {
-										if reasoningActive {
-											totalReasoningMs := reasoningAccumulatedMs + time.Since(reasoningStartedAt).Milliseconds()
-											reasoningEndEvt := map[string]interface{}{
-												"type":             "reasoning.end",
-												"elapsed_ms":       time.Since(reasoningStartedAt).Milliseconds(),
-												"total_elapsed_ms": requestElapsedMs(),
-											}
-											appendChatEvent("assistant", "reasoning.end", reasoningEndEvt)
-											if reasoningEndBytes, err := json.Marshal(reasoningEndEvt); err == nil {
-												emitStreamChunk(fmt.Sprintf("data: %s", string(reasoningEndBytes)))
-											}
-											reasoningAccumulatedMs = totalReasoningMs
-											reasoningActive = false
-											reasoningStartedAt = time.Time{}
-										}
-										log.Printf("[handleChat] Detected JSON tool wrapper before assistant content emission. Switching to buffering mode.")
-										isBuffering = true
-										buffer = c
-										continue
-									}
-									if !generationFirstTokenEmitted {
-										generationFirstTokenEmitted = true
-										emitGenerationEvent("generation.first_token", map[string]interface{}{"phase": "answering"})
-									}
-									if generationPhase != "answering" {
-										generationPhase = "answering"
-										emitGenerationEvent("generation.phase", map[string]interface{}{"phase": generationPhase})
-									}
-									if reasoningActive {
-										totalReasoningMs := reasoningAccumulatedMs + time.Since(reasoningStartedAt).Milliseconds()
-										reasoningEndEvt := map[string]interface{}{
-											"type":             "reasoning.end",
-											"elapsed_ms":       time.Since(reasoningStartedAt).Milliseconds(),
-											"total_elapsed_ms": requestElapsedMs(),
-										}
-										appendChatEvent("assistant", "reasoning.end", reasoningEndEvt)
-										if reasoningEndBytes, err := json.Marshal(reasoningEndEvt); err == nil {
-											emitStreamChunk(fmt.Sprintf("data: %s", string(reasoningEndBytes)))
-										}
-										reasoningAccumulatedMs = totalReasoningMs
-										reasoningActive = false
-										reasoningStartedAt = time.Time{}
-									}
-									fullResponse += c
-									appendChatEvent("assistant", "message.delta", map[string]interface{}{
-										"type":         "message.delta",
-										"content":      c,
-										"full_content": fullResponse,
-									})
-								}
-							}
-						}
-					}
+	chatCtx, chatCancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer chatCancel()
+	if strings.TrimSpace(userID) != "" {
+		registerCurrentChatCancel(userID, chatCancel)
+		defer unregisterCurrentChatCancel(userID)
+	}
 
-					// --- D. Self-Correction for non-buffered models ---
-					// This block was previously in an `else if strings.HasPrefix(strings.TrimSpace(line), "data: ")`
-					// It should now be integrated here, after content extraction but before forwarding.
-					if toolPattern == nil { // Only if no tool pattern is active
-						var content string
-						if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
-							if choice, ok := choices[0].(map[string]interface{}); ok {
-								if delta, ok := choice["delta"].(map[string]interface{}); ok {
-									if c, ok := delta["content"].(string); ok {
-										content = c
-									} else if rc, ok := delta["reasoning_content"].(string); ok {
-										content = rc
-									} else if r, ok := delta["reasoning"].(string); ok {
-										content = r
-									}
-								}
-							}
-						}
-						if cleaned, changed := sanitizeLeakedModelChannelContent(content); changed {
-							content = cleaned
-						}
+	if userID != "" {
+		authMgr.mu.RLock()
+		user := authMgr.users[userID]
+		authMgr.mu.RUnlock()
+		if user != nil {
+			if user.Settings.ApiToken != nil {
+				tokenRaw = *user.Settings.ApiToken
+			}
+			if user.Settings.LLMMode != nil {
+				llmMode = *user.Settings.LLMMode
+			}
+			contextStrategy = defaultContextStrategyForMode(llmMode)
+			if user.Settings.ContextStrategy != nil {
+				contextStrategy = normalizeContextStrategyForMode(llmMode, *user.Settings.ContextStrategy)
+			}
+			if user.Settings.EnableTools != nil {
+				enableTools = *user.Settings.EnableTools
+			}
+			if user.Settings.EnableMemory != nil {
+				enableMemory = *user.Settings.EnableMemory
+			} else {
+				enableMemory = true // Default to true for authenticated users
+			}
+			if user.Settings.DisabledTools != nil {
+				disabledTools = expandDisabledToolAliases(user.Settings.DisabledTools)
+			}
+			if user.Settings.DisallowedCommands != nil {
+				disallowedCmds = user.Settings.DisallowedCommands
+			}
+			if user.Settings.DisallowedDirectories != nil {
+				disallowedDirs = user.Settings.DisallowedDirectories
+			}
+			commandSettings = user.Settings
+			if user.Settings.StatefulTurnLimit != nil && *user.Settings.StatefulTurnLimit > 0 {
+				serverStatefulTurnLimitValue = *user.Settings.StatefulTurnLimit
+			}
+			if user.Settings.StatefulCharBudget != nil && *user.Settings.StatefulCharBudget > 0 {
+				serverStatefulCharBudgetValue = *user.Settings.StatefulCharBudget
+			}
+			if user.Settings.StatefulTokenBudget != nil && *user.Settings.StatefulTokenBudget > 0 {
+				serverStatefulTokenBudgetValue = *user.Settings.StatefulTokenBudget
+			}
+		}
+	}
+	// An API key without memory:read gets a chat without memory retrieval or
+	// memory tools.
+	enableMemory = enableMemory && requestHasScope(r, APIKeyScopeMemoryRead)
+	// With upstreams configured the requested model picks the server; user
+	// token and mode overrides only apply to the single llmEndpoint.
+	var activeUpstream upstream.Target
+	var failoverUpstreams []upstream.Target
+	if targets := app.upstreams.Route(requestedChatModel(body)); len(targets) > 0 {
+		activeUpstream = targets[0]
+		endpointRaw, tokenRaw = activeUpstream.Endpoint, activeUpstream.Token
+		if llmMode != activeUpstream.Mode {
+			llmMode = activeUpstream.Mode
+			contextStrategy = normalizeContextStrategyForMode(llmMode, contextStrategy)
+		}
+		for _, target := range targets[1:] {
+			// Failover resends the prepared request, so only upstreams
+			// speaking the same wire format qualify.
+			if target.Mode == llmMode {
+				failoverUpstreams = append(failoverUpstreams, target)
+			}
+		}
+		body = replaceChatModel(body, activeUpstream.Model)
+		AddDebugTrace("chat", "upstream.route", "Routed chat request to upstream", map[string]interface{}{
+			"upstream":  activeUpstream.Name,
+			"model":     activeUpstream.Model,
+			"mode":      llmMode,
+			"failovers": len(failoverUpstreams),
+		})
+	}
+	if requestContextStrategy != "" {
+		contextStrategy = normalizeContextStrategyForMode(llmMode, requestContextStrategy)
+	}
+	toolExecCtx := toolruntime.ExecutionContext{
+		RequestID:             clientTurnID,
+		UserID:                userID,
+		EnableMemory:          enableMemory,
+		LocationInfo:          locationInfo,
+		DisabledTools:         disabledTools,
+		DisallowedCommands:    disallowedCmds,
+		DisallowedDirectories: disallowedDirs,
+		Scopes:                requestScopes(r),
+	}
+	applyCommandSandboxSettings(&toolExecCtx, commandSettings)
+	applyToolApprovalSettings(&toolExecCtx, commandSettings)
+	log.Printf("[handleChat-DEBUG] userID=%s, enableMemory=%v, disabledTools=%v, Location=%s, DisallowedCmds=%v, DisallowedDirs=%v", userID, enableMemory, disabledTools, locationInfo, disallowedCmds, disallowedDirs)
+	AddDebugTrace("chat", "request.context", "Resolved chat execution context", map[string]interface{}{
+		"user":                userID,
+		"memory":              enableMemory,
+		"disabled_tools":      len(disabledTools),
+		"disallowed_cmds":     len(disallowedCmds),
+		"disallowed_dirs":     len(disallowedDirs),
+		"location":            compactText(locationInfo, 80),
+		"context_strategy":    contextStrategy,
+		"stateful_turns":      statefulTurnCount,
+		"stateful_chars":      statefulEstChars,
+		"summary_chars":       statefulSummaryChars,
+		"input_tokens":        statefulInputTokens,
+		"peak_tokens":         statefulPeakInputTokens,
+		"token_budget":        statefulTokenBudget,
+		"risk_score":          statefulRiskScore,
+		"risk_level":          statefulRiskLevel,
+		"server_turn_limit":   serverStatefulTurnLimitValue,
+		"server_char_budget":  serverStatefulCharBudgetValue,
+		"server_token_budget": serverStatefulTokenBudgetValue,
+	})
+	if statefulResetReason != "" {
+		AddDebugTrace("stateful", "reset", "Stateful conversation was compacted or reset", map[string]interface{}{
+			"user":         userID,
+			"reason":       statefulResetReason,
+			"turns_before": statefulTurnCount,
+			"chars_before": statefulEstChars,
+			"reset_count":  statefulResetCount,
+		})
+	}
 
-						// 🧪 Special Handling for Command-R / GPT-OSS Format (<|channel|>)
-						if enableTools && !isBuffering && (looksLikeChannelToolMarkup(content) || strings.Contains(content, "<|tool_code|>") || strings.Contains(content, "<tool_call>") || strings.Contains(content, "<execute_command") || strings.Contains(content, "<search_memory") || strings.Contains(content, "<read_memory") || strings.Contains(content, "<read_memory_context") || strings.Contains(content, "<read_buffered_source") || strings.Contains(content, "<read_help")) {
-							log.Printf("[handleChat] Detected Command-R/GPT-OSS/Qwen Tool Call Pattern. Switching to buffering mode.")
-							isBuffering = true
-							buffer = content
-
-							if strings.Contains(content, "<tool_call>") {
-								// Qwen Style: <tool_call>{JSON}</tool_call>
-								toolPattern = map[string]string{"format": "qwen"}
-								// Regex: optional explicit tool name + JSON/relaxed-JSON arguments object
-								toolRegex = regexp.MustCompile(`(?s)<tool_call>\s*(?:([a-zA-Z0-9_]+)\s*)?(\{[\s\S]*?\})\s*</tool_call>\s*\{?`)
-							} else {
-								// Command-R / GPT-OSS Style
-								// Define a regex that captures the prefix as Group 1 (ignored) and the JSON as Group 2
-								// Pattern: <|channel|>...<|message|> { JSON }
-								toolPattern = map[string]string{"format": "command-r"}
-								toolRegex = regexp.MustCompile(`(?s)(<\|channel\|>.*?<\|message\|>)\s*(\{[\s\S]*\})`)
-							}
-							continue
-						}
+	var reqMap map[string]interface{}
+	// Always unmarshal body into reqMap to prevent nil panics later in the turn loop
+	json.Unmarshal(body, &reqMap)
+	responseFormat, err := chatharness.ParseResponseFormat(reqMap)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid response_format: %v", err), http.StatusBadRequest)
+		return
+	}
+	if responseFormat != nil {
+		// Tool calls, memory and skills would compete with the requested
+		// format, so a structured request runs as a plain completion.
+		enableTools = false
+		AddDebugTrace("chat", "response_format.requested", "Client requested structured output", map[string]interface{}{
+			"type":   responseFormat.Type,
+			"name":   responseFormat.Name,
+			"native": responseFormat.NativeFor(llmMode),
+		})
+	}
+	initialUserInputText := extractChatInputText(reqMap)
+	toolExecCtx.FreshResults = wantsFreshToolResults(r.Header.Get("X-Fresh-Results"), initialUserInputText)
+	incomingPreviousResponseID := extractStringValue(reqMap, []string{"previous_response_id"})
+	chainsResponses := chatharness.ChainsResponses(llmMode)
+	if chainsResponses && incomingPreviousResponseID != "" && !chatharness.IsValidResponseID(incomingPreviousResponseID) {
+		delete(reqMap, "previous_response_id")
+		body, _ = json.Marshal(reqMap)
+		incomingPreviousResponseID = ""
+	} else if chainsResponses && chatharness.IsValidResponseID(incomingPreviousResponseID) {
+		incomingPreviousResponseID = strings.TrimSpace(incomingPreviousResponseID)
+		reqMap["previous_response_id"] = incomingPreviousResponseID
+		body, _ = json.Marshal(reqMap)
+	}
+	hasPreviousResponseID := chainsResponses && chatharness.IsValidResponseID(incomingPreviousResponseID)
+	if !hasPreviousResponseID && chainsResponses && strings.TrimSpace(userID) != "" {
+		if existingSession, err := mcp.GetCurrentChatSession(userID); err == nil && chatharness.IsValidResponseID(existingSession.LastResponseID) {
+			hasPreviousResponseID = true
+		}
+	}
+	AddDebugTrace("chat", "request.received", "Incoming chat request", map[string]interface{}{
+		"user":       userID,
+		"body_bytes": len(body),
+		"messages":   lenInterfaceSlice(reqMap["messages"]),
+		"__payload":  prettyJSONForDebug(body),
+	})
 
-						// 🔍 Self-Correction for non-buffered models
-						if enableTools && len(content) > 5 {
-							lc := strings.ToLower(content)
-							// Broaden trigger keywords: <|, function, tool, execute, {"name":, and tool names
-							hasToolName := strings.Contains(lc, "search_web") ||
-								strings.Contains(lc, "personal_memory") ||
-								strings.Contains(lc, "read_user_document") ||
-								strings.Contains(lc, "read_web_page") ||
-								strings.Contains(lc, "read_buffered_source") ||
-								strings.Contains(lc, "read_help")
-
-							if strings.Contains(lc, "<|") ||
-								strings.Contains(lc, "function") ||
-								strings.Contains(lc, "tool") ||
-								strings.Contains(lc, "execute") ||
-								hasToolName ||
-								(strings.Contains(lc, "{\"") && strings.Contains(lc, "args")) {
-
-								// 🧬 Anti-Recursion & Meta-Content Filter
-								// We want to skip learning if the content is:
-								// 1. A regex definition (has "(?s)", "regex")
-								// 2. A code block explanation of a tool call (has "tool_call[")
-								// 3. A JSON definition inside a markdown block (often starts with ```json) - though hard to detect in fragments
-								// 4. Broken/Partial JSON that is clearly just text discussion
-								if strings.Contains(lc, "(?s)") ||
-									strings.Contains(lc, "regex") ||
-									strings.Contains(lc, "tool_call[") || // Catch array/map access style which is code, not natural language
-									strings.Contains(lc, "tool_call [") ||
-									strings.Contains(lc, "```") {
-									log.Printf("[handleChat] Self-Correction trigger skipped: detected meta-content (regex/code)")
-								} else {
-									// Double check: if it's just a tool name mention without execution context, skip
-									// Real execution usually involves JSON-like structure "{" or special tokens "<|"
-									isRealExecution := strings.Contains(lc, "<|") || (strings.Contains(lc, "{") && strings.Contains(lc, ":"))
-
-									if isRealExecution {
-										log.Printf("[handleChat] Invalid tool pattern detected in content: %s", content)
-										// 🛡️ Mark for Self-Correction
-										needsCorrection = true
-										badContentCapture = content // Capture the snippet for the prompt
-									} else {
-										// If it's just a word "tool" or "function" without structure, ignore
-									}
+	memorySnapshot := ""
+	autoContext := ""
+	recentContext := ""
+	recentContextTurns := 0
+	recentContextSource := ""
+	memorySnapshotDebug := mcp.MemorySnapshotDebug{}
+	autoContextDebug := mcp.AutoSearchMemoryDebug{}
+	if enableMemory && contextStrategy == "retrieval" && responseFormat == nil {
+		recentContext, recentContextTurns, recentContextSource = getRecentConversationContext(userID)
+		if hasPreviousResponseID {
+			recentContext = compactRecentTurnContent(recentContext, recentContextStatefulBudget)
+			recentContextSource += "+stateful_compact"
+		} else {
+			preferRecentContext := strings.TrimSpace(recentContext) != "" && chatharness.IsLikelyContextualFollowup(initialUserInputText)
+			if !preferRecentContext {
+				memorySnapshotDebug = mcp.GetMemorySnapshotDebug(userID)
+				memorySnapshot = memorySnapshotDebug.Text
+			}
+			if !preferRecentContext {
+				if messages, ok := reqMap["messages"].([]interface{}); ok && len(messages) > 0 {
+					for i := len(messages) - 1; i >= 0; i-- {
+						if m, ok := messages[i].(map[string]interface{}); ok {
+							if role, ok := m["role"].(string); ok && role == "user" {
+								if content, ok := m["content"].(string); ok {
+									autoContextDebug = mcp.AutoSearchMemoryDebugQuery(userID, content)
+									autoContext = compactText(autoContextDebug.Context, 1200)
+									break
 								}
 							}
 						}
 					}
 				}
-
-				// Native provider deltas are converted into the app's canonical tool events
-				// after all argument fragments have been accumulated.
-				if hasNativeToolDelta {
-					continue
-				}
-
-				// Forward the line (if not already continued by custom format or tool logic)
-				emitStreamChunk(line)
-
 			} else {
-				// Check for raw error JSON (not prefixed with data:)
-				// e.g. {"error":{"message":"Context size has been exceeded.",...}}
-				if strings.HasPrefix(line, "{") && strings.Contains(line, "\"error\"") {
-					log.Printf("[handleChat] Detected Raw JSON Error in stream: %s", line)
-					if strings.Contains(line, "Context size has been exceeded") || strings.Contains(line, "context_length_exceeded") {
-						if strings.TrimSpace(reasoningResponse) != "" && !reasoningOnlyFinalRecoveryUsed && turn < maxToolTurns-1 {
-							log.Printf("[handleChat] Context exceeded during reasoning. Attempting recovery from summarized reasoning...")
-							break
-						}
-						// Send explicit known error event
-						// We use a custom event type or just an error field that app.js will pick up
-						emitStreamChunk("data: {\"error\": \"LM_STUDIO_CONTEXT_ERROR: Context size exceeded.\"}")
-						return // Stop processing
-					}
-				}
-
-				// Forward non-data lines (e.g. event: ...)
-				emitStreamChunk(line)
+				recentContextSource += "+followup_priority"
+				AddDebugTrace("chat", "context.followup_priority", "Suppressed broad memory retrieval for a contextual follow-up", map[string]interface{}{
+					"user_input":           compactText(initialUserInputText, 180),
+					"recent_context_turns": recentContextTurns,
+				})
 			}
 		}
+	}
 
-		resp.Body.Close() // Explicit close after scanner is done with this turn
-
-		if enableTools && chatToolCalls.HasCalls() {
-			calls := chatToolCalls.Calls()
-			if len(calls) > 0 {
-				call := calls[0]
-				toolExecutedThisTurn = true
-				lastToolCallID = call.ID
-				lastToolName = call.Name
-				lastToolArgsStr = call.Arguments
-				lastSavedBufferForTurn = fullResponse
-
-				startEvt := map[string]interface{}{
-					"type":    "tool_call.start",
-					"tool":    lastToolName,
-					"call_id": lastToolCallID,
-				}
-				startBytes, _ := json.Marshal(startEvt)
-				appendChatEvent("assistant", "tool_call.start", startEvt)
-				emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-
-				var parsedArguments interface{} = map[string]interface{}{}
-				if err := json.Unmarshal([]byte(lastToolArgsStr), &parsedArguments); err != nil {
-					parsedArguments = lastToolArgsStr
-				}
-				argsEvt := map[string]interface{}{
-					"type":      "tool_call.arguments",
-					"tool":      lastToolName,
-					"call_id":   lastToolCallID,
-					"arguments": parsedArguments,
-				}
-				argsBytes, _ := json.Marshal(argsEvt)
-				appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-				emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-
-				if len(calls) > 1 {
-					AddDebugTrace("chat", "tool.multiple", "Provider returned multiple tool calls; executing the first because sequential mode is active", map[string]interface{}{
-						"turn":  turn,
-						"count": len(calls),
-					})
-				}
-			}
+	// Load structured user profile facts (always, not dependent on context strategy)
+	userProfileFacts := ""
+	if enableMemory && strings.TrimSpace(userID) != "" && responseFormat == nil {
+		userProfileFacts = mcp.FormatUserProfileForPrompt(userID)
+		if strings.TrimSpace(userProfileFacts) != "" {
+			log.Printf("[handleChat] Loaded %d chars of user profile facts for %s", len(userProfileFacts), userID)
 		}
+	}
+	if contextStrategy == "retrieval" {
+		AddDebugTrace("chat", "context.retrieval", "Collected retrieval context for prompt injection", map[string]interface{}{
+			"user":                     userID,
+			"mode":                     llmMode,
+			"memory_enabled":           enableMemory,
+			"tools_enabled":            enableTools,
+			"recent_context_chars":     len([]rune(strings.TrimSpace(recentContext))),
+			"recent_context_empty":     strings.TrimSpace(recentContext) == "",
+			"recent_context_preview":   compactText(recentContext, 420),
+			"recent_context_turns":     recentContextTurns,
+			"recent_context_source":    recentContextSource,
+			"memory_snapshot_chars":    len([]rune(strings.TrimSpace(memorySnapshot))),
+			"active_context_chars":     len([]rune(strings.TrimSpace(autoContext))),
+			"memory_snapshot_empty":    strings.TrimSpace(memorySnapshot) == "",
+			"active_context_empty":     strings.TrimSpace(autoContext) == "",
+			"memory_snapshot_preview":  compactText(memorySnapshot, 320),
+			"active_context_preview":   compactText(autoContext, 320),
+			"recent_memories_count":    memorySnapshotDebug.MemoryCount,
+			"recent_saved_turns_count": memorySnapshotDebug.SavedTurnCount,
+			"retrieved_memories_count": autoContextDebug.RetrievedMemoriesCount,
+			"saved_turn_hits":          autoContextDebug.SavedTurnHits,
+			"chunk_match_count":        autoContextDebug.ChunkMatchCount,
+			"used_synthesis":           autoContextDebug.UsedSynthesis,
+			"__payload": map[string]interface{}{
+				"kind":                  "retrieval_context",
+				"context_strategy":      contextStrategy,
+				"recent_context":        recentContext,
+				"memory_snapshot":       memorySnapshot,
+				"memory_snapshot_full":  memorySnapshotDebug.RawText,
+				"active_context":        autoContext,
+				"active_context_full":   autoContextDebug.RawContext,
+				"memory_snapshot_debug": memorySnapshotDebug,
+				"active_context_debug":  autoContextDebug,
+				"recent_context_turns":  recentContextTurns,
+				"recent_context_source": recentContextSource,
+			},
+		})
+	}
 
-		if nativeToolLoopDetected {
-			AddDebugTrace("chat", "turn.complete", "Turn stopped due to native tool loop", map[string]interface{}{
-				"turn":           turn,
-				"elapsed_ms":     time.Since(turnStart).Milliseconds(),
-				"reason":         compactText(nativeToolLoopMessage, 200),
-				"response_chars": len(fullResponse),
+	var skillCompilation skillkit.Compilation
+	if responseFormat == nil {
+		skillCompilation = compileActiveSkills(initialUserInputText)
+	}
+	selectedSkillNames := make([]string, 0, len(skillCompilation.Selected))
+	selectedSkillEvents := make([]map[string]string, 0, len(skillCompilation.Selected))
+	for _, skill := range skillCompilation.Selected {
+		selectedSkillNames = append(selectedSkillNames, skill.Namespace)
+		selectedSkillEvents = append(selectedSkillEvents, map[string]string{
+			"namespace":    skill.Namespace,
+			"name":         skill.Name,
+			"display_name": skill.DisplayName,
+		})
+	}
+	AddDebugTrace("chat", "skills.selected", "Selected request-relevant skills", map[string]interface{}{
+		"discovered":        skillCompilation.Discovered,
+		"selected":          selectedSkillNames,
+		"selected_count":    len(selectedSkillNames),
+		"diagnostic_count":  len(skillCompilation.Diagnostics),
+		"instruction_chars": len([]rune(skillCompilation.Prompt)),
+	})
+	if enableTools {
+		// Tools shipped by the selected skills exist only for this request.
+		skillToolDefinitions, releaseSkillTools, skillToolErrs := toolruntime.DefaultSkillTools.Activate(skillCompilation.Selected)
+		defer releaseSkillTools()
+		for _, skill := range skillCompilation.Selected {
+			toolExecCtx.ActiveSkills = append(toolExecCtx.ActiveSkills, skill.Namespace)
+		}
+		for _, skillToolErr := range skillToolErrs {
+			log.Printf("[Skills] %v", skillToolErr)
+		}
+		if len(skillToolDefinitions) > 0 || len(skillToolErrs) > 0 {
+			skillToolNames := make([]string, 0, len(skillToolDefinitions))
+			for _, definition := range skillToolDefinitions {
+				skillToolNames = append(skillToolNames, definition.Name)
+			}
+			AddDebugTrace("chat", "skills.tools", "Registered tools from selected skills", map[string]interface{}{
+				"tools":  skillToolNames,
+				"errors": len(skillToolErrs),
 			})
-			break
 		}
-
-		if reasoningRunawayDetected {
-			AddDebugTrace("chat", "turn.complete", "Turn stopped due to repetitive reasoning", map[string]interface{}{
-				"turn":           turn,
-				"elapsed_ms":     time.Since(turnStart).Milliseconds(),
-				"reason":         compactText(reasoningRunawayMessage, 200),
-				"response_chars": len(fullResponse),
+	}
+	var promptTools []promptkit.ToolDefinition
+	if enableTools {
+		for _, definition := range toolruntime.Default.List(toolExecCtx) {
+			promptTools = append(promptTools, promptkit.ToolDefinition{
+				Name:         definition.Name,
+				Description:  definition.Description,
+				InputSchema:  definition.InputSchema,
+				ParallelSafe: definition.Metadata.ParallelSafe,
 			})
-			break
 		}
+	}
+
+	preparedRequest, err := chatharness.PrepareRequest(chatharness.RequestInput{
+		Body:              body,
+		EndpointRaw:       endpointRaw,
+		TokenRaw:          tokenRaw,
+		LLMMode:           llmMode,
+		ContextStrategy:   contextStrategy,
+		EnableTools:       enableTools,
+		EnableMemory:      enableMemory,
+		RecentContext:     recentContext,
+		MemorySnapshot:    memorySnapshot,
+		ActiveContext:     autoContext,
+		RetrievalInjected: strings.TrimSpace(recentContext) != "" || strings.TrimSpace(memorySnapshot) != "" || strings.TrimSpace(autoContext) != "",
+		UserProfileFacts:  userProfileFacts,
+		SkillInstructions: skillCompilation.Prompt,
+		Tools:             promptTools,
+		ResponseFormat:    responseFormat,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to prepare chat request: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if preparedRequest.IsStatefulFollowup {
+		log.Println("[handleChat] Detected follow-up stateful turn, skipping redundant system prompt (maintaining tools)")
+	}
+	if preparedRequest.InjectedPrompt {
+		log.Println("[handleChat] Injected or deduplicated System Prompt instructions")
+	}
+	if !enableTools {
+		log.Printf("[handleChat] App tools disabled (Mode=%s, ContextStrategy=%s)", llmMode, contextStrategy)
+	}
+
+	body = preparedRequest.Body
+	reqMap = preparedRequest.ReqMap
+	providerTools, _ := reqMap["tools"].([]interface{})
+	providerParallelToolCalls, _ := reqMap["parallel_tool_calls"].(bool)
+	initialUserInputText = preparedRequest.InitialUserInputText
+	endpoint := preparedRequest.Endpoint
+	token := preparedRequest.Token
+	llmURL = preparedRequest.UpstreamURL
+	modelID := preparedRequest.ModelID
+	providerAdapter := chatharness.AdapterFor(llmMode)
+	log.Printf("[handleChat] User: %s, Mode: %s, Endpoint: %s, URL: %s", userID, llmMode, endpoint, llmURL)
+	AddDebugTrace("chat", "request.prepared", "Prepared upstream LLM request", map[string]interface{}{
+		"user":                     userID,
+		"mode":                     llmMode,
+		"context_strategy":         contextStrategy,
+		"model":                    modelID,
+		"upstream":                 activeUpstream.Name,
+		"url":                      llmURL,
+		"body_bytes":               len(body),
+		"injected_prompt":          preparedRequest.InjectedPrompt,
+		"selected_skills":          selectedSkillNames,
+		"stateful_followup":        preparedRequest.IsStatefulFollowup,
+		"memory_snapshot_chars":    len([]rune(strings.TrimSpace(memorySnapshot))),
+		"active_context_chars":     len([]rune(strings.TrimSpace(autoContext))),
+		"memory_snapshot_preview":  compactText(memorySnapshot, 220),
+		"active_context_preview":   compactText(autoContext, 220),
+		"retrieved_memories_count": autoContextDebug.RetrievedMemoriesCount,
+		"saved_turn_hits":          autoContextDebug.SavedTurnHits,
+		"chunk_match_count":        autoContextDebug.ChunkMatchCount,
+		"__payload": map[string]interface{}{
+			"kind":                 "prepared_request_context",
+			"context_strategy":     contextStrategy,
+			"recent_context":       recentContext,
+			"memory_snapshot":      memorySnapshot,
+			"memory_snapshot_full": memorySnapshotDebug.RawText,
+			"active_context":       autoContext,
+			"active_context_full":  autoContextDebug.RawContext,
+		},
+		"stateful_turns": statefulTurnCount,
+		"stateful_chars": statefulEstChars,
+		"input_tokens":   statefulInputTokens,
+		"peak_tokens":    statefulPeakInputTokens,
+		"token_budget":   statefulTokenBudget,
+		"risk_score":     statefulRiskScore,
+		"risk_level":     statefulRiskLevel,
+	})
+
+	parseIntHeader := func(value string) int {
+		parsed, _ := strconv.Atoi(strings.TrimSpace(value))
+		return parsed
+	}
+
+	statefulTurnCountValue := 0
+	statefulEstimatedCharsValue := 0
+	statefulResetCountValue := 0
+	statefulLastInputTokensValue := 0
+	statefulPeakInputTokensValue := 0
+	statefulTokenBudgetValue := serverStatefulTokenBudgetValue
+	statefulRiskScoreValue := 0.0
+	statefulRiskLevelValue := "low"
+	statefulLastOutputTokensValue := 0
+	statefulSummaryText := ""
 
-		// Recover local models that print a JSON tool wrapper as assistant text
-		// instead of using the provider's native function-call field.
-		if enableTools && isBuffering {
-			if parsedTool, parsedArgsJSON, parsedArgs, ok := parseJSONToolCall(buffer); ok {
-				if isRegisteredPromptTool(parsedTool, promptTools) {
-					log.Printf("[handleChat] Recovered JSON Tool Call: %s", parsedTool)
-					toolExecutedThisTurn = true
-					lastToolName = parsedTool
-					lastToolArgsStr = parsedArgsJSON
-					lastSavedBufferForTurn = fullResponse
-
-					startEvt := map[string]interface{}{"type": "tool_call.start", "tool": parsedTool}
-					startBytes, _ := json.Marshal(startEvt)
-					appendChatEvent("assistant", "tool_call.start", startEvt)
-					emitStreamChunk(fmt.Sprintf("data: %s", string(startBytes)))
-
-					argsEvt := map[string]interface{}{"type": "tool_call.arguments", "tool": parsedTool, "arguments": parsedArgs}
-					argsBytes, _ := json.Marshal(argsEvt)
-					appendChatEvent("assistant", "tool_call.arguments", argsEvt)
-					emitStreamChunk(fmt.Sprintf("data: %s", string(argsBytes)))
-
-					buffer = ""
-					isBuffering = false
-				} else {
-					needsCorrection = true
-					badContentCapture = buffer
-				}
-			}
-		}
+	if strings.TrimSpace(statefulResetReason) != "" {
+		statefulResetCountValue = parseIntHeader(statefulResetCount)
+	}
 
-		// 🛠️ FINAL BUFFER FLUSH: If we were buffering and the stream ended, flush what's left.
-		if isBuffering && len(buffer) > 0 {
-			recognized, _ := classifyPromptToolMarkup(buffer, promptTools)
-			if looksLikeToolMarkup(buffer) || recognized {
-				log.Printf("[handleChat] Final buffer flush suppressed raw tool markup")
-				needsCorrection = true
-				if badContentCapture == "" {
-					badContentCapture = buffer
-				}
-				AddDebugTrace("chat", "tool.quarantine", "Suppressed raw tool markup at stream end", map[string]interface{}{
-					"snippet": compactText(buffer, 220),
-				})
-			} else {
-				log.Printf("[handleChat] Final buffer flush triggered (Stream End)")
-				emitCanonicalAssistantDelta(buffer)
-				lastSavedBufferForTurn = buffer // Save for history before clearing
-			}
-			buffer = ""
-		} else if len(partialTagBuffer) > 0 {
-			recognized, possiblePrefix := classifyPromptToolMarkup(partialTagBuffer, promptTools)
-			if enableTools && (recognized || possiblePrefix || looksLikeJSONToolCallPossiblePrefix(partialTagBuffer) || looksLikeToolMarkup(partialTagBuffer)) {
-				needsCorrection = true
-				if badContentCapture == "" {
-					badContentCapture = partialTagBuffer
+	var (
+		sessionLastResponseID string
+		sessionUIStateJSON    = "{}"
+		sessionUISnapshot     = chatharness.SessionUISnapshot{ToolCards: map[string]chatharness.SessionToolCardSnapshot{}, Messages: []chatharness.SessionMessageSnapshot{}}
+	)
+	if strings.TrimSpace(userID) != "" {
+		if existingSession, existingErr := mcp.GetCurrentChatSession(userID); existingErr == nil {
+			sessionUIStateJSON = existingSession.UIStateJSON
+			sessionUISnapshot = chatharness.ParseUISnapshot(existingSession.UIStateJSON)
+			statefulSummaryText = existingSession.SummaryText
+			if chainsResponses && statefulResetReason == "" {
+				statefulTurnCountValue = existingSession.TurnCount
+				statefulEstimatedCharsValue = existingSession.EstimatedChars
+				statefulLastInputTokensValue = existingSession.LastInputTokens
+				statefulLastOutputTokensValue = existingSession.LastOutputTokens
+				statefulPeakInputTokensValue = existingSession.PeakInputTokens
+				statefulTokenBudgetValue = serverStatefulTokenBudgetValue
+				if chatharness.IsValidResponseID(existingSession.LastResponseID) {
+					sessionLastResponseID = strings.TrimSpace(existingSession.LastResponseID)
+					if reqMap != nil {
+						reqMap["previous_response_id"] = sessionLastResponseID
+					}
 				}
-				AddDebugTrace("chat", "tool.quarantine", "Suppressed incomplete streamed tool markup", map[string]interface{}{
-					"snippet": compactText(partialTagBuffer, 220),
-				})
-			} else {
-				emitCanonicalAssistantDelta(partialTagBuffer)
-				lastSavedBufferForTurn += partialTagBuffer
 			}
-			partialTagBuffer = ""
 		}
-
-		log.Printf("[handleChat-DEBUG] turn %d processing complete. Total response len: %d", turn, len(fullResponse))
-		if reasoningActive {
-			totalReasoningMs := reasoningAccumulatedMs + time.Since(reasoningStartedAt).Milliseconds()
-			reasoningEndEvt := map[string]interface{}{
-				"type":             "reasoning.end",
-				"elapsed_ms":       time.Since(reasoningStartedAt).Milliseconds(),
-				"total_elapsed_ms": requestElapsedMs(),
-			}
-			appendChatEvent("assistant", "reasoning.end", reasoningEndEvt)
-			if reasoningEndBytes, err := json.Marshal(reasoningEndEvt); err == nil {
-				emitStreamChunk(fmt.Sprintf("data: %s", string(reasoningEndBytes)))
-			}
-			reasoningAccumulatedMs = totalReasoningMs
-			reasoningActive = false
-			reasoningStartedAt = time.Time{}
-		}
-
-		// 🛡️ TOOL EXECUTION & LOOP LOGIC
-		if enableTools && toolExecutedThisTurn {
-			log.Printf("[handleChat] Turn %d detected Tool Call: %s. Executing...", turn, lastToolName)
-			rawToolArgumentsForEvent := lastToolArgsStr
-			AddDebugTrace("chat", "tool.detected", "Tool call detected in assistant output", map[string]interface{}{
-				"turn": turn,
-				"tool": lastToolName,
-				"args": compactText(lastToolArgsStr, 200),
-			})
-			if repairedArgsJSON, repaired := chatharness.RepairMissingReadWebPageArguments(lastToolName, lastToolArgsStr, initialUserInputText); repaired {
-				lastToolArgsStr = repairedArgsJSON
-			}
-			if repairedArgsJSON, repaired := chatharness.RepairMissingSearchToolArguments(lastToolName, lastToolArgsStr, initialUserInputText, recentContext); repaired {
-				lastToolArgsStr = repairedArgsJSON
-			}
-			if refinedArgsJSON, refined := chatharness.RefineContextualFollowupSearchQuery(lastToolName, lastToolArgsStr, initialUserInputText, recentContext); refined {
-				lastToolArgsStr = refinedArgsJSON
-			}
-			if refinedArgsJSON, refined := chatharness.RefineFamilySearchToolArguments(lastToolName, lastToolArgsStr, initialUserInputText); refined {
-				lastToolArgsStr = refinedArgsJSON
-			}
-			if refinedArgsJSON, refined := chatharness.RefineExactLookupToolArguments(lastToolName, lastToolArgsStr, initialUserInputText); refined {
-				lastToolArgsStr = refinedArgsJSON
-			}
-			if upgradedName, upgradedArgsJSON, upgraded := chatharness.UpgradeFreshnessSearchToolCall(lastToolName, lastToolArgsStr, initialUserInputText); upgraded {
-				lastToolName = upgradedName
-				lastToolArgsStr = upgradedArgsJSON
-			}
-			if lastToolArgsStr != rawToolArgumentsForEvent {
-				var repairedArgs interface{}
-				_ = json.Unmarshal([]byte(lastToolArgsStr), &repairedArgs)
-				repairEvent := map[string]interface{}{
-					"type":      "tool_call.arguments",
-					"tool":      lastToolName,
-					"arguments": repairedArgs,
-					"recovered": true,
-				}
-				appendChatEvent("assistant", "tool_call.arguments", repairEvent)
-				if repairBytes, marshalErr := json.Marshal(repairEvent); marshalErr == nil {
-					emitStreamChunk(fmt.Sprintf("data: %s", string(repairBytes)))
-				}
-				AddDebugTrace("chat", "tool.arguments_repaired", "Normalized missing or malformed tool arguments against the current request", map[string]interface{}{
-					"turn": turn,
-					"tool": lastToolName,
-					"args": compactText(lastToolArgsStr, 240),
-				})
-			}
-
-			// 1. Execute Tool
-			toolStart := time.Now()
-			toolUsageWeight := 1
-			if lastToolName == "search_web_multi" {
-				// A batch contains exactly two provider requests. Charge both against
-				// the existing evidence/provider budgets so parallelism cannot bypass
-				// the safeguards used by sequential search_web calls.
-				toolUsageWeight = 2
-			}
-			toolUsageCounts[lastToolName] += toolUsageWeight
-			toolSig := lastToolName + ":" + compactText(strings.TrimSpace(lastToolArgsStr), 240)
-			toolSignatureCounts[toolSig]++
-			executeCommandText := ""
-			executeCommandFamily := ""
-			if lastToolName == "execute_command" {
-				executeCommandText = chatharness.ExtractExecuteCommandFromArgsJSON(lastToolArgsStr)
-				executeCommandFamily = chatharness.ExecuteCommandBudgetFamily(executeCommandText)
-				if executeCommandFamily != "" {
-					executeCommandFamilyCounts[executeCommandFamily]++
-				}
-			}
-
-			var result string
-			var err error
-			toolActuallyCalled := false
-			duplicateToolCall := false
-			webEvidenceToolCalls := totalToolUsageFor(toolUsageCounts, isWebEvidenceTool)
-			webSearchProviderCalls := totalToolUsageFor(toolUsageCounts, isWebSearchProviderTool)
-			if isWebEvidenceTool(lastToolName) && webEvidenceToolCalls > webEvidenceBudget {
-				result = webEvidenceBudgetMessage(webEvidenceToolCalls - 1)
-				AddDebugTrace("chat", "tool.skipped", "Skipped web evidence tool due to combined per-request budget", map[string]interface{}{
-					"turn":  turn,
-					"tool":  lastToolName,
-					"count": webEvidenceToolCalls,
-				})
-			} else if isWebSearchProviderTool(lastToolName) && webSearchProviderCalls > webSearchProviderLimit {
-				result = fmt.Sprintf("Web search provider budget reached after %d searches. Do not search another provider in this answer. If the evidence already buffered is strong enough, answer from it. If it is weak, conflicting, or off-topic, say you could not verify the answer well enough and ask whether to continue with deeper research.", webSearchProviderCalls-1)
-				AddDebugTrace("chat", "tool.skipped", "Skipped web search provider due to combined per-request budget", map[string]interface{}{
-					"turn":  turn,
-					"tool":  lastToolName,
-					"count": webSearchProviderCalls,
-				})
-			} else if lastToolName == "read_buffered_source" && toolUsageCounts[lastToolName] > bufferedSourceReadLimit {
-				result = "read_buffered_source already ran multiple times in this answer. Stop reading more buffered excerpts. If the evidence already returned is strong enough, answer from it; otherwise say the evidence is insufficient and ask whether to continue with deeper research."
-				AddDebugTrace("chat", "tool.skipped", "Skipped repeated buffered source read due to per-request budget", map[string]interface{}{
-					"turn":  turn,
-					"tool":  lastToolName,
-					"count": toolUsageCounts[lastToolName],
-				})
-			} else if (lastToolName == "search_web" || lastToolName == "naver_search") && toolUsageCounts[lastToolName] > webSearchProviderLimit {
-				result = fmt.Sprintf("Tool budget reached for %s. Do not search again in this answer. If the evidence already buffered is strong enough, answer from it; otherwise say the evidence is insufficient and ask whether to continue with deeper research.", lastToolName)
-				AddDebugTrace("chat", "tool.skipped", "Skipped repeated web search due to per-request budget", map[string]interface{}{
-					"turn":  turn,
-					"tool":  lastToolName,
-					"count": toolUsageCounts[lastToolName],
-				})
-			} else if lastToolName == "read_web_page" && toolUsageCounts[lastToolName] > 2 {
-				result = "read_web_page already ran multiple times in this answer. Avoid more page reads unless the user explicitly asks to retry. If buffered evidence is strong enough, answer from it; otherwise say the evidence is insufficient and ask whether to continue with deeper research."
-				AddDebugTrace("chat", "tool.skipped", "Skipped repeated page read due to per-request budget", map[string]interface{}{
-					"turn":  turn,
-					"tool":  lastToolName,
-					"count": toolUsageCounts[lastToolName],
-				})
-			} else if lastToolName == "execute_command" && toolUsageCounts[lastToolName] > 5 {
-				result = "execute_command already ran many times in this answer. Stop gathering more shell output and answer the user directly from the latest useful results."
-				AddDebugTrace("chat", "tool.skipped", "Skipped execute_command due to overall budget", map[string]interface{}{
-					"turn":  turn,
-					"tool":  lastToolName,
-					"count": toolUsageCounts[lastToolName],
-				})
-			} else if lastToolName == "execute_command" && executeCommandFamily != "" && executeCommandFamilyCounts[executeCommandFamily] > 3 {
-				result = fmt.Sprintf("Too many execute_command calls were used for the same task family (%s). Use the latest command results you already have and answer the user directly.", executeCommandFamily)
-				AddDebugTrace("chat", "tool.skipped", "Skipped execute_command due to family budget", map[string]interface{}{
-					"turn":    turn,
-					"tool":    lastToolName,
-					"family":  executeCommandFamily,
-					"command": compactText(executeCommandText, 180),
-					"count":   executeCommandFamilyCounts[executeCommandFamily],
-				})
-			} else if toolSignatureCounts[toolSig] > 1 {
-				duplicateToolCall = true
-				result = fmt.Sprintf("Duplicate tool call prevented for %s with near-identical arguments. Use existing buffered evidence and continue answering.", lastToolName)
-				AddDebugTrace("chat", "tool.skipped", "Skipped duplicate tool call with same arguments", map[string]interface{}{
-					"turn":  turn,
-					"tool":  lastToolName,
-					"count": toolSignatureCounts[toolSig],
-				})
-			} else {
-				toolActuallyCalled = true
-				toolResult, callErr := toolruntime.Default.Call(chatCtx, toolExecCtx, lastToolName, json.RawMessage(lastToolArgsStr))
-				result, err = toolResult.Content, callErr
-			}
-			if toolActuallyCalled && isWebSearchProviderTool(lastToolName) {
-				webSearchEvidenceAttempts += toolUsageWeight
-			}
-			var toolResultEvt map[string]interface{}
-			if err != nil {
-				log.Printf("[handleChat] Tool Execution Failed: %v", err)
-				AddDebugTrace("chat", "tool.error", "Tool execution failed", map[string]interface{}{
-					"turn":       turn,
-					"tool":       lastToolName,
-					"elapsed_ms": time.Since(toolStart).Milliseconds(),
-					"error":      err.Error(),
-				})
-				toolResultEvt = map[string]interface{}{
-					"type":   "tool_call.failure",
-					"tool":   lastToolName,
-					"reason": err.Error(),
-				}
-				if strings.TrimSpace(result) == "" {
-					result = fmt.Sprintf("Error executing tool %s: %v", lastToolName, err)
-				} else {
-					result = fmt.Sprintf("Error executing tool %s: %v\n\n%s", lastToolName, err, strings.TrimSpace(result))
-				}
-			} else {
-				log.Printf("[handleChat] Tool Execution Success.")
-				AddDebugTrace("chat", "tool.success", "Tool execution completed", map[string]interface{}{
-					"turn":         turn,
-					"tool":         lastToolName,
-					"elapsed_ms":   time.Since(toolStart).Milliseconds(),
-					"result_chars": len(result),
+		if chainsResponses && statefulResetReason != "" && reqMap != nil {
+			delete(reqMap, "previous_response_id")
+			sessionLastResponseID = ""
+		}
+		if chainsResponses && statefulResetReason == "" {
+			projectedChars := statefulEstimatedCharsValue + len([]rune(strings.TrimSpace(initialUserInputText)))
+			projectedTokens := statefulLastInputTokensValue + orchestrator.EstimateTokens(initialUserInputText)
+			shouldCompact := statefulTurnCountValue >= serverStatefulTurnLimitValue ||
+				projectedChars >= serverStatefulCharBudgetValue ||
+				projectedTokens >= serverStatefulTokenBudgetValue ||
+				statefulLastInputTokensValue >= serverStatefulTokenBudgetValue
+			if shouldCompact {
+				statefulSummaryText = summarizeChatSessionForReset(statefulSummaryText, chatSessionUISnapshot{
+					ToolCards:    map[string]chatSessionToolCardSnapshot{},
+					Messages:     nil,
+					LastEventSeq: sessionUISnapshot.LastEventSeq,
 				})
-				toolResultEvt = map[string]interface{}{
-					"type": "tool_call.success",
-					"tool": lastToolName,
-				}
-			}
-			toolEvidenceSourceCount := 0
-			if isWebEvidenceTool(lastToolName) {
-				sources := chatharness.ExtractWebEvidenceSources(result, 6)
-				toolEvidenceSourceCount = len(sources)
-				if len(sources) > 0 {
-					evidence := make([]interface{}, 0, len(sources))
-					for _, source := range sources {
-						evidence = append(evidence, map[string]interface{}{
-							"title": source.Title,
-							"url":   source.URL,
+				if len(sessionUISnapshot.Messages) > 0 {
+					converted := make([]chatSessionMessageSnapshot, 0, len(sessionUISnapshot.Messages))
+					for _, msg := range sessionUISnapshot.Messages {
+						converted = append(converted, chatSessionMessageSnapshot{
+							TurnID:                  msg.TurnID,
+							UserContent:             msg.UserContent,
+							AssistantContent:        msg.AssistantContent,
+							ReasoningContent:        msg.ReasoningContent,
+							ReasoningDurationMS:     msg.ReasoningDurationMS,
+							ReasoningAccumulatedMS:  msg.ReasoningAccumulatedMS,
+							ReasoningCurrentPhaseMS: msg.ReasoningCurrentPhaseMS,
 						})
-						if !webEvidenceSourceURLs[source.URL] {
-							webEvidenceSourceURLs[source.URL] = true
-							webEvidenceSources = append(webEvidenceSources, source)
-						}
 					}
-					toolResultEvt["evidence"] = evidence
+					statefulSummaryText = summarizeChatSessionForReset(statefulSummaryText, chatSessionUISnapshot{
+						ToolCards:    map[string]chatSessionToolCardSnapshot{},
+						Messages:     converted,
+						LastEventSeq: sessionUISnapshot.LastEventSeq,
+					})
 				}
-			}
-			// Emit Result Event to Frontend
-			resBytes, _ := json.Marshal(toolResultEvt)
-			appendChatEvent("assistant", fmt.Sprintf("%v", toolResultEvt["type"]), toolResultEvt)
-			emitStreamChunk(fmt.Sprintf("data: %s", string(resBytes)))
-
-			if chatharness.ShouldFailClosedWebSearch(lastToolName, err, toolEvidenceSourceCount) {
-				failureAnswer := chatharness.BuildWebSearchFailureAnswer(initialUserInputText, err.Error())
-				fullResponse = ""
-				emitCanonicalAssistantDelta(failureAnswer)
-				AddDebugTrace("chat", "web_search.fail_closed", "Stopped generation after web search returned no evidence", map[string]interface{}{
-					"turn":  turn,
-					"tool":  lastToolName,
-					"error": err.Error(),
-				})
-				break
-			}
-
-			if llmMode == "stateful" && lastResponseID == "" {
-				log.Printf("[handleChat] WARNING: No lastResponseID captured for turn %d. Multi-turn might break.", turn)
-			}
-			freshnessSensitive := chatharness.IsFreshnessSensitiveWebRequest(initialUserInputText)
-			requireFreshnessCrossCheck := freshnessSensitive &&
-				isWebSearchProviderTool(lastToolName) &&
-				webSearchEvidenceAttempts < 2 &&
-				!duplicateToolCall &&
-				!isDeepWebResearchRequest(initialUserInputText) &&
-				!bulkToolTestRequest
-			finalAnswerOnly := chatharness.ShouldFinalizeAfterWebSearch(
-				lastToolName,
-				result,
-				isDeepWebResearchRequest(initialUserInputText),
-				bulkToolTestRequest,
-			)
-			if requireFreshnessCrossCheck {
-				finalAnswerOnly = false
-			}
-			if isWebSearchProviderTool(lastToolName) && webSearchEvidenceAttempts >= webSearchProviderLimit {
-				finalAnswerOnly = true
-			}
-			if duplicateToolCall {
-				finalAnswerOnly = true
-			}
-			singleSearchRefinement := strings.Contains(strings.ToLower(result), "evidence quality warning: no_authoritative_or_reputable_source")
-			if finalAnswerOnly {
-				singleSearchRefinement = false
-			}
-			reqMap, body, _ = chatharness.PrepareToolFollowupRequest(chatharness.ToolFollowupInput{
-				LLMMode:                    llmMode,
-				ModelID:                    modelID,
-				LastResponseID:             lastResponseID,
-				ToolName:                   lastToolName,
-				ToolResult:                 result,
-				LastAssistantBuffer:        lastSavedBufferForTurn,
-				ReqMap:                     reqMap,
-				ToolCallID:                 lastToolCallID,
-				ToolArguments:              lastToolArgsStr,
-				OriginalUserText:           initialUserInputText,
-				CompletedTools:             completedToolNames(promptTools, toolUsageCounts),
-				AvailableTools:             availableToolNames(promptTools),
-				FinalAnswerOnly:            finalAnswerOnly,
-				RequireFreshnessCrossCheck: requireFreshnessCrossCheck,
-				SingleSearchRefinement:     singleSearchRefinement,
-				ProviderTools:              providerTools,
-			})
-			AddDebugTrace("chat", "turn.followup", "Prepared follow-up turn with tool result", map[string]interface{}{
-				"turn":                  turn,
-				"tool":                  lastToolName,
-				"body_bytes":            len(body),
-				"final_only":            finalAnswerOnly,
-				"freshness_cross_check": requireFreshnessCrossCheck,
-			})
-			continue // Start next turn loop
-		}
-
-		if enableTools && needsCorrection && badContentCapture != "" && turn < 9 {
-			correctionPrompt := promptkit.SelfCorrectionPromptTemplate(badContentCapture)
-			if llmMode == "stateful" {
-				reqMap = map[string]interface{}{
-					"model":       modelID,
-					"input":       correctionPrompt,
-					"stream":      true,
-					"temperature": 0.1,
+				statefulResetReason = "auto_summary_reset"
+				statefulResetCountValue += 1
+				sessionLastResponseID = ""
+				statefulTurnCountValue = 0
+				statefulEstimatedCharsValue = len([]rune(statefulSummaryText))
+				statefulLastInputTokensValue = orchestrator.EstimateTokens(statefulSummaryText)
+				statefulLastOutputTokensValue = 0
+				if statefulPeakInputTokensValue < statefulLastInputTokensValue {
+					statefulPeakInputTokensValue = statefulLastInputTokensValue
 				}
-				if chatharness.IsValidResponseID(lastResponseID) {
-					reqMap["previous_response_id"] = strings.TrimSpace(lastResponseID)
+				if reqMap != nil {
+					delete(reqMap, "previous_response_id")
 				}
-			} else {
-				messages, _ := reqMap["messages"].([]interface{})
-				messages = append(messages,
-					map[string]interface{}{"role": "assistant", "content": badContentCapture},
-					map[string]interface{}{"role": "user", "content": correctionPrompt},
-				)
-				reqMap["messages"] = messages
-				reqMap["temperature"] = 0.1
-			}
-			var marshalErr error
-			body, marshalErr = json.Marshal(reqMap)
-			if marshalErr == nil {
-				AddDebugTrace("chat", "self_correction.retry", "Retrying malformed tool call through the normal parser", map[string]interface{}{
-					"turn":    turn,
-					"snippet": compactText(badContentCapture, 180),
+				AddDebugTrace("stateful", "reset", "Server-side automatic stateful compact triggered", map[string]interface{}{
+					"user":             userID,
+					"reason":           statefulResetReason,
+					"turn_count":       statefulTurnCountValue,
+					"projected_chars":  projectedChars,
+					"projected_tokens": projectedTokens,
+					"turn_limit":       serverStatefulTurnLimitValue,
+					"char_budget":      serverStatefulCharBudgetValue,
+					"token_budget":     serverStatefulTokenBudgetValue,
 				})
-				needsCorrection = false
-				badContentCapture = ""
-				continue
 			}
 		}
-
-		if strings.TrimSpace(fullResponse) == "" && strings.TrimSpace(reasoningResponse) != "" && !toolExecutedThisTurn {
-			if harvested, ok := chatharness.HarvestFinalAnswerFromReasoning(reasoningResponse); ok {
-				fullResponse = harvested
-				AddDebugTrace("chat", "final_answer.harvested", "Harvested complete final answer directly from reasoning output", map[string]interface{}{
-					"turn":            turn,
-					"harvested_chars": len([]rune(harvested)),
-				})
-				payload := map[string]interface{}{
-					"choices": []interface{}{
-						map[string]interface{}{
-							"delta": map[string]string{
-								"content": harvested,
-							},
-						},
-					},
-				}
-				if jsonBytes, err := json.Marshal(payload); err == nil {
-					emitStreamChunk(fmt.Sprintf("data: %s", string(jsonBytes)))
-				}
-				appendChatEvent("assistant", "message.delta", map[string]interface{}{
-					"type":         "message.delta",
-					"content":      harvested,
-					"full_content": fullResponse,
-				})
-			}
+		statefulTokenBudgetValue = serverStatefulTokenBudgetValue
+		statefulRiskScoreValue, statefulRiskLevelValue = computeServerStatefulRisk(
+			statefulTurnCountValue,
+			statefulEstimatedCharsValue,
+			statefulLastInputTokensValue,
+			initialUserInputText,
+			serverStatefulTurnLimitValue,
+			serverStatefulCharBudgetValue,
+			serverStatefulTokenBudgetValue,
+		)
+		if newBody, marshalErr := json.Marshal(reqMap); marshalErr == nil {
+			body = newBody
 		}
+	}
 
-		shouldRecoverReasoning := strings.TrimSpace(reasoningResponse) != "" && !toolExecutedThisTurn && !reasoningOnlyFinalRecoveryUsed && turn < maxToolTurns-1 && (strings.TrimSpace(fullResponse) == "" || (len([]rune(fullResponse)) < 40 && len([]rune(reasoningResponse)) > 400))
-		if shouldRecoverReasoning {
-			reasoningOnlyFinalRecoveryUsed = true
-			var recoveryErr error
-			reqMap, body, recoveryErr = chatharness.PrepareReasoningOnlyFinalRequest(
-				llmMode, modelID, lastResponseID, initialUserInputText, reasoningResponse, reqMap,
-			)
-			if recoveryErr == nil {
-				if llmMode == "stateful" {
-					llmURL = strings.TrimRight(endpoint, "/") + "/v1/chat/completions"
-				}
-				AddDebugTrace("chat", "final_answer.recovery", "Retrying once after the model emitted reasoning without a final answer", map[string]interface{}{
-					"turn":            turn,
-					"reasoning_chars": len(reasoningResponse),
-					"mode":            llmMode,
-				})
-				continue
-			}
-			AddDebugTrace("chat", "final_answer.recovery_error", "Could not prepare reasoning-only final answer recovery", map[string]interface{}{
-				"turn":  turn,
-				"error": recoveryErr.Error(),
-			})
+	// Registered before the stream closes the session so it runs after, once
+	// every event of the turn is stored and can be cited as provenance.
+	var finishedTurnMemory *chatTurnMemory
+	defer func() {
+		if finishedTurnMemory != nil {
+			go rememberChatTurn(*finishedTurnMemory)
 		}
+	}()
+
+	stream := orchestrator.NewChatStream(userID, clientTurnID, chatharness.SessionPersistState{
+		LLMMode:          llmMode,
+		ModelID:          modelID,
+		LastResponseID:   sessionLastResponseID,
+		SummaryText:      statefulSummaryText,
+		TurnCount:        statefulTurnCountValue,
+		EstimatedChars:   statefulEstimatedCharsValue,
+		LastInputTokens:  statefulLastInputTokensValue,
+		LastOutputTokens: statefulLastOutputTokensValue,
+		PeakInputTokens:  statefulPeakInputTokensValue,
+		TokenBudget:      statefulTokenBudgetValue,
+		RiskScore:        statefulRiskScoreValue,
+		RiskLevel:        statefulRiskLevelValue,
+		LastResetReason:  statefulResetReason,
+		UIStateJSON:      sessionUIStateJSON,
+	}, sessionUISnapshot)
+	stream.Chains = chainsResponses
+	stream.Format = responseFormat
+	// A structured answer the provider cannot constrain is held back until it
+	// validates, so a repaired answer never follows a broken one on the wire.
+	stream.HoldAnswer = responseFormat != nil && !responseFormat.NativeFor(llmMode)
+	stream.Started = requestStart
+	stream.Trace = AddDebugTrace
+	defer stream.Close(chatCtx)
+
+	stream.Begin(llmURL, reqMap, body)
+	endLLMActivity := beginLLMActivity()
+	defer endLLMActivity()
 
-		// If no tool executed, we are done with all turns
-		AddDebugTrace("chat", "turn.complete", "Turn completed without additional tool recursion", map[string]interface{}{
-			"turn":           turn,
-			"elapsed_ms":     time.Since(turnStart).Milliseconds(),
-			"response_chars": len(fullResponse),
+	chatEvents := chatharness.NewEventSequencer("req-"+generateToken()[:16], clientTurnID)
+	if err := stream.Open(w, chatEvents); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if len(selectedSkillEvents) > 0 {
+		orchestrator.Emit(stream, "assistant", map[string]interface{}{
+			"type":    "skill.applied",
+			"turn_id": clientTurnID,
+			"skills":  selectedSkillEvents,
 		})
-		break
-	} // --- TURN LOOP END ---
-
-	if strings.TrimSpace(fullResponse) == "" && strings.TrimSpace(reasoningResponse) != "" {
-		if harvested, ok := chatharness.HarvestFinalAnswerFromReasoning(reasoningResponse); ok {
-			fullResponse = harvested
-			AddDebugTrace("chat", "final_answer.harvested_post_loop", "Harvested final answer from reasoning after turn loop ended", map[string]interface{}{
-				"harvested_chars": len([]rune(harvested)),
-			})
-			payload := map[string]interface{}{
-				"choices": []interface{}{
-					map[string]interface{}{
-						"delta": map[string]string{
-							"content": harvested,
-						},
-					},
-				},
-			}
-			if jsonBytes, err := json.Marshal(payload); err == nil {
-				emitStreamChunk(fmt.Sprintf("data: %s", string(jsonBytes)))
-			}
-			appendChatEvent("assistant", "message.delta", map[string]interface{}{
-				"type":         "message.delta",
-				"content":      harvested,
-				"full_content": fullResponse,
-			})
-		}
 	}
 
-	if cleanedResponse, stripped := stripLeadingPromptToolArtifacts(fullResponse, promptTools); stripped {
-		AddDebugTrace("chat", "tool.final_quarantine", "Removed leaked textual tool wrapper from the final assistant answer", map[string]interface{}{
-			"before_chars": len([]rune(fullResponse)),
-			"after_chars":  len([]rune(cleanedResponse)),
+	// requestToolApproval pauses a SideEffecting call until the browser posts a
+	// decision to /api/chat-session/tool-approvals. Timeouts and cancellation
+	// resolve as rejections, which reach the model as the tool error.
+	requestToolApproval := func(ctx context.Context, execCtx toolruntime.ExecutionContext, name string, arguments json.RawMessage) error {
+		approval := toolApprovals.open(execCtx, name, arguments, toolApprovalTimeout)
+		requiredEvt := map[string]interface{}{
+			"type":        "tool_call.approval_required",
+			"approval_id": approval.ID,
+			"tool":        name,
+			"arguments":   approval.Arguments,
+			"timeout_ms":  toolApprovalTimeout.Milliseconds(),
+			"expires_at":  approval.ExpiresAt.UnixMilli(),
+		}
+		if approval.CallID != "" {
+			requiredEvt["call_id"] = approval.CallID
+		}
+		orchestrator.Emit(stream, "assistant", requiredEvt)
+		AddDebugTrace("chat", "tool.approval_required", "Waiting for the user to approve a side-effecting tool", map[string]interface{}{
+			"tool":        name,
+			"approval_id": approval.ID,
+			"call_id":     approval.CallID,
 		})
-		fullResponse = cleanedResponse
-	}
-	fullResponse = chatharness.AppendMissingWebEvidenceSources(fullResponse, initialUserInputText, webEvidenceSources)
 
-	// A malformed call that still remains after the bounded retry loop is never
-	// forwarded as assistant content.
-	if enableTools && needsCorrection && badContentCapture != "" {
-		log.Printf("[handleChat] Tool call remained malformed after self-correction")
-		AddDebugTrace("chat", "self_correction.exhausted", "Tool-call self-correction was exhausted", map[string]interface{}{
-			"snippet": compactText(badContentCapture, 180),
+		waitStart := time.Now()
+		outcome := toolApprovals.wait(ctx, approval)
+		resolvedEvt := map[string]interface{}{
+			"type":        "tool_call.approval_resolved",
+			"approval_id": approval.ID,
+			"tool":        name,
+			"decision":    outcome,
+		}
+		if approval.CallID != "" {
+			resolvedEvt["call_id"] = approval.CallID
+		}
+		orchestrator.Emit(stream, "assistant", resolvedEvt)
+		AddDebugTrace("chat", "tool.approval_resolved", "Resolved side-effecting tool approval", map[string]interface{}{
+			"tool":        name,
+			"approval_id": approval.ID,
+			"decision":    outcome,
+			"waited_ms":   time.Since(waitStart).Milliseconds(),
 		})
-		emitter.SendError("TOOL_CALL_FORMAT_ERROR: The model did not produce a valid app tool call.")
+		return toolApprovalError(name, outcome, toolApprovalTimeout)
+	}
+	if toolApprovalModeOf(commandSettings) == toolApprovalAsk {
+		// This client streams events, so ask the user instead of rejecting.
+		toolExecCtx.Approve = requestToolApproval
 	}
 
-	// 🔍 FINAL Memory Logging: Catch everything after all turns and corrections
-	if enableMemory && len(messagesForMemory) > 0 && fullResponse != "" {
-		log.Printf("[handleChat] Final Assistant Response Captured (Len: %d). Logging to DB...", len(fullResponse))
-		go logChatToHistory(userID, messagesForMemory, fullResponse, modelID)
+	// Extract messages for Memory Analysis (if enabled)
+	var messagesForMemory []map[string]interface{}
+	if enableMemory {
+		var tmpBody struct {
+			Messages []map[string]interface{} `json:"messages"`
+			Input    interface{}              `json:"input"` // Flexible for any type
+		}
+		if err := json.Unmarshal(body, &tmpBody); err == nil {
+			if len(tmpBody.Messages) > 0 {
+				messagesForMemory = tmpBody.Messages
+			} else if inputStr, ok := tmpBody.Input.(string); ok && inputStr != "" {
+				// Construct a single user message from Input
+				messagesForMemory = []map[string]interface{}{
+					{"role": "user", "content": inputStr},
+				}
+			}
+		} else {
+			log.Printf("[handleChat] Failed to extract messages for memory: %v", err)
+		}
 	}
-	if llmMode == "stateful" {
-		if strings.TrimSpace(fullResponse) != "" || strings.TrimSpace(sessionLastResponseID) != "" {
-			statefulTurnCountValue += 1
-			statefulEstimatedCharsValue += len([]rune(strings.TrimSpace(initialUserInputText))) + len([]rune(strings.TrimSpace(fullResponse)))
-		}
-		if statefulLastInputTokensValue <= 0 {
-			statefulLastInputTokensValue = estimateStatefulTokens(initialUserInputText) + estimateStatefulTokens(statefulSummaryText)
-		}
-		if statefulLastOutputTokensValue <= 0 {
-			statefulLastOutputTokensValue = estimateStatefulTokens(fullResponse)
-		}
-		if statefulPeakInputTokensValue < statefulLastInputTokensValue {
-			statefulPeakInputTokensValue = statefulLastInputTokensValue
-		}
-		statefulTurnCount = strconv.Itoa(statefulTurnCountValue)
-		statefulEstChars = strconv.Itoa(statefulEstimatedCharsValue)
-		statefulInputTokens = strconv.Itoa(statefulLastInputTokensValue)
-		statefulPeakInputTokens = strconv.Itoa(statefulPeakInputTokensValue)
-		statefulTokenBudget = strconv.Itoa(statefulTokenBudgetValue)
-		statefulRiskScore = strconv.FormatFloat(statefulRiskScoreValue, 'f', -1, 64)
-		statefulRiskLevel = statefulRiskLevelValue
-	}
-	sessionStatus = "idle"
-	var finalReasoningContent string
-	var finalToolPayload map[string]interface{}
-	for _, turn := range sessionTracker.Snapshot.Turns {
-		if strings.TrimSpace(turn.TurnID) != strings.TrimSpace(clientTurnID) {
-			continue
+	// 🔍 FINAL Memory Logging: Catch everything after all turns and corrections
+	// Remembering the turn writes memory, which an API key needs memory:write for.
+	if enableMemory && requestHasScope(r, APIKeyScopeMemoryWrite) && len(messagesForMemory) > 0 {
+		stream.Remember = func(answer string) bool {
+			userText := lastUserMessageText(messagesForMemory)
+			if userText == "" {
+				return false
+			}
+			log.Printf("[handleChat] Final Assistant Response Captured (Len: %d). Queueing memory for %s, model: %s", len(answer), userID, stream.State.ModelID)
+			finishedTurnMemory = &chatTurnMemory{
+				UserID:        userID,
+				ModelID:       stream.State.ModelID,
+				LLMMode:       llmMode,
+				UserText:      userText,
+				AssistantText: answer,
+				TurnID:        clientTurnID,
+				SessionID:     stream.SessionID(),
+			}
+			return true
 		}
-		finalReasoningContent = strings.TrimSpace(turn.Reasoning.Content)
-		if turn.Tool != nil && hasMeaningfulTurnToolSnapshot(*turn.Tool) {
-			finalToolPayload = map[string]interface{}{
-				"state":     strings.TrimSpace(turn.Tool.State),
-				"summary":   strings.TrimSpace(turn.Tool.Summary),
-				"args":      turn.Tool.Args,
-				"tool_name": strings.TrimSpace(turn.Tool.ToolName),
-				"history":   turn.Tool.History,
+	}
+
+	transport := &orchestrator.HTTPTransport{URL: llmURL, Token: token, Adapter: providerAdapter}
+	round := &orchestrator.ChatRound{
+		Sink:              stream,
+		TextTools:         enableTools,
+		PromptTools:       promptTools,
+		ProviderTools:     providerTools,
+		ParallelToolCalls: providerParallelToolCalls,
+		Native:            providerAdapter != nil,
+		LLMMode:           llmMode,
+		ModelID:           modelID,
+		ReqMap:            reqMap,
+		Body:              body,
+		OriginalUserText:  initialUserInputText,
+		RecentContext:     recentContext,
+		MaxTurns:          orchestrator.TurnBudget(initialUserInputText),
+		Format:            responseFormat,
+		HoldAnswer:        stream.HoldAnswer,
+		Events:            chatEvents,
+		TurnID:            clientTurnID,
+		Started:           requestStart,
+		Transport:         transport,
+		RecoveryURL:       strings.TrimRight(endpoint, "/") + "/v1/chat/completions",
+		ResponseID:        sessionLastResponseID,
+		Trace:             AddDebugTrace,
+		OnResponseID: func(id string) {
+			if id == "" {
+				stream.ClearResponseID()
+				return
 			}
+			stream.State.LastResponseID = id
+		},
+		OnStatefulReset: func(reason string) {
+			stream.State.LastResetReason = reason
+		},
+	}
+	if enableTools {
+		round.Tools = registryTools(toolExecCtx)
+	}
+	round.Failover = func(err error) (string, bool) {
+		if len(failoverUpstreams) == 0 || !upstreamUnavailable(err) {
+			return "", false
 		}
-		break
+		// Nothing has streamed yet, so the same request can move to the
+		// next upstream serving the model.
+		app.upstreams.MarkFailure(activeUpstream.Name, err)
+		failed := activeUpstream
+		activeUpstream, failoverUpstreams = failoverUpstreams[0], failoverUpstreams[1:]
+		endpoint, token = activeUpstream.Endpoint, activeUpstream.Token
+		transport.URL, transport.Token = chatharness.UpstreamURL(endpoint, llmMode), token
+		round.RecoveryURL = strings.TrimRight(endpoint, "/") + "/v1/chat/completions"
+		stream.State.ModelID = activeUpstream.Model
+		log.Printf("[handleChat] Upstream %s failed (%v), failing over to %s", failed.Name, err, activeUpstream.Name)
+		stream.Record("system", "upstream.failover", map[string]interface{}{
+			"from":  failed.Name,
+			"to":    activeUpstream.Name,
+			"model": activeUpstream.Model,
+		})
+		AddDebugTrace("chat", "upstream.failover", "Retrying turn on the next upstream", map[string]interface{}{
+			"from":  failed.Name,
+			"to":    activeUpstream.Name,
+			"model": activeUpstream.Model,
+			"error": compactText(err.Error(), 180),
+		})
+		return activeUpstream.Model, true
+	}
+
+	retryTransport := &orchestrator.RetryTransport{
+		Transport: transport,
+		Policy:    app.upstreamRetry,
+		OnRetry: func(attempt orchestrator.RetryAttempt) {
+			var statusCode int
+			var statusErr *orchestrator.StatusError
+			if errors.As(attempt.Err, &statusErr) {
+				statusCode = statusErr.StatusCode
+			}
+			log.Printf("[handleChat] Upstream attempt %d failed (%v), retrying in %s", attempt.Attempt, attempt.Err, attempt.Delay)
+			AddDebugTrace("chat", "upstream.retry", "Retrying upstream before the first token", map[string]interface{}{
+				"turn":        attempt.Turn,
+				"attempt":     attempt.Attempt,
+				"reason":      attempt.Reason(),
+				"status_code": statusCode,
+				"delay_ms":    attempt.Delay.Milliseconds(),
+				"upstream":    activeUpstream.Name,
+				"error":       compactText(attempt.Err.Error(), 180),
+			})
+			orchestrator.Emit(stream, "system", map[string]interface{}{
+				"type":         "upstream.retry",
+				"turn_id":      clientTurnID,
+				"attempt":      attempt.Attempt,
+				"max_attempts": attempt.MaxAttempts,
+				"delay_ms":     attempt.Delay.Milliseconds(),
+				"reason":       attempt.Reason(),
+				"status_code":  statusCode,
+			})
+		},
 	}
-	emitGenerationEvent("generation.finished", map[string]interface{}{
-		"phase":      "finished",
-		"elapsed_ms": requestElapsedMs(),
-		"turn_id":    clientTurnID,
-	})
-	requestCompletePayload := map[string]interface{}{
-		"type":                    "request.complete",
-		"response_chars":          len(fullResponse),
-		"response_id":             sessionLastResponseID,
-		"mode":                    llmMode,
-		"elapsed_ms":              requestElapsedMs(),
-		"total_elapsed_ms":        requestElapsedMs(),
-		"turn_id":                 clientTurnID,
-		"final_assistant_content": fullResponse,
-		"final_assistant_chars":   len(fullResponse),
-		"final_assistant_hash":    buildAssistantContentHash(fullResponse),
-	}
-	if finalReasoningContent != "" {
-		requestCompletePayload["reasoning_content"] = finalReasoningContent
-	}
-	if finalToolPayload != nil {
-		requestCompletePayload["tool"] = finalToolPayload
-	}
-	appendChatEvent("assistant", "request.complete", requestCompletePayload)
-	if requestCompleteBytes, err := json.Marshal(requestCompletePayload); err == nil {
-		emitStreamChunk(fmt.Sprintf("data: %s", string(requestCompleteBytes)))
-	}
-	AddDebugTrace("chat", "request.complete", "Chat request finished", map[string]interface{}{
-		"user":           userID,
-		"elapsed_ms":     requestElapsedMs(),
-		"response_chars": len(fullResponse),
-		"memory_logged":  enableMemory && len(messagesForMemory) > 0 && fullResponse != "",
-		"stateful_turns": statefulTurnCount,
-		"stateful_chars": statefulEstChars,
-		"risk_score":     statefulRiskScore,
-		"risk_level":     statefulRiskLevel,
-		"__payload":      fullResponse,
-	})
+	turnErr := orchestrator.Engine{Transport: retryTransport, MaxTurns: round.MaxTurns}.Run(chatCtx, round.Body, round)
+	stream.Finish(round, turnErr)
 }
 
 // handleTTS converts text to speech using Supertonic
@@ -7394,34 +4703,16 @@ func InitTTS(assetsDir string, threads int) error {
 	return nil
 }
 
-// logChatToHistory appends the latest chat turn to a log file for async processing.
-func logChatToHistory(userID string, messages []map[string]interface{}, assistantResponse string, modelID string) {
-	log.Printf("[AsyncMemory] logChatToHistory called for user: %s, model: %s, msgs: %d", userID, modelID, len(messages))
-
-	// 1. Find the last user message
-	var lastUserMsg string
+// lastUserMessageText returns the text of the last user message.
+func lastUserMessageText(messages []map[string]interface{}) string {
 	for i := len(messages) - 1; i >= 0; i-- {
 		if role, ok := messages[i]["role"].(string); ok && role == "user" {
 			if content, ok := messages[i]["content"].(string); ok {
-				lastUserMsg = content
-				break
+				return content
 			}
 		}
 	}
-
-	if lastUserMsg == "" {
-		return
-	}
-
-	// 2. Real-time Raw Memory Storage: Insert directly into SQLite
-	fullContext := fmt.Sprintf("User: %s\nAssistant: %s", lastUserMsg, assistantResponse)
-
-	id, err := mcp.InsertMemory(userID, fullContext)
-	if err != nil {
-		log.Printf("[AsyncMemory] ❌ Failed to insert raw memory to DB: %v", err)
-	} else {
-		log.Printf("[AsyncMemory] ✅ Saved raw interaction to DB (ID: %d) for user %s", id, userID)
-	}
+	return ""
 }
 
 // sendSSEError sends a properly formatted SSE error event to the client
@@ -7444,23 +4735,16 @@ func sendSSEError(w http.ResponseWriter, flusher http.Flusher, msg string) {
 	flusher.Flush()
 }
 
-func writeSSEEvent(w io.Writer, eventName string, payload interface{}) error {
-	data, err := json.Marshal(payload)
+// writeSessionSSEEvent writes a chat session stream event that is not a
+// persisted chat event. Its seq is the last event_seq delivered and it has
+// no SSE id, so EventSource keeps resuming from the last chat_event.
+func writeSessionSSEEvent(w io.Writer, eventName string, afterSeq int, payload interface{}) error {
+	env, err := chatharness.NewEnvelope(eventName, payload)
 	if err != nil {
 		return err
 	}
-	if strings.TrimSpace(eventName) != "" {
-		if _, err := fmt.Fprintf(w, "event: %s\n", strings.TrimSpace(eventName)); err != nil {
-			return err
-		}
-	}
-	for _, line := range strings.Split(string(data), "\n") {
-		if _, err := fmt.Fprintf(w, "data: %s\n", line); err != nil {
-			return err
-		}
-	}
-	_, err = fmt.Fprint(w, "\n")
-	return err
+	env.Seq = int64(afterSeq)
+	return chatharness.WriteEnvelope(w, eventName, "", env)
 }
 
 func writeSSEComment(w io.Writer, comment string) error {
@@ -7468,69 +4752,6 @@ func writeSSEComment(w io.Writer, comment string) error {
 	return err
 }
 
-type upstreamSSEBlock struct {
-	EventName string
-	Data      string
-	Raw       string
-}
-
-func readUpstreamSSEBlock(reader *bufio.Reader) (upstreamSSEBlock, error) {
-	var (
-		block      upstreamSSEBlock
-		rawLines   []string
-		dataLines  []string
-		eventName  string
-		haveFields bool
-	)
-
-	flush := func() upstreamSSEBlock {
-		block.EventName = strings.TrimSpace(eventName)
-		block.Data = strings.Join(dataLines, "\n")
-		block.Raw = strings.Join(rawLines, "\n")
-		return block
-	}
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil && !errors.Is(err, io.EOF) {
-			return upstreamSSEBlock{}, err
-		}
-
-		line = strings.TrimRight(line, "\r\n")
-		if line == "" {
-			if haveFields || len(rawLines) > 0 {
-				return flush(), nil
-			}
-			if errors.Is(err, io.EOF) {
-				return upstreamSSEBlock{}, io.EOF
-			}
-			continue
-		}
-
-		rawLines = append(rawLines, line)
-		haveFields = true
-
-		switch {
-		case strings.HasPrefix(line, "event:"):
-			eventName = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
-		case strings.HasPrefix(line, "data:"):
-			dataLine := strings.TrimPrefix(line, "data:")
-			if strings.HasPrefix(dataLine, " ") {
-				dataLine = dataLine[1:]
-			}
-			dataLines = append(dataLines, dataLine)
-		case strings.HasPrefix(line, ":"):
-			// SSE comment/heartbeat; preserve in Raw only.
-		default:
-			// Some providers emit raw JSON lines instead of proper SSE fields.
-		}
-
-		if errors.Is(err, io.EOF) {
-			return flush(), nil
-		}
-	}
-}
-
 func lenInterfaceSlice(v interface{}) int {
 	items, ok := v.([]interface{})
 	if !ok {
@@ -25,6 +25,10 @@ Example:
 
 skills/user/my-skill/SKILL.md
 
+A skill can also declare tools in tools/*.json. Each manifest names a program
+from the skill's scripts/ folder; tool arguments are sent to it as JSON on
+stdin, and the tool is only offered while the skill is selected.
+
 Bundled skills are maintained by the application separately. Do not copy or
 edit bundled skills here. Valid user skills are selected per request and become
 available on the next chat request.
@@ -16,6 +16,7 @@ const (
 	supertonic2DirName        = "supertonic2"
 	supertonic3DirName        = "supertonic3"
 	embeddingsDirName         = "embeddings"
+	rerankersDirName          = "rerankers"
 	runtimeDirName            = "runtime"
 	onnxRuntimeDirName        = "onnxruntime"
 	browserDirName            = "browser"
@@ -78,6 +79,10 @@ func getWritableEmbeddingRootDir() string {
 	return joinAppDataPath(assetsDirName, embeddingsDirName)
 }
 
+func getWritableRerankerRootDir() string {
+	return joinAppDataPath(assetsDirName, rerankersDirName)
+}
+
 func getWritableONNXRuntimeDir() string {
 	return joinAppDataPath(assetsDirName, runtimeDirName, onnxRuntimeDirName)
 }
@@ -106,6 +111,14 @@ func getEmbeddingModelInstallDir(modelID string) string {
 	return filepath.Join(getWritableEmbeddingRootDir(), modelID)
 }
 
+func getRerankerModelInstallDir(modelID string) string {
+	modelID = filepath.Clean(modelID)
+	if modelID == "." || modelID == "" {
+		modelID = defaultRerankerModelID
+	}
+	return filepath.Join(getWritableRerankerRootDir(), modelID)
+}
+
 func getTTSAssetsDir() string {
 	writable := getWritableTTSAssetsDir()
 	if fileExists(filepath.Join(writable, legacyTTSOnnxDirName, "vocoder.onnx")) {
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+// Per-user policies for SideEffecting tools (execute_command and the memory
+// writers): run them straight away, pause the turn until the user decides in
+// the browser, or never run them.
+const (
+	toolApprovalAlways = "always"
+	toolApprovalAsk    = "ask"
+	toolApprovalNever  = "never"
+)
+
+// toolApprovalTimeout bounds how long a turn waits for a decision. An
+// unanswered request is resolved as a rejection.
+var toolApprovalTimeout = 2 * time.Minute
+
+var errToolApprovalNotFound = errors.New("tool approval not found or already resolved")
+
+func isToolApprovalMode(mode string) bool {
+	switch mode {
+	case toolApprovalAlways, toolApprovalAsk, toolApprovalNever:
+		return true
+	default:
+		return false
+	}
+}
+
+func toolApprovalModeOf(settings UserSettings) string {
+	if settings.ToolApproval == nil || !isToolApprovalMode(*settings.ToolApproval) {
+		return toolApprovalAlways
+	}
+	return *settings.ToolApproval
+}
+
+// applyToolApprovalSettings installs the user's approval policy. "never" hides
+// SideEffecting tools and rejects any that slip through; "ask" rejects too
+// until an interactive caller replaces Approve with a real prompt.
+func applyToolApprovalSettings(execCtx *toolruntime.ExecutionContext, settings UserSettings) {
+	switch toolApprovalModeOf(settings) {
+	case toolApprovalAsk:
+		execCtx.Approve = func(_ context.Context, _ toolruntime.ExecutionContext, name string, _ json.RawMessage) error {
+			return fmt.Errorf("%s needs the user's approval, which this client cannot ask for; it was not run", name)
+		}
+	case toolApprovalNever:
+		disabled := append([]string(nil), execCtx.DisabledTools...)
+		for _, definition := range toolruntime.Default.List(toolruntime.ExecutionContext{EnableMemory: true}) {
+			if definition.Metadata.SideEffecting {
+				disabled = append(disabled, definition.Name)
+			}
+		}
+		execCtx.DisabledTools = disabled
+		execCtx.Approve = func(_ context.Context, _ toolruntime.ExecutionContext, name string, _ json.RawMessage) error {
+			return fmt.Errorf("the user's tool approval policy does not allow %s; it was not run", name)
+		}
+	}
+}
+
+// toolApprovalRequest is one paused SideEffecting call waiting for the user.
+type toolApprovalRequest struct {
+	ID        string          `json:"approval_id"`
+	UserID    string          `json:"-"`
+	TurnID    string          `json:"turn_id,omitempty"`
+	CallID    string          `json:"call_id,omitempty"`
+	Tool      string          `json:"tool"`
+	Arguments json.RawMessage `json:"arguments"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	decision  chan bool
+}
+
+type toolApprovalBroker struct {
+	mu      sync.Mutex
+	pending map[string]*toolApprovalRequest
+}
+
+var toolApprovals = &toolApprovalBroker{pending: make(map[string]*toolApprovalRequest)}
+
+func (b *toolApprovalBroker) open(execCtx toolruntime.ExecutionContext, name string, arguments json.RawMessage, timeout time.Duration) *toolApprovalRequest {
+	request := &toolApprovalRequest{
+		ID:        "approval-" + generateToken()[:16],
+		UserID:    execCtx.UserID,
+		TurnID:    execCtx.RequestID,
+		CallID:    execCtx.CallID,
+		Tool:      name,
+		Arguments: append(json.RawMessage(nil), arguments...),
+		ExpiresAt: time.Now().Add(timeout),
+		decision:  make(chan bool, 1),
+	}
+	b.mu.Lock()
+	b.pending[request.ID] = request
+	b.mu.Unlock()
+	return request
+}
+
+// resolve delivers a decision. Approvals owned by other users are reported as
+// missing so ids cannot be probed.
+func (b *toolApprovalBroker) resolve(userID, approvalID string, approved bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	request, ok := b.pending[approvalID]
+	if !ok || request.UserID != userID {
+		return errToolApprovalNotFound
+	}
+	delete(b.pending, approvalID)
+	request.decision <- approved
+	return nil
+}
+
+// wait blocks until the request is decided, expires or ctx ends, and returns
+// "approved", "rejected", "timeout" or "cancelled".
+func (b *toolApprovalBroker) wait(ctx context.Context, request *toolApprovalRequest) string {
+	timer := time.NewTimer(time.Until(request.ExpiresAt))
+	defer timer.Stop()
+	outcome := ""
+	select {
+	case approved := <-request.decision:
+		if approved {
+			return "approved"
+		}
+		return "rejected"
+	case <-timer.C:
+		outcome = "timeout"
+	case <-ctx.Done():
+		outcome = "cancelled"
+	}
+	b.mu.Lock()
+	delete(b.pending, request.ID)
+	b.mu.Unlock()
+	// A decision that raced the timeout still wins.
+	select {
+	case approved := <-request.decision:
+		if approved {
+			return "approved"
+		}
+		return "rejected"
+	default:
+		return outcome
+	}
+}
+
+func (b *toolApprovalBroker) pendingFor(userID string) []toolApprovalRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests := make([]toolApprovalRequest, 0)
+	for _, request := range b.pending {
+		if request.UserID == userID {
+			requests = append(requests, *request)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].ExpiresAt.Before(requests[j].ExpiresAt) })
+	return requests
+}
+
+// toolApprovalError turns a non-approved outcome into the error the model sees
+// in place of the tool result.
+func toolApprovalError(name, outcome string, timeout time.Duration) error {
+	switch outcome {
+	case "approved":
+		return nil
+	case "timeout":
+		return fmt.Errorf("no approval for %s arrived within %s, so it was treated as a rejection and not run", name, timeout)
+	case "cancelled":
+		return fmt.Errorf("the request was cancelled before %s was approved; it was not run", name)
+	default:
+		return fmt.Errorf("the user rejected this %s call and it was not run; do not retry it unless the user asks", name)
+	}
+}
+
+// handleToolApprovals lists the caller's pending approvals (GET) or records a
+// decision for one of them (POST {"approval_id", "decision": "approve"|"reject"}).
+func handleToolApprovals() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"approvals": toolApprovals.pendingFor(userID),
+			})
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ApprovalID string `json:"approval_id"`
+			Decision   string `json:"decision"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var approved bool
+		switch strings.ToLower(strings.TrimSpace(req.Decision)) {
+		case "approve":
+			approved = true
+		case "reject":
+			approved = false
+		default:
+			http.Error(w, "decision must be approve or reject", http.StatusBadRequest)
+			return
+		}
+		if err := toolApprovals.resolve(userID, strings.TrimSpace(req.ApprovalID), approved); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "ok",
+			"approved": approved,
+		})
+	}
+}
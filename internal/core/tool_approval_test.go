@@ -0,0 +1,111 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+func waitForPendingApproval(t *testing.T, userID string) toolApprovalRequest {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if pending := toolApprovals.pendingFor(userID); len(pending) > 0 {
+			return pending[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("approval request was never opened")
+	return toolApprovalRequest{}
+}
+
+func TestToolApprovalDecisionsResumeTheCall(t *testing.T) {
+	execCtx := toolruntime.ExecutionContext{UserID: "approval-user", RequestID: "turn-1", CallID: "call_1"}
+	for _, tc := range []struct {
+		decision string
+		want     string
+	}{
+		{"approve", "approved"},
+		{"reject", "rejected"},
+	} {
+		request := toolApprovals.open(execCtx, "execute_command", json.RawMessage(`{"command":"ls"}`), time.Minute)
+		outcome := make(chan string, 1)
+		go func() { outcome <- toolApprovals.wait(context.Background(), request) }()
+
+		if err := toolApprovals.resolve("someone-else", request.ID, true); err != errToolApprovalNotFound {
+			t.Fatalf("another user resolved the approval: %v", err)
+		}
+		pending := waitForPendingApproval(t, "approval-user")
+		if pending.CallID != "call_1" || string(pending.Arguments) != `{"command":"ls"}` {
+			t.Fatalf("pending approval lost its call details: %#v", pending)
+		}
+
+		body := `{"approval_id":"` + request.ID + `","decision":"` + tc.decision + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/chat-session/tool-approvals", strings.NewReader(body))
+		req.Header.Set("X-User-ID", "approval-user")
+		rec := httptest.NewRecorder()
+		handleToolApprovals()(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.decision, rec.Code, rec.Body.String())
+		}
+		if got := <-outcome; got != tc.want {
+			t.Fatalf("%s: outcome %q, want %q", tc.decision, got, tc.want)
+		}
+		if err := toolApprovals.resolve("approval-user", request.ID, true); err != errToolApprovalNotFound {
+			t.Fatalf("%s: approval resolved twice: %v", tc.decision, err)
+		}
+	}
+}
+
+func TestToolApprovalTimeoutIsRejection(t *testing.T) {
+	execCtx := toolruntime.ExecutionContext{UserID: "approval-timeout"}
+	request := toolApprovals.open(execCtx, "delete_memory", json.RawMessage(`{"id":1}`), 20*time.Millisecond)
+	outcome := toolApprovals.wait(context.Background(), request)
+	if outcome != "timeout" {
+		t.Fatalf("outcome = %q, want timeout", outcome)
+	}
+	if len(toolApprovals.pendingFor("approval-timeout")) != 0 {
+		t.Fatal("timed out approval stayed pending")
+	}
+	err := toolApprovalError("delete_memory", outcome, 20*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "treated as a rejection") {
+		t.Fatalf("timeout was not reported as a rejection: %v", err)
+	}
+}
+
+func TestToolApprovalPolicies(t *testing.T) {
+	never := toolApprovalNever
+	execCtx := toolruntime.ExecutionContext{UserID: "approval-never", EnableMemory: true}
+	applyToolApprovalSettings(&execCtx, UserSettings{ToolApproval: &never})
+	for _, definition := range toolruntime.Default.List(execCtx) {
+		if definition.Metadata.SideEffecting {
+			t.Fatalf("never policy still lists %s", definition.Name)
+		}
+	}
+	if _, err := toolruntime.Default.Call(context.Background(), execCtx, "execute_command", json.RawMessage(`{"command":"echo hi"}`)); err == nil {
+		t.Fatal("never policy ran execute_command")
+	}
+
+	ask := toolApprovalAsk
+	execCtx = toolruntime.ExecutionContext{UserID: "approval-ask"}
+	applyToolApprovalSettings(&execCtx, UserSettings{ToolApproval: &ask})
+	_, err := toolruntime.Default.Call(context.Background(), execCtx, "execute_command", json.RawMessage(`{"command":"echo hi"}`))
+	if err == nil || !strings.Contains(err.Error(), "cannot ask") {
+		t.Fatalf("ask policy without a prompt did not reject: %v", err)
+	}
+	if _, err := toolruntime.Default.Call(context.Background(), execCtx, "get_current_time", json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("read-only tool was gated: %v", err)
+	}
+
+	execCtx = toolruntime.ExecutionContext{}
+	applyToolApprovalSettings(&execCtx, UserSettings{})
+	if execCtx.Approve != nil || toolApprovalModeOf(UserSettings{}) != toolApprovalAlways {
+		t.Fatal("default policy should run side effects without asking")
+	}
+}
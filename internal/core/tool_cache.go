@@ -0,0 +1,31 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+)
+
+// freshResultPhrases are explicit requests to skip cached tool results. Plain
+// recency words such as "latest" are not enough; search TTLs already shrink
+// for those.
+var freshResultPhrases = []string{
+	"fresh result", "fresh data", "without cache", "no cache", "bypass cache", "skip cache",
+	"don't use cache", "do not use cache", "search again", "look it up again", "refresh the result",
+	"캐시 없이", "캐시 말고", "캐시 쓰지", "새로고침", "다시 검색", "새로 검색", "다시 찾아",
+}
+
+// wantsFreshToolResults reports whether the chat request asks for tool results
+// that bypass the result cache, either with an X-Fresh-Results header or in
+// the user's own words.
+func wantsFreshToolResults(header, userText string) bool {
+	if fresh, err := strconv.ParseBool(strings.TrimSpace(header)); err == nil && fresh {
+		return true
+	}
+	lower := strings.ToLower(userText)
+	for _, phrase := range freshResultPhrases {
+		if strings.Contains(lower, phrase) {
+			return true
+		}
+	}
+	return false
+}
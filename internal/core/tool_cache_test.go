@@ -0,0 +1,23 @@
+package core
+
+import "testing"
+
+func TestWantsFreshToolResults(t *testing.T) {
+	cases := []struct {
+		header string
+		text   string
+		want   bool
+	}{
+		{"", "오늘 서울 날씨 알려줘", false},
+		{"", "What is the latest Go release?", false},
+		{"", "Search again with fresh results please", true},
+		{"", "캐시 없이 다시 알려줘", true},
+		{"true", "날씨", true},
+		{"yes", "날씨", false},
+	}
+	for _, tc := range cases {
+		if got := wantsFreshToolResults(tc.header, tc.text); got != tc.want {
+			t.Errorf("wantsFreshToolResults(%q, %q) = %v, want %v", tc.header, tc.text, got, tc.want)
+		}
+	}
+}
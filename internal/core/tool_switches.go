@@ -0,0 +1,86 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"dinkisstyle-chat/internal/mcp"
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+// GetToolSwitches returns the app-wide state of every switchable tool
+// (exposed to Wails).
+func (a *App) GetToolSwitches() []mcp.ToolSwitch {
+	return mcp.ToolSwitches()
+}
+
+// SetToolEnabled switches a tool on or off for every user and persists the
+// override. It applies to the next tool listing without a restart.
+func (a *App) SetToolEnabled(name string, enabled bool) error {
+	name = strings.TrimSpace(name)
+	if !toolruntime.Default.Has(name) {
+		return fmt.Errorf("unknown tool: %s", name)
+	}
+	a.serverMux.Lock()
+	defer a.serverMux.Unlock()
+	overrides := mcp.ToolOverrides()
+	overrides[name] = enabled
+	mcp.SetToolOverrides(overrides)
+	a.saveConfig()
+	AddDebugTrace("tools", "switch.changed", "Changed app-wide tool switch", map[string]interface{}{
+		"tool":    name,
+		"enabled": enabled,
+	})
+	return nil
+}
+
+// handleToolSwitches lets administrators read and change the app-wide tool
+// switches. GET with ?user=<id> also layers that user's settings on top, so
+// the answer to "why can't this user call X" comes from one place.
+func handleToolSwitches(app *App, authMgr *AuthManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			resp := map[string]interface{}{"tools": mcp.ToolSwitches()}
+			if userID := strings.TrimSpace(r.URL.Query().Get("user")); userID != "" {
+				authMgr.mu.RLock()
+				_, exists := authMgr.users[userID]
+				authMgr.mu.RUnlock()
+				if !exists {
+					http.Error(w, "user not found", http.StatusNotFound)
+					return
+				}
+				execCtx, enableTools := userToolExecutionContext(app, authMgr, userID, "", "")
+				resp["user"] = map[string]interface{}{
+					"id":           userID,
+					"enable_tools": enableTools,
+					"tools":        toolruntime.Default.Explain(execCtx),
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Name    string `json:"name"`
+			Enabled *bool  `json:"enabled"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, "name and enabled are required", http.StatusBadRequest)
+			return
+		}
+		if err := app.SetToolEnabled(req.Name, *req.Enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mcp.ToolSwitchFor(req.Name))
+	}
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"dinkisstyle-chat/internal/mcp"
+	"dinkisstyle-chat/internal/toolruntime"
+)
+
+func TestToolSwitchesExplainAppAndUserLayers(t *testing.T) {
+	defer mcp.SetToolOverrides(nil)
+	mcp.SetToolOverrides(map[string]bool{"naver_search": false})
+	authMgr := &AuthManager{users: map[string]*User{
+		"alice": {ID: "alice", Settings: UserSettings{DisabledTools: []string{"namu_wiki"}}},
+	}}
+	app := &App{enableTools: true}
+
+	rec := httptest.NewRecorder()
+	handleToolSwitches(app, authMgr)(rec, httptest.NewRequest(http.MethodGet, "/api/tools?user=alice", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Tools []mcp.ToolSwitch `json:"tools"`
+		User  struct {
+			EnableTools bool                     `json:"enable_tools"`
+			Tools       []toolruntime.ToolPolicy `json:"tools"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	switches := map[string]mcp.ToolSwitch{}
+	for _, state := range resp.Tools {
+		switches[state.Name] = state
+	}
+	if state := switches["naver_search"]; state.Enabled || state.Override == nil || state.Reason != "disabled by administrator" {
+		t.Fatalf("administrator override not reported: %#v", state)
+	}
+	if state := switches["send_keys"]; state.Enabled || state.Default {
+		t.Fatalf("terminal tool should be off by default: %#v", state)
+	}
+	policies := map[string]toolruntime.ToolPolicy{}
+	for _, policy := range resp.User.Tools {
+		policies[policy.Name] = policy
+	}
+	if !resp.User.EnableTools || policies["naver_search"].Effective || policies["namu_wiki"].Reason != "disabled for this user" || !policies["read_web_page"].Effective {
+		t.Fatalf("per-user layers not explained: %#v", resp.User)
+	}
+
+	rec = httptest.NewRecorder()
+	handleToolSwitches(app, authMgr)(rec, httptest.NewRequest(http.MethodGet, "/api/tools?user=nobody", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown user: status %d", rec.Code)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"dinkisstyle-chat/internal/mcp"
 )
 
 func TestServerDoesNotExposeLegacyMCPTransport(t *testing.T) {
@@ -20,3 +23,54 @@ func TestServerDoesNotExposeLegacyMCPTransport(t *testing.T) {
 		}
 	}
 }
+
+func TestMCPEndpointServesRegistryWithUserPolicy(t *testing.T) {
+	if err := mcp.InitDB(filepath.Join(t.TempDir(), "mcp-endpoint.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer mcp.CloseDB()
+	auth := NewAuthManager(filepath.Join(t.TempDir(), "users.json"))
+	if err := auth.AddUser("agent", "secret", "user"); err != nil {
+		t.Fatal(err)
+	}
+	auth.users["agent"].Settings.DisabledTools = []string{"get_current_location"}
+	token, err := auth.Authenticate("agent", "secret", false, "test", "127.0.0.1")
+	if err != nil || token == "" {
+		t.Fatalf("login failed: %v", err)
+	}
+	mux := createServerMux(&App{authMgr: auth, enableTools: true}, auth)
+	post := func(body, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/mcp", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if recorder := post(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`, ""); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated MCP request returned %d", recorder.Code)
+	}
+	if recorder := post(`{"jsonrpc":"2.0","method":"notifications/initialized"}`, token); recorder.Code != http.StatusAccepted {
+		t.Fatalf("notification returned %d, want 202", recorder.Code)
+	}
+
+	recorder := post(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`, token)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("tools/list returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	body := recorder.Body.String()
+	if !strings.Contains(body, `"get_current_time"`) || strings.Contains(body, `"get_current_location"`) {
+		t.Fatalf("tools/list ignored the user's disabled_tools: %s", body)
+	}
+
+	recorder = post(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"get_current_location","arguments":{}}}`, token)
+	if !strings.Contains(recorder.Body.String(), `"isError":true`) {
+		t.Fatalf("disabled tool call was not rejected: %s", recorder.Body.String())
+	}
+	recorder = post(`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"get_current_time","arguments":{}}}`, token)
+	if !strings.Contains(recorder.Body.String(), `"isError":false`) {
+		t.Fatalf("tool call failed: %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,124 @@
+package evalharness
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RetrievalCase is one labelled query of a retrieval evaluation set. Sets
+// are JSONL files with one case per line.
+type RetrievalCase struct {
+	ID       string  `json:"id"`
+	UserID   string  `json:"user_id,omitempty"`
+	Query    string  `json:"query"`
+	Relevant []int64 `json:"relevant_memory_ids"`
+}
+
+// RetrievalScore holds the metrics of one ranked result list.
+type RetrievalScore struct {
+	RecallAt       map[int]float64 `json:"recall_at"`
+	ReciprocalRank float64         `json:"reciprocal_rank"`
+}
+
+// RetrievalSummary averages RetrievalScores over a set.
+type RetrievalSummary struct {
+	Cases    int             `json:"cases"`
+	RecallAt map[int]float64 `json:"recall_at"`
+	MRR      float64         `json:"mrr"`
+}
+
+func LoadRetrievalCases(path string) ([]RetrievalCase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read retrieval cases: %w", err)
+	}
+	defer file.Close()
+
+	var cases []RetrievalCase
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var item RetrievalCase
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			return nil, fmt.Errorf("decode retrieval case on line %d: %w", line, err)
+		}
+		item.Query = strings.TrimSpace(item.Query)
+		if item.Query == "" || len(item.Relevant) == 0 {
+			return nil, fmt.Errorf("retrieval case on line %d needs a query and relevant_memory_ids", line)
+		}
+		if strings.TrimSpace(item.ID) == "" {
+			item.ID = fmt.Sprintf("line-%d", line)
+		}
+		cases = append(cases, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read retrieval cases: %w", err)
+	}
+	return cases, nil
+}
+
+// ScoreRetrieval computes recall@k for each k and the reciprocal rank of the
+// first relevant id. Repeated ids in ranked count once, at their first rank.
+func ScoreRetrieval(ranked, relevant []int64, ks []int) RetrievalScore {
+	want := make(map[int64]bool, len(relevant))
+	for _, id := range relevant {
+		want[id] = true
+	}
+	score := RetrievalScore{RecallAt: make(map[int]float64, len(ks))}
+	if len(want) == 0 {
+		return score
+	}
+
+	seen := make(map[int64]bool, len(ranked))
+	found := make([]int, 0, len(ranked))
+	for _, id := range ranked {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		hits := 0
+		if len(found) > 0 {
+			hits = found[len(found)-1]
+		}
+		if want[id] {
+			hits++
+			if score.ReciprocalRank == 0 {
+				score.ReciprocalRank = 1 / float64(len(found)+1)
+			}
+		}
+		found = append(found, hits)
+	}
+	for _, k := range ks {
+		if k <= 0 || len(found) == 0 {
+			score.RecallAt[k] = 0
+			continue
+		}
+		score.RecallAt[k] = float64(found[min(k, len(found))-1]) / float64(len(want))
+	}
+	return score
+}
+
+func SummarizeRetrieval(scores []RetrievalScore, ks []int) RetrievalSummary {
+	summary := RetrievalSummary{Cases: len(scores), RecallAt: make(map[int]float64, len(ks))}
+	if len(scores) == 0 {
+		return summary
+	}
+	for _, score := range scores {
+		for _, k := range ks {
+			summary.RecallAt[k] += score.RecallAt[k]
+		}
+		summary.MRR += score.ReciprocalRank
+	}
+	for _, k := range ks {
+		summary.RecallAt[k] /= float64(len(scores))
+	}
+	summary.MRR /= float64(len(scores))
+	return summary
+}
@@ -0,0 +1,47 @@
+package evalharness
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScoreRetrieval(t *testing.T) {
+	ks := []int{1, 3, 10}
+	score := ScoreRetrieval([]int64{7, 7, 3, 9, 4}, []int64{3, 4}, ks)
+	if score.RecallAt[1] != 0 || score.RecallAt[3] != 0.5 || score.RecallAt[10] != 1 {
+		t.Fatalf("recall = %v", score.RecallAt)
+	}
+	if score.ReciprocalRank != 0.5 {
+		t.Fatalf("reciprocal rank = %v, want 0.5 (the repeated 7 counts once)", score.ReciprocalRank)
+	}
+
+	miss := ScoreRetrieval([]int64{1, 2}, []int64{3}, ks)
+	summary := SummarizeRetrieval([]RetrievalScore{score, miss}, ks)
+	if summary.Cases != 2 || summary.RecallAt[10] != 0.5 || math.Abs(summary.MRR-0.25) > 1e-12 {
+		t.Fatalf("summary = %+v", summary)
+	}
+}
+
+func TestLoadRetrievalCases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cases.jsonl")
+	data := "# comment\n{\"query\":\"dog name\",\"relevant_memory_ids\":[4]}\n\n{\"id\":\"b\",\"user_id\":\"alice\",\"query\":\"tea\",\"relevant_memory_ids\":[1,2]}\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases, err := LoadRetrievalCases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 2 || cases[0].ID != "line-2" || cases[1].UserID != "alice" || len(cases[1].Relevant) != 2 {
+		t.Fatalf("cases = %+v", cases)
+	}
+
+	if err := os.WriteFile(path, []byte("{\"query\":\"no labels\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRetrievalCases(path); err == nil {
+		t.Fatal("a case without relevant ids must be rejected")
+	}
+}
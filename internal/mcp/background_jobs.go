@@ -0,0 +1,139 @@
+package mcp
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	BackgroundJobQueued    = "queued"
+	BackgroundJobRunning   = "running"
+	BackgroundJobCompleted = "completed"
+	BackgroundJobFailed    = "failed"
+)
+
+// BackgroundJob is one row of background_chat_jobs. Workers claim queued
+// jobs of their job_type one at a time.
+type BackgroundJob struct {
+	ID                 int64     `json:"id"`
+	UserID             string    `json:"user_id"`
+	JobType            string    `json:"job_type"`
+	Status             string    `json:"status"`
+	LLMMode            string    `json:"llm_mode"`
+	ModelID            string    `json:"model_id"`
+	RequestPayloadJSON string    `json:"request_payload_json"`
+	FinalText          string    `json:"final_text,omitempty"`
+	ErrorText          string    `json:"error_text,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+func EnqueueBackgroundJob(userID, jobType, llmMode, modelID, payloadJSON string) (int64, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+	userID = strings.TrimSpace(userID)
+	jobType = strings.TrimSpace(jobType)
+	if userID == "" || jobType == "" {
+		return 0, fmt.Errorf("user id and job type are required")
+	}
+	if strings.TrimSpace(llmMode) == "" {
+		llmMode = "standard"
+	}
+	if strings.TrimSpace(payloadJSON) == "" {
+		payloadJSON = "{}"
+	}
+
+	now := time.Now().UTC()
+	result, err := db.Exec(`
+		INSERT INTO background_chat_jobs (user_id, job_type, status, llm_mode, model_id, request_payload_json, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, jobType, BackgroundJobQueued, llmMode, strings.TrimSpace(modelID), payloadJSON, now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to enqueue background job: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// ClaimNextBackgroundJob marks the oldest queued job of jobType as running
+// and returns it. ok is false when nothing is queued.
+func ClaimNextBackgroundJob(jobType string) (job BackgroundJob, ok bool, err error) {
+	if db == nil {
+		return job, false, fmt.Errorf("database not initialized")
+	}
+	for {
+		err = db.QueryRow(`
+			SELECT id, user_id, job_type, status, llm_mode, model_id, request_payload_json, created_at
+			FROM background_chat_jobs
+			WHERE job_type = ? AND status = ?
+			ORDER BY id ASC
+			LIMIT 1`, jobType, BackgroundJobQueued,
+		).Scan(&job.ID, &job.UserID, &job.JobType, &job.Status, &job.LLMMode, &job.ModelID, &job.RequestPayloadJSON, &job.CreatedAt)
+		if err == sql.ErrNoRows {
+			return BackgroundJob{}, false, nil
+		}
+		if err != nil {
+			return BackgroundJob{}, false, fmt.Errorf("failed to query queued background job: %w", err)
+		}
+
+		now := time.Now().UTC()
+		result, err := db.Exec(`
+			UPDATE background_chat_jobs
+			SET status = ?, started_at = ?, updated_at = ?
+			WHERE id = ? AND status = ?`,
+			BackgroundJobRunning, now, now, job.ID, BackgroundJobQueued,
+		)
+		if err != nil {
+			return BackgroundJob{}, false, fmt.Errorf("failed to claim background job: %w", err)
+		}
+		// Another worker may have claimed the row in between; try the next one.
+		if affected, _ := result.RowsAffected(); affected == 1 {
+			job.Status = BackgroundJobRunning
+			return job, true, nil
+		}
+	}
+}
+
+func CompleteBackgroundJob(jobID int64, finalText string) error {
+	return finishBackgroundJob(jobID, BackgroundJobCompleted, finalText, "")
+}
+
+func FailBackgroundJob(jobID int64, errorText string) error {
+	return finishBackgroundJob(jobID, BackgroundJobFailed, "", errorText)
+}
+
+func finishBackgroundJob(jobID int64, status, finalText, errorText string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	now := time.Now().UTC()
+	if _, err := db.Exec(`
+		UPDATE background_chat_jobs
+		SET status = ?, final_text = ?, error_text = ?, updated_at = ?, completed_at = ?
+		WHERE id = ?`,
+		status, finalText, errorText, now, now, jobID,
+	); err != nil {
+		return fmt.Errorf("failed to finish background job: %w", err)
+	}
+	return nil
+}
+
+// RequeueInterruptedBackgroundJobs puts jobs of jobType that were running
+// when the app stopped back in the queue.
+func RequeueInterruptedBackgroundJobs(jobType string) (int64, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+	result, err := db.Exec(`
+		UPDATE background_chat_jobs
+		SET status = ?, started_at = NULL, updated_at = ?
+		WHERE job_type = ? AND status = ?`,
+		BackgroundJobQueued, time.Now().UTC(), jobType, BackgroundJobRunning,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue background jobs: %w", err)
+	}
+	return result.RowsAffected()
+}
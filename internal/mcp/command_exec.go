@@ -0,0 +1,160 @@
+package mcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCommandTimeout        = 60 * time.Second
+	DefaultCommandMaxOutputBytes = 64 * 1024
+	commandWaitDelay             = 2 * time.Second
+)
+
+// CommandLimits bounds every execute_command run. Zero values use the defaults.
+type CommandLimits struct {
+	Timeout        time.Duration
+	MaxOutputBytes int
+}
+
+var (
+	commandLimitsMu      sync.RWMutex
+	currentCommandLimits = CommandLimits{Timeout: DefaultCommandTimeout, MaxOutputBytes: DefaultCommandMaxOutputBytes}
+)
+
+func SetCommandLimits(limits CommandLimits) {
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultCommandTimeout
+	}
+	if limits.MaxOutputBytes <= 0 {
+		limits.MaxOutputBytes = DefaultCommandMaxOutputBytes
+	}
+	commandLimitsMu.Lock()
+	defer commandLimitsMu.Unlock()
+	currentCommandLimits = limits
+}
+
+func getCommandLimits() CommandLimits {
+	commandLimitsMu.RLock()
+	defer commandLimitsMu.RUnlock()
+	return currentCommandLimits
+}
+
+// commandRun is the outcome of one shell command, reported back to the model.
+type commandRun struct {
+	Output    string
+	ExitCode  int
+	Duration  time.Duration
+	Truncated bool
+	Limit     int
+	TimedOut  bool
+	Cancelled bool
+	Err       error
+}
+
+// runCommand starts spec in its own process group. Cancelling ctx or hitting
+// the timeout kills the whole group, so children started by the command
+// cannot keep the chat turn waiting.
+func runCommand(ctx context.Context, spec commandSpec, limits CommandLimits) commandRun {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	runCtx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(runCtx, spec.Argv[0], spec.Argv[1:]...)
+	cmd.Dir = spec.Dir
+	cmd.Env = spec.Env
+	configureProcessGroup(cmd)
+	if spec.Jail {
+		if err := configureCommandJail(cmd, limits); err != nil {
+			return commandRun{ExitCode: -1, Limit: limits.MaxOutputBytes, Err: err}
+		}
+	}
+	cmd.WaitDelay = commandWaitDelay
+
+	if spec.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(spec.Stdin)
+	}
+	output := &limitedBuffer{limit: limits.MaxOutputBytes}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err := cmd.Run()
+	run := commandRun{
+		Output:    output.String(),
+		ExitCode:  -1,
+		Duration:  time.Since(start),
+		Truncated: output.truncated,
+		Limit:     limits.MaxOutputBytes,
+		Err:       err,
+	}
+	if cmd.ProcessState != nil {
+		run.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	switch {
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil:
+		run.TimedOut = true
+		run.Err = fmt.Errorf("command timed out after %s", limits.Timeout)
+	case ctx.Err() != nil:
+		run.Cancelled = true
+		run.Err = fmt.Errorf("command cancelled: %w", ctx.Err())
+	case errors.Is(err, exec.ErrWaitDelay) && run.ExitCode == 0:
+		// The shell exited cleanly but a background child kept the pipes open.
+		run.Err = nil
+	}
+	return run
+}
+
+// Report renders the output with a status line the model can rely on.
+func (r commandRun) Report() string {
+	status := []string{fmt.Sprintf("exit code: %d", r.ExitCode), fmt.Sprintf("duration: %dms", r.Duration.Milliseconds())}
+	if r.TimedOut {
+		status = append(status, "timed out, process group killed")
+	} else if r.Cancelled {
+		status = append(status, "cancelled, process group killed")
+	}
+	if r.Truncated {
+		status = append(status, fmt.Sprintf("output truncated at %d bytes", r.Limit))
+	}
+	footer := "[" + strings.Join(status, ", ") + "]"
+	output := strings.TrimSpace(r.Output)
+	if r.Err != nil {
+		return fmt.Sprintf("Command failed: %v\nOutput:\n%s\n%s", r.Err, output, footer)
+	}
+	if output == "" {
+		output = "Command completed with no output."
+	}
+	return output + "\n" + footer
+}
+
+type limitedBuffer struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	original := len(data)
+	remaining := b.limit - b.buffer.Len()
+	if len(data) > remaining {
+		b.truncated = true
+		if remaining < 0 {
+			remaining = 0
+		}
+		data = data[:remaining]
+	}
+	_, _ = b.buffer.Write(data)
+	return original, nil
+}
+
+func (b *limitedBuffer) String() string {
+	return strings.ToValidUTF8(b.buffer.String(), "")
+}
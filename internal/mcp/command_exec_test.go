@@ -0,0 +1,82 @@
+package mcp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func skipWithoutPOSIXShell(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("process group tests use a POSIX shell")
+	}
+}
+
+func TestExecuteCommandReportsExitCodeAndDuration(t *testing.T) {
+	skipWithoutPOSIXShell(t)
+	result, err := ExecuteCommandContext(context.Background(), "echo hello; exit 3", nil, nil)
+	if err == nil {
+		t.Fatalf("non-zero exit was reported as success: %s", result)
+	}
+	if !strings.Contains(result, "Command failed") || !strings.Contains(result, "hello") || !strings.Contains(result, "exit code: 3") || !strings.Contains(result, "duration: ") {
+		t.Fatalf("failure report is missing details: %s", result)
+	}
+
+	result, err = ExecuteCommandContext(context.Background(), "echo ok", nil, nil)
+	if err != nil || !strings.HasPrefix(result, "ok\n") || !strings.Contains(result, "exit code: 0") {
+		t.Fatalf("unexpected success report: %q err=%v", result, err)
+	}
+}
+
+func TestExecuteCommandTimeoutKillsProcessGroup(t *testing.T) {
+	skipWithoutPOSIXShell(t)
+	SetCommandLimits(CommandLimits{Timeout: 300 * time.Millisecond})
+	defer SetCommandLimits(CommandLimits{})
+
+	marker := filepath.Join(t.TempDir(), "survivor")
+	start := time.Now()
+	result, err := ExecuteCommandContext(context.Background(), "(sleep 1; touch "+marker+") & sleep 30", nil, nil)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("timeout did not stop the command promptly: %s", elapsed)
+	}
+	if err == nil || !strings.Contains(result, "timed out, process group killed") {
+		t.Fatalf("timeout was not reported: %q err=%v", result, err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, statErr := os.Stat(marker); statErr == nil {
+		t.Fatal("background child survived the process group kill")
+	}
+}
+
+func TestExecuteCommandHonoursContextCancellation(t *testing.T) {
+	skipWithoutPOSIXShell(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	result, err := ExecuteToolWithContext("execute_command", []byte(`{"command":"sleep 30"}`), ToolContext{Context: ctx})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancellation did not stop the command promptly: %s", elapsed)
+	}
+	if err == nil || !strings.Contains(result, "cancelled, process group killed") {
+		t.Fatalf("cancellation was not reported: %q err=%v", result, err)
+	}
+}
+
+func TestExecuteCommandTruncatesOutput(t *testing.T) {
+	skipWithoutPOSIXShell(t)
+	SetCommandLimits(CommandLimits{MaxOutputBytes: 16})
+	defer SetCommandLimits(CommandLimits{})
+
+	result, err := ExecuteCommandContext(context.Background(), "printf '%0100d' 0", nil, nil)
+	if err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+	if !strings.HasPrefix(result, strings.Repeat("0", 16)+"\n") || !strings.Contains(result, "output truncated at 16 bytes") {
+		t.Fatalf("output was not truncated: %q", result)
+	}
+}
@@ -0,0 +1,230 @@
+//go:build linux
+
+package mcp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const commandJailArg = "__dkst_command_jail__"
+
+// commandJailDeniedSyscalls fail with EPERM inside the jail. They cover
+// namespace and mount changes, tracing other processes, kernel modules and
+// keyrings, none of which a chat command needs. clone is filtered separately
+// on its namespace flags, and clone3 fails with ENOSYS so libc falls back to
+// clone.
+var commandJailDeniedSyscalls = []uintptr{
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_MOUNT_SETATTR, unix.SYS_OPEN_TREE, unix.SYS_MOVE_MOUNT,
+	unix.SYS_FSOPEN, unix.SYS_FSCONFIG, unix.SYS_FSMOUNT, unix.SYS_FSPICK,
+	unix.SYS_SETNS, unix.SYS_UNSHARE,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD, unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD, unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+}
+
+// commandJailCloneNamespaces are the clone flags that would start a new
+// namespace. CLONE_NEWTIME is left out: clone reuses that bit for the exit
+// signal.
+const commandJailCloneNamespaces = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS |
+	unix.CLONE_NEWIPC | unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+// Securebits from linux/securebits.h; x/sys/unix does not export them.
+const (
+	commandJailSecbitNoRoot       = 1 << 0
+	commandJailSecbitNoRootLocked = 1 << 1
+)
+
+// configureCommandJail re-executes the gateway binary as a small launcher
+// inside fresh user, mount, PID, network, IPC and UTS namespaces. The
+// launcher makes the filesystem read-only apart from the working and temp
+// directories, drops its capabilities, applies rlimits and a seccomp filter,
+// then execs the command.
+func configureCommandJail(cmd *exec.Cmd, limits CommandLimits) error {
+	if commandJailAuditArch == 0 {
+		return fmt.Errorf("command jail is not supported on linux/%s", runtime.GOARCH)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("command jail unavailable: %w", err)
+	}
+	cpuSeconds := int(limits.Timeout/time.Second) + 1
+	cmd.Args = append([]string{self, commandJailArg, strconv.Itoa(cpuSeconds), "--"}, cmd.Args...)
+	cmd.Path = self
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	// The launcher needs these inside its user namespace to remount the
+	// filesystem and lock securebits; it drops them before the exec.
+	cmd.SysProcAttr.AmbientCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_SETPCAP}
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	return nil
+}
+
+// RunCommandJailIfRequested turns this process into the jail launcher when
+// the gateway re-executed itself for a jailed command. It must run first in
+// main, before any other initialization, and does not return in that case.
+func RunCommandJailIfRequested() {
+	if len(os.Args) < 5 || os.Args[1] != commandJailArg || os.Args[3] != "--" {
+		return
+	}
+	err := enterCommandJail(os.Args[2], os.Args[4:])
+	fmt.Fprintln(os.Stderr, "command jail:", err)
+	os.Exit(126)
+}
+
+func enterCommandJail(cpu string, argv []string) error {
+	// prctl and seccomp apply to the calling thread, which must also exec.
+	runtime.LockOSThread()
+	if err := commandJailReadOnlyFilesystem(); err != nil {
+		return err
+	}
+	if err := commandJailDropCapabilities(); err != nil {
+		return err
+	}
+	cpuSeconds, err := strconv.ParseUint(cpu, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cpu limit %q", cpu)
+	}
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{unix.RLIMIT_CPU, cpuSeconds},
+		{unix.RLIMIT_FSIZE, 256 << 20},
+		{unix.RLIMIT_NOFILE, 1024},
+		{unix.RLIMIT_CORE, 0},
+	}
+	for _, limit := range limits {
+		if err := unix.Setrlimit(limit.resource, &unix.Rlimit{Cur: limit.value, Max: limit.value}); err != nil {
+			return fmt.Errorf("setrlimit %d: %w", limit.resource, err)
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+	filter := commandJailSeccompFilter()
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&program)), 0, 0); err != nil {
+		return fmt.Errorf("seccomp: %w", err)
+	}
+	if len(argv) == 0 {
+		return errors.New("no command to run")
+	}
+	return unix.Exec(argv[0], argv, os.Environ())
+}
+
+// commandJailReadOnlyFilesystem remounts every mount in the jail's mount
+// namespace read-only, except bind mounts of the working directory and the
+// temp directory. Mounts inherited from the host are locked in the user
+// namespace, so the command cannot make them writable again.
+func commandJailReadOnlyFilesystem() error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("working directory: %w", err)
+	}
+	var binds []string
+	for _, dir := range []string{wd, os.TempDir()} {
+		if dir == "/" || slices.Contains(binds, dir) {
+			continue
+		}
+		if err := unix.Mount(dir, dir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", dir, err)
+		}
+		binds = append(binds, dir)
+	}
+	if err := unix.MountSetattr(-1, "/", unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}); err != nil {
+		return fmt.Errorf("remount read-only: %w", err)
+	}
+	for _, dir := range binds {
+		// EPERM means the host mount was already read-only and stays so.
+		err := unix.MountSetattr(-1, dir, unix.AT_RECURSIVE, &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY})
+		if err != nil && !errors.Is(err, unix.EPERM) {
+			return fmt.Errorf("remount %s writable: %w", dir, err)
+		}
+	}
+	// The current directory still points below the bind mount.
+	if err := os.Chdir(wd); err != nil {
+		return fmt.Errorf("enter working directory: %w", err)
+	}
+	return nil
+}
+
+// commandJailDropCapabilities clears every capability the launcher holds in
+// its user namespace and locks SECBIT_NOROOT so that uid 0 inside the jail
+// does not regain them on exec.
+func commandJailDropCapabilities() error {
+	if err := unix.Prctl(unix.PR_SET_SECUREBITS, commandJailSecbitNoRoot|commandJailSecbitNoRootLocked, 0, 0, 0); err != nil {
+		return fmt.Errorf("securebits: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("clear ambient capabilities: %w", err)
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("drop capabilities: %w", err)
+	}
+	return nil
+}
+
+func commandJailSeccompFilter() []unix.SockFilter {
+	statement := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jumpTrue, jumpFalse uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jumpTrue, Jf: jumpFalse, K: k}
+	}
+	const (
+		loadWord    = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jumpEqual   = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jumpAtLeast = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		jumpSet     = unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K
+		ret         = unix.BPF_RET | unix.BPF_K
+		denied      = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	)
+	filter := []unix.SockFilter{
+		// seccomp_data.arch: refuse syscalls made through a foreign ABI.
+		statement(loadWord, 4),
+		jump(jumpEqual, commandJailAuditArch, 1, 0),
+		statement(ret, unix.SECCOMP_RET_KILL_PROCESS),
+		// seccomp_data.nr: x32 numbers would alias the denied syscalls.
+		statement(loadWord, 0),
+		jump(jumpAtLeast, 0x40000000, 0, 1),
+		statement(ret, denied),
+		jump(jumpEqual, unix.SYS_CLONE3, 0, 1),
+		statement(ret, unix.SECCOMP_RET_ERRNO|uint32(unix.ENOSYS)),
+		// clone flags are the first argument on amd64 and arm64; the low
+		// word of seccomp_data.args[0] holds every CLONE_NEW* bit.
+		jump(jumpEqual, unix.SYS_CLONE, 0, 4),
+		statement(loadWord, 16),
+		jump(jumpSet, commandJailCloneNamespaces, 0, 1),
+		statement(ret, denied),
+		statement(ret, unix.SECCOMP_RET_ALLOW),
+	}
+	for _, number := range commandJailDeniedSyscalls {
+		filter = append(filter, jump(jumpEqual, uint32(number), 0, 1), statement(ret, denied))
+	}
+	return append(filter, statement(ret, unix.SECCOMP_RET_ALLOW))
+}
@@ -0,0 +1,5 @@
+package mcp
+
+import "golang.org/x/sys/unix"
+
+const commandJailAuditArch = unix.AUDIT_ARCH_X86_64
@@ -0,0 +1,6 @@
+//go:build linux && !amd64 && !arm64
+
+package mcp
+
+// The seccomp filter is only built for amd64 and arm64.
+const commandJailAuditArch = 0
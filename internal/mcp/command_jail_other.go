@@ -0,0 +1,17 @@
+//go:build !linux
+
+package mcp
+
+import (
+	"errors"
+	"os/exec"
+)
+
+const commandJailAuditArch = 0
+
+func configureCommandJail(cmd *exec.Cmd, limits CommandLimits) error {
+	return errors.New("command jail is only available on Linux")
+}
+
+// RunCommandJailIfRequested is only needed on Linux.
+func RunCommandJailIfRequested() {}
@@ -0,0 +1,496 @@
+package mcp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	CommandModeShell = "shell"
+	CommandModeArgv  = "argv"
+)
+
+// CommandPolicy is the per-user execute_command policy. Commands run through
+// the shell unless Mode is argv. The allow and deny lists apply in both modes,
+// but only argv mode enforces them reliably: in a shell string cd, globbing,
+// variables and nested shells can all hide what will really run.
+type CommandPolicy struct {
+	Mode               string
+	AllowedCommands    []string
+	DisallowedCommands []string
+	AllowedDirs        []string
+	DisallowedDirs     []string
+	Jail               bool
+}
+
+// commandSpec is a fully resolved command ready to start.
+type commandSpec struct {
+	Argv  []string
+	Dir   string
+	Env   []string
+	Jail  bool
+	Stdin []byte
+}
+
+func (p CommandPolicy) argvMode() bool {
+	return EffectiveCommandMode(p.Mode) == CommandModeArgv
+}
+
+// EffectiveCommandMode normalizes a stored command mode to the mode
+// execute_command will actually use; anything but argv runs in the shell.
+func EffectiveCommandMode(mode string) string {
+	if strings.EqualFold(strings.TrimSpace(mode), CommandModeArgv) {
+		return CommandModeArgv
+	}
+	return CommandModeShell
+}
+
+// commandLaunchers run another program chosen by their arguments, which would
+// let a denied command hide behind an allowed one.
+var commandLaunchers = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true, "fish": true, "csh": true, "tcsh": true,
+	"cmd": true, "powershell": true, "pwsh": true,
+	"env": true, "xargs": true, "sudo": true, "su": true, "doas": true, "nohup": true, "timeout": true,
+	"nice": true, "ionice": true, "setsid": true, "stdbuf": true, "chroot": true, "busybox": true,
+	"time": true, "watch": true, "strace": true, "script": true, "unshare": true, "nsenter": true,
+}
+
+// inlineCodeFlags are interpreter options that execute code from argv,
+// keyed by interpreter name without its version suffix.
+var inlineCodeFlags = map[string]map[string]bool{
+	"python":    {"-c": true},
+	"pypy":      {"-c": true},
+	"perl":      {"-e": true, "-E": true},
+	"ruby":      {"-e": true},
+	"node":      {"-e": true, "--eval": true, "-p": true, "--print": true},
+	"php":       {"-r": true},
+	"lua":       {"-e": true},
+	"osascript": {"-e": true},
+	"find":      {"-exec": true, "-execdir": true, "-ok": true, "-okdir": true},
+}
+
+// inlineProgramCommands take a program as their first operand.
+var inlineProgramCommands = map[string]bool{"awk": true, "gawk": true, "mawk": true, "nawk": true}
+
+// prepareCommand turns the model's command string into a commandSpec that
+// satisfies the policy, or explains which rule rejected it.
+func (p CommandPolicy) prepareCommand(command, workingDir string) (commandSpec, error) {
+	env := scrubbedCommandEnv()
+	spec := commandSpec{Env: env, Jail: p.Jail}
+
+	dir, err := p.resolveWorkingDir(workingDir)
+	if err != nil {
+		return commandSpec{}, err
+	}
+	spec.Dir = dir
+
+	if !p.argvMode() {
+		if err := p.checkShellCommand(command, dir); err != nil {
+			return commandSpec{}, err
+		}
+		shell, flag := "sh", "-c"
+		if runtime.GOOS == "windows" {
+			shell, flag = "cmd", "/C"
+		}
+		shellPath, err := lookCommandPath(shell, env)
+		if err != nil {
+			return commandSpec{}, err
+		}
+		spec.Argv = []string{shellPath, flag, command}
+		return spec, nil
+	}
+
+	argv, err := splitCommandLine(command)
+	if err != nil {
+		return commandSpec{}, err
+	}
+	executable := argv[0]
+	if strings.ContainsAny(executable, `/\`) {
+		executable = resolveCommandPath(executable, dir)
+	} else if executable, err = lookCommandPath(executable, env); err != nil {
+		return commandSpec{}, err
+	}
+	resolvedExecutable := resolveCommandPath(executable, dir)
+	if err := p.checkExecutable(argv, resolvedExecutable); err != nil {
+		return commandSpec{}, err
+	}
+	for _, arg := range argv[1:] {
+		for _, candidate := range pathCandidates(arg) {
+			if err := p.checkPath(resolveCommandPath(candidate, dir)); err != nil {
+				return commandSpec{}, err
+			}
+		}
+	}
+	spec.Argv = append([]string{executable}, argv[1:]...)
+	return spec, nil
+}
+
+func (p CommandPolicy) resolveWorkingDir(workingDir string) (string, error) {
+	base, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	workingDir = strings.TrimSpace(workingDir)
+	if workingDir == "" {
+		if allowed := nonEmpty(p.AllowedDirs); len(allowed) > 0 {
+			workingDir = allowed[0]
+		} else {
+			workingDir = base
+		}
+	}
+	dir := resolveCommandPath(workingDir, base)
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("working directory %q does not exist", workingDir)
+	}
+	if err := p.checkPath(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// checkShellCommand applies the command and directory lists to a shell
+// string on a best-effort basis: the first word of every simple command is
+// checked against the command lists and every other word as a path.
+func (p CommandPolicy) checkShellCommand(command, dir string) error {
+	segments := strings.FieldsFunc(command, func(r rune) bool {
+		return strings.ContainsRune(";&|()`\n\r", r)
+	})
+	for _, segment := range segments {
+		words := strings.Fields(strings.TrimPrefix(strings.TrimSpace(segment), "$"))
+		if len(words) == 0 {
+			continue
+		}
+		if err := p.checkCommandLists(strings.Trim(words[0], `'"`)); err != nil {
+			return err
+		}
+		for _, word := range words[1:] {
+			for _, candidate := range pathCandidates(strings.Trim(word, `'"`)) {
+				if err := p.checkPath(resolveCommandPath(candidate, dir)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkCommandLists matches one command name against the deny and allow lists.
+func (p CommandPolicy) checkCommandLists(command string) error {
+	name := commandBaseName(command)
+	for _, disallowed := range nonEmpty(p.DisallowedCommands) {
+		if strings.EqualFold(name, commandBaseName(disallowed)) {
+			return fmt.Errorf("permission denied: command '%s' is not allowed", command)
+		}
+	}
+	allowed := nonEmpty(p.AllowedCommands)
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, candidate := range allowed {
+		if strings.EqualFold(name, commandBaseName(candidate)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("permission denied: command '%s' is not in the allowed command list", command)
+}
+
+func (p CommandPolicy) checkExecutable(argv []string, resolved string) error {
+	names := []string{commandBaseName(argv[0]), commandBaseName(resolved)}
+	for _, disallowed := range nonEmpty(p.DisallowedCommands) {
+		for _, name := range names {
+			if strings.EqualFold(name, commandBaseName(disallowed)) {
+				return fmt.Errorf("permission denied: command '%s' is not allowed", argv[0])
+			}
+		}
+	}
+	allowed := nonEmpty(p.AllowedCommands)
+	isAllowed := func(name string) bool {
+		for _, candidate := range allowed {
+			if strings.EqualFold(name, commandBaseName(candidate)) {
+				return true
+			}
+		}
+		return false
+	}
+	// A bare name is found through the system PATH, where symlinks such as
+	// python3 -> python3.12 are the admin's own. An explicit path must also
+	// resolve to an allowed name, so a planted link cannot borrow one.
+	explicitPath := strings.ContainsAny(argv[0], `/\`)
+	if len(allowed) > 0 && (!isAllowed(names[0]) || (explicitPath && !isAllowed(names[1]))) {
+		return fmt.Errorf("permission denied: command '%s' is not in the allowed command list", argv[0])
+	}
+	// Launchers and inline-code flags stay available only when the admin
+	// allow-lists the command by name.
+	if isAllowed(names[0]) {
+		return nil
+	}
+	for _, name := range names {
+		if commandLaunchers[name] {
+			return fmt.Errorf("permission denied: '%s' runs other commands and is not allowed in argv mode", argv[0])
+		}
+		if inlineProgramCommands[name] {
+			return fmt.Errorf("permission denied: '%s' runs inline programs and is not allowed in argv mode", argv[0])
+		}
+		if flags, ok := inlineCodeFlags[interpreterName(name)]; ok {
+			for _, arg := range argv[1:] {
+				if inlineCodeArg(flags, arg) {
+					return fmt.Errorf("permission denied: '%s %s' runs inline code and is not allowed in argv mode", argv[0], arg)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// interpreterName strips a version suffix, so python3.12 and perl5.36 are
+// checked as python and perl.
+func interpreterName(name string) string {
+	if trimmed := strings.TrimRight(name, "0123456789."); trimmed != "" {
+		return trimmed
+	}
+	return name
+}
+
+// inlineCodeArg reports whether arg is one of the interpreter's inline-code
+// options. Short options may be grouped, as in -Ic or -le, so every letter
+// of a group is checked; a long option may carry its value after "=".
+func inlineCodeArg(flags map[string]bool, arg string) bool {
+	if flags[arg] {
+		return true
+	}
+	if strings.HasPrefix(arg, "--") {
+		name, _, _ := strings.Cut(arg, "=")
+		return flags[name]
+	}
+	if !strings.HasPrefix(arg, "-") {
+		return false
+	}
+	for _, letter := range arg[1:] {
+		if flags["-"+string(letter)] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p CommandPolicy) checkPath(path string) error {
+	for _, dir := range nonEmpty(p.DisallowedDirs) {
+		if pathWithin(path, resolveCommandPath(dir, "")) {
+			return fmt.Errorf("permission denied: directory '%s' is restricted", dir)
+		}
+	}
+	allowed := nonEmpty(p.AllowedDirs)
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, dir := range allowed {
+		if pathWithin(path, resolveCommandPath(dir, "")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("permission denied: path '%s' is outside the allowed directories", path)
+}
+
+// splitCommandLine tokenizes one command with POSIX-style quoting. Shell
+// operators, expansions and globs are rejected instead of passed through,
+// so the model learns that argv mode runs exactly one program.
+func splitCommandLine(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+	)
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < len(runes) && strings.ContainsRune(`"\`, runes[i+1]) {
+				i++
+				current.WriteRune(runes[i])
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == '\\' && runtime.GOOS != "windows":
+			if i+1 >= len(runes) {
+				return nil, errors.New("command ends with a dangling escape")
+			}
+			i++
+			current.WriteRune(runes[i])
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case strings.ContainsRune(";&|<>()`$\n\r", r):
+			return nil, fmt.Errorf("shell syntax %q is not supported in argv mode; run one program with plain arguments", string(r))
+		case strings.ContainsRune("*?[{", r) || (r == '~' && !inArg):
+			return nil, fmt.Errorf("shell expansion %q is not supported in argv mode; pass explicit paths", string(r))
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("command has an unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 || strings.TrimSpace(args[0]) == "" {
+		return nil, errors.New("command is empty")
+	}
+	for _, arg := range args {
+		if strings.ContainsRune(arg, 0) {
+			return nil, errors.New("invalid command argument")
+		}
+	}
+	return args, nil
+}
+
+// pathCandidates lists the values in one argument that a program may open:
+// the argument itself, the value of --flag=value and the tail of -fVALUE.
+func pathCandidates(arg string) []string {
+	if !strings.HasPrefix(arg, "-") || arg == "-" {
+		return []string{arg}
+	}
+	var candidates []string
+	if _, value, ok := strings.Cut(arg, "="); ok && value != "" {
+		candidates = append(candidates, value)
+	}
+	if len(arg) > 2 && arg[1] != '-' {
+		candidates = append(candidates, arg[2:])
+	}
+	return candidates
+}
+
+// resolveCommandPath makes path absolute against base and resolves symlinks
+// on the longest existing prefix, so links cannot point around a rule.
+func resolveCommandPath(path, base string) string {
+	if !filepath.IsAbs(path) {
+		if base == "" {
+			base, _ = os.Getwd()
+		}
+		path = filepath.Join(base, path)
+	}
+	path = filepath.Clean(path)
+	var rest []string
+	current := path
+	for {
+		if resolved, err := filepath.EvalSymlinks(current); err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...)
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return path
+		}
+		rest = append([]string{filepath.Base(current)}, rest...)
+		current = parent
+	}
+}
+
+func pathWithin(path, root string) bool {
+	if runtime.GOOS == "windows" {
+		path, root = strings.ToLower(path), strings.ToLower(root)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+func commandBaseName(command string) string {
+	name := strings.ToLower(filepath.Base(strings.ReplaceAll(strings.TrimSpace(command), `\`, "/")))
+	for _, ext := range []string{".exe", ".cmd", ".bat", ".com"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// lookCommandPath searches the scrubbed PATH, ignoring relative entries that
+// would let a file planted in the working directory shadow a system tool.
+func lookCommandPath(name string, env []string) (string, error) {
+	pathValue := ""
+	for _, entry := range env {
+		if key, value, ok := strings.Cut(entry, "="); ok && strings.EqualFold(key, "PATH") {
+			pathValue = value
+		}
+	}
+	extensions := []string{""}
+	if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+		extensions = []string{".com", ".exe", ".bat", ".cmd"}
+	}
+	for _, dir := range filepath.SplitList(pathValue) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		for _, ext := range extensions {
+			candidate := filepath.Join(dir, name+ext)
+			info, err := os.Stat(candidate)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			if runtime.GOOS != "windows" && info.Mode()&0o111 == 0 {
+				continue
+			}
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("command '%s' was not found on PATH", name)
+}
+
+var commandEnvKeys = map[string]bool{
+	"HOME": true, "USER": true, "LOGNAME": true, "LANG": true, "TZ": true, "TMPDIR": true,
+	"TEMP": true, "TMP": true, "SYSTEMROOT": true, "SYSTEMDRIVE": true, "COMSPEC": true,
+	"PATHEXT": true, "WINDIR": true, "USERPROFILE": true,
+}
+
+// scrubbedCommandEnv keeps locale, home and temp variables plus the absolute
+// PATH entries; API tokens and other secrets in the gateway environment are
+// not passed to commands.
+func scrubbedCommandEnv() []string {
+	env := []string{"TERM=dumb", "GIT_TERMINAL_PROMPT=0"}
+	for _, entry := range os.Environ() {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		upper := strings.ToUpper(key)
+		switch {
+		case upper == "PATH":
+			var dirs []string
+			for _, dir := range filepath.SplitList(value) {
+				if filepath.IsAbs(dir) {
+					dirs = append(dirs, dir)
+				}
+			}
+			env = append(env, key+"="+strings.Join(dirs, string(os.PathListSeparator)))
+		case commandEnvKeys[upper] || strings.HasPrefix(upper, "LC_"):
+			env = append(env, entry)
+		}
+	}
+	return env
+}
+
+func nonEmpty(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
@@ -0,0 +1,266 @@
+package mcp
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Jailed commands re-execute the current binary, which is this test binary.
+	RunCommandJailIfRequested()
+	os.Exit(m.Run())
+}
+
+// commandSandboxFixture creates an allowed workspace next to a restricted
+// directory holding a secret, plus a symlink from the workspace into it.
+func commandSandboxFixture(t *testing.T) (workspace, restricted string) {
+	t.Helper()
+	skipWithoutPOSIXShell(t)
+	root := t.TempDir()
+	workspace = filepath.Join(root, "workspace")
+	restricted = filepath.Join(root, "restricted")
+	for _, dir := range []string{workspace, restricted} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(restricted, "secret.txt"), []byte("DKST_SECRET"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workspace, "notes.txt"), []byte("workspace notes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(restricted, filepath.Join(workspace, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return workspace, restricted
+}
+
+func TestCommandPolicyBlocksDirectoryBypasses(t *testing.T) {
+	workspace, restricted := commandSandboxFixture(t)
+	policy := CommandPolicy{Mode: CommandModeArgv, DisallowedDirs: []string{restricted}}
+
+	for _, command := range []string{
+		"cat " + restricted + "/secret.txt",
+		"cat ../restricted/secret.txt",
+		"cat link/secret.txt",
+		"cat " + workspace + "/link/secret.txt",
+		"cd " + restricted + " && cat secret.txt",
+		"cat " + restricted + "/*",
+		"cat ${HOME}/../" + restricted,
+		"cat $(printf " + restricted + ")/secret.txt",
+		"sh -c 'cat " + restricted + "/secret.txt'",
+		"grep -f" + restricted + "/secret.txt notes.txt",
+		"grep --file=" + restricted + "/secret.txt notes.txt",
+		"python3 -c 'print(open(\"x\").read())'",
+		"find . -exec cat '{}' +",
+		"awk '{print}' notes.txt",
+	} {
+		result, err := ExecuteCommandWithPolicy(context.Background(), command, workspace, policy)
+		if err == nil || strings.Contains(result, "DKST_SECRET") {
+			t.Errorf("bypass was not blocked: %q -> %q", command, result)
+		}
+	}
+
+	if _, err := ExecuteCommandWithPolicy(context.Background(), "cat notes.txt", restricted, policy); err == nil {
+		t.Error("working directory inside a restricted directory was accepted")
+	}
+	result, err := ExecuteCommandWithPolicy(context.Background(), "cat 'notes.txt'", workspace, policy)
+	if err != nil || !strings.Contains(result, "workspace notes") {
+		t.Fatalf("allowed command failed: %q err=%v", result, err)
+	}
+}
+
+func TestCommandPolicyBlocksCommandBypasses(t *testing.T) {
+	workspace, _ := commandSandboxFixture(t)
+	rmPath, err := exec.LookPath("rm")
+	if err != nil {
+		t.Skip("rm is not available")
+	}
+	alias := filepath.Join(workspace, "tidy")
+	if err := os.Symlink(rmPath, alias); err != nil {
+		t.Fatal(err)
+	}
+	policy := CommandPolicy{Mode: CommandModeArgv, DisallowedCommands: []string{"rm"}}
+
+	for _, command := range []string{
+		"rm notes.txt",
+		"RM notes.txt",
+		rmPath + " notes.txt",
+		"./tidy notes.txt",
+		"ls; rm notes.txt",
+		"ls | rm notes.txt",
+		"sh -c 'rm notes.txt'",
+		"env rm notes.txt",
+		"xargs rm",
+		"$(echo rm) notes.txt",
+		"`echo rm` notes.txt",
+		"nohup rm notes.txt",
+	} {
+		if _, err := ExecuteCommandWithPolicy(context.Background(), command, workspace, policy); err == nil {
+			t.Errorf("denied command ran through %q", command)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(workspace, "notes.txt")); err != nil {
+		t.Fatalf("a bypass removed the file: %v", err)
+	}
+}
+
+func TestCommandPolicyRejectsInlineCodeFlags(t *testing.T) {
+	policy := CommandPolicy{Mode: CommandModeArgv}
+	tests := []struct {
+		argv    []string
+		blocked bool
+	}{
+		{[]string{"python3", "-c", "print(1)"}, true},
+		{[]string{"python3", "-Ic", "print(1)"}, true},
+		{[]string{"python3", "-cprint(1)"}, true},
+		{[]string{"python3.12", "-c", "print(1)"}, true},
+		{[]string{"/usr/bin/python3.12", "-Ic", "print(1)"}, true},
+		{[]string{"perl", "-le", "print 1"}, true},
+		{[]string{"perl5.36", "-E", "say 1"}, true},
+		{[]string{"ruby", "-we", "puts 1"}, true},
+		{[]string{"node", "-pe", "1"}, true},
+		{[]string{"node", "--eval=1"}, true},
+		{[]string{"node18", "--print", "1"}, true},
+		{[]string{"python3", "-I", "script.py"}, false},
+		{[]string{"python3.12", "script.py", "--count", "3"}, false},
+		{[]string{"perl5.36", "-Mstrict", "-w", "script.pl"}, false},
+		{[]string{"node", "--version"}, false},
+	}
+	for _, tt := range tests {
+		err := policy.checkExecutable(tt.argv, tt.argv[0])
+		if blocked := err != nil; blocked != tt.blocked {
+			t.Errorf("%q: blocked = %v (%v), want %v", tt.argv, blocked, err, tt.blocked)
+		}
+	}
+}
+
+func TestCommandPolicyAllowListsCommandsAndDirectories(t *testing.T) {
+	workspace, restricted := commandSandboxFixture(t)
+	policy := CommandPolicy{Mode: CommandModeArgv, AllowedCommands: []string{"cat", "ls"}, AllowedDirs: []string{workspace}}
+
+	result, err := ExecuteCommandWithPolicy(context.Background(), "cat notes.txt", "", policy)
+	if err != nil || !strings.Contains(result, "workspace notes") {
+		t.Fatalf("allowed command did not run in the first allowed directory: %q err=%v", result, err)
+	}
+	for _, command := range []string{
+		"echo hello",
+		"cat " + restricted + "/secret.txt",
+		"cat link/secret.txt",
+		"ls /",
+	} {
+		if result, err := ExecuteCommandWithPolicy(context.Background(), command, workspace, policy); err == nil {
+			t.Errorf("allow-list was bypassed by %q -> %q", command, result)
+		}
+	}
+	if _, err := ExecuteCommandWithPolicy(context.Background(), "ls", restricted, policy); err == nil {
+		t.Error("working directory outside the allowed directories was accepted")
+	}
+}
+
+func TestCommandPolicyShellModeKeepsDenyLists(t *testing.T) {
+	workspace, restricted := commandSandboxFixture(t)
+	policy := CommandPolicy{DisallowedCommands: []string{"rm"}, DisallowedDirs: []string{restricted}}
+	if policy.argvMode() {
+		t.Fatal("a deny list switched the policy to argv mode")
+	}
+
+	result, err := ExecuteCommandWithPolicy(context.Background(), "cat notes.txt | tr a-z A-Z", workspace, policy)
+	if err != nil || !strings.Contains(result, "WORKSPACE NOTES") {
+		t.Fatalf("shell pipeline failed: %q err=%v", result, err)
+	}
+	for _, command := range []string{
+		"rm notes.txt",
+		"ls; rm notes.txt",
+		"ls && /bin/rm notes.txt",
+		"cat " + restricted + "/secret.txt",
+		"cat link/secret.txt",
+	} {
+		if result, err := ExecuteCommandWithPolicy(context.Background(), command, workspace, policy); err == nil {
+			t.Errorf("shell mode ran denied command %q -> %q", command, result)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(workspace, "notes.txt")); err != nil {
+		t.Fatalf("a denied command removed the file: %v", err)
+	}
+}
+
+func TestEffectiveCommandMode(t *testing.T) {
+	for mode, want := range map[string]string{"": CommandModeShell, "shell": CommandModeShell, " ARGV ": CommandModeArgv, "bogus": CommandModeShell} {
+		if got := EffectiveCommandMode(mode); got != want {
+			t.Errorf("EffectiveCommandMode(%q) = %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestCommandEnvironmentIsScrubbed(t *testing.T) {
+	skipWithoutPOSIXShell(t)
+	t.Setenv("DKST_TEST_API_TOKEN", "should-not-leak")
+	result, err := ExecuteCommandWithPolicy(context.Background(), "env", "", CommandPolicy{})
+	if err != nil {
+		t.Fatalf("env failed: %v", err)
+	}
+	if strings.Contains(result, "should-not-leak") {
+		t.Fatalf("gateway secret leaked into the command environment:\n%s", result)
+	}
+	if !strings.Contains(result, "PATH=") {
+		t.Fatalf("PATH was not kept:\n%s", result)
+	}
+}
+
+func TestSplitCommandLineQuoting(t *testing.T) {
+	args, err := splitCommandLine(`grep -n "two words" 'a;b' c\ d`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"grep", "-n", "two words", "a;b", "c d"}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Fatalf("args = %q, want %q", args, want)
+	}
+	for _, command := range []string{`echo "unterminated`, `echo a > b`, `echo ~/x`, `echo *`} {
+		if _, err := splitCommandLine(command); err == nil {
+			t.Errorf("%q was accepted", command)
+		}
+	}
+}
+
+func TestCommandJailIsolatesProcess(t *testing.T) {
+	if runtime.GOOS != "linux" || commandJailAuditArch == 0 {
+		t.Skip("command jail is Linux amd64/arm64 only")
+	}
+	if err := exec.Command("unshare", "-Ur", "true").Run(); err != nil {
+		t.Skip("unprivileged user namespaces are not available")
+	}
+	root := t.TempDir()
+	workspace, outside := filepath.Join(root, "workspace"), filepath.Join(root, "outside")
+	for _, dir := range []string{workspace, outside} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("TMPDIR", workspace)
+	command := `echo pid=$$; unshare -U true || echo unshare-denied; ` +
+		`touch ` + outside + `/escaped || echo outside-read-only; touch made && echo workspace-writable`
+	result, err := ExecuteCommandWithPolicy(context.Background(), command, workspace, CommandPolicy{Jail: true})
+	if err != nil {
+		t.Fatalf("jailed command failed: %q err=%v", result, err)
+	}
+	if !strings.Contains(result, "pid=1\n") {
+		t.Fatalf("command did not run in a new PID namespace: %q", result)
+	}
+	if !strings.Contains(result, "unshare-denied") {
+		t.Fatalf("seccomp filter did not deny unshare: %q", result)
+	}
+	if !strings.Contains(result, "outside-read-only") || !strings.Contains(result, "workspace-writable") {
+		t.Fatalf("jail did not keep only the working directory writable: %q", result)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "escaped")); err == nil {
+		t.Fatal("jailed command wrote outside its working directory")
+	}
+}
@@ -4,7 +4,6 @@ package mcp
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
 	"math"
@@ -118,6 +117,8 @@ func InitDB(dbPath string) error {
 		return fmt.Errorf("failed to create db directory: %w", err)
 	}
 
+	resetVectorIndexes(filepath.Join(filepath.Dir(dbPath), "vector-index"))
+
 	log.Printf("[DB] Connecting to SQLite database at: %s", dbPath)
 	db, err = sql.Open("sqlite", dbPath)
 	if err != nil {
@@ -158,6 +159,7 @@ func configureSQLiteConnection(db *sql.DB) error {
 
 // CloseDB closes the database connection.
 func CloseDB() {
+	resetVectorIndexes("")
 	if db != nil {
 		log.Println("[DB] Closing SQLite database.")
 		_ = db.Close()
@@ -304,6 +306,20 @@ func createSchema() error {
 	CREATE INDEX IF NOT EXISTS idx_auth_sessions_user_id ON auth_sessions(user_id);
 	CREATE INDEX IF NOT EXISTS idx_auth_sessions_expires_at ON auth_sessions(expires_at);
 
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		key_prefix TEXT NOT NULL DEFAULT '',
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
+		expires_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id);
+
 	CREATE TABLE IF NOT EXISTS chat_sessions (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id TEXT NOT NULL,
@@ -457,10 +473,63 @@ func createSchema() error {
 	CREATE INDEX IF NOT EXISTS idx_user_profile_facts_user_category
 	ON user_profile_facts(user_id, category);
 
+	CREATE TABLE IF NOT EXISTS user_profile_fact_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		fact_key TEXT NOT NULL,
+		fact_value TEXT NOT NULL,
+		category TEXT NOT NULL DEFAULT 'general',
+		source TEXT NOT NULL DEFAULT 'llm',
+		confidence REAL,
+		session_id INTEGER NOT NULL DEFAULT 0,
+		turn_id TEXT NOT NULL DEFAULT '',
+		valid_from DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		valid_to DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_user_profile_fact_history_user_key
+	ON user_profile_fact_history(user_id, fact_key, valid_from DESC);
+
+	CREATE TABLE IF NOT EXISTS memory_provenance (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		memory_id INTEGER NOT NULL DEFAULT 0,
+		profile_fact_id INTEGER NOT NULL DEFAULT 0,
+		action TEXT NOT NULL,
+		session_id INTEGER NOT NULL DEFAULT 0,
+		turn_id TEXT NOT NULL DEFAULT '',
+		event_ids_json TEXT NOT NULL DEFAULT '[]',
+		job_id INTEGER NOT NULL DEFAULT 0,
+		previous_text TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_memory_provenance_memory
+	ON memory_provenance(user_id, memory_id, created_at DESC);
+
+	CREATE INDEX IF NOT EXISTS idx_memory_provenance_profile_fact
+	ON memory_provenance(user_id, profile_fact_id, created_at DESC);
+
 	CREATE TABLE IF NOT EXISTS app_meta (
 		key TEXT PRIMARY KEY,
 		value TEXT NOT NULL
 	);
+
+	CREATE TABLE IF NOT EXISTS tool_result_cache (
+		cache_key TEXT PRIMARY KEY,
+		tool TEXT NOT NULL,
+		user_id TEXT NOT NULL DEFAULT '',
+		value TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		stored_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tool_result_cache_user
+	ON tool_result_cache(user_id);
+
+	CREATE INDEX IF NOT EXISTS idx_tool_result_cache_stored
+	ON tool_result_cache(stored_at DESC);
 	`
 	_, err := db.Exec(query)
 	if err != nil {
@@ -485,9 +554,15 @@ func createSchema() error {
 	if err := migrateSavedTurnsSchema(); err != nil {
 		return err
 	}
+	if err := migrateUserProfileFactHistory(); err != nil {
+		return err
+	}
 	if err := ensureFTSIndexVersion(); err != nil {
 		return err
 	}
+	if err := ensureEmbeddingStorageVersion(); err != nil {
+		return err
+	}
 	if err := runRetentionMaintenance(time.Now().UTC()); err != nil {
 		log.Printf("[DB] retention maintenance warning: %v", err)
 	}
@@ -898,6 +973,7 @@ func migrateMemoryRetentionSchema() error {
 	hasImportance := false
 	hasPinned := false
 	hasTier := false
+	hasConfidence := false
 
 	for rows.Next() {
 		var cid int
@@ -918,6 +994,8 @@ func migrateMemoryRetentionSchema() error {
 			hasPinned = true
 		case "memory_tier":
 			hasTier = true
+		case "confidence":
+			hasConfidence = true
 		}
 	}
 
@@ -941,10 +1019,18 @@ func migrateMemoryRetentionSchema() error {
 			return fmt.Errorf("failed to add memory_tier to memories: %w", err)
 		}
 	}
+	if !hasConfidence {
+		if _, err := db.Exec(`ALTER TABLE memories ADD COLUMN confidence REAL`); err != nil {
+			return fmt.Errorf("failed to add confidence to memories: %w", err)
+		}
+	}
 
+	// Only rows without a tier are classified, so tiers set by memory
+	// extraction or by hand survive restarts.
 	rows, err = db.Query(`
 		SELECT id, full_text, memory_type, created_at
-		FROM memories`)
+		FROM memories
+		WHERE memory_tier IS NULL OR memory_tier = '' OR importance_score IS NULL`)
 	if err != nil {
 		return fmt.Errorf("failed to list memories for retention backfill: %w", err)
 	}
@@ -1038,6 +1124,9 @@ func runRetentionMaintenance(now time.Time) error {
 	if err := pruneAgedMemories(now); err != nil {
 		return err
 	}
+	if err := pruneExpiredToolCache(now); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -1228,6 +1317,21 @@ type AuthSessionEntry struct {
 	ExpiresAt  time.Time
 }
 
+// APIKeyEntry is a gateway-issued API key. Only the SHA-256 hash of the key
+// is stored; KeyPrefix keeps its first characters so users can tell keys
+// apart. A nil ExpiresAt never expires.
+type APIKeyEntry struct {
+	ID         int64      `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	KeyPrefix  string     `json:"key_prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
 type ChatSessionEntry struct {
 	ID               int64
 	UserID           string
@@ -1389,6 +1493,120 @@ func PurgeExpiredAuthSessions(now time.Time) error {
 	return nil
 }
 
+func InsertAPIKey(entry APIKeyEntry) (int64, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+
+	query := `
+	INSERT INTO api_keys (user_id, name, key_prefix, key_hash, scopes, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?)`
+
+	var expiresAt interface{}
+	if entry.ExpiresAt != nil {
+		expiresAt = entry.ExpiresAt.UTC()
+	}
+	result, err := db.Exec(query, entry.UserID, entry.Name, entry.KeyPrefix, entry.KeyHash, strings.Join(entry.Scopes, " "), expiresAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert api key: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+const apiKeyColumns = `id, user_id, name, key_prefix, key_hash, scopes, created_at, last_used_at, expires_at`
+
+func scanAPIKey(scanner interface{ Scan(...interface{}) error }) (APIKeyEntry, error) {
+	var k APIKeyEntry
+	var scopes string
+	var lastUsedAt, expiresAt sql.NullTime
+	if err := scanner.Scan(&k.ID, &k.UserID, &k.Name, &k.KeyPrefix, &k.KeyHash, &scopes, &k.CreatedAt, &lastUsedAt, &expiresAt); err != nil {
+		return k, err
+	}
+	k.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	return k, nil
+}
+
+func GetAPIKeyByHash(keyHash string) (APIKeyEntry, error) {
+	if db == nil {
+		return APIKeyEntry{}, fmt.Errorf("database not initialized")
+	}
+
+	k, err := scanAPIKey(db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return k, err
+		}
+		return k, fmt.Errorf("failed to fetch api key: %w", err)
+	}
+	return k, nil
+}
+
+func ListAPIKeys(userID string) ([]APIKeyEntry, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	rows, err := db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKeyEntry{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func TouchAPIKey(id int64, usedAt time.Time) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	_, err := db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, usedAt.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update api key: %w", err)
+	}
+	return nil
+}
+
+// DeleteAPIKey revokes one of userID's keys and reports whether it existed.
+func DeleteAPIKey(userID string, id int64) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+
+	result, err := db.Exec(`DELETE FROM api_keys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete api key: %w", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+func DeleteAPIKeysByUser(userID string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	_, err := db.Exec(`DELETE FROM api_keys WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user api keys: %w", err)
+	}
+	return nil
+}
+
 func UpsertChatSession(entry ChatSessionEntry) (ChatSessionEntry, error) {
 	var saved ChatSessionEntry
 	if db == nil {
@@ -1709,6 +1927,43 @@ func ListChatEvents(userID string, sessionID int64, afterSeq, limit int) ([]Chat
 	return entries, nil
 }
 
+// ChatEventIDsForTurn returns the ids of the persisted events of one client
+// turn, oldest first.
+func ChatEventIDsForTurn(userID string, sessionID int64, turnID string) ([]int64, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	turnID = strings.TrimSpace(turnID)
+	if sessionID <= 0 || turnID == "" {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id
+		FROM chat_events
+		WHERE user_id = ? AND session_id = ? AND turn_id = ?
+		ORDER BY event_seq ASC`,
+		strings.TrimSpace(userID), sessionID, turnID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chat event ids: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan chat event id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate chat event ids: %w", err)
+	}
+	return ids, nil
+}
+
 func CountChatEvents(userID string, sessionID int64) (int, error) {
 	if db == nil {
 		return 0, fmt.Errorf("database not initialized")
@@ -1835,6 +2090,7 @@ func SaveSavedTurn(userID, promptText, responseText string) (SavedTurnEntry, err
 	if err = tx.Commit(); err != nil {
 		return entry, fmt.Errorf("failed to commit saved turn insert: %w", err)
 	}
+	notifyMemoryChanged(userID)
 
 	return GetSavedTurn(userID, id)
 }
@@ -2042,11 +2298,67 @@ func searchSavedTurnChunkMatchesVector(userID, queryStr string, limit int) ([]Sa
 	if len(queryVector) == 0 {
 		return nil, nil
 	}
+	hits, err := searchChunkVectorIndex(vectorIndexSavedTurn, userID, queryModel, queryVector, limit, nil)
+	if err != nil {
+		log.Printf("[DB] Saved turn vector index unavailable, scanning: %v", err)
+		return scanSavedTurnChunkMatchesVector(userID, queryVector, queryModel, limit)
+	}
+	if len(hits) == 0 {
+		return nil, nil
+	}
+
+	scores, chunkIDs := vectorHitScores(hits)
+	placeholders, args := sqlInt64Placeholders(chunkIDs)
+	rows, err := db.Query(`
+		SELECT
+			st.id, st.user_id, st.title, st.title_source, st.auto_title_failures, st.prompt_text, st.response_text, st.created_at, st.updated_at,
+			stc.id, stc.chunk_index, stc.chunk_text
+		FROM saved_turn_chunks stc
+		JOIN saved_turns st ON st.id = stc.saved_turn_id
+		WHERE stc.user_id = ?
+		  AND stc.id IN (`+placeholders+`)
+	`, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("saved turn chunk vector search failed: %w", err)
+	}
+	defer rows.Close()
+
+	var ranked []SavedTurnChunkMatch
+	for rows.Next() {
+		var match SavedTurnChunkMatch
+		if err := rows.Scan(
+			&match.ID,
+			&match.UserID,
+			&match.Title,
+			&match.TitleSource,
+			&match.AutoTitleFailures,
+			&match.PromptText,
+			&match.ResponseText,
+			&match.CreatedAt,
+			&match.UpdatedAt,
+			&match.ChunkID,
+			&match.ChunkIndex,
+			&match.ChunkText,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan saved turn vector match: %w", err)
+		}
+		match.VectorScore = scores[match.ChunkID]
+		ranked = append(ranked, match)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortSavedTurnChunkMatchesByVector(ranked)
+	return ranked, nil
+}
 
+// scanSavedTurnChunkMatchesVector scores every stored saved turn vector. It
+// backs up the vector index when that cannot be loaded.
+func scanSavedTurnChunkMatchesVector(userID string, queryVector []float64, queryModel string, limit int) ([]SavedTurnChunkMatch, error) {
 	rows, err := db.Query(`
 		SELECT
 			st.id, st.user_id, st.title, st.title_source, st.auto_title_failures, st.prompt_text, st.response_text, st.created_at, st.updated_at,
-			stc.id, stc.chunk_index, stc.chunk_text, e.embedding_json, e.embedding_model
+			stc.id, stc.chunk_index, stc.chunk_text, e.embedding_blob, e.embedding_json, e.embedding_model
 		FROM saved_turn_chunks stc
 		JOIN saved_turns st ON st.id = stc.saved_turn_id
 		JOIN saved_turn_chunk_embeddings e ON e.chunk_id = stc.id
@@ -2057,9 +2369,11 @@ func searchSavedTurnChunkMatchesVector(userID, queryStr string, limit int) ([]Sa
 	}
 	defer rows.Close()
 
+	query := toFloat32Vector(queryVector)
 	var ranked []SavedTurnChunkMatch
 	for rows.Next() {
 		var match SavedTurnChunkMatch
+		var embeddingBlob []byte
 		var embeddingJSON string
 		var embeddingModel string
 		if err := rows.Scan(
@@ -2075,6 +2389,7 @@ func searchSavedTurnChunkMatchesVector(userID, queryStr string, limit int) ([]Sa
 			&match.ChunkID,
 			&match.ChunkIndex,
 			&match.ChunkText,
+			&embeddingBlob,
 			&embeddingJSON,
 			&embeddingModel,
 		); err != nil {
@@ -2083,11 +2398,11 @@ func searchSavedTurnChunkMatchesVector(userID, queryStr string, limit int) ([]Sa
 		if strings.TrimSpace(queryModel) != "" && strings.TrimSpace(embeddingModel) != "" && embeddingModel != queryModel {
 			continue
 		}
-		vector, err := parseBufferedEmbeddingJSON(embeddingJSON)
+		vector, err := decodeStoredEmbedding(embeddingBlob, embeddingJSON)
 		if err != nil {
 			continue
 		}
-		score := cosineSimilarity(queryVector, vector)
+		score := dotFloat32(query, vector)
 		if score <= 0 {
 			continue
 		}
@@ -2098,6 +2413,14 @@ func searchSavedTurnChunkMatchesVector(userID, queryStr string, limit int) ([]Sa
 		return nil, err
 	}
 
+	sortSavedTurnChunkMatchesByVector(ranked)
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
+
+func sortSavedTurnChunkMatchesByVector(ranked []SavedTurnChunkMatch) {
 	sort.SliceStable(ranked, func(i, j int) bool {
 		if math.Abs(ranked[i].VectorScore-ranked[j].VectorScore) < 1e-9 {
 			if ranked[i].CreatedAt.Equal(ranked[j].CreatedAt) {
@@ -2107,10 +2430,6 @@ func searchSavedTurnChunkMatchesVector(userID, queryStr string, limit int) ([]Sa
 		}
 		return ranked[i].VectorScore > ranked[j].VectorScore
 	})
-	if len(ranked) > limit {
-		ranked = ranked[:limit]
-	}
-	return ranked, nil
 }
 
 func hybridSearchSavedTurnChunkMatches(userID, queryStr string, limit int) ([]SavedTurnChunkMatch, error) {
@@ -2127,41 +2446,44 @@ func hybridSearchSavedTurnChunkMatches(userID, queryStr string, limit int) ([]Sa
 		return nil, nil
 	}
 
-	merged := make(map[string]SavedTurnChunkMatch, len(ftsMatches)+len(vectorMatches))
-	for _, match := range ftsMatches {
-		match.HybridScore = match.FTSScore
-		key := fmt.Sprintf("%d:%d", match.ID, match.ChunkIndex)
-		merged[key] = match
-	}
-	for _, match := range vectorMatches {
+	matches := make([]SavedTurnChunkMatch, 0, len(ftsMatches)+len(vectorMatches))
+	candidates := make([]retrievalCandidate, 0, len(ftsMatches)+len(vectorMatches))
+	positions := make(map[string]int, len(ftsMatches)+len(vectorMatches))
+	for rank, match := range ftsMatches {
+		positions[fmt.Sprintf("%d:%d", match.ID, match.ChunkIndex)] = len(matches)
+		matches = append(matches, match)
+		candidates = append(candidates, retrievalCandidate{
+			FTSScore:  match.FTSScore,
+			FTSRank:   rank + 1,
+			CreatedAt: match.CreatedAt,
+			Text:      match.ChunkText,
+		})
+	}
+	for rank, match := range vectorMatches {
 		key := fmt.Sprintf("%d:%d", match.ID, match.ChunkIndex)
-		existing, ok := merged[key]
-		if ok {
-			existing.VectorScore = match.VectorScore
-			existing.HybridScore = (existing.FTSScore * 0.65) + (match.VectorScore * 0.35)
-			merged[key] = existing
+		if position, ok := positions[key]; ok {
+			matches[position].VectorScore = match.VectorScore
+			candidates[position].VectorScore = match.VectorScore
+			candidates[position].VectorRank = rank + 1
 			continue
 		}
-		match.HybridScore = match.VectorScore * 0.35
-		merged[key] = match
-	}
-
-	ranked := make([]SavedTurnChunkMatch, 0, len(merged))
-	for _, match := range merged {
+		positions[key] = len(matches)
+		matches = append(matches, match)
+		candidates = append(candidates, retrievalCandidate{
+			VectorScore: match.VectorScore,
+			VectorRank:  rank + 1,
+			CreatedAt:   match.CreatedAt,
+			Text:        match.ChunkText,
+		})
+	}
+
+	order, scores := rankRetrievalCandidates(queryStr, candidates, getRetrievalConfigForUser(userID), limit, time.Now())
+	ranked := make([]SavedTurnChunkMatch, 0, len(order))
+	for i, position := range order {
+		match := matches[position]
+		match.HybridScore = scores[i]
 		ranked = append(ranked, match)
 	}
-	sort.SliceStable(ranked, func(i, j int) bool {
-		if math.Abs(ranked[i].HybridScore-ranked[j].HybridScore) < 1e-9 {
-			if ranked[i].CreatedAt.Equal(ranked[j].CreatedAt) {
-				return ranked[i].ChunkIndex < ranked[j].ChunkIndex
-			}
-			return ranked[i].CreatedAt.After(ranked[j].CreatedAt)
-		}
-		return ranked[i].HybridScore > ranked[j].HybridScore
-	})
-	if len(ranked) > limit {
-		ranked = ranked[:limit]
-	}
 	return ranked, nil
 }
 
@@ -2226,6 +2548,7 @@ func DeleteSavedTurn(userID string, turnID int64) error {
 	if err = tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit saved turn delete: %w", err)
 	}
+	notifyMemoryChanged(userID)
 	return nil
 }
 
@@ -2309,6 +2632,7 @@ func UpdateSavedTurnTitle(userID string, turnID int64, title string, titleSource
 	if err = tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit saved turn title update: %w", err)
 	}
+	notifyMemoryChanged(userID)
 	return nil
 }
 
@@ -2383,6 +2707,7 @@ func InsertMemory(userID, fullText string) (int64, error) {
 	if err = tx.Commit(); err != nil {
 		return 0, fmt.Errorf("failed to commit memory insert: %w", err)
 	}
+	notifyMemoryChanged(userID)
 
 	return id, nil
 }
@@ -2421,7 +2746,7 @@ func rebuildSavedTurnChunksTx(tx *sql.Tx, savedTurnID int64, userID, title, prom
 		`, chunkID, buildFTSIndexedText(chunk.Text), savedTurnID, userID, chunk.Index); err != nil {
 			return fmt.Errorf("failed to index saved turn chunk: %w", err)
 		}
-		if err := upsertSavedTurnChunkEmbeddingTx(tx, chunkID, chunk.Text); err != nil {
+		if err := upsertSavedTurnChunkEmbeddingTx(tx, userID, chunkID, chunk.Text); err != nil {
 			return err
 		}
 	}
@@ -2460,6 +2785,51 @@ func deleteSavedTurnChunksTx(tx *sql.Tx, savedTurnID int64, userID string) error
 	if _, err := tx.Exec(`DELETE FROM saved_turn_chunks WHERE saved_turn_id = ? AND user_id = ?`, savedTurnID, userID); err != nil {
 		return fmt.Errorf("failed to delete saved turn chunks: %w", err)
 	}
+	forgetChunkVectors(vectorIndexSavedTurn, chunkIDs)
+	return nil
+}
+
+// rebuildMemoryChunksTx replaces the chunks, FTS rows and embeddings of a
+// memory whose full_text changed.
+func rebuildMemoryChunksTx(tx *sql.Tx, memoryID int64, userID, fullText string, createdAt time.Time) error {
+	if err := deleteMemoryChunksTx(tx, memoryID, userID); err != nil {
+		return err
+	}
+	return insertMemoryChunksTx(tx, memoryID, userID, fullText, createdAt)
+}
+
+func deleteMemoryChunksTx(tx *sql.Tx, memoryID int64, userID string) error {
+	rows, err := tx.Query(`SELECT id FROM memory_chunks WHERE memory_id = ? AND user_id = ?`, memoryID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to query memory chunks for delete: %w", err)
+	}
+	var chunkIDs []int64
+	for rows.Next() {
+		var chunkID int64
+		if scanErr := rows.Scan(&chunkID); scanErr != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan memory chunk id for delete: %w", scanErr)
+		}
+		chunkIDs = append(chunkIDs, chunkID)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("failed to iterate memory chunk ids for delete: %w", err)
+	}
+	rows.Close()
+
+	for _, chunkID := range chunkIDs {
+		if _, err := tx.Exec(`DELETE FROM memory_chunk_embeddings WHERE chunk_id = ?`, chunkID); err != nil {
+			return fmt.Errorf("failed to delete memory chunk embedding: %w", err)
+		}
+		if _, err := tx.Exec(`DELETE FROM memory_chunks_fts WHERE rowid = ?`, chunkID); err != nil {
+			return fmt.Errorf("failed to delete memory chunk fts row: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM memory_chunks WHERE memory_id = ? AND user_id = ?`, memoryID, userID); err != nil {
+		return fmt.Errorf("failed to delete memory chunks: %w", err)
+	}
+	forgetChunkVectors(vectorIndexMemory, chunkIDs)
 	return nil
 }
 
@@ -2492,7 +2862,7 @@ func insertMemoryChunksTx(tx *sql.Tx, memoryID int64, userID, fullText string, c
 		`, chunkID, buildFTSIndexedText(chunk.Text), memoryID, userID, chunk.Index); err != nil {
 			return fmt.Errorf("failed to index memory chunk: %w", err)
 		}
-		if err := upsertMemoryChunkEmbeddingTx(tx, chunkID, chunk.Text); err != nil {
+		if err := upsertMemoryChunkEmbeddingTx(tx, userID, chunkID, chunk.Text); err != nil {
 			return err
 		}
 	}
@@ -2500,7 +2870,7 @@ func insertMemoryChunksTx(tx *sql.Tx, memoryID int64, userID, fullText string, c
 	return nil
 }
 
-func upsertMemoryChunkEmbeddingTx(tx *sql.Tx, chunkID int64, text string) error {
+func upsertMemoryChunkEmbeddingTx(tx *sql.Tx, userID string, chunkID int64, text string) error {
 	vector, modelName := buildBufferedEmbedding(text, BufferedEmbeddingUsageDocument)
 	if len(vector) == 0 {
 		return nil
@@ -2508,26 +2878,13 @@ func upsertMemoryChunkEmbeddingTx(tx *sql.Tx, chunkID int64, text string) error
 	if strings.TrimSpace(modelName) == "" {
 		modelName = webEmbeddingModel
 	}
-	embeddingJSON, err := json.Marshal(vector)
-	if err != nil {
-		return fmt.Errorf("failed to marshal memory embedding: %w", err)
-	}
-	if _, err := tx.Exec(`
-		INSERT INTO memory_chunk_embeddings (
-			chunk_id, embedding_model, embedding_dim, embedding_json, updated_at
-		) VALUES (?, ?, ?, ?, ?)
-		ON CONFLICT(chunk_id) DO UPDATE SET
-			embedding_model = excluded.embedding_model,
-			embedding_dim = excluded.embedding_dim,
-			embedding_json = excluded.embedding_json,
-			updated_at = excluded.updated_at
-	`, chunkID, modelName, len(vector), string(embeddingJSON), time.Now().UTC()); err != nil {
+	if err := upsertChunkEmbeddingTx(tx, vectorIndexMemory, userID, chunkID, vector, modelName); err != nil {
 		return fmt.Errorf("failed to store memory chunk embedding: %w", err)
 	}
 	return nil
 }
 
-func upsertSavedTurnChunkEmbeddingTx(tx *sql.Tx, chunkID int64, text string) error {
+func upsertSavedTurnChunkEmbeddingTx(tx *sql.Tx, userID string, chunkID int64, text string) error {
 	vector, modelName := buildBufferedEmbedding(text, BufferedEmbeddingUsageDocument)
 	if len(vector) == 0 {
 		return nil
@@ -2535,20 +2892,7 @@ func upsertSavedTurnChunkEmbeddingTx(tx *sql.Tx, chunkID int64, text string) err
 	if strings.TrimSpace(modelName) == "" {
 		modelName = webEmbeddingModel
 	}
-	embeddingJSON, err := json.Marshal(vector)
-	if err != nil {
-		return fmt.Errorf("failed to marshal saved turn embedding: %w", err)
-	}
-	if _, err := tx.Exec(`
-		INSERT INTO saved_turn_chunk_embeddings (
-			chunk_id, embedding_model, embedding_dim, embedding_json, updated_at
-		) VALUES (?, ?, ?, ?, ?)
-		ON CONFLICT(chunk_id) DO UPDATE SET
-			embedding_model = excluded.embedding_model,
-			embedding_dim = excluded.embedding_dim,
-			embedding_json = excluded.embedding_json,
-			updated_at = excluded.updated_at
-	`, chunkID, modelName, len(vector), string(embeddingJSON), time.Now().UTC()); err != nil {
+	if err := upsertChunkEmbeddingTx(tx, vectorIndexSavedTurn, userID, chunkID, vector, modelName); err != nil {
 		return fmt.Errorf("failed to store saved turn chunk embedding: %w", err)
 	}
 	return nil
@@ -2796,11 +3140,64 @@ func searchMemoryChunkMatchesVector(userID, queryStr string, limit int) ([]Memor
 	if len(queryVector) == 0 {
 		return nil, nil
 	}
+	hits, err := searchChunkVectorIndex(vectorIndexMemory, userID, queryModel, queryVector, limit, nil)
+	if err != nil {
+		log.Printf("[DB] Memory vector index unavailable, scanning: %v", err)
+		return scanMemoryChunkMatchesVector(userID, queryVector, queryModel, limit)
+	}
+	if len(hits) == 0 {
+		return nil, nil
+	}
+
+	scores, chunkIDs := vectorHitScores(hits)
+	placeholders, args := sqlInt64Placeholders(chunkIDs)
+	rows, err := db.Query(`
+		SELECT
+			m.id, m.user_id, m.full_text, m.hit_count, m.created_at, m.memory_type,
+			mc.id, mc.chunk_index, mc.chunk_text
+		FROM memory_chunks mc
+		JOIN memories m ON m.id = mc.memory_id
+		WHERE mc.user_id = ?
+		  AND mc.id IN (`+placeholders+`)
+	`, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("memory chunk vector search failed: %w", err)
+	}
+	defer rows.Close()
+
+	var ranked []MemoryChunkMatch
+	for rows.Next() {
+		var match MemoryChunkMatch
+		if err := rows.Scan(
+			&match.ID,
+			&match.UserID,
+			&match.FullText,
+			&match.HitCount,
+			&match.CreatedAt,
+			&match.MemoryType,
+			&match.ChunkID,
+			&match.ChunkIndex,
+			&match.ChunkText,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan memory vector match: %w", err)
+		}
+		match.VectorScore = scores[match.ChunkID]
+		ranked = append(ranked, match)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortMemoryChunkMatchesByVector(ranked)
+	return ranked, nil
+}
 
+// scanMemoryChunkMatchesVector scores every stored memory vector. It backs
+// up the vector index when that cannot be loaded.
+func scanMemoryChunkMatchesVector(userID string, queryVector []float64, queryModel string, limit int) ([]MemoryChunkMatch, error) {
 	rows, err := db.Query(`
 		SELECT
 			m.id, m.user_id, m.full_text, m.hit_count, m.created_at, m.memory_type,
-			mc.id, mc.chunk_index, mc.chunk_text, e.embedding_json, e.embedding_model
+			mc.id, mc.chunk_index, mc.chunk_text, e.embedding_blob, e.embedding_json, e.embedding_model
 		FROM memory_chunks mc
 		JOIN memories m ON m.id = mc.memory_id
 		JOIN memory_chunk_embeddings e ON e.chunk_id = mc.id
@@ -2811,9 +3208,11 @@ func searchMemoryChunkMatchesVector(userID, queryStr string, limit int) ([]Memor
 	}
 	defer rows.Close()
 
+	query := toFloat32Vector(queryVector)
 	var ranked []MemoryChunkMatch
 	for rows.Next() {
 		var match MemoryChunkMatch
+		var embeddingBlob []byte
 		var embeddingJSON string
 		var embeddingModel string
 		if err := rows.Scan(
@@ -2826,6 +3225,7 @@ func searchMemoryChunkMatchesVector(userID, queryStr string, limit int) ([]Memor
 			&match.ChunkID,
 			&match.ChunkIndex,
 			&match.ChunkText,
+			&embeddingBlob,
 			&embeddingJSON,
 			&embeddingModel,
 		); err != nil {
@@ -2834,11 +3234,11 @@ func searchMemoryChunkMatchesVector(userID, queryStr string, limit int) ([]Memor
 		if strings.TrimSpace(queryModel) != "" && strings.TrimSpace(embeddingModel) != "" && embeddingModel != queryModel {
 			continue
 		}
-		vector, err := parseBufferedEmbeddingJSON(embeddingJSON)
+		vector, err := decodeStoredEmbedding(embeddingBlob, embeddingJSON)
 		if err != nil {
 			continue
 		}
-		score := cosineSimilarity(queryVector, vector)
+		score := dotFloat32(query, vector)
 		if score <= 0 {
 			continue
 		}
@@ -2849,6 +3249,14 @@ func searchMemoryChunkMatchesVector(userID, queryStr string, limit int) ([]Memor
 		return nil, err
 	}
 
+	sortMemoryChunkMatchesByVector(ranked)
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
+
+func sortMemoryChunkMatchesByVector(ranked []MemoryChunkMatch) {
 	sort.SliceStable(ranked, func(i, j int) bool {
 		if math.Abs(ranked[i].VectorScore-ranked[j].VectorScore) < 1e-9 {
 			if ranked[i].CreatedAt.Equal(ranked[j].CreatedAt) {
@@ -2858,10 +3266,6 @@ func searchMemoryChunkMatchesVector(userID, queryStr string, limit int) ([]Memor
 		}
 		return ranked[i].VectorScore > ranked[j].VectorScore
 	})
-	if len(ranked) > limit {
-		ranked = ranked[:limit]
-	}
-	return ranked, nil
 }
 
 func hybridSearchMemoryChunkMatches(userID, queryStr string, limit int) ([]MemoryChunkMatch, error) {
@@ -2878,41 +3282,46 @@ func hybridSearchMemoryChunkMatches(userID, queryStr string, limit int) ([]Memor
 		return nil, nil
 	}
 
-	merged := make(map[string]MemoryChunkMatch, len(ftsMatches)+len(vectorMatches))
-	for _, match := range ftsMatches {
-		match.HybridScore = match.FTSScore
-		key := fmt.Sprintf("%d:%d", match.ID, match.ChunkIndex)
-		merged[key] = match
-	}
-	for _, match := range vectorMatches {
+	matches := make([]MemoryChunkMatch, 0, len(ftsMatches)+len(vectorMatches))
+	candidates := make([]retrievalCandidate, 0, len(ftsMatches)+len(vectorMatches))
+	positions := make(map[string]int, len(ftsMatches)+len(vectorMatches))
+	for rank, match := range ftsMatches {
+		positions[fmt.Sprintf("%d:%d", match.ID, match.ChunkIndex)] = len(matches)
+		matches = append(matches, match)
+		candidates = append(candidates, retrievalCandidate{
+			FTSScore:  match.FTSScore,
+			FTSRank:   rank + 1,
+			CreatedAt: match.CreatedAt,
+			HitCount:  match.HitCount,
+			Text:      match.ChunkText,
+		})
+	}
+	for rank, match := range vectorMatches {
 		key := fmt.Sprintf("%d:%d", match.ID, match.ChunkIndex)
-		existing, ok := merged[key]
-		if ok {
-			existing.VectorScore = match.VectorScore
-			existing.HybridScore = (existing.FTSScore * 0.65) + (match.VectorScore * 0.35)
-			merged[key] = existing
+		if position, ok := positions[key]; ok {
+			matches[position].VectorScore = match.VectorScore
+			candidates[position].VectorScore = match.VectorScore
+			candidates[position].VectorRank = rank + 1
 			continue
 		}
-		match.HybridScore = match.VectorScore * 0.35
-		merged[key] = match
-	}
-
-	ranked := make([]MemoryChunkMatch, 0, len(merged))
-	for _, match := range merged {
+		positions[key] = len(matches)
+		matches = append(matches, match)
+		candidates = append(candidates, retrievalCandidate{
+			VectorScore: match.VectorScore,
+			VectorRank:  rank + 1,
+			CreatedAt:   match.CreatedAt,
+			HitCount:    match.HitCount,
+			Text:        match.ChunkText,
+		})
+	}
+
+	order, scores := rankRetrievalCandidates(queryStr, candidates, getRetrievalConfigForUser(userID), limit, time.Now())
+	ranked := make([]MemoryChunkMatch, 0, len(order))
+	for i, position := range order {
+		match := matches[position]
+		match.HybridScore = scores[i]
 		ranked = append(ranked, match)
 	}
-	sort.SliceStable(ranked, func(i, j int) bool {
-		if math.Abs(ranked[i].HybridScore-ranked[j].HybridScore) < 1e-9 {
-			if ranked[i].CreatedAt.Equal(ranked[j].CreatedAt) {
-				return ranked[i].ChunkIndex < ranked[j].ChunkIndex
-			}
-			return ranked[i].CreatedAt.After(ranked[j].CreatedAt)
-		}
-		return ranked[i].HybridScore > ranked[j].HybridScore
-	})
-	if len(ranked) > limit {
-		ranked = ranked[:limit]
-	}
 	return ranked, nil
 }
 
@@ -3014,7 +3423,7 @@ func ReadMemory(userID string, memoryID int64) (MemoryEntry, error) {
 	err := db.QueryRow(query, memoryID, userID).Scan(&m.ID, &m.UserID, &m.FullText, &m.HitCount, &m.CreatedAt, &m.MemoryType, &lastAccessedRaw, &m.ImportanceScore, &pinned, &m.MemoryTier)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return m, fmt.Errorf("memory not found")
+			return m, ErrMemoryNotFound
 		}
 		return m, fmt.Errorf("failed to read memory: %w", err)
 	}
@@ -3039,35 +3448,11 @@ func DeleteMemory(userID string, memoryID int64) error {
 		}
 	}()
 
-	rows, err := tx.Query(`SELECT id FROM memory_chunks WHERE memory_id = ? AND user_id = ?`, memoryID, userID)
-	if err != nil {
-		return fmt.Errorf("failed to query memory chunks for delete: %w", err)
-	}
-	var chunkIDs []int64
-	for rows.Next() {
-		var chunkID int64
-		if scanErr := rows.Scan(&chunkID); scanErr != nil {
-			rows.Close()
-			return fmt.Errorf("failed to scan memory chunk id for delete: %w", scanErr)
-		}
-		chunkIDs = append(chunkIDs, chunkID)
-	}
-	if err := rows.Err(); err != nil {
-		rows.Close()
-		return fmt.Errorf("failed to iterate memory chunk ids for delete: %w", err)
-	}
-	rows.Close()
-
-	for _, chunkID := range chunkIDs {
-		if _, err := tx.Exec(`DELETE FROM memory_chunk_embeddings WHERE chunk_id = ?`, chunkID); err != nil {
-			return fmt.Errorf("failed to delete memory chunk embedding: %w", err)
-		}
-		if _, err := tx.Exec(`DELETE FROM memory_chunks_fts WHERE rowid = ?`, chunkID); err != nil {
-			return fmt.Errorf("failed to delete memory chunk fts row: %w", err)
-		}
+	if err = deleteMemoryChunksTx(tx, memoryID, userID); err != nil {
+		return err
 	}
-	if _, err := tx.Exec(`DELETE FROM memory_chunks WHERE memory_id = ? AND user_id = ?`, memoryID, userID); err != nil {
-		return fmt.Errorf("failed to delete memory chunks: %w", err)
+	if _, err = tx.Exec(`DELETE FROM memory_provenance WHERE memory_id = ? AND user_id = ?`, memoryID, userID); err != nil {
+		return fmt.Errorf("failed to delete memory provenance: %w", err)
 	}
 
 	res, err := tx.Exec(`
@@ -3082,11 +3467,13 @@ func DeleteMemory(userID string, memoryID int64) error {
 		return fmt.Errorf("failed to get rows affected: %w", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("memory not found or not owned by user")
+		err = fmt.Errorf("memory not found or not owned by user")
+		return err
 	}
-	if err := tx.Commit(); err != nil {
+	if err = tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit memory delete: %w", err)
 	}
+	notifyMemoryChanged(userID)
 
 	return nil
 }
@@ -3108,13 +3495,21 @@ type UserProfileFact struct {
 // UpsertUserProfileFact inserts or updates a structured fact about the user.
 // If a fact with the same user_id and fact_key already exists, its value is updated.
 func UpsertUserProfileFact(userID, factKey, factValue, category, source string) (int64, error) {
+	fact, err := SaveUserProfileFact(userID, factKey, factValue, category, source, ProfileFactRef{})
+	return fact.ID, err
+}
+
+// SaveUserProfileFact is UpsertUserProfileFact with a source reference for
+// the fact's history. It returns the stored fact, whose key may be an
+// existing key of the same concept rather than factKey.
+func SaveUserProfileFact(userID, factKey, factValue, category, source string, ref ProfileFactRef) (fact UserProfileFact, err error) {
 	if db == nil {
-		return 0, fmt.Errorf("database not initialized")
+		return fact, fmt.Errorf("database not initialized")
 	}
 	factKey = strings.TrimSpace(factKey)
 	factValue = strings.TrimSpace(factValue)
 	if factKey == "" || factValue == "" {
-		return 0, fmt.Errorf("fact_key and fact_value must not be empty")
+		return fact, fmt.Errorf("fact_key and fact_value must not be empty")
 	}
 	if category == "" {
 		category = "general"
@@ -3123,8 +3518,43 @@ func UpsertUserProfileFact(userID, factKey, factValue, category, source string)
 		source = "llm"
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		return fact, fmt.Errorf("failed to start user profile fact upsert: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if factKey, err = resolveProfileFactKeyTx(tx, userID, factKey); err != nil {
+		return fact, err
+	}
+	if fact, err = upsertUserProfileFactTx(tx, userID, factKey, factValue, category, source, ref); err != nil {
+		return fact, err
+	}
+	if err = tx.Commit(); err != nil {
+		return fact, fmt.Errorf("failed to commit user profile fact upsert: %w", err)
+	}
+	notifyMemoryChanged(userID)
+	return fact, nil
+}
+
+// upsertUserProfileFactTx writes an already validated fact under exactly
+// factKey and returns the stored row, whose id stays the same when an
+// existing key is updated. A changed value or category opens a new version
+// in the fact's history.
+func upsertUserProfileFactTx(tx *sql.Tx, userID, factKey, factValue, category, source string, ref ProfileFactRef) (UserProfileFact, error) {
+	var previous UserProfileFact
+	err := tx.QueryRow(`SELECT fact_value, category FROM user_profile_facts WHERE user_id = ? AND fact_key = ?`, userID, factKey).
+		Scan(&previous.FactValue, &previous.Category)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return UserProfileFact{}, fmt.Errorf("failed to read user profile fact: %w", err)
+	}
+
 	now := time.Now().UTC()
-	result, err := db.Exec(`
+	if _, err := tx.Exec(`
 		INSERT INTO user_profile_facts (user_id, fact_key, fact_value, category, source, created_at, updated_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(user_id, fact_key) DO UPDATE SET
@@ -3132,11 +3562,23 @@ func UpsertUserProfileFact(userID, factKey, factValue, category, source string)
 			category = excluded.category,
 			source = excluded.source,
 			updated_at = excluded.updated_at
-	`, userID, factKey, factValue, category, source, now, now)
-	if err != nil {
-		return 0, fmt.Errorf("failed to upsert user profile fact: %w", err)
+	`, userID, factKey, factValue, category, source, now, now); err != nil {
+		return UserProfileFact{}, fmt.Errorf("failed to upsert user profile fact: %w", err)
 	}
-	return result.LastInsertId()
+	if !exists || previous.FactValue != factValue || previous.Category != category {
+		if err := recordProfileFactVersionTx(tx, userID, factKey, factValue, category, source, ref, now); err != nil {
+			return UserProfileFact{}, err
+		}
+	}
+
+	var fact UserProfileFact
+	if err := tx.QueryRow(`
+		SELECT id, user_id, fact_key, fact_value, category, source, created_at, updated_at
+		FROM user_profile_facts WHERE user_id = ? AND fact_key = ?`, userID, factKey,
+	).Scan(&fact.ID, &fact.UserID, &fact.FactKey, &fact.FactValue, &fact.Category, &fact.Source, &fact.CreatedAt, &fact.UpdatedAt); err != nil {
+		return UserProfileFact{}, fmt.Errorf("failed to read user profile fact: %w", err)
+	}
+	return fact, nil
 }
 
 // GetUserProfileFacts returns all profile facts for a user, ordered by category then key.
@@ -3168,7 +3610,7 @@ func GetUserProfileFacts(userID string) ([]UserProfileFact, error) {
 }
 
 // DeleteUserProfileFact removes a specific profile fact by user_id and fact_key.
-func DeleteUserProfileFact(userID, factKey string) error {
+func DeleteUserProfileFact(userID, factKey string) (err error) {
 	if db == nil {
 		return fmt.Errorf("database not initialized")
 	}
@@ -3177,55 +3619,91 @@ func DeleteUserProfileFact(userID, factKey string) error {
 		return fmt.Errorf("fact_key must not be empty")
 	}
 
-	result, err := db.Exec(`
-		DELETE FROM user_profile_facts
-		WHERE user_id = ? AND fact_key = ?
-	`, userID, factKey)
+	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to delete user profile fact: %w", err)
+		return fmt.Errorf("failed to start user profile fact delete: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var factID int64
+	err = tx.QueryRow(`SELECT id FROM user_profile_facts WHERE user_id = ? AND fact_key = ?`, userID, factKey).Scan(&factID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("profile fact '%s' not found for user", factKey)
 	}
-
-	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to check deleted rows: %w", err)
+		return fmt.Errorf("failed to read user profile fact: %w", err)
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("profile fact '%s' not found for user", factKey)
+	if err = deleteUserProfileFactTx(tx, userID, factID, factKey); err != nil {
+		return err
 	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit user profile fact delete: %w", err)
+	}
+	notifyMemoryChanged(userID)
 	return nil
 }
 
 // DeleteUserProfileFactByID removes a specific profile fact by its numeric ID.
-func DeleteUserProfileFactByID(userID string, factID int64) error {
+func DeleteUserProfileFactByID(userID string, factID int64) (err error) {
 	if db == nil {
 		return fmt.Errorf("database not initialized")
 	}
 
-	result, err := db.Exec(`
-		DELETE FROM user_profile_facts
-		WHERE id = ? AND user_id = ?
-	`, factID, userID)
+	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to delete user profile fact by ID: %w", err)
+		return fmt.Errorf("failed to start user profile fact delete: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var factKey string
+	err = tx.QueryRow(`SELECT fact_key FROM user_profile_facts WHERE id = ? AND user_id = ?`, factID, userID).Scan(&factKey)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("profile fact ID %d not found for user", factID)
 	}
-
-	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to check deleted rows: %w", err)
+		return fmt.Errorf("failed to read user profile fact: %w", err)
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("profile fact ID %d not found for user", factID)
+	if err = deleteUserProfileFactTx(tx, userID, factID, factKey); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit user profile fact delete: %w", err)
+	}
+	notifyMemoryChanged(userID)
+	return nil
+}
+
+// deleteUserProfileFactTx removes an existing fact and its provenance and
+// closes its open version. History outlives the fact so a deletion can be
+// reverted.
+func deleteUserProfileFactTx(tx *sql.Tx, userID string, factID int64, factKey string) error {
+	if _, err := tx.Exec(`DELETE FROM memory_provenance WHERE user_id = ? AND profile_fact_id = ?`, userID, factID); err != nil {
+		return fmt.Errorf("failed to delete user profile fact provenance: %w", err)
+	}
+	if err := closeProfileFactVersionTx(tx, userID, factKey, time.Now().UTC()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_profile_facts WHERE id = ? AND user_id = ?`, factID, userID); err != nil {
+		return fmt.Errorf("failed to delete user profile fact: %w", err)
 	}
 	return nil
 }
 
 // FormatUserProfileForPrompt builds a formatted string of all profile facts for system prompt injection.
+// Only the newest fact of each concept is included.
 func FormatUserProfileForPrompt(userID string) string {
 	facts, err := GetUserProfileFacts(userID)
 	if err != nil {
 		log.Printf("[ToolRuntime] Failed to load user profile facts: %v", err)
 		return ""
 	}
+	facts = currentUserProfileFacts(facts)
 	if len(facts) == 0 {
 		return ""
 	}
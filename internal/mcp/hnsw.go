@@ -0,0 +1,375 @@
+package mcp
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	hnswDefaultM              = 16
+	hnswDefaultEfConstruction = 200
+	hnswDefaultEfSearch       = 96
+
+	// hnswExactLimit is the number of vectors up to which Search scans them
+	// all; below it a graph walk costs more than it saves.
+	hnswExactLimit = 512
+)
+
+// hnswNode is one vector in the graph. Links[level] holds neighbour node
+// indexes. Removed nodes stay in the graph as waypoints until compaction.
+type hnswNode struct {
+	ID      int64
+	Vector  []float32
+	Links   [][]int32
+	Deleted bool
+}
+
+// hnswGraph is an in-process HNSW index over dot-product similarity, which
+// equals cosine similarity for the normalized embeddings stored here. It is
+// not safe for concurrent use; chunkVectorIndex guards it.
+type hnswGraph struct {
+	Dim            int
+	M              int
+	EfConstruction int
+	EfSearch       int
+	Entry          int32
+	MaxLevel       int
+	Nodes          []hnswNode
+
+	ids  map[int64]int32
+	live int
+	rng  *rand.Rand
+}
+
+type vectorHit struct {
+	ID    int64
+	Score float64
+}
+
+type hnswCandidate struct {
+	node int32
+	dist float64
+}
+
+type hnswNearestHeap []hnswCandidate
+
+func (h hnswNearestHeap) Len() int            { return len(h) }
+func (h hnswNearestHeap) Less(i, j int) bool  { return h[i].dist < h[j].dist }
+func (h hnswNearestHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hnswNearestHeap) Push(x interface{}) { *h = append(*h, x.(hnswCandidate)) }
+func (h *hnswNearestHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+type hnswFurthestHeap []hnswCandidate
+
+func (h hnswFurthestHeap) Len() int            { return len(h) }
+func (h hnswFurthestHeap) Less(i, j int) bool  { return h[i].dist > h[j].dist }
+func (h hnswFurthestHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hnswFurthestHeap) Push(x interface{}) { *h = append(*h, x.(hnswCandidate)) }
+func (h *hnswFurthestHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func newHNSWGraph(dim int) *hnswGraph {
+	g := &hnswGraph{
+		Dim:            dim,
+		M:              hnswDefaultM,
+		EfConstruction: hnswDefaultEfConstruction,
+		EfSearch:       hnswDefaultEfSearch,
+		Entry:          -1,
+	}
+	g.reindex()
+	return g
+}
+
+// reindex restores the unexported lookup state after decoding.
+func (g *hnswGraph) reindex() {
+	g.ids = make(map[int64]int32, len(g.Nodes))
+	g.live = 0
+	for index, node := range g.Nodes {
+		if !node.Deleted {
+			g.ids[node.ID] = int32(index)
+			g.live++
+		}
+	}
+	g.rng = rand.New(rand.NewSource(int64(len(g.Nodes)) + 1))
+}
+
+func dotFloat32(a, b []float32) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot
+}
+
+func (g *hnswGraph) Len() int {
+	return g.live
+}
+
+func (g *hnswGraph) Has(id int64) bool {
+	_, ok := g.ids[id]
+	return ok
+}
+
+func (g *hnswGraph) distance(query []float32, node int32) float64 {
+	return 1 - dotFloat32(query, g.Nodes[node].Vector)
+}
+
+func (g *hnswGraph) randomLevel() int {
+	return int(math.Floor(-math.Log(1-g.rng.Float64()) / math.Log(float64(g.M))))
+}
+
+// Add inserts or replaces the vector for id. Vectors of another dimension
+// are ignored.
+func (g *hnswGraph) Add(id int64, vector []float32) {
+	if len(vector) != g.Dim {
+		return
+	}
+	g.Remove(id)
+
+	level := g.randomLevel()
+	node := int32(len(g.Nodes))
+	g.Nodes = append(g.Nodes, hnswNode{ID: id, Vector: vector, Links: make([][]int32, level+1)})
+	g.ids[id] = node
+	g.live++
+	if g.Entry < 0 {
+		g.Entry, g.MaxLevel = node, level
+		return
+	}
+
+	entry := g.Entry
+	for lc := g.MaxLevel; lc > level; lc-- {
+		entry = g.greedy(vector, entry, lc)
+	}
+	entries := []int32{entry}
+	for lc := min(level, g.MaxLevel); lc >= 0; lc-- {
+		candidates := g.searchLayer(vector, entries, g.EfConstruction, lc, nil)
+		neighbours := g.selectNeighbours(candidates, g.M)
+		g.Nodes[node].Links[lc] = neighbours
+		for _, neighbour := range neighbours {
+			g.link(neighbour, node, lc)
+		}
+		entries = entries[:0]
+		for _, candidate := range candidates {
+			entries = append(entries, candidate.node)
+		}
+	}
+	if level > g.MaxLevel {
+		g.Entry, g.MaxLevel = node, level
+	}
+}
+
+// Remove drops id from search results. The graph is rebuilt once removed
+// nodes outnumber live ones so walks stay short.
+func (g *hnswGraph) Remove(id int64) bool {
+	node, ok := g.ids[id]
+	if !ok {
+		return false
+	}
+	delete(g.ids, id)
+	g.Nodes[node].Deleted = true
+	g.live--
+	if len(g.Nodes) > hnswExactLimit && g.live < len(g.Nodes)/2 {
+		g.compact()
+	}
+	return true
+}
+
+func (g *hnswGraph) compact() {
+	nodes := g.Nodes
+	g.Nodes, g.Entry, g.MaxLevel = nil, -1, 0
+	g.reindex()
+	for _, node := range nodes {
+		if !node.Deleted {
+			g.Add(node.ID, node.Vector)
+		}
+	}
+}
+
+// Search returns up to k live vectors most similar to query. When accept is
+// set only its ids are returned. Small graphs and small accept sets are
+// scanned exactly.
+func (g *hnswGraph) Search(query []float32, k int, accept map[int64]bool) []vectorHit {
+	if k <= 0 || g.live == 0 || len(query) != g.Dim {
+		return nil
+	}
+	if g.live <= hnswExactLimit || (accept != nil && len(accept) <= hnswExactLimit) {
+		return g.Exact(query, k, accept)
+	}
+
+	entry := g.Entry
+	for lc := g.MaxLevel; lc > 0; lc-- {
+		entry = g.greedy(query, entry, lc)
+	}
+	candidates := g.searchLayer(query, []int32{entry}, max(g.EfSearch, k), 0, func(node int32) bool {
+		return !g.Nodes[node].Deleted && (accept == nil || accept[g.Nodes[node].ID])
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	hits := make([]vectorHit, 0, len(candidates))
+	for _, candidate := range candidates {
+		hits = append(hits, vectorHit{ID: g.Nodes[candidate.node].ID, Score: 1 - candidate.dist})
+	}
+	return hits
+}
+
+// Exact scores every live vector (or every accepted one) against query.
+func (g *hnswGraph) Exact(query []float32, k int, accept map[int64]bool) []vectorHit {
+	if k <= 0 || len(query) != g.Dim {
+		return nil
+	}
+	var hits []vectorHit
+	if accept != nil && len(accept) < g.live {
+		for id := range accept {
+			if node, ok := g.ids[id]; ok {
+				hits = append(hits, vectorHit{ID: id, Score: dotFloat32(query, g.Nodes[node].Vector)})
+			}
+		}
+	} else {
+		for _, node := range g.Nodes {
+			if !node.Deleted && (accept == nil || accept[node.ID]) {
+				hits = append(hits, vectorHit{ID: node.ID, Score: dotFloat32(query, node.Vector)})
+			}
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score == hits[j].Score {
+			return hits[i].ID < hits[j].ID
+		}
+		return hits[i].Score > hits[j].Score
+	})
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+// greedy walks one layer towards query and returns the closest node found.
+func (g *hnswGraph) greedy(query []float32, entry int32, level int) int32 {
+	best, bestDist := entry, g.distance(query, entry)
+	for changed := true; changed; {
+		changed = false
+		for _, next := range g.Nodes[best].Links[level] {
+			if dist := g.distance(query, next); dist < bestDist {
+				best, bestDist, changed = next, dist, true
+			}
+		}
+	}
+	return best
+}
+
+// searchLayer is the HNSW beam search. Nodes rejected by accept are still
+// walked through but never returned. The result is sorted nearest first.
+func (g *hnswGraph) searchLayer(query []float32, entries []int32, ef, level int, accept func(int32) bool) []hnswCandidate {
+	visited := make(map[int32]struct{}, ef*4)
+	candidates := &hnswNearestHeap{}
+	results := &hnswFurthestHeap{}
+	for _, entry := range entries {
+		if _, seen := visited[entry]; seen {
+			continue
+		}
+		visited[entry] = struct{}{}
+		candidate := hnswCandidate{node: entry, dist: g.distance(query, entry)}
+		heap.Push(candidates, candidate)
+		if accept == nil || accept(entry) {
+			heap.Push(results, candidate)
+			if results.Len() > ef {
+				heap.Pop(results)
+			}
+		}
+	}
+
+	for candidates.Len() > 0 {
+		current := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && current.dist > (*results)[0].dist {
+			break
+		}
+		for _, next := range g.Nodes[current.node].Links[level] {
+			if _, seen := visited[next]; seen {
+				continue
+			}
+			visited[next] = struct{}{}
+			dist := g.distance(query, next)
+			if results.Len() >= ef && dist >= (*results)[0].dist {
+				continue
+			}
+			heap.Push(candidates, hnswCandidate{node: next, dist: dist})
+			if accept == nil || accept(next) {
+				heap.Push(results, hnswCandidate{node: next, dist: dist})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	nearest := make([]hnswCandidate, results.Len())
+	for i := len(nearest) - 1; i >= 0; i-- {
+		nearest[i] = heap.Pop(results).(hnswCandidate)
+	}
+	return nearest
+}
+
+// selectNeighbours applies the HNSW diversity heuristic to candidates
+// (nearest first) and tops up with the nearest skipped ones.
+func (g *hnswGraph) selectNeighbours(candidates []hnswCandidate, m int) []int32 {
+	selected := make([]int32, 0, m)
+	skipped := make([]int32, 0, len(candidates))
+	for _, candidate := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		diverse := true
+		for _, chosen := range selected {
+			if 1-dotFloat32(g.Nodes[candidate.node].Vector, g.Nodes[chosen].Vector) < candidate.dist {
+				diverse = false
+				break
+			}
+		}
+		if diverse {
+			selected = append(selected, candidate.node)
+		} else {
+			skipped = append(skipped, candidate.node)
+		}
+	}
+	for _, node := range skipped {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, node)
+	}
+	return selected
+}
+
+// link adds a back-link and prunes the neighbour list when it is full.
+func (g *hnswGraph) link(from, to int32, level int) {
+	links := append(g.Nodes[from].Links[level], to)
+	limit := g.M
+	if level == 0 {
+		limit = 2 * g.M
+	}
+	if len(links) > limit {
+		vector := g.Nodes[from].Vector
+		candidates := make([]hnswCandidate, 0, len(links))
+		for _, node := range links {
+			candidates = append(candidates, hnswCandidate{node: node, dist: g.distance(vector, node)})
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+		links = g.selectNeighbours(candidates, limit)
+	}
+	g.Nodes[from].Links[level] = links
+}
@@ -12,10 +12,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -36,6 +34,8 @@ type Tool struct {
 }
 
 type ToolContext struct {
+	// Context carries the caller's cancellation; nil means no cancellation.
+	Context        context.Context
 	RequestID      string
 	UserID         string
 	EnableMemory   bool
@@ -43,6 +43,10 @@ type ToolContext struct {
 	LocationInfo   string
 	DisallowedCmds []string
 	DisallowedDirs []string
+	AllowedCmds    []string
+	AllowedDirs    []string
+	CommandMode    string
+	CommandJail    bool
 }
 
 type ToolHost interface {
@@ -57,23 +61,6 @@ type ToolHostFuncs struct {
 	ReadTerminalTailFunc func(lines int, maxWaitMs int, idleMs int) (string, error)
 }
 
-type timedToolCacheEntry struct {
-	Value    string
-	StoredAt time.Time
-}
-
-var (
-	searchCacheMu sync.Mutex
-	searchCache   = make(map[string]timedToolCacheEntry)
-	pageCacheMu   sync.Mutex
-	pageCache     = make(map[string]timedToolCacheEntry)
-)
-
-const (
-	searchCacheTTL = 10 * time.Minute
-	pageCacheTTL   = 30 * time.Minute
-)
-
 type ToolHooks struct {
 	Trace                   func(source, stage, message string, details map[string]interface{})
 	SearchMemory            func(userID, query string) (string, error)
@@ -165,6 +152,8 @@ func getHost() ToolHost {
 	return currentHost
 }
 
+// GetToolList returns every built-in tool. Whether one is switched on is
+// decided at call time by IsToolEnabled, so admin changes apply live.
 func GetToolList() []Tool {
 	tools := []Tool{
 		{
@@ -400,20 +389,18 @@ func GetToolList() []Tool {
 				"properties": map[string]interface{}{
 					"command": map[string]interface{}{
 						"type":        "string",
-						"description": "The shell command to execute.",
+						"description": "The shell command to execute. Users with command restrictions run one program with plain arguments: no pipes, redirects, variables, globs or cd.",
+					},
+					"cwd": map[string]interface{}{
+						"type":        "string",
+						"description": "Optional working directory. Use this instead of cd.",
 					},
 				},
 				"required": []string{"command"},
 			},
 		},
 	}
-	filtered := make([]Tool, 0, len(tools))
-	for _, tool := range tools {
-		if isToolConfiguredEnabled(tool.Name) {
-			filtered = append(filtered, tool)
-		}
-	}
-	return filtered
+	return tools
 }
 
 func compactMemoryText(input string, limit int) string {
@@ -1067,7 +1054,7 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 
 	log.Printf("[Tool Runtime] Execute: %s (User: %s, Memory: %v, Loc: %s)", toolName, userID, enableMemory, ctx.LocationInfo)
 	toolName, argumentsJSON = normalizeToolArguments(toolName, argumentsJSON)
-	if !isToolConfiguredEnabled(toolName) {
+	if !IsToolEnabled(toolName) {
 		return "", fmt.Errorf("tool '%s' is disabled by app config", toolName)
 	}
 	emitTraceEvent("tool_runtime", "tool.start", "Executing app tool", traceDetailsMap(
@@ -1093,7 +1080,7 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for search_web: %v", err)
 		}
-		result, err := SearchWeb(args.Query)
+		result, err := cachedToolFetch(ctx.Context, func() (string, error) { return SearchWeb(args.Query) })
 		if err == nil {
 			result, err = bufferToolResult(userID, toolName, args.Query, "", fmt.Sprintf("Search: %s", compactMemoryText(args.Query, 80)), result)
 		}
@@ -1107,7 +1094,7 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for search_web_multi: %v", err)
 		}
-		result, err := SearchWebMulti(args.Queries)
+		result, err := cachedToolFetch(ctx.Context, func() (string, error) { return SearchWebMulti(args.Queries) })
 		if err == nil {
 			result, err = bufferToolResult(userID, toolName, strings.Join(args.Queries, " | "), "", "Parallel web search", result)
 		}
@@ -1121,7 +1108,7 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for read_web_page: %v", err)
 		}
-		result, err := ReadPage(args.URL)
+		result, err := cachedToolFetch(ctx.Context, func() (string, error) { return ReadPage(args.URL) })
 		if err == nil {
 			result, err = bufferToolResult(userID, toolName, "", args.URL, "", result)
 		} else {
@@ -1177,7 +1164,7 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for search_memory: %v", err)
 		}
-		result, err := runSearchMemoryHook(userID, args.Query)
+		result, err := cachedToolFetch(ctx.Context, func() (string, error) { return runSearchMemoryHook(userID, args.Query) })
 		emitToolResultTrace(toolName, start, result, err)
 		return result, err
 
@@ -1191,7 +1178,7 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for read_memory: %v", err)
 		}
-		result, err := runReadMemoryHook(userID, args.MemoryID)
+		result, err := cachedToolFetch(ctx.Context, func() (string, error) { return runReadMemoryHook(userID, args.MemoryID) })
 		emitToolResultTrace(toolName, start, result, err)
 		return result, err
 
@@ -1206,7 +1193,9 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for read_memory_context: %v", err)
 		}
-		result, err := runReadMemoryContextHook(userID, args.MemoryID, args.ChunkIndex)
+		result, err := cachedToolFetch(ctx.Context, func() (string, error) {
+			return runReadMemoryContextHook(userID, args.MemoryID, args.ChunkIndex)
+		})
 		emitToolResultTrace(toolName, start, result, err)
 		return result, err
 
@@ -1236,12 +1225,15 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for save_user_fact: %v", err)
 		}
-		factID, err := UpsertUserProfileFact(userID, args.FactKey, args.FactValue, args.Category, "llm")
+		fact, err := SaveUserProfileFact(userID, args.FactKey, args.FactValue, args.Category, "llm", ProfileFactRef{})
 		if err != nil {
 			emitToolResultTrace(toolName, start, "", err)
 			return "", err
 		}
-		result := fmt.Sprintf("Saved user profile fact: %s = %s (ID: %d)", args.FactKey, args.FactValue, factID)
+		result := fmt.Sprintf("Saved user profile fact: %s = %s (ID: %d)", fact.FactKey, fact.FactValue, fact.ID)
+		if fact.FactKey != strings.TrimSpace(args.FactKey) {
+			result += fmt.Sprintf(" (updated existing key %q instead of adding %q)", fact.FactKey, strings.TrimSpace(args.FactKey))
+		}
 		emitToolResultTrace(toolName, start, result, nil)
 		return result, nil
 
@@ -1276,7 +1268,7 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for namu_wiki: %v", err)
 		}
-		result, err := SearchNamuwiki(args.Keyword)
+		result, err := cachedToolFetch(ctx.Context, func() (string, error) { return SearchNamuwiki(args.Keyword) })
 		if err == nil {
 			result, err = bufferToolResult(userID, toolName, args.Keyword, fmt.Sprintf("https://namu.wiki/w/%s", args.Keyword), "", result)
 		}
@@ -1290,7 +1282,7 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 		if err := json.Unmarshal(argumentsJSON, &args); err != nil {
 			return "", fmt.Errorf("invalid arguments for naver_search: %v", err)
 		}
-		result, err := SearchNaver(args.Query)
+		result, err := cachedToolFetch(ctx.Context, func() (string, error) { return SearchNaver(args.Query) })
 		if err == nil {
 			result, err = bufferToolResult(userID, toolName, args.Query, "", fmt.Sprintf("Naver: %s", compactMemoryText(args.Query, 80)), result)
 		}
@@ -1355,7 +1347,14 @@ func ExecuteToolWithContext(toolName string, argumentsJSON []byte, ctx ToolConte
 			emitToolResultTrace(toolName, start, result, err)
 			return result, err
 		}
-		result, err := ExecuteCommand(command, ctx.DisallowedCmds, ctx.DisallowedDirs)
+		result, err := ExecuteCommandWithPolicy(ctx.Context, command, args["cwd"], CommandPolicy{
+			Mode:               ctx.CommandMode,
+			AllowedCommands:    ctx.AllowedCmds,
+			DisallowedCommands: ctx.DisallowedCmds,
+			AllowedDirs:        ctx.AllowedDirs,
+			DisallowedDirs:     ctx.DisallowedDirs,
+			Jail:               ctx.CommandJail,
+		})
 		emitToolResultTrace(toolName, start, result, err)
 		return result, err
 
@@ -1398,8 +1397,6 @@ type webSearchResult struct {
 	PublishedAt string
 }
 
-const maxTimedToolCacheEntries = 64
-
 // SearchWeb performs a web search using DuckDuckGo Lite.
 func SearchWeb(query string) (string, error) {
 	originalQuery := query
@@ -1411,13 +1408,6 @@ func SearchWeb(query string) (string, error) {
 		traceArgs = append(traceArgs, "original_query", originalQuery)
 	}
 
-	cacheKey := strings.ToLower(strings.Join(strings.Fields(query), " "))
-	cacheTTL := searchCacheTTLForQuery(query)
-	if cached, ok := getTimedToolCache(searchCache, &searchCacheMu, cacheKey, cacheTTL); ok {
-		emitTraceEvent("tool_runtime", "search_web.cache_hit", "Using cached web search result", traceDetailsMap("query", query, "elapsed_ms", toolDurationMs(start), "provider", "duckduckgo"))
-		return cached, nil
-	}
-
 	emitTraceEvent("tool_runtime", "search_web.start", "Starting web search", traceDetailsMap(traceArgs...))
 
 	client := &http.Client{Timeout: 12 * time.Second}
@@ -1432,9 +1422,7 @@ func SearchWeb(query string) (string, error) {
 	}
 
 	emitTraceEvent("tool_runtime", "search_web.complete", "Web search completed", traceDetailsMap("query", query, "elapsed_ms", toolDurationMs(start), "results", len(results), "provider", provider))
-	formatted := formatSearchResultsWithGuidance(query, provider, results)
-	setTimedToolCache(searchCache, &searchCacheMu, cacheKey, formatted, cacheTTL)
-	return formatted, nil
+	return formatSearchResultsWithGuidance(query, provider, results), nil
 }
 
 type parallelSearchOutcome struct {
@@ -2043,54 +2031,9 @@ func shouldReadTopSearchResult(query string, result webSearchResult) bool {
 	return (quality == "authoritative" || quality == "reputable_news" || quality == "primary_repository") && len([]rune(result.Snippet)) < 80
 }
 
-func getTimedToolCache(cache map[string]timedToolCacheEntry, mu *sync.Mutex, key string, ttl time.Duration) (string, bool) {
-	key = strings.TrimSpace(key)
-	if key == "" {
-		return "", false
-	}
-	mu.Lock()
-	defer mu.Unlock()
-	entry, ok := cache[key]
-	if !ok {
-		return "", false
-	}
-	if time.Since(entry.StoredAt) > ttl {
-		delete(cache, key)
-		return "", false
-	}
-	return entry.Value, true
-}
-
-func setTimedToolCache(cache map[string]timedToolCacheEntry, mu *sync.Mutex, key, value string, ttl ...time.Duration) {
-	key = strings.TrimSpace(key)
-	if key == "" || strings.TrimSpace(value) == "" {
-		return
-	}
-	mu.Lock()
-	defer mu.Unlock()
-	entryTTL := searchCacheTTL
-	if len(ttl) > 0 && ttl[0] > 0 {
-		entryTTL = ttl[0]
-	}
-	for existingKey, entry := range cache {
-		if time.Since(entry.StoredAt) > entryTTL {
-			delete(cache, existingKey)
-		}
-	}
-	for len(cache) >= maxTimedToolCacheEntries {
-		var oldestKey string
-		var oldestTime time.Time
-		for existingKey, entry := range cache {
-			if oldestKey == "" || entry.StoredAt.Before(oldestTime) {
-				oldestKey, oldestTime = existingKey, entry.StoredAt
-			}
-		}
-		delete(cache, oldestKey)
-	}
-	cache[key] = timedToolCacheEntry{Value: value, StoredAt: time.Now()}
-}
-
-func searchCacheTTLForQuery(query string) time.Duration {
+// SearchCacheTTL shortens base for queries about fast-changing facts and
+// lengthens it for documentation lookups.
+func SearchCacheTTL(query string, base time.Duration) time.Duration {
 	lower := strings.ToLower(query)
 	volatile := []string{"오늘", "현재", "실시간", "속보", "날씨", "주가", "환율", "경기 결과", "today", "current", "latest", "breaking", "weather", "stock price", "exchange rate", "score"}
 	for _, signal := range volatile {
@@ -2104,7 +2047,7 @@ func searchCacheTTLForQuery(query string) time.Duration {
 			return 30 * time.Minute
 		}
 	}
-	return searchCacheTTL
+	return base
 }
 
 func fetchSearchPage(client *http.Client, searchURL string) (string, error) {
@@ -2173,19 +2116,11 @@ func SearchNaver(query string) (string, error) {
 	query = normalizeToolSearchQuery(query)
 	log.Printf("[ToolRuntime] Searching Naver for: %s", query)
 	start := time.Now()
-	cacheKey := "naver:" + strings.ToLower(strings.Join(strings.Fields(query), " "))
-	cacheTTL := searchCacheTTLForQuery(query)
-	if cached, ok := getTimedToolCache(searchCache, &searchCacheMu, cacheKey, cacheTTL); ok {
-		emitTraceEvent("tool_runtime", "naver_search.cache_hit", "Using cached Naver search result", traceDetailsMap("query", query, "elapsed_ms", toolDurationMs(start), "provider", "naver"))
-		return cached, nil
-	}
-
 	searchURL := fmt.Sprintf("https://search.naver.com/search.naver?&sm=top_hty&fbm=0&ie=utf8&query=%s", url.QueryEscape(query))
 	client := &http.Client{Timeout: 8 * time.Second}
 	if pageHTML, err := fetchSearchPage(client, searchURL); err == nil {
 		if results, parseErr := parseNaverSearchResults(pageHTML, 5); parseErr == nil && len(results) > 0 {
 			formatted := formatSearchResultsWithGuidance(query, "naver", results)
-			setTimedToolCache(searchCache, &searchCacheMu, cacheKey, formatted, cacheTTL)
 			emitTraceEvent("tool_runtime", "naver_search.complete", "Naver search completed via HTTP", traceDetailsMap("query", query, "elapsed_ms", toolDurationMs(start), "results", len(results), "provider", "naver", "mode", "http"))
 			return formatted, nil
 		}
@@ -2262,17 +2197,10 @@ func ReadPage(pageURL string) (string, error) {
 	start := time.Now()
 	emitTraceEvent("tool_runtime", "read_web_page.start", "Starting page read", traceDetailsMap("url", pageURL))
 
-	cacheKey := strings.TrimSpace(pageURL)
-	if cached, ok := getTimedToolCache(pageCache, &pageCacheMu, cacheKey, pageCacheTTL); ok {
-		emitTraceEvent("tool_runtime", "read_web_page.cache_hit", "Using cached page read result", traceDetailsMap("url", pageURL, "elapsed_ms", toolDurationMs(start), "chars", len(cached)))
-		return cached, nil
-	}
-
 	if fastResult, err := readPageFastHTTP(pageURL); err == nil && isUsefulFastPageResult(fastResult) {
 		if len(fastResult) > 30000 {
 			fastResult = fastResult[:30000] + "... (truncated)"
 		}
-		setTimedToolCache(pageCache, &pageCacheMu, cacheKey, fastResult)
 		emitTraceEvent("tool_runtime", "read_web_page.complete", "Page read completed via fast HTTP path", traceDetailsMap("url", pageURL, "elapsed_ms", toolDurationMs(start), "chars", len(fastResult), "mode", "http_fast_path"))
 		return fastResult, nil
 	}
@@ -2456,7 +2384,6 @@ func ReadPage(pageURL string) (string, error) {
 	if len(res) > 30000 {
 		res = res[:30000] + "... (truncated)"
 	}
-	setTimedToolCache(pageCache, &pageCacheMu, cacheKey, res)
 
 	emitTraceEvent("tool_runtime", "read_web_page.complete", "Page read completed", traceDetailsMap("url", pageURL, "elapsed_ms", toolDurationMs(start), "chars", len(res)))
 	return res, nil
@@ -2688,53 +2615,78 @@ func defaultNormalizeSearchQuery(query string) string {
 
 // ExecuteCommand runs a shell command with restrictions
 func ExecuteCommand(command string, disallowedCmds []string, disallowedDirs []string) (string, error) {
-	log.Printf("[ToolRuntime] ExecuteCommand: %s", command)
+	return ExecuteCommandContext(context.Background(), command, disallowedCmds, disallowedDirs)
+}
 
-	// 1. Basic Security Checks
-	if strings.TrimSpace(command) == "" {
-		return "", fmt.Errorf("command is empty")
-	}
+// ExecuteCommandContext runs a command under a deny-list policy, stopping its
+// process group when ctx is cancelled or the configured timeout expires.
+func ExecuteCommandContext(ctx context.Context, command string, disallowedCmds []string, disallowedDirs []string) (string, error) {
+	return ExecuteCommandWithPolicy(ctx, command, "", CommandPolicy{DisallowedCommands: disallowedCmds, DisallowedDirs: disallowedDirs})
+}
 
-	parts := strings.Fields(command)
-	if len(parts) == 0 {
+// ExecuteCommandWithPolicy checks command against policy and runs it in
+// workingDir, or in the policy's default directory when workingDir is empty.
+func ExecuteCommandWithPolicy(ctx context.Context, command, workingDir string, policy CommandPolicy) (string, error) {
+	log.Printf("[ToolRuntime] ExecuteCommand: %s", command)
+	if strings.TrimSpace(command) == "" {
 		return "", fmt.Errorf("command is empty")
 	}
-	baseCmd := parts[0]
-
-	// 2. Check Disallowed Commands
-	for _, disallowed := range disallowedCmds {
-		if strings.EqualFold(baseCmd, disallowed) {
-			return "", fmt.Errorf("permission denied: command '%s' is not allowed", baseCmd)
-		}
-	}
-
-	// 3. Check Disallowed Directories (Command Arguments)
-	// Iterate through arguments to see if they reference disallowed paths
-	for _, arg := range parts[1:] {
-		// Clean the path
-		argClean := filepath.Clean(arg)
-		for _, dir := range disallowedDirs {
-			// Check if arg starts with disallowed dir (simple check)
-			// TODO: Enhance with better path resolution
-			if strings.HasPrefix(argClean, filepath.Clean(dir)) {
-				return "", fmt.Errorf("permission denied: directory '%s' is restricted", dir)
-			}
-		}
+	spec, err := policy.prepareCommand(command, workingDir)
+	if err != nil {
+		emitTraceEvent("tool_runtime", "command.rejected", "Shell command rejected by policy", traceDetailsMap(
+			"argv_mode", policy.argvMode(),
+			"error", err.Error(),
+		))
+		return "", err
 	}
 
-	// 4. Execution
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("cmd", "/C", command)
-	} else {
-		cmd = exec.Command("sh", "-c", command)
-	}
+	// Execution
+	limits := getCommandLimits()
+	run := runCommand(ctx, spec, limits)
+	emitTraceEvent("tool_runtime", "command.finished", "Shell command finished", traceDetailsMap(
+		"argv_mode", policy.argvMode(),
+		"jail", spec.Jail,
+		"exit_code", run.ExitCode,
+		"duration_ms", run.Duration.Milliseconds(),
+		"truncated", run.Truncated,
+		"timed_out", run.TimedOut,
+		"cancelled", run.Cancelled,
+	))
+	return run.Report(), run.Err
+}
 
-	// Capture Output
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Sprintf("Command failed: %v\nOutput:\n%s", err, strings.TrimSpace(string(output))), err
+// RunToolScript runs a fixed argv in dir and hands input to it on stdin. It
+// shares execute_command's limits, process-group kill, scrubbed environment
+// and optional jail; nothing from input is ever placed on the command line.
+func RunToolScript(ctx context.Context, argv []string, dir string, input []byte, jail bool) (string, error) {
+	if len(argv) == 0 || strings.TrimSpace(argv[0]) == "" {
+		return "", fmt.Errorf("tool script command is empty")
 	}
-
-	return string(output), nil
+	env := scrubbedCommandEnv()
+	executable := argv[0]
+	if !strings.ContainsAny(executable, `/\`) {
+		resolved, err := lookCommandPath(executable, env)
+		if err != nil {
+			return "", err
+		}
+		executable = resolved
+	}
+	spec := commandSpec{
+		Argv:  append([]string{executable}, argv[1:]...),
+		Dir:   dir,
+		Env:   env,
+		Jail:  jail,
+		Stdin: append([]byte{}, input...),
+	}
+	run := runCommand(ctx, spec, getCommandLimits())
+	emitTraceEvent("tool_runtime", "script.finished", "Tool script finished", traceDetailsMap(
+		"program", filepath.Base(argv[0]),
+		"jail", jail,
+		"exit_code", run.ExitCode,
+		"duration_ms", run.Duration.Milliseconds(),
+		"truncated", run.Truncated,
+		"timed_out", run.TimedOut,
+		"cancelled", run.Cancelled,
+	))
+	return run.Report(), run.Err
 }
@@ -1,57 +1,135 @@
 package mcp
 
 import (
+	"sort"
 	"strings"
 	"sync"
 )
 
-const toolConfigText = `
-search_web = enable
-search_web_multi = enable
-read_web_page = enable
-read_buffered_source = enable
-read_help = enable
-get_current_time = enable
-search_memory = enable
-read_memory = enable
-read_memory_context = enable
-delete_memory = enable
-save_user_fact = enable
-delete_user_fact = enable
-naver_search = enable
-namu_wiki = enable
-get_current_location = enable
-send_keys = disable
-read_terminal_tail = disable
-execute_command = enable
-`
+// defaultToolStates is the built-in enable/disable table. Administrators
+// override individual entries at runtime with SetToolOverrides; tools that are
+// not listed here (external MCP and skill tools) are enabled by default.
+var defaultToolStates = map[string]bool{
+	"search_web":           true,
+	"search_web_multi":     true,
+	"read_web_page":        true,
+	"read_buffered_source": true,
+	"read_help":            true,
+	"get_current_time":     true,
+	"search_memory":        true,
+	"read_memory":          true,
+	"read_memory_context":  true,
+	"delete_memory":        true,
+	"save_user_fact":       true,
+	"delete_user_fact":     true,
+	"naver_search":         true,
+	"namu_wiki":            true,
+	"get_current_location": true,
+	"send_keys":            false,
+	"read_terminal_tail":   false,
+	"execute_command":      true,
+}
+
+// hostTools need a ToolHost, so they stay unavailable without one whatever
+// their switch says.
+var hostTools = map[string]bool{"send_keys": true, "read_terminal_tail": true}
 
 var (
-	toolConfigOnce sync.Once
-	toolConfigMap  map[string]string
+	toolStateMu   sync.RWMutex
+	toolOverrides = map[string]bool{}
 )
 
-func isToolConfiguredEnabled(name string) bool {
-	toolConfigOnce.Do(loadToolConfig)
-	return toolConfigMap[strings.TrimSpace(name)] == "enable"
+// ToolSwitch explains the app-wide state of one tool.
+type ToolSwitch struct {
+	Name      string `json:"name"`
+	Default   bool   `json:"default"`
+	Override  *bool  `json:"override,omitempty"`
+	Enabled   bool   `json:"enabled"`
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
 }
 
-func loadToolConfig() {
-	toolConfigMap = make(map[string]string)
-	for _, line := range strings.Split(toolConfigText, "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
+// SetToolOverrides replaces the administrator's overrides. Entries equal to
+// the built-in default are dropped so the stored config stays minimal.
+func SetToolOverrides(overrides map[string]bool) {
+	next := make(map[string]bool, len(overrides))
+	for name, enabled := range overrides {
+		name = strings.TrimSpace(name)
+		if name == "" {
 			continue
 		}
-		key, value, ok := strings.Cut(line, "=")
-		if !ok {
+		if builtin, known := defaultToolStates[name]; known && builtin == enabled {
 			continue
 		}
-		key = strings.TrimSpace(key)
-		value = strings.ToLower(strings.TrimSpace(value))
-		switch value {
-		case "enable", "disable":
-			toolConfigMap[key] = value
+		if _, known := defaultToolStates[name]; !known && enabled {
+			continue
 		}
+		next[name] = enabled
+	}
+	toolStateMu.Lock()
+	toolOverrides = next
+	toolStateMu.Unlock()
+}
+
+// ToolOverrides returns a copy of the administrator's overrides.
+func ToolOverrides() map[string]bool {
+	toolStateMu.RLock()
+	defer toolStateMu.RUnlock()
+	overrides := make(map[string]bool, len(toolOverrides))
+	for name, enabled := range toolOverrides {
+		overrides[name] = enabled
+	}
+	return overrides
+}
+
+// IsToolEnabled reports whether a tool is switched on app-wide and, for
+// terminal tools, whether a host is attached to run it.
+func IsToolEnabled(name string) bool {
+	return ToolSwitchFor(name).Enabled
+}
+
+// ToolSwitchFor resolves default, override and availability for one tool.
+func ToolSwitchFor(name string) ToolSwitch {
+	name = strings.TrimSpace(name)
+	builtin, known := defaultToolStates[name]
+	if !known {
+		builtin = true
+	}
+	state := ToolSwitch{Name: name, Default: builtin, Enabled: builtin, Available: true}
+	toolStateMu.RLock()
+	if override, ok := toolOverrides[name]; ok {
+		state.Override = &override
+		state.Enabled = override
+	}
+	toolStateMu.RUnlock()
+	if hostTools[name] && getHost() == nil {
+		state.Available = false
+	}
+	switch {
+	case !state.Available:
+		state.Enabled = false
+		state.Reason = "no terminal host is attached"
+	case !state.Enabled && state.Override != nil:
+		state.Reason = "disabled by administrator"
+	case !state.Enabled:
+		state.Reason = "disabled by default"
+	}
+	return state
+}
+
+// ToolSwitches lists the built-in tools plus any overridden names, sorted.
+func ToolSwitches() []ToolSwitch {
+	names := make(map[string]bool, len(defaultToolStates))
+	for name := range defaultToolStates {
+		names[name] = true
+	}
+	for name := range ToolOverrides() {
+		names[name] = true
+	}
+	switches := make([]ToolSwitch, 0, len(names))
+	for name := range names {
+		switches = append(switches, ToolSwitchFor(name))
 	}
+	sort.Slice(switches, func(i, j int) bool { return switches[i].Name < switches[j].Name })
+	return switches
 }
@@ -0,0 +1,514 @@
+package mcp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	ExtractedFactKindMemory  = "memory"
+	ExtractedFactKindProfile = "profile"
+)
+
+// How an extracted fact relates to what is already stored.
+const (
+	MemoryActionNew        = "new"
+	MemoryActionUpdate     = "update"
+	MemoryActionContradict = "contradict"
+	MemoryActionDuplicate  = "duplicate"
+)
+
+const (
+	memoryTypeRawInteraction    = "raw_interaction"
+	profileFactSourceExtraction = "extraction"
+	// Facts the model is less sure of than this are dropped.
+	minExtractedFactConfidence = 0.3
+)
+
+var extractedMemoryTypes = map[string]bool{
+	"fact":         true,
+	"preference":   true,
+	"event":        true,
+	"plan":         true,
+	"relationship": true,
+	"instruction":  true,
+}
+
+// ExtractedMemoryFact is one atomic fact the extraction model found in a
+// chat turn. Target names the offered memory ("m12") or profile fact
+// ("p:car") that an update, contradict or duplicate refers to.
+type ExtractedMemoryFact struct {
+	Text       string  `json:"text"`
+	Kind       string  `json:"kind"`
+	Type       string  `json:"type,omitempty"`
+	Tier       string  `json:"tier,omitempty"`
+	Importance float64 `json:"importance,omitempty"`
+	Confidence float64 `json:"confidence,omitempty"`
+	Action     string  `json:"action,omitempty"`
+	Target     string  `json:"target,omitempty"`
+	Key        string  `json:"key,omitempty"`
+	Value      string  `json:"value,omitempty"`
+	Category   string  `json:"category,omitempty"`
+}
+
+// MemoryExtractionContext is what the extraction model is shown of the
+// user's existing knowledge. Only these entries may be updated by a run.
+type MemoryExtractionContext struct {
+	Memories     []MemoryEntry
+	ProfileFacts []UserProfileFact
+}
+
+// MemoryProvenance points stored knowledge back to the chat turn and
+// persisted chat events it was extracted from.
+type MemoryProvenance struct {
+	SessionID int64   `json:"session_id,omitempty"`
+	TurnID    string  `json:"turn_id,omitempty"`
+	EventIDs  []int64 `json:"event_ids,omitempty"`
+	JobID     int64   `json:"job_id,omitempty"`
+}
+
+type MemoryProvenanceEntry struct {
+	MemoryProvenance
+	ID            int64     `json:"id"`
+	MemoryID      int64     `json:"memory_id,omitempty"`
+	ProfileFactID int64     `json:"profile_fact_id,omitempty"`
+	Action        string    `json:"action"`
+	PreviousText  string    `json:"previous_text,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// AppliedMemoryFact reports what ApplyExtractedMemoryFacts did with a fact.
+type AppliedMemoryFact struct {
+	Fact          ExtractedMemoryFact `json:"fact"`
+	Action        string              `json:"action"`
+	MemoryID      int64               `json:"memory_id,omitempty"`
+	ProfileFactID int64               `json:"profile_fact_id,omitempty"`
+}
+
+// LoadMemoryExtractionContext finds the stored facts closest to a turn and
+// all profile facts of the user. Raw transcripts are never offered; they are
+// not atomic facts and must not be rewritten.
+func LoadMemoryExtractionContext(userID, turnText string, limit int) (MemoryExtractionContext, error) {
+	var ctx MemoryExtractionContext
+	if limit <= 0 {
+		limit = 8
+	}
+	matches, err := SearchMemoryChunkMatches(userID, turnText, limit*3)
+	if err != nil {
+		return ctx, err
+	}
+	seen := make(map[int64]bool, len(matches))
+	for _, match := range matches {
+		if seen[match.ID] || match.MemoryType == memoryTypeRawInteraction {
+			continue
+		}
+		seen[match.ID] = true
+		ctx.Memories = append(ctx.Memories, match.MemoryEntry)
+		if len(ctx.Memories) >= limit {
+			break
+		}
+	}
+	ctx.ProfileFacts, err = GetUserProfileFacts(userID)
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, nil
+}
+
+// ApplyExtractedMemoryFacts merges facts into the user's memories and
+// profile facts and records provenance for every fact it keeps. Updates and
+// contradictions rewrite the targeted entry and remember its previous text;
+// duplicates only add provenance. Targets outside offered are ignored and
+// the fact is stored as new.
+func ApplyExtractedMemoryFacts(userID string, facts []ExtractedMemoryFact, offered MemoryExtractionContext, provenance MemoryProvenance) ([]AppliedMemoryFact, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	if err := ensureMemoryRetentionSchema(); err != nil {
+		return nil, err
+	}
+
+	offeredMemories := make(map[int64]MemoryEntry, len(offered.Memories))
+	for _, memory := range offered.Memories {
+		offeredMemories[memory.ID] = memory
+	}
+	offeredFacts := make(map[string]UserProfileFact, len(offered.ProfileFacts))
+	for _, fact := range offered.ProfileFacts {
+		offeredFacts[strings.ToLower(fact.FactKey)] = fact
+	}
+
+	var applied []AppliedMemoryFact
+	seen := make(map[string]bool, len(facts))
+	for _, raw := range facts {
+		fact, ok := normalizeExtractedFact(raw)
+		if !ok {
+			continue
+		}
+		dedupeKey := fact.Kind + "\x00" + fact.Key + "\x00" + normalizeFactText(fact.Text)
+		if seen[dedupeKey] {
+			continue
+		}
+		seen[dedupeKey] = true
+
+		var result AppliedMemoryFact
+		var err error
+		if fact.Kind == ExtractedFactKindProfile {
+			result, err = applyExtractedProfileFact(userID, fact, offeredFacts, provenance)
+		} else {
+			result, err = applyExtractedMemory(userID, fact, offeredMemories, provenance)
+		}
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, result)
+	}
+	if len(applied) > 0 {
+		notifyMemoryChanged(userID)
+	}
+	return applied, nil
+}
+
+func applyExtractedMemory(userID string, fact ExtractedMemoryFact, offered map[int64]MemoryEntry, provenance MemoryProvenance) (result AppliedMemoryFact, err error) {
+	result = AppliedMemoryFact{Fact: fact, Action: fact.Action}
+	var target MemoryEntry
+	hasTarget := false
+	if id, ok := parseExtractedTarget(fact.Target, "m"); ok {
+		target, hasTarget = offered[id]
+	}
+	if !hasTarget || fact.Action == MemoryActionNew {
+		// The model may miss a restatement it was shown; catch exact ones.
+		for _, memory := range offered {
+			if normalizeFactText(memory.FullText) == normalizeFactText(fact.Text) {
+				target, hasTarget = memory, true
+				result.Action = MemoryActionDuplicate
+				break
+			}
+		}
+	}
+	if !hasTarget {
+		result.Action = MemoryActionNew
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to start memory extraction write: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := time.Now().UTC()
+	if result.Action == MemoryActionNew {
+		// Earlier turns may have stored the same sentence without it being
+		// among the offered candidates.
+		var existingID int64
+		err = tx.QueryRow(`
+			SELECT id FROM memories
+			WHERE user_id = ? AND full_text = ? AND memory_type != ?
+			ORDER BY id ASC
+			LIMIT 1`, userID, fact.Text, memoryTypeRawInteraction,
+		).Scan(&existingID)
+		switch {
+		case err == nil:
+			target.ID = existingID
+			result.Action = MemoryActionDuplicate
+		case err == sql.ErrNoRows:
+			err = nil
+		default:
+			return result, fmt.Errorf("failed to look up duplicate memory: %w", err)
+		}
+	}
+
+	previousText := ""
+	switch result.Action {
+	case MemoryActionDuplicate:
+		if _, err = tx.Exec(`
+			UPDATE memories
+			SET importance_score = MAX(COALESCE(importance_score, 0), ?),
+			    confidence = MAX(COALESCE(confidence, 0), ?),
+			    last_accessed_at = ?
+			WHERE id = ? AND user_id = ?`,
+			fact.Importance, fact.Confidence, now, target.ID, userID,
+		); err != nil {
+			return result, fmt.Errorf("failed to refresh duplicate memory: %w", err)
+		}
+		result.MemoryID = target.ID
+	case MemoryActionUpdate, MemoryActionContradict:
+		previousText = target.FullText
+		if _, err = tx.Exec(`
+			UPDATE memories
+			SET full_text = ?, memory_type = ?, memory_tier = ?, importance_score = ?, confidence = ?, last_accessed_at = ?
+			WHERE id = ? AND user_id = ?`,
+			fact.Text, fact.Type, fact.Tier, fact.Importance, fact.Confidence, now, target.ID, userID,
+		); err != nil {
+			return result, fmt.Errorf("failed to update memory: %w", err)
+		}
+		if err = rebuildMemoryChunksTx(tx, target.ID, userID, fact.Text, now); err != nil {
+			return result, err
+		}
+		result.MemoryID = target.ID
+	default:
+		var insert sql.Result
+		insert, err = tx.Exec(`
+			INSERT INTO memories (user_id, full_text, hit_count, memory_type, last_accessed_at, importance_score, pinned, memory_tier, confidence)
+			VALUES (?, ?, 0, ?, ?, ?, 0, ?, ?)`,
+			userID, fact.Text, fact.Type, now, fact.Importance, fact.Tier, fact.Confidence,
+		)
+		if err != nil {
+			return result, fmt.Errorf("failed to insert extracted memory: %w", err)
+		}
+		if result.MemoryID, err = insert.LastInsertId(); err != nil {
+			return result, fmt.Errorf("failed to get extracted memory id: %w", err)
+		}
+		if err = insertMemoryChunksTx(tx, result.MemoryID, userID, fact.Text, now); err != nil {
+			return result, err
+		}
+	}
+
+	if err = insertMemoryProvenanceTx(tx, userID, result.MemoryID, 0, result.Action, previousText, provenance); err != nil {
+		return result, err
+	}
+	if err = tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit extracted memory: %w", err)
+	}
+	return result, nil
+}
+
+func applyExtractedProfileFact(userID string, fact ExtractedMemoryFact, offered map[string]UserProfileFact, provenance MemoryProvenance) (result AppliedMemoryFact, err error) {
+	if target, ok := strings.CutPrefix(strings.TrimSpace(fact.Target), "p:"); ok {
+		if existing, ok := offered[strings.ToLower(strings.TrimSpace(target))]; ok && fact.Action != MemoryActionNew {
+			fact.Key = existing.FactKey
+		}
+	}
+	if existing, ok := offered[strings.ToLower(fact.Key)]; ok {
+		fact.Key = existing.FactKey
+	}
+	result = AppliedMemoryFact{Fact: fact, Action: MemoryActionNew}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to start profile fact extraction write: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if fact.Key, err = resolveProfileFactKeyTx(tx, userID, fact.Key); err != nil {
+		return result, err
+	}
+	result.Fact.Key = fact.Key
+
+	var existingID int64
+	var existingValue string
+	err = tx.QueryRow(`SELECT id, fact_value FROM user_profile_facts WHERE user_id = ? AND fact_key = ?`, userID, fact.Key).Scan(&existingID, &existingValue)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+	case err != nil:
+		return result, fmt.Errorf("failed to read user profile fact: %w", err)
+	case strings.EqualFold(strings.TrimSpace(existingValue), fact.Value):
+		result.Action = MemoryActionDuplicate
+	case fact.Action == MemoryActionContradict:
+		result.Action = MemoryActionContradict
+	default:
+		result.Action = MemoryActionUpdate
+	}
+
+	previousText := ""
+	if result.Action == MemoryActionDuplicate {
+		result.ProfileFactID = existingID
+	} else {
+		if existingID > 0 {
+			previousText = existingValue
+		}
+		var stored UserProfileFact
+		stored, err = upsertUserProfileFactTx(tx, userID, fact.Key, fact.Value, fact.Category, profileFactSourceExtraction, ProfileFactRef{
+			Confidence: fact.Confidence,
+			SessionID:  provenance.SessionID,
+			TurnID:     provenance.TurnID,
+		})
+		if err != nil {
+			return result, err
+		}
+		result.ProfileFactID = stored.ID
+	}
+
+	if err = insertMemoryProvenanceTx(tx, userID, 0, result.ProfileFactID, result.Action, previousText, provenance); err != nil {
+		return result, err
+	}
+	if err = tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit extracted profile fact: %w", err)
+	}
+	return result, nil
+}
+
+func insertMemoryProvenanceTx(tx *sql.Tx, userID string, memoryID, profileFactID int64, action, previousText string, provenance MemoryProvenance) error {
+	eventIDs := provenance.EventIDs
+	if eventIDs == nil {
+		eventIDs = []int64{}
+	}
+	eventIDsJSON, err := json.Marshal(eventIDs)
+	if err != nil {
+		return fmt.Errorf("failed to encode provenance event ids: %w", err)
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO memory_provenance (user_id, memory_id, profile_fact_id, action, session_id, turn_id, event_ids_json, job_id, previous_text, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, memoryID, profileFactID, action, provenance.SessionID, strings.TrimSpace(provenance.TurnID), string(eventIDsJSON), provenance.JobID, previousText, time.Now().UTC(),
+	); err != nil {
+		return fmt.Errorf("failed to record memory provenance: %w", err)
+	}
+	return nil
+}
+
+// ListMemoryProvenance returns where a memory came from, newest first.
+func ListMemoryProvenance(userID string, memoryID int64) ([]MemoryProvenanceEntry, error) {
+	return listProvenance(`memory_id = ?`, userID, memoryID)
+}
+
+// ListProfileFactProvenance returns where a profile fact came from, newest
+// first.
+func ListProfileFactProvenance(userID string, profileFactID int64) ([]MemoryProvenanceEntry, error) {
+	return listProvenance(`profile_fact_id = ?`, userID, profileFactID)
+}
+
+func listProvenance(filter, userID string, targetID int64) ([]MemoryProvenanceEntry, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	rows, err := db.Query(`
+		SELECT id, memory_id, profile_fact_id, action, session_id, turn_id, event_ids_json, job_id, previous_text, created_at
+		FROM memory_provenance
+		WHERE user_id = ? AND `+filter+`
+		ORDER BY created_at DESC, id DESC`, userID, targetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query memory provenance: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []MemoryProvenanceEntry
+	for rows.Next() {
+		var entry MemoryProvenanceEntry
+		var eventIDsJSON string
+		if err := rows.Scan(&entry.ID, &entry.MemoryID, &entry.ProfileFactID, &entry.Action, &entry.SessionID, &entry.TurnID, &eventIDsJSON, &entry.JobID, &entry.PreviousText, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan memory provenance: %w", err)
+		}
+		_ = json.Unmarshal([]byte(eventIDsJSON), &entry.EventIDs)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// normalizeExtractedFact fills defaults and clamps model output. ok is false
+// for facts that are empty or too uncertain to keep.
+func normalizeExtractedFact(fact ExtractedMemoryFact) (ExtractedMemoryFact, bool) {
+	fact.Text = strings.Join(strings.Fields(fact.Text), " ")
+	fact.Key = strings.ToLower(strings.Join(strings.Fields(fact.Key), "_"))
+	fact.Value = strings.TrimSpace(fact.Value)
+	fact.Kind = strings.ToLower(strings.TrimSpace(fact.Kind))
+	if fact.Kind != ExtractedFactKindProfile && fact.Kind != ExtractedFactKindMemory {
+		fact.Kind = ExtractedFactKindMemory
+		if fact.Key != "" && fact.Value != "" {
+			fact.Kind = ExtractedFactKindProfile
+		}
+	}
+
+	fact.Action = strings.ToLower(strings.TrimSpace(fact.Action))
+	switch fact.Action {
+	case MemoryActionNew, MemoryActionUpdate, MemoryActionContradict, MemoryActionDuplicate:
+	default:
+		fact.Action = MemoryActionNew
+	}
+	if fact.Confidence == 0 {
+		fact.Confidence = 0.7
+	}
+	fact.Confidence = min(max(fact.Confidence, 0), 1)
+	if fact.Confidence < minExtractedFactConfidence {
+		return fact, false
+	}
+	if fact.Importance == 0 {
+		fact.Importance = 0.5
+	}
+	fact.Importance = min(max(fact.Importance, 0), 1)
+
+	if fact.Kind == ExtractedFactKindProfile {
+		if fact.Value == "" {
+			fact.Value = fact.Text
+		}
+		if fact.Key == "" || fact.Value == "" {
+			return fact, false
+		}
+		if fact.Text == "" {
+			fact.Text = fact.Key + ": " + fact.Value
+		}
+		fact.Category = strings.ToLower(strings.TrimSpace(fact.Category))
+		if fact.Category == "" {
+			fact.Category = "general"
+		}
+		return fact, true
+	}
+
+	if fact.Text == "" {
+		return fact, false
+	}
+	fact.Type = strings.ToLower(strings.TrimSpace(fact.Type))
+	if !extractedMemoryTypes[fact.Type] {
+		fact.Type = "fact"
+	}
+	fact.Tier = strings.ToLower(strings.TrimSpace(fact.Tier))
+	switch fact.Tier {
+	case memoryTierCore, memoryTierWorking, memoryTierEphemeral:
+	default:
+		switch {
+		case fact.Importance >= 0.8:
+			fact.Tier = memoryTierCore
+		case fact.Importance >= 0.5:
+			fact.Tier = memoryTierWorking
+		default:
+			fact.Tier = memoryTierEphemeral
+		}
+	}
+	return fact, true
+}
+
+// parseExtractedTarget reads "m12" style references to offered entries.
+func parseExtractedTarget(target, prefix string) (int64, bool) {
+	target = strings.TrimSpace(strings.Trim(strings.TrimSpace(target), "[]"))
+	digits, ok := strings.CutPrefix(strings.ToLower(target), prefix)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// normalizeFactText folds case, punctuation and spacing so restatements of
+// the same sentence compare equal.
+func normalizeFactText(text string) string {
+	var sb strings.Builder
+	space := false
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && sb.Len() > 0 {
+				sb.WriteByte(' ')
+			}
+			space = false
+			sb.WriteRune(r)
+		default:
+			space = true
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,182 @@
+package mcp
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestApplyExtractedMemoryFacts(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "memory.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	rawID, err := InsertMemory("alice", "User: my garden has tomatoes\nAssistant: nice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := MemoryProvenance{SessionID: 3, TurnID: "turn-1", EventIDs: []int64{7, 8}, JobID: 1}
+	applied, err := ApplyExtractedMemoryFacts("alice", []ExtractedMemoryFact{
+		{Text: "Alice grows tomatoes in her garden.", Type: "fact", Tier: "working", Importance: 0.6, Confidence: 0.9},
+		{Text: "alice grows tomatoes in her garden", Confidence: 0.9},
+		{Text: "Alice might like jazz.", Confidence: 0.1},
+		{Kind: "profile", Key: "Car", Value: "Tesla Model 3", Category: "vehicle", Confidence: 0.95},
+	}, MemoryExtractionContext{}, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].Action != MemoryActionNew || applied[1].Action != MemoryActionNew || applied[1].Fact.Key != "car" {
+		t.Fatalf("first run applied %+v, want one memory and one profile fact", applied)
+	}
+	memoryID := applied[0].MemoryID
+
+	memory, err := ReadMemory("alice", memoryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory.MemoryType != "fact" || memory.MemoryTier != memoryTierWorking || memory.ImportanceScore != 0.6 {
+		t.Fatalf("extracted memory = %+v", memory)
+	}
+	provenance, err := ListMemoryProvenance("alice", memoryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provenance) != 1 || provenance[0].TurnID != "turn-1" || provenance[0].SessionID != 3 || len(provenance[0].EventIDs) != 2 || provenance[0].EventIDs[1] != 8 {
+		t.Fatalf("provenance = %+v", provenance)
+	}
+
+	offered, err := LoadMemoryExtractionContext("alice", "garden tomatoes", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range offered.Memories {
+		if entry.ID == rawID {
+			t.Fatal("raw transcripts must not be offered for merging")
+		}
+	}
+	if len(offered.Memories) != 1 || len(offered.ProfileFacts) != 1 {
+		t.Fatalf("offered = %+v", offered)
+	}
+
+	second := MemoryProvenance{SessionID: 3, TurnID: "turn-2", JobID: 2}
+	applied, err = ApplyExtractedMemoryFacts("alice", []ExtractedMemoryFact{
+		{Text: "Alice grows tomatoes in her garden!", Action: "new", Importance: 0.9},
+		{Text: "Alice grows cherry tomatoes on her balcony.", Action: "contradict", Target: "[m" + strconv.FormatInt(memoryID, 10) + "]", Tier: "core"},
+		{Text: "Alice drives an electric car.", Action: "update", Target: "m" + strconv.FormatInt(rawID, 10)},
+		{Kind: "profile", Key: "vehicle", Value: "Kia EV6", Action: "contradict", Target: "p:car"},
+	}, offered, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 4 {
+		t.Fatalf("second run applied %+v", applied)
+	}
+	if applied[0].Action != MemoryActionDuplicate || applied[0].MemoryID != memoryID {
+		t.Fatalf("restatement = %+v, want a duplicate of %d", applied[0], memoryID)
+	}
+	if applied[1].Action != MemoryActionContradict || applied[1].MemoryID != memoryID {
+		t.Fatalf("contradiction = %+v", applied[1])
+	}
+	if applied[2].Action != MemoryActionNew || applied[2].MemoryID == rawID {
+		t.Fatalf("a target that was not offered must become a new memory, got %+v", applied[2])
+	}
+	if applied[3].Action != MemoryActionContradict || applied[3].Fact.Key != "car" {
+		t.Fatalf("profile contradiction = %+v", applied[3])
+	}
+
+	memory, err = ReadMemory("alice", memoryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory.FullText != "Alice grows cherry tomatoes on her balcony." || memory.MemoryTier != memoryTierCore {
+		t.Fatalf("contradicted memory = %+v", memory)
+	}
+	matches, err := SearchMemoryChunkMatches("alice", "balcony", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].ID != memoryID {
+		t.Fatalf("rewritten memory is not searchable: %+v", matches)
+	}
+	provenance, err = ListMemoryProvenance("alice", memoryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provenance) != 3 || provenance[0].Action != MemoryActionContradict || provenance[0].PreviousText != "Alice grows tomatoes in her garden." {
+		t.Fatalf("provenance after contradiction = %+v", provenance)
+	}
+
+	facts, err := GetUserProfileFacts("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(facts) != 1 || facts[0].FactValue != "Kia EV6" || facts[0].Source != profileFactSourceExtraction {
+		t.Fatalf("profile facts = %+v", facts)
+	}
+	factProvenance, err := ListProfileFactProvenance("alice", facts[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(factProvenance) != 2 || factProvenance[0].PreviousText != "Tesla Model 3" || factProvenance[0].TurnID != "turn-2" {
+		t.Fatalf("profile fact provenance = %+v", factProvenance)
+	}
+
+	if err := DeleteMemory("alice", memoryID); err != nil {
+		t.Fatal(err)
+	}
+	if provenance, _ := ListMemoryProvenance("alice", memoryID); len(provenance) != 0 {
+		t.Fatalf("deleting a memory must drop its provenance, got %+v", provenance)
+	}
+}
+
+func TestBackgroundJobQueue(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "jobs.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	first, err := EnqueueBackgroundJob("alice", "memory_extraction", "", "model-a", `{"n":1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EnqueueBackgroundJob("bob", "memory_extraction", "standard", "model-b", `{"n":2}`); err != nil {
+		t.Fatal(err)
+	}
+
+	job, ok, err := ClaimNextBackgroundJob("memory_extraction")
+	if err != nil || !ok || job.ID != first || job.Status != BackgroundJobRunning || job.LLMMode != "standard" || job.RequestPayloadJSON != `{"n":1}` {
+		t.Fatalf("claimed %+v ok=%v err=%v", job, ok, err)
+	}
+	if _, ok, _ := ClaimNextBackgroundJob("chat"); ok {
+		t.Fatal("claimed a job of another type")
+	}
+
+	// A restart puts the interrupted job back ahead of the later one.
+	if requeued, err := RequeueInterruptedBackgroundJobs("memory_extraction"); err != nil || requeued != 1 {
+		t.Fatalf("requeued %d err=%v", requeued, err)
+	}
+	job, _, _ = ClaimNextBackgroundJob("memory_extraction")
+	if job.ID != first {
+		t.Fatalf("claimed %d after requeue, want %d", job.ID, first)
+	}
+	if err := CompleteBackgroundJob(job.ID, "[]"); err != nil {
+		t.Fatal(err)
+	}
+	job, _, _ = ClaimNextBackgroundJob("memory_extraction")
+	if err := FailBackgroundJob(job.ID, "model unreachable"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := ClaimNextBackgroundJob("memory_extraction"); ok {
+		t.Fatal("finished jobs must not be claimed again")
+	}
+
+	var status, errorText string
+	if err := db.QueryRow(`SELECT status, error_text FROM background_chat_jobs WHERE id = ?`, job.ID).Scan(&status, &errorText); err != nil {
+		t.Fatal(err)
+	}
+	if status != BackgroundJobFailed || !strings.Contains(errorText, "unreachable") {
+		t.Fatalf("failed job status=%q error=%q", status, errorText)
+	}
+}
@@ -0,0 +1,410 @@
+package mcp
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrMemoryNotFound is returned for a memory that does not exist or
+// belongs to another user.
+var ErrMemoryNotFound = errors.New("memory not found")
+
+// ErrInvalidMemoryRequest wraps filter and edit values that were rejected.
+var ErrInvalidMemoryRequest = errors.New("invalid memory request")
+
+// MemoryActionEdit marks a memory text change made by the user.
+const MemoryActionEdit = "edit"
+
+const (
+	defaultMemoryListLimit = 50
+	maxMemoryListLimit     = 200
+)
+
+// MemoryListFilter narrows a memory listing. Zero values do not filter.
+type MemoryListFilter struct {
+	Tier          string
+	MemoryType    string
+	Pinned        *bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	MinHitCount   int
+	MaxHitCount   *int
+	Limit         int
+	Offset        int
+}
+
+// MemoryUpdate changes the given fields of a memory. Nil fields are kept.
+type MemoryUpdate struct {
+	FullText   *string
+	MemoryType *string
+	Tier       *string
+	Pinned     *bool
+	Importance *float64
+}
+
+func normalizeMemoryListFilter(filter MemoryListFilter) (MemoryListFilter, error) {
+	filter.Tier = strings.ToLower(strings.TrimSpace(filter.Tier))
+	filter.MemoryType = strings.TrimSpace(filter.MemoryType)
+	if filter.Tier != "" && !isMemoryTier(filter.Tier) {
+		return filter, fmt.Errorf("%w: unknown memory tier %q", ErrInvalidMemoryRequest, filter.Tier)
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultMemoryListLimit
+	}
+	filter.Limit = min(filter.Limit, maxMemoryListLimit)
+	filter.Offset = max(filter.Offset, 0)
+	return filter, nil
+}
+
+func isMemoryTier(tier string) bool {
+	switch tier {
+	case memoryTierCore, memoryTierWorking, memoryTierEphemeral:
+		return true
+	}
+	return false
+}
+
+func memoryListConditions(userID string, filter MemoryListFilter) (string, []any) {
+	conditions := []string{"user_id = ?"}
+	args := []any{userID}
+	if filter.Tier != "" {
+		conditions = append(conditions, "COALESCE(memory_tier, 'ephemeral') = ?")
+		args = append(args, filter.Tier)
+	}
+	if filter.MemoryType != "" {
+		conditions = append(conditions, "memory_type = ?")
+		args = append(args, filter.MemoryType)
+	}
+	if filter.Pinned != nil {
+		conditions = append(conditions, "COALESCE(pinned, 0) = ?")
+		args = append(args, boolToInt(*filter.Pinned))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.CreatedAfter.UTC())
+	}
+	if !filter.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.CreatedBefore.UTC())
+	}
+	if filter.MinHitCount > 0 {
+		conditions = append(conditions, "hit_count >= ?")
+		args = append(args, filter.MinHitCount)
+	}
+	if filter.MaxHitCount != nil {
+		conditions = append(conditions, "hit_count <= ?")
+		args = append(args, *filter.MaxHitCount)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+const memoryEntryColumns = `id, user_id, full_text, hit_count, created_at, memory_type,
+	       COALESCE(last_accessed_at, created_at), COALESCE(importance_score, 0.25), COALESCE(pinned, 0), COALESCE(memory_tier, 'ephemeral')`
+
+func scanMemoryEntries(rows *sql.Rows) ([]MemoryEntry, error) {
+	defer rows.Close()
+	var entries []MemoryEntry
+	for rows.Next() {
+		var m MemoryEntry
+		var pinned int
+		var lastAccessedRaw string
+		if err := rows.Scan(&m.ID, &m.UserID, &m.FullText, &m.HitCount, &m.CreatedAt, &m.MemoryType, &lastAccessedRaw, &m.ImportanceScore, &pinned, &m.MemoryTier); err != nil {
+			return nil, fmt.Errorf("failed to scan memory: %w", err)
+		}
+		m.LastAccessedAt = parseSQLiteTime(lastAccessedRaw, m.CreatedAt)
+		m.Pinned = pinned != 0
+		entries = append(entries, m)
+	}
+	return entries, rows.Err()
+}
+
+// ListMemories returns one page of a user's memories, newest first, and
+// the number of memories matching the filter.
+func ListMemories(userID string, filter MemoryListFilter) ([]MemoryEntry, int, error) {
+	if db == nil {
+		return nil, 0, fmt.Errorf("database not initialized")
+	}
+	if err := ensureMemoryRetentionSchema(); err != nil {
+		return nil, 0, err
+	}
+	filter, err := normalizeMemoryListFilter(filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	where, args := memoryListConditions(userID, filter)
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM memories WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count memories: %w", err)
+	}
+	rows, err := db.Query(`
+		SELECT `+memoryEntryColumns+`
+		FROM memories
+		WHERE `+where+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?`, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list memories: %w", err)
+	}
+	entries, err := scanMemoryEntries(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+// SearchMemoryEntries runs the hybrid chunk search and returns the matching
+// memories that pass the filter, best match first. Limit and Offset page
+// through the filtered matches.
+func SearchMemoryEntries(userID, queryStr string, filter MemoryListFilter) ([]MemoryEntry, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	if err := ensureMemoryRetentionSchema(); err != nil {
+		return nil, err
+	}
+	filter, err := normalizeMemoryListFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Filters are applied after ranking, so fetch enough chunks to fill
+	// the requested page from several chunks per memory.
+	matches, err := SearchMemoryChunkMatches(userID, queryStr, min((filter.Offset+filter.Limit)*3, maxMemoryListLimit*3))
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	seen := make(map[int64]bool, len(matches))
+	for _, match := range matches {
+		if !seen[match.ID] {
+			seen[match.ID] = true
+			ids = append(ids, match.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	where, args := memoryListConditions(userID, filter)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := db.Query(`
+		SELECT `+memoryEntryColumns+`
+		FROM memories
+		WHERE `+where+` AND id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load searched memories: %w", err)
+	}
+	entries, err := scanMemoryEntries(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int64]MemoryEntry, len(entries))
+	for _, entry := range entries {
+		byID[entry.ID] = entry
+	}
+	var ranked []MemoryEntry
+	for _, id := range ids {
+		if entry, ok := byID[id]; ok {
+			ranked = append(ranked, entry)
+		}
+	}
+	if filter.Offset >= len(ranked) {
+		return nil, nil
+	}
+	ranked = ranked[filter.Offset:]
+	return ranked[:min(filter.Limit, len(ranked))], nil
+}
+
+// UpdateMemory applies a user edit. A text change rebuilds the memory's
+// chunks, FTS rows and embeddings in the same transaction and is recorded
+// in its provenance.
+func UpdateMemory(userID string, memoryID int64, update MemoryUpdate) (entry MemoryEntry, err error) {
+	if db == nil {
+		return entry, fmt.Errorf("database not initialized")
+	}
+	if err = ensureMemoryRetentionSchema(); err != nil {
+		return entry, err
+	}
+	if update.FullText != nil && strings.TrimSpace(*update.FullText) == "" {
+		return entry, fmt.Errorf("%w: full_text must not be empty", ErrInvalidMemoryRequest)
+	}
+	if update.MemoryType != nil && strings.TrimSpace(*update.MemoryType) == "" {
+		return entry, fmt.Errorf("%w: memory_type must not be empty", ErrInvalidMemoryRequest)
+	}
+	if update.Tier != nil && !isMemoryTier(strings.ToLower(strings.TrimSpace(*update.Tier))) {
+		return entry, fmt.Errorf("%w: unknown memory tier %q", ErrInvalidMemoryRequest, *update.Tier)
+	}
+	if update.Importance != nil && (*update.Importance < 0 || *update.Importance > 1) {
+		return entry, fmt.Errorf("%w: importance must be between 0 and 1", ErrInvalidMemoryRequest)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return entry, fmt.Errorf("failed to start memory update: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var previousText string
+	var createdAt time.Time
+	err = tx.QueryRow(`SELECT full_text, created_at FROM memories WHERE id = ? AND user_id = ?`, memoryID, userID).Scan(&previousText, &createdAt)
+	if err == sql.ErrNoRows {
+		return entry, ErrMemoryNotFound
+	}
+	if err != nil {
+		return entry, fmt.Errorf("failed to read memory: %w", err)
+	}
+
+	var assignments []string
+	var args []any
+	if update.FullText != nil {
+		fullText := strings.TrimSpace(*update.FullText)
+		if fullText != previousText {
+			assignments = append(assignments, "full_text = ?")
+			args = append(args, fullText)
+			if err = rebuildMemoryChunksTx(tx, memoryID, userID, fullText, createdAt); err != nil {
+				return entry, err
+			}
+			if err = insertMemoryProvenanceTx(tx, userID, memoryID, 0, MemoryActionEdit, previousText, MemoryProvenance{}); err != nil {
+				return entry, err
+			}
+		}
+	}
+	if update.MemoryType != nil {
+		assignments = append(assignments, "memory_type = ?")
+		args = append(args, strings.TrimSpace(*update.MemoryType))
+	}
+	if update.Tier != nil {
+		assignments = append(assignments, "memory_tier = ?")
+		args = append(args, strings.ToLower(strings.TrimSpace(*update.Tier)))
+	}
+	if update.Pinned != nil {
+		assignments = append(assignments, "pinned = ?")
+		args = append(args, boolToInt(*update.Pinned))
+	}
+	if update.Importance != nil {
+		assignments = append(assignments, "importance_score = ?")
+		args = append(args, *update.Importance)
+	}
+	if len(assignments) > 0 {
+		args = append(args, memoryID, userID)
+		if _, err = tx.Exec(`UPDATE memories SET `+strings.Join(assignments, ", ")+` WHERE id = ? AND user_id = ?`, args...); err != nil {
+			return entry, fmt.Errorf("failed to update memory: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return entry, fmt.Errorf("failed to commit memory update: %w", err)
+	}
+	if len(assignments) > 0 {
+		notifyMemoryChanged(userID)
+	}
+	return ReadMemory(userID, memoryID)
+}
+
+// DeleteMemories removes several memories in one transaction and returns
+// how many existed. IDs the user does not own are skipped.
+func DeleteMemories(userID string, memoryIDs []int64) (deleted int, err error) {
+	if db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+	if len(memoryIDs) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start memory bulk delete: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, memoryID := range memoryIDs {
+		if err = deleteMemoryChunksTx(tx, memoryID, userID); err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec(`DELETE FROM memory_provenance WHERE memory_id = ? AND user_id = ?`, memoryID, userID); err != nil {
+			return 0, fmt.Errorf("failed to delete memory provenance: %w", err)
+		}
+		var result sql.Result
+		if result, err = tx.Exec(`DELETE FROM memories WHERE id = ? AND user_id = ?`, memoryID, userID); err != nil {
+			return 0, fmt.Errorf("failed to delete memory: %w", err)
+		}
+		var affected int64
+		if affected, err = result.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		deleted += int(affected)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit memory bulk delete: %w", err)
+	}
+	if deleted > 0 {
+		notifyMemoryChanged(userID)
+	}
+	return deleted, nil
+}
+
+// DeleteUserProfileFacts removes several profile facts by ID and returns
+// how many existed. Their history is kept so each can be reverted.
+func DeleteUserProfileFacts(userID string, factIDs []int64) (deleted int, err error) {
+	if db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+	if len(factIDs) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start profile fact bulk delete: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := time.Now().UTC()
+	for _, factID := range factIDs {
+		var factKey string
+		err = tx.QueryRow(`SELECT fact_key FROM user_profile_facts WHERE id = ? AND user_id = ?`, factID, userID).Scan(&factKey)
+		if err == sql.ErrNoRows {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read user profile fact: %w", err)
+		}
+		if err = closeProfileFactVersionTx(tx, userID, factKey, now); err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec(`DELETE FROM memory_provenance WHERE user_id = ? AND profile_fact_id = ?`, userID, factID); err != nil {
+			return 0, fmt.Errorf("failed to delete user profile fact provenance: %w", err)
+		}
+		if _, err = tx.Exec(`DELETE FROM user_profile_facts WHERE id = ? AND user_id = ?`, factID, userID); err != nil {
+			return 0, fmt.Errorf("failed to delete user profile fact: %w", err)
+		}
+		deleted++
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit profile fact bulk delete: %w", err)
+	}
+	if deleted > 0 {
+		notifyMemoryChanged(userID)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,133 @@
+package mcp
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryManagement(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "manage.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	var ids []int64
+	for _, text := range []string{
+		"User: I adopted a parrot named Kiwi\nAssistant: lovely",
+		"User: my favorite tea is oolong\nAssistant: noted",
+		"User: the parrot cage needs a new perch\nAssistant: ok",
+	} {
+		id, err := InsertMemory("alice", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := InsertMemory("bob", "User: my parrot is loud\nAssistant: hm"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE memories SET hit_count = 4, memory_tier = 'core' WHERE id = ?`, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	page, total, err := ListMemories("alice", MemoryListFilter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(page) != 2 || page[0].ID != ids[2] {
+		t.Fatalf("first page = %+v total %d", page, total)
+	}
+	page, _, _ = ListMemories("alice", MemoryListFilter{Limit: 2, Offset: 2})
+	if len(page) != 1 || page[0].ID != ids[0] {
+		t.Fatalf("second page = %+v", page)
+	}
+	zero := 0
+	for name, tc := range map[string]struct {
+		filter MemoryListFilter
+		want   int
+	}{
+		"tier":      {MemoryListFilter{Tier: "Core"}, 1},
+		"min hits":  {MemoryListFilter{MinHitCount: 3}, 1},
+		"max hits":  {MemoryListFilter{MaxHitCount: &zero}, 2},
+		"type":      {MemoryListFilter{MemoryType: "raw_interaction"}, 3},
+		"after":     {MemoryListFilter{CreatedAfter: time.Now().UTC().Add(time.Hour)}, 0},
+		"before":    {MemoryListFilter{CreatedBefore: time.Now().UTC().Add(time.Hour)}, 3},
+		"no filter": {MemoryListFilter{}, 3},
+	} {
+		if _, total, err := ListMemories("alice", tc.filter); err != nil || total != tc.want {
+			t.Fatalf("%s: total %d err %v, want %d", name, total, err, tc.want)
+		}
+	}
+	if _, _, err := ListMemories("alice", MemoryListFilter{Tier: "forever"}); !errors.Is(err, ErrInvalidMemoryRequest) {
+		t.Fatalf("unknown tier err = %v", err)
+	}
+
+	found, err := SearchMemoryEntries("alice", "parrot", MemoryListFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("search = %+v, want alice's two parrot memories", found)
+	}
+	if found, _ = SearchMemoryEntries("alice", "parrot", MemoryListFilter{MinHitCount: 1}); len(found) != 0 {
+		t.Fatalf("filtered search = %+v", found)
+	}
+
+	text := "Alice's parrot is called Mango."
+	tier := "working"
+	pinned := true
+	edited, err := UpdateMemory("alice", ids[0], MemoryUpdate{FullText: &text, Tier: &tier, Pinned: &pinned})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.FullText != text || edited.MemoryTier != memoryTierWorking || !edited.Pinned {
+		t.Fatalf("edited memory = %+v", edited)
+	}
+	if matches, _ := SearchMemoryChunkMatches("alice", "Mango", 5); len(matches) != 1 || matches[0].ID != ids[0] {
+		t.Fatalf("edited text is not searchable: %+v", matches)
+	}
+	if matches, _ := SearchMemoryChunkMatches("alice", "Kiwi", 5); len(matches) != 0 {
+		t.Fatalf("old text is still indexed: %+v", matches)
+	}
+	provenance, err := ListMemoryProvenance("alice", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provenance) != 1 || provenance[0].Action != MemoryActionEdit || provenance[0].PreviousText == "" {
+		t.Fatalf("edit provenance = %+v", provenance)
+	}
+	if _, err := UpdateMemory("bob", ids[0], MemoryUpdate{Pinned: &pinned}); !errors.Is(err, ErrMemoryNotFound) {
+		t.Fatalf("editing another user's memory err = %v", err)
+	}
+	badTier := "forever"
+	if _, err := UpdateMemory("alice", ids[0], MemoryUpdate{Tier: &badTier}); !errors.Is(err, ErrInvalidMemoryRequest) {
+		t.Fatalf("bad tier err = %v", err)
+	}
+
+	deleted, err := DeleteMemories("alice", []int64{ids[0], ids[2], 9999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Fatalf("deleted %d, want 2", deleted)
+	}
+	if _, total, _ := ListMemories("alice", MemoryListFilter{}); total != 1 {
+		t.Fatalf("%d memories left, want 1", total)
+	}
+	if matches, _ := SearchMemoryChunkMatches("alice", "Mango", 5); len(matches) != 0 {
+		t.Fatalf("deleted memory is still searchable: %+v", matches)
+	}
+
+	fact, err := SaveUserProfileFact("alice", "pet", "parrot", "family", "user", ProfileFactRef{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := DeleteUserProfileFacts("alice", []int64{fact.ID, 9999}); err != nil || deleted != 1 {
+		t.Fatalf("deleted %d facts, err %v", deleted, err)
+	}
+	if timeline, _ := GetUserProfileFactTimeline("alice", "pet"); len(timeline) != 1 || timeline[0].ValidTo == nil {
+		t.Fatalf("bulk delete must close the fact's history, got %+v", timeline)
+	}
+}
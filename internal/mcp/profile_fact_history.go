@@ -0,0 +1,302 @@
+package mcp
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const profileFactSourceRevert = "revert"
+
+// profileFactConcepts maps keys that name the same attribute to one concept,
+// so "vehicle" updates an existing "car" instead of living next to it.
+var profileFactConcepts = map[string]string{
+	"name": "name", "full_name": "name", "real_name": "name", "이름": "name", "성명": "name",
+	"birthday": "birthday", "birth_date": "birthday", "birthdate": "birthday", "date_of_birth": "birthday", "dob": "birthday", "생일": "birthday", "생년월일": "birthday",
+	"age": "age", "나이": "age",
+	"car": "vehicle", "vehicle": "vehicle", "automobile": "vehicle", "차": "vehicle", "자동차": "vehicle", "차량": "vehicle",
+	"job": "occupation", "occupation": "occupation", "profession": "occupation", "job_title": "occupation", "직업": "occupation",
+	"company": "employer", "employer": "employer", "workplace": "employer", "회사": "employer", "직장": "employer",
+	"location": "location", "city": "location", "residence": "location", "home_city": "location", "거주지": "location", "사는_곳": "location",
+	"pet": "pet", "pet_name": "pet", "반려동물": "pet",
+	"email": "email", "email_address": "email", "이메일": "email",
+	"phone": "phone", "phone_number": "phone", "mobile": "phone", "전화번호": "phone",
+	"spouse": "spouse", "wife": "spouse", "husband": "spouse", "배우자": "spouse",
+	"language": "language", "preferred_language": "language", "언어": "language",
+}
+
+// ProfileFactRef records where a profile fact version came from. Zero
+// values mean unknown.
+type ProfileFactRef struct {
+	Confidence float64
+	SessionID  int64
+	TurnID     string
+}
+
+// UserProfileFactVersion is one value a profile fact held. The current
+// version has no ValidTo.
+type UserProfileFactVersion struct {
+	ID         int64      `json:"id"`
+	UserID     string     `json:"user_id"`
+	FactKey    string     `json:"fact_key"`
+	FactValue  string     `json:"fact_value"`
+	Category   string     `json:"category"`
+	Source     string     `json:"source"`
+	Confidence float64    `json:"confidence,omitempty"`
+	SessionID  int64      `json:"session_id,omitempty"`
+	TurnID     string     `json:"turn_id,omitempty"`
+	ValidFrom  time.Time  `json:"valid_from"`
+	ValidTo    *time.Time `json:"valid_to,omitempty"`
+}
+
+// ProfileFactConflict is a set of current facts whose keys name the same
+// concept, newest first. Only the first is shown to the model.
+type ProfileFactConflict struct {
+	Concept string            `json:"concept"`
+	Facts   []UserProfileFact `json:"facts"`
+}
+
+func profileFactConcept(factKey string) string {
+	key := strings.ToLower(strings.TrimSpace(factKey))
+	key = strings.NewReplacer("-", "_", " ", "_").Replace(key)
+	if concept, ok := profileFactConcepts[key]; ok {
+		return concept
+	}
+	return key
+}
+
+// migrateUserProfileFactHistory gives every fact stored before history
+// existed an open version, so its timeline starts at its last update.
+func migrateUserProfileFactHistory() error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	if _, err := db.Exec(`
+		INSERT INTO user_profile_fact_history (user_id, fact_key, fact_value, category, source, valid_from)
+		SELECT f.user_id, f.fact_key, f.fact_value, f.category, f.source, f.updated_at
+		FROM user_profile_facts f
+		WHERE NOT EXISTS (
+			SELECT 1 FROM user_profile_fact_history h
+			WHERE h.user_id = f.user_id AND h.fact_key = f.fact_key AND h.valid_to IS NULL
+		)`); err != nil {
+		return fmt.Errorf("failed to backfill user profile fact history: %w", err)
+	}
+	return nil
+}
+
+// resolveProfileFactKeyTx returns the stored key a write of factKey should
+// go to: factKey itself, or an existing key of the same concept.
+func resolveProfileFactKeyTx(tx *sql.Tx, userID, factKey string) (string, error) {
+	rows, err := tx.Query(`
+		SELECT fact_key FROM user_profile_facts
+		WHERE user_id = ?
+		ORDER BY updated_at DESC, id DESC`, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to query user profile fact keys: %w", err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return "", fmt.Errorf("failed to scan user profile fact key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return "", fmt.Errorf("failed to iterate user profile fact keys: %w", err)
+	}
+	rows.Close()
+
+	concept := profileFactConcept(factKey)
+	resolved := factKey
+	for _, key := range keys {
+		if key == factKey {
+			return factKey, nil
+		}
+		if resolved == factKey && profileFactConcept(key) == concept {
+			resolved = key
+		}
+	}
+	return resolved, nil
+}
+
+// recordProfileFactVersionTx closes the open version of a fact and opens a
+// new one holding its latest value.
+func recordProfileFactVersionTx(tx *sql.Tx, userID, factKey, factValue, category, source string, ref ProfileFactRef, now time.Time) error {
+	if err := closeProfileFactVersionTx(tx, userID, factKey, now); err != nil {
+		return err
+	}
+	var confidence sql.NullFloat64
+	if ref.Confidence > 0 {
+		confidence = sql.NullFloat64{Float64: ref.Confidence, Valid: true}
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO user_profile_fact_history (user_id, fact_key, fact_value, category, source, confidence, session_id, turn_id, valid_from)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, factKey, factValue, category, source, confidence, ref.SessionID, strings.TrimSpace(ref.TurnID), now,
+	); err != nil {
+		return fmt.Errorf("failed to record user profile fact version: %w", err)
+	}
+	return nil
+}
+
+func closeProfileFactVersionTx(tx *sql.Tx, userID, factKey string, now time.Time) error {
+	if _, err := tx.Exec(`
+		UPDATE user_profile_fact_history
+		SET valid_to = ?
+		WHERE user_id = ? AND fact_key = ? AND valid_to IS NULL`,
+		now, userID, factKey,
+	); err != nil {
+		return fmt.Errorf("failed to close user profile fact version: %w", err)
+	}
+	return nil
+}
+
+// GetUserProfileFactTimeline returns every version of a fact, newest first.
+// Keys of the same concept share one timeline.
+func GetUserProfileFactTimeline(userID, factKey string) ([]UserProfileFactVersion, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	factKey = strings.TrimSpace(factKey)
+	if factKey == "" {
+		return nil, fmt.Errorf("fact_key must not be empty")
+	}
+
+	rows, err := db.Query(`
+		SELECT id, user_id, fact_key, fact_value, category, source, confidence, session_id, turn_id, valid_from, valid_to
+		FROM user_profile_fact_history
+		WHERE user_id = ?
+		ORDER BY valid_from DESC, id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user profile fact history: %w", err)
+	}
+	defer rows.Close()
+
+	concept := profileFactConcept(factKey)
+	var versions []UserProfileFactVersion
+	for rows.Next() {
+		version, err := scanProfileFactVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		if profileFactConcept(version.FactKey) == concept {
+			versions = append(versions, version)
+		}
+	}
+	return versions, rows.Err()
+}
+
+func scanProfileFactVersion(scanner interface{ Scan(...any) error }) (UserProfileFactVersion, error) {
+	var version UserProfileFactVersion
+	var confidence sql.NullFloat64
+	var validTo sql.NullTime
+	if err := scanner.Scan(
+		&version.ID,
+		&version.UserID,
+		&version.FactKey,
+		&version.FactValue,
+		&version.Category,
+		&version.Source,
+		&confidence,
+		&version.SessionID,
+		&version.TurnID,
+		&version.ValidFrom,
+		&validTo,
+	); err != nil {
+		return version, fmt.Errorf("failed to scan user profile fact version: %w", err)
+	}
+	version.Confidence = confidence.Float64
+	if validTo.Valid {
+		version.ValidTo = &validTo.Time
+	}
+	return version, nil
+}
+
+// RevertUserProfileFact makes an earlier version the current value again.
+// The revert is itself a new version, so it can be undone the same way.
+func RevertUserProfileFact(userID string, versionID int64) (UserProfileFact, error) {
+	if db == nil {
+		return UserProfileFact{}, fmt.Errorf("database not initialized")
+	}
+	version, err := scanProfileFactVersion(db.QueryRow(`
+		SELECT id, user_id, fact_key, fact_value, category, source, confidence, session_id, turn_id, valid_from, valid_to
+		FROM user_profile_fact_history
+		WHERE id = ? AND user_id = ?`, versionID, userID))
+	if err != nil {
+		if strings.Contains(err.Error(), sql.ErrNoRows.Error()) {
+			return UserProfileFact{}, fmt.Errorf("profile fact version %d not found for user: %w", versionID, sql.ErrNoRows)
+		}
+		return UserProfileFact{}, err
+	}
+	return SaveUserProfileFact(userID, version.FactKey, version.FactValue, version.Category, profileFactSourceRevert, ProfileFactRef{
+		Confidence: version.Confidence,
+		SessionID:  version.SessionID,
+		TurnID:     version.TurnID,
+	})
+}
+
+// FindUserProfileFactConflicts lists current facts stored under different
+// keys for the same concept, such as "car" and "vehicle".
+func FindUserProfileFactConflicts(userID string) ([]ProfileFactConflict, error) {
+	facts, err := GetUserProfileFacts(userID)
+	if err != nil {
+		return nil, err
+	}
+	byConcept := make(map[string][]UserProfileFact)
+	var concepts []string
+	for _, fact := range facts {
+		concept := profileFactConcept(fact.FactKey)
+		if _, ok := byConcept[concept]; !ok {
+			concepts = append(concepts, concept)
+		}
+		byConcept[concept] = append(byConcept[concept], fact)
+	}
+
+	var conflicts []ProfileFactConflict
+	for _, concept := range concepts {
+		group := byConcept[concept]
+		if len(group) < 2 {
+			continue
+		}
+		sortProfileFactsNewestFirst(group)
+		conflicts = append(conflicts, ProfileFactConflict{Concept: concept, Facts: group})
+	}
+	return conflicts, nil
+}
+
+// currentUserProfileFacts drops facts that an update under another key of
+// the same concept has replaced, keeping the input order.
+func currentUserProfileFacts(facts []UserProfileFact) []UserProfileFact {
+	newest := make(map[string]UserProfileFact, len(facts))
+	for _, fact := range facts {
+		concept := profileFactConcept(fact.FactKey)
+		if kept, ok := newest[concept]; !ok || profileFactNewer(fact, kept) {
+			newest[concept] = fact
+		}
+	}
+	current := make([]UserProfileFact, 0, len(newest))
+	for _, fact := range facts {
+		if newest[profileFactConcept(fact.FactKey)].ID == fact.ID {
+			current = append(current, fact)
+		}
+	}
+	return current
+}
+
+func sortProfileFactsNewestFirst(facts []UserProfileFact) {
+	sort.SliceStable(facts, func(i, j int) bool {
+		return profileFactNewer(facts[i], facts[j])
+	})
+}
+
+func profileFactNewer(a, b UserProfileFact) bool {
+	if !a.UpdatedAt.Equal(b.UpdatedAt) {
+		return a.UpdatedAt.After(b.UpdatedAt)
+	}
+	return a.ID > b.ID
+}
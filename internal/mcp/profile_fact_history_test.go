@@ -0,0 +1,129 @@
+package mcp
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserProfileFactHistory(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "profile.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	if _, err := UpsertUserProfileFact("alice", "car", "Tesla Model 3", "vehicle", ""); err != nil {
+		t.Fatal(err)
+	}
+	// Restating the same value must not open a new version.
+	if _, err := UpsertUserProfileFact("alice", "car", "Tesla Model 3", "vehicle", ""); err != nil {
+		t.Fatal(err)
+	}
+	fact, err := SaveUserProfileFact("alice", "Vehicle", "Kia EV6", "vehicle", "extraction", ProfileFactRef{Confidence: 0.8, SessionID: 4, TurnID: "turn-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fact.FactKey != "car" || fact.FactValue != "Kia EV6" {
+		t.Fatalf("same-concept write stored %+v, want it on the existing car key", fact)
+	}
+
+	timeline, err := GetUserProfileFactTimeline("alice", "vehicle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline) != 2 || timeline[0].FactValue != "Kia EV6" || timeline[0].ValidTo != nil || timeline[0].TurnID != "turn-2" || timeline[0].Confidence != 0.8 {
+		t.Fatalf("timeline = %+v", timeline)
+	}
+	if timeline[1].FactValue != "Tesla Model 3" || timeline[1].ValidTo == nil {
+		t.Fatalf("superseded version = %+v, want it closed", timeline[1])
+	}
+
+	reverted, err := RevertUserProfileFact("alice", timeline[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.ID != fact.ID || reverted.FactValue != "Tesla Model 3" || reverted.Source != profileFactSourceRevert {
+		t.Fatalf("reverted fact = %+v", reverted)
+	}
+	if timeline, _ = GetUserProfileFactTimeline("alice", "car"); len(timeline) != 3 || timeline[0].FactValue != "Tesla Model 3" {
+		t.Fatalf("timeline after revert = %+v", timeline)
+	}
+	if _, err := RevertUserProfileFact("bob", timeline[0].ID); err == nil {
+		t.Fatal("reverting another user's version must fail")
+	}
+
+	// Facts written before history existed get an open version on startup.
+	if _, err := db.Exec(`INSERT INTO user_profile_facts (user_id, fact_key, fact_value, category, source, updated_at) VALUES ('alice', 'automobile', 'Vespa', 'vehicle', 'llm', ?)`, time.Now().UTC().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpsertUserProfileFact("alice", "city", "Seoul", "location", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUserProfileFactHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUserProfileFactHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if timeline, _ = GetUserProfileFactTimeline("alice", "car"); len(timeline) != 4 || timeline[0].FactKey != "automobile" {
+		t.Fatalf("timeline after backfill = %+v", timeline)
+	}
+
+	conflicts, err := FindUserProfileFactConflicts("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Concept != "vehicle" || len(conflicts[0].Facts) != 2 || conflicts[0].Facts[0].FactKey != "automobile" {
+		t.Fatalf("conflicts = %+v", conflicts)
+	}
+	prompt := FormatUserProfileForPrompt("alice")
+	if !strings.Contains(prompt, "automobile: Vespa") || strings.Contains(prompt, "Tesla") || !strings.Contains(prompt, "city: Seoul") {
+		t.Fatalf("prompt must hold only current values, got %q", prompt)
+	}
+
+	if err := DeleteUserProfileFact("alice", "automobile"); err != nil {
+		t.Fatal(err)
+	}
+	if timeline, _ = GetUserProfileFactTimeline("alice", "automobile"); len(timeline) != 4 || timeline[0].ValidTo == nil {
+		t.Fatalf("deleting a fact must keep its history closed, got %+v", timeline)
+	}
+	// The restored value goes to the concept's surviving key.
+	if reverted, err = RevertUserProfileFact("alice", timeline[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if reverted.FactKey != "car" || reverted.FactValue != "Vespa" {
+		t.Fatalf("reverting a deleted fact stored %+v", reverted)
+	}
+}
+
+func TestDeleteUserProfileFactChecksTheFactFirst(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "profile.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	fact, err := SaveUserProfileFact("alice", "pet", "cat", "animal", "", ProfileFactRef{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUserProfileFactByID("bob", fact.ID); err == nil {
+		t.Fatal("deleting another user's fact must fail")
+	}
+	if err := DeleteUserProfileFact("alice", "pets"); err == nil {
+		t.Fatal("deleting a missing key must fail")
+	}
+	if timeline, _ := GetUserProfileFactTimeline("alice", "pet"); len(timeline) != 1 || timeline[0].ValidTo != nil {
+		t.Fatalf("a failed delete touched the history: %+v", timeline)
+	}
+
+	if err := DeleteUserProfileFactByID("alice", fact.ID); err != nil {
+		t.Fatal(err)
+	}
+	if timeline, _ := GetUserProfileFactTimeline("alice", "pet"); len(timeline) != 1 || timeline[0].ValidTo == nil {
+		t.Fatalf("deleting the fact must close its version: %+v", timeline)
+	}
+	if err := DeleteUserProfileFactByID("alice", fact.ID); err == nil {
+		t.Fatal("deleting the fact twice must fail")
+	}
+}
@@ -0,0 +1,251 @@
+package mcp
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RetrievalFusionRRF      = "rrf"
+	RetrievalFusionWeighted = "weighted"
+)
+
+// RetrievalConfig controls how hybrid search merges its FTS and vector hit
+// lists and how the merged list is boosted and reranked.
+type RetrievalConfig struct {
+	// Fusion is "rrf" (reciprocal rank fusion) or "weighted" (score blend).
+	Fusion       string  `json:"fusion"`
+	RRFK         int     `json:"rrfK"`
+	FTSWeight    float64 `json:"ftsWeight"`
+	VectorWeight float64 `json:"vectorWeight"`
+	// RecencyBoost multiplies a score by up to 1+RecencyBoost for brand new
+	// entries, halving every RecencyHalfLifeDays.
+	RecencyBoost        float64 `json:"recencyBoost"`
+	RecencyHalfLifeDays int     `json:"recencyHalfLifeDays"`
+	// HitCountBoost multiplies a score by 1+HitCountBoost*ln(1+hits).
+	HitCountBoost float64 `json:"hitCountBoost"`
+	// RerankTopN is how many fused candidates the reranker rescores.
+	RerankTopN    int  `json:"rerankTopN"`
+	DisableRerank bool `json:"disableRerank"`
+}
+
+// RetrievalReranker scores (query, passage) pairs; higher is more relevant.
+// Scores are logits and are squashed with a sigmoid before boosting.
+type RetrievalReranker func(query string, passages []string) ([]float64, error)
+
+var (
+	retrievalConfigMu         sync.RWMutex
+	retrievalConfig           = DefaultRetrievalConfig()
+	userRetrievalProvider     func(userID string) (RetrievalConfig, bool)
+	retrievalRerankerMu       sync.RWMutex
+	retrievalReranker         RetrievalReranker
+	retrievalRerankerDisabled bool
+)
+
+func DefaultRetrievalConfig() RetrievalConfig {
+	return RetrievalConfig{
+		Fusion:              RetrievalFusionRRF,
+		RRFK:                60,
+		FTSWeight:           0.65,
+		VectorWeight:        0.35,
+		RecencyBoost:        0,
+		RecencyHalfLifeDays: 30,
+		HitCountBoost:       0,
+		RerankTopN:          20,
+	}
+}
+
+func NormalizeRetrievalConfig(cfg RetrievalConfig) RetrievalConfig {
+	defaults := DefaultRetrievalConfig()
+	cfg.Fusion = strings.ToLower(strings.TrimSpace(cfg.Fusion))
+	if cfg.Fusion != RetrievalFusionWeighted {
+		cfg.Fusion = RetrievalFusionRRF
+	}
+	if cfg.RRFK <= 0 {
+		cfg.RRFK = defaults.RRFK
+	}
+	if cfg.FTSWeight < 0 || cfg.VectorWeight < 0 || cfg.FTSWeight+cfg.VectorWeight == 0 {
+		cfg.FTSWeight, cfg.VectorWeight = defaults.FTSWeight, defaults.VectorWeight
+	}
+	if cfg.RecencyBoost < 0 {
+		cfg.RecencyBoost = 0
+	}
+	if cfg.RecencyHalfLifeDays <= 0 {
+		cfg.RecencyHalfLifeDays = defaults.RecencyHalfLifeDays
+	}
+	if cfg.HitCountBoost < 0 {
+		cfg.HitCountBoost = 0
+	}
+	if cfg.RerankTopN <= 0 {
+		cfg.RerankTopN = defaults.RerankTopN
+	}
+	return cfg
+}
+
+func SetRetrievalConfig(cfg RetrievalConfig) {
+	retrievalConfigMu.Lock()
+	defer retrievalConfigMu.Unlock()
+	retrievalConfig = NormalizeRetrievalConfig(cfg)
+}
+
+func GetRetrievalConfig() RetrievalConfig {
+	retrievalConfigMu.RLock()
+	defer retrievalConfigMu.RUnlock()
+	return retrievalConfig
+}
+
+func SetUserRetrievalConfigProvider(provider func(userID string) (RetrievalConfig, bool)) {
+	retrievalConfigMu.Lock()
+	defer retrievalConfigMu.Unlock()
+	userRetrievalProvider = provider
+}
+
+func getRetrievalConfigForUser(userID string) RetrievalConfig {
+	retrievalConfigMu.RLock()
+	provider := userRetrievalProvider
+	fallback := retrievalConfig
+	retrievalConfigMu.RUnlock()
+
+	if provider != nil {
+		if cfg, ok := provider(strings.TrimSpace(userID)); ok {
+			return NormalizeRetrievalConfig(cfg)
+		}
+	}
+	return fallback
+}
+
+// SetRetrievalReranker installs the cross-encoder used after fusion. A nil
+// reranker turns the stage off.
+func SetRetrievalReranker(reranker RetrievalReranker) {
+	retrievalRerankerMu.Lock()
+	defer retrievalRerankerMu.Unlock()
+	retrievalReranker = reranker
+	retrievalRerankerDisabled = false
+}
+
+func getRetrievalReranker() RetrievalReranker {
+	retrievalRerankerMu.RLock()
+	defer retrievalRerankerMu.RUnlock()
+	if retrievalRerankerDisabled {
+		return nil
+	}
+	return retrievalReranker
+}
+
+// disableRetrievalRerankerAfterError stops calling a reranker that failed
+// so one broken model does not slow every search down.
+func disableRetrievalRerankerAfterError(err error) {
+	retrievalRerankerMu.Lock()
+	defer retrievalRerankerMu.Unlock()
+	if !retrievalRerankerDisabled {
+		log.Printf("[DB] Reranker failed, falling back to fused order: %v", err)
+	}
+	retrievalRerankerDisabled = true
+}
+
+// retrievalCandidate is one merged hit. Ranks are 1-based positions in the
+// FTS and vector lists; zero means the list did not return the hit.
+type retrievalCandidate struct {
+	FTSScore    float64
+	VectorScore float64
+	FTSRank     int
+	VectorRank  int
+	CreatedAt   time.Time
+	HitCount    int
+	Text        string
+}
+
+// fuseRetrievalScore combines the two hit lists for one candidate.
+func fuseRetrievalScore(candidate retrievalCandidate, cfg RetrievalConfig) float64 {
+	if cfg.Fusion == RetrievalFusionWeighted {
+		return candidate.FTSScore*cfg.FTSWeight + candidate.VectorScore*cfg.VectorWeight
+	}
+	// RRF ignores the raw scores, which live on different scales (BM25 vs
+	// cosine), and only trusts each list's ordering.
+	var score float64
+	if candidate.FTSRank > 0 {
+		score += 1 / float64(cfg.RRFK+candidate.FTSRank)
+	}
+	if candidate.VectorRank > 0 {
+		score += 1 / float64(cfg.RRFK+candidate.VectorRank)
+	}
+	return score
+}
+
+func retrievalBoost(candidate retrievalCandidate, cfg RetrievalConfig, now time.Time) float64 {
+	boost := 1.0
+	if cfg.RecencyBoost > 0 && !candidate.CreatedAt.IsZero() {
+		ageDays := max(now.Sub(candidate.CreatedAt).Hours()/24, 0)
+		boost *= 1 + cfg.RecencyBoost*math.Pow(0.5, ageDays/float64(cfg.RecencyHalfLifeDays))
+	}
+	if cfg.HitCountBoost > 0 && candidate.HitCount > 0 {
+		boost *= 1 + cfg.HitCountBoost*math.Log1p(float64(candidate.HitCount))
+	}
+	return boost
+}
+
+// rankRetrievalCandidates orders candidates for query and returns the
+// indexes of the best limit of them with their final scores. With a
+// reranker installed the top RerankTopN fused candidates are rescored by it
+// and only those can be returned.
+func rankRetrievalCandidates(query string, candidates []retrievalCandidate, cfg RetrievalConfig, limit int, now time.Time) ([]int, []float64) {
+	scores := make([]float64, len(candidates))
+	boosts := make([]float64, len(candidates))
+	order := make([]int, len(candidates))
+	for i, candidate := range candidates {
+		boosts[i] = retrievalBoost(candidate, cfg, now)
+		scores[i] = fuseRetrievalScore(candidate, cfg) * boosts[i]
+		order[i] = i
+	}
+	sortRetrievalOrder(order, scores, candidates)
+
+	if reranker := getRetrievalReranker(); reranker != nil && !cfg.DisableRerank && len(order) > 1 {
+		window := order[:min(len(order), max(cfg.RerankTopN, limit))]
+		passages := make([]string, len(window))
+		for i, index := range window {
+			passages[i] = candidates[index].Text
+		}
+		logits, err := reranker(query, passages)
+		if err == nil && len(logits) != len(window) {
+			err = fmt.Errorf("reranker returned %d scores for %d passages", len(logits), len(window))
+		}
+		if err != nil {
+			disableRetrievalRerankerAfterError(err)
+		} else {
+			for i, index := range window {
+				scores[index] = boosts[index] / (1 + math.Exp(-logits[i]))
+			}
+			order = window
+			sortRetrievalOrder(order, scores, candidates)
+		}
+	}
+
+	if len(order) > limit {
+		order = order[:limit]
+	}
+	ranked := make([]float64, len(order))
+	for i, index := range order {
+		ranked[i] = scores[index]
+	}
+	return order, ranked
+}
+
+// sortRetrievalOrder sorts by score, breaking ties towards newer entries
+// and then the order the candidates were found in.
+func sortRetrievalOrder(order []int, scores []float64, candidates []retrievalCandidate) {
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if math.Abs(scores[a]-scores[b]) < 1e-12 {
+			if !candidates[a].CreatedAt.Equal(candidates[b].CreatedAt) {
+				return candidates[a].CreatedAt.After(candidates[b].CreatedAt)
+			}
+			return a < b
+		}
+		return scores[a] > scores[b]
+	})
+}
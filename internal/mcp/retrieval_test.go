@@ -0,0 +1,191 @@
+package mcp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetrievalFusion(t *testing.T) {
+	now := time.Now()
+	candidates := []retrievalCandidate{
+		// A strong keyword hit the vector search missed.
+		{FTSScore: 0.95, FTSRank: 1, CreatedAt: now},
+		// Found by both lists, but ranked lower in each.
+		{FTSScore: 0.40, FTSRank: 2, VectorScore: 0.80, VectorRank: 2, CreatedAt: now},
+		{VectorScore: 0.82, VectorRank: 1, CreatedAt: now},
+	}
+
+	order, scores := rankRetrievalCandidates("q", candidates, DefaultRetrievalConfig(), 3, now)
+	if len(order) != 3 || order[0] != 1 {
+		t.Fatalf("rrf order = %v, want the hit found by both lists first", order)
+	}
+	if want := 2.0 / 62; math.Abs(scores[0]-want) > 1e-12 {
+		t.Fatalf("rrf score = %v, want %v", scores[0], want)
+	}
+
+	weighted := DefaultRetrievalConfig()
+	weighted.Fusion = RetrievalFusionWeighted
+	order, scores = rankRetrievalCandidates("q", candidates, weighted, 2, now)
+	if len(order) != 2 || order[0] != 0 || math.Abs(scores[0]-0.95*0.65) > 1e-12 {
+		t.Fatalf("weighted order = %v scores = %v", order, scores)
+	}
+
+	if cfg := NormalizeRetrievalConfig(RetrievalConfig{Fusion: "Weighted", RRFK: -1, FTSWeight: -1}); cfg.Fusion != RetrievalFusionWeighted || cfg.RRFK != 60 || cfg.FTSWeight != 0.65 || cfg.RerankTopN != 20 {
+		t.Fatalf("normalized = %+v", cfg)
+	}
+}
+
+func TestRetrievalBoosts(t *testing.T) {
+	now := time.Now()
+	candidates := []retrievalCandidate{
+		{FTSRank: 1, CreatedAt: now.Add(-300 * 24 * time.Hour)},
+		{FTSRank: 2, CreatedAt: now},
+		{FTSRank: 3, CreatedAt: now.Add(-300 * 24 * time.Hour), HitCount: 50},
+	}
+	if order, _ := rankRetrievalCandidates("q", candidates, DefaultRetrievalConfig(), 3, now); order[0] != 0 {
+		t.Fatalf("boosts must be off by default, order = %v", order)
+	}
+
+	recent := DefaultRetrievalConfig()
+	recent.RecencyBoost = 1
+	if order, _ := rankRetrievalCandidates("q", candidates, recent, 3, now); order[0] != 1 {
+		t.Fatalf("recency boost order = %v", order)
+	}
+
+	popular := DefaultRetrievalConfig()
+	popular.HitCountBoost = 0.5
+	if order, _ := rankRetrievalCandidates("q", candidates, popular, 3, now); order[0] != 2 {
+		t.Fatalf("hit count boost order = %v", order)
+	}
+
+	if boost := retrievalBoost(retrievalCandidate{CreatedAt: now.Add(-30 * 24 * time.Hour)}, recent, now); math.Abs(boost-1.5) > 1e-9 {
+		t.Fatalf("boost after one half-life = %v, want 1.5", boost)
+	}
+}
+
+func TestRetrievalReranker(t *testing.T) {
+	t.Cleanup(func() { SetRetrievalReranker(nil) })
+	now := time.Now()
+	candidates := make([]retrievalCandidate, 30)
+	for i := range candidates {
+		candidates[i] = retrievalCandidate{FTSRank: i + 1, Text: fmt.Sprintf("passage %d", i)}
+	}
+
+	var seen []string
+	SetRetrievalReranker(func(query string, passages []string) ([]float64, error) {
+		seen = passages
+		logits := make([]float64, len(passages))
+		for i := range passages {
+			logits[i] = float64(i)
+		}
+		return logits, nil
+	})
+	cfg := DefaultRetrievalConfig()
+	cfg.RerankTopN = 10
+	order, scores := rankRetrievalCandidates("q", candidates, cfg, 5, now)
+	if len(seen) != 10 || seen[0] != "passage 0" {
+		t.Fatalf("reranker saw %v, want the fused top 10", seen)
+	}
+	if len(order) != 5 || order[0] != 9 || math.Abs(scores[0]-1/(1+math.Exp(-9))) > 1e-12 {
+		t.Fatalf("reranked order = %v scores = %v", order, scores)
+	}
+
+	cfg.DisableRerank = true
+	if order, _ := rankRetrievalCandidates("q", candidates, cfg, 5, now); order[0] != 0 {
+		t.Fatalf("a user who disabled reranking got %v", order)
+	}
+
+	calls := 0
+	SetRetrievalReranker(func(string, []string) ([]float64, error) {
+		calls++
+		return nil, errors.New("model crashed")
+	})
+	cfg.DisableRerank = false
+	for range 2 {
+		if order, _ := rankRetrievalCandidates("q", candidates, cfg, 5, now); order[0] != 0 {
+			t.Fatalf("a failed reranker must keep the fused order, got %v", order)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("failed reranker called %d times, want 1", calls)
+	}
+}
+
+func TestMemorySearchUsesUserRetrievalConfig(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "memory.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+	t.Cleanup(func() { SetUserRetrievalConfigProvider(nil) })
+
+	old, err := InsertMemory("alice", "the garden tomato harvest was late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := InsertMemory("alice", "the garden tomato harvest was early")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE memories SET created_at = ? WHERE id = ?`, time.Now().Add(-365*24*time.Hour), fresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE memories SET created_at = ? WHERE id = ?`, time.Now(), old); err != nil {
+		t.Fatal(err)
+	}
+
+	SetUserRetrievalConfigProvider(func(userID string) (RetrievalConfig, bool) {
+		if userID != "alice" {
+			return RetrievalConfig{}, false
+		}
+		return RetrievalConfig{RecencyBoost: 5}, true
+	})
+	matches, err := SearchMemoryChunkMatches("alice", "garden tomato harvest", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].ID != old || matches[0].HybridScore <= matches[1].HybridScore {
+		t.Fatalf("matches = %+v, want the recent memory first", matches)
+	}
+}
+
+func TestMemoryCandidatesFuseFullTextOnlyMatches(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "memory.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	chunked, err := InsertMemory("alice", "the garden tomato harvest was late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A popular memory that only the LIKE search finds: its chunks are gone.
+	popular, err := InsertMemory("alice", "notes on the garden tomato harvest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`DELETE FROM memory_chunk_embeddings WHERE chunk_id IN (SELECT id FROM memory_chunks WHERE memory_id = ?)`,
+		`DELETE FROM memory_chunks_fts WHERE memory_id = ?`,
+		`DELETE FROM memory_chunks WHERE memory_id = ?`,
+		`UPDATE memories SET hit_count = 40 WHERE id = ?`,
+	} {
+		if _, err := db.Exec(statement, popular); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	candidates, err := buildMemoryCandidates("alice", "garden tomato harvest", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 || candidates[0].MemoryID != chunked || candidates[1].MemoryID != popular {
+		t.Fatalf("candidates = %+v, want the fused chunk match before the full-text-only match", candidates)
+	}
+	if fullText := candidates[1]; fullText.MatchReason != "full text match" || fullText.HybridScore <= 0 || fullText.HybridScore > 1/float64(DefaultRetrievalConfig().RRFK+1) {
+		t.Fatalf("full-text-only score = %v, want an RRF-scale score", fullText.HybridScore)
+	}
+}
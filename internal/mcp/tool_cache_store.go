@@ -0,0 +1,181 @@
+package mcp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ToolCacheEntry is one persisted tool result. UserID is empty for results
+// that are shared by every user.
+type ToolCacheEntry struct {
+	Key       string
+	Tool      string
+	UserID    string
+	Value     string
+	StoredAt  time.Time
+	ExpiresAt time.Time
+}
+
+// LoadToolCacheEntry returns an unexpired entry. A missing database is treated
+// as a miss so the cache keeps working in memory only.
+func LoadToolCacheEntry(key string, now time.Time) (ToolCacheEntry, bool, error) {
+	entry := ToolCacheEntry{Key: key}
+	if db == nil {
+		return entry, false, nil
+	}
+	var storedAt, expiresAt int64
+	err := db.QueryRow(`
+		SELECT tool, user_id, value, stored_at, expires_at
+		FROM tool_result_cache
+		WHERE cache_key = ? AND expires_at > ?`, key, now.UnixNano()).Scan(
+		&entry.Tool,
+		&entry.UserID,
+		&entry.Value,
+		&storedAt,
+		&expiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, fmt.Errorf("failed to load tool cache entry: %w", err)
+	}
+	entry.StoredAt = time.Unix(0, storedAt)
+	entry.ExpiresAt = time.Unix(0, expiresAt)
+	return entry, true, nil
+}
+
+// SaveToolCacheEntry upserts an entry, then trims the table to maxEntries rows
+// and maxBytes of values, dropping expired and then oldest entries first.
+func SaveToolCacheEntry(entry ToolCacheEntry, maxEntries int, maxBytes int64) error {
+	if db == nil {
+		return nil
+	}
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin tool cache transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO tool_result_cache (cache_key, tool, user_id, value, size, stored_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(cache_key) DO UPDATE SET
+			tool = excluded.tool,
+			user_id = excluded.user_id,
+			value = excluded.value,
+			size = excluded.size,
+			stored_at = excluded.stored_at,
+			expires_at = excluded.expires_at`,
+		entry.Key, entry.Tool, strings.TrimSpace(entry.UserID), entry.Value, len(entry.Value),
+		entry.StoredAt.UnixNano(), entry.ExpiresAt.UnixNano(),
+	); err != nil {
+		return fmt.Errorf("failed to save tool cache entry: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM tool_result_cache WHERE expires_at <= ?`, entry.StoredAt.UnixNano()); err != nil {
+		return fmt.Errorf("failed to prune expired tool cache entries: %w", err)
+	}
+	if maxEntries > 0 {
+		if _, err := tx.Exec(`
+			DELETE FROM tool_result_cache
+			WHERE cache_key IN (
+				SELECT cache_key FROM tool_result_cache
+				ORDER BY stored_at DESC, cache_key
+				LIMIT -1 OFFSET ?
+			)`, maxEntries); err != nil {
+			return fmt.Errorf("failed to cap tool cache entries: %w", err)
+		}
+	}
+	if maxBytes > 0 {
+		if _, err := tx.Exec(`
+			DELETE FROM tool_result_cache
+			WHERE cache_key IN (
+				SELECT cache_key FROM (
+					SELECT cache_key, SUM(size) OVER (ORDER BY stored_at DESC, cache_key) AS running
+					FROM tool_result_cache
+				) WHERE running > ?
+			)`, maxBytes); err != nil {
+			return fmt.Errorf("failed to cap tool cache size: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit tool cache entry: %w", err)
+	}
+	return nil
+}
+
+// DeleteToolCacheEntriesForUser drops every private entry of one user.
+func DeleteToolCacheEntriesForUser(userID string) error {
+	userID = strings.TrimSpace(userID)
+	if db == nil || userID == "" {
+		return nil
+	}
+	if _, err := db.Exec(`DELETE FROM tool_result_cache WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to invalidate tool cache: %w", err)
+	}
+	return nil
+}
+
+func pruneExpiredToolCache(now time.Time) error {
+	if _, err := db.Exec(`DELETE FROM tool_result_cache WHERE expires_at <= ?`, now.UnixNano()); err != nil {
+		return fmt.Errorf("failed to prune tool cache: %w", err)
+	}
+	return nil
+}
+
+// ToolFetchCache memoizes the fetch stage of a tool call. The caller's context
+// decides whether and how a call is cached; see toolruntime.ResultCache.
+type ToolFetchCache func(ctx context.Context, fetch func() (string, error)) (string, error)
+
+var (
+	toolFetchCacheMu sync.RWMutex
+	toolFetchCache   ToolFetchCache
+)
+
+// SetToolFetchCache installs the cache used by cacheable built-in tools.
+func SetToolFetchCache(cache ToolFetchCache) {
+	toolFetchCacheMu.Lock()
+	defer toolFetchCacheMu.Unlock()
+	toolFetchCache = cache
+}
+
+// cachedToolFetch runs fetch through the installed cache. Only the part of a
+// tool that does not depend on the caller (network reads, not per-user
+// buffering) should be wrapped, unless the registry keys the call by user.
+func cachedToolFetch(ctx context.Context, fetch func() (string, error)) (string, error) {
+	toolFetchCacheMu.RLock()
+	cache := toolFetchCache
+	toolFetchCacheMu.RUnlock()
+	if cache == nil || ctx == nil {
+		return fetch()
+	}
+	return cache(ctx, fetch)
+}
+
+var (
+	memoryChangeHookMu sync.RWMutex
+	memoryChangeHook   func(userID string)
+)
+
+// SetMemoryChangeHook registers a callback that runs after any memory, saved
+// turn or profile fact of a user changes.
+func SetMemoryChangeHook(fn func(userID string)) {
+	memoryChangeHookMu.Lock()
+	defer memoryChangeHookMu.Unlock()
+	memoryChangeHook = fn
+}
+
+// notifyMemoryChanged lets the tool cache drop the user's private results so a
+// memory tool never answers from a snapshot taken before the change.
+func notifyMemoryChanged(userID string) {
+	memoryChangeHookMu.RLock()
+	hook := memoryChangeHook
+	memoryChangeHookMu.RUnlock()
+	if hook != nil {
+		hook(strings.TrimSpace(userID))
+	}
+}
@@ -187,12 +187,24 @@ func buildMemoryCandidates(userID, query string, limit int) ([]memoryCandidate,
 			candidateMap[candidate.MemoryID] = candidate
 		}
 	}
+	// Full-text matches that no chunk search returned form a third ranked
+	// list. Scoring them through the same fusion and boosts keeps them on
+	// the scale of the fused chunk scores.
+	var fullTextOnly []memoryCandidate
+	var fullTextRanking []retrievalCandidate
 	for _, memory := range fullResults {
+		if existing, ok := candidateMap[memory.ID]; ok {
+			if existing.Snippet == "" {
+				existing.Snippet = memory.FullText
+			}
+			candidateMap[memory.ID] = existing
+			continue
+		}
 		memoryType := strings.TrimSpace(memory.MemoryType)
 		if memoryType == "" {
 			memoryType = "raw_interaction"
 		}
-		candidate := memoryCandidate{
+		fullTextOnly = append(fullTextOnly, memoryCandidate{
 			MemoryID:    memory.ID,
 			BaseID:      memory.ID,
 			SourceType:  "memory",
@@ -201,15 +213,18 @@ func buildMemoryCandidates(userID, query string, limit int) ([]memoryCandidate,
 			Snippet:     memory.FullText,
 			MatchReason: "full text match",
 			ChunkIndex:  -1,
-			HybridScore: float64(memory.HitCount) * 0.01,
-		}
-		if existing, ok := candidateMap[candidate.MemoryID]; ok {
-			if existing.Snippet == "" {
-				existing.Snippet = candidate.Snippet
-			}
-			candidateMap[candidate.MemoryID] = existing
-			continue
-		}
+		})
+		fullTextRanking = append(fullTextRanking, retrievalCandidate{
+			FTSRank:   len(fullTextRanking) + 1,
+			CreatedAt: memory.CreatedAt,
+			HitCount:  memory.HitCount,
+			Text:      memory.FullText,
+		})
+	}
+	order, scores := rankRetrievalCandidates(trimmed, fullTextRanking, getRetrievalConfigForUser(userID), len(fullTextRanking), time.Now())
+	for i, index := range order {
+		candidate := fullTextOnly[index]
+		candidate.HybridScore = scores[i]
 		candidateMap[candidate.MemoryID] = candidate
 	}
 	for _, match := range savedTurnChunkResults {
@@ -0,0 +1,502 @@
+package mcp
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunk tables with a vector index. Each user, embedding model and dimension
+// gets its own graph.
+const (
+	vectorIndexMemory    = "memory"
+	vectorIndexSavedTurn = "saved_turn"
+	vectorIndexWeb       = "web"
+)
+
+const (
+	vectorIndexFileVersion  = 2
+	embeddingStorageVersion = "float32-blob-v1"
+)
+
+var vectorIndexTables = map[string]struct {
+	embeddings string
+	chunks     string
+}{
+	vectorIndexMemory:    {embeddings: "memory_chunk_embeddings", chunks: "memory_chunks"},
+	vectorIndexSavedTurn: {embeddings: "saved_turn_chunk_embeddings", chunks: "saved_turn_chunks"},
+	vectorIndexWeb:       {embeddings: "web_chunk_embeddings", chunks: "web_source_chunks"},
+}
+
+type vectorIndexKey struct {
+	kind   string
+	userID string
+	model  string
+	dim    int
+}
+
+type chunkVectorIndex struct {
+	mu    sync.RWMutex
+	graph *hnswGraph
+	dirty bool
+}
+
+// vectorTableMark summarizes the embedding rows behind one index. Edits
+// and re-chunks can keep the row count but always move the highest chunk
+// id or update time, so a persisted graph is fresh only while all three
+// still match.
+type vectorTableMark struct {
+	Count        int
+	MaxChunkID   int64
+	MaxUpdatedAt string
+}
+
+type vectorIndexFile struct {
+	Version int
+	Kind    string
+	UserID  string
+	Model   string
+	Mark    vectorTableMark
+	Graph   *hnswGraph
+}
+
+var (
+	vectorIndexMu  sync.Mutex
+	vectorIndexes  = map[vectorIndexKey]*chunkVectorIndex{}
+	vectorIndexDir string
+)
+
+// encodeEmbeddingBlob packs a vector as little-endian float32 values.
+func encodeEmbeddingBlob(vector []float64) []byte {
+	blob := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(blob[4*i:], math.Float32bits(float32(value)))
+	}
+	return blob
+}
+
+func decodeEmbeddingBlob(blob []byte) ([]float32, error) {
+	if len(blob) == 0 || len(blob)%4 != 0 {
+		return nil, fmt.Errorf("invalid embedding blob length %d", len(blob))
+	}
+	vector := make([]float32, len(blob)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:]))
+	}
+	return vector, nil
+}
+
+// decodeStoredEmbedding reads the blob column and falls back to the JSON
+// column written before embeddings were packed.
+func decodeStoredEmbedding(blob []byte, embeddingJSON string) ([]float32, error) {
+	if len(blob) > 0 {
+		return decodeEmbeddingBlob(blob)
+	}
+	vector, err := parseBufferedEmbeddingJSON(embeddingJSON)
+	if err != nil {
+		return nil, err
+	}
+	return toFloat32Vector(vector), nil
+}
+
+func toFloat32Vector(vector []float64) []float32 {
+	converted := make([]float32, len(vector))
+	for i, value := range vector {
+		converted[i] = float32(value)
+	}
+	return converted
+}
+
+// upsertChunkEmbeddingTx stores the packed embedding of a chunk and mirrors
+// it into the loaded vector index.
+func upsertChunkEmbeddingTx(tx *sql.Tx, kind, userID string, chunkID int64, vector []float64, modelName string) error {
+	table := vectorIndexTables[kind].embeddings
+	if _, err := tx.Exec(fmt.Sprintf(`
+		INSERT INTO %s (
+			chunk_id, embedding_model, embedding_dim, embedding_blob, embedding_json, updated_at
+		) VALUES (?, ?, ?, ?, '', ?)
+		ON CONFLICT(chunk_id) DO UPDATE SET
+			embedding_model = excluded.embedding_model,
+			embedding_dim = excluded.embedding_dim,
+			embedding_blob = excluded.embedding_blob,
+			embedding_json = '',
+			updated_at = excluded.updated_at
+	`, table), chunkID, modelName, len(vector), encodeEmbeddingBlob(vector), time.Now().UTC()); err != nil {
+		return err
+	}
+	noteChunkVector(vectorIndexKey{kind: kind, userID: userID, model: modelName, dim: len(vector)}, chunkID, toFloat32Vector(vector))
+	return nil
+}
+
+func noteChunkVector(key vectorIndexKey, chunkID int64, vector []float32) {
+	forgetChunkVectors(key.kind, []int64{chunkID})
+	vectorIndexMu.Lock()
+	index := vectorIndexes[key]
+	vectorIndexMu.Unlock()
+	if index == nil {
+		return
+	}
+	index.mu.Lock()
+	index.graph.Add(chunkID, vector)
+	index.dirty = true
+	index.mu.Unlock()
+}
+
+// forgetChunkVectors removes deleted chunks from every loaded index of kind.
+// Chunk ids are unique per table, so the owner does not need to be known.
+func forgetChunkVectors(kind string, chunkIDs []int64) {
+	if len(chunkIDs) == 0 {
+		return
+	}
+	vectorIndexMu.Lock()
+	var indexes []*chunkVectorIndex
+	for key, index := range vectorIndexes {
+		if key.kind == kind {
+			indexes = append(indexes, index)
+		}
+	}
+	vectorIndexMu.Unlock()
+	for _, index := range indexes {
+		index.mu.Lock()
+		for _, chunkID := range chunkIDs {
+			if index.graph.Remove(chunkID) {
+				index.dirty = true
+			}
+		}
+		index.mu.Unlock()
+	}
+}
+
+// searchChunkVectorIndex returns the chunks of kind most similar to query.
+// A loaded index is rebuilt when its size no longer matches the table, which
+// repairs updates lost to rolled-back transactions; a persisted one also
+// when the table changed after it was saved.
+func searchChunkVectorIndex(kind, userID, model string, query []float64, k int, accept map[int64]bool) ([]vectorHit, error) {
+	key := vectorIndexKey{kind: kind, userID: userID, model: model, dim: len(query)}
+	index, err := loadChunkVectorIndex(key)
+	if err != nil {
+		return nil, err
+	}
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	var hits []vectorHit
+	for _, hit := range index.graph.Search(toFloat32Vector(query), k, accept) {
+		if hit.Score > 0 {
+			hits = append(hits, hit)
+		}
+	}
+	return hits, nil
+}
+
+func loadChunkVectorIndex(key vectorIndexKey) (*chunkVectorIndex, error) {
+	mark, err := markChunkVectors(key)
+	if err != nil {
+		return nil, err
+	}
+	vectorIndexMu.Lock()
+	index := vectorIndexes[key]
+	vectorIndexMu.Unlock()
+	if index != nil {
+		index.mu.RLock()
+		size := index.graph.Len()
+		index.mu.RUnlock()
+		if size == mark.Count {
+			return index, nil
+		}
+	}
+
+	graph, storedMark, err := readVectorIndexFile(key)
+	dirty := false
+	if err != nil || storedMark != mark || graph.Len() != mark.Count {
+		if graph, err = buildChunkVectorGraph(key); err != nil {
+			return nil, err
+		}
+		dirty = true
+	}
+	index = &chunkVectorIndex{graph: graph, dirty: dirty}
+	if dirty {
+		if err := saveChunkVectorIndex(key, index); err != nil {
+			log.Printf("[DB] Failed to persist %s vector index: %v", key.kind, err)
+		}
+	}
+	vectorIndexMu.Lock()
+	vectorIndexes[key] = index
+	vectorIndexMu.Unlock()
+	return index, nil
+}
+
+func markChunkVectors(key vectorIndexKey) (vectorTableMark, error) {
+	if db == nil {
+		return vectorTableMark{}, fmt.Errorf("database not initialized")
+	}
+	tables := vectorIndexTables[key.kind]
+	var mark vectorTableMark
+	err := db.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*), COALESCE(MAX(e.chunk_id), 0), COALESCE(CAST(MAX(e.updated_at) AS TEXT), '')
+		FROM %s e
+		JOIN %s c ON c.id = e.chunk_id
+		WHERE c.user_id = ?
+		  AND e.embedding_dim = ?
+		  AND (e.embedding_model = ? OR e.embedding_model = '')
+	`, tables.embeddings, tables.chunks), key.userID, key.dim, key.model).Scan(&mark.Count, &mark.MaxChunkID, &mark.MaxUpdatedAt)
+	if err != nil {
+		return vectorTableMark{}, fmt.Errorf("failed to count %s vectors: %w", key.kind, err)
+	}
+	return mark, nil
+}
+
+func buildChunkVectorGraph(key vectorIndexKey) (*hnswGraph, error) {
+	tables := vectorIndexTables[key.kind]
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT e.chunk_id, e.embedding_blob, e.embedding_json
+		FROM %s e
+		JOIN %s c ON c.id = e.chunk_id
+		WHERE c.user_id = ?
+		  AND e.embedding_dim = ?
+		  AND (e.embedding_model = ? OR e.embedding_model = '')
+		ORDER BY e.chunk_id ASC
+	`, tables.embeddings, tables.chunks), key.userID, key.dim, key.model)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s vectors: %w", key.kind, err)
+	}
+	defer rows.Close()
+
+	graph := newHNSWGraph(key.dim)
+	for rows.Next() {
+		var chunkID int64
+		var blob []byte
+		var embeddingJSON string
+		if err := rows.Scan(&chunkID, &blob, &embeddingJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan %s vector: %w", key.kind, err)
+		}
+		vector, err := decodeStoredEmbedding(blob, embeddingJSON)
+		if err != nil || len(vector) != key.dim {
+			// Keep the count in step with the table; the zero vector
+			// never scores above zero.
+			vector = make([]float32, key.dim)
+		}
+		graph.Add(chunkID, vector)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate %s vectors: %w", key.kind, err)
+	}
+	return graph, nil
+}
+
+func vectorIndexPath(key vectorIndexKey) string {
+	if vectorIndexDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", key.userID, key.model, key.dim)))
+	return filepath.Join(vectorIndexDir, fmt.Sprintf("%s-%s.hnsw", key.kind, hex.EncodeToString(sum[:8])))
+}
+
+func readVectorIndexFile(key vectorIndexKey) (*hnswGraph, vectorTableMark, error) {
+	path := vectorIndexPath(key)
+	if path == "" {
+		return nil, vectorTableMark{}, os.ErrNotExist
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, vectorTableMark{}, err
+	}
+	defer file.Close()
+
+	var stored vectorIndexFile
+	if err := gob.NewDecoder(file).Decode(&stored); err != nil {
+		return nil, vectorTableMark{}, err
+	}
+	if stored.Version != vectorIndexFileVersion || stored.Kind != key.kind || stored.UserID != key.userID ||
+		stored.Model != key.model || stored.Graph == nil || stored.Graph.Dim != key.dim {
+		return nil, vectorTableMark{}, fmt.Errorf("vector index %s does not match", path)
+	}
+	stored.Graph.reindex()
+	return stored.Graph, stored.Mark, nil
+}
+
+func saveChunkVectorIndex(key vectorIndexKey, index *chunkVectorIndex) error {
+	path := vectorIndexPath(key)
+	if path == "" {
+		return nil
+	}
+	// Read the mark before locking the index: writers hold the only database
+	// connection while they update the graph. A write that lands in between
+	// leaves a mark the next load no longer matches, which only costs a rebuild.
+	mark, err := markChunkVectors(key)
+	if err != nil {
+		return err
+	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if index.graph.Len() != mark.Count {
+		// The graph holds vectors of an uncommitted or rolled-back write;
+		// the next load rebuilds it from the table instead.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), ".hnsw-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	stored := vectorIndexFile{
+		Version: vectorIndexFileVersion,
+		Kind:    key.kind,
+		UserID:  key.userID,
+		Model:   key.model,
+		Mark:    mark,
+		Graph:   index.graph,
+	}
+	if err := gob.NewEncoder(temp).Encode(&stored); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+	index.dirty = false
+	return nil
+}
+
+// resetVectorIndexes persists changed indexes and forgets all of them. It
+// runs when the database is opened or closed.
+func resetVectorIndexes(dir string) {
+	vectorIndexMu.Lock()
+	indexes := vectorIndexes
+	vectorIndexes = map[vectorIndexKey]*chunkVectorIndex{}
+	vectorIndexMu.Unlock()
+	for key, index := range indexes {
+		if !index.dirty {
+			continue
+		}
+		if err := saveChunkVectorIndex(key, index); err != nil {
+			log.Printf("[DB] Failed to persist %s vector index: %v", key.kind, err)
+		}
+	}
+	vectorIndexDir = dir
+}
+
+// ensureEmbeddingStorageVersion packs embeddings still stored as JSON into
+// float32 blobs once per database.
+func ensureEmbeddingStorageVersion() error {
+	var version string
+	err := db.QueryRow(`SELECT value FROM app_meta WHERE key = 'embedding_storage_version'`).Scan(&version)
+	switch {
+	case err == nil && version == embeddingStorageVersion:
+		return nil
+	case err != nil && err != sql.ErrNoRows:
+		return fmt.Errorf("failed to inspect embedding storage version: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin embedding migration: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	packed := 0
+	for _, kind := range []string{vectorIndexMemory, vectorIndexSavedTurn, vectorIndexWeb} {
+		var count int
+		if count, err = packJSONEmbeddingsTx(tx, vectorIndexTables[kind].embeddings); err != nil {
+			return err
+		}
+		packed += count
+	}
+	if _, err = tx.Exec(`
+		INSERT INTO app_meta(key, value)
+		VALUES('embedding_storage_version', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, embeddingStorageVersion); err != nil {
+		return fmt.Errorf("failed to persist embedding storage version: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit embedding migration: %w", err)
+	}
+	if packed > 0 {
+		log.Printf("[DB] Packed %d JSON embeddings into float32 blobs", packed)
+	}
+	return nil
+}
+
+func packJSONEmbeddingsTx(tx *sql.Tx, table string) (int, error) {
+	rows, err := tx.Query(fmt.Sprintf(`
+		SELECT chunk_id, embedding_json
+		FROM %s
+		WHERE embedding_blob IS NULL AND embedding_json != ''
+	`, table))
+	if err != nil {
+		return 0, fmt.Errorf("failed to query %s for packing: %w", table, err)
+	}
+	type row struct {
+		chunkID int64
+		blob    []byte
+	}
+	var items []row
+	for rows.Next() {
+		var chunkID int64
+		var embeddingJSON string
+		if err := rows.Scan(&chunkID, &embeddingJSON); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan %s for packing: %w", table, err)
+		}
+		var vector []float64
+		if json.Unmarshal([]byte(strings.TrimSpace(embeddingJSON)), &vector) != nil || len(vector) == 0 {
+			continue
+		}
+		items = append(items, row{chunkID: chunkID, blob: encodeEmbeddingBlob(vector)})
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("failed to iterate %s for packing: %w", table, err)
+	}
+	rows.Close()
+
+	for _, item := range items {
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET embedding_blob = ?, embedding_json = '' WHERE chunk_id = ?`, table), item.blob, item.chunkID); err != nil {
+			return 0, fmt.Errorf("failed to pack %s row %d: %w", table, item.chunkID, err)
+		}
+	}
+	return len(items), nil
+}
+
+// sqlInt64Placeholders returns "?, ?, ..." and the matching arguments.
+func sqlInt64Placeholders(values []int64) (string, []interface{}) {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", "), args
+}
+
+func vectorHitScores(hits []vectorHit) (map[int64]float64, []int64) {
+	scores := make(map[int64]float64, len(hits))
+	ids := make([]int64, 0, len(hits))
+	for _, hit := range hits {
+		scores[hit.ID] = hit.Score
+		ids = append(ids, hit.ID)
+	}
+	return scores, ids
+}
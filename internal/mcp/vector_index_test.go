@@ -0,0 +1,298 @@
+package mcp
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func randomUnitVector(rng *rand.Rand, dim int) []float32 {
+	vector := make([]float32, dim)
+	var norm float64
+	for i := range vector {
+		value := rng.NormFloat64()
+		vector[i] = float32(value)
+		norm += value * value
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector
+}
+
+// hnswRecall is the share of the exact top k that Search also returns.
+func hnswRecall(t *testing.T, graph *hnswGraph, queries [][]float32, k int, accept map[int64]bool) float64 {
+	t.Helper()
+	found, total := 0, 0
+	for _, query := range queries {
+		want := map[int64]bool{}
+		for _, hit := range graph.Exact(query, k, accept) {
+			want[hit.ID] = true
+		}
+		for _, hit := range graph.Search(query, k, accept) {
+			if accept != nil && !accept[hit.ID] {
+				t.Fatalf("Search returned %d outside the accept set", hit.ID)
+			}
+			if want[hit.ID] {
+				found++
+			}
+		}
+		total += len(want)
+	}
+	return float64(found) / float64(total)
+}
+
+func TestHNSWRecall(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	const dim, size, k = 48, 4000, 10
+	graph := newHNSWGraph(dim)
+	for id := int64(1); id <= size; id++ {
+		graph.Add(id, randomUnitVector(rng, dim))
+	}
+	queries := make([][]float32, 60)
+	for i := range queries {
+		queries[i] = randomUnitVector(rng, dim)
+	}
+
+	if recall := hnswRecall(t, graph, queries, k, nil); recall < 0.95 {
+		t.Fatalf("recall@%d = %.3f, want >= 0.95", k, recall)
+	}
+
+	accept := map[int64]bool{}
+	for id := int64(1); id <= size; id += 3 {
+		accept[id] = true
+	}
+	if recall := hnswRecall(t, graph, queries, k, accept); recall < 0.9 {
+		t.Fatalf("filtered recall@%d = %.3f, want >= 0.9", k, recall)
+	}
+
+	for id := int64(1); id <= size; id += 2 {
+		graph.Remove(id)
+	}
+	if graph.Len() != size/2 {
+		t.Fatalf("Len() = %d after removals, want %d", graph.Len(), size/2)
+	}
+	for _, query := range queries {
+		for _, hit := range graph.Search(query, k, nil) {
+			if hit.ID%2 == 1 {
+				t.Fatalf("removed vector %d was returned", hit.ID)
+			}
+		}
+	}
+	if recall := hnswRecall(t, graph, queries, k, nil); recall < 0.95 {
+		t.Fatalf("recall@%d after removals = %.3f, want >= 0.95", k, recall)
+	}
+
+	graph.Remove(2)
+	if len(graph.Nodes) != graph.Len() || graph.Has(2) || !graph.Has(4) {
+		t.Fatalf("graph was not compacted: %d nodes, %d live", len(graph.Nodes), graph.Len())
+	}
+	if recall := hnswRecall(t, graph, queries, k, nil); recall < 0.95 {
+		t.Fatalf("recall@%d after compaction = %.3f, want >= 0.95", k, recall)
+	}
+}
+
+func TestEmbeddingBlobRoundTrip(t *testing.T) {
+	vector := []float64{0.5, -0.25, 1, 0}
+	decoded, err := decodeEmbeddingBlob(encodeEmbeddingBlob(vector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range vector {
+		if float64(decoded[i]) != vector[i] {
+			t.Fatalf("decoded = %v, want %v", decoded, vector)
+		}
+	}
+	if _, err := decodeEmbeddingBlob([]byte{1, 2, 3}); err == nil {
+		t.Fatal("a truncated blob must not decode")
+	}
+	if legacy, err := decodeStoredEmbedding(nil, "[0.5,-0.25]"); err != nil || len(legacy) != 2 || legacy[1] != -0.25 {
+		t.Fatalf("legacy JSON = %v, %v", legacy, err)
+	}
+}
+
+func TestMemoryVectorSearchUsesIndex(t *testing.T) {
+	dir := t.TempDir()
+	if err := InitDB(filepath.Join(dir, "memory.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	for i := 0; i < 40; i++ {
+		if _, err := InsertMemory("alice", fmt.Sprintf("note %d about topic%d and shared words like garden tomato", i, i%7)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := InsertMemory("bob", "bob also grows a garden tomato"); err != nil {
+		t.Fatal(err)
+	}
+
+	compare := func(query string) []MemoryChunkMatch {
+		t.Helper()
+		indexed, err := searchMemoryChunkMatchesVector("alice", query, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vector, model := buildBufferedEmbedding(query, BufferedEmbeddingUsageQuery)
+		scanned, err := scanMemoryChunkMatchesVector("alice", vector, model, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(indexed) != len(scanned) {
+			t.Fatalf("indexed %d matches, scanned %d", len(indexed), len(scanned))
+		}
+		// Equal scores may be cut at the limit differently, so compare
+		// scores rather than chunk ids.
+		for i := range indexed {
+			if math.Abs(indexed[i].VectorScore-scanned[i].VectorScore) > 1e-6 || indexed[i].UserID != "alice" {
+				t.Fatalf("match %d: indexed %+v, scanned %+v", i, indexed[i], scanned[i])
+			}
+		}
+		return indexed
+	}
+
+	matches := compare("topic3 garden")
+	if len(matches) == 0 {
+		t.Fatal("no vector matches")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "vector-index", "memory-*.hnsw")); len(files) != 1 {
+		t.Fatalf("persisted index files = %v", files)
+	}
+
+	if err := DeleteMemory("alice", matches[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range compare("topic3 garden") {
+		if match.ID == matches[0].ID {
+			t.Fatal("deleted memory is still returned")
+		}
+	}
+	if _, err := InsertMemory("alice", "a brand new topic3 garden entry"); err != nil {
+		t.Fatal(err)
+	}
+	compare("topic3 garden")
+
+	// A reopened database loads the persisted index instead of rebuilding.
+	CloseDB()
+	if err := InitDB(filepath.Join(dir, "memory.db")); err != nil {
+		t.Fatal(err)
+	}
+	compare("topic5 tomato")
+}
+
+func TestPersistedVectorIndexDetectsSameSizeChanges(t *testing.T) {
+	dir := t.TempDir()
+	if err := InitDB(filepath.Join(dir, "memory.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	first, err := InsertMemory("alice", "the garden tomato harvest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InsertMemory("alice", "the orchard apple harvest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := searchMemoryChunkMatchesVector("alice", "garden harvest", 4); err != nil {
+		t.Fatal(err)
+	}
+	vectorIndexMu.Lock()
+	var key vectorIndexKey
+	for loaded := range vectorIndexes {
+		key = loaded
+	}
+	vectorIndexMu.Unlock()
+	if key.kind != vectorIndexMemory {
+		t.Fatalf("memory index was not loaded: %+v", key)
+	}
+
+	chunkIDs := func(memoryID int64) []int64 {
+		t.Helper()
+		rows, err := db.Query(`SELECT id FROM memory_chunks WHERE memory_id = ?`, memoryID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	removed := chunkIDs(first)
+	if err := DeleteMemory("alice", first); err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := InsertMemory("alice", "the garden pepper harvest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := chunkIDs(replacement)
+	if len(added) != len(removed) {
+		t.Skipf("chunk counts differ (%d vs %d); the row count would change", len(added), len(removed))
+	}
+
+	// Simulate a crash: the dirty in-memory graph is lost and the file on
+	// disk still describes the table before the edit, with the same size.
+	vectorIndexMu.Lock()
+	vectorIndexes = map[vectorIndexKey]*chunkVectorIndex{}
+	vectorIndexMu.Unlock()
+
+	index, err := loadChunkVectorIndex(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range removed {
+		if index.graph.Has(id) {
+			t.Errorf("stale chunk %d was reloaded from the persisted index", id)
+		}
+	}
+	for _, id := range added {
+		if !index.graph.Has(id) {
+			t.Errorf("new chunk %d is missing from the index", id)
+		}
+	}
+}
+
+func TestEmbeddingStorageMigrationPacksJSON(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "memory.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseDB)
+
+	id, err := InsertMemory("alice", "legacy garden notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunkID int64
+	if err := db.QueryRow(`SELECT id FROM memory_chunks WHERE memory_id = ?`, id).Scan(&chunkID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE memory_chunk_embeddings SET embedding_blob = NULL, embedding_json = '[0.6,0.8]' WHERE chunk_id = ?`, chunkID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM app_meta WHERE key = 'embedding_storage_version'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureEmbeddingStorageVersion(); err != nil {
+		t.Fatal(err)
+	}
+
+	var blob []byte
+	var embeddingJSON string
+	if err := db.QueryRow(`SELECT embedding_blob, embedding_json FROM memory_chunk_embeddings WHERE chunk_id = ?`, chunkID).Scan(&blob, &embeddingJSON); err != nil {
+		t.Fatal(err)
+	}
+	vector, err := decodeEmbeddingBlob(blob)
+	if err != nil || embeddingJSON != "" || len(vector) != 2 || vector[0] != 0.6 {
+		t.Fatalf("packed row = %v %q (%v)", vector, embeddingJSON, err)
+	}
+}
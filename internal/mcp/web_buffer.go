@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"math"
 	"net/url"
 	"sort"
@@ -817,7 +818,7 @@ func saveBufferedWebSourceDB(source *BufferedWebSource) error {
 		`, chunkID, buildFTSIndexedText(chunk.Text), source.SourceID, source.UserID, chunk.Index); err != nil {
 			return fmt.Errorf("failed to index web source chunk: %w", err)
 		}
-		if err := upsertBufferedChunkEmbeddingTx(tx, chunkID, chunk.Text); err != nil {
+		if err := upsertBufferedChunkEmbeddingTx(tx, source.UserID, chunkID, chunk.Text); err != nil {
 			return err
 		}
 	}
@@ -1227,13 +1228,11 @@ func hybridSearchBufferedChunksDB(userID, sourceID, query string, maxChunks int)
 	ftsQuery := buildBufferedFTSQuery(query)
 	ftsLimit := max(maxChunks*3, maxChunks)
 
-	ftsCandidates := make(map[int64]bufferedChunkCandidate)
+	var ftsCandidates []bufferedChunkCandidate
 	if ftsQuery != "" {
 		matches, err := searchBufferedChunksFTSDB(userID, sourceID, ftsQuery, ftsLimit)
 		if err == nil {
-			for _, match := range matches {
-				ftsCandidates[match.ID] = match
-			}
+			ftsCandidates = matches
 		}
 	}
 
@@ -1246,36 +1245,37 @@ func hybridSearchBufferedChunksDB(userID, sourceID, query string, maxChunks int)
 		return nil, "", fmt.Errorf("no buffered passages available")
 	}
 
-	merged := make(map[int64]bufferedChunkCandidate, len(ftsCandidates)+len(vectorCandidates))
-	for id, candidate := range ftsCandidates {
-		candidate.HybridScore = candidate.FTSScore
-		merged[id] = candidate
+	merged := make([]bufferedChunkCandidate, 0, len(ftsCandidates)+len(vectorCandidates))
+	candidates := make([]retrievalCandidate, 0, len(ftsCandidates)+len(vectorCandidates))
+	positions := make(map[int64]int, len(ftsCandidates)+len(vectorCandidates))
+	for rank, candidate := range ftsCandidates {
+		positions[candidate.ID] = len(merged)
+		merged = append(merged, candidate)
+		candidates = append(candidates, retrievalCandidate{FTSScore: candidate.FTSScore, FTSRank: rank + 1, Text: candidate.Text})
 	}
-	for _, candidate := range vectorCandidates {
-		existing, ok := merged[candidate.ID]
-		if ok {
-			existing.VectorScore = candidate.VectorScore
-			existing.HybridScore = (existing.FTSScore * 0.65) + (candidate.VectorScore * 0.35)
-			merged[candidate.ID] = existing
+	for rank, candidate := range vectorCandidates {
+		if position, ok := positions[candidate.ID]; ok {
+			merged[position].VectorScore = candidate.VectorScore
+			candidates[position].VectorScore = candidate.VectorScore
+			candidates[position].VectorRank = rank + 1
 			continue
 		}
-		candidate.HybridScore = candidate.VectorScore * 0.35
-		merged[candidate.ID] = candidate
+		positions[candidate.ID] = len(merged)
+		merged = append(merged, candidate)
+		candidates = append(candidates, retrievalCandidate{VectorScore: candidate.VectorScore, VectorRank: rank + 1, Text: candidate.Text})
 	}
 
-	ranked := make([]bufferedChunkCandidate, 0, len(merged))
-	for _, candidate := range merged {
+	// Web passages are fetched for the current turn, so recency and hit
+	// boosts do not apply and the reranker is reserved for memory search.
+	cfg := getRetrievalConfigForUser(userID)
+	cfg.RecencyBoost, cfg.HitCountBoost, cfg.DisableRerank = 0, 0, true
+	order, scores := rankRetrievalCandidates(query, candidates, cfg, maxChunks, time.Now())
+	ranked := make([]bufferedChunkCandidate, 0, len(order))
+	for i, position := range order {
+		candidate := merged[position]
+		candidate.HybridScore = scores[i]
 		ranked = append(ranked, candidate)
 	}
-	sort.SliceStable(ranked, func(i, j int) bool {
-		if math.Abs(ranked[i].HybridScore-ranked[j].HybridScore) < 1e-9 {
-			return ranked[i].Index < ranked[j].Index
-		}
-		return ranked[i].HybridScore > ranked[j].HybridScore
-	})
-	if len(ranked) > maxChunks {
-		ranked = ranked[:maxChunks]
-	}
 	sort.SliceStable(ranked, func(i, j int) bool {
 		return ranked[i].Index < ranked[j].Index
 	})
@@ -1296,7 +1296,54 @@ func searchBufferedChunksVectorDB(userID, sourceID, query string, maxChunks int)
 	}
 
 	rows, err := db.Query(`
-		SELECT c.id, c.chunk_index, c.chunk_text, e.embedding_json, e.embedding_model
+		SELECT id, chunk_index, chunk_text
+		FROM web_source_chunks
+		WHERE user_id = ?
+		  AND source_id = ?
+	`, userID, sourceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load buffered vector candidates: %w", err)
+	}
+	defer rows.Close()
+
+	chunks := map[int64]bufferedChunkCandidate{}
+	accept := map[int64]bool{}
+	for rows.Next() {
+		var candidate bufferedChunkCandidate
+		if err := rows.Scan(&candidate.ID, &candidate.Index, &candidate.Text); err != nil {
+			return nil, fmt.Errorf("failed to scan buffered vector candidate: %w", err)
+		}
+		chunks[candidate.ID] = candidate
+		accept[candidate.ID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate buffered vector candidates: %w", err)
+	}
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	rows.Close()
+
+	hits, err := searchChunkVectorIndex(vectorIndexWeb, userID, queryModel, queryVector, maxChunks, accept)
+	if err != nil {
+		log.Printf("[DB] Web chunk vector index unavailable, scanning: %v", err)
+		return scanBufferedChunksVectorDB(userID, sourceID, queryVector, queryModel, maxChunks)
+	}
+	ranked := make([]bufferedChunkCandidate, 0, len(hits))
+	for _, hit := range hits {
+		candidate := chunks[hit.ID]
+		candidate.VectorScore = hit.Score
+		ranked = append(ranked, candidate)
+	}
+	sortBufferedCandidatesByVector(ranked)
+	return ranked, nil
+}
+
+// scanBufferedChunksVectorDB scores every stored vector of a source. It
+// backs up the vector index when that cannot be loaded.
+func scanBufferedChunksVectorDB(userID, sourceID string, queryVector []float64, queryModel string, maxChunks int) ([]bufferedChunkCandidate, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.chunk_index, c.chunk_text, e.embedding_blob, e.embedding_json, e.embedding_model
 		FROM web_source_chunks c
 		JOIN web_chunk_embeddings e ON e.chunk_id = c.id
 		WHERE c.user_id = ?
@@ -1307,22 +1354,24 @@ func searchBufferedChunksVectorDB(userID, sourceID, query string, maxChunks int)
 	}
 	defer rows.Close()
 
+	query := toFloat32Vector(queryVector)
 	var ranked []bufferedChunkCandidate
 	for rows.Next() {
 		var candidate bufferedChunkCandidate
+		var embeddingBlob []byte
 		var embeddingJSON string
 		var embeddingModel string
-		if err := rows.Scan(&candidate.ID, &candidate.Index, &candidate.Text, &embeddingJSON, &embeddingModel); err != nil {
+		if err := rows.Scan(&candidate.ID, &candidate.Index, &candidate.Text, &embeddingBlob, &embeddingJSON, &embeddingModel); err != nil {
 			return nil, fmt.Errorf("failed to scan buffered vector candidate: %w", err)
 		}
 		if strings.TrimSpace(queryModel) != "" && strings.TrimSpace(embeddingModel) != "" && embeddingModel != queryModel {
 			continue
 		}
-		vector, err := parseBufferedEmbeddingJSON(embeddingJSON)
+		vector, err := decodeStoredEmbedding(embeddingBlob, embeddingJSON)
 		if err != nil {
 			continue
 		}
-		score := cosineSimilarity(queryVector, vector)
+		score := dotFloat32(query, vector)
 		if score <= 0 {
 			continue
 		}
@@ -1333,16 +1382,20 @@ func searchBufferedChunksVectorDB(userID, sourceID, query string, maxChunks int)
 		return nil, fmt.Errorf("failed to iterate buffered vector candidates: %w", err)
 	}
 
+	sortBufferedCandidatesByVector(ranked)
+	if len(ranked) > maxChunks {
+		ranked = ranked[:maxChunks]
+	}
+	return ranked, nil
+}
+
+func sortBufferedCandidatesByVector(ranked []bufferedChunkCandidate) {
 	sort.SliceStable(ranked, func(i, j int) bool {
 		if math.Abs(ranked[i].VectorScore-ranked[j].VectorScore) < 1e-9 {
 			return ranked[i].Index < ranked[j].Index
 		}
 		return ranked[i].VectorScore > ranked[j].VectorScore
 	})
-	if len(ranked) > maxChunks {
-		ranked = ranked[:maxChunks]
-	}
-	return ranked, nil
 }
 
 func buildBufferedFTSQuery(query string) string {
@@ -1378,7 +1431,7 @@ func normalizeFTSScore(bm25 float64) float64 {
 	return 1.0 / (1.0 + math.Abs(bm25))
 }
 
-func upsertBufferedChunkEmbeddingTx(tx *sql.Tx, chunkID int64, text string) error {
+func upsertBufferedChunkEmbeddingTx(tx *sql.Tx, userID string, chunkID int64, text string) error {
 	vector, modelName := buildBufferedEmbedding(text, BufferedEmbeddingUsageDocument)
 	if len(vector) == 0 {
 		return nil
@@ -1386,20 +1439,7 @@ func upsertBufferedChunkEmbeddingTx(tx *sql.Tx, chunkID int64, text string) erro
 	if strings.TrimSpace(modelName) == "" {
 		modelName = webEmbeddingModel
 	}
-	embeddingJSON, err := json.Marshal(vector)
-	if err != nil {
-		return fmt.Errorf("failed to marshal buffered embedding: %w", err)
-	}
-	if _, err := tx.Exec(`
-		INSERT INTO web_chunk_embeddings (
-			chunk_id, embedding_model, embedding_dim, embedding_json, updated_at
-		) VALUES (?, ?, ?, ?, ?)
-		ON CONFLICT(chunk_id) DO UPDATE SET
-			embedding_model = excluded.embedding_model,
-			embedding_dim = excluded.embedding_dim,
-			embedding_json = excluded.embedding_json,
-			updated_at = excluded.updated_at
-	`, chunkID, modelName, len(vector), string(embeddingJSON), time.Now().UTC()); err != nil {
+	if err := upsertChunkEmbeddingTx(tx, vectorIndexWeb, userID, chunkID, vector, modelName); err != nil {
 		return fmt.Errorf("failed to store buffered chunk embedding: %w", err)
 	}
 	return nil
@@ -1478,17 +1518,6 @@ func parseBufferedEmbeddingJSON(raw string) ([]float64, error) {
 	return vector, nil
 }
 
-func cosineSimilarity(a, b []float64) float64 {
-	if len(a) == 0 || len(a) != len(b) {
-		return 0
-	}
-	var dot float64
-	for i := range a {
-		dot += a[i] * b[i]
-	}
-	return dot
-}
-
 func pruneBufferedWebSourcesTx(tx *sql.Tx, userID string, keep int) error {
 	if keep <= 0 {
 		return nil
@@ -1558,6 +1587,7 @@ func deleteBufferedWebSourceTx(tx *sql.Tx, sourceID string) error {
 	if _, err := tx.Exec(`DELETE FROM web_source_chunks WHERE source_id = ?`, sourceID); err != nil {
 		return fmt.Errorf("failed to delete buffered chunks: %w", err)
 	}
+	forgetChunkVectors(vectorIndexWeb, chunkIDs)
 	if _, err := tx.Exec(`DELETE FROM web_sources WHERE source_id = ?`, sourceID); err != nil {
 		return fmt.Errorf("failed to delete buffered source: %w", err)
 	}
@@ -186,12 +186,15 @@ func TestClassifySearchResultQualityUsesDomainBoundaries(t *testing.T) {
 }
 
 func TestSearchCacheTTLReflectsFreshness(t *testing.T) {
-	if got := searchCacheTTLForQuery("오늘 날씨"); got != time.Minute {
+	if got := SearchCacheTTL("오늘 날씨", 10*time.Minute); got != time.Minute {
 		t.Fatalf("volatile query TTL = %s", got)
 	}
-	if got := searchCacheTTLForQuery("Go 공식 문서"); got != 30*time.Minute {
+	if got := SearchCacheTTL("Go 공식 문서", 10*time.Minute); got != 30*time.Minute {
 		t.Fatalf("stable query TTL = %s", got)
 	}
+	if got := SearchCacheTTL("golang generics", 10*time.Minute); got != 10*time.Minute {
+		t.Fatalf("neutral query TTL = %s", got)
+	}
 }
 
 func TestFormattedSearchResultsExposeProviderAndRetrievalTime(t *testing.T) {
@@ -0,0 +1,219 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/promptkit"
+)
+
+// Per-request tool budgets. Deep research and catalog smoke tests get the
+// larger web budgets.
+const (
+	webEvidenceToolBudget        = 4
+	webSearchProviderBudget      = 3
+	bufferedSourceReadBudget     = 2
+	deepWebEvidenceToolBudget    = 8
+	deepWebSearchProviderBudget  = 4
+	deepBufferedSourceReadBudget = 4
+)
+
+// toolBudget counts the tool calls of one request against the budgets.
+type toolBudget struct {
+	deep bool
+	bulk bool
+
+	usage      map[string]int
+	signatures map[string]int
+	families   map[string]int
+	// searches is the number of web search provider requests that ran.
+	searches int
+
+	webEvidenceLimit    int
+	searchProviderLimit int
+	sourceReadLimit     int
+}
+
+func newToolBudget(userText string) *toolBudget {
+	b := &toolBudget{
+		deep:                isDeepWebResearchRequest(userText),
+		bulk:                chatharness.IsBulkToolTestRequest(userText),
+		usage:               make(map[string]int),
+		signatures:          make(map[string]int),
+		families:            make(map[string]int),
+		webEvidenceLimit:    webEvidenceToolBudget,
+		searchProviderLimit: webSearchProviderBudget,
+		sourceReadLimit:     bufferedSourceReadBudget,
+	}
+	if b.deep || b.bulk {
+		b.webEvidenceLimit = deepWebEvidenceToolBudget
+		b.searchProviderLimit = deepWebSearchProviderBudget
+		b.sourceReadLimit = deepBufferedSourceReadBudget
+	}
+	if b.bulk {
+		// A complete catalog smoke test needs four provider tools, while
+		// search_web_multi consumes two provider slots by design.
+		b.searchProviderLimit = 6
+	}
+	return b
+}
+
+// chargeToolBudget records one call against the per-request budgets. When
+// the call must not run it returns the message to hand back to the model.
+func (r *ChatRound) chargeToolBudget(turn int, callID, name, args string) (string, int, bool, bool) {
+	b := r.budget
+	if !r.Events.ClaimToolCall(callID, name, args) {
+		r.trace("tool.skipped", "Skipped tool call whose call ID already ran in this request", map[string]interface{}{
+			"turn":    turn,
+			"tool":    name,
+			"call_id": callID,
+		})
+		return fmt.Sprintf("Tool call %s already ran in this answer. Do not repeat it; answer from its earlier result.", callID), 0, true, true
+	}
+	weight := 1
+	if name == "search_web_multi" {
+		// A batch contains exactly two provider requests. Charge both against
+		// the existing evidence/provider budgets so parallelism cannot bypass
+		// the safeguards used by sequential search_web calls.
+		weight = 2
+	}
+	b.usage[name] += weight
+	signature := name + ":" + compactText(strings.TrimSpace(args), 240)
+	b.signatures[signature]++
+	command, family := "", ""
+	if name == "execute_command" {
+		command = chatharness.ExtractExecuteCommandFromArgsJSON(args)
+		family = chatharness.ExecuteCommandBudgetFamily(command)
+		if family != "" {
+			b.families[family]++
+		}
+	}
+
+	skip := func(message, reason string, count int) (string, int, bool, bool) {
+		r.trace("tool.skipped", reason, map[string]interface{}{
+			"turn":  turn,
+			"tool":  name,
+			"count": count,
+		})
+		return message, weight, true, false
+	}
+	webEvidenceCalls := totalToolUsageFor(b.usage, isWebEvidenceTool)
+	searchProviderCalls := totalToolUsageFor(b.usage, isWebSearchProviderTool)
+	switch {
+	case isWebEvidenceTool(name) && webEvidenceCalls > b.webEvidenceLimit:
+		return skip(webEvidenceBudgetMessage(webEvidenceCalls-1), "Skipped web evidence tool due to combined per-request budget", webEvidenceCalls)
+	case isWebSearchProviderTool(name) && searchProviderCalls > b.searchProviderLimit:
+		return skip(fmt.Sprintf("Web search provider budget reached after %d searches. Do not search another provider in this answer. If the evidence already buffered is strong enough, answer from it. If it is weak, conflicting, or off-topic, say you could not verify the answer well enough and ask whether to continue with deeper research.", searchProviderCalls-1), "Skipped web search provider due to combined per-request budget", searchProviderCalls)
+	case name == "read_buffered_source" && b.usage[name] > b.sourceReadLimit:
+		return skip("read_buffered_source already ran multiple times in this answer. Stop reading more buffered excerpts. If the evidence already returned is strong enough, answer from it; otherwise say the evidence is insufficient and ask whether to continue with deeper research.", "Skipped repeated buffered source read due to per-request budget", b.usage[name])
+	case (name == "search_web" || name == "naver_search") && b.usage[name] > b.searchProviderLimit:
+		return skip(fmt.Sprintf("Tool budget reached for %s. Do not search again in this answer. If the evidence already buffered is strong enough, answer from it; otherwise say the evidence is insufficient and ask whether to continue with deeper research.", name), "Skipped repeated web search due to per-request budget", b.usage[name])
+	case name == "read_web_page" && b.usage[name] > 2:
+		return skip("read_web_page already ran multiple times in this answer. Avoid more page reads unless the user explicitly asks to retry. If buffered evidence is strong enough, answer from it; otherwise say the evidence is insufficient and ask whether to continue with deeper research.", "Skipped repeated page read due to per-request budget", b.usage[name])
+	case name == "execute_command" && b.usage[name] > 5:
+		return skip("execute_command already ran many times in this answer. Stop gathering more shell output and answer the user directly from the latest useful results.", "Skipped execute_command due to overall budget", b.usage[name])
+	case name == "execute_command" && family != "" && b.families[family] > 3:
+		r.trace("tool.skipped", "Skipped execute_command due to family budget", map[string]interface{}{
+			"turn":    turn,
+			"tool":    name,
+			"family":  family,
+			"command": compactText(command, 180),
+			"count":   b.families[family],
+		})
+		return fmt.Sprintf("Too many execute_command calls were used for the same task family (%s). Use the latest command results you already have and answer the user directly.", family), weight, true, false
+	case b.signatures[signature] > 1:
+		r.trace("tool.skipped", "Skipped duplicate tool call with same arguments", map[string]interface{}{
+			"turn":  turn,
+			"tool":  name,
+			"count": b.signatures[signature],
+		})
+		return fmt.Sprintf("Duplicate tool call prevented for %s with near-identical arguments. Use existing buffered evidence and continue answering.", name), weight, true, true
+	}
+	return "", weight, false, false
+}
+
+func isWebEvidenceTool(toolName string) bool {
+	switch strings.TrimSpace(toolName) {
+	case "search_web", "search_web_multi", "naver_search", "namu_wiki", "read_web_page", "read_buffered_source":
+		return true
+	default:
+		return false
+	}
+}
+
+func availableToolNames(tools []promptkit.ToolDefinition) []string {
+	names := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		if name := strings.TrimSpace(tool.Name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func completedToolNames(tools []promptkit.ToolDefinition, usage map[string]int) []string {
+	names := make([]string, 0, len(usage))
+	for _, name := range availableToolNames(tools) {
+		if usage[name] > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func isWebSearchProviderTool(toolName string) bool {
+	switch strings.TrimSpace(toolName) {
+	case "search_web", "search_web_multi", "naver_search", "namu_wiki":
+		return true
+	default:
+		return false
+	}
+}
+
+func totalToolUsageFor(tools map[string]int, predicate func(string) bool) int {
+	total := 0
+	for toolName, count := range tools {
+		if predicate(toolName) {
+			total += count
+		}
+	}
+	return total
+}
+
+func webEvidenceBudgetMessage(total int) string {
+	if total <= 0 {
+		total = webEvidenceToolBudget
+	}
+	return fmt.Sprintf("Web evidence budget reached after %d tool calls. Stop searching or reading more sources in this answer. If the evidence already returned is strong enough, answer from it. If it is weak, conflicting, or off-topic, say that you could not verify the answer well enough and ask whether to continue with deeper research.", total)
+}
+
+func isDeepWebResearchRequest(text string) bool {
+	normalized := strings.ToLower(strings.Join(strings.Fields(strings.TrimSpace(text)), " "))
+	if normalized == "" {
+		return false
+	}
+	deepSignals := []string{
+		"deep research",
+		"source comparison",
+		"compare sources",
+		"multiple sources",
+		"thorough research",
+		"dig deeper",
+		"깊게 조사",
+		"자세히 조사",
+		"철저히 조사",
+		"여러 출처",
+		"출처 비교",
+		"교차검증",
+		"교차 검증",
+		"검증해서",
+		"근거를 비교",
+	}
+	for _, signal := range deepSignals {
+		if strings.Contains(normalized, signal) {
+			return true
+		}
+	}
+	return false
+}
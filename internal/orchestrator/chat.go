@@ -0,0 +1,507 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/promptkit"
+)
+
+// bufferingThreshold bounds how much streamed text is held back while a
+// possible textual tool call is completed.
+const bufferingThreshold = 8000
+
+// ErrStreamAborted ends Run after the round already reported the failure to
+// the client on the stream.
+var ErrStreamAborted = errors.New("orchestrator: stream aborted")
+
+// TurnError is a round whose Transport failed before anything streamed.
+type TurnError struct {
+	Turn int
+	Err  error
+}
+
+func (e *TurnError) Error() string { return e.Err.Error() }
+
+func (e *TurnError) Unwrap() error { return e.Err }
+
+// ToolResult is one executed call. Err marks a failed call; its Result is
+// still handed back to the model.
+type ToolResult struct {
+	chatharness.ToolCallOutcome
+	Err     error
+	Elapsed time.Duration
+}
+
+// Tools runs the calls of one round and returns their results in call
+// order.
+type Tools interface {
+	Call(ctx context.Context, turn int, calls []chatharness.ProviderToolCall) []ToolResult
+}
+
+// ToolsFunc adapts a function to Tools.
+type ToolsFunc func(ctx context.Context, turn int, calls []chatharness.ProviderToolCall) []ToolResult
+
+func (f ToolsFunc) Call(ctx context.Context, turn int, calls []chatharness.ProviderToolCall) []ToolResult {
+	return f(ctx, turn, calls)
+}
+
+// Usage is a token count reported by the upstream.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+func (u *Usage) add(prompt, completion interface{}) {
+	if value, ok := prompt.(float64); ok {
+		u.PromptTokens += int(value)
+	}
+	if value, ok := completion.(float64); ok {
+		u.CompletionTokens += int(value)
+	}
+}
+
+func (u *Usage) set(prompt, completion interface{}) {
+	if value, ok := prompt.(float64); ok && value > 0 {
+		u.PromptTokens = int(value)
+	}
+	if value, ok := completion.(float64); ok && value > 0 {
+		u.CompletionTokens = int(value)
+	}
+}
+
+// TurnBudget is the number of rounds a request may use. A catalog smoke
+// test calls every tool once and gets more.
+func TurnBudget(userText string) int {
+	if chatharness.IsBulkToolTestRequest(userText) {
+		return 24
+	}
+	return DefaultMaxTurns
+}
+
+// ChatRound is the Round behind /api/chat and /v1/chat/completions. It
+// streams every round to the Sink, collects native and textual tool calls,
+// runs them through Tools under the per-request budgets, and decides what
+// follows: a tool result, a self-correction prompt for a malformed call, a
+// recovery from an answer left in the reasoning, or a structured-output
+// repair. Provider chunks are forwarded to Sink.Send as they arrive; app
+// events are recorded with Sink.Record.
+type ChatRound struct {
+	Sink Sink
+	// Tools runs gateway calls; nil leaves tool calls unhandled.
+	Tools Tools
+	// Passthrough reports native calls the gateway must not run, such as
+	// tools a client defined itself. A round with any such call ends the
+	// loop and leaves those calls in ToolCalls for the caller.
+	Passthrough func(name string) bool
+	// TextTools accepts calls written as markup in the answer, for models
+	// prompted with the tool catalog, and asks the model to correct
+	// malformed ones.
+	TextTools bool
+	// PromptTools is the gateway catalog offered to the model; ProviderTools
+	// are the native definitions re-sent with each follow-up.
+	PromptTools       []promptkit.ToolDefinition
+	ProviderTools     []interface{}
+	ParallelToolCalls bool
+	// Native marks a stream normalized by a provider adapter, whose calls
+	// arrive complete as tool_call.arguments events.
+	Native  bool
+	LLMMode string
+	ModelID string
+	// ReqMap is the decoded working request and Body its encoding; both
+	// follow every round.
+	ReqMap           map[string]interface{}
+	Body             []byte
+	OriginalUserText string
+	// RecentContext is the recent conversation, used to repair search
+	// arguments of contextual follow-ups.
+	RecentContext string
+	// MaxTurns must match the Engine's; zero means DefaultMaxTurns.
+	MaxTurns int
+	// Format is the requested response_format. With HoldAnswer set the
+	// answer is validated after each round and repaired when it does not
+	// match.
+	Format     *chatharness.ResponseFormat
+	HoldAnswer bool
+	// Events dedupes tool call IDs and round ends across the request.
+	Events  *chatharness.EventSequencer
+	TurnID  string
+	Started time.Time
+	// Transport is moved to RecoveryURL when a stateful request recovers an
+	// answer left in the reasoning over Chat Completions.
+	Transport   *HTTPTransport
+	RecoveryURL string
+	// Failover moves the request to another upstream after the first round
+	// failed before streaming and returns the model served there.
+	Failover func(err error) (model string, ok bool)
+	// OnResponseID follows the stored response used for
+	// previous_response_id, including when it is dropped.
+	OnResponseID func(id string)
+	// OnStatefulReset is called when a stale previous_response_id is
+	// dropped and the request retried without it.
+	OnStatefulReset func(reason string)
+	Trace           func(category, event, message string, fields map[string]interface{})
+
+	// Content is the answer so far and Reasoning the latest round's
+	// reasoning. ResponseID is the latest stored response.
+	Content    string
+	Reasoning  string
+	ResponseID string
+	// ToolCalls are the passthrough calls that ended the loop.
+	ToolCalls []chatharness.ProviderToolCall
+	// FinishReason is the upstream's stop reason for the last round, as
+	// sent (finish_reason or chat.end stop_reason).
+	FinishReason string
+	// Usage sums the token counts the upstream reported over all rounds;
+	// LastUsage holds the latest nonzero counts.
+	Usage     Usage
+	LastUsage Usage
+	// Sources are the web pages tool results cited, for the answer footer.
+	Sources []chatharness.WebEvidenceSource
+
+	// Request state.
+	generationStarted     bool
+	generationPhase       string
+	reasoningActive       bool
+	reasoningStartedAt    time.Time
+	reasoningMs           int64
+	needsCorrection       bool
+	badContent            string
+	previousResponseRetry bool
+	reasoningRecovered    bool
+	discardResponseID     bool
+	structuredRepairs     int
+	failed                bool
+	budget                *toolBudget
+
+	// Round state, reset by Begin.
+	turnStart          time.Time
+	callPending        bool
+	call               chatharness.ProviderToolCall
+	extraCalls         []chatharness.ProviderToolCall
+	savedBuffer        string
+	calls              *chatharness.ChatToolAccumulator
+	previousResponseID string
+	pendingNativeTool  string
+	nativeCommands     int
+	nativeFamilies     map[string]int
+	nativeLoop         string
+	runaway            string
+	toolFormat         string
+	toolRegex          *regexp.Regexp
+	partialTag         string
+	buffering          bool
+	buffer             string
+}
+
+func (r *ChatRound) Begin(ctx context.Context, turn int) {
+	if r.budget == nil {
+		r.budget = newToolBudget(r.OriginalUserText)
+		r.generationPhase = "queued"
+	}
+	r.Events.BeginRound()
+	r.turnStart = time.Now()
+	r.callPending = false
+	r.call = chatharness.ProviderToolCall{}
+	r.extraCalls = nil
+	r.savedBuffer = ""
+	r.calls = chatharness.NewChatToolAccumulator()
+	r.previousResponseID = r.ResponseID
+	r.pendingNativeTool = ""
+	r.nativeCommands = 0
+	r.nativeFamilies = make(map[string]int)
+	r.nativeLoop = ""
+	r.runaway = ""
+	r.Reasoning = ""
+	r.FinishReason = ""
+	r.toolFormat, r.toolRegex = "", nil
+	r.partialTag = ""
+	r.buffering = false
+	r.buffer = ""
+	r.trace("turn.start", "Dispatching upstream turn", map[string]interface{}{
+		"turn":       turn,
+		"model":      r.ModelID,
+		"body_bytes": len(r.Body),
+	})
+}
+
+func (r *ChatRound) Failed(ctx context.Context, turn int, err error) (Step, error) {
+	if turn == 0 && r.Failover != nil && ctx.Err() == nil {
+		// Nothing has streamed yet, so the same request can move to the
+		// next upstream serving the model.
+		if model, ok := r.Failover(err); ok {
+			r.ModelID = model
+			if r.ReqMap != nil {
+				r.ReqMap["model"] = model
+				// Stored responses live on the failed upstream.
+				delete(r.ReqMap, "previous_response_id")
+				r.remarshal()
+			}
+			if chatharness.ChainsResponses(r.LLMMode) {
+				r.setResponseID("")
+			}
+			// A failover does not consume a tool turn.
+			return Retry(r.Body), nil
+		}
+	}
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		r.trace("turn.error", "Upstream request failed", map[string]interface{}{
+			"turn":       turn,
+			"elapsed_ms": time.Since(r.turnStart).Milliseconds(),
+			"error":      err.Error(),
+		})
+		return Done(), &TurnError{Turn: turn, Err: err}
+	}
+	r.trace("turn.error", "Upstream returned an error status", map[string]interface{}{
+		"turn":        turn,
+		"status_code": statusErr.StatusCode,
+		"elapsed_ms":  time.Since(r.turnStart).Milliseconds(),
+		"error":       compactText(statusErr.Body, 180),
+	})
+	if chatharness.ChainsResponses(r.LLMMode) && !r.previousResponseRetry && chatharness.IsUnknownPreviousResponseError(statusErr.Body) {
+		r.previousResponseRetry = true
+		r.discardResponseID = false
+		r.setResponseID("")
+		r.Sink.Record("system", "stateful.reset", map[string]interface{}{
+			"reason": "invalid_previous_response_id",
+		})
+		if r.OnStatefulReset != nil {
+			r.OnStatefulReset("invalid_previous_response_id")
+		}
+		if r.ReqMap != nil {
+			delete(r.ReqMap, "previous_response_id")
+			r.remarshal()
+		}
+		r.trace("stateful.reset", "Retrying request without invalid previous_response_id", map[string]interface{}{
+			"turn": turn,
+		})
+		return Next(r.Body), nil
+	}
+	return Done(), &TurnError{Turn: turn, Err: err}
+}
+
+// Complete finishes the answer after Run: it harvests an answer the model
+// left in its reasoning, drops a leaked tool wrapper and cites the web
+// sources the answer relied on.
+func (r *ChatRound) Complete() string {
+	if strings.TrimSpace(r.Content) == "" && strings.TrimSpace(r.Reasoning) != "" {
+		if harvested, ok := chatharness.HarvestFinalAnswerFromReasoning(r.Reasoning); ok {
+			r.trace("final_answer.harvested_post_loop", "Harvested final answer from reasoning after turn loop ended", map[string]interface{}{
+				"harvested_chars": len([]rune(harvested)),
+			})
+			r.replaceAnswer(harvested)
+		}
+	}
+	if cleaned, stripped := stripLeadingPromptToolArtifacts(r.Content, r.PromptTools); stripped {
+		r.trace("tool.final_quarantine", "Removed leaked textual tool wrapper from the final assistant answer", map[string]interface{}{
+			"before_chars": len([]rune(r.Content)),
+			"after_chars":  len([]rune(cleaned)),
+		})
+		r.Content = cleaned
+	}
+	r.Content = chatharness.AppendMissingWebEvidenceSources(r.Content, r.OriginalUserText, r.Sources)
+	return r.Content
+}
+
+// MalformedToolCall is the text of a tool call that was still malformed
+// when the turn budget or the self-correction retries ran out.
+func (r *ChatRound) MalformedToolCall() string {
+	if !r.TextTools || !r.needsCorrection {
+		return ""
+	}
+	return r.badContent
+}
+
+// StructuredRepairs is the number of response_format repairs requested.
+func (r *ChatRound) StructuredRepairs() int {
+	return r.structuredRepairs
+}
+
+func (r *ChatRound) maxTurns() int {
+	if r.MaxTurns <= 0 {
+		return DefaultMaxTurns
+	}
+	return r.MaxTurns
+}
+
+// nativeCalls reports whether native tool calls are collected at all.
+func (r *ChatRound) nativeCalls() bool {
+	return r.Tools != nil || r.Passthrough != nil
+}
+
+func (r *ChatRound) trace(event, message string, fields map[string]interface{}) {
+	if r.Trace != nil {
+		r.Trace("chat", event, message, fields)
+	}
+}
+
+func (r *ChatRound) elapsedMs() int64 {
+	return time.Since(r.Started).Milliseconds()
+}
+
+func (r *ChatRound) remarshal() {
+	if body, err := json.Marshal(r.ReqMap); err == nil {
+		r.Body = body
+	}
+}
+
+func (r *ChatRound) setResponseID(id string) {
+	r.ResponseID = id
+	if r.OnResponseID != nil {
+		r.OnResponseID(id)
+	}
+}
+
+// generationEvent records a generation.* progress event for the session.
+func (r *ChatRound) generationEvent(eventType string, payload map[string]interface{}) {
+	payload["type"] = eventType
+	r.Sink.Record("system", eventType, payload)
+}
+
+func (r *ChatRound) enterPhase(phase string) {
+	if !r.generationStarted {
+		r.generationStarted = true
+		r.generationEvent("generation.first_token", map[string]interface{}{"phase": phase})
+	}
+	if r.generationPhase != phase {
+		r.generationPhase = phase
+		r.generationEvent("generation.phase", map[string]interface{}{"phase": phase})
+	}
+}
+
+// sendContent forwards content to the client as a Chat Completions delta.
+func (r *ChatRound) sendContent(content string) {
+	payload := map[string]interface{}{
+		"choices": []interface{}{
+			map[string]interface{}{
+				"delta": map[string]string{
+					"content": content,
+				},
+			},
+		},
+	}
+	if data, err := json.Marshal(payload); err == nil {
+		r.Sink.Send("data: " + string(data))
+	}
+}
+
+// answer appends content produced by the gateway rather than streamed, such
+// as a flushed buffer, and forwards it.
+func (r *ChatRound) answer(content string) {
+	if strings.TrimSpace(content) == "" {
+		return
+	}
+	r.enterPhase("answering")
+	r.Content += content
+	r.Sink.Record("assistant", "message.delta", map[string]interface{}{
+		"type":         "message.delta",
+		"content":      content,
+		"full_content": r.Content,
+	})
+	r.sendContent(content)
+}
+
+// replaceAnswer sets the answer to content recovered after the stream.
+func (r *ChatRound) replaceAnswer(content string) {
+	r.Content = content
+	r.sendContent(content)
+	r.Sink.Record("assistant", "message.delta", map[string]interface{}{
+		"type":         "message.delta",
+		"content":      content,
+		"full_content": r.Content,
+	})
+}
+
+func (r *ChatRound) startReasoning() {
+	if !r.reasoningActive {
+		r.reasoningActive = true
+		r.reasoningStartedAt = time.Now()
+	}
+}
+
+// endReasoning closes an open reasoning block before the answer starts.
+func (r *ChatRound) endReasoning() {
+	if !r.reasoningActive {
+		return
+	}
+	elapsed := time.Since(r.reasoningStartedAt).Milliseconds()
+	Emit(r.Sink, "assistant", map[string]interface{}{
+		"type":             "reasoning.end",
+		"elapsed_ms":       elapsed,
+		"total_elapsed_ms": r.elapsedMs(),
+	})
+	r.reasoningMs += elapsed
+	r.reasoningActive = false
+	r.reasoningStartedAt = time.Time{}
+}
+
+// reasoningDelta records reasoning text and reports a runaway loop.
+func (r *ChatRound) reasoningDelta(content string) bool {
+	if content == "" {
+		return false
+	}
+	r.Reasoning += content
+	if snippet, source, ok := detectReasoningRunawayRepetition(r.Reasoning); ok {
+		return r.stopRunaway(snippet, source)
+	}
+	return false
+}
+
+func (r *ChatRound) stopRunaway(snippet, source string) bool {
+	if strings.TrimSpace(snippet) == "" {
+		return false
+	}
+	r.runaway = fmt.Sprintf("LMSTUDIO_RUNAWAY_REPETITION: repetitive reasoning detected (%s)", source)
+	r.Sink.Record("assistant", "error", map[string]interface{}{
+		"type":             "error",
+		"error":            r.runaway,
+		"code":             "LMSTUDIO_RUNAWAY_REPETITION",
+		"phase":            "reasoning",
+		"snippet":          snippet,
+		"total_elapsed_ms": r.elapsedMs(),
+	})
+	if data, err := json.Marshal(map[string]interface{}{
+		"error":   r.runaway,
+		"code":    "LMSTUDIO_RUNAWAY_REPETITION",
+		"phase":   "reasoning",
+		"snippet": snippet,
+	}); err == nil {
+		r.Sink.Send("data: " + string(data))
+	}
+	r.trace("reasoning.loop", "Stopped stream due to repetitive reasoning", map[string]interface{}{
+		"snippet": compactText(snippet, 160),
+		"source":  source,
+	})
+	return true
+}
+
+// quarantine marks text that looked like a tool call but never parsed; it
+// is withheld from the client and, budget permitting, sent back to the
+// model for correction.
+func (r *ChatRound) quarantine(content string) {
+	r.needsCorrection = true
+	r.badContent = content
+}
+
+// acceptTextCall queues a call parsed from the answer text and announces it.
+func (r *ChatRound) acceptTextCall(name, argsJSON string, args interface{}, phase bool) {
+	r.callPending = true
+	r.call = chatharness.ProviderToolCall{Name: name, Arguments: argsJSON}
+	r.savedBuffer = r.Content
+	if phase {
+		r.generationPhase = "tool_call"
+		r.generationEvent("generation.phase", map[string]interface{}{"phase": r.generationPhase, "tool": name})
+	}
+	Emit(r.Sink, "assistant", map[string]interface{}{"type": "tool_call.start", "tool": name})
+	Emit(r.Sink, "assistant", map[string]interface{}{"type": "tool_call.arguments", "tool": name, "arguments": args})
+	r.buffer = ""
+	r.buffering = false
+}
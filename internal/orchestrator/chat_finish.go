@@ -0,0 +1,559 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/promptkit"
+)
+
+func (r *ChatRound) Finish(ctx context.Context, turn int) (Step, error) {
+	if r.failed {
+		r.endReasoning()
+		return Done(), nil
+	}
+	if r.LLMMode == chatharness.LLMModeResponses && r.ResponseID != r.previousResponseID {
+		// Everything sent so far is now stored with ResponseID; the next
+		// round only carries what the follow-up appends.
+		chatharness.ChainResponse(r.ReqMap, r.ResponseID)
+	}
+
+	if r.nativeCalls() && r.calls.HasCalls() {
+		calls := r.calls.Calls()
+		if passed := r.passthroughCalls(calls); len(passed) > 0 {
+			// The client continues the conversation with its own calls
+			// only, so gateway calls of the same round cannot run.
+			r.endReasoning()
+			r.skipGatewayCalls(turn, calls)
+			r.ToolCalls = passed
+			EmitToolCalls(r.Sink, passed)
+			return Done(), nil
+		}
+		if r.Tools != nil {
+			r.callPending = true
+			r.call = calls[0]
+			r.savedBuffer = r.Content
+			if len(calls) > 1 && r.ParallelToolCalls && r.LLMMode != "stateful" {
+				r.extraCalls = calls[1:]
+			} else {
+				calls = calls[:1]
+			}
+			EmitToolCalls(r.Sink, calls)
+			if count := len(r.calls.Calls()); count > 1 && len(r.extraCalls) == 0 {
+				r.trace("tool.multiple", "Provider returned multiple tool calls; executing the first because parallel tool calls were not requested", map[string]interface{}{
+					"turn":  turn,
+					"count": count,
+				})
+			}
+		}
+	}
+
+	if r.nativeLoop != "" {
+		r.trace("turn.complete", "Turn stopped due to native tool loop", map[string]interface{}{
+			"turn":           turn,
+			"elapsed_ms":     time.Since(r.turnStart).Milliseconds(),
+			"reason":         compactText(r.nativeLoop, 200),
+			"response_chars": len(r.Content),
+		})
+		return Done(), nil
+	}
+	if r.runaway != "" {
+		r.trace("turn.complete", "Turn stopped due to repetitive reasoning", map[string]interface{}{
+			"turn":           turn,
+			"elapsed_ms":     time.Since(r.turnStart).Milliseconds(),
+			"reason":         compactText(r.runaway, 200),
+			"response_chars": len(r.Content),
+		})
+		return Done(), nil
+	}
+
+	r.settleBuffer()
+	r.endReasoning()
+
+	if r.callPending && r.Tools != nil {
+		return r.runTools(ctx, turn)
+	}
+	if r.TextTools && r.needsCorrection && r.badContent != "" && turn < r.maxTurns()-1 {
+		if step, ok := r.selfCorrect(turn); ok {
+			return step, nil
+		}
+	}
+
+	if strings.TrimSpace(r.Content) == "" && strings.TrimSpace(r.Reasoning) != "" && !r.callPending {
+		if harvested, ok := chatharness.HarvestFinalAnswerFromReasoning(r.Reasoning); ok {
+			r.trace("final_answer.harvested", "Harvested complete final answer directly from reasoning output", map[string]interface{}{
+				"turn":            turn,
+				"harvested_chars": len([]rune(harvested)),
+			})
+			r.replaceAnswer(harvested)
+		}
+	}
+	if r.shouldRecoverReasoning(turn) {
+		if step, ok := r.recoverReasoning(turn); ok {
+			return step, nil
+		}
+	}
+	if r.HoldAnswer && r.Format != nil && r.structuredRepairs < chatharness.MaxStructuredOutputRepairs && turn < r.maxTurns()-1 {
+		if step, ok := r.repairStructuredAnswer(turn); ok {
+			return step, nil
+		}
+	}
+
+	r.trace("turn.complete", "Turn completed without additional tool recursion", map[string]interface{}{
+		"turn":           turn,
+		"elapsed_ms":     time.Since(r.turnStart).Milliseconds(),
+		"response_chars": len(r.Content),
+	})
+	return Done(), nil
+}
+
+func (r *ChatRound) passthroughCalls(calls []chatharness.ProviderToolCall) []chatharness.ProviderToolCall {
+	if r.Passthrough == nil {
+		return nil
+	}
+	var passed []chatharness.ProviderToolCall
+	for _, call := range calls {
+		if r.Passthrough(call.Name) {
+			passed = append(passed, call)
+		}
+	}
+	return passed
+}
+
+// skipGatewayCalls reports each gateway call of a round that also called
+// client tools with a tool_call.failure event, since its result could never
+// reach the model.
+func (r *ChatRound) skipGatewayCalls(turn int, calls []chatharness.ProviderToolCall) {
+	for _, call := range calls {
+		if r.Passthrough(call.Name) {
+			continue
+		}
+		reason := "not run: the same round called client tools, which end the request"
+		r.trace("tool.skipped", "Skipped gateway tool call mixed with client tool calls", map[string]interface{}{
+			"turn":    turn,
+			"tool":    call.Name,
+			"call_id": call.ID,
+		})
+		Emit(r.Sink, "assistant", map[string]interface{}{
+			"type":    "tool_call.failure",
+			"tool":    call.Name,
+			"call_id": call.ID,
+			"reason":  reason,
+		})
+	}
+}
+
+// settleBuffer decides what the stream left held back: a JSON wrapper the
+// model printed instead of a native call, a buffer to flush as answer
+// text, or markup to correct.
+func (r *ChatRound) settleBuffer() {
+	if r.TextTools && r.buffering {
+		if name, argsJSON, args, ok := chatharness.ParseJSONToolCall(r.buffer); ok {
+			if isRegisteredPromptTool(name, r.PromptTools) {
+				r.acceptTextCall(name, argsJSON, args, false)
+			} else {
+				r.quarantine(r.buffer)
+			}
+		}
+	}
+
+	if r.buffering && len(r.buffer) > 0 {
+		if recognized, _ := classifyPromptToolMarkup(r.buffer, r.PromptTools); recognized || looksLikeToolMarkup(r.buffer) {
+			r.needsCorrection = true
+			if r.badContent == "" {
+				r.badContent = r.buffer
+			}
+			r.trace("tool.quarantine", "Suppressed raw tool markup at stream end", map[string]interface{}{
+				"snippet": compactText(r.buffer, 220),
+			})
+		} else {
+			r.answer(r.buffer)
+			r.savedBuffer = r.buffer
+		}
+		r.buffer = ""
+	} else if r.partialTag != "" {
+		recognized, possible := classifyPromptToolMarkup(r.partialTag, r.PromptTools)
+		if r.TextTools && (recognized || possible || looksLikeJSONToolCallPossiblePrefix(r.partialTag) || looksLikeToolMarkup(r.partialTag)) {
+			r.needsCorrection = true
+			if r.badContent == "" {
+				r.badContent = r.partialTag
+			}
+			r.trace("tool.quarantine", "Suppressed incomplete streamed tool markup", map[string]interface{}{
+				"snippet": compactText(r.partialTag, 220),
+			})
+		} else {
+			r.answer(r.partialTag)
+			r.savedBuffer += r.partialTag
+		}
+		r.partialTag = ""
+	}
+}
+
+// runTools executes the round's calls under the budgets and prepares the
+// follow-up carrying their results.
+func (r *ChatRound) runTools(ctx context.Context, turn int) (Step, error) {
+	name, args := r.repairToolCall(turn, r.call.ID, r.call.Name, r.call.Arguments)
+	start := time.Now()
+	var (
+		result    string
+		err       error
+		duplicate bool
+		sources   int
+		outcomes  []chatharness.ToolCallOutcome
+	)
+	if len(r.extraCalls) == 0 {
+		skipResult, weight, skipped, dup := r.chargeToolBudget(turn, r.call.ID, name, args)
+		duplicate = dup
+		if skipped {
+			result = skipResult
+		} else {
+			results := r.Tools.Call(ctx, turn, []chatharness.ProviderToolCall{{ID: r.call.ID, Name: name, Arguments: args}})
+			if len(results) > 0 {
+				result, err = results[0].Result, results[0].Err
+			}
+			if isWebSearchProviderTool(name) {
+				r.budget.searches += weight
+			}
+		}
+		result, sources = r.recordToolResult(turn, name, r.call.ID, result, err, time.Since(start))
+	} else {
+		// Several native calls in one round: budgets and duplicate checks
+		// are charged in provider order, then Tools runs what is left as
+		// one batch.
+		pending := append([]chatharness.ProviderToolCall{{ID: r.call.ID, Name: name, Arguments: args}}, r.extraCalls...)
+		outcomes = make([]chatharness.ToolCallOutcome, len(pending))
+		errs := make([]error, len(pending))
+		elapsed := make([]time.Duration, len(pending))
+		batch := make([]chatharness.ProviderToolCall, 0, len(pending))
+		indexes := make([]int, 0, len(pending))
+		duplicate = true
+		for index, call := range pending {
+			callName, callArgs := call.Name, call.Arguments
+			if index > 0 {
+				callName, callArgs = r.repairToolCall(turn, call.ID, callName, callArgs)
+			}
+			outcomes[index] = chatharness.ToolCallOutcome{ID: call.ID, Name: callName, Arguments: callArgs}
+			skipResult, weight, skipped, dup := r.chargeToolBudget(turn, call.ID, callName, callArgs)
+			if !dup {
+				duplicate = false
+			}
+			if skipped {
+				outcomes[index].Result = skipResult
+				continue
+			}
+			if isWebSearchProviderTool(callName) {
+				r.budget.searches += weight
+			}
+			batch = append(batch, chatharness.ProviderToolCall{ID: call.ID, Name: callName, Arguments: callArgs})
+			indexes = append(indexes, index)
+		}
+		r.trace("tool.parallel", "Executing multiple tool calls from one model round", map[string]interface{}{
+			"turn":     turn,
+			"calls":    len(pending),
+			"executed": len(batch),
+		})
+		if len(batch) > 0 {
+			for batchIndex, batchResult := range r.Tools.Call(ctx, turn, batch) {
+				if batchIndex >= len(indexes) {
+					break
+				}
+				index := indexes[batchIndex]
+				outcomes[index].Result = batchResult.Result
+				errs[index] = batchResult.Err
+				elapsed[index] = batchResult.Elapsed
+			}
+		}
+		for index := range outcomes {
+			var count int
+			outcomes[index].Result, count = r.recordToolResult(turn, outcomes[index].Name, outcomes[index].ID, outcomes[index].Result, errs[index], elapsed[index])
+			sources += count
+		}
+		result = outcomes[0].Result
+		r.trace("tool.parallel_done", "Finished multi-call tool round", map[string]interface{}{
+			"turn":       turn,
+			"calls":      len(pending),
+			"elapsed_ms": time.Since(start).Milliseconds(),
+		})
+	}
+
+	if len(outcomes) == 0 && chatharness.ShouldFailClosedWebSearch(name, err, sources) {
+		r.Content = ""
+		r.answer(chatharness.BuildWebSearchFailureAnswer(r.OriginalUserText, err.Error()))
+		r.trace("web_search.fail_closed", "Stopped generation after web search returned no evidence", map[string]interface{}{
+			"turn":  turn,
+			"tool":  name,
+			"error": err.Error(),
+		})
+		return Done(), nil
+	}
+
+	b := r.budget
+	crossCheck := chatharness.IsFreshnessSensitiveWebRequest(r.OriginalUserText) &&
+		isWebSearchProviderTool(name) &&
+		b.searches < 2 &&
+		!duplicate &&
+		!b.deep &&
+		!b.bulk
+	finalOnly := chatharness.ShouldFinalizeAfterWebSearch(name, result, b.deep, b.bulk)
+	if crossCheck {
+		finalOnly = false
+	}
+	if isWebSearchProviderTool(name) && b.searches >= b.searchProviderLimit {
+		finalOnly = true
+	}
+	if duplicate {
+		finalOnly = true
+	}
+	refinement := !finalOnly && strings.Contains(strings.ToLower(result), "evidence quality warning: no_authoritative_or_reputable_source")
+	reqMap, body, err := chatharness.PrepareToolFollowupRequest(chatharness.ToolFollowupInput{
+		LLMMode:                    r.LLMMode,
+		ModelID:                    r.ModelID,
+		LastResponseID:             r.ResponseID,
+		ToolName:                   name,
+		ToolResult:                 result,
+		LastAssistantBuffer:        r.savedBuffer,
+		ReqMap:                     r.ReqMap,
+		ToolCallID:                 r.call.ID,
+		ToolArguments:              args,
+		OriginalUserText:           r.OriginalUserText,
+		CompletedTools:             completedToolNames(r.PromptTools, b.usage),
+		AvailableTools:             availableToolNames(r.PromptTools),
+		FinalAnswerOnly:            finalOnly,
+		RequireFreshnessCrossCheck: crossCheck,
+		SingleSearchRefinement:     refinement,
+		ProviderTools:              r.ProviderTools,
+		ParallelToolCalls:          r.ParallelToolCalls,
+		ToolCalls:                  outcomes,
+	})
+	if err != nil {
+		return Done(), fmt.Errorf("prepare tool follow-up: %w", err)
+	}
+	r.ReqMap, r.Body = reqMap, body
+	r.trace("turn.followup", "Prepared follow-up turn with tool result", map[string]interface{}{
+		"turn":                  turn,
+		"tool":                  name,
+		"body_bytes":            len(body),
+		"final_only":            finalOnly,
+		"freshness_cross_check": crossCheck,
+	})
+	return Next(body), nil
+}
+
+// repairToolCall normalizes one model-issued call against the current
+// request and reports recovered arguments to the client.
+func (r *ChatRound) repairToolCall(turn int, callID, name, args string) (string, string) {
+	raw := args
+	r.trace("tool.detected", "Tool call detected in assistant output", map[string]interface{}{
+		"turn": turn,
+		"tool": name,
+		"args": compactText(args, 200),
+	})
+	if repaired, ok := chatharness.RepairMissingReadWebPageArguments(name, args, r.OriginalUserText); ok {
+		args = repaired
+	}
+	if repaired, ok := chatharness.RepairMissingSearchToolArguments(name, args, r.OriginalUserText, r.RecentContext); ok {
+		args = repaired
+	}
+	if refined, ok := chatharness.RefineContextualFollowupSearchQuery(name, args, r.OriginalUserText, r.RecentContext); ok {
+		args = refined
+	}
+	if refined, ok := chatharness.RefineFamilySearchToolArguments(name, args, r.OriginalUserText); ok {
+		args = refined
+	}
+	if refined, ok := chatharness.RefineExactLookupToolArguments(name, args, r.OriginalUserText); ok {
+		args = refined
+	}
+	if upgradedName, upgradedArgs, ok := chatharness.UpgradeFreshnessSearchToolCall(name, args, r.OriginalUserText); ok {
+		name, args = upgradedName, upgradedArgs
+	}
+	if args != raw {
+		var decoded interface{}
+		_ = json.Unmarshal([]byte(args), &decoded)
+		event := map[string]interface{}{
+			"type":      "tool_call.arguments",
+			"tool":      name,
+			"arguments": decoded,
+			"recovered": true,
+		}
+		if callID != "" {
+			event["call_id"] = callID
+		}
+		Emit(r.Sink, "assistant", event)
+		r.trace("tool.arguments_repaired", "Normalized missing or malformed tool arguments against the current request", map[string]interface{}{
+			"turn": turn,
+			"tool": name,
+			"args": compactText(args, 240),
+		})
+	}
+	return name, args
+}
+
+// recordToolResult emits the success/failure event for one executed call
+// and returns the text handed back to the model with its evidence count.
+func (r *ChatRound) recordToolResult(turn int, name, callID, result string, err error, elapsed time.Duration) (string, int) {
+	event := map[string]interface{}{"type": "tool_call.success", "tool": name}
+	if err != nil {
+		log.Printf("[orchestrator] Tool %s failed: %v", name, err)
+		r.trace("tool.error", "Tool execution failed", map[string]interface{}{
+			"turn":       turn,
+			"tool":       name,
+			"elapsed_ms": elapsed.Milliseconds(),
+			"error":      err.Error(),
+		})
+		event = map[string]interface{}{"type": "tool_call.failure", "tool": name, "reason": err.Error()}
+		if strings.TrimSpace(result) == "" {
+			result = fmt.Sprintf("Error executing tool %s: %v", name, err)
+		} else {
+			result = fmt.Sprintf("Error executing tool %s: %v\n\n%s", name, err, strings.TrimSpace(result))
+		}
+	} else {
+		r.trace("tool.success", "Tool execution completed", map[string]interface{}{
+			"turn":         turn,
+			"tool":         name,
+			"elapsed_ms":   elapsed.Milliseconds(),
+			"result_chars": len(result),
+		})
+	}
+	if callID != "" {
+		event["call_id"] = callID
+	}
+	count := 0
+	if isWebEvidenceTool(name) {
+		sources := chatharness.ExtractWebEvidenceSources(result, 6)
+		count = len(sources)
+		if len(sources) > 0 {
+			evidence := make([]interface{}, 0, len(sources))
+			for _, source := range sources {
+				evidence = append(evidence, map[string]interface{}{
+					"title": source.Title,
+					"url":   source.URL,
+				})
+				r.addSource(source)
+			}
+			event["evidence"] = evidence
+		}
+	}
+	Emit(r.Sink, "assistant", event)
+	return result, count
+}
+
+func (r *ChatRound) addSource(source chatharness.WebEvidenceSource) {
+	for _, known := range r.Sources {
+		if known.URL == source.URL {
+			return
+		}
+	}
+	r.Sources = append(r.Sources, source)
+}
+
+// selfCorrect asks the model to redo a malformed tool call in the format it
+// was prompted with.
+func (r *ChatRound) selfCorrect(turn int) (Step, bool) {
+	prompt := promptkit.SelfCorrectionPromptTemplate(r.badContent)
+	if r.LLMMode == "stateful" {
+		r.ReqMap = map[string]interface{}{
+			"model":       r.ModelID,
+			"input":       prompt,
+			"stream":      true,
+			"temperature": 0.1,
+		}
+		if chatharness.IsValidResponseID(r.ResponseID) {
+			r.ReqMap["previous_response_id"] = strings.TrimSpace(r.ResponseID)
+		}
+	} else {
+		messages, _ := r.ReqMap["messages"].([]interface{})
+		r.ReqMap["messages"] = append(messages,
+			map[string]interface{}{"role": "assistant", "content": r.badContent},
+			map[string]interface{}{"role": "user", "content": prompt},
+		)
+		r.ReqMap["temperature"] = 0.1
+	}
+	body, err := json.Marshal(r.ReqMap)
+	if err != nil {
+		return Step{}, false
+	}
+	r.Body = body
+	r.trace("self_correction.retry", "Retrying malformed tool call through the normal parser", map[string]interface{}{
+		"turn":    turn,
+		"snippet": compactText(r.badContent, 180),
+	})
+	r.needsCorrection = false
+	r.badContent = ""
+	return Next(body), true
+}
+
+// shouldRecoverReasoning reports a round that reasoned without answering,
+// or answered with a stub after long reasoning.
+func (r *ChatRound) shouldRecoverReasoning(turn int) bool {
+	if strings.TrimSpace(r.Reasoning) == "" || r.callPending || r.reasoningRecovered || turn >= r.maxTurns()-1 {
+		return false
+	}
+	return strings.TrimSpace(r.Content) == "" || (len([]rune(r.Content)) < 40 && len([]rune(r.Reasoning)) > 400)
+}
+
+// recoverReasoning retries once, asking for the final answer the reasoning
+// already worked out.
+func (r *ChatRound) recoverReasoning(turn int) (Step, bool) {
+	r.reasoningRecovered = true
+	reqMap, body, err := chatharness.PrepareReasoningOnlyFinalRequest(r.LLMMode, r.ModelID, r.ResponseID, r.OriginalUserText, r.Reasoning, r.ReqMap)
+	if err != nil {
+		r.trace("final_answer.recovery_error", "Could not prepare reasoning-only final answer recovery", map[string]interface{}{
+			"turn":  turn,
+			"error": err.Error(),
+		})
+		return Step{}, false
+	}
+	r.ReqMap, r.Body = reqMap, body
+	if r.LLMMode == "stateful" && r.Transport != nil && r.RecoveryURL != "" {
+		r.Transport.URL = r.RecoveryURL
+	}
+	r.trace("final_answer.recovery", "Retrying once after the model emitted reasoning without a final answer", map[string]interface{}{
+		"turn":            turn,
+		"reasoning_chars": len(r.Reasoning),
+		"mode":            r.LLMMode,
+	})
+	return Next(body), true
+}
+
+// repairStructuredAnswer retries an answer that does not match the
+// requested response_format.
+func (r *ChatRound) repairStructuredAnswer(turn int) (Step, bool) {
+	_, problem := r.Format.Validate(r.Content)
+	if problem == nil {
+		return Step{}, false
+	}
+	r.structuredRepairs++
+	reqMap, body, err := chatharness.PrepareStructuredOutputRepairRequest(chatharness.StructuredOutputRepairInput{
+		LLMMode:        r.LLMMode,
+		ModelID:        r.ModelID,
+		LastResponseID: r.ResponseID,
+		ReqMap:         r.ReqMap,
+		Format:         r.Format,
+		Answer:         r.Content,
+		Problem:        problem,
+	})
+	if err != nil {
+		return Step{}, false
+	}
+	r.ReqMap, r.Body = reqMap, body
+	r.trace("response_format.repair", "Retrying an answer that did not match the response format", map[string]interface{}{
+		"turn":    turn,
+		"attempt": r.structuredRepairs,
+		"error":   compactText(problem.Error(), 180),
+		"snippet": compactText(r.Content, 180),
+	})
+	Emit(r.Sink, "system", map[string]interface{}{
+		"type":         "response_format.repair",
+		"turn_id":      r.TurnID,
+		"attempt":      r.structuredRepairs,
+		"max_attempts": chatharness.MaxStructuredOutputRepairs,
+		"error":        compactText(problem.Error(), 180),
+	})
+	r.Content = ""
+	return Next(body), true
+}
@@ -0,0 +1,445 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/mcp"
+)
+
+// ChatStream is the client side of one /api/chat request. It is the Sink
+// the ChatRound writes to: lines go to the SSE response until the client
+// detaches and events are recorded in the user's current chat session,
+// which it opens, keeps and settles when the request ends.
+type ChatStream struct {
+	// State is persisted with the session; the caller keeps ModelID and
+	// LastResponseID current while the round runs.
+	State  chatharness.SessionPersistState
+	UserID string
+	TurnID string
+	// Chains counts stateful turns and tokens for upstreams chaining
+	// responses through previous_response_id.
+	Chains bool
+	// With HoldAnswer set answer deltas are neither sent nor recorded until
+	// Finish validates the answer against Format.
+	Format     *chatharness.ResponseFormat
+	HoldAnswer bool
+	Started    time.Time
+	// Remember queues the finished turn for memory and reports whether it
+	// did.
+	Remember func(answer string) bool
+	Trace    func(category, event, message string, fields map[string]interface{})
+
+	session *chatharness.SessionTracker
+	w       http.ResponseWriter
+	emitter *chatharness.SSEEmitter
+	written bool
+}
+
+// NewChatStream marks the user's current session as running. Without a
+// user, or when the session cannot be stored, events are only streamed.
+func NewChatStream(userID, turnID string, state chatharness.SessionPersistState, snapshot chatharness.SessionUISnapshot) *ChatStream {
+	s := &ChatStream{State: state, UserID: userID, TurnID: turnID}
+	s.State.Status = "failed"
+	var entry mcp.ChatSessionEntry
+	ok := false
+	if strings.TrimSpace(userID) != "" {
+		var err error
+		entry, err = mcp.UpsertChatSession(mcp.ChatSessionEntry{
+			UserID:           userID,
+			SessionKey:       "default",
+			Status:           "running",
+			LLMMode:          state.LLMMode,
+			ModelID:          state.ModelID,
+			LastResponseID:   state.LastResponseID,
+			SummaryText:      state.SummaryText,
+			TurnCount:        state.TurnCount,
+			EstimatedChars:   state.EstimatedChars,
+			LastInputTokens:  state.LastInputTokens,
+			LastOutputTokens: state.LastOutputTokens,
+			PeakInputTokens:  state.PeakInputTokens,
+			TokenBudget:      state.TokenBudget,
+			RiskScore:        state.RiskScore,
+			RiskLevel:        state.RiskLevel,
+			LastResetReason:  state.LastResetReason,
+			UIStateJSON:      state.UIStateJSON,
+		})
+		if err != nil {
+			log.Printf("[chat-session] failed to initialize current session for %s: %v", userID, err)
+		} else {
+			ok = true
+			s.State.Status = "running"
+		}
+	}
+	s.session = chatharness.NewSessionTracker(userID, turnID, entry, ok, snapshot, state.UIStateJSON)
+	return s
+}
+
+// SessionID is the stored session the turn belongs to, or 0 without one.
+func (s *ChatStream) SessionID() int64 {
+	if !s.session.SessionOK {
+		return 0
+	}
+	return s.session.Session.ID
+}
+
+// ClearResponseID forgets the stored response of the session as well, so a
+// chain the upstream rejected is not resumed.
+func (s *ChatStream) ClearResponseID() {
+	s.State.LastResponseID = ""
+	s.session.Session.LastResponseID = ""
+}
+
+func (s *ChatStream) Send(line string) {
+	if s.emitter == nil || !s.emitter.Active() || (s.HoldAnswer && chatharness.IsAnswerDelta(line)) {
+		return
+	}
+	if err := s.emitter.EmitRaw(line); err != nil {
+		log.Printf("[handleChat] Client stream detached for %s: %v", s.UserID, err)
+		return
+	}
+	s.written = true
+}
+
+func (s *ChatStream) Record(role, eventType string, payload interface{}) {
+	if s.HoldAnswer && eventType == "message.delta" {
+		return
+	}
+	s.session.AppendEvent(s.State, role, eventType, payload)
+	s.State.UIStateJSON = s.session.UIStateJSON
+}
+
+// Begin records the prepared request and the user message that starts the
+// turn.
+func (s *ChatStream) Begin(url string, reqMap map[string]interface{}, body []byte) {
+	s.Record("system", "request.prepared", map[string]interface{}{
+		"mode":       s.State.LLMMode,
+		"model":      s.State.ModelID,
+		"url":        url,
+		"body_bytes": len(body),
+	})
+	s.Record("system", "generation.started", map[string]interface{}{
+		"type":  "generation.started",
+		"phase": "queued",
+		"mode":  s.State.LLMMode,
+		"model": s.State.ModelID,
+	})
+	if s.State.LastResetReason != "" {
+		s.Record("system", "stateful.reset", map[string]interface{}{
+			"reason":         s.State.LastResetReason,
+			"turn_count":     s.State.TurnCount,
+			"estimatedChars": s.State.EstimatedChars,
+		})
+	}
+	if messages, ok := reqMap["messages"].([]interface{}); ok {
+		for i := len(messages) - 1; i >= 0; i-- {
+			msg, ok := messages[i].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if role, _ := msg["role"].(string); role == "user" {
+				s.Record("user", "message.created", msg)
+				break
+			}
+		}
+	} else if inputStr, ok := reqMap["input"].(string); ok && strings.TrimSpace(inputStr) != "" {
+		s.Record("user", "message.created", map[string]interface{}{"content": inputStr})
+	}
+}
+
+// Open starts the SSE response, numbering its events with events.
+func (s *ChatStream) Open(w http.ResponseWriter, events *chatharness.EventSequencer) error {
+	emitter, err := chatharness.NewSSEEmitter(w)
+	if err != nil {
+		return err
+	}
+	emitter.Sequence(events)
+	w.Header().Set("X-Request-ID", events.RequestID)
+	emitter.SetupHeaders()
+	s.w, s.emitter = w, emitter
+	return nil
+}
+
+// Close settles the session. A request cancelled before it finished ends
+// with a cancelled generation.finished event.
+func (s *ChatStream) Close(ctx context.Context) {
+	if !s.session.SessionOK {
+		return
+	}
+	if ctx.Err() == context.Canceled && s.State.Status != "idle" {
+		s.State.Status = "cancelled"
+		s.Record("system", "generation.finished", map[string]interface{}{
+			"type":    "generation.finished",
+			"phase":   "cancelled",
+			"turn_id": s.TurnID,
+		})
+	}
+	s.session.Finalize(s.State)
+}
+
+// Finish ends the request after the engine returned err: upstream failures
+// become client errors, a held structured answer is validated and sent,
+// and the stateful counters and request.complete close the turn.
+func (s *ChatStream) Finish(round *ChatRound, err error) {
+	if s.Chains {
+		if tokens := round.LastUsage.PromptTokens; tokens > 0 {
+			s.State.LastInputTokens = tokens
+			if s.State.PeakInputTokens < tokens {
+				s.State.PeakInputTokens = tokens
+			}
+		}
+		if tokens := round.LastUsage.CompletionTokens; tokens > 0 {
+			s.State.LastOutputTokens = tokens
+		}
+	}
+	if errors.Is(err, ErrStreamAborted) {
+		return
+	}
+	var roundErr *TurnError
+	if err != nil && !errors.As(err, &roundErr) {
+		log.Printf("[handleChat] Turn loop ended with error: %v", err)
+		s.emitter.SendError(fmt.Sprintf("LLM error: %v", err))
+		return
+	}
+	if roundErr != nil {
+		s.fail(roundErr)
+		return
+	}
+
+	answer := round.Complete()
+	if s.HoldAnswer {
+		answer = s.releaseAnswer(answer, round.StructuredRepairs())
+	}
+
+	// A malformed call that still remains after the bounded retry loop is never
+	// forwarded as assistant content.
+	if badContentCapture := round.MalformedToolCall(); badContentCapture != "" {
+		log.Printf("[handleChat] Tool call remained malformed after self-correction")
+		s.trace("self_correction.exhausted", "Tool-call self-correction was exhausted", map[string]interface{}{
+			"snippet": compactText(badContentCapture, 180),
+		})
+		s.emitter.SendError("TOOL_CALL_FORMAT_ERROR: The model did not produce a valid app tool call.")
+	}
+
+	memoryLogged := false
+	if s.Remember != nil && answer != "" {
+		memoryLogged = s.Remember(answer)
+	}
+	if s.Chains {
+		s.countStatefulTurn(round.OriginalUserText, answer)
+	}
+	s.State.Status = "idle"
+	s.complete(answer, memoryLogged)
+}
+
+// fail reports a round that failed before its answer. Nothing has been
+// written yet after a first-round failure, so it can still be a plain HTTP
+// error.
+func (s *ChatStream) fail(roundErr *TurnError) {
+	var statusErr *StatusError
+	if !errors.As(roundErr, &statusErr) {
+		log.Printf("LLM request failed: %v", roundErr)
+		if s.written {
+			s.emitter.SendError(fmt.Sprintf("LLM connection failed: %v", roundErr))
+		} else if roundErr.Turn == 0 {
+			http.Error(s.w, fmt.Sprintf("LLM connection failed: %v", roundErr), http.StatusBadGateway)
+		}
+		return
+	}
+
+	errorMsg := statusErr.Body
+	log.Printf("LLM error response: %s", errorMsg)
+	switch {
+	case statusErr.StatusCode == http.StatusUnauthorized || strings.Contains(errorMsg, "invalid_api_key") || strings.Contains(errorMsg, "Malformed LM Studio API token"):
+		// The frontend localizes errors starting with "LM_STUDIO_AUTH_ERROR:".
+		if s.written {
+			s.emitter.SendError("LM_STUDIO_AUTH_ERROR: " + errorMsg)
+		} else {
+			http.Error(s.w, "LM_STUDIO_AUTH_ERROR: "+errorMsg, statusErr.StatusCode)
+		}
+	case strings.Contains(errorMsg, "Context size has been exceeded") ||
+		strings.Contains(errorMsg, "context_length_exceeded") ||
+		strings.Contains(errorMsg, "exceeds the available context size") ||
+		strings.Contains(errorMsg, "too many tokens"):
+		log.Printf("[handleChat] LM Studio Context Limit Reached. Informing user.")
+		s.emitter.SendError("LM_STUDIO_CONTEXT_ERROR: Context limit reached. Please clear the chat or use a larger context model.")
+	case strings.Contains(errorMsg, "does not support image inputs"):
+		log.Printf("[handleChat] Non-Vision Model Error detected. Informing user.")
+		s.emitter.SendError("LM_STUDIO_VISION_ERROR: Model does not support images.")
+	default:
+		s.emitter.SendError(fmt.Sprintf("LLM error: %s", errorMsg))
+	}
+}
+
+// releaseAnswer sends the held structured answer once, as its validated
+// document when it matches Format, and returns what it sent.
+func (s *ChatStream) releaseAnswer(answer string, repairs int) string {
+	s.HoldAnswer = false
+	document, validateErr := s.Format.Validate(answer)
+	if validateErr == nil {
+		answer = document
+	}
+	if strings.TrimSpace(answer) != "" {
+		payload := map[string]interface{}{
+			"choices": []interface{}{
+				map[string]interface{}{
+					"delta": map[string]string{
+						"content": answer,
+					},
+				},
+			},
+		}
+		if data, err := json.Marshal(payload); err == nil {
+			s.Send("data: " + string(data))
+		}
+		s.Record("assistant", "message.delta", map[string]interface{}{
+			"type":         "message.delta",
+			"content":      answer,
+			"full_content": answer,
+		})
+	}
+	if validateErr != nil {
+		log.Printf("[handleChat] Answer did not match response_format after %d repairs: %v", repairs, validateErr)
+		s.trace("response_format.exhausted", "Response format repairs were exhausted", map[string]interface{}{
+			"repairs": repairs,
+			"error":   compactText(validateErr.Error(), 180),
+			"snippet": compactText(answer, 180),
+		})
+		s.emitter.SendError("RESPONSE_FORMAT_ERROR: The model did not produce an answer matching response_format: " + compactText(validateErr.Error(), 240))
+	}
+	return answer
+}
+
+// countStatefulTurn adds the finished turn to the chain, estimating the
+// token counts the upstream did not report.
+func (s *ChatStream) countStatefulTurn(userText, answer string) {
+	if strings.TrimSpace(answer) != "" || strings.TrimSpace(s.State.LastResponseID) != "" {
+		s.State.TurnCount++
+		s.State.EstimatedChars += len([]rune(strings.TrimSpace(userText))) + len([]rune(strings.TrimSpace(answer)))
+	}
+	if s.State.LastInputTokens <= 0 {
+		s.State.LastInputTokens = EstimateTokens(userText) + EstimateTokens(s.State.SummaryText)
+	}
+	if s.State.LastOutputTokens <= 0 {
+		s.State.LastOutputTokens = EstimateTokens(answer)
+	}
+	if s.State.PeakInputTokens < s.State.LastInputTokens {
+		s.State.PeakInputTokens = s.State.LastInputTokens
+	}
+}
+
+// complete sends request.complete with the final answer and the reasoning
+// and tool card the session recorded for the turn.
+func (s *ChatStream) complete(answer string, memoryLogged bool) {
+	elapsedMs := time.Since(s.Started).Milliseconds()
+	var finalReasoningContent string
+	var finalToolPayload map[string]interface{}
+	for _, turn := range s.session.Snapshot.Turns {
+		if strings.TrimSpace(turn.TurnID) != strings.TrimSpace(s.TurnID) {
+			continue
+		}
+		finalReasoningContent = strings.TrimSpace(turn.Reasoning.Content)
+		if turn.Tool != nil && hasMeaningfulTurnToolSnapshot(*turn.Tool) {
+			finalToolPayload = map[string]interface{}{
+				"state":     strings.TrimSpace(turn.Tool.State),
+				"summary":   strings.TrimSpace(turn.Tool.Summary),
+				"args":      turn.Tool.Args,
+				"tool_name": strings.TrimSpace(turn.Tool.ToolName),
+				"history":   turn.Tool.History,
+			}
+		}
+		break
+	}
+	s.Record("system", "generation.finished", map[string]interface{}{
+		"type":       "generation.finished",
+		"phase":      "finished",
+		"elapsed_ms": elapsedMs,
+		"turn_id":    s.TurnID,
+	})
+	requestCompletePayload := map[string]interface{}{
+		"type":                    "request.complete",
+		"response_chars":          len(answer),
+		"response_id":             s.State.LastResponseID,
+		"mode":                    s.State.LLMMode,
+		"elapsed_ms":              elapsedMs,
+		"total_elapsed_ms":        elapsedMs,
+		"turn_id":                 s.TurnID,
+		"final_assistant_content": answer,
+		"final_assistant_chars":   len(answer),
+		"final_assistant_hash":    assistantContentHash(answer),
+	}
+	if finalReasoningContent != "" {
+		requestCompletePayload["reasoning_content"] = finalReasoningContent
+	}
+	if finalToolPayload != nil {
+		requestCompletePayload["tool"] = finalToolPayload
+	}
+	Emit(s, "assistant", requestCompletePayload)
+	s.trace("request.complete", "Chat request finished", map[string]interface{}{
+		"user":           s.UserID,
+		"elapsed_ms":     elapsedMs,
+		"response_chars": len(answer),
+		"memory_logged":  memoryLogged,
+		"stateful_turns": s.State.TurnCount,
+		"stateful_chars": s.State.EstimatedChars,
+		"risk_score":     s.State.RiskScore,
+		"risk_level":     s.State.RiskLevel,
+		"__payload":      answer,
+	})
+}
+
+func (s *ChatStream) trace(event, message string, fields map[string]interface{}) {
+	if s.Trace != nil {
+		s.Trace("chat", event, message, fields)
+	}
+}
+
+// EstimateTokens approximates the token count of text at four runes per
+// token, for upstreams that report no usage.
+func EstimateTokens(text string) int {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return 0
+	}
+	runeCount := len([]rune(trimmed))
+	return (runeCount + 3) / 4
+}
+
+func assistantContentHash(input string) string {
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:8])
+}
+
+func hasMeaningfulTurnToolSnapshot(card chatharness.SessionToolCardSnapshot) bool {
+	if strings.TrimSpace(card.Summary) != "" {
+		return true
+	}
+	if name := strings.TrimSpace(card.ToolName); name != "" && !strings.EqualFold(name, "Tool") {
+		return true
+	}
+	if card.Args != nil {
+		bytes, err := json.Marshal(card.Args)
+		if err != nil {
+			return true
+		}
+		serialized := strings.TrimSpace(string(bytes))
+		if serialized != "" && serialized != "{}" && serialized != "[]" && serialized != "null" {
+			return true
+		}
+	}
+	for _, entry := range card.History {
+		if strings.TrimSpace(entry.Tool) != "" || strings.TrimSpace(entry.Detail) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package orchestrator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+)
+
+func newTestStream(t *testing.T, w http.ResponseWriter) *ChatStream {
+	t.Helper()
+	stream := NewChatStream("", "turn-1", chatharness.SessionPersistState{LLMMode: "stateful", ModelID: "test-model"}, chatharness.SessionUISnapshot{})
+	stream.Started = time.Now()
+	if err := stream.Open(w, chatharness.NewEventSequencer("req-test", "turn-1")); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return stream
+}
+
+func TestChatStreamCompletesRequest(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(`{"choices":[{"delta":{"content":"It is noon."}}],"usage":{"prompt_tokens":20,"completion_tokens":7}}`, "[DONE]")},
+	}}
+	recorder := httptest.NewRecorder()
+	stream := newTestStream(t, recorder)
+	stream.Chains = true
+	remembered := ""
+	stream.Remember = func(answer string) bool {
+		remembered = answer
+		return true
+	}
+	round := newTestRound(stream, nil, "standard")
+	round.OriginalUserText = "what time is it"
+	stream.Finish(round, (Engine{Transport: transport}).Run(context.Background(), round.Body, round))
+
+	body := recorder.Body.String()
+	if !strings.Contains(body, "It is noon.") || !strings.Contains(body, `"type":"request.complete"`) {
+		t.Fatalf("stream = %q", body)
+	}
+	if remembered != "It is noon." {
+		t.Fatalf("remembered = %q", remembered)
+	}
+	if stream.State.Status != "idle" || stream.State.TurnCount != 1 || stream.State.LastInputTokens != 20 || stream.State.LastOutputTokens != 7 {
+		t.Fatalf("state = %+v", stream.State)
+	}
+}
+
+func TestChatStreamReportsUpstreamFailures(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	stream := newTestStream(t, recorder)
+	stream.Finish(newTestRound(stream, nil, "standard"), &TurnError{Err: &StatusError{StatusCode: http.StatusUnauthorized, Body: "invalid_api_key"}})
+	if recorder.Code != http.StatusUnauthorized || !strings.HasPrefix(recorder.Body.String(), "LM_STUDIO_AUTH_ERROR: ") {
+		t.Fatalf("unstarted stream answered %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	// Once a line reached the client the failure has to arrive as an event.
+	recorder = httptest.NewRecorder()
+	stream = newTestStream(t, recorder)
+	Emit(stream, "system", map[string]interface{}{"type": "upstream.retry", "attempt": 1})
+	stream.Finish(newTestRound(stream, nil, "standard"), &TurnError{Err: &StatusError{StatusCode: http.StatusUnauthorized, Body: "invalid_api_key"}})
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"message":"LM_STUDIO_AUTH_ERROR: invalid_api_key"`) {
+		t.Fatalf("started stream answered %d %q", recorder.Code, recorder.Body.String())
+	}
+	if stream.State.Status == "idle" {
+		t.Fatal("a failed request left the session idle")
+	}
+}
+
+func TestChatStreamReleasesHeldAnswerOnce(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(contentChunk(`{"ok":true}`), "[DONE]")},
+	}}
+	recorder := httptest.NewRecorder()
+	stream := newTestStream(t, recorder)
+	stream.Format = &chatharness.ResponseFormat{Type: chatharness.ResponseFormatJSONObject}
+	stream.HoldAnswer = true
+	round := newTestRound(stream, nil, "standard")
+	round.Format, round.HoldAnswer = stream.Format, true
+	stream.Finish(round, (Engine{Transport: transport}).Run(context.Background(), round.Body, round))
+
+	body := recorder.Body.String()
+	if count := strings.Count(body, `{\"ok\":true}`); count != 2 {
+		t.Fatalf("held answer was sent %d times, want once plus request.complete: %q", count, body)
+	}
+	if strings.Contains(body, "event: error") {
+		t.Fatalf("valid answer reported an error: %q", body)
+	}
+}
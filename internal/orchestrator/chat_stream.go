@@ -0,0 +1,752 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+)
+
+var (
+	qwenToolCallPattern      = regexp.MustCompile(`(?s)<tool_call>\s*(?:([a-zA-Z0-9_]+)\s*)?(\{[\s\S]*?\})\s*</tool_call>\s*\{?`)
+	channelToolCallPattern   = regexp.MustCompile(`(?s)(<\|channel\|>.*?<\|message\|>)\s*(\{[\s\S]*\})`)
+	channelToolTargetPattern = regexp.MustCompile(`to=([a-zA-Z0-9_]+)`)
+)
+
+func (r *ChatRound) Stream(ctx context.Context, turn int, stream io.Reader) error {
+	r.trace("turn.response", "Upstream stream opened", map[string]interface{}{
+		"turn":       turn,
+		"elapsed_ms": time.Since(r.turnStart).Milliseconds(),
+	})
+	reader := bufio.NewReader(stream)
+	for {
+		block, err := chatharness.ReadSSEBlock(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("[orchestrator] Stream read error: %v", err)
+			}
+			return nil
+		}
+		stop, err := r.streamBlock(turn, block)
+		if err != nil || stop {
+			return err
+		}
+	}
+}
+
+// streamBlock handles one SSE block and reports whether the round's stream
+// must stop early.
+func (r *ChatRound) streamBlock(turn int, block chatharness.SSEBlock) (bool, error) {
+	line := block.Raw
+	data := block.Data
+	if strings.TrimSpace(line) == "" {
+		return false, nil
+	}
+	if data == "" {
+		// Raw JSON errors arrive without a data: prefix.
+		if strings.HasPrefix(line, "{") && strings.Contains(line, "\"error\"") {
+			log.Printf("[orchestrator] Raw JSON error in stream: %s", line)
+			if strings.Contains(line, "Context size has been exceeded") || strings.Contains(line, "context_length_exceeded") {
+				if strings.TrimSpace(r.Reasoning) != "" && !r.reasoningRecovered && turn < r.maxTurns()-1 {
+					// Finish recovers an answer from the reasoning so far.
+					return true, nil
+				}
+				r.Sink.Send("data: {\"error\": \"LM_STUDIO_CONTEXT_ERROR: Context size exceeded.\"}")
+				return true, ErrStreamAborted
+			}
+		}
+		r.Sink.Send(line)
+		return false, nil
+	}
+
+	if data == "[DONE]" {
+		return r.streamDone(line)
+	}
+
+	var chunk map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		r.Sink.Send(line)
+		return false, nil
+	}
+	hasNativeToolDelta := false
+	if r.nativeCalls() {
+		hasNativeToolDelta = r.calls.AddChunk(chunk)
+	}
+	if eventType, ok := chunk["type"].(string); ok {
+		return r.streamEvent(turn, line, eventType, chunk)
+	}
+	if usage, ok := chunk["usage"].(map[string]interface{}); ok {
+		r.Usage.add(usage["prompt_tokens"], usage["completion_tokens"])
+		r.LastUsage.set(usage["prompt_tokens"], usage["completion_tokens"])
+	}
+	if stop, handled := r.streamCompletionChunk(chunk); handled {
+		return stop, nil
+	}
+	// Native deltas become canonical tool events once every argument
+	// fragment has arrived.
+	if !hasNativeToolDelta {
+		r.Sink.Send(line)
+	}
+	return false, nil
+}
+
+// streamDone handles the Chat Completions [DONE] marker, settling any text
+// still held back as a possible tool call.
+func (r *ChatRound) streamDone(line string) (bool, error) {
+	if r.nativeCalls() && r.calls.HasCalls() {
+		return false, nil
+	}
+	if r.TextTools && r.buffering && strings.TrimSpace(r.buffer) != "" {
+		if name, argsJSON, args, ok := chatharness.ParsePromptToolMarkup(r.buffer); ok && isRegisteredPromptTool(name, r.PromptTools) {
+			r.acceptTextCall(name, argsJSON, args, false)
+			r.toolFormat = ""
+			return false, nil
+		}
+	}
+	if r.TextTools && r.buffering && looksLikeJSONToolCallPrefix(r.buffer) {
+		// Finish parses the complete JSON wrapper.
+		return true, nil
+	}
+	if r.buffering && len(r.buffer) > 0 {
+		recognized, _ := classifyPromptToolMarkup(r.buffer, r.PromptTools)
+		if r.TextTools && (recognized || looksLikeToolMarkup(r.buffer)) {
+			r.needsCorrection = true
+			if r.badContent == "" {
+				r.badContent = r.buffer
+			}
+			r.buffer = ""
+			r.Sink.Send(line)
+			return false, nil
+		}
+		r.sendContent(r.buffer)
+		r.Content += r.buffer
+		r.buffer = ""
+	}
+	r.Sink.Send(line)
+	return false, nil
+}
+
+// streamEvent handles an app event: an LM Studio stateful event or one
+// normalized by a provider adapter.
+func (r *ChatRound) streamEvent(turn int, line, eventType string, chunk map[string]interface{}) (bool, error) {
+	switch eventType {
+	case "message.delta":
+		content, ok := chunk["content"].(string)
+		if !ok {
+			break
+		}
+		if r.TextTools {
+			var held bool
+			if content, held = r.holdTextToolDelta(content); held {
+				return false, nil
+			}
+		}
+		r.enterPhase("answering")
+		r.endReasoning()
+		r.Content += content
+		if r.TextTools && r.toolFormat == "" && len(content) > 5 && mentionsToolCall(content) {
+			log.Printf("[orchestrator] Invalid tool pattern detected in content: %s", content)
+			r.quarantine(content)
+		}
+		payload := copyPayload(chunk)
+		payload["full_content"] = r.Content
+		r.Sink.Record("assistant", "message.delta", payload)
+		r.Sink.Send(line)
+		return false, nil
+
+	case "reasoning.start", "reasoning.delta", "reasoning.end":
+		payload := copyPayload(chunk)
+		switch eventType {
+		case "reasoning.start":
+			r.generationPhase = "thinking"
+			r.generationEvent("generation.phase", map[string]interface{}{"phase": r.generationPhase})
+			r.reasoningActive = true
+			r.reasoningStartedAt = time.Now()
+			payload["started_at"] = r.reasoningStartedAt.Format(time.RFC3339Nano)
+			payload["total_elapsed_ms"] = r.elapsedMs()
+		case "reasoning.delta":
+			r.enterPhase("thinking")
+			r.startReasoning()
+			payload["elapsed_ms"] = time.Since(r.reasoningStartedAt).Milliseconds()
+			payload["total_elapsed_ms"] = r.elapsedMs()
+			text, _ := payload["content"].(string)
+			if text == "" {
+				text, _ = payload["reasoning_content"].(string)
+			}
+			if text == "" {
+				text, _ = payload["text"].(string)
+			}
+			if r.reasoningDelta(text) {
+				return true, nil
+			}
+		case "reasoning.end":
+			r.startReasoning()
+			elapsed := time.Since(r.reasoningStartedAt).Milliseconds()
+			payload["elapsed_ms"] = elapsed
+			payload["total_elapsed_ms"] = r.elapsedMs()
+			r.reasoningMs += elapsed
+			r.reasoningActive = false
+			r.reasoningStartedAt = time.Time{}
+		}
+		Emit(r.Sink, "assistant", payload)
+		return false, nil
+
+	case "tool_call.arguments":
+		if !r.nativeCalls() {
+			return false, nil
+		}
+		return r.streamToolArguments(turn, line, chunk), nil
+
+	case "tool_call.name", "tool_call.start", "tool_call.success", "tool_call.failure":
+		if !r.nativeCalls() || r.Native {
+			// Calls are announced with their call IDs once the round ends.
+			return false, nil
+		}
+		if eventType == "tool_call.name" {
+			if name, _ := chunk["tool_name"].(string); strings.TrimSpace(name) != "" {
+				r.pendingNativeTool = strings.TrimSpace(name)
+			} else if name, _ := chunk["tool"].(string); strings.TrimSpace(name) != "" {
+				r.pendingNativeTool = strings.TrimSpace(name)
+			}
+		}
+		r.Sink.Record("assistant", eventType, chunk)
+		r.Sink.Send(line)
+		return false, nil
+
+	case "chat.end", "message.end":
+		return r.streamEnd(turn, line, eventType, chunk), nil
+
+	case "error":
+		r.Sink.Record("system", eventType, chunk)
+		if r.toolFormatError(turn, chunk) {
+			return false, nil
+		}
+		r.Sink.Send(line)
+		// An upstream error ends the request; nothing after it is trusted.
+		r.failed = true
+		return true, nil
+	}
+	r.Sink.Record("system", eventType, chunk)
+	r.Sink.Send(line)
+	return false, nil
+}
+
+// holdTextToolDelta buffers a message.delta that may be a textual tool
+// call, accepting or quarantining the buffer once it is decided. It returns
+// the content to forward, including a held prefix that turned out to be
+// text, and whether the delta was held back instead.
+func (r *ChatRound) holdTextToolDelta(content string) (string, bool) {
+	textual := r.toolFormat == "text-tool" || r.toolFormat == "json-tool"
+	candidate := content
+	if r.buffering && textual {
+		r.buffer += content
+		candidate = r.buffer
+	} else if r.partialTag != "" {
+		candidate = r.partialTag + content
+	}
+	if !r.buffering {
+		start, hold := classifyPromptToolStreamCandidate(candidate, r.PromptTools)
+		if !start && hold {
+			r.partialTag = candidate
+			return "", true
+		}
+		if start {
+			r.buffering = true
+			r.buffer = candidate
+			r.partialTag = ""
+			r.toolFormat = "text-tool"
+			if looksLikeJSONToolCallPrefix(candidate) {
+				r.toolFormat = "json-tool"
+			}
+			textual = true
+		} else if r.partialTag != "" {
+			content = candidate
+			r.partialTag = ""
+		}
+	}
+	if !r.buffering || !textual {
+		return content, false
+	}
+	if name, argsJSON, args, _ := chatharness.ParsePromptToolMarkup(r.buffer); isRegisteredPromptTool(name, r.PromptTools) {
+		r.acceptTextCall(name, argsJSON, args, true)
+		r.toolFormat = ""
+		return "", true
+	}
+	if r.toolFormat == "text-tool" && hasPromptToolClosingTag(r.buffer, r.PromptTools) {
+		r.quarantine(r.buffer)
+		r.trace("tool.quarantine", "Suppressed malformed streamed tool markup", map[string]interface{}{
+			"snippet": compactText(r.buffer, 220),
+		})
+		r.buffer, r.buffering, r.toolFormat = "", false, ""
+	}
+	if len(r.buffer) > bufferingThreshold {
+		r.quarantine(r.buffer)
+		r.trace("tool.quarantine", "Suppressed oversized streamed tool wrapper", map[string]interface{}{
+			"snippet": compactText(r.buffer, 220),
+		})
+		r.buffer, r.buffering, r.toolFormat = "", false, ""
+	}
+	return "", true
+}
+
+// streamToolArguments handles a complete call from an app event stream.
+func (r *ChatRound) streamToolArguments(turn int, line string, chunk map[string]interface{}) bool {
+	payload := copyPayload(chunk)
+	call, args, hasCall := chatharness.ParseProviderToolArgumentsEvent(chunk, r.pendingNativeTool)
+	name := strings.TrimSpace(call.Name)
+	registered := isRegisteredPromptTool(name, r.PromptTools)
+	switch {
+	case hasCall && r.Passthrough != nil && r.Passthrough(name):
+		r.calls.AddCall(call)
+	case registered && r.Native:
+		// Native adapters deliver complete calls, possibly several per
+		// round; they are replayed after the stream like Chat Completions
+		// deltas so parallel calls keep their call IDs.
+		r.calls.AddCall(call)
+	case registered:
+		r.callPending = true
+		r.call = chatharness.ProviderToolCall{ID: call.ID, Name: name, Arguments: call.Arguments}
+		r.savedBuffer = r.Content
+		payload["tool"] = name
+		payload["arguments"] = args
+	case hasCall && r.Tools != nil:
+		r.quarantine(fmt.Sprintf("Unknown app tool %q with arguments %s", name, call.Arguments))
+	}
+	if name == "execute_command" && r.Tools != nil {
+		r.nativeCommands++
+		command := chatharness.ExtractExecuteCommandFromArgsJSON(call.Arguments)
+		family := chatharness.ExecuteCommandBudgetFamily(command)
+		if family != "" {
+			r.nativeFamilies[family]++
+		}
+		if r.nativeCommands > 5 {
+			r.nativeLoop = "execute_command already ran many times in this answer. Use the latest command results you already received and answer the user directly."
+		} else if family != "" && r.nativeFamilies[family] > 3 {
+			r.nativeLoop = fmt.Sprintf("Too many execute_command calls were used for the same task family (%s). Use the latest command results you already received and answer the user directly.", family)
+		}
+		if r.nativeLoop != "" {
+			r.Sink.Record("assistant", "tool_call.failure", map[string]interface{}{
+				"type":   "tool_call.failure",
+				"tool":   name,
+				"reason": r.nativeLoop,
+			})
+			r.trace("tool.loop", "Stopped native execute_command due to tool budget", map[string]interface{}{
+				"turn":    turn,
+				"tool":    name,
+				"family":  family,
+				"command": compactText(command, 180),
+				"count":   r.nativeCommands,
+			})
+			return true
+		}
+	}
+	if !r.Native {
+		r.Sink.Record("assistant", "tool_call.arguments", payload)
+		r.Sink.Send(line)
+	}
+	return false
+}
+
+// streamEnd handles the end of an app event round. LM Studio repeats the
+// complete assistant message in chat.end, so a textual tool call can appear
+// there even when its message.delta chunks were quarantined; such an end is
+// not forwarded, or the client would render the call as the answer.
+func (r *ChatRound) streamEnd(turn int, line, eventType string, chunk map[string]interface{}) bool {
+	if snippet, source, ok := detectReasoningPayloadRunawayRepetition(chunk); ok {
+		r.stopRunaway(snippet, source)
+		return true
+	}
+	if result, ok := chunk["result"].(map[string]interface{}); ok {
+		if responseID, _ := result["response_id"].(string); chatharness.IsValidResponseID(responseID) && !r.discardResponseID {
+			r.setResponseID(strings.TrimSpace(responseID))
+		}
+		if stopReason, _ := result["stop_reason"].(string); stopReason != "" {
+			r.FinishReason = stopReason
+		}
+		if stats, ok := result["stats"].(map[string]interface{}); ok {
+			r.Usage.add(stats["input_tokens"], stats["total_output_tokens"])
+			r.LastUsage.set(stats["input_tokens"], stats["total_output_tokens"])
+		}
+	}
+
+	endContent := chatharness.ExtractFinalAssistantContent(chunk)
+	if r.TextTools && !r.callPending && strings.TrimSpace(endContent) != "" {
+		if name, argsJSON, args, _ := chatharness.ParsePromptToolMarkup(endContent); isRegisteredPromptTool(name, r.PromptTools) {
+			r.acceptTextCall(name, argsJSON, args, true)
+		} else if recognized, possible := classifyPromptToolMarkup(endContent, r.PromptTools); recognized || possible || looksLikeToolMarkup(endContent) {
+			r.quarantine(endContent)
+		}
+	}
+	if r.callPending || (r.TextTools && r.needsCorrection) || (r.nativeCalls() && r.calls.HasCalls()) {
+		r.trace("tool.end_suppressed", "Suppressed intermediate LM Studio end payload containing tool markup", map[string]interface{}{
+			"turn":    turn,
+			"snippet": compactText(endContent, 220),
+		})
+		return false
+	}
+	r.Sink.Record("assistant", eventType, chunk)
+	r.Sink.Send(line)
+	return false
+}
+
+// toolFormatError recovers from LM Studio failing to parse a native call.
+// A read_web_page call whose URL is in the user's message is rebuilt;
+// anything else is queued for self-correction. It reports whether the
+// error was such a failure.
+func (r *ChatRound) toolFormatError(turn int, chunk map[string]interface{}) bool {
+	detail, ok := chunk["error"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	errType, _ := detail["type"].(string)
+	message, _ := detail["message"].(string)
+	if errType != "tool_format_generation_error" {
+		return false
+	}
+	// The stored response holds the broken call; do not chain from it.
+	r.discardResponseID = true
+	r.setResponseID("")
+	if r.pendingNativeTool == "" {
+		r.quarantine(fmt.Sprintf("Native tool call parse error: %s", message))
+		Emit(r.Sink, "assistant", map[string]interface{}{
+			"type":   "tool_call.failure",
+			"tool":   "Tool",
+			"reason": message,
+		})
+		r.trace("tool.error", "Tool format generation error queued for self-correction", map[string]interface{}{
+			"turn":  turn,
+			"error": compactText(message, 180),
+		})
+		return true
+	}
+	repaired, ok := chatharness.RepairMissingReadWebPageArguments(r.pendingNativeTool, "{}", r.OriginalUserText)
+	if !ok {
+		r.quarantine(fmt.Sprintf("Native tool call parse error for %s: %s", r.pendingNativeTool, message))
+		r.trace("tool.error", "Native tool format error queued for self-correction instead of executing empty arguments", map[string]interface{}{
+			"turn":  turn,
+			"tool":  r.pendingNativeTool,
+			"error": compactText(message, 180),
+		})
+		return true
+	}
+	r.callPending = true
+	r.call = chatharness.ProviderToolCall{Name: r.pendingNativeTool, Arguments: repaired}
+	r.savedBuffer = r.Content
+	var args interface{}
+	_ = json.Unmarshal([]byte(repaired), &args)
+	Emit(r.Sink, "assistant", map[string]interface{}{
+		"type":      "tool_call.arguments",
+		"tool":      r.pendingNativeTool,
+		"arguments": args,
+		"recovered": true,
+	})
+	r.trace("tool.arguments_repaired", "Recovered explicit current-turn URL after native tool format error", map[string]interface{}{
+		"turn":  turn,
+		"tool":  r.pendingNativeTool,
+		"args":  compactText(repaired, 240),
+		"error": compactText(message, 180),
+	})
+	return true
+}
+
+// streamCompletionChunk handles a Chat Completions chunk. It reports whether
+// the chunk was consumed (held back as a possible tool call) and whether the
+// stream must stop.
+func (r *ChatRound) streamCompletionChunk(chunk map[string]interface{}) (stop bool, handled bool) {
+	choice, delta := completionDelta(chunk)
+	if finishReason, _ := choice["finish_reason"].(string); finishReason != "" {
+		r.FinishReason = finishReason
+	}
+
+	// JSON wrappers written as assistant content are parsed after the
+	// stream closes, so no fragment leaks to the client.
+	if r.TextTools && r.buffering && r.toolFormat == "" && looksLikeJSONToolCallPrefix(r.buffer) {
+		content, _ := delta["content"].(string)
+		r.buffer += content
+		if len(r.buffer) > bufferingThreshold {
+			r.quarantine(r.buffer)
+			r.buffer = ""
+			r.buffering = false
+		}
+		return false, true
+	}
+	if r.TextTools && r.toolFormat != "" && r.buffering {
+		r.bufferCompletionContent(delta)
+		return false, true
+	}
+
+	if delta != nil {
+		reasoning, _ := delta["reasoning_content"].(string)
+		if reasoning == "" {
+			reasoning, _ = delta["reasoning"].(string)
+		}
+		if reasoning != "" {
+			if !r.reasoningActive {
+				r.startReasoning()
+				r.Sink.Record("assistant", "reasoning.start", map[string]interface{}{
+					"type":             "reasoning.start",
+					"started_at":       r.reasoningStartedAt.Format(time.RFC3339Nano),
+					"total_elapsed_ms": r.elapsedMs(),
+				})
+			}
+			if r.reasoningDelta(reasoning) {
+				return true, true
+			}
+			r.Sink.Record("assistant", "reasoning.delta", map[string]interface{}{
+				"type":             "reasoning.delta",
+				"content":          reasoning,
+				"elapsed_ms":       time.Since(r.reasoningStartedAt).Milliseconds(),
+				"total_elapsed_ms": r.elapsedMs(),
+			})
+		}
+		if content, ok := delta["content"].(string); ok {
+			if r.completionContent(content) {
+				return false, true
+			}
+		}
+	}
+
+	if r.toolFormat == "" {
+		return false, r.detectCompletionToolMarkup(delta)
+	}
+	return false, false
+}
+
+// completionContent forwards one content delta unless it may start a
+// textual tool call. It reports whether the delta was held back.
+func (r *ChatRound) completionContent(content string) bool {
+	if cleaned, changed := sanitizeLeakedModelChannelContent(content); changed {
+		if strings.TrimSpace(cleaned) == "" {
+			return true
+		}
+		content = cleaned
+		r.trace("channel.quarantine", "Stripped leaked model channel markup from assistant content", map[string]interface{}{
+			"snippet": compactText(content, 220),
+		})
+	}
+	if r.TextTools && !r.buffering {
+		candidate := content
+		if r.partialTag != "" {
+			candidate = r.partialTag + content
+		}
+		recognized, possible := classifyPromptToolMarkup(candidate, r.PromptTools)
+		switch {
+		case !recognized && possible:
+			r.partialTag = candidate
+			return true
+		case recognized:
+			r.buffering = true
+			r.buffer = candidate
+			r.partialTag = ""
+			r.toolFormat = "text-tool"
+			return true
+		case len(r.Content) < 50 && looksLikeJSONToolCallPrefix(candidate):
+			content = candidate
+			r.partialTag = ""
+		case len(r.Content) < 50 && looksLikeJSONToolCallPossiblePrefix(candidate):
+			r.partialTag = candidate
+			return true
+		case r.partialTag != "":
+			content = candidate
+			r.partialTag = ""
+		}
+	}
+	if r.TextTools && r.toolFormat == "" && !r.buffering && len(r.Content) < 50 && looksLikeJSONToolCallPrefix(content) {
+		r.endReasoning()
+		r.buffering = true
+		r.buffer = content
+		return true
+	}
+	r.enterPhase("answering")
+	r.endReasoning()
+	r.Content += content
+	r.Sink.Record("assistant", "message.delta", map[string]interface{}{
+		"type":         "message.delta",
+		"content":      content,
+		"full_content": r.Content,
+	})
+	return false
+}
+
+// bufferCompletionContent extends a buffered textual tool call in the
+// format detected for it and accepts the call once it parses.
+func (r *ChatRound) bufferCompletionContent(delta map[string]interface{}) {
+	content, ok := delta["content"].(string)
+	if !ok {
+		if content, ok = delta["reasoning_content"].(string); !ok {
+			content, _ = delta["reasoning"].(string)
+		}
+	}
+	r.buffer += content
+
+	if r.toolFormat == "text-tool" {
+		if name, argsJSON, args, ok := chatharness.ParsePromptToolMarkup(r.buffer); ok && isRegisteredPromptTool(name, r.PromptTools) {
+			r.acceptTextCall(name, argsJSON, args, false)
+			r.toolFormat = ""
+			return
+		}
+		if hasPromptToolClosingTag(r.buffer, r.PromptTools) {
+			r.quarantine(r.buffer)
+			r.buffer, r.buffering, r.toolFormat = "", false, ""
+		}
+		return
+	}
+
+	if matches := r.toolRegex.FindStringSubmatch(r.buffer); len(matches) > 2 {
+		name := matches[1]
+		if strings.Contains(name, "<|channel|>") {
+			// Command-R and GPT-OSS name the tool in a to=... attribute;
+			// a generic "functions" target is resolved from the JSON.
+			if target := channelToolTargetPattern.FindStringSubmatch(name); len(target) > 1 {
+				name = target[1]
+			}
+		}
+		name, argsJSON, args, _ := chatharness.NormalizeBufferedToolMatch(name, matches[2])
+		if args == nil {
+			args = argsJSON
+		}
+		r.acceptTextCall(name, argsJSON, args, true)
+		return
+	}
+	if name, argsJSON, args, ok := chatharness.ParseXMLLikeToolCall(r.buffer); ok {
+		r.acceptTextCall(name, argsJSON, args, true)
+		return
+	}
+	if name, argsJSON, args, ok := chatharness.ParseBareToolCallTag(r.buffer, r.OriginalUserText); ok {
+		r.acceptTextCall(name, argsJSON, args, true)
+		return
+	}
+
+	if len(r.buffer) > bufferingThreshold {
+		// Nothing matched; release the buffer unless it is tool markup.
+		lower := strings.ToLower(r.buffer)
+		if (strings.Contains(lower, "function") || strings.Contains(lower, "call") || strings.Contains(lower, "tool")) &&
+			strings.Contains(lower, "{") && strings.Contains(lower, "}") {
+			r.quarantine(r.buffer)
+		}
+		if looksLikeToolMarkup(r.buffer) {
+			r.trace("tool.quarantine", "Suppressed oversized raw tool markup buffer", map[string]interface{}{
+				"snippet": compactText(r.buffer, 220),
+			})
+		} else {
+			r.sendContent(r.buffer)
+			r.Content += r.buffer
+		}
+		r.buffer = ""
+	}
+}
+
+// detectCompletionToolMarkup switches to buffering when a delta starts a
+// Command-R, GPT-OSS or Qwen style call, and otherwise flags content that
+// looks like a call the model failed to format. It reports whether the
+// delta was held back.
+func (r *ChatRound) detectCompletionToolMarkup(delta map[string]interface{}) bool {
+	content, ok := delta["content"].(string)
+	if !ok {
+		if content, ok = delta["reasoning_content"].(string); !ok {
+			content, _ = delta["reasoning"].(string)
+		}
+	}
+	if cleaned, changed := sanitizeLeakedModelChannelContent(content); changed {
+		content = cleaned
+	}
+	if !r.TextTools {
+		return false
+	}
+	if !r.buffering && startsChannelToolCall(content) {
+		r.buffering = true
+		r.buffer = content
+		if strings.Contains(content, "<tool_call>") {
+			// Qwen: <tool_call>{JSON}</tool_call>, optionally naming the tool.
+			r.toolFormat, r.toolRegex = "qwen", qwenToolCallPattern
+		} else {
+			// Command-R / GPT-OSS: <|channel|>...<|message|> {JSON}
+			r.toolFormat, r.toolRegex = "command-r", channelToolCallPattern
+		}
+		return true
+	}
+	if len(content) > 5 && (mentionsToolCall(content) || mentionsToolName(content)) {
+		lower := strings.ToLower(content)
+		// Regexes and code samples that discuss tool calls are not calls.
+		isMeta := strings.Contains(lower, "(?s)") ||
+			strings.Contains(lower, "regex") ||
+			strings.Contains(lower, "tool_call[") ||
+			strings.Contains(lower, "tool_call [") ||
+			strings.Contains(lower, "```")
+		// A real attempt carries JSON-like structure or special tokens.
+		structured := strings.Contains(lower, "<|") || (strings.Contains(lower, "{") && strings.Contains(lower, ":"))
+		if !isMeta && structured {
+			log.Printf("[orchestrator] Invalid tool pattern detected in content: %s", content)
+			r.quarantine(content)
+		}
+	}
+	return false
+}
+
+// startsChannelToolCall reports content that opens a Command-R, GPT-OSS or
+// Qwen style call.
+func startsChannelToolCall(content string) bool {
+	if looksLikeChannelToolMarkup(content) {
+		return true
+	}
+	for _, marker := range []string{"<|tool_code|>", "<tool_call>", "<execute_command", "<search_memory", "<read_memory", "<read_buffered_source", "<read_help"} {
+		if strings.Contains(content, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionsToolCall reports content using tool-call vocabulary; callers
+// decide whether it is structured enough to be a failed call.
+func mentionsToolCall(content string) bool {
+	lower := strings.ToLower(content)
+	return strings.Contains(lower, "<|") ||
+		strings.Contains(lower, "function") ||
+		strings.Contains(lower, "tool") ||
+		strings.Contains(lower, "execute") ||
+		(strings.Contains(lower, "{\"") && strings.Contains(lower, "args"))
+}
+
+// mentionsToolName reports content naming one of the gateway's web,
+// memory or document tools.
+func mentionsToolName(content string) bool {
+	lower := strings.ToLower(content)
+	for _, name := range []string{"search_web", "personal_memory", "read_user_document", "read_web_page", "read_buffered_source", "read_help"} {
+		if strings.Contains(lower, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// completionDelta returns the first choice of a Chat Completions chunk and
+// its delta, or its message for non-streamed chunks.
+func completionDelta(chunk map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	choices, _ := chunk["choices"].([]interface{})
+	if len(choices) == 0 {
+		return nil, nil
+	}
+	choice, _ := choices[0].(map[string]interface{})
+	delta, _ := choice["delta"].(map[string]interface{})
+	if delta == nil {
+		delta, _ = choice["message"].(map[string]interface{})
+	}
+	return choice, delta
+}
+
+func copyPayload(chunk map[string]interface{}) map[string]interface{} {
+	payload := make(map[string]interface{}, len(chunk)+1)
+	for key, value := range chunk {
+		payload[key] = value
+	}
+	return payload
+}
@@ -0,0 +1,502 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/promptkit"
+)
+
+// recordingSink keeps the sent lines and the recorded event types, leaving
+// out generation.* progress events.
+type recordingSink struct {
+	types []string
+	lines []string
+}
+
+func (s *recordingSink) Send(line string) { s.lines = append(s.lines, line) }
+
+func (s *recordingSink) Record(role, eventType string, payload interface{}) {
+	if !strings.HasPrefix(eventType, "generation.") {
+		s.types = append(s.types, eventType)
+	}
+}
+
+func (s *recordingSink) has(eventType string) bool {
+	for _, recorded := range s.types {
+		if recorded == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// sse joins provider chunks into one SSE response body.
+func sse(chunks ...string) string {
+	var out strings.Builder
+	for _, chunk := range chunks {
+		out.WriteString("data: " + chunk + "\n\n")
+	}
+	return out.String()
+}
+
+// contentChunk is a Chat Completions chunk carrying answer text.
+func contentChunk(content string) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"choices": []interface{}{map[string]interface{}{"delta": map[string]interface{}{"content": content}}},
+	})
+	return string(data)
+}
+
+const (
+	timeCallChunk1 = `{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_time","arguments":"{\"tz\":"}}]}}]}`
+	timeCallChunk2 = `{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"UTC\"}"}}]}}]}`
+	noonChunk      = `{"choices":[{"delta":{"content":"It is noon."}}]}`
+)
+
+func echoTools(calls *[]chatharness.ProviderToolCall) Tools {
+	return ToolsFunc(func(ctx context.Context, turn int, batch []chatharness.ProviderToolCall) []ToolResult {
+		results := make([]ToolResult, 0, len(batch))
+		for _, call := range batch {
+			*calls = append(*calls, call)
+			result := ToolResult{ToolCallOutcome: chatharness.ToolCallOutcome{ID: call.ID, Name: call.Name, Arguments: call.Arguments, Result: call.Name + " ok"}}
+			if call.Name == "broken" {
+				result.Result = ""
+				result.Err = errors.New("unavailable")
+			}
+			results = append(results, result)
+		}
+		return results
+	})
+}
+
+func requestMessages(t *testing.T, body []byte) []map[string]interface{} {
+	t.Helper()
+	var req struct {
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("decode request: %v", err)
+	}
+	return req.Messages
+}
+
+func requestField(t *testing.T, body []byte, field string) interface{} {
+	t.Helper()
+	var req map[string]interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("decode request: %v", err)
+	}
+	return req[field]
+}
+
+func newTestRound(sink Sink, tools Tools, mode string) *ChatRound {
+	reqMap := map[string]interface{}{"model": "test-model", "messages": []interface{}{map[string]interface{}{"role": "user", "content": "hi"}}}
+	body, _ := json.Marshal(reqMap)
+	return &ChatRound{
+		Sink:    sink,
+		Tools:   tools,
+		LLMMode: mode,
+		ModelID: "test-model",
+		ReqMap:  reqMap,
+		Body:    body,
+	}
+}
+
+func TestChatRound(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		parallel   bool
+		rounds     []scriptedRound
+		wantErr    bool
+		wantCalls  []string
+		wantTypes  []string
+		wantAnswer string
+		check      func(t *testing.T, requests []Request)
+	}{
+		{
+			name:       "plain answer",
+			rounds:     []scriptedRound{{stream: sse(`{"choices":[{"delta":{"content":"Hi"}}]}`, `{"choices":[{"delta":{"content":" there"}}]}`, "[DONE]")}},
+			wantTypes:  []string{"message.delta", "message.delta"},
+			wantAnswer: "Hi there",
+		},
+		{
+			name: "reasoning then answer",
+			rounds: []scriptedRound{{stream: sse(
+				`{"choices":[{"delta":{"reasoning_content":"thinking"}}]}`,
+				`{"choices":[{"delta":{"content":"Done."}}]}`,
+			)}},
+			wantTypes:  []string{"reasoning.start", "reasoning.delta", "reasoning.end", "message.delta"},
+			wantAnswer: "Done.",
+		},
+		{
+			name: "streamed tool call then answer",
+			rounds: []scriptedRound{
+				{stream: sse(timeCallChunk1, timeCallChunk2, "[DONE]")},
+				{stream: sse(noonChunk, "[DONE]")},
+			},
+			wantCalls:  []string{`get_time {"tz":"UTC"}`},
+			wantTypes:  []string{"tool_call.start", "tool_call.arguments", "tool_call.success", "message.delta"},
+			wantAnswer: "It is noon.",
+			check: func(t *testing.T, requests []Request) {
+				messages := requestMessages(t, requests[1].Body)
+				if len(messages) != 3 || messages[1]["role"] != "assistant" || messages[2]["role"] != "tool" || messages[2]["tool_call_id"] != "call_1" {
+					t.Fatalf("follow-up messages = %v", messages)
+				}
+			},
+		},
+		{
+			name: "sequential mode runs the first call only",
+			rounds: []scriptedRound{
+				{stream: sse(`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"a","function":{"name":"one","arguments":"{}"}},{"index":1,"id":"b","function":{"name":"two","arguments":"{}"}}]}}]}`)},
+				{stream: sse(noonChunk)},
+			},
+			wantCalls:  []string{"one {}"},
+			wantTypes:  []string{"tool_call.start", "tool_call.arguments", "tool_call.success", "message.delta"},
+			wantAnswer: "It is noon.",
+		},
+		{
+			name:     "adapter events with parallel calls and response chaining",
+			mode:     chatharness.LLMModeResponses,
+			parallel: true,
+			rounds: []scriptedRound{
+				{stream: sse(
+					`{"type":"tool_call.start","tool":"search_web"}`,
+					`{"type":"tool_call.arguments","tool":"search_web","call_id":"c1","arguments":{"query":"go"}}`,
+					`{"type":"tool_call.arguments","tool":"broken","call_id":"c2","arguments":"{}"}`,
+					`{"type":"chat.end","result":{"response_id":"resp_1"}}`,
+				)},
+				{stream: sse(`{"type":"message.delta","content":"Found it."}`, `{"type":"chat.end","result":{"response_id":"resp_2"}}`)},
+			},
+			wantCalls: []string{`search_web {"query":"go"}`, "broken {}"},
+			wantTypes: []string{
+				"tool_call.start", "tool_call.arguments", "tool_call.start", "tool_call.arguments",
+				"tool_call.success", "tool_call.failure", "message.delta", "chat.end",
+			},
+			wantAnswer: "Found it.",
+			check: func(t *testing.T, requests []Request) {
+				if got := requestField(t, requests[1].Body, "previous_response_id"); got != "resp_1" {
+					t.Fatalf("follow-up previous_response_id = %v", got)
+				}
+				messages := requestMessages(t, requests[1].Body)
+				if content, _ := messages[len(messages)-1]["content"].(string); !strings.Contains(content, "unavailable") {
+					t.Fatalf("failed call result = %q", content)
+				}
+			},
+		},
+		{
+			name:      "stream error event ends the loop",
+			rounds:    []scriptedRound{{stream: sse(`{"type":"error","error":{"message":"context overflow"}}`, `{"choices":[{"delta":{"content":"late"}}]}`)}},
+			wantTypes: []string{"error"},
+		},
+		{
+			name:      "transport failure is returned",
+			rounds:    []scriptedRound{{err: &StatusError{StatusCode: 500, Body: "boom"}}},
+			wantErr:   true,
+			wantTypes: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := tt.mode
+			if mode == "" {
+				mode = "standard"
+			}
+			transport := &scriptedTransport{rounds: tt.rounds}
+			sink := &recordingSink{}
+			var calls []chatharness.ProviderToolCall
+			round := newTestRound(sink, echoTools(&calls), mode)
+			round.ParallelToolCalls = tt.parallel
+			round.Native = mode == chatharness.LLMModeResponses
+			round.PromptTools = []promptkit.ToolDefinition{{Name: "search_web"}, {Name: "broken"}}
+			round.MaxTurns = 4
+			err := Engine{Transport: transport, MaxTurns: 4}.Run(context.Background(), round.Body, round)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var gotCalls []string
+			for _, call := range calls {
+				gotCalls = append(gotCalls, call.Name+" "+call.Arguments)
+			}
+			if !reflect.DeepEqual(gotCalls, tt.wantCalls) {
+				t.Fatalf("calls = %v, want %v", gotCalls, tt.wantCalls)
+			}
+			if !reflect.DeepEqual(sink.types, tt.wantTypes) {
+				t.Fatalf("events = %v, want %v", sink.types, tt.wantTypes)
+			}
+			if round.Complete() != tt.wantAnswer {
+				t.Fatalf("content = %q, want %q", round.Content, tt.wantAnswer)
+			}
+			if tt.check != nil {
+				tt.check(t, transport.requests)
+			}
+		})
+	}
+}
+
+func TestChatRoundStopsAtTurnBudget(t *testing.T) {
+	transport := &scriptedTransport{}
+	for i := 0; i < 5; i++ {
+		call := fmt.Sprintf(`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_%d","function":{"name":"get_time","arguments":"{\"tz\":\"UTC+%d\"}"}}]}}]}`, i, i)
+		transport.rounds = append(transport.rounds, scriptedRound{stream: sse(call)})
+	}
+	var calls []chatharness.ProviderToolCall
+	round := newTestRound(&recordingSink{}, echoTools(&calls), "standard")
+	round.MaxTurns = 3
+	if err := (Engine{Transport: transport, MaxTurns: 3}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(transport.requests) != 3 || len(calls) != 3 {
+		t.Fatalf("requests = %d, calls = %d, want 3 each", len(transport.requests), len(calls))
+	}
+}
+
+func TestChatRoundSkipsDuplicateCalls(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(timeCallChunk1, timeCallChunk2)},
+		{stream: sse(strings.Replace(timeCallChunk1, "call_1", "call_2", 1), timeCallChunk2)},
+		{stream: sse(noonChunk)},
+	}}
+	var calls []chatharness.ProviderToolCall
+	round := newTestRound(&recordingSink{}, echoTools(&calls), "standard")
+	if err := (Engine{Transport: transport}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("calls = %v, want the repeated call skipped", calls)
+	}
+	messages := requestMessages(t, transport.requests[2].Body)
+	if content, _ := messages[len(messages)-1]["content"].(string); !strings.Contains(content, "Duplicate tool call prevented") {
+		t.Fatalf("duplicate result = %q", content)
+	}
+	if _, hasTools := requestField(t, transport.requests[2].Body, "tools").([]interface{}); hasTools {
+		t.Fatal("a duplicate call must be followed by a final-answer-only round")
+	}
+}
+
+func TestChatRoundPassesClientCallsThrough(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(timeCallChunk1, timeCallChunk2, `{"choices":[{"delta":{},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":12,"completion_tokens":5}}`)},
+		{stream: sse(
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"a","function":{"name":"lookup_order","arguments":"{}"}},{"index":1,"id":"b","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+			`{"type":"chat.end","result":{"stop_reason":"tool_use","stats":{"input_tokens":20,"total_output_tokens":7}}}`,
+		)},
+	}}
+	var calls []chatharness.ProviderToolCall
+	round := newTestRound(&recordingSink{}, echoTools(&calls), "standard")
+	round.Passthrough = func(name string) bool { return name != "get_time" }
+	if err := (Engine{Transport: transport, MaxTurns: 4}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(calls) != 1 || calls[0].Name != "get_time" {
+		t.Fatalf("gateway ran %v, want only get_time", calls)
+	}
+	if len(round.ToolCalls) != 1 || round.ToolCalls[0].Name != "lookup_order" || round.ToolCalls[0].ID != "a" {
+		t.Fatalf("passthrough calls = %v", round.ToolCalls)
+	}
+	if round.FinishReason != "tool_use" {
+		t.Fatalf("finish reason = %q", round.FinishReason)
+	}
+	if round.Usage != (Usage{PromptTokens: 32, CompletionTokens: 12}) {
+		t.Fatalf("usage = %+v", round.Usage)
+	}
+	if round.LastUsage != (Usage{PromptTokens: 20, CompletionTokens: 7}) {
+		t.Fatalf("last usage = %+v", round.LastUsage)
+	}
+}
+
+func TestChatRoundReportsGatewayCallsSkippedInMixedRound(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"a","function":{"name":"lookup_order","arguments":"{}"}},{"index":1,"id":"b","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+			`{"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+		)},
+	}}
+	failures := map[string]string{}
+	sink := SinkFuncs{RecordFunc: func(role, eventType string, payload interface{}) {
+		if event, _ := payload.(map[string]interface{}); eventType == "tool_call.failure" {
+			callID, _ := event["call_id"].(string)
+			failures[callID], _ = event["reason"].(string)
+		}
+	}}
+	var calls []chatharness.ProviderToolCall
+	round := newTestRound(sink, echoTools(&calls), "standard")
+	round.Passthrough = func(name string) bool { return name != "get_time" }
+	if err := (Engine{Transport: transport, MaxTurns: 4}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("gateway ran %v in a round handed back to the client", calls)
+	}
+	if len(round.ToolCalls) != 1 || round.ToolCalls[0].ID != "a" {
+		t.Fatalf("passthrough calls = %v", round.ToolCalls)
+	}
+	if len(failures) != 1 || !strings.Contains(failures["b"], "client tools") {
+		t.Fatalf("skipped gateway call was not reported: %v", failures)
+	}
+}
+
+func TestChatRoundRunsTextualToolCall(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(
+			contentChunk("```json\n"),
+			contentChunk(`{"name":"read_buffered_source","arguments":{"source_id":"src_1","query":"theme"}}`),
+			contentChunk("\n```"),
+			"[DONE]",
+		)},
+		{stream: sse(contentChunk("Open the settings."), "[DONE]")},
+	}}
+	sink := &recordingSink{}
+	var calls []chatharness.ProviderToolCall
+	round := newTestRound(sink, echoTools(&calls), "standard")
+	round.TextTools = true
+	round.PromptTools = []promptkit.ToolDefinition{{Name: "read_buffered_source"}}
+	if err := (Engine{Transport: transport}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(calls) != 1 || calls[0].Name != "read_buffered_source" || !strings.Contains(calls[0].Arguments, "src_1") {
+		t.Fatalf("calls = %v", calls)
+	}
+	if answer := round.Complete(); answer != "Open the settings." {
+		t.Fatalf("answer = %q", answer)
+	}
+	for _, line := range sink.lines {
+		if strings.Contains(line, "```") {
+			t.Fatalf("tool wrapper leaked to the client: %s", line)
+		}
+	}
+	if !sink.has("tool_call.success") {
+		t.Fatalf("events = %v", sink.types)
+	}
+}
+
+func TestChatRoundSelfCorrectsMalformedToolCall(t *testing.T) {
+	malformed := `Calling function search_web with {"query": "go"`
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(contentChunk(malformed), "[DONE]")},
+		{stream: sse(contentChunk("Here is the answer."), "[DONE]")},
+	}}
+	var calls []chatharness.ProviderToolCall
+	round := newTestRound(&recordingSink{}, echoTools(&calls), "standard")
+	round.TextTools = true
+	round.PromptTools = []promptkit.ToolDefinition{{Name: "search_web"}}
+	if err := (Engine{Transport: transport}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(transport.requests) != 2 || len(calls) != 0 {
+		t.Fatalf("requests = %d, calls = %v", len(transport.requests), calls)
+	}
+	messages := requestMessages(t, transport.requests[1].Body)
+	last := messages[len(messages)-1]
+	if last["role"] != "user" || messages[len(messages)-2]["content"] != malformed {
+		t.Fatalf("correction messages = %v", messages)
+	}
+	if got := requestField(t, transport.requests[1].Body, "temperature"); got != 0.1 {
+		t.Fatalf("correction temperature = %v", got)
+	}
+	if round.MalformedToolCall() != "" {
+		t.Fatalf("corrected call still reported: %q", round.MalformedToolCall())
+	}
+}
+
+func TestChatRoundResetsStalePreviousResponse(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{err: &StatusError{StatusCode: 400, Body: `{"error":"previous_response_not_found"}`}},
+		{stream: sse(`{"type":"message.delta","content":"Fresh start."}`, `{"type":"chat.end","result":{"response_id":"resp_new"}}`)},
+	}}
+	sink := &recordingSink{}
+	round := newTestRound(sink, nil, "stateful")
+	round.ReqMap = map[string]interface{}{"model": "test-model", "input": "hi", "previous_response_id": "resp_old"}
+	round.Body, _ = json.Marshal(round.ReqMap)
+	round.ResponseID = "resp_old"
+	var reset string
+	var ids []string
+	round.OnStatefulReset = func(reason string) { reset = reason }
+	round.OnResponseID = func(id string) { ids = append(ids, id) }
+	if err := (Engine{Transport: transport}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := requestField(t, transport.requests[1].Body, "previous_response_id"); got != nil {
+		t.Fatalf("retry still chains %v", got)
+	}
+	if reset != "invalid_previous_response_id" || !sink.has("stateful.reset") {
+		t.Fatalf("reset = %q, events = %v", reset, sink.types)
+	}
+	if !reflect.DeepEqual(ids, []string{"", "resp_new"}) || round.ResponseID != "resp_new" {
+		t.Fatalf("response ids = %v, final %q", ids, round.ResponseID)
+	}
+}
+
+func TestChatRoundFailsOverBeforeStreaming(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{err: &StatusError{StatusCode: 503, Body: "down"}},
+		{stream: sse(noonChunk)},
+	}}
+	round := newTestRound(&recordingSink{}, nil, "standard")
+	var failures []error
+	round.Failover = func(err error) (string, bool) {
+		failures = append(failures, err)
+		return "backup-model", len(failures) == 1
+	}
+	if err := (Engine{Transport: transport}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if transport.requests[1].Turn != 0 || requestField(t, transport.requests[1].Body, "model") != "backup-model" {
+		t.Fatalf("failover request = turn %d, body %s", transport.requests[1].Turn, transport.requests[1].Body)
+	}
+	if round.Content != "It is noon." {
+		t.Fatalf("content = %q", round.Content)
+	}
+}
+
+func TestChatRoundReturnsTurnErrorWithStatus(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{{err: &StatusError{StatusCode: 401, Body: "invalid_api_key"}}}}
+	round := newTestRound(&recordingSink{}, nil, "standard")
+	err := (Engine{Transport: transport}).Run(context.Background(), round.Body, round)
+	var turnErr *TurnError
+	var statusErr *StatusError
+	if !errors.As(err, &turnErr) || turnErr.Turn != 0 || !errors.As(err, &statusErr) || statusErr.StatusCode != 401 {
+		t.Fatalf("Run error = %v", err)
+	}
+}
+
+func TestChatRoundRepairsStructuredAnswer(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(contentChunk("Sure, here it is"), "[DONE]")},
+		{stream: sse(contentChunk(`{"ok":true}`), "[DONE]")},
+	}}
+	sink := &recordingSink{}
+	round := newTestRound(sink, nil, "standard")
+	round.Format = &chatharness.ResponseFormat{Type: chatharness.ResponseFormatJSONObject}
+	round.HoldAnswer = true
+	if err := (Engine{Transport: transport}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(transport.requests) != 2 || round.StructuredRepairs() != 1 || !sink.has("response_format.repair") {
+		t.Fatalf("requests = %d, repairs = %d, events = %v", len(transport.requests), round.StructuredRepairs(), sink.types)
+	}
+	if round.Content != `{"ok":true}` {
+		t.Fatalf("content = %q", round.Content)
+	}
+}
+
+func TestChatRoundRecoversAnswerLeftInReasoning(t *testing.T) {
+	transport := &scriptedTransport{rounds: []scriptedRound{
+		{stream: sse(`{"choices":[{"delta":{"reasoning_content":"Let me think. The user said hi"}}]}`, "[DONE]")},
+		{stream: sse(contentChunk("Hello!"), "[DONE]")},
+	}}
+	round := newTestRound(&recordingSink{}, nil, "standard")
+	if err := (Engine{Transport: transport}).Run(context.Background(), round.Body, round); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(transport.requests) != 2 || round.Complete() != "Hello!" {
+		t.Fatalf("requests = %d, answer = %q", len(transport.requests), round.Content)
+	}
+}
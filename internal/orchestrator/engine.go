@@ -0,0 +1,166 @@
+// Package orchestrator runs the multi-round chat loop independently of HTTP.
+// An Engine sends each round's request through a Transport and hands the
+// response stream to a Round, which reports what the model did and decides
+// whether another round follows. Rounds emit app-contract events through a
+// Sink, so the whole loop can be driven by scripted providers in tests.
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// DefaultMaxTurns bounds the rounds of one request when Engine.MaxTurns is
+// unset.
+const DefaultMaxTurns = 10
+
+// maxRetriesPerTurn stops a Round that keeps asking to retry the same round.
+const maxRetriesPerTurn = 8
+
+// Request is one upstream round.
+type Request struct {
+	Turn int
+	// Body is the working request in Chat Completions (or LM Studio
+	// stateful) shape; the Transport encodes it for the provider.
+	Body []byte
+}
+
+// Transport delivers one round to the upstream and returns its response
+// stream. A non-2xx answer is reported as *StatusError.
+type Transport interface {
+	Open(ctx context.Context, req Request) (io.ReadCloser, error)
+}
+
+// StatusError is an upstream answer with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the upstream's Retry-After hint, zero when absent.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream returned HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+type stepAction int
+
+const (
+	stepDone stepAction = iota
+	stepNext
+	stepRetry
+)
+
+// Step is a Round's decision after a round.
+type Step struct {
+	action stepAction
+	body   []byte
+}
+
+// Done ends the loop.
+func Done() Step { return Step{action: stepDone} }
+
+// Next sends body as the following round.
+func Next(body []byte) Step { return Step{action: stepNext, body: body} }
+
+// Retry sends body again as the same round without consuming a turn, for
+// failures before anything streamed.
+func Retry(body []byte) Step { return Step{action: stepRetry, body: body} }
+
+// Round is the per-request logic the Engine drives. Begin starts every
+// attempt of a round; Failed handles a Transport error; Stream consumes a
+// successful response; Finish decides what follows it. An error from
+// Failed, Stream or Finish ends Run with that error.
+type Round interface {
+	Begin(ctx context.Context, turn int)
+	Failed(ctx context.Context, turn int, err error) (Step, error)
+	Stream(ctx context.Context, turn int, stream io.Reader) error
+	Finish(ctx context.Context, turn int) (Step, error)
+}
+
+// RoundFuncs adapts plain functions to Round. Nil functions fall back to
+// doing nothing, returning the transport error, and ending the loop.
+type RoundFuncs struct {
+	BeginFunc  func(ctx context.Context, turn int)
+	FailedFunc func(ctx context.Context, turn int, err error) (Step, error)
+	StreamFunc func(ctx context.Context, turn int, stream io.Reader) error
+	FinishFunc func(ctx context.Context, turn int) (Step, error)
+}
+
+func (f RoundFuncs) Begin(ctx context.Context, turn int) {
+	if f.BeginFunc != nil {
+		f.BeginFunc(ctx, turn)
+	}
+}
+
+func (f RoundFuncs) Failed(ctx context.Context, turn int, err error) (Step, error) {
+	if f.FailedFunc != nil {
+		return f.FailedFunc(ctx, turn, err)
+	}
+	return Done(), err
+}
+
+func (f RoundFuncs) Stream(ctx context.Context, turn int, stream io.Reader) error {
+	if f.StreamFunc != nil {
+		return f.StreamFunc(ctx, turn, stream)
+	}
+	_, err := io.Copy(io.Discard, stream)
+	return err
+}
+
+func (f RoundFuncs) Finish(ctx context.Context, turn int) (Step, error) {
+	if f.FinishFunc != nil {
+		return f.FinishFunc(ctx, turn)
+	}
+	return Done(), nil
+}
+
+// Engine is the turn loop. It holds no per-request state and may be reused.
+type Engine struct {
+	Transport Transport
+	MaxTurns  int
+}
+
+// Run drives round from body until it returns Done, fails, or the turn
+// budget is spent. Running out of turns is not an error.
+func (e Engine) Run(ctx context.Context, body []byte, round Round) error {
+	maxTurns := e.MaxTurns
+	if maxTurns <= 0 {
+		maxTurns = DefaultMaxTurns
+	}
+	retries := 0
+	for turn := 0; turn < maxTurns; turn++ {
+		round.Begin(ctx, turn)
+		stream, err := e.Transport.Open(ctx, Request{Turn: turn, Body: body})
+		var step Step
+		if err != nil {
+			step, err = round.Failed(ctx, turn, err)
+		} else {
+			err = round.Stream(ctx, turn, stream)
+			stream.Close()
+			if err == nil {
+				step, err = round.Finish(ctx, turn)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		switch step.action {
+		case stepDone:
+			return nil
+		case stepRetry:
+			retries++
+			if retries > maxRetriesPerTurn {
+				return fmt.Errorf("orchestrator: round %d retried %d times", turn, maxRetriesPerTurn)
+			}
+			turn--
+		default:
+			retries = 0
+		}
+		body = step.body
+	}
+	return nil
+}
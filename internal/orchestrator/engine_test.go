@@ -0,0 +1,154 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scriptedTransport answers round i with rounds[i] and records the bodies it
+// was sent. A round with err set fails instead of streaming.
+type scriptedTransport struct {
+	rounds   []scriptedRound
+	requests []Request
+}
+
+type scriptedRound struct {
+	stream string
+	err    error
+}
+
+func (s *scriptedTransport) Open(ctx context.Context, req Request) (io.ReadCloser, error) {
+	index := len(s.requests)
+	s.requests = append(s.requests, req)
+	if index >= len(s.rounds) {
+		return nil, errors.New("script exhausted")
+	}
+	if s.rounds[index].err != nil {
+		return nil, s.rounds[index].err
+	}
+	return io.NopCloser(strings.NewReader(s.rounds[index].stream)), nil
+}
+
+func TestEngineRun(t *testing.T) {
+	errBoom := errors.New("boom")
+	tests := []struct {
+		name      string
+		rounds    []scriptedRound
+		maxTurns  int
+		failed    func(turn int, err error) (Step, error)
+		finish    func(turn int) (Step, error)
+		wantErr   error
+		wantTurns []int
+		wantBody  []string
+	}{
+		{
+			name:      "done after first round",
+			rounds:    []scriptedRound{{stream: "a"}},
+			wantTurns: []int{0},
+			wantBody:  []string{"start"},
+		},
+		{
+			name:   "next until done",
+			rounds: []scriptedRound{{stream: "a"}, {stream: "b"}, {stream: "c"}},
+			finish: func(turn int) (Step, error) {
+				if turn == 2 {
+					return Done(), nil
+				}
+				return Next([]byte{byte('1' + turn)}), nil
+			},
+			wantTurns: []int{0, 1, 2},
+			wantBody:  []string{"start", "1", "2"},
+		},
+		{
+			name:   "retry keeps the turn",
+			rounds: []scriptedRound{{err: errBoom}, {stream: "a"}},
+			failed: func(turn int, err error) (Step, error) {
+				return Retry([]byte("again")), nil
+			},
+			wantTurns: []int{0, 0},
+			wantBody:  []string{"start", "again"},
+		},
+		{
+			name:      "transport error ends the loop",
+			rounds:    []scriptedRound{{err: errBoom}},
+			wantErr:   errBoom,
+			wantTurns: []int{0},
+			wantBody:  []string{"start"},
+		},
+		{
+			name:     "turn budget",
+			rounds:   []scriptedRound{{stream: "a"}, {stream: "b"}, {stream: "c"}},
+			maxTurns: 2,
+			finish: func(turn int) (Step, error) {
+				return Next([]byte("more")), nil
+			},
+			wantTurns: []int{0, 1},
+			wantBody:  []string{"start", "more"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &scriptedTransport{rounds: tt.rounds}
+			var begun []int
+			round := RoundFuncs{
+				BeginFunc: func(ctx context.Context, turn int) { begun = append(begun, turn) },
+			}
+			if tt.failed != nil {
+				round.FailedFunc = func(ctx context.Context, turn int, err error) (Step, error) { return tt.failed(turn, err) }
+			}
+			if tt.finish != nil {
+				round.FinishFunc = func(ctx context.Context, turn int) (Step, error) { return tt.finish(turn) }
+			}
+			err := Engine{Transport: transport, MaxTurns: tt.maxTurns}.Run(context.Background(), []byte("start"), round)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run error = %v, want %v", err, tt.wantErr)
+			}
+			if got, want := len(begun), len(tt.wantTurns); got != want {
+				t.Fatalf("begun turns = %v, want %v", begun, tt.wantTurns)
+			}
+			for i, req := range transport.requests {
+				if req.Turn != tt.wantTurns[i] || string(req.Body) != tt.wantBody[i] {
+					t.Fatalf("request %d = turn %d body %q, want turn %d body %q", i, req.Turn, req.Body, tt.wantTurns[i], tt.wantBody[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEngineStopsRetryingForever(t *testing.T) {
+	transport := &scriptedTransport{}
+	for i := 0; i <= maxRetriesPerTurn+1; i++ {
+		transport.rounds = append(transport.rounds, scriptedRound{err: errors.New("down")})
+	}
+	round := RoundFuncs{FailedFunc: func(ctx context.Context, turn int, err error) (Step, error) {
+		return Retry([]byte("again")), nil
+	}}
+	if err := (Engine{Transport: transport}).Run(context.Background(), []byte("start"), round); err == nil {
+		t.Fatal("expected an error once retries are exhausted")
+	}
+	if got, want := len(transport.requests), maxRetriesPerTurn+1; got != want {
+		t.Fatalf("requests = %d, want %d", got, want)
+	}
+}
+
+func TestHTTPTransportReportsStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	transport := &HTTPTransport{URL: server.URL, Token: "secret"}
+	_, err := transport.Open(context.Background(), Request{Body: []byte(`{}`)})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable || !strings.Contains(statusErr.Body, "model not loaded") {
+		t.Fatalf("Open error = %v, want 503 StatusError", err)
+	}
+}
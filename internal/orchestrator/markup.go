@@ -0,0 +1,249 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"dinkisstyle-chat/internal/chatharness"
+	"dinkisstyle-chat/internal/promptkit"
+)
+
+// Models without native function calling write their calls into the answer.
+// These helpers decide which streamed text is such a call, so a ChatRound
+// can hold it back from the client until it parses or is quarantined.
+
+func looksLikeJSONToolCallPrefix(raw string) bool {
+	trimmed := strings.ToLower(strings.TrimSpace(raw))
+	return strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "```json")
+}
+
+func looksLikeJSONToolCallPossiblePrefix(raw string) bool {
+	trimmed := strings.ToLower(strings.TrimSpace(raw))
+	if trimmed == "" {
+		return false
+	}
+	for _, marker := range []string{"```json", "{"} {
+		if strings.HasPrefix(marker, trimmed) {
+			return true
+		}
+	}
+	return false
+}
+
+func looksLikeToolMarkup(raw string) bool {
+	trimmed := strings.ToLower(strings.TrimSpace(raw))
+	if trimmed == "" {
+		return false
+	}
+	if _, _, _, ok := chatharness.ParseJSONToolCall(raw); ok {
+		return true
+	}
+	hasToolName := strings.Contains(trimmed, `"tool"`) ||
+		strings.Contains(trimmed, `"name"`) ||
+		strings.Contains(trimmed, `"tool_name"`)
+	hasToolArguments := strings.Contains(trimmed, `"arguments"`) ||
+		strings.Contains(trimmed, `"tool_arguments"`) ||
+		strings.Contains(trimmed, `"parameters"`) ||
+		strings.Contains(trimmed, `"params"`)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "```json")) && hasToolName && hasToolArguments {
+		return true
+	}
+	markers := []string{
+		"<tool_call",
+		"</tool_call",
+		"<tool_code",
+		"</tool_code",
+		"<|tool_code|>",
+		"<|/tool_code|>",
+		"<execute_command",
+		"</execute_command",
+		"<search_memory",
+		"</search_memory",
+		"<read_memory",
+		"</read_memory",
+		"<read_memory_context",
+		"</read_memory_context",
+		"<read_buffered_source",
+		"</read_buffered_source",
+		"<read_help",
+		"</read_help",
+		"<search_web",
+		"</search_web",
+		"<naver_search",
+		"</naver_search",
+		"<namu_wiki",
+		"</namu_wiki",
+		"<arg_key",
+		"</arg_key",
+		"<arg_value",
+		"</arg_value",
+		"<query>",
+		"</query>",
+		"<source_id>",
+		"</source_id>",
+	}
+	for _, marker := range markers {
+		if strings.Contains(trimmed, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func classifyPromptToolMarkup(raw string, tools []promptkit.ToolDefinition) (recognized bool, possiblePrefix bool) {
+	trimmed := strings.ToLower(strings.TrimSpace(raw))
+	if trimmed == "" {
+		return false, false
+	}
+	markers := []string{"<tool_call>", "<tool_code>", "<|tool_code|>"}
+	for _, tool := range tools {
+		name := strings.ToLower(strings.TrimSpace(tool.Name))
+		if name != "" {
+			markers = append(markers, "<"+name+">", name+"(", name+" (")
+		}
+	}
+	for _, marker := range markers {
+		if strings.HasPrefix(trimmed, marker) {
+			return true, true
+		}
+		if strings.HasPrefix(marker, trimmed) {
+			possiblePrefix = true
+		}
+	}
+	return false, possiblePrefix
+}
+
+// classifyPromptToolStreamCandidate applies the same quarantine decision to
+// both OpenAI-style deltas and LM Studio's custom message.delta events. JSON
+// wrappers need special handling because their first chunks ("`", "```", or
+// "{") do not yet contain a tool name and cannot be parsed as a complete call.
+func classifyPromptToolStreamCandidate(raw string, tools []promptkit.ToolDefinition) (startBuffering bool, holdPrefix bool) {
+	recognized, possiblePrefix := classifyPromptToolMarkup(raw, tools)
+	if recognized || looksLikeJSONToolCallPrefix(raw) {
+		return true, false
+	}
+	return false, possiblePrefix || looksLikeJSONToolCallPossiblePrefix(raw)
+}
+
+func hasPromptToolClosingTag(raw string, tools []promptkit.ToolDefinition) bool {
+	lower := strings.ToLower(raw)
+	if strings.Contains(lower, "</tool_call>") {
+		return true
+	}
+	if strings.Contains(lower, "</tool_code>") || strings.Contains(lower, "<|/tool_code|>") {
+		return true
+	}
+	for _, tool := range tools {
+		name := strings.ToLower(strings.TrimSpace(tool.Name))
+		if name != "" && strings.Contains(lower, "</"+name+">") {
+			return true
+		}
+		trimmed := strings.TrimSpace(lower)
+		if name != "" && (strings.HasPrefix(trimmed, name+"(") || strings.HasPrefix(trimmed, name+" (")) && strings.HasSuffix(trimmed, ")") {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegisteredPromptTool(name string, tools []promptkit.ToolDefinition) bool {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return false
+	}
+	for _, tool := range tools {
+		if strings.EqualFold(strings.TrimSpace(tool.Name), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripLeadingPromptToolArtifacts is a final defense for an already-completed
+// textual tool wrapper. Streaming paths should quarantine these before they
+// reach the answer, but keeping them out of request.complete and persisted
+// assistant history prevents an upstream format variation from resurfacing as
+// a visible fenced JSON block.
+func stripLeadingPromptToolArtifacts(raw string, tools []promptkit.ToolDefinition) (string, bool) {
+	remaining := strings.TrimSpace(raw)
+	changed := false
+	for remaining != "" {
+		consumed := 0
+		candidate := ""
+		if match := regexp.MustCompile("(?is)^```(?:json)?\\s*([\\s\\S]*?)\\s*```\\s*").FindStringIndex(remaining); len(match) == 2 && match[0] == 0 {
+			candidate = remaining[:match[1]]
+			consumed = match[1]
+		} else if strings.HasPrefix(remaining, "{") {
+			decoder := json.NewDecoder(strings.NewReader(remaining))
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err == nil {
+				consumed = int(decoder.InputOffset())
+				candidate = remaining[:consumed]
+			}
+		}
+		if consumed <= 0 || candidate == "" {
+			break
+		}
+		toolName, _, _, ok := chatharness.ParsePromptToolMarkup(candidate)
+		if !ok || !isRegisteredPromptTool(toolName, tools) {
+			break
+		}
+		remaining = strings.TrimSpace(remaining[consumed:])
+		changed = true
+	}
+	return remaining, changed
+}
+
+func normalizeModelChannelMarkup(raw string) string {
+	replacer := strings.NewReplacer(
+		"<|channel>", "<|channel|>",
+		"<channel|>", "<|channel|>",
+	)
+	return replacer.Replace(raw)
+}
+
+var (
+	channelThoughtPattern = regexp.MustCompile(`(?is)<\|channel\|>\s*thought\b`)
+	channelAnswerPattern  = regexp.MustCompile(`(?is)<\|channel\|>\s*(?:final|assistant|response)\b`)
+	channelMarkerPattern  = regexp.MustCompile(`(?is)<\|channel\|>\s*(?:thought|final|assistant|response)\b`)
+)
+
+func sanitizeLeakedModelChannelContent(raw string) (string, bool) {
+	normalized := normalizeModelChannelMarkup(raw)
+	if !strings.Contains(normalized, "<|channel|>") {
+		return raw, false
+	}
+
+	// A thought block runs until the next answer channel or the end; RE2
+	// has no lookahead, so the end is found separately.
+	cleaned := normalized
+	for {
+		start := channelThoughtPattern.FindStringIndex(cleaned)
+		if start == nil {
+			break
+		}
+		end := len(cleaned)
+		if next := channelAnswerPattern.FindStringIndex(cleaned[start[1]:]); next != nil {
+			end = start[1] + next[0]
+		}
+		cleaned = cleaned[:start[0]] + cleaned[end:]
+	}
+	cleaned = channelMarkerPattern.ReplaceAllString(cleaned, "")
+	cleaned = strings.ReplaceAll(cleaned, "<|message|>", "")
+	cleaned = strings.ReplaceAll(cleaned, "<|end|>", "")
+	cleaned = strings.TrimSpace(cleaned)
+
+	return cleaned, cleaned != strings.TrimSpace(raw)
+}
+
+func looksLikeChannelToolMarkup(raw string) bool {
+	normalized := normalizeModelChannelMarkup(strings.ToLower(strings.TrimSpace(raw)))
+	if !strings.Contains(normalized, "<|channel|>") {
+		return false
+	}
+	if strings.Contains(normalized, "<|tool_code|>") || strings.Contains(normalized, "to=") {
+		return true
+	}
+	return strings.Contains(normalized, "{") && strings.Contains(normalized, "}")
+}
@@ -1,44 +1,12 @@
-package core
+package orchestrator
 
 import (
 	"testing"
 
+	"dinkisstyle-chat/internal/chatharness"
 	"dinkisstyle-chat/internal/promptkit"
 )
 
-func TestNormalizeBufferedToolMatchUnwrapsAppToolCall(t *testing.T) {
-	name, argumentsJSON, _, wrapper := normalizeBufferedToolMatch("", `{"name":"search_web","arguments":{"query":"latest news"}}`)
-	if !wrapper {
-		t.Fatal("canonical app tool call was not recognized as a wrapper")
-	}
-	if name != "search_web" {
-		t.Fatalf("got tool name %q", name)
-	}
-	if argumentsJSON != `{"query":"latest news"}` {
-		t.Fatalf("wrapper was forwarded instead of arguments: %s", argumentsJSON)
-	}
-}
-
-func TestParseJSONToolCallAcceptsLocalModelAliases(t *testing.T) {
-	tests := []struct {
-		raw  string
-		name string
-		args string
-	}{
-		{`{"tool":"search_web","arguments":{"query":"MCP 도구 검증 테스트"}}`, "search_web", `{"query":"MCP 도구 검증 테스트"}`},
-		{`{"tool":"read_buffered_source","parameters":{"source_id":"src_123","query":"Engine 핵심 기능"}}`, "read_buffered_source", `{"query":"Engine 핵심 기능","source_id":"src_123"}`},
-		{"```json\n{\"name\":\"get_current_time\",\"arguments\":{}}\n```", "get_current_time", `{}`},
-		{"```json\n{\"tool\":\"get_current_location\",\"params\":{}}\n```\n도구를 실행하겠습니다.", "get_current_location", `{}`},
-		{`{"thought":"next","tool_name":"read_help","tool_arguments":{"query":"도구"}}`, "read_help", `{"query":"도구"}`},
-	}
-	for _, test := range tests {
-		name, argumentsJSON, arguments, ok := parseJSONToolCall(test.raw)
-		if !ok || name != test.name || argumentsJSON != test.args || arguments == nil {
-			t.Fatalf("parseJSONToolCall(%q) = name=%q args=%q parsed=%#v ok=%v", test.raw, name, argumentsJSON, arguments, ok)
-		}
-	}
-}
-
 func TestLooksLikeJSONToolCallPossiblePrefixHoldsSplitFence(t *testing.T) {
 	for _, raw := range []string{"`", "``", "```", "```j", "```json"} {
 		if !looksLikeJSONToolCallPossiblePrefix(raw) {
@@ -67,7 +35,7 @@ func TestPromptToolStreamClassifierQuarantinesCustomJSONDeltas(t *testing.T) {
 	if !start || hold {
 		t.Fatalf("complete JSON wrapper was not quarantined: start=%v hold=%v", start, hold)
 	}
-	name, _, _, ok := parsePromptToolMarkup(complete)
+	name, _, _, ok := chatharness.ParsePromptToolMarkup(complete)
 	if !ok || name != "read_buffered_source" {
 		t.Fatalf("quarantined JSON wrapper was not executable: name=%q ok=%v", name, ok)
 	}
@@ -94,19 +62,6 @@ func TestFinalAnswerQuarantineRemovesRecordedStatefulToolJSON(t *testing.T) {
 	}
 }
 
-func TestParseToolCodeCallAcceptsPrintedFunctionSyntax(t *testing.T) {
-	raw := `<tool_code>
-print(read_buffered_source(source_id="src_18c835144500", query="What is Engine? Features, installation, usage examples, architecture"))
-</tool_code>`
-	name, argumentsJSON, arguments, ok := parsePromptToolMarkup(raw)
-	if !ok || name != "read_buffered_source" || arguments == nil {
-		t.Fatalf("tool_code wrapper was not parsed: name=%q args=%q parsed=%#v ok=%v", name, argumentsJSON, arguments, ok)
-	}
-	if argumentsJSON != `{"query":"What is Engine? Features, installation, usage examples, architecture","source_id":"src_18c835144500"}` {
-		t.Fatalf("unexpected tool_code arguments: %s", argumentsJSON)
-	}
-}
-
 func TestLooksLikeToolMarkupQuarantinesIncompleteJSONWrapper(t *testing.T) {
 	raw := `{"tool":"search_web","arguments":{"query":"unfinished"}`
 	if !looksLikeToolMarkup(raw) {
@@ -114,37 +69,6 @@ func TestLooksLikeToolMarkupQuarantinesIncompleteJSONWrapper(t *testing.T) {
 	}
 }
 
-func TestParseXMLLikeToolCallAcceptsToolSpecificJSON(t *testing.T) {
-	name, argumentsJSON, arguments, ok := parseXMLLikeToolCall(`<get_current_time>{}</get_current_time>`)
-	if name != "get_current_time" || argumentsJSON != `{}` || arguments == nil || !ok {
-		t.Fatalf("unexpected no-arg tool parse: name=%q args=%q parsed=%#v ok=%v", name, argumentsJSON, arguments, ok)
-	}
-
-	name, argumentsJSON, _, _ = parseXMLLikeToolCall(`<execute_command>{"command":"uptime"}</execute_command>`)
-	if name != "execute_command" || argumentsJSON != `{"command":"uptime"}` {
-		t.Fatalf("unexpected command parse: name=%q args=%q", name, argumentsJSON)
-	}
-}
-
-func TestParseXMLLikeToolCallAcceptsEmptyNoArgumentElement(t *testing.T) {
-	name, argumentsJSON, arguments, ok := parseXMLLikeToolCall(`<get_current_time></get_current_time>`)
-	if name != "get_current_time" || argumentsJSON != `{}` || arguments == nil || !ok {
-		t.Fatalf("unexpected empty-element parse: name=%q args=%q parsed=%#v ok=%v", name, argumentsJSON, arguments, ok)
-	}
-}
-
-func TestParseXMLLikeToolCallAcceptsRawTextBody(t *testing.T) {
-	name, argumentsJSON, arguments, ok := parseXMLLikeToolCall(`<search_memory>나를 주인님이라고 부르기로 한거</search_memory>`)
-	if !ok || name != "search_memory" || argumentsJSON != `{"query":"나를 주인님이라고 부르기로 한거"}` || arguments == nil {
-		t.Fatalf("unexpected raw-text XML tool parse: name=%q args=%q ok=%v", name, argumentsJSON, ok)
-	}
-
-	name, argumentsJSON, _, ok = parseXMLLikeToolCall(`<save_user_fact>나를 주인님이라고 부르기로 한거</save_user_fact>`)
-	if !ok || name != "save_user_fact" || argumentsJSON != `{"fact_key":"user_fact","fact_value":"나를 주인님이라고 부르기로 한거"}` {
-		t.Fatalf("unexpected raw-text save_user_fact parse: name=%q args=%q ok=%v", name, argumentsJSON, ok)
-	}
-}
-
 func TestCompletedToolNamesFollowAdvertisedCatalogOrder(t *testing.T) {
 	tools := []promptkit.ToolDefinition{{Name: "get_current_time"}, {Name: "get_current_location"}, {Name: "read_help"}}
 	completed := completedToolNames(tools, map[string]int{"read_help": 1, "get_current_time": 2})
@@ -153,25 +77,6 @@ func TestCompletedToolNamesFollowAdvertisedCatalogOrder(t *testing.T) {
 	}
 }
 
-func TestParsePromptToolMarkupAcceptsLegacyWrapper(t *testing.T) {
-	name, argumentsJSON, _, ok := parsePromptToolMarkup(`<tool_call>{"name":"get_current_time","arguments":{}}</tool_call>`)
-	if !ok || name != "get_current_time" || argumentsJSON != `{}` {
-		t.Fatalf("legacy wrapper was not normalized: name=%q args=%q ok=%v", name, argumentsJSON, ok)
-	}
-}
-
-func TestParsePromptToolMarkupAcceptsQwenFunctionParameterWrapper(t *testing.T) {
-	raw := `<tool_call><function=read_web_page><parameter=url>https://go.dev/doc/go1.25</parameter></function></tool_call>`
-	name, argumentsJSON, arguments, ok := parsePromptToolMarkup(raw)
-	if !ok || name != "read_web_page" {
-		t.Fatalf("Qwen function/parameter wrapper was not parsed: name=%q args=%q ok=%v", name, argumentsJSON, ok)
-	}
-	args, _ := arguments.(map[string]interface{})
-	if args["url"] != "https://go.dev/doc/go1.25" {
-		t.Fatalf("Qwen wrapper arguments were not preserved: %#v", args)
-	}
-}
-
 func TestClassifyPromptToolMarkupHandlesSplitOpeningTag(t *testing.T) {
 	tools := []promptkit.ToolDefinition{{Name: "get_current_time"}}
 	if recognized, possible := classifyPromptToolMarkup(`<get_current_`, tools); recognized || !possible {
@@ -200,8 +105,8 @@ func TestLMStudioEndPayloadToolMarkupIsRecognized(t *testing.T) {
 			}},
 		},
 	}
-	content := extractFinalAssistantContent(payload)
-	name, argumentsJSON, _, ok := parsePromptToolMarkup(content)
+	content := chatharness.ExtractFinalAssistantContent(payload)
+	name, argumentsJSON, _, ok := chatharness.ParsePromptToolMarkup(content)
 	tools := []promptkit.ToolDefinition{{Name: "execute_command"}}
 	if !ok || !isRegisteredPromptTool(name, tools) || argumentsJSON != `{"command":"sysctl -n kern.boottime"}` {
 		t.Fatalf("terminal tool call in chat.end was not recognized: name=%q args=%q ok=%v", name, argumentsJSON, ok)
@@ -210,7 +115,7 @@ func TestLMStudioEndPayloadToolMarkupIsRecognized(t *testing.T) {
 
 func TestParseFunctionLikeToolCall(t *testing.T) {
 	raw := `read_buffered_source(source_id="src_18c83936c25763f0", query="게시글의 주요 내용과 운영자의 사과/해명 내용을 요약해 주세요.")`
-	name, argumentsJSON, arguments, ok := parsePromptToolMarkup(raw)
+	name, argumentsJSON, arguments, ok := chatharness.ParsePromptToolMarkup(raw)
 	if !ok || name != "read_buffered_source" {
 		t.Fatalf("function-like tool call was not parsed: name=%q args=%q ok=%v", name, argumentsJSON, ok)
 	}
@@ -236,3 +141,14 @@ func TestLooksLikeToolMarkupRejectsOrphanedClosingTags(t *testing.T) {
 		t.Fatal("orphaned tool closing tags were not recognized as hidden protocol markup")
 	}
 }
+
+func TestSanitizeLeakedModelChannelContentDropsThoughtBlocks(t *testing.T) {
+	raw := "<|channel|>thought I should greet.<|channel|>final<|message|>Hello!"
+	cleaned, changed := sanitizeLeakedModelChannelContent(raw)
+	if !changed || cleaned != "Hello!" {
+		t.Fatalf("cleaned = %q, changed = %v", cleaned, changed)
+	}
+	if cleaned, _ := sanitizeLeakedModelChannelContent("<|channel|>thought still thinking"); cleaned != "" {
+		t.Fatalf("unterminated thought block = %q", cleaned)
+	}
+}
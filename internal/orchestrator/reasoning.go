@@ -0,0 +1,128 @@
+package orchestrator
+
+import (
+	"regexp"
+	"strings"
+
+	"dinkisstyle-chat/internal/chatharness"
+)
+
+var reasoningLoopSentencePattern = regexp.MustCompile(`[^.!?。！？]+[.!?。！？]+`)
+
+func detectReasoningRunawayRepetition(text string) (string, string, bool) {
+	sectionText := text
+	sectionRunes := []rune(sectionText)
+	if len(sectionRunes) > 8000 {
+		sectionText = string(sectionRunes[len(sectionRunes)-8000:])
+	}
+
+	normalized := strings.Join(strings.Fields(text), " ")
+	runes := []rune(normalized)
+	if len(runes) < 140 {
+		return "", "", false
+	}
+	if len(runes) > 6000 {
+		runes = runes[len(runes)-6000:]
+		normalized = string(runes)
+	}
+
+	if snippet, ok := detectRepeatedSuffixRunes(runes, 6, 180, 9); ok {
+		return compactText(snippet, 80), "chunk-loop", true
+	}
+	if snippet, ok := detectRepeatedSuffixRunes(runes, 50, 260, 6); ok {
+		return compactText(snippet, 120), "long-chunk-loop", true
+	}
+	if snippet, ok := detectRepeatedSuffixRunes(runes, 240, 1200, 3); ok {
+		return compactText(snippet, 160), "section-loop", true
+	}
+	if snippet, ok := detectRepeatedReasoningSection(sectionText); ok {
+		return compactText(snippet, 160), "repeated-section", true
+	}
+
+	words := strings.Fields(normalized)
+	if len(words) >= 12 {
+		lastWord := strings.ToLower(words[len(words)-1])
+		if len([]rune(lastWord)) >= 2 && len([]rune(lastWord)) <= 30 {
+			count := 1
+			for i := len(words) - 2; i >= 0; i-- {
+				if strings.ToLower(words[i]) != lastWord {
+					break
+				}
+				count++
+			}
+			if count >= 12 {
+				return lastWord, "word-loop", true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+func detectRepeatedReasoningSection(text string) (string, bool) {
+	seen := make(map[string]int)
+	addCandidate := func(candidate string) (string, bool) {
+		segment := strings.Join(strings.Fields(candidate), " ")
+		if len([]rune(segment)) < 36 {
+			return "", false
+		}
+		key := strings.ToLower(segment)
+		seen[key]++
+		if seen[key] >= 4 {
+			return segment, true
+		}
+		return "", false
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		if snippet, ok := addCandidate(line); ok {
+			return snippet, true
+		}
+	}
+
+	for _, sentence := range reasoningLoopSentencePattern.FindAllString(strings.Join(strings.Fields(text), " "), -1) {
+		if snippet, ok := addCandidate(sentence); ok {
+			return snippet, true
+		}
+	}
+
+	return "", false
+}
+
+func detectRepeatedSuffixRunes(runes []rune, minUnit, maxUnit, minRepeats int) (string, bool) {
+	if minUnit <= 0 || maxUnit < minUnit || minRepeats < 2 {
+		return "", false
+	}
+	for unitLen := minUnit; unitLen <= maxUnit && unitLen*minRepeats <= len(runes); unitLen++ {
+		unitStart := len(runes) - unitLen
+		unit := string(runes[unitStart:])
+		repeats := 1
+		for start := unitStart - unitLen; start >= 0; start -= unitLen {
+			if string(runes[start:start+unitLen]) != unit {
+				break
+			}
+			repeats++
+		}
+		if repeats >= minRepeats {
+			return unit, true
+		}
+	}
+	return "", false
+}
+
+func detectReasoningPayloadRunawayRepetition(payloadMap map[string]interface{}) (string, string, bool) {
+	reasoningContent := chatharness.ExtractReasoningContent(payloadMap)
+	if strings.TrimSpace(reasoningContent) == "" {
+		return "", "", false
+	}
+	return detectReasoningRunawayRepetition(reasoningContent)
+}
+
+func compactText(input string, limit int) string {
+	input = strings.TrimSpace(input)
+	if limit <= 0 || len([]rune(input)) <= limit {
+		return input
+	}
+	runes := []rune(input)
+	return strings.TrimSpace(string(runes[:limit])) + "... (truncated)"
+}
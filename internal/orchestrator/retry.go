@@ -0,0 +1,282 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Retry defaults used when a RetryPolicy field is zero.
+const (
+	DefaultRetryMaxAttempts    = 3
+	DefaultRetryInitialBackoff = 500 * time.Millisecond
+	DefaultRetryMaxBackoff     = 8 * time.Second
+	DefaultModelLoadWait       = 2 * time.Minute
+)
+
+// RetryPolicy is config.json "upstreamRetry". Zero fields keep the defaults.
+type RetryPolicy struct {
+	// MaxAttempts counts the first try; 1 disables retries.
+	MaxAttempts      int `json:"maxAttempts,omitempty"`
+	InitialBackoffMs int `json:"initialBackoffMs,omitempty"`
+	MaxBackoffMs     int `json:"maxBackoffMs,omitempty"`
+	// ModelLoadWaitSeconds bounds how long a round keeps retrying while the
+	// upstream reports that the model is still loading. Those attempts do
+	// not count against MaxAttempts.
+	ModelLoadWaitSeconds int `json:"modelLoadWaitSeconds,omitempty"`
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) initialBackoff() time.Duration {
+	if p.InitialBackoffMs <= 0 {
+		return DefaultRetryInitialBackoff
+	}
+	return time.Duration(p.InitialBackoffMs) * time.Millisecond
+}
+
+func (p RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoffMs <= 0 {
+		return DefaultRetryMaxBackoff
+	}
+	return time.Duration(p.MaxBackoffMs) * time.Millisecond
+}
+
+func (p RetryPolicy) modelLoadWait() time.Duration {
+	if p.ModelLoadWaitSeconds <= 0 {
+		return DefaultModelLoadWait
+	}
+	return time.Duration(p.ModelLoadWaitSeconds) * time.Second
+}
+
+// backoff is the full-jitter delay before retry number attempt (from 1):
+// a random duration up to initial*2^(attempt-1), capped at the max.
+func (p RetryPolicy) backoff(attempt int, random func(int64) int64) time.Duration {
+	limit := p.initialBackoff()
+	for i := 1; i < attempt && limit < p.maxBackoff(); i++ {
+		limit *= 2
+	}
+	if limit > p.maxBackoff() {
+		limit = p.maxBackoff()
+	}
+	// Keep at least half the window so retries never fire back to back.
+	half := int64(limit / 2)
+	return time.Duration(half + random(int64(limit)-half+1))
+}
+
+// RetryAttempt describes a failed attempt that is about to be retried.
+type RetryAttempt struct {
+	Turn int
+	// Attempt is the number of the failed attempt, from 1.
+	Attempt     int
+	MaxAttempts int
+	Delay       time.Duration
+	// ModelLoading reports that the upstream answered that the model is
+	// still loading.
+	ModelLoading bool
+	Err          error
+}
+
+// Reason is a short machine-readable cause for status events.
+func (a RetryAttempt) Reason() string {
+	var statusErr *StatusError
+	switch {
+	case a.ModelLoading:
+		return "model_loading"
+	case errors.As(a.Err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		return "rate_limited"
+	case errors.As(a.Err, &statusErr):
+		return "unavailable"
+	default:
+		return "connection"
+	}
+}
+
+// RetryTransport retries transient upstream failures before anything has
+// streamed: the inner Open failing, or the response failing before its
+// first byte. Once a byte has been read the stream is handed to the Round
+// and is never replayed.
+type RetryTransport struct {
+	Transport Transport
+	Policy    RetryPolicy
+	// OnRetry is called before each wait, for traces and status events.
+	OnRetry func(RetryAttempt)
+
+	// sleep and random are replaced in tests.
+	sleep  func(ctx context.Context, d time.Duration) error
+	random func(n int64) int64
+}
+
+func (t *RetryTransport) Open(ctx context.Context, req Request) (io.ReadCloser, error) {
+	started := time.Now()
+	attempts := 0
+	for attempt := 1; ; attempt++ {
+		stream, err := t.Transport.Open(ctx, req)
+		if err == nil {
+			stream, err = awaitFirstByte(stream)
+		}
+		if err == nil {
+			return stream, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		loading := IsModelLoading(err)
+		if !loading {
+			attempts++
+		}
+		if !loading && (!IsRetryable(err) || attempts >= t.Policy.maxAttempts()) {
+			return nil, err
+		}
+		delay := t.Policy.backoff(attempt, t.randomFunc())
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			delay = statusErr.RetryAfter
+		}
+		// A model load, or a Retry-After beyond what we would wait for one,
+		// ends once the load budget is spent.
+		if time.Since(started)+delay > t.Policy.modelLoadWait() {
+			return nil, err
+		}
+
+		if t.OnRetry != nil {
+			t.OnRetry(RetryAttempt{
+				Turn:         req.Turn,
+				Attempt:      attempt,
+				MaxAttempts:  t.Policy.maxAttempts(),
+				Delay:        delay,
+				ModelLoading: loading,
+				Err:          err,
+			})
+		}
+		if err := t.sleepFunc()(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *RetryTransport) sleepFunc() func(context.Context, time.Duration) error {
+	if t.sleep != nil {
+		return t.sleep
+	}
+	return func(ctx context.Context, d time.Duration) error {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func (t *RetryTransport) randomFunc() func(int64) int64 {
+	if t.random != nil {
+		return t.random
+	}
+	return rand.Int63n
+}
+
+// awaitFirstByte blocks until the response produces its first byte, so a
+// connection reset before anything streamed is still retryable. An empty
+// body is passed through for the Round to handle.
+func awaitFirstByte(stream io.ReadCloser) (io.ReadCloser, error) {
+	reader := bufio.NewReader(stream)
+	if _, err := reader.Peek(1); err != nil && !errors.Is(err, io.EOF) {
+		stream.Close()
+		return nil, err
+	}
+	return bufferedBody{Reader: reader, Closer: stream}, nil
+}
+
+type bufferedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// modelLoadingMarkers are the error texts LM Studio, llama.cpp and
+// OpenAI-compatible servers send while a model is still being loaded.
+var modelLoadingMarkers = []string{
+	"loading model",
+	"model is loading",
+	"model is still loading",
+	"model loading",
+	"model is currently loading",
+	"model is not yet loaded",
+}
+
+// IsModelLoading reports whether err is an upstream answer saying the model
+// is still loading. A failed load is not a loading state.
+func IsModelLoading(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	body := strings.ToLower(statusErr.Body)
+	if strings.Contains(body, "failed to load") {
+		return false
+	}
+	for _, marker := range modelLoadingMarkers {
+		if strings.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRetryable reports whether err is worth retrying unchanged: a network
+// failure, a timeout or overload status, or a model that is still loading.
+// Other 4xx answers would fail the same way again.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return IsModelLoading(err)
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an
+// HTTP date; anything else is zero.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
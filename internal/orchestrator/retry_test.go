@@ -0,0 +1,221 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type transportFunc func(ctx context.Context, req Request) (io.ReadCloser, error)
+
+func (f transportFunc) Open(ctx context.Context, req Request) (io.ReadCloser, error) {
+	return f(ctx, req)
+}
+
+// resetReader fails like a connection reset before any byte arrives.
+type resetReader struct{}
+
+func (resetReader) Read([]byte) (int, error) { return 0, syscall.ECONNRESET }
+
+func TestRetryTransport(t *testing.T) {
+	unavailable := &StatusError{StatusCode: http.StatusServiceUnavailable, Body: "busy"}
+	loading := &StatusError{StatusCode: http.StatusServiceUnavailable, Body: `{"error":{"code":503,"message":"Loading model","type":"unavailable_error"}}`}
+	tests := []struct {
+		name        string
+		policy      RetryPolicy
+		results     []interface{} // error, io.Reader, or string body
+		wantOpens   int
+		wantErr     bool
+		wantReasons []string
+		wantDelays  []time.Duration
+	}{
+		{
+			name:        "503 then success",
+			results:     []interface{}{unavailable, unavailable, "data: ok\n\n"},
+			wantOpens:   3,
+			wantReasons: []string{"unavailable", "unavailable"},
+		},
+		{
+			name:      "client error is not retried",
+			results:   []interface{}{&StatusError{StatusCode: http.StatusBadRequest, Body: "invalid previous_response_id"}},
+			wantOpens: 1,
+			wantErr:   true,
+		},
+		{
+			name:        "attempts run out",
+			policy:      RetryPolicy{MaxAttempts: 2},
+			results:     []interface{}{unavailable, unavailable, "data: late\n\n"},
+			wantOpens:   2,
+			wantErr:     true,
+			wantReasons: []string{"unavailable"},
+		},
+		{
+			name:        "model loading does not spend attempts",
+			policy:      RetryPolicy{MaxAttempts: 1},
+			results:     []interface{}{loading, loading, loading, "data: ok\n\n"},
+			wantOpens:   4,
+			wantReasons: []string{"model_loading", "model_loading", "model_loading"},
+		},
+		{
+			name: "retry-after is respected",
+			results: []interface{}{
+				&StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second},
+				"data: ok\n\n",
+			},
+			wantOpens:   2,
+			wantReasons: []string{"rate_limited"},
+			wantDelays:  []time.Duration{3 * time.Second},
+		},
+		{
+			name:      "retry-after beyond the load budget gives up",
+			policy:    RetryPolicy{ModelLoadWaitSeconds: 10},
+			results:   []interface{}{&StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Minute}},
+			wantOpens: 1,
+			wantErr:   true,
+		},
+		{
+			name:        "reset before the first byte",
+			results:     []interface{}{resetReader{}, "data: ok\n\n"},
+			wantOpens:   2,
+			wantReasons: []string{"connection"},
+		},
+		{
+			name:      "empty body is not retried",
+			results:   []interface{}{""},
+			wantOpens: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opens := 0
+			inner := transportFunc(func(ctx context.Context, req Request) (io.ReadCloser, error) {
+				result := tt.results[opens]
+				opens++
+				switch result := result.(type) {
+				case error:
+					return nil, result
+				case io.Reader:
+					return io.NopCloser(result), nil
+				default:
+					return io.NopCloser(strings.NewReader(result.(string))), nil
+				}
+			})
+			var reasons []string
+			var delays []time.Duration
+			transport := &RetryTransport{
+				Transport: inner,
+				Policy:    tt.policy,
+				OnRetry: func(attempt RetryAttempt) {
+					reasons = append(reasons, attempt.Reason())
+					delays = append(delays, attempt.Delay)
+				},
+				sleep:  func(ctx context.Context, d time.Duration) error { return nil },
+				random: func(n int64) int64 { return 0 },
+			}
+			stream, err := transport.Open(context.Background(), Request{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if opens != tt.wantOpens {
+				t.Fatalf("opens = %d, want %d", opens, tt.wantOpens)
+			}
+			if strings.Join(reasons, ",") != strings.Join(tt.wantReasons, ",") {
+				t.Fatalf("retry reasons = %v, want %v", reasons, tt.wantReasons)
+			}
+			for i, want := range tt.wantDelays {
+				if delays[i] != want {
+					t.Fatalf("delay %d = %s, want %s", i, delays[i], want)
+				}
+			}
+			if err == nil {
+				data, _ := io.ReadAll(stream)
+				if want, _ := tt.results[opens-1].(string); string(data) != want {
+					t.Fatalf("stream = %q, want %q", data, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransportStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	opens := 0
+	transport := &RetryTransport{
+		Transport: transportFunc(func(ctx context.Context, req Request) (io.ReadCloser, error) {
+			opens++
+			cancel()
+			return nil, &StatusError{StatusCode: http.StatusBadGateway}
+		}),
+	}
+	if _, err := transport.Open(ctx, Request{}); err == nil || opens != 1 {
+		t.Fatalf("Open = %v after %d opens, want one failed attempt", err, opens)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoffMs: 100, MaxBackoffMs: 1000}
+	highest := func(n int64) int64 { return n - 1 }
+	lowest := func(n int64) int64 { return 0 }
+	for attempt, want := range map[int]time.Duration{1: 100, 2: 200, 3: 400, 4: 800, 5: 1000, 9: 1000} {
+		want *= time.Millisecond
+		if got := policy.backoff(attempt, highest); got != want {
+			t.Errorf("backoff(%d) upper bound = %s, want %s", attempt, got, want)
+		}
+		if got := policy.backoff(attempt, lowest); got != want/2 {
+			t.Errorf("backoff(%d) lower bound = %s, want %s", attempt, got, want/2)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"7":                             7 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"Fri, 16 Oct 2026 12:00:30 GMT": 30 * time.Second,
+		"Fri, 16 Oct 2026 11:00:00 GMT": 0,
+	}
+	for value, want := range tests {
+		if got := parseRetryAfter(value, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestIsModelLoading(t *testing.T) {
+	for body, want := range map[string]bool{
+		`{"error":{"message":"Loading model"}}`:               true,
+		`{"error":"Model is still loading, retry shortly"}`:   true,
+		`{"error":"Failed to load model: insufficient VRAM"}`: false,
+		`{"error":"Model not found"}`:                         false,
+	} {
+		if got := IsModelLoading(&StatusError{StatusCode: http.StatusServiceUnavailable, Body: body}); got != want {
+			t.Errorf("IsModelLoading(%s) = %v, want %v", body, got, want)
+		}
+	}
+	if IsModelLoading(errors.New("Loading model")) {
+		t.Error("a transport error is not a loading answer")
+	}
+}
+
+func TestHTTPTransportReportsRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	_, err := (&HTTPTransport{URL: server.URL}).Open(context.Background(), Request{Body: []byte(`{}`)})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter != 5*time.Second {
+		t.Fatalf("Open error = %#v, want Retry-After of 5s", err)
+	}
+}
@@ -0,0 +1,66 @@
+package orchestrator
+
+import (
+	"encoding/json"
+
+	"dinkisstyle-chat/internal/chatharness"
+)
+
+// Sink receives what a Round produces. Send writes one SSE line to the
+// client as-is; Record persists an event in the chat session. Some events
+// are only recorded (for example reasoning already forwarded inside a
+// provider chunk) and some lines are only sent.
+type Sink interface {
+	Send(line string)
+	Record(role, eventType string, payload interface{})
+}
+
+// SinkFuncs adapts plain functions to Sink; nil functions drop the event.
+type SinkFuncs struct {
+	SendFunc   func(line string)
+	RecordFunc func(role, eventType string, payload interface{})
+}
+
+func (f SinkFuncs) Send(line string) {
+	if f.SendFunc != nil {
+		f.SendFunc(line)
+	}
+}
+
+func (f SinkFuncs) Record(role, eventType string, payload interface{}) {
+	if f.RecordFunc != nil {
+		f.RecordFunc(role, eventType, payload)
+	}
+}
+
+// Emit records payload under its "type" and sends it as a data: line.
+func Emit(sink Sink, role string, payload map[string]interface{}) {
+	eventType, _ := payload["type"].(string)
+	sink.Record(role, eventType, payload)
+	if data, err := json.Marshal(payload); err == nil {
+		sink.Send("data: " + string(data))
+	}
+}
+
+// EmitToolCalls announces the calls of one round with tool_call.start and
+// tool_call.arguments events carrying each call_id. Arguments are sent
+// decoded when they are valid JSON.
+func EmitToolCalls(sink Sink, calls []chatharness.ProviderToolCall) {
+	for _, call := range calls {
+		Emit(sink, "assistant", map[string]interface{}{
+			"type":    "tool_call.start",
+			"tool":    call.Name,
+			"call_id": call.ID,
+		})
+		var arguments interface{} = map[string]interface{}{}
+		if err := json.Unmarshal([]byte(call.Arguments), &arguments); err != nil {
+			arguments = call.Arguments
+		}
+		Emit(sink, "assistant", map[string]interface{}{
+			"type":      "tool_call.arguments",
+			"tool":      call.Name,
+			"call_id":   call.ID,
+			"arguments": arguments,
+		})
+	}
+}
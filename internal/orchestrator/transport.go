@@ -0,0 +1,88 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+)
+
+// HTTPTransport posts rounds to an OpenAI-compatible, LM Studio or native
+// provider endpoint. Fields may be changed between rounds, for example when
+// a request fails over to another upstream.
+type HTTPTransport struct {
+	URL   string
+	Token string
+	// Adapter encodes the working request for a native provider and
+	// normalizes its stream into app events; nil sends the body as-is.
+	Adapter chatharness.ProviderAdapter
+	Client  *http.Client
+}
+
+func (t *HTTPTransport) Open(ctx context.Context, req Request) (io.ReadCloser, error) {
+	body := req.Body
+	if t.Adapter != nil {
+		// The working request stays in Chat Completions shape across tool
+		// rounds; only the dispatched copy is in the provider's format.
+		encoded, err := t.Adapter.EncodeRequest(body)
+		if err != nil {
+			return nil, fmt.Errorf("encode %s request: %w", t.Adapter.Mode(), err)
+		}
+		body = encoded
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	// Check if token is effectively empty or just "bearer", OR IS A MASKED VALUE
+	token := strings.TrimSpace(t.Token)
+	isMasked := strings.HasPrefix(token, "***") || strings.HasSuffix(token, "...")
+	if t.Adapter != nil {
+		if isMasked {
+			token = ""
+		}
+		t.Adapter.SetHeaders(httpReq.Header, token)
+	} else if token != "" && !isMasked {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		// Default to lm-studio (standard, no hacks).
+		// If this fails with 401, the caller guides the user from the error.
+		log.Printf("[orchestrator] Empty/Invalid/Masked Token detected ('%s'), using Default: lm-studio", token)
+		httpReq.Header.Set("Authorization", "Bearer lm-studio")
+	}
+
+	client := t.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		errorBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(errorBody),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	if t.Adapter == nil {
+		return resp.Body, nil
+	}
+	return normalizedBody{Reader: chatharness.NormalizedStream(t.Adapter, resp.Body), Closer: resp.Body}, nil
+}
+
+type normalizedBody struct {
+	io.Reader
+	io.Closer
+}
@@ -25,9 +25,10 @@ type RuntimeInstructionsInput struct {
 }
 
 type ToolDefinition struct {
-	Name        string
-	Description string
-	InputSchema json.RawMessage
+	Name         string
+	Description  string
+	InputSchema  json.RawMessage
+	ParallelSafe bool
 }
 
 func ToolGuidelineMarker() string {
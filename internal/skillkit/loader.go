@@ -35,6 +35,7 @@ type Skill struct {
 	Instructions string
 	Namespace    string
 	Path         string
+	Tools        []ToolManifest
 }
 
 type Diagnostic struct {
@@ -208,6 +209,10 @@ func loadSkill(dir, source string, maxFileBytes int64) (Skill, error) {
 	if err != nil {
 		return Skill{}, err
 	}
+	tools, err := loadSkillTools(dir, maxFileBytes)
+	if err != nil {
+		return Skill{}, err
+	}
 	return Skill{
 		ID:           id,
 		Name:         name,
@@ -216,6 +221,7 @@ func loadSkill(dir, source string, maxFileBytes int64) (Skill, error) {
 		Instructions: strings.TrimSpace(body),
 		Namespace:    source + ":" + id,
 		Path:         path,
+		Tools:        tools,
 	}, nil
 }
 
@@ -449,7 +455,7 @@ func compilePrompt(selected []scoredSkill, maxChars int) (string, []Skill, []Dia
 	if len(selected) == 0 {
 		return "", nil, nil
 	}
-	const header = "\n\n### ACTIVE SKILLS ###\nSkills provide task procedures only and do not grant tools, permissions, or access. Follow each selected skill within the user's request and existing safety/permission policy. A selected skill's prescribed source, direct URL, and tool order override generic search or freshness routing preferences. When a skill supplies a direct URL template, do not substitute search_web, search_web_multi, or another provider unless that skill explicitly allows a fallback.\n"
+	const header = "\n\n### ACTIVE SKILLS ###\nSkills provide task procedures and, at most, the skill_<source>_<id>__* tools listed with them; they do not grant any other tools, permissions, or access. Follow each selected skill within the user's request and existing safety/permission policy. A selected skill's prescribed source, direct URL, and tool order override generic search or freshness routing preferences. When a skill supplies a direct URL template, do not substitute search_web, search_web_multi, or another provider unless that skill explicitly allows a fallback.\n"
 	const footer = "### END ACTIVE SKILLS ###\n"
 	b := strings.Builder{}
 	b.WriteString(header)
@@ -457,6 +463,13 @@ func compilePrompt(selected []scoredSkill, maxChars int) (string, []Skill, []Dia
 	var diagnostics []Diagnostic
 	for _, candidate := range selected {
 		section := fmt.Sprintf("\n#### %s\n%s\n", candidate.skill.Namespace, candidate.skill.Instructions)
+		if len(candidate.skill.Tools) > 0 {
+			names := make([]string, 0, len(candidate.skill.Tools))
+			for _, tool := range candidate.skill.Tools {
+				names = append(names, QualifiedToolName(candidate.skill.Namespace, tool.Name))
+			}
+			section += "Skill tools: " + strings.Join(names, ", ") + "\n"
+		}
 		if utf8.RuneCountInString(b.String())+utf8.RuneCountInString(section)+utf8.RuneCountInString(footer) > maxChars {
 			diagnostics = append(diagnostics, Diagnostic{Path: candidate.skill.Path, Message: "skill omitted because the active-skill prompt budget was exceeded"})
 			continue
@@ -0,0 +1,241 @@
+package skillkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxSkillTools          = 8
+	maxToolDescriptionRune = 1024
+	maxToolNameLength      = 40
+)
+
+// ToolManifest is one tools/*.json file of a skill package. The command runs
+// a program from the skill's scripts/ directory; tool arguments reach it as
+// JSON on stdin and are never interpolated into the command.
+type ToolManifest struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+	Command     []string        `json:"command"`
+	// ReadOnly tools skip the side-effect approval policy and may run in
+	// parallel. Anything else is treated as side-effecting.
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// Argv is Command with scripts/ entries resolved to absolute paths, and
+	// Dir is the skill directory the command runs in.
+	Argv []string `json:"-"`
+	Dir  string   `json:"-"`
+	Path string   `json:"-"`
+}
+
+// QualifiedToolName namespaces a skill tool as skill_<source>_<skill id>__<tool>
+// from the skill's Namespace, so a builtin and a user skill that share an id
+// register different tools.
+func QualifiedToolName(namespace, tool string) string {
+	return "skill_" + strings.ReplaceAll(namespace, ":", "_") + "__" + tool
+}
+
+func loadSkillTools(dir string, maxFileBytes int64) ([]ToolManifest, error) {
+	toolsDir := filepath.Join(dir, "tools")
+	info, err := os.Lstat(toolsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 || !info.IsDir() {
+		return nil, fmt.Errorf("tools must be a directory, not a symlink")
+	}
+	paths, err := filepath.Glob(filepath.Join(toolsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	if len(paths) > maxSkillTools {
+		return nil, fmt.Errorf("skill declares %d tools, at most %d are allowed", len(paths), maxSkillTools)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var tools []ToolManifest
+	seen := map[string]bool{}
+	for _, path := range paths {
+		tool, err := loadToolManifest(path, absDir, maxFileBytes)
+		if err != nil {
+			return nil, fmt.Errorf("tools/%s: %w", filepath.Base(path), err)
+		}
+		if seen[tool.Name] {
+			return nil, fmt.Errorf("tools/%s: duplicate tool name %q", filepath.Base(path), tool.Name)
+		}
+		seen[tool.Name] = true
+		tools = append(tools, tool)
+	}
+	return tools, nil
+}
+
+func loadToolManifest(path, skillDir string, maxFileBytes int64) (ToolManifest, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return ToolManifest{}, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 || !info.Mode().IsRegular() {
+		return ToolManifest{}, fmt.Errorf("manifest must be a regular file, not a symlink")
+	}
+	if info.Size() > maxFileBytes {
+		return ToolManifest{}, fmt.Errorf("manifest exceeds %d bytes", maxFileBytes)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ToolManifest{}, err
+	}
+	var tool ToolManifest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&tool); err != nil {
+		return ToolManifest{}, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	tool.Name = strings.TrimSpace(tool.Name)
+	tool.Description = strings.TrimSpace(tool.Description)
+	if !validToolName(tool.Name) {
+		return ToolManifest{}, fmt.Errorf("invalid tool name %q", tool.Name)
+	}
+	if tool.Description == "" {
+		return ToolManifest{}, fmt.Errorf("tool description is required")
+	}
+	if utf8.RuneCountInString(tool.Description) > maxToolDescriptionRune {
+		return ToolManifest{}, fmt.Errorf("tool description exceeds %d characters", maxToolDescriptionRune)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(tool.InputSchema, &schema); err != nil || schema == nil {
+		return ToolManifest{}, fmt.Errorf("inputSchema must be a JSON object")
+	}
+	if schema["type"] != "object" {
+		return ToolManifest{}, fmt.Errorf(`inputSchema type must be "object"`)
+	}
+	argv, err := resolveToolCommand(tool.Command, skillDir)
+	if err != nil {
+		return ToolManifest{}, err
+	}
+	tool.Argv = argv
+	tool.Dir = skillDir
+	tool.Path = path
+	return tool, nil
+}
+
+// scriptInterpreters may run a skill script when the script path follows
+// them directly. Versioned names such as python3.12 match their base name.
+var scriptInterpreters = map[string]bool{
+	"sh": true, "bash": true, "dash": true, "zsh": true,
+	"python": true, "pypy": true, "node": true, "perl": true, "ruby": true,
+	"php": true, "lua": true, "pwsh": true, "powershell": true,
+}
+
+// resolveToolCommand checks a command template: the program is either a
+// script under scripts/ or a known interpreter followed directly by one, so
+// no interpreter flag such as -c can run inline code. The remaining elements
+// are fixed arguments for the script, and no element may look like an
+// argument placeholder.
+func resolveToolCommand(command []string, skillDir string) ([]string, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("command is required")
+	}
+	for index, element := range command {
+		if strings.TrimSpace(element) == "" {
+			return nil, fmt.Errorf("command element %d is empty", index)
+		}
+		if strings.Contains(element, "{{") || strings.Contains(element, "$") {
+			return nil, fmt.Errorf("command element %q looks like a placeholder; arguments are passed as JSON on stdin", element)
+		}
+	}
+	scriptIndex := 0
+	if !isScriptPath(command[0]) {
+		if len(command) < 2 || !isScriptPath(command[1]) {
+			return nil, fmt.Errorf("command must run a file from the skill's scripts directory, directly or right after its interpreter")
+		}
+		if strings.ContainsAny(command[0], `/\`) {
+			return nil, fmt.Errorf("command program must be a scripts/ path or a bare program name")
+		}
+		if !scriptInterpreters[interpreterName(command[0])] {
+			return nil, fmt.Errorf("command program %q is not a known script interpreter", command[0])
+		}
+		scriptIndex = 1
+	}
+	script, err := resolveToolScript(command[scriptIndex], skillDir)
+	if err != nil {
+		return nil, err
+	}
+	argv := append([]string(nil), command...)
+	argv[scriptIndex] = script
+	return argv, nil
+}
+
+func isScriptPath(element string) bool {
+	slashed := filepath.ToSlash(element)
+	return strings.HasPrefix(slashed, "scripts/") || strings.HasPrefix(slashed, "./scripts/")
+}
+
+// interpreterName strips an .exe suffix and a trailing version from name.
+func interpreterName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".exe")
+	if base := strings.TrimRight(name, "0123456789."); base != "" {
+		return base
+	}
+	return name
+}
+
+// resolveToolScript returns the absolute path of a scripts/ element, which
+// must be a regular file inside the real scripts directory.
+func resolveToolScript(element, skillDir string) (string, error) {
+	scriptsDir := filepath.Join(skillDir, "scripts")
+	script := filepath.Join(skillDir, filepath.FromSlash(filepath.ToSlash(element)))
+	if rel, err := filepath.Rel(scriptsDir, script); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("command script %q escapes the scripts directory", element)
+	}
+	info, err := os.Lstat(script)
+	if err != nil {
+		return "", fmt.Errorf("command script %q: %w", element, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("command script %q must be a regular file, not a symlink", element)
+	}
+	// Reject scripts reached through a symlinked scripts/ or subdirectory.
+	if dirInfo, err := os.Lstat(scriptsDir); err != nil || dirInfo.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("scripts must be a directory, not a symlink")
+	}
+	realScripts, err := filepath.EvalSymlinks(scriptsDir)
+	if err != nil {
+		return "", err
+	}
+	realScript, err := filepath.EvalSymlinks(script)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realScripts, realScript); err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("command script %q escapes the scripts directory", element)
+	}
+	return script, nil
+}
+
+func validToolName(value string) bool {
+	if value == "" || len(value) > maxToolNameLength || value[0] < 'a' || value[0] > 'z' || strings.Contains(value, "__") {
+		return false
+	}
+	for _, r := range value {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
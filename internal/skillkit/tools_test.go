@@ -0,0 +1,80 @@
+package skillkit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSkillToolsRejectsUnsafeManifests(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "outside.sh")
+	if err := os.WriteFile(outside, []byte("echo outside\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		manifest string
+		want     string
+	}{
+		{"placeholder", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["sh","scripts/run.sh","{{query}}"]}`, "placeholder"},
+		{"shell variable", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["sh","scripts/run.sh","$QUERY"]}`, "placeholder"},
+		{"no script", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["curl","https://example.com"]}`, "scripts directory"},
+		{"escape", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["sh","scripts/../SKILL.md"]}`, "escapes"},
+		{"absolute program", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["/bin/sh","scripts/run.sh"]}`, "bare program"},
+		{"symlink", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["sh","scripts/link.sh"]}`, "symlink"},
+		{"schema", `{"name":"run","description":"d","inputSchema":{"type":"string"},"command":["sh","scripts/run.sh"]}`, `type must be "object"`},
+		{"name", `{"name":"Run Tool","description":"d","inputSchema":{"type":"object"},"command":["sh","scripts/run.sh"]}`, "invalid tool name"},
+		{"inline code", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["sh","-c","cat /etc/passwd","scripts/run.sh"]}`, "scripts directory"},
+		{"interpreter flag", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["python3","-I","scripts/run.sh"]}`, "scripts directory"},
+		{"unknown interpreter", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["xargs","scripts/run.sh"]}`, "not a known script interpreter"},
+		{"unknown field", `{"name":"run","description":"d","inputSchema":{"type":"object"},"command":["sh","scripts/run.sh"],"shell":true}`, "unknown field"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, sub := range []string{"tools", "scripts"} {
+				if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(dir, "scripts", "run.sh"), []byte("cat\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(outside, filepath.Join(dir, "scripts", "link.sh")); err != nil {
+				t.Skip("symlinks are not available")
+			}
+			if err := os.WriteFile(filepath.Join(dir, "tools", "run.json"), []byte(tc.manifest), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadSkillTools(dir, defaultMaxFileBytes)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveToolCommandAcceptsScriptForms(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "scripts"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "scripts", "run.py")
+	if err := os.WriteFile(script, []byte("print(1)\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		command []string
+		want    []string
+	}{
+		{[]string{"scripts/run.py"}, []string{script}},
+		{[]string{"./scripts/run.py", "--quiet"}, []string{script, "--quiet"}},
+		{[]string{"python3.12", "scripts/run.py", "-c", "fixed"}, []string{"python3.12", script, "-c", "fixed"}},
+	} {
+		argv, err := resolveToolCommand(tc.command, dir)
+		if err != nil || strings.Join(argv, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("resolveToolCommand(%q) = %q, %v; want %q", tc.command, argv, err, tc.want)
+		}
+	}
+}
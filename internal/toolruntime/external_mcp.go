@@ -0,0 +1,509 @@
+package toolruntime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dinkisstyle-chat/internal/config"
+	"dinkisstyle-chat/internal/mcp"
+)
+
+// ExternalServerConfig describes one third-party MCP server configured per install.
+type ExternalServerConfig struct {
+	Name           string            `json:"name"`
+	Transport      string            `json:"transport"`
+	Command        string            `json:"command,omitempty"`
+	Args           []string          `json:"args,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Dir            string            `json:"dir,omitempty"`
+	URL            string            `json:"url,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	TimeoutSeconds int               `json:"timeoutSeconds,omitempty"`
+	Disabled       bool              `json:"disabled,omitempty"`
+}
+
+// ExternalServerStatus is the health snapshot shown to administrators.
+type ExternalServerStatus struct {
+	Name          string    `json:"name"`
+	Transport     string    `json:"transport"`
+	State         string    `json:"state"`
+	Tools         []string  `json:"tools"`
+	LastError     string    `json:"lastError,omitempty"`
+	ConnectedAt   time.Time `json:"connectedAt,omitempty"`
+	LastFailureAt time.Time `json:"lastFailureAt,omitempty"`
+	Failures      int       `json:"failures"`
+	Reconnects    int       `json:"reconnects"`
+}
+
+const (
+	externalStateConnecting  = "connecting"
+	externalStateReady       = "ready"
+	externalStateUnavailable = "unavailable"
+
+	externalToolSeparator   = "__"
+	externalMaxToolName     = 64
+	externalInitTimeout     = 20 * time.Second
+	externalCallTimeout     = 60 * time.Second
+	externalPingInterval    = 30 * time.Second
+	externalMinBackoff      = 2 * time.Second
+	externalMaxBackoff      = 2 * time.Minute
+	externalToolListMaxPage = 20
+)
+
+var externalNamePattern = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// ExternalServers connects configured MCP servers and keeps their tools
+// registered in a Registry while the server is reachable.
+type ExternalServers struct {
+	registry *Registry
+
+	mu      sync.Mutex
+	servers []*externalServer
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type externalServer struct {
+	config    ExternalServerConfig
+	namespace string
+	registry  *Registry
+
+	mu        sync.Mutex
+	transport mcpTransport
+	status    ExternalServerStatus
+}
+
+type externalTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+	Annotations struct {
+		ReadOnlyHint    *bool `json:"readOnlyHint"`
+		DestructiveHint *bool `json:"destructiveHint"`
+		IdempotentHint  *bool `json:"idempotentHint"`
+	} `json:"annotations"`
+}
+
+func NewExternalServers(registry *Registry) *ExternalServers {
+	return &ExternalServers{registry: registry}
+}
+
+// Start connects every enabled server in the background. Servers that are down
+// at startup are retried with backoff, so Start never blocks app startup.
+func (m *ExternalServers) Start(ctx context.Context, configs []ExternalServerConfig) {
+	m.Stop()
+	ctx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cancel = cancel
+	m.servers = nil
+	seen := make(map[string]bool)
+	for _, serverConfig := range configs {
+		if serverConfig.Disabled {
+			continue
+		}
+		namespace := ExternalNamespace(serverConfig.Name)
+		transport := normalizeExternalTransport(serverConfig.Transport)
+		if namespace == "" || seen[namespace] {
+			log.Printf("[MCP-Client] Skipping server with empty or duplicate name %q", serverConfig.Name)
+			continue
+		}
+		if transport == "" {
+			log.Printf("[MCP-Client] Skipping server %q: unsupported transport %q", serverConfig.Name, serverConfig.Transport)
+			continue
+		}
+		seen[namespace] = true
+		serverConfig.Transport = transport
+		server := &externalServer{
+			config:    serverConfig,
+			namespace: namespace,
+			registry:  m.registry,
+			status: ExternalServerStatus{
+				Name:      namespace,
+				Transport: transport,
+				State:     externalStateConnecting,
+				Tools:     []string{},
+			},
+		}
+		m.servers = append(m.servers, server)
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			server.supervise(ctx)
+		}()
+	}
+}
+
+// Stop disconnects all servers and removes their tools from the registry.
+func (m *ExternalServers) Stop() {
+	m.mu.Lock()
+	cancel := m.cancel
+	m.cancel = nil
+	m.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	m.wg.Wait()
+}
+
+func (m *ExternalServers) Statuses() []ExternalServerStatus {
+	m.mu.Lock()
+	servers := append([]*externalServer(nil), m.servers...)
+	m.mu.Unlock()
+	statuses := make([]ExternalServerStatus, 0, len(servers))
+	for _, server := range servers {
+		statuses = append(statuses, server.snapshot())
+	}
+	return statuses
+}
+
+// ExternalNamespace converts a configured server name to the prefix used for
+// its tools. Tool names are lower-cased by the call normalizer, so the
+// namespace is lower-case as well.
+func ExternalNamespace(name string) string {
+	name = externalNamePattern.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "_")
+	return strings.Trim(name, "_-")
+}
+
+func externalToolName(namespace, tool string) string {
+	return namespace + externalToolSeparator + ExternalNamespace(tool)
+}
+
+func normalizeExternalTransport(transport string) string {
+	switch strings.ToLower(strings.TrimSpace(transport)) {
+	case "", "stdio":
+		return "stdio"
+	case "http", "streamable-http", "streamable_http":
+		return "http"
+	default:
+		return ""
+	}
+}
+
+func (s *externalServer) snapshot() ExternalServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Tools = append([]string(nil), s.status.Tools...)
+	return status
+}
+
+// supervise owns the connection lifecycle: connect, watch for exit or failed
+// pings, drop the tools, and reconnect with exponential backoff.
+func (s *externalServer) supervise(ctx context.Context) {
+	defer s.disconnect(nil)
+	backoff := externalMinBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.connect(ctx, attempt > 0)
+		if err == nil {
+			backoff = externalMinBackoff
+			err = s.watch(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.disconnect(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > externalMaxBackoff {
+			backoff = externalMaxBackoff
+		}
+	}
+}
+
+func (s *externalServer) connect(ctx context.Context, reconnect bool) error {
+	s.mu.Lock()
+	s.status.State = externalStateConnecting
+	if reconnect {
+		s.status.Reconnects++
+	}
+	s.mu.Unlock()
+
+	var transport mcpTransport
+	var err error
+	switch s.config.Transport {
+	case "http":
+		transport, err = newHTTPTransport(s.config)
+	default:
+		transport, err = startStdioTransport(s.config)
+	}
+	if err != nil {
+		return err
+	}
+	initCtx, cancel := context.WithTimeout(ctx, externalInitTimeout)
+	defer cancel()
+	tools, err := initializeExternalServer(initCtx, transport)
+	if err != nil {
+		transport.Close()
+		return err
+	}
+
+	registered := s.registerTools(tools, transport)
+	s.mu.Lock()
+	s.transport = transport
+	s.status.State = externalStateReady
+	s.status.Tools = registered
+	s.status.LastError = ""
+	s.status.ConnectedAt = time.Now()
+	s.mu.Unlock()
+	log.Printf("[MCP-Client] Connected %s (%s): %d tools", s.namespace, s.config.Transport, len(registered))
+	mcp.EmitTrace("mcp_client", "server.ready", "External MCP server connected", map[string]interface{}{
+		"server":    s.namespace,
+		"transport": s.config.Transport,
+		"tools":     len(registered),
+	})
+	return nil
+}
+
+func initializeExternalServer(ctx context.Context, transport mcpTransport) ([]externalTool, error) {
+	_, err := transport.Request(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo": map[string]interface{}{
+			"name":    "dkst-llm-gateway",
+			"version": config.AppVersion,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initialize failed: %w", err)
+	}
+	if err := transport.Notify(ctx, "notifications/initialized", nil); err != nil {
+		return nil, fmt.Errorf("initialized notification failed: %w", err)
+	}
+
+	var tools []externalTool
+	cursor := ""
+	for page := 0; page < externalToolListMaxPage; page++ {
+		var params interface{}
+		if cursor != "" {
+			params = map[string]interface{}{"cursor": cursor}
+		}
+		raw, err := transport.Request(ctx, "tools/list", params)
+		if err != nil {
+			return nil, fmt.Errorf("tools/list failed: %w", err)
+		}
+		var listed struct {
+			Tools      []externalTool `json:"tools"`
+			NextCursor string         `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(raw, &listed); err != nil {
+			return nil, fmt.Errorf("invalid tools/list result: %w", err)
+		}
+		tools = append(tools, listed.Tools...)
+		if cursor = strings.TrimSpace(listed.NextCursor); cursor == "" {
+			break
+		}
+	}
+	return tools, nil
+}
+
+func (s *externalServer) registerTools(tools []externalTool, transport mcpTransport) []string {
+	registered := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		name := externalToolName(s.namespace, tool.Name)
+		if strings.TrimSpace(tool.Name) == "" || len(name) > externalMaxToolName {
+			log.Printf("[MCP-Client] Skipping tool %q from %s: invalid or too long name", tool.Name, s.namespace)
+			continue
+		}
+		schema := tool.InputSchema
+		if len(schema) == 0 || !json.Valid(schema) {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		description := strings.TrimSpace(tool.Description)
+		if description == "" {
+			description = tool.Name
+		}
+		definition := Definition{
+			Name:        name,
+			Description: "[" + s.namespace + "] " + description,
+			InputSchema: schema,
+			Metadata:    externalMetadata(tool),
+		}
+		remoteName := tool.Name
+		if err := s.registry.Register(definition, func(ctx context.Context, execCtx ExecutionContext, arguments json.RawMessage) (Result, error) {
+			return s.call(ctx, transport, remoteName, arguments)
+		}); err != nil {
+			log.Printf("[MCP-Client] Failed to register %s: %v", name, err)
+			continue
+		}
+		registered = append(registered, name)
+	}
+	sort.Strings(registered)
+	return registered
+}
+
+// externalMetadata trusts only the read-only hint; anything else is treated as
+// side-effecting because third-party annotations are advisory.
+func externalMetadata(tool externalTool) Metadata {
+	metadata := Metadata{Category: "external", SideEffecting: true}
+	if tool.Annotations.ReadOnlyHint != nil && *tool.Annotations.ReadOnlyHint {
+		metadata.ReadOnly = true
+		metadata.SideEffecting = false
+		metadata.ParallelSafe = true
+	}
+	return metadata
+}
+
+func (s *externalServer) watch(ctx context.Context) error {
+	s.mu.Lock()
+	transport := s.transport
+	s.mu.Unlock()
+	ticker := time.NewTicker(externalPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-transport.Done():
+			return fmt.Errorf("connection closed")
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			_, err := transport.Request(pingCtx, "ping", nil)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				var rpcErr *jsonRPCError
+				if errors.As(err, &rpcErr) && rpcErr.Code == -32601 {
+					continue
+				}
+				return fmt.Errorf("ping failed: %w", err)
+			}
+		}
+	}
+}
+
+// disconnect closes the transport and removes the server's tools so the model
+// is never offered a tool that cannot run. A nil err means a clean shutdown.
+func (s *externalServer) disconnect(err error) {
+	s.mu.Lock()
+	transport := s.transport
+	tools := s.status.Tools
+	s.transport = nil
+	s.status.Tools = []string{}
+	s.status.State = externalStateUnavailable
+	if err != nil {
+		s.status.LastError = err.Error()
+		s.status.LastFailureAt = time.Now()
+		s.status.Failures++
+	}
+	s.mu.Unlock()
+
+	if transport != nil {
+		transport.Close()
+	}
+	for _, name := range tools {
+		s.registry.Unregister(name)
+	}
+	if err != nil {
+		log.Printf("[MCP-Client] Server %s unavailable: %v", s.namespace, err)
+		mcp.EmitTrace("mcp_client", "server.unavailable", "External MCP server unavailable", map[string]interface{}{
+			"server": s.namespace,
+			"error":  err.Error(),
+		})
+	}
+}
+
+func (s *externalServer) call(ctx context.Context, transport mcpTransport, name string, arguments json.RawMessage) (Result, error) {
+	select {
+	case <-transport.Done():
+		return Result{IsError: true}, fmt.Errorf("mcp server %s is reconnecting", s.namespace)
+	default:
+	}
+	timeout := externalCallTimeout
+	if s.config.TimeoutSeconds > 0 {
+		timeout = time.Duration(s.config.TimeoutSeconds) * time.Second
+	}
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	raw, err := transport.Request(callCtx, "tools/call", map[string]interface{}{
+		"name":      name,
+		"arguments": arguments,
+	})
+	if err != nil {
+		mcp.EmitTrace("mcp_client", "tool.error", "External MCP tool call failed", map[string]interface{}{
+			"server":      s.namespace,
+			"tool":        name,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"error":       err.Error(),
+		})
+		return Result{IsError: true}, fmt.Errorf("mcp server %s: %w", s.namespace, err)
+	}
+	var called struct {
+		Content           []externalContent `json:"content"`
+		StructuredContent json.RawMessage   `json:"structuredContent"`
+		IsError           bool              `json:"isError"`
+	}
+	if err := json.Unmarshal(raw, &called); err != nil {
+		return Result{IsError: true}, fmt.Errorf("invalid tools/call result from %s: %w", s.namespace, err)
+	}
+	content := renderExternalContent(called.Content)
+	if content == "" && len(called.StructuredContent) > 0 && string(called.StructuredContent) != "null" {
+		content = string(called.StructuredContent)
+	}
+	mcp.EmitTrace("mcp_client", "tool.done", "External MCP tool call completed", map[string]interface{}{
+		"server":       s.namespace,
+		"tool":         name,
+		"duration_ms":  time.Since(start).Milliseconds(),
+		"result_chars": len(content),
+		"is_error":     called.IsError,
+	})
+	result := Result{Content: content, IsError: called.IsError, Meta: map[string]interface{}{"mcp_server": s.namespace}}
+	if called.IsError {
+		return result, fmt.Errorf("tool %s reported an error", name)
+	}
+	return result, nil
+}
+
+type externalContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	MimeType string `json:"mimeType"`
+	URI      string `json:"uri"`
+	Name     string `json:"name"`
+	Resource *struct {
+		URI      string `json:"uri"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+	} `json:"resource"`
+}
+
+func renderExternalContent(items []externalContent) string {
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		switch item.Type {
+		case "text":
+			parts = append(parts, item.Text)
+		case "resource":
+			if item.Resource == nil {
+				continue
+			}
+			if strings.TrimSpace(item.Resource.Text) != "" {
+				parts = append(parts, item.Resource.Text)
+			} else {
+				parts = append(parts, fmt.Sprintf("[resource: %s]", item.Resource.URI))
+			}
+		case "resource_link":
+			parts = append(parts, fmt.Sprintf("[resource link: %s %s]", item.Name, item.URI))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s content: %s]", item.Type, item.MimeType))
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n"))
+}
+
+// External hosts the configured third-party MCP servers for Default.
+var External = NewExternalServers(Default)
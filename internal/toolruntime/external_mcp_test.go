@@ -0,0 +1,193 @@
+package toolruntime
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMCPReply answers the small subset of MCP the client uses. It is shared by
+// the stdio helper process and the HTTP test server.
+func fakeMCPReply(line []byte) (map[string]interface{}, bool) {
+	var request struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params struct {
+			Name      string                 `json:"name"`
+			Arguments map[string]interface{} `json:"arguments"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(line, &request); err != nil || len(request.ID) == 0 {
+		return nil, false
+	}
+	reply := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+	switch request.Method {
+	case "initialize":
+		reply["result"] = map[string]interface{}{"protocolVersion": mcpProtocolVersion, "capabilities": map[string]interface{}{"tools": map[string]interface{}{}}}
+	case "tools/list":
+		reply["result"] = map[string]interface{}{"tools": []map[string]interface{}{
+			{
+				"name":        "Echo",
+				"description": "Echo text back",
+				"inputSchema": map[string]interface{}{"type": "object", "required": []string{"text"}, "properties": map[string]interface{}{"text": map[string]interface{}{"type": "string"}}},
+				"annotations": map[string]interface{}{"readOnlyHint": true},
+			},
+			{"name": "crash", "description": "Exit the server", "inputSchema": map[string]interface{}{"type": "object"}},
+		}}
+	case "tools/call":
+		if request.Params.Name == "crash" {
+			os.Exit(3)
+		}
+		reply["result"] = map[string]interface{}{"content": []map[string]interface{}{{"type": "text", "text": fmt.Sprint("echo: ", request.Params.Arguments["text"])}}}
+	case "ping":
+		reply["result"] = map[string]interface{}{}
+	default:
+		reply["error"] = map[string]interface{}{"code": -32601, "message": "unknown method"}
+	}
+	return reply, true
+}
+
+func TestExternalMCPHelperProcess(t *testing.T) {
+	if os.Getenv("DKST_FAKE_MCP_SERVER") != "1" {
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if reply, ok := fakeMCPReply(scanner.Bytes()); ok {
+			data, _ := json.Marshal(reply)
+			fmt.Println(string(data))
+		}
+	}
+	os.Exit(0)
+}
+
+func waitForExternalTool(t *testing.T, registry *Registry, name string, present bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		found := false
+		for _, definition := range registry.List(ExecutionContext{}) {
+			if definition.Name == name {
+				found = true
+				break
+			}
+		}
+		if found == present {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("tool %q present=%v was not reached", name, present)
+}
+
+func TestExternalStdioServerRegistersToolsAndReconnects(t *testing.T) {
+	registry := NewRegistry()
+	servers := NewExternalServers(registry)
+	servers.Start(context.Background(), []ExternalServerConfig{{
+		Name:      "Fake Server",
+		Transport: "stdio",
+		Command:   os.Args[0],
+		Args:      []string{"-test.run=TestExternalMCPHelperProcess"},
+		Env:       map[string]string{"DKST_FAKE_MCP_SERVER": "1"},
+	}})
+	defer servers.Stop()
+
+	waitForExternalTool(t, registry, "fake_server__echo", true)
+	for _, definition := range registry.List(ExecutionContext{}) {
+		if definition.Name == "fake_server__echo" && (!definition.Metadata.ReadOnly || !strings.HasPrefix(definition.Description, "[fake_server]")) {
+			t.Fatalf("unexpected external definition: %#v", definition)
+		}
+		if definition.Name == "fake_server__crash" && !definition.Metadata.SideEffecting {
+			t.Fatalf("tool without read-only hint must be side-effecting: %#v", definition)
+		}
+	}
+
+	result, err := registry.Call(context.Background(), ExecutionContext{}, "fake_server__echo", json.RawMessage(`{"text":"hi"}`))
+	if err != nil || result.Content != "echo: hi" {
+		t.Fatalf("echo call failed: result=%#v err=%v", result, err)
+	}
+	if _, err := registry.Call(context.Background(), ExecutionContext{}, "fake_server__echo", json.RawMessage(`{}`)); err == nil {
+		t.Fatal("external schema required argument was not enforced")
+	}
+	if _, err := registry.Call(context.Background(), ExecutionContext{DisabledTools: []string{"fake_server__echo"}}, "fake_server__echo", json.RawMessage(`{"text":"hi"}`)); err == nil {
+		t.Fatal("per-user disabled tools policy was not applied to external tools")
+	}
+
+	if _, err := registry.Call(context.Background(), ExecutionContext{}, "fake_server__crash", json.RawMessage(`{}`)); err == nil {
+		t.Fatal("call to crashing server unexpectedly succeeded")
+	}
+	waitForExternalTool(t, registry, "fake_server__echo", false)
+	waitForExternalTool(t, registry, "fake_server__echo", true)
+
+	status := servers.Statuses()[0]
+	if status.State != externalStateReady || status.Reconnects < 1 || status.Failures < 1 {
+		t.Fatalf("unexpected health status after reconnect: %#v", status)
+	}
+	result, err = registry.Call(context.Background(), ExecutionContext{}, "fake_server__echo", json.RawMessage(`{"text":"again"}`))
+	if err != nil || result.Content != "echo: again" {
+		t.Fatalf("echo after reconnect failed: result=%#v err=%v", result, err)
+	}
+
+	servers.Stop()
+	if _, err := registry.Call(context.Background(), ExecutionContext{}, "fake_server__echo", json.RawMessage(`{"text":"hi"}`)); err == nil {
+		t.Fatal("external tool stayed registered after Stop")
+	}
+}
+
+func TestExternalHTTPServerUsesSessionAndSSEReplies(t *testing.T) {
+	var sessionErrors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		reply, ok := fakeMCPReply(body)
+		if !ok {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if strings.Contains(string(body), `"initialize"`) {
+			w.Header().Set("Mcp-Session-Id", "session-1")
+		} else if r.Header.Get("Mcp-Session-Id") != "session-1" {
+			sessionErrors = append(sessionErrors, string(body))
+		}
+		data, _ := json.Marshal(reply)
+		if strings.Contains(string(body), `"tools/call"`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\"}\n\n")
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	registry := NewRegistry()
+	servers := NewExternalServers(registry)
+	servers.Start(context.Background(), []ExternalServerConfig{{
+		Name:      "remote",
+		Transport: "streamable-http",
+		URL:       server.URL,
+		Headers:   map[string]string{"Authorization": "Bearer secret"},
+	}})
+	defer servers.Stop()
+
+	waitForExternalTool(t, registry, "remote__echo", true)
+	result, err := registry.Call(context.Background(), ExecutionContext{}, "remote__echo", json.RawMessage(`{"text":"sse"}`))
+	if err != nil || result.Content != "echo: sse" {
+		t.Fatalf("http echo call failed: result=%#v err=%v", result, err)
+	}
+	if len(sessionErrors) > 0 {
+		t.Fatalf("requests were sent without the negotiated session id: %v", sessionErrors)
+	}
+}
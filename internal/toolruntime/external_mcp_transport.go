@@ -0,0 +1,457 @@
+package toolruntime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const mcpProtocolVersion = "2025-06-18"
+
+var errMCPTransportClosed = errors.New("mcp transport is closed")
+
+type jsonRPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *jsonRPCError) Error() string {
+	return fmt.Sprintf("mcp error %d: %s", e.Code, e.Message)
+}
+
+type jsonRPCMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+}
+
+// mcpTransport carries JSON-RPC requests to one external MCP server.
+type mcpTransport interface {
+	Request(ctx context.Context, method string, params interface{}) (json.RawMessage, error)
+	Notify(ctx context.Context, method string, params interface{}) error
+	Done() <-chan struct{}
+	Close() error
+}
+
+func encodeParams(params interface{}) (json.RawMessage, error) {
+	if params == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// stdioTransport speaks newline-delimited JSON-RPC with a child process.
+type stdioTransport struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+	nextID  atomic.Int64
+
+	mu      sync.Mutex
+	pending map[string]chan jsonRPCMessage
+	done    chan struct{}
+	err     error
+	stderr  limitedText
+}
+
+func startStdioTransport(config ExternalServerConfig) (*stdioTransport, error) {
+	if strings.TrimSpace(config.Command) == "" {
+		return nil, fmt.Errorf("command is required for stdio transport")
+	}
+	cmd := exec.Command(config.Command, config.Args...)
+	cmd.Dir = strings.TrimSpace(config.Dir)
+	cmd.Env = os.Environ()
+	for key, value := range config.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	transport := &stdioTransport{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[string]chan jsonRPCMessage),
+		done:    make(chan struct{}),
+		stderr:  limitedText{limit: 8 * 1024},
+	}
+	cmd.Stderr = &transport.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go transport.readLoop(stdout)
+	return transport, nil
+}
+
+func (t *stdioTransport) readLoop(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	var readErr error
+	for {
+		line, err := reader.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			t.dispatch(trimmed)
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	waitErr := t.cmd.Wait()
+	if waitErr != nil {
+		readErr = waitErr
+	}
+	if stderr := strings.TrimSpace(t.stderr.String()); stderr != "" {
+		readErr = fmt.Errorf("%v: %s", readErr, stderr)
+	}
+	t.shutdown(fmt.Errorf("mcp server exited: %w", readErr))
+}
+
+func (t *stdioTransport) dispatch(line []byte) {
+	var message jsonRPCMessage
+	if err := json.Unmarshal(line, &message); err != nil {
+		return
+	}
+	if message.Method != "" {
+		if len(message.ID) > 0 {
+			t.replyToServerRequest(message)
+		}
+		return
+	}
+	key := string(message.ID)
+	t.mu.Lock()
+	waiter, ok := t.pending[key]
+	delete(t.pending, key)
+	t.mu.Unlock()
+	if ok {
+		waiter <- message
+	}
+}
+
+// replyToServerRequest answers ping and rejects other server-initiated requests
+// so a server never blocks waiting for the gateway.
+func (t *stdioTransport) replyToServerRequest(request jsonRPCMessage) {
+	reply := jsonRPCMessage{JSONRPC: "2.0", ID: request.ID}
+	if request.Method == "ping" {
+		reply.Result = json.RawMessage(`{}`)
+	} else {
+		reply.Error = &jsonRPCError{Code: -32601, Message: "method not supported by gateway client"}
+	}
+	_ = t.write(reply)
+}
+
+func (t *stdioTransport) write(message jsonRPCMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	select {
+	case <-t.done:
+		return t.closedErr()
+	default:
+	}
+	_, err = t.stdin.Write(append(data, '\n'))
+	return err
+}
+
+func (t *stdioTransport) Request(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	encoded, err := encodeParams(params)
+	if err != nil {
+		return nil, err
+	}
+	id := json.RawMessage(fmt.Sprintf("%d", t.nextID.Add(1)))
+	waiter := make(chan jsonRPCMessage, 1)
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		return nil, t.err
+	}
+	t.pending[string(id)] = waiter
+	t.mu.Unlock()
+
+	if err := t.write(jsonRPCMessage{JSONRPC: "2.0", ID: id, Method: method, Params: encoded}); err != nil {
+		t.forget(string(id))
+		return nil, err
+	}
+	select {
+	case message := <-waiter:
+		if message.Error != nil {
+			return nil, message.Error
+		}
+		return message.Result, nil
+	case <-t.done:
+		return nil, t.closedErr()
+	case <-ctx.Done():
+		t.forget(string(id))
+		_ = t.Notify(context.Background(), "notifications/cancelled", map[string]interface{}{"requestId": json.RawMessage(id)})
+		return nil, ctx.Err()
+	}
+}
+
+func (t *stdioTransport) Notify(ctx context.Context, method string, params interface{}) error {
+	encoded, err := encodeParams(params)
+	if err != nil {
+		return err
+	}
+	return t.write(jsonRPCMessage{JSONRPC: "2.0", Method: method, Params: encoded})
+}
+
+func (t *stdioTransport) forget(id string) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+func (t *stdioTransport) closedErr() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	return errMCPTransportClosed
+}
+
+func (t *stdioTransport) shutdown(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return
+	}
+	if err == nil {
+		err = errMCPTransportClosed
+	}
+	t.err = err
+	t.pending = make(map[string]chan jsonRPCMessage)
+	close(t.done)
+}
+
+func (t *stdioTransport) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *stdioTransport) Close() error {
+	_ = t.stdin.Close()
+	select {
+	case <-t.done:
+		return nil
+	case <-time.After(2 * time.Second):
+	}
+	if t.cmd.Process != nil {
+		_ = t.cmd.Process.Kill()
+	}
+	<-t.done
+	return nil
+}
+
+// httpTransport implements the MCP streamable HTTP transport: every message is
+// a POST and the reply is either a JSON body or an SSE stream.
+type httpTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	nextID  atomic.Int64
+
+	mu        sync.Mutex
+	sessionID string
+	done      chan struct{}
+	closed    bool
+}
+
+func newHTTPTransport(config ExternalServerConfig) (*httpTransport, error) {
+	if strings.TrimSpace(config.URL) == "" {
+		return nil, fmt.Errorf("url is required for http transport")
+	}
+	return &httpTransport{
+		url:     strings.TrimSpace(config.URL),
+		headers: config.Headers,
+		client:  &http.Client{},
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (t *httpTransport) post(ctx context.Context, message jsonRPCMessage) (*http.Response, error) {
+	t.mu.Lock()
+	closed := t.closed
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if closed {
+		return nil, errMCPTransportClosed
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("MCP-Protocol-Version", mcpProtocolVersion)
+	if sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", sessionID)
+	}
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if id := strings.TrimSpace(resp.Header.Get("Mcp-Session-Id")); id != "" {
+		t.mu.Lock()
+		t.sessionID = id
+		t.mu.Unlock()
+	}
+	if resp.StatusCode == http.StatusNotFound && sessionID != "" {
+		resp.Body.Close()
+		t.Close()
+		return nil, fmt.Errorf("mcp session expired")
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		resp.Body.Close()
+		return nil, fmt.Errorf("mcp http status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) Request(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	encoded, err := encodeParams(params)
+	if err != nil {
+		return nil, err
+	}
+	id := json.RawMessage(fmt.Sprintf("%d", t.nextID.Add(1)))
+	resp, err := t.post(ctx, jsonRPCMessage{JSONRPC: "2.0", ID: id, Method: method, Params: encoded})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var message jsonRPCMessage
+	if strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/event-stream") {
+		message, err = readSSEResponse(resp.Body, string(id))
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if message.Error != nil {
+		return nil, message.Error
+	}
+	return message.Result, nil
+}
+
+// readSSEResponse scans an SSE reply until the JSON-RPC response for id arrives.
+func readSSEResponse(body io.Reader, id string) (jsonRPCMessage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+	var data strings.Builder
+	flush := func() (jsonRPCMessage, bool) {
+		defer data.Reset()
+		var message jsonRPCMessage
+		if data.Len() == 0 || json.Unmarshal([]byte(data.String()), &message) != nil {
+			return message, false
+		}
+		return message, message.Method == "" && string(message.ID) == id
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if message, ok := flush(); ok {
+				return message, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "data:") {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if message, ok := flush(); ok {
+		return message, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return jsonRPCMessage{}, err
+	}
+	return jsonRPCMessage{}, fmt.Errorf("mcp stream ended without a response")
+}
+
+func (t *httpTransport) Notify(ctx context.Context, method string, params interface{}) error {
+	encoded, err := encodeParams(params)
+	if err != nil {
+		return err
+	}
+	resp, err := t.post(ctx, jsonRPCMessage{JSONRPC: "2.0", Method: method, Params: encoded})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *httpTransport) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *httpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+	return nil
+}
+
+type limitedText struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+	limit  int
+}
+
+func (b *limitedText) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	original := len(data)
+	if remaining := b.limit - b.buffer.Len(); remaining > 0 {
+		if len(data) > remaining {
+			data = data[:remaining]
+		}
+		_, _ = b.buffer.Write(data)
+	}
+	return original, nil
+}
+
+func (b *limitedText) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
@@ -0,0 +1,131 @@
+package toolruntime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"dinkisstyle-chat/internal/config"
+)
+
+var supportedMCPProtocolVersions = []string{mcpProtocolVersion, "2025-03-26", "2024-11-05"}
+
+// MCPServer serves a Registry over MCP JSON-RPC. It is transport independent:
+// the HTTP endpoint and the stdio bridge both feed it one message at a time
+// together with the caller's ExecutionContext.
+type MCPServer struct {
+	registry *Registry
+}
+
+func NewMCPServer(registry *Registry) *MCPServer {
+	return &MCPServer{registry: registry}
+}
+
+// HandleMessage processes one JSON-RPC message and returns the encoded reply.
+// Notifications and client responses produce a nil reply.
+func (s *MCPServer) HandleMessage(ctx context.Context, execCtx ExecutionContext, data []byte) []byte {
+	var message jsonRPCMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return encodeRPCReply(jsonRPCMessage{
+			JSONRPC: "2.0",
+			ID:      json.RawMessage("null"),
+			Error:   &jsonRPCError{Code: -32700, Message: "parse error"},
+		})
+	}
+	if message.Method == "" || len(message.ID) == 0 {
+		return nil
+	}
+	reply := jsonRPCMessage{JSONRPC: "2.0", ID: message.ID}
+	result, err := s.dispatch(ctx, execCtx, message.Method, message.Params)
+	if err != nil {
+		rpcErr, ok := err.(*jsonRPCError)
+		if !ok {
+			rpcErr = &jsonRPCError{Code: -32603, Message: err.Error()}
+		}
+		reply.Error = rpcErr
+	} else {
+		reply.Result = result
+	}
+	return encodeRPCReply(reply)
+}
+
+func encodeRPCReply(reply jsonRPCMessage) []byte {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		data, _ = json.Marshal(jsonRPCMessage{JSONRPC: "2.0", ID: reply.ID, Error: &jsonRPCError{Code: -32603, Message: "failed to encode reply"}})
+	}
+	return data
+}
+
+func (s *MCPServer) dispatch(ctx context.Context, execCtx ExecutionContext, method string, params json.RawMessage) (json.RawMessage, error) {
+	switch method {
+	case "initialize":
+		var request struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		_ = json.Unmarshal(params, &request)
+		version := mcpProtocolVersion
+		for _, supported := range supportedMCPProtocolVersions {
+			if strings.TrimSpace(request.ProtocolVersion) == supported {
+				version = supported
+				break
+			}
+		}
+		return json.Marshal(map[string]interface{}{
+			"protocolVersion": version,
+			"capabilities": map[string]interface{}{
+				"tools": map[string]interface{}{"listChanged": false},
+			},
+			"serverInfo": map[string]interface{}{
+				"name":    "dkst-llm-gateway",
+				"version": config.AppVersion,
+			},
+		})
+	case "ping":
+		return json.RawMessage(`{}`), nil
+	case "tools/list":
+		definitions := s.registry.List(execCtx)
+		tools := make([]map[string]interface{}, 0, len(definitions))
+		for _, definition := range definitions {
+			tools = append(tools, map[string]interface{}{
+				"name":        definition.Name,
+				"description": definition.Description,
+				"inputSchema": definition.InputSchema,
+				"annotations": map[string]interface{}{
+					"readOnlyHint":    definition.Metadata.ReadOnly,
+					"destructiveHint": definition.Metadata.SideEffecting,
+				},
+			})
+		}
+		return json.Marshal(map[string]interface{}{"tools": tools})
+	case "tools/call":
+		var request struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(params, &request); err != nil || strings.TrimSpace(request.Name) == "" {
+			return nil, &jsonRPCError{Code: -32602, Message: "tools/call requires a tool name"}
+		}
+		if !s.registry.Has(request.Name) {
+			return nil, &jsonRPCError{Code: -32602, Message: fmt.Sprintf("unknown tool: %s", request.Name)}
+		}
+		result, err := s.registry.Call(ctx, execCtx, request.Name, request.Arguments)
+		text := result.Content
+		if err != nil {
+			// Tool failures are results, not protocol errors, so the calling
+			// agent can read the reason and retry like the chat loop does.
+			if strings.TrimSpace(text) == "" {
+				text = err.Error()
+			} else {
+				text = err.Error() + "\n\n" + strings.TrimSpace(text)
+			}
+		}
+		return json.Marshal(map[string]interface{}{
+			"content": []map[string]interface{}{{"type": "text", "text": text}},
+			"isError": err != nil || result.IsError,
+		})
+	default:
+		return nil, &jsonRPCError{Code: -32601, Message: "method not found: " + method}
+	}
+}
@@ -0,0 +1,91 @@
+package toolruntime
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMCPServerRoundTripsThroughExternalClient(t *testing.T) {
+	served := NewRegistry()
+	for _, name := range []string{"lookup", "private"} {
+		toolName := name
+		err := served.Register(Definition{
+			Name:        toolName,
+			Description: "test tool " + toolName,
+			InputSchema: json.RawMessage(`{"type":"object","required":["q"],"properties":{"q":{"type":"string"}}}`),
+			Metadata:    Metadata{ReadOnly: true},
+		}, func(_ context.Context, execCtx ExecutionContext, arguments json.RawMessage) (Result, error) {
+			return Result{Content: execCtx.UserID + ":" + toolName + ":" + string(arguments)}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := NewMCPServer(served)
+	execCtx := ExecutionContext{UserID: "lan-agent", DisabledTools: []string{"private"}}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reply := server.HandleMessage(r.Context(), execCtx, body)
+		if reply == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(reply)
+	}))
+	defer httpServer.Close()
+
+	client := NewRegistry()
+	servers := NewExternalServers(client)
+	servers.Start(context.Background(), []ExternalServerConfig{{Name: "gateway", Transport: "http", URL: httpServer.URL}})
+	defer servers.Stop()
+	waitForExternalTool(t, client, "gateway__lookup", true)
+
+	for _, definition := range client.List(ExecutionContext{}) {
+		if definition.Name == "gateway__private" {
+			t.Fatal("tool disabled for the calling user was listed")
+		}
+		if definition.Name == "gateway__lookup" && !definition.Metadata.ReadOnly {
+			t.Fatalf("read-only annotation was not served: %#v", definition)
+		}
+	}
+	result, err := client.Call(context.Background(), ExecutionContext{}, "gateway__lookup", json.RawMessage(`{"q":"x"}`))
+	if err != nil || !strings.HasPrefix(result.Content, "lan-agent:lookup:") {
+		t.Fatalf("round trip failed: result=%#v err=%v", result, err)
+	}
+}
+
+func TestMCPServerReportsProtocolAndToolErrors(t *testing.T) {
+	registry := NewRegistry()
+	_ = registry.Register(Definition{
+		Name:        "needs_q",
+		InputSchema: json.RawMessage(`{"type":"object","required":["q"],"properties":{"q":{"type":"string"}}}`),
+	}, func(context.Context, ExecutionContext, json.RawMessage) (Result, error) {
+		return Result{Content: "ok"}, nil
+	})
+	server := NewMCPServer(registry)
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{`not json`, `"code":-32700`},
+		{`{"jsonrpc":"2.0","id":1,"method":"resources/list"}`, `"code":-32601`},
+		{`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"missing"}}`, `"code":-32602`},
+		{`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"needs_q","arguments":{}}}`, `"isError":true`},
+		{`{"jsonrpc":"2.0","id":4,"method":"initialize","params":{"protocolVersion":"2024-11-05"}}`, `"protocolVersion":"2024-11-05"`},
+	}
+	for _, test := range tests {
+		reply := string(server.HandleMessage(context.Background(), ExecutionContext{}, []byte(test.message)))
+		if !strings.Contains(reply, test.want) {
+			t.Fatalf("HandleMessage(%s) = %s, want %s", test.message, reply, test.want)
+		}
+	}
+	if reply := server.HandleMessage(context.Background(), ExecutionContext{}, []byte(`{"jsonrpc":"2.0","method":"notifications/initialized"}`)); reply != nil {
+		t.Fatalf("notification produced a reply: %s", reply)
+	}
+}
@@ -0,0 +1,331 @@
+package toolruntime
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"dinkisstyle-chat/internal/mcp"
+)
+
+// ResultCacheLimits bounds a ResultCache. Persist* limits apply to the SQLite
+// table shared by every cache; zero PersistEntries keeps results in memory.
+type ResultCacheLimits struct {
+	MaxEntries     int
+	MaxBytes       int64
+	MaxValueBytes  int
+	PersistEntries int
+	PersistBytes   int64
+}
+
+func DefaultResultCacheLimits() ResultCacheLimits {
+	return ResultCacheLimits{
+		MaxEntries:     256,
+		MaxBytes:       8 << 20,
+		MaxValueBytes:  256 << 10,
+		PersistEntries: 2048,
+		PersistBytes:   64 << 20,
+	}
+}
+
+type CacheStats struct {
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Bypasses int64 `json:"bypasses"`
+	Entries  int   `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+}
+
+type cachedResult struct {
+	tool      string
+	userID    string
+	value     string
+	storedAt  time.Time
+	expiresAt time.Time
+	usedAt    time.Time
+}
+
+// ResultCache reuses tool results for Metadata.CacheTTL. Entries are keyed by
+// tool name and canonical arguments, plus the user for CachePerUser and
+// RequiresMemory tools, so private results are never served to another user.
+// A memory change of a user drops that user's entries.
+type ResultCache struct {
+	limits ResultCacheLimits
+
+	mu          sync.Mutex
+	entries     map[string]cachedResult
+	bytes       int64
+	generations map[string]uint64
+	stats       CacheStats
+}
+
+func NewResultCache(limits ResultCacheLimits) *ResultCache {
+	return &ResultCache{
+		limits:      limits,
+		entries:     make(map[string]cachedResult),
+		generations: make(map[string]uint64),
+	}
+}
+
+var DefaultResultCache = NewResultCache(DefaultResultCacheLimits())
+
+// Stats returns the hit, miss and bypass counters and the in-memory size.
+func (c *ResultCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// InvalidateUser drops every private entry of userID, in memory and on disk.
+// Fetches that were already running for the user are not stored.
+func (c *ResultCache) InvalidateUser(userID string) {
+	userID = strings.TrimSpace(userID)
+	if userID == "" {
+		return
+	}
+	c.mu.Lock()
+	c.generations[userID]++
+	for key, entry := range c.entries {
+		if entry.userID == userID {
+			c.removeLocked(key)
+		}
+	}
+	c.mu.Unlock()
+	if c.limits.PersistEntries > 0 {
+		if err := mcp.DeleteToolCacheEntriesForUser(userID); err != nil {
+			log.Printf("[ToolCache] %v", err)
+		}
+	}
+}
+
+// cachedCall describes how Registry.Call wants one call cached. It travels in
+// the handler context so only the fetch stage of a handler is memoized.
+type cachedCall struct {
+	cache  *ResultCache
+	key    string
+	tool   string
+	userID string
+	ttl    time.Duration
+	fresh  bool
+}
+
+type cachedCallKey struct{}
+
+// CachedFetch runs fetch through the cache chosen by Registry.Call for ctx. It
+// is installed as the mcp tool fetch cache; without a cached call in ctx it
+// simply runs fetch.
+func CachedFetch(ctx context.Context, fetch func() (string, error)) (string, error) {
+	call, ok := ctx.Value(cachedCallKey{}).(cachedCall)
+	if !ok || call.cache == nil {
+		return fetch()
+	}
+	return call.cache.fetch(call, fetch)
+}
+
+func (c *ResultCache) fetch(call cachedCall, fetch func() (string, error)) (string, error) {
+	now := time.Now()
+	c.mu.Lock()
+	generation := c.generations[call.userID]
+	if call.fresh {
+		c.stats.Bypasses++
+		c.mu.Unlock()
+		c.trace("bypass", "Tool cache bypassed for fresh results", call, 0)
+	} else if entry, ok := c.entries[call.key]; ok && now.Before(entry.expiresAt) {
+		entry.usedAt = now
+		c.entries[call.key] = entry
+		c.stats.Hits++
+		c.mu.Unlock()
+		c.trace("hit", "Using cached tool result", call, now.Sub(entry.storedAt))
+		return entry.value, nil
+	} else {
+		c.mu.Unlock()
+		if stored, ok := c.loadPersisted(call, now); ok {
+			c.mu.Lock()
+			if c.generations[call.userID] == generation {
+				c.putLocked(call.key, stored)
+			}
+			c.stats.Hits++
+			c.mu.Unlock()
+			c.trace("hit", "Using persisted tool result", call, now.Sub(stored.storedAt))
+			return stored.value, nil
+		}
+		c.mu.Lock()
+		c.stats.Misses++
+		c.mu.Unlock()
+		c.trace("miss", "Tool cache miss", call, 0)
+	}
+
+	value, err := fetch()
+	if err != nil || strings.TrimSpace(value) == "" {
+		return value, err
+	}
+	if c.limits.MaxValueBytes > 0 && len(value) > c.limits.MaxValueBytes {
+		return value, nil
+	}
+	storedAt := time.Now()
+	entry := cachedResult{
+		tool:      call.tool,
+		userID:    call.userID,
+		value:     value,
+		storedAt:  storedAt,
+		expiresAt: storedAt.Add(call.ttl),
+		usedAt:    storedAt,
+	}
+	c.mu.Lock()
+	if c.generations[call.userID] != generation {
+		c.mu.Unlock()
+		return value, nil
+	}
+	c.putLocked(call.key, entry)
+	c.mu.Unlock()
+	if c.limits.PersistEntries > 0 {
+		persisted := mcp.ToolCacheEntry{
+			Key:       call.key,
+			Tool:      entry.tool,
+			UserID:    entry.userID,
+			Value:     entry.value,
+			StoredAt:  entry.storedAt,
+			ExpiresAt: entry.expiresAt,
+		}
+		if err := mcp.SaveToolCacheEntry(persisted, c.limits.PersistEntries, c.limits.PersistBytes); err != nil {
+			log.Printf("[ToolCache] %v", err)
+		}
+	}
+	return value, nil
+}
+
+func (c *ResultCache) loadPersisted(call cachedCall, now time.Time) (cachedResult, bool) {
+	if c.limits.PersistEntries <= 0 {
+		return cachedResult{}, false
+	}
+	stored, ok, err := mcp.LoadToolCacheEntry(call.key, now)
+	if err != nil {
+		log.Printf("[ToolCache] %v", err)
+		return cachedResult{}, false
+	}
+	// Keys already include the user, so a mismatch can only mean a hash
+	// collision; never hand a private result to someone else.
+	if !ok || stored.Tool != call.tool || stored.UserID != call.userID {
+		return cachedResult{}, false
+	}
+	return cachedResult{
+		tool:      stored.Tool,
+		userID:    stored.UserID,
+		value:     stored.Value,
+		storedAt:  stored.StoredAt,
+		expiresAt: stored.ExpiresAt,
+		usedAt:    now,
+	}, true
+}
+
+func (c *ResultCache) putLocked(key string, entry cachedResult) {
+	c.removeLocked(key)
+	now := entry.usedAt
+	for existingKey, existing := range c.entries {
+		if !now.Before(existing.expiresAt) {
+			c.removeLocked(existingKey)
+		}
+	}
+	size := int64(len(entry.value))
+	for len(c.entries) > 0 && ((c.limits.MaxEntries > 0 && len(c.entries) >= c.limits.MaxEntries) ||
+		(c.limits.MaxBytes > 0 && c.bytes+size > c.limits.MaxBytes)) {
+		var oldestKey string
+		var oldestTime time.Time
+		for existingKey, existing := range c.entries {
+			if oldestKey == "" || existing.usedAt.Before(oldestTime) {
+				oldestKey, oldestTime = existingKey, existing.usedAt
+			}
+		}
+		c.removeLocked(oldestKey)
+	}
+	c.entries[key] = entry
+	c.bytes += size
+}
+
+func (c *ResultCache) removeLocked(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.bytes -= int64(len(entry.value))
+		delete(c.entries, key)
+	}
+}
+
+func (c *ResultCache) trace(stage, message string, call cachedCall, age time.Duration) {
+	stats := c.Stats()
+	details := map[string]interface{}{
+		"tool":     call.tool,
+		"private":  call.userID != "",
+		"hits":     stats.Hits,
+		"misses":   stats.Misses,
+		"bypasses": stats.Bypasses,
+		"entries":  stats.Entries,
+		"ttl_ms":   call.ttl.Milliseconds(),
+	}
+	if stage == "hit" {
+		details["age_ms"] = age.Milliseconds()
+	}
+	mcp.EmitTrace("tool_cache", stage, message, details)
+}
+
+// withCachedCall marks ctx so the handler's fetch stage goes through cache.
+// Side-effecting tools and tools without a CacheTTL are never cached.
+func withCachedCall(ctx context.Context, cache *ResultCache, execCtx ExecutionContext, name string, metadata Metadata, arguments json.RawMessage) context.Context {
+	if cache == nil || metadata.CacheTTL <= 0 || metadata.SideEffecting {
+		return ctx
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(arguments, &decoded); err != nil {
+		return ctx
+	}
+	canonical, err := json.Marshal(decoded)
+	if err != nil {
+		return ctx
+	}
+	userID := ""
+	if metadata.CachePerUser || metadata.RequiresMemory {
+		userID = strings.TrimSpace(execCtx.UserID)
+		if userID == "" {
+			return ctx
+		}
+	}
+	sum := sha256.Sum256([]byte(name + "\x00" + userID + "\x00" + string(canonical)))
+	return context.WithValue(ctx, cachedCallKey{}, cachedCall{
+		cache:  cache,
+		key:    hex.EncodeToString(sum[:]),
+		tool:   name,
+		userID: userID,
+		ttl:    cacheTTLFor(name, metadata.CacheTTL, decoded),
+		fresh:  execCtx.FreshResults,
+	})
+}
+
+// cacheTTLFor lets search tools shorten or lengthen the declared TTL from the
+// query, so weather or prices expire sooner than documentation lookups.
+func cacheTTLFor(name string, base time.Duration, arguments interface{}) time.Duration {
+	fields, _ := arguments.(map[string]interface{})
+	switch name {
+	case "search_web", "naver_search":
+		if query, ok := fields["query"].(string); ok {
+			return mcp.SearchCacheTTL(query, base)
+		}
+	case "search_web_multi":
+		queries, _ := fields["queries"].([]interface{})
+		ttl := base
+		for _, raw := range queries {
+			if query, ok := raw.(string); ok {
+				if queryTTL := mcp.SearchCacheTTL(query, base); queryTTL < ttl {
+					ttl = queryTTL
+				}
+			}
+		}
+		return ttl
+	}
+	return base
+}
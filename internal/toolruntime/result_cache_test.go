@@ -0,0 +1,150 @@
+package toolruntime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dinkisstyle-chat/internal/mcp"
+)
+
+func newCachedTestRegistry(t *testing.T, metadata Metadata) (*Registry, *ResultCache, *int) {
+	t.Helper()
+	registry := NewRegistry()
+	cache := NewResultCache(ResultCacheLimits{MaxEntries: 8})
+	registry.SetResultCache(cache)
+	fetches := 0
+	err := registry.Register(Definition{
+		Name:        "lookup",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"q":{"type":"string"},"n":{"type":"integer"}}}`),
+		Metadata:    metadata,
+	}, func(ctx context.Context, execCtx ExecutionContext, arguments json.RawMessage) (Result, error) {
+		content, err := CachedFetch(ctx, func() (string, error) {
+			fetches++
+			return fmt.Sprintf("%s#%d", execCtx.UserID, fetches), nil
+		})
+		return Result{Content: content}, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry, cache, &fetches
+}
+
+func callLookup(t *testing.T, registry *Registry, execCtx ExecutionContext, arguments string) string {
+	t.Helper()
+	result, err := registry.Call(context.Background(), execCtx, "lookup", json.RawMessage(arguments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.Content
+}
+
+func TestResultCacheSharesPublicResultsByCanonicalArguments(t *testing.T) {
+	registry, cache, fetches := newCachedTestRegistry(t, Metadata{ReadOnly: true, CacheTTL: time.Minute})
+	first := callLookup(t, registry, ExecutionContext{UserID: "alice"}, `{"q":"go","n":1}`)
+	second := callLookup(t, registry, ExecutionContext{UserID: "bob"}, `{"n":1, "q":"go"}`)
+	if first != second || *fetches != 1 {
+		t.Fatalf("public result was not reused: %q, %q after %d fetches", first, second, *fetches)
+	}
+	callLookup(t, registry, ExecutionContext{UserID: "bob"}, `{"q":"go","n":2}`)
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+}
+
+func TestResultCacheNeverSharesMemoryResultsAcrossUsers(t *testing.T) {
+	registry, cache, fetches := newCachedTestRegistry(t, Metadata{ReadOnly: true, RequiresMemory: true, CacheTTL: time.Minute})
+	alice := ExecutionContext{UserID: "alice", EnableMemory: true}
+	bob := ExecutionContext{UserID: "bob", EnableMemory: true}
+	if got := callLookup(t, registry, alice, `{"q":"pets"}`); got != "alice#1" {
+		t.Fatalf("alice got %q", got)
+	}
+	if got := callLookup(t, registry, bob, `{"q":"pets"}`); got != "bob#2" {
+		t.Fatalf("bob was served %q", got)
+	}
+	if got := callLookup(t, registry, alice, `{"q":"pets"}`); got != "alice#1" {
+		t.Fatalf("alice cache miss: %q", got)
+	}
+
+	cache.InvalidateUser("alice")
+	if got := callLookup(t, registry, alice, `{"q":"pets"}`); got != "alice#3" {
+		t.Fatalf("invalidated entry was reused: %q", got)
+	}
+	if got := callLookup(t, registry, bob, `{"q":"pets"}`); got != "bob#2" || *fetches != 3 {
+		t.Fatalf("invalidating alice dropped bob's entry: %q", got)
+	}
+}
+
+func TestResultCacheFreshResultsBypassAndRefresh(t *testing.T) {
+	registry, cache, _ := newCachedTestRegistry(t, Metadata{ReadOnly: true, CacheTTL: time.Minute})
+	callLookup(t, registry, ExecutionContext{}, `{"q":"news"}`)
+	if got := callLookup(t, registry, ExecutionContext{FreshResults: true}, `{"q":"news"}`); got != "#2" {
+		t.Fatalf("fresh request was served from cache: %q", got)
+	}
+	if got := callLookup(t, registry, ExecutionContext{}, `{"q":"news"}`); got != "#2" {
+		t.Fatalf("fresh result did not refresh the cache: %q", got)
+	}
+	if stats := cache.Stats(); stats.Bypasses != 1 || stats.Hits != 1 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+}
+
+func TestResultCacheSkipsSideEffectingAndUncachedTools(t *testing.T) {
+	for _, metadata := range []Metadata{{SideEffecting: true, CacheTTL: time.Minute}, {ReadOnly: true}} {
+		registry, _, fetches := newCachedTestRegistry(t, metadata)
+		callLookup(t, registry, ExecutionContext{}, `{"q":"x"}`)
+		callLookup(t, registry, ExecutionContext{}, `{"q":"x"}`)
+		if *fetches != 2 {
+			t.Fatalf("%#v: expected no caching, got %d fetches", metadata, *fetches)
+		}
+	}
+}
+
+func TestResultCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	registry, cache, fetches := newCachedTestRegistry(t, Metadata{ReadOnly: true, CacheTTL: time.Minute})
+	for index := 0; index < 10; index++ {
+		callLookup(t, registry, ExecutionContext{}, fmt.Sprintf(`{"n":%d}`, index))
+	}
+	if stats := cache.Stats(); stats.Entries != 8 {
+		t.Fatalf("cache held %d entries, want 8", stats.Entries)
+	}
+	callLookup(t, registry, ExecutionContext{}, `{"n":0}`)
+	if *fetches != 11 {
+		t.Fatalf("evicted entry was still served after %d fetches", *fetches)
+	}
+}
+
+func TestResultCachePersistsAcrossRestartsUntilMemoryChanges(t *testing.T) {
+	if err := mcp.InitDB(filepath.Join(t.TempDir(), "tool-cache.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mcp.CloseDB)
+	limits := ResultCacheLimits{MaxEntries: 8, PersistEntries: 8}
+	call := cachedCall{key: "k", tool: "search_memory", userID: "alice", ttl: time.Minute}
+	fetches := 0
+	fetch := func() (string, error) {
+		fetches++
+		return fmt.Sprintf("result %d", fetches), nil
+	}
+
+	call.cache = NewResultCache(limits)
+	call.cache.fetch(call, fetch)
+	call.cache = NewResultCache(limits)
+	if got, _ := call.cache.fetch(call, fetch); got != "result 1" || fetches != 1 {
+		t.Fatalf("restarted cache did not reuse the persisted result: %q", got)
+	}
+
+	mcp.SetMemoryChangeHook(call.cache.InvalidateUser)
+	t.Cleanup(func() { mcp.SetMemoryChangeHook(nil) })
+	if _, err := mcp.UpsertUserProfileFact("alice", "pet", "cat", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	call.cache = NewResultCache(limits)
+	if got, _ := call.cache.fetch(call, fetch); got != "result 2" {
+		t.Fatalf("memory change did not invalidate the persisted result: %q", got)
+	}
+}
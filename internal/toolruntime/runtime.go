@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"dinkisstyle-chat/internal/mcp"
 )
@@ -18,6 +19,14 @@ type Metadata struct {
 	SideEffecting  bool   `json:"sideEffecting,omitempty"`
 	ParallelSafe   bool   `json:"parallelSafe,omitempty"`
 	RequiresMemory bool   `json:"requiresMemory,omitempty"`
+	// Skill is the namespace of the skill that provides the tool. Such tools
+	// are only listed and callable while that skill is in ActiveSkills.
+	Skill string `json:"skill,omitempty"`
+	// CacheTTL, when positive, lets the registry's ResultCache reuse the
+	// tool's fetched result for that long. CachePerUser keys entries by user;
+	// RequiresMemory tools are always keyed by user.
+	CacheTTL     time.Duration `json:"cacheTTL,omitempty"`
+	CachePerUser bool          `json:"cachePerUser,omitempty"`
 }
 
 type Definition struct {
@@ -29,14 +38,71 @@ type Definition struct {
 
 type ExecutionContext struct {
 	RequestID             string
+	CallID                string
 	UserID                string
 	EnableMemory          bool
 	LocationInfo          string
 	DisabledTools         []string
 	DisallowedCommands    []string
 	DisallowedDirectories []string
+	AllowedCommands       []string
+	AllowedDirectories    []string
+	CommandMode           string
+	CommandJail           bool
+	ActiveSkills          []string
+	// FreshResults skips cached tool results because the user asked for
+	// fresh data; the fetched results still refresh the cache.
+	FreshResults bool
+	// Approve, when set, is consulted before every SideEffecting tool runs;
+	// a non-nil error rejects the call and is reported to the model.
+	Approve ApprovalFunc
+	// Scopes, when non-nil, are the scopes of the API key behind the
+	// request; tools whose RequiredScope is missing are neither listed nor
+	// callable. Nil means a session login without key restrictions.
+	Scopes []string
 }
 
+// API key scopes that gate tools, named as in the gateway's API keys.
+const (
+	ScopeMemoryRead  = "memory:read"
+	ScopeMemoryWrite = "memory:write"
+	ScopeAdmin       = "admin"
+)
+
+// RequiredScope is the API key scope a tool needs beyond chat:
+// memory:write for tools that change stored memories, memory:read for the
+// other memory tools, and admin for host tools and every other
+// SideEffecting tool, including skill scripts and external MCP tools.
+func RequiredScope(metadata Metadata) string {
+	switch {
+	case metadata.RequiresMemory && metadata.SideEffecting:
+		return ScopeMemoryWrite
+	case metadata.RequiresMemory:
+		return ScopeMemoryRead
+	case metadata.Category == "system", metadata.SideEffecting:
+		return ScopeAdmin
+	default:
+		return ""
+	}
+}
+
+// HasScope reports whether the request may use tools that need scope.
+func (c ExecutionContext) HasScope(scope string) bool {
+	if c.Scopes == nil || scope == "" {
+		return true
+	}
+	for _, granted := range c.Scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ApprovalFunc decides whether a SideEffecting call may run. name and
+// arguments are already normalized and validated.
+type ApprovalFunc func(ctx context.Context, execCtx ExecutionContext, name string, arguments json.RawMessage) error
+
 type Result struct {
 	Content string                 `json:"content"`
 	IsError bool                   `json:"isError,omitempty"`
@@ -47,6 +113,7 @@ type Handler func(context.Context, ExecutionContext, json.RawMessage) (Result, e
 
 type registeredTool struct {
 	definition Definition
+	schema     *schemaNode
 	handler    Handler
 }
 
@@ -54,6 +121,7 @@ type Registry struct {
 	mu    sync.RWMutex
 	order []string
 	tools map[string]registeredTool
+	cache *ResultCache
 }
 
 func NewRegistry() *Registry {
@@ -71,6 +139,10 @@ func (r *Registry) Register(definition Definition, handler Handler) error {
 	if len(definition.InputSchema) == 0 || !json.Valid(definition.InputSchema) {
 		return fmt.Errorf("tool %q has an invalid input schema", name)
 	}
+	schema, err := compileSchema(definition.InputSchema)
+	if err != nil {
+		return fmt.Errorf("tool %q has an invalid input schema: %w", name, err)
+	}
 
 	definition.Name = name
 	r.mu.Lock()
@@ -78,19 +150,61 @@ func (r *Registry) Register(definition Definition, handler Handler) error {
 	if _, exists := r.tools[name]; exists {
 		return fmt.Errorf("tool %q is already registered", name)
 	}
-	r.tools[name] = registeredTool{definition: definition, handler: handler}
+	r.tools[name] = registeredTool{definition: definition, schema: schema, handler: handler}
 	r.order = append(r.order, name)
 	return nil
 }
 
+// SetResultCache selects the cache used for tools with a CacheTTL; nil
+// disables caching.
+func (r *Registry) SetResultCache(cache *ResultCache) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = cache
+}
+
+// Unregister removes a tool so it is no longer listed or callable.
+func (r *Registry) Unregister(name string) bool {
+	name = strings.TrimSpace(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.tools[name]; !exists {
+		return false
+	}
+	delete(r.tools, name)
+	for index, registered := range r.order {
+		if registered == name {
+			r.order = append(r.order[:index], r.order[index+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Has reports whether a tool is registered, after call-name normalization.
+func (r *Registry) Has(name string) bool {
+	name, _ = mcp.NormalizeToolCall(strings.TrimSpace(name), nil)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, exists := r.tools[name]
+	return exists
+}
+
 func (r *Registry) List(execCtx ExecutionContext) []Definition {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	disabled := stringSet(execCtx.DisabledTools)
+	activeSkills := stringSet(execCtx.ActiveSkills)
 	definitions := make([]Definition, 0, len(r.order))
 	for _, name := range r.order {
 		tool := r.tools[name]
-		if disabled[name] || (tool.definition.Metadata.RequiresMemory && !execCtx.EnableMemory) {
+		if !mcp.IsToolEnabled(name) || disabled[name] || (tool.definition.Metadata.RequiresMemory && !execCtx.EnableMemory) {
+			continue
+		}
+		if !execCtx.HasScope(RequiredScope(tool.definition.Metadata)) {
+			continue
+		}
+		if skill := tool.definition.Metadata.Skill; skill != "" && !activeSkills[skill] {
 			continue
 		}
 		definitions = append(definitions, tool.definition)
@@ -98,6 +212,49 @@ func (r *Registry) List(execCtx ExecutionContext) []Definition {
 	return definitions
 }
 
+// ToolPolicy explains why one registered tool is or is not offered to a
+// request: the app-wide switch first, then the per-user layers.
+type ToolPolicy struct {
+	Name         string `json:"name"`
+	Category     string `json:"category"`
+	AppEnabled   bool   `json:"app_enabled"`
+	UserDisabled bool   `json:"user_disabled"`
+	Effective    bool   `json:"effective"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// Explain reports the effective policy of every tool visible to execCtx, in
+// the same order List uses.
+func (r *Registry) Explain(execCtx ExecutionContext) []ToolPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	disabled := stringSet(execCtx.DisabledTools)
+	activeSkills := stringSet(execCtx.ActiveSkills)
+	policies := make([]ToolPolicy, 0, len(r.order))
+	for _, name := range r.order {
+		metadata := r.tools[name].definition.Metadata
+		if metadata.Skill != "" && !activeSkills[metadata.Skill] {
+			continue
+		}
+		state := mcp.ToolSwitchFor(name)
+		policy := ToolPolicy{Name: name, Category: metadata.Category, AppEnabled: state.Enabled, UserDisabled: disabled[name]}
+		switch {
+		case !state.Enabled:
+			policy.Reason = state.Reason
+		case policy.UserDisabled:
+			policy.Reason = "disabled for this user"
+		case metadata.RequiresMemory && !execCtx.EnableMemory:
+			policy.Reason = "memory is off for this user"
+		case !execCtx.HasScope(RequiredScope(metadata)):
+			policy.Reason = "API key lacks the " + RequiredScope(metadata) + " scope"
+		default:
+			policy.Effective = true
+		}
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
 func (r *Registry) Call(ctx context.Context, execCtx ExecutionContext, name string, arguments json.RawMessage) (result Result, err error) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
@@ -110,34 +267,115 @@ func (r *Registry) Call(ctx context.Context, execCtx ExecutionContext, name stri
 	arguments = json.RawMessage(normalizedArguments)
 	r.mu.RLock()
 	tool, ok := r.tools[name]
+	cache := r.cache
 	r.mu.RUnlock()
+	if skill := tool.definition.Metadata.Skill; ok && skill != "" && !stringSet(execCtx.ActiveSkills)[skill] {
+		ok = false
+	}
 	if !ok {
 		return Result{IsError: true}, fmt.Errorf("tool not found: %s", name)
 	}
+	if state := mcp.ToolSwitchFor(name); !state.Enabled {
+		return Result{IsError: true}, fmt.Errorf("tool %q is unavailable: %s", name, state.Reason)
+	}
 	if stringSet(execCtx.DisabledTools)[name] {
 		return Result{IsError: true}, fmt.Errorf("tool %q is disabled for this user", name)
 	}
 	if tool.definition.Metadata.RequiresMemory && !execCtx.EnableMemory {
 		return Result{IsError: true}, fmt.Errorf("memory feature is disabled by user settings")
 	}
+	if scope := RequiredScope(tool.definition.Metadata); !execCtx.HasScope(scope) {
+		return Result{IsError: true}, fmt.Errorf("tool %q needs an API key with the %s scope", name, scope)
+	}
 	if len(arguments) == 0 {
 		arguments = json.RawMessage(`{}`)
 	}
-	if err := validateRequiredArguments(tool.definition.InputSchema, arguments); err != nil {
+	if err := validateArguments(tool.schema, arguments); err != nil {
 		return Result{IsError: true}, fmt.Errorf("invalid arguments for %s: %w", name, err)
 	}
 	if err := ctx.Err(); err != nil {
 		return Result{IsError: true}, err
 	}
+	if tool.definition.Metadata.SideEffecting && execCtx.Approve != nil {
+		if err := execCtx.Approve(ctx, execCtx, name, arguments); err != nil {
+			return Result{IsError: true}, err
+		}
+	}
+	ctx = withCachedCall(ctx, cache, execCtx, name, tool.definition.Metadata, arguments)
 	return tool.handler(ctx, execCtx, arguments)
 }
 
+// BatchCall is one native tool call from a model round.
+type BatchCall struct {
+	ID        string
+	Name      string
+	Arguments json.RawMessage
+}
+
+type BatchResult struct {
+	ID      string
+	Name    string
+	Result  Result
+	Err     error
+	Elapsed time.Duration
+}
+
+// CallBatch executes the calls of one model round. Consecutive ParallelSafe
+// calls run concurrently on at most workers goroutines; any other call is a
+// barrier that runs alone, so side effects keep the order the model chose.
+// Results are returned in the same order as calls, keyed by tool_call_id.
+func (r *Registry) CallBatch(ctx context.Context, execCtx ExecutionContext, calls []BatchCall, workers int) []BatchResult {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]BatchResult, len(calls))
+	run := func(index int) {
+		call := calls[index]
+		callCtx := execCtx
+		callCtx.CallID = call.ID
+		start := time.Now()
+		result, err := r.Call(ctx, callCtx, call.Name, call.Arguments)
+		results[index] = BatchResult{ID: call.ID, Name: call.Name, Result: result, Err: err, Elapsed: time.Since(start)}
+	}
+	for index := 0; index < len(calls); {
+		if !r.parallelSafe(calls[index].Name) {
+			run(index)
+			index++
+			continue
+		}
+		end := index
+		for end < len(calls) && r.parallelSafe(calls[end].Name) {
+			end++
+		}
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, workers)
+		for waveIndex := index; waveIndex < end; waveIndex++ {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(callIndex int) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				run(callIndex)
+			}(waveIndex)
+		}
+		wg.Wait()
+		index = end
+	}
+	return results
+}
+
+func (r *Registry) parallelSafe(name string) bool {
+	name, _ = mcp.NormalizeToolCall(strings.TrimSpace(name), nil)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tool, ok := r.tools[name]
+	return ok && tool.definition.Metadata.ParallelSafe && !tool.definition.Metadata.SideEffecting
+}
+
 func NewDefaultRegistry() *Registry {
 	registry := NewRegistry()
+	registry.SetResultCache(DefaultResultCache)
 	for _, legacy := range mcp.GetToolList() {
-		if !supportedByGateway(legacy.Name) {
-			continue
-		}
 		schema, err := json.Marshal(legacy.InputSchema)
 		if err != nil {
 			continue
@@ -151,6 +389,7 @@ func NewDefaultRegistry() *Registry {
 		name := definition.Name
 		_ = registry.Register(definition, func(ctx context.Context, execCtx ExecutionContext, arguments json.RawMessage) (Result, error) {
 			content, callErr := mcp.ExecuteToolWithContext(name, arguments, mcp.ToolContext{
+				Context:        ctx,
 				RequestID:      execCtx.RequestID,
 				UserID:         execCtx.UserID,
 				EnableMemory:   execCtx.EnableMemory,
@@ -158,6 +397,10 @@ func NewDefaultRegistry() *Registry {
 				LocationInfo:   execCtx.LocationInfo,
 				DisallowedCmds: execCtx.DisallowedCommands,
 				DisallowedDirs: execCtx.DisallowedDirectories,
+				AllowedCmds:    execCtx.AllowedCommands,
+				AllowedDirs:    execCtx.AllowedDirectories,
+				CommandMode:    execCtx.CommandMode,
+				CommandJail:    execCtx.CommandJail,
 			})
 			return Result{Content: content, IsError: callErr != nil}, callErr
 		})
@@ -165,27 +408,24 @@ func NewDefaultRegistry() *Registry {
 	return registry
 }
 
-func supportedByGateway(name string) bool {
-	switch name {
-	case "send_keys", "read_terminal_tail":
-		return false
-	default:
-		return true
-	}
-}
-
 func metadataFor(name string) Metadata {
 	switch name {
 	case "search_memory", "read_memory", "read_memory_context":
-		return Metadata{Category: "memory", ReadOnly: true, ParallelSafe: true, RequiresMemory: true}
+		return Metadata{Category: "memory", ReadOnly: true, ParallelSafe: true, RequiresMemory: true, CacheTTL: 5 * time.Minute, CachePerUser: true}
 	case "delete_memory", "save_user_fact", "delete_user_fact":
 		return Metadata{Category: "memory", SideEffecting: true, RequiresMemory: true}
-	case "search_web", "search_web_multi", "read_web_page", "read_buffered_source", "read_help", "naver_search", "namu_wiki":
+	case "search_web", "search_web_multi", "naver_search":
+		return Metadata{Category: "web", ReadOnly: true, ParallelSafe: true, CacheTTL: 10 * time.Minute}
+	case "read_web_page", "namu_wiki":
+		return Metadata{Category: "web", ReadOnly: true, ParallelSafe: true, CacheTTL: 30 * time.Minute}
+	case "read_buffered_source", "read_help":
 		return Metadata{Category: "web", ReadOnly: true, ParallelSafe: true}
 	case "get_current_time", "get_current_location":
 		return Metadata{Category: "context", ReadOnly: true, ParallelSafe: true}
 	case "execute_command", "send_keys":
 		return Metadata{Category: "system", SideEffecting: true}
+	case "read_terminal_tail":
+		return Metadata{Category: "system", ReadOnly: true}
 	default:
 		return Metadata{Category: "general"}
 	}
@@ -201,74 +441,12 @@ func stringSet(values []string) map[string]bool {
 	return set
 }
 
-func validateRequiredArguments(schemaJSON, argumentsJSON json.RawMessage) error {
-	var schema struct {
-		Type       string   `json:"type"`
-		Required   []string `json:"required"`
-		Properties map[string]struct {
-			Type     string `json:"type"`
-			MinItems int    `json:"minItems"`
-			MaxItems int    `json:"maxItems"`
-			Items    *struct {
-				Type string `json:"type"`
-			} `json:"items"`
-		} `json:"properties"`
-	}
-	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
-		return fmt.Errorf("invalid tool schema: %w", err)
-	}
-	var arguments map[string]interface{}
+func validateArguments(schema *schemaNode, argumentsJSON json.RawMessage) error {
+	var arguments interface{}
 	if err := json.Unmarshal(argumentsJSON, &arguments); err != nil {
-		return err
-	}
-	if strings.TrimSpace(schema.Type) == "object" && arguments == nil {
-		return fmt.Errorf("arguments must be an object")
-	}
-	for _, name := range schema.Required {
-		value, exists := arguments[name]
-		if !exists || value == nil {
-			return fmt.Errorf("argument %q is required", name)
-		}
-		if text, ok := value.(string); ok && strings.TrimSpace(text) == "" {
-			return fmt.Errorf("argument %q cannot be empty", name)
-		}
+		return fmt.Errorf("arguments are not valid JSON: %w", err)
 	}
-	for name, property := range schema.Properties {
-		value, exists := arguments[name]
-		if !exists || value == nil {
-			continue
-		}
-		switch property.Type {
-		case "string":
-			if _, ok := value.(string); !ok {
-				return fmt.Errorf("argument %q must be a string", name)
-			}
-		case "integer":
-			number, ok := value.(float64)
-			if !ok || number != float64(int64(number)) {
-				return fmt.Errorf("argument %q must be an integer", name)
-			}
-		case "array":
-			items, ok := value.([]interface{})
-			if !ok {
-				return fmt.Errorf("argument %q must be an array", name)
-			}
-			if property.MinItems > 0 && len(items) < property.MinItems {
-				return fmt.Errorf("argument %q must contain at least %d items", name, property.MinItems)
-			}
-			if property.MaxItems > 0 && len(items) > property.MaxItems {
-				return fmt.Errorf("argument %q must contain at most %d items", name, property.MaxItems)
-			}
-			if property.Items != nil && property.Items.Type == "string" {
-				for _, item := range items {
-					if text, ok := item.(string); !ok || strings.TrimSpace(text) == "" {
-						return fmt.Errorf("argument %q must contain non-empty strings", name)
-					}
-				}
-			}
-		}
-	}
-	return nil
+	return schema.check(arguments)
 }
 
 var Default = NewDefaultRegistry()
@@ -60,6 +60,41 @@ func TestRegistryAppliesRequestScopedPolicy(t *testing.T) {
 	}
 }
 
+func TestAppToolSwitchAppliesLiveAndExplainsUserLayer(t *testing.T) {
+	defer mcp.SetToolOverrides(nil)
+	mcp.SetToolOverrides(map[string]bool{"get_current_time": false})
+	for _, definition := range Default.List(ExecutionContext{}) {
+		if definition.Name == "get_current_time" {
+			t.Fatal("tool switched off by the administrator was still listed")
+		}
+	}
+	if _, err := Default.Call(context.Background(), ExecutionContext{}, "get_current_time", json.RawMessage(`{}`)); err == nil || !strings.Contains(err.Error(), "disabled by administrator") {
+		t.Fatalf("expected administrator rejection, got %v", err)
+	}
+
+	policies := map[string]ToolPolicy{}
+	for _, policy := range Default.Explain(ExecutionContext{DisabledTools: []string{"get_current_time", "naver_search"}}) {
+		policies[policy.Name] = policy
+	}
+	if policy := policies["get_current_time"]; policy.Effective || policy.AppEnabled || policy.Reason != "disabled by administrator" {
+		t.Fatalf("app switch should explain get_current_time first: %#v", policy)
+	}
+	if policy := policies["naver_search"]; policy.Effective || !policy.UserDisabled || policy.Reason != "disabled for this user" {
+		t.Fatalf("user layer not explained: %#v", policy)
+	}
+	if policy := policies["search_memory"]; policy.Effective || policy.Reason != "memory is off for this user" {
+		t.Fatalf("memory layer not explained: %#v", policy)
+	}
+	if policy := policies["read_web_page"]; !policy.Effective {
+		t.Fatalf("enabled tool reported as off: %#v", policy)
+	}
+
+	mcp.SetToolOverrides(nil)
+	if _, err := Default.Call(context.Background(), ExecutionContext{}, "get_current_time", json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("tool stayed off after the override was cleared: %v", err)
+	}
+}
+
 func TestRegistryHidesMemoryToolsWhenMemoryDisabled(t *testing.T) {
 	for _, definition := range Default.List(ExecutionContext{EnableMemory: false}) {
 		if definition.Name == "search_memory" {
@@ -183,3 +218,141 @@ func TestExecuteCommandReportsShellFailure(t *testing.T) {
 		t.Fatalf("shell failure details were not preserved: result=%#v err=%v", result, err)
 	}
 }
+
+func TestCallBatchRunsParallelSafeCallsConcurrentlyAndSerializesSideEffects(t *testing.T) {
+	registry := NewRegistry()
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	var order []string
+	track := func(name string) func() {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		order = append(order, "start:"+name)
+		mu.Unlock()
+		return func() {
+			mu.Lock()
+			active--
+			order = append(order, "end:"+name)
+			mu.Unlock()
+		}
+	}
+	release := make(chan struct{})
+	started := make(chan struct{}, 8)
+	register := func(name string, metadata Metadata, wait bool) {
+		err := registry.Register(Definition{
+			Name:        name,
+			InputSchema: json.RawMessage(`{"type":"object","properties":{}}`),
+			Metadata:    metadata,
+		}, func(context.Context, ExecutionContext, json.RawMessage) (Result, error) {
+			done := track(name)
+			defer done()
+			if wait {
+				started <- struct{}{}
+				<-release
+			}
+			return Result{Content: name}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	register("read_a", Metadata{ReadOnly: true, ParallelSafe: true}, true)
+	register("read_b", Metadata{ReadOnly: true, ParallelSafe: true}, true)
+	register("read_c", Metadata{ReadOnly: true, ParallelSafe: true}, false)
+	register("write", Metadata{SideEffecting: true}, false)
+
+	go func() {
+		// Both waiting reads must be in flight at once before either finishes.
+		<-started
+		<-started
+		close(release)
+	}()
+	calls := []BatchCall{
+		{ID: "call_1", Name: "read_a"},
+		{ID: "call_2", Name: "read_b"},
+		{ID: "call_3", Name: "write"},
+		{ID: "call_4", Name: "read_c"},
+	}
+	results := registry.CallBatch(context.Background(), ExecutionContext{}, calls, 2)
+	for index, result := range results {
+		if result.ID != calls[index].ID || result.Err != nil || result.Result.Content != calls[index].Name {
+			t.Fatalf("result %d out of order or failed: %#v", index, result)
+		}
+	}
+	if maxActive != 2 {
+		t.Fatalf("expected two concurrent reads within the worker bound, got max %d", maxActive)
+	}
+	writeStart, writeEnd := -1, -1
+	for index, entry := range order {
+		switch entry {
+		case "start:write":
+			writeStart = index
+		case "end:write":
+			writeEnd = index
+		}
+	}
+	if writeEnd != writeStart+1 || order[writeStart-1] != "end:read_a" && order[writeStart-1] != "end:read_b" || order[writeEnd+1] != "start:read_c" {
+		t.Fatalf("side-effecting call was not serialized between read waves: %v", order)
+	}
+}
+
+func TestRegistryAsksApprovalOnlyForSideEffectingTools(t *testing.T) {
+	registry := NewRegistry()
+	ran := map[string]bool{}
+	for name, metadata := range map[string]Metadata{"read": {ReadOnly: true, ParallelSafe: true}, "write": {SideEffecting: true}} {
+		name := name
+		if err := registry.Register(Definition{
+			Name:        name,
+			InputSchema: json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"}}}`),
+			Metadata:    metadata,
+		}, func(context.Context, ExecutionContext, json.RawMessage) (Result, error) {
+			ran[name] = true
+			return Result{Content: name}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var asked []string
+	execCtx := ExecutionContext{Approve: func(_ context.Context, execCtx ExecutionContext, name string, arguments json.RawMessage) error {
+		asked = append(asked, execCtx.CallID+":"+name+":"+string(arguments))
+		return fmt.Errorf("the user rejected %s", name)
+	}}
+	results := registry.CallBatch(context.Background(), execCtx, []BatchCall{
+		{ID: "call_1", Name: "read", Arguments: json.RawMessage(`{}`)},
+		{ID: "call_2", Name: "write", Arguments: json.RawMessage(`{"path":"a.txt"}`)},
+	}, 2)
+	if results[0].Err != nil || !ran["read"] {
+		t.Fatalf("read-only call was gated: %#v", results[0])
+	}
+	if results[1].Err == nil || !results[1].Result.IsError || ran["write"] {
+		t.Fatalf("rejected side effect still ran: %#v", results[1])
+	}
+	if len(asked) != 1 || asked[0] != `call_2:write:{"path":"a.txt"}` {
+		t.Fatalf("approval saw %v", asked)
+	}
+}
+
+func TestRequiredScopeGatesEverySideEffectBeyondMemory(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		metadata Metadata
+		want     string
+	}{
+		{"execute_command", metadataFor("execute_command"), ScopeAdmin},
+		{"send_keys", metadataFor("send_keys"), ScopeAdmin},
+		{"read_terminal_tail", metadataFor("read_terminal_tail"), ScopeAdmin},
+		{"save_user_fact", metadataFor("save_user_fact"), ScopeMemoryWrite},
+		{"search_memory", metadataFor("search_memory"), ScopeMemoryRead},
+		{"search_web", metadataFor("search_web"), ""},
+		{"skill script", Metadata{Category: "skill", SideEffecting: true, Skill: "user:notes"}, ScopeAdmin},
+		{"read-only skill script", Metadata{Category: "skill", ReadOnly: true, Skill: "user:notes"}, ""},
+		{"external tool", externalMetadata(externalTool{}), ScopeAdmin},
+	} {
+		if got := RequiredScope(tt.metadata); got != tt.want {
+			t.Errorf("RequiredScope(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
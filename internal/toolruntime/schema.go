@@ -0,0 +1,661 @@
+package toolruntime
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file implements the subset of JSON Schema Draft 2020-12 that tool
+// schemas use: type, enum, const, object/array/string/number keywords,
+// allOf/anyOf/oneOf/not and local $ref into $defs. Unknown keywords are
+// ignored as the specification requires.
+//
+// One gateway rule goes beyond the specification: a string that is required
+// or is an array item must not be blank unless the schema sets minLength: 0.
+// Local models often emit "" for arguments they could not fill.
+
+// SchemaError is one argument violation, addressed by a JSON Pointer into the
+// arguments so the model can tell which value to fix.
+type SchemaError struct {
+	Path    string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	return path + ": " + e.Message
+}
+
+// SchemaErrors lists the first violations found in one set of arguments.
+type SchemaErrors []SchemaError
+
+func (e SchemaErrors) Error() string {
+	parts := make([]string, 0, len(e))
+	for _, schemaErr := range e {
+		parts = append(parts, schemaErr.Error())
+	}
+	return strings.Join(parts, "; ")
+}
+
+const maxReportedSchemaErrors = 5
+
+type schemaNode struct {
+	boolean *bool
+
+	types            []string
+	enum             []interface{}
+	constValue       interface{}
+	hasConst         bool
+	properties       map[string]*schemaNode
+	propertyOrder    []string
+	required         []string
+	additional       *schemaNode
+	minProperties    *int
+	maxProperties    *int
+	items            *schemaNode
+	prefixItems      []*schemaNode
+	minItems         *int
+	maxItems         *int
+	uniqueItems      bool
+	minLength        *int
+	maxLength        *int
+	pattern          *regexp.Regexp
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+	allOf            []*schemaNode
+	anyOf            []*schemaNode
+	oneOf            []*schemaNode
+	not              *schemaNode
+	ref              string
+	root             *schemaNode
+	defs             map[string]*schemaNode
+}
+
+var schemaTypeNames = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// compileSchema parses a tool input schema and rejects malformed keywords.
+func compileSchema(raw json.RawMessage) (*schemaNode, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+	root := &schemaNode{}
+	if err := compileSchemaValue(value, "", root, root); err != nil {
+		return nil, err
+	}
+	if err := root.resolveRefs(map[*schemaNode]bool{}); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func compileSchemaValue(value interface{}, path string, node, root *schemaNode) error {
+	node.root = root
+	if flag, ok := value.(bool); ok {
+		node.boolean = &flag
+		return nil
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("schema %s must be an object or boolean", schemaPathLabel(path))
+	}
+	sub := func(raw interface{}, childPath string) (*schemaNode, error) {
+		child := &schemaNode{}
+		if err := compileSchemaValue(raw, childPath, child, root); err != nil {
+			return nil, err
+		}
+		return child, nil
+	}
+	subList := func(key string) ([]*schemaNode, error) {
+		raw, exists := object[key]
+		if !exists {
+			return nil, nil
+		}
+		list, ok := raw.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("schema %s/%s must be a non-empty array", path, key)
+		}
+		nodes := make([]*schemaNode, 0, len(list))
+		for index, item := range list {
+			child, err := sub(item, fmt.Sprintf("%s/%s/%d", path, key, index))
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, child)
+		}
+		return nodes, nil
+	}
+	nonNegative := func(key string) (*int, error) {
+		raw, exists := object[key]
+		if !exists {
+			return nil, nil
+		}
+		number, ok := raw.(float64)
+		if !ok || number < 0 || number != math.Trunc(number) {
+			return nil, fmt.Errorf("schema %s/%s must be a non-negative integer", path, key)
+		}
+		result := int(number)
+		return &result, nil
+	}
+	numberKeyword := func(key string) (*float64, error) {
+		raw, exists := object[key]
+		if !exists {
+			return nil, nil
+		}
+		number, ok := raw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("schema %s/%s must be a number", path, key)
+		}
+		return &number, nil
+	}
+
+	var err error
+	switch typed := object["type"].(type) {
+	case nil:
+	case string:
+		node.types = []string{typed}
+	case []interface{}:
+		for _, item := range typed {
+			name, _ := item.(string)
+			node.types = append(node.types, name)
+		}
+	default:
+		return fmt.Errorf("schema %s/type must be a string or array", path)
+	}
+	for _, name := range node.types {
+		if !schemaTypeNames[name] {
+			return fmt.Errorf("schema %s/type has unknown type %q", path, name)
+		}
+	}
+	if raw, exists := object["enum"]; exists {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return fmt.Errorf("schema %s/enum must be an array", path)
+		}
+		node.enum = list
+	}
+	if raw, exists := object["const"]; exists {
+		node.constValue, node.hasConst = raw, true
+	}
+	if raw, exists := object["properties"]; exists {
+		properties, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("schema %s/properties must be an object", path)
+		}
+		node.properties = make(map[string]*schemaNode, len(properties))
+		for name, property := range properties {
+			if node.properties[name], err = sub(property, path+"/properties/"+escapePointer(name)); err != nil {
+				return err
+			}
+			node.propertyOrder = append(node.propertyOrder, name)
+		}
+		sort.Strings(node.propertyOrder)
+	}
+	if raw, exists := object["required"]; exists {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return fmt.Errorf("schema %s/required must be an array of strings", path)
+		}
+		for _, item := range list {
+			name, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("schema %s/required must be an array of strings", path)
+			}
+			node.required = append(node.required, name)
+		}
+	}
+	if raw, exists := object["additionalProperties"]; exists {
+		if node.additional, err = sub(raw, path+"/additionalProperties"); err != nil {
+			return err
+		}
+	}
+	if node.minProperties, err = nonNegative("minProperties"); err != nil {
+		return err
+	}
+	if node.maxProperties, err = nonNegative("maxProperties"); err != nil {
+		return err
+	}
+	if raw, exists := object["items"]; exists {
+		if node.items, err = sub(raw, path+"/items"); err != nil {
+			return err
+		}
+	}
+	if node.prefixItems, err = subList("prefixItems"); err != nil {
+		return err
+	}
+	if node.minItems, err = nonNegative("minItems"); err != nil {
+		return err
+	}
+	if node.maxItems, err = nonNegative("maxItems"); err != nil {
+		return err
+	}
+	if raw, exists := object["uniqueItems"]; exists {
+		flag, ok := raw.(bool)
+		if !ok {
+			return fmt.Errorf("schema %s/uniqueItems must be a boolean", path)
+		}
+		node.uniqueItems = flag
+	}
+	if node.minLength, err = nonNegative("minLength"); err != nil {
+		return err
+	}
+	if node.maxLength, err = nonNegative("maxLength"); err != nil {
+		return err
+	}
+	if raw, exists := object["pattern"]; exists {
+		text, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("schema %s/pattern must be a string", path)
+		}
+		if node.pattern, err = regexp.Compile(text); err != nil {
+			return fmt.Errorf("schema %s/pattern is not a valid regular expression: %v", path, err)
+		}
+	}
+	for key, target := range map[string]**float64{
+		"minimum":          &node.minimum,
+		"maximum":          &node.maximum,
+		"exclusiveMinimum": &node.exclusiveMinimum,
+		"exclusiveMaximum": &node.exclusiveMaximum,
+		"multipleOf":       &node.multipleOf,
+	} {
+		if *target, err = numberKeyword(key); err != nil {
+			return err
+		}
+	}
+	if node.multipleOf != nil && *node.multipleOf <= 0 {
+		return fmt.Errorf("schema %s/multipleOf must be greater than 0", path)
+	}
+	if node.allOf, err = subList("allOf"); err != nil {
+		return err
+	}
+	if node.anyOf, err = subList("anyOf"); err != nil {
+		return err
+	}
+	if node.oneOf, err = subList("oneOf"); err != nil {
+		return err
+	}
+	if raw, exists := object["not"]; exists {
+		if node.not, err = sub(raw, path+"/not"); err != nil {
+			return err
+		}
+	}
+	if raw, exists := object["$ref"]; exists {
+		ref, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("schema %s/$ref must be a string", path)
+		}
+		node.ref = ref
+	}
+	for _, key := range []string{"$defs", "definitions"} {
+		raw, exists := object[key]
+		if !exists {
+			continue
+		}
+		defs, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("schema %s/%s must be an object", path, key)
+		}
+		if node.defs == nil {
+			node.defs = make(map[string]*schemaNode, len(defs))
+		}
+		for name, def := range defs {
+			if node.defs["#/"+key+"/"+escapePointer(name)], err = sub(def, path+"/"+key+"/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (n *schemaNode) children() []*schemaNode {
+	var nodes []*schemaNode
+	for _, name := range n.propertyOrder {
+		nodes = append(nodes, n.properties[name])
+	}
+	nodes = append(nodes, n.additional, n.items, n.not)
+	nodes = append(nodes, n.prefixItems...)
+	nodes = append(nodes, n.allOf...)
+	nodes = append(nodes, n.anyOf...)
+	nodes = append(nodes, n.oneOf...)
+	for _, def := range n.defs {
+		nodes = append(nodes, def)
+	}
+	return nodes
+}
+
+func (n *schemaNode) resolveRefs(seen map[*schemaNode]bool) error {
+	if n == nil || seen[n] {
+		return nil
+	}
+	seen[n] = true
+	if n.ref != "" && n.root.lookupRef(n.ref) == nil {
+		return fmt.Errorf("schema $ref %q cannot be resolved; only local #/$defs references are supported", n.ref)
+	}
+	for _, child := range n.children() {
+		if err := child.resolveRefs(seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *schemaNode) lookupRef(ref string) *schemaNode {
+	if ref == "#" {
+		return n
+	}
+	if def, ok := n.defs[ref]; ok {
+		return def
+	}
+	return nil
+}
+
+// Schema is a compiled schema for values other than tool arguments, such as a
+// structured chat answer. It applies the same rules as tool arguments.
+type Schema struct {
+	root *schemaNode
+}
+
+// CompileSchema parses raw and rejects malformed keywords.
+func CompileSchema(raw json.RawMessage) (*Schema, error) {
+	root, err := compileSchema(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+// Validate checks one JSON document with plain JSON Schema semantics and
+// returns SchemaErrors on failure. Unlike tool arguments, empty strings and
+// null values are judged only by the schema itself.
+func (s *Schema) Validate(document json.RawMessage) error {
+	var value interface{}
+	if err := json.Unmarshal(document, &value); err != nil {
+		return fmt.Errorf("not valid JSON: %w", err)
+	}
+	return s.root.run(value, true)
+}
+
+// check validates decoded JSON arguments and returns SchemaErrors on failure.
+func (n *schemaNode) check(value interface{}) error {
+	return n.run(value, false)
+}
+
+// schemaWalk is one validation pass. Strict passes follow JSON Schema
+// exactly; the default pass adds the tool-argument rules that required
+// strings and array items must be non-empty and optional nulls are skipped.
+type schemaWalk struct {
+	errs   SchemaErrors
+	strict bool
+}
+
+func (n *schemaNode) run(value interface{}, strict bool) error {
+	walk := &schemaWalk{strict: strict}
+	n.validate(value, "", false, walk, 0)
+	errs := walk.errs
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) > maxReportedSchemaErrors {
+		errs = errs[:maxReportedSchemaErrors]
+	}
+	return errs
+}
+
+func (n *schemaNode) validate(value interface{}, path string, mustBeFilled bool, walk *schemaWalk, depth int) {
+	if n == nil {
+		return
+	}
+	add := func(format string, args ...interface{}) {
+		walk.errs = append(walk.errs, SchemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if depth > 64 {
+		add("schema nesting is too deep")
+		return
+	}
+	if n.boolean != nil {
+		if !*n.boolean {
+			add("is not allowed")
+		}
+		return
+	}
+	if n.ref != "" {
+		n.root.lookupRef(n.ref).validate(value, path, mustBeFilled, walk, depth+1)
+	}
+
+	if len(n.types) > 0 && !matchesAnyType(value, n.types) {
+		add("must be %s", describeTypes(n.types))
+		return
+	}
+	if n.enum != nil {
+		found := false
+		for _, candidate := range n.enum {
+			if jsonEqual(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("must be one of %s", describeEnum(n.enum))
+		}
+	}
+	if n.hasConst && !jsonEqual(n.constValue, value) {
+		add("must be %s", describeEnum([]interface{}{n.constValue}))
+	}
+
+	switch typed := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(typed)
+		if mustBeFilled && !walk.strict && strings.TrimSpace(typed) == "" && (n.minLength == nil || *n.minLength > 0) {
+			add("must be non-empty")
+		}
+		if n.minLength != nil && length < *n.minLength {
+			add("must be at least %d characters", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			add("must be at most %d characters", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(typed) {
+			add("must match pattern %s", n.pattern.String())
+		}
+	case float64:
+		if n.minimum != nil && typed < *n.minimum {
+			add("must be >= %s", formatSchemaNumber(*n.minimum))
+		}
+		if n.maximum != nil && typed > *n.maximum {
+			add("must be <= %s", formatSchemaNumber(*n.maximum))
+		}
+		if n.exclusiveMinimum != nil && typed <= *n.exclusiveMinimum {
+			add("must be > %s", formatSchemaNumber(*n.exclusiveMinimum))
+		}
+		if n.exclusiveMaximum != nil && typed >= *n.exclusiveMaximum {
+			add("must be < %s", formatSchemaNumber(*n.exclusiveMaximum))
+		}
+		if n.multipleOf != nil {
+			quotient := typed / *n.multipleOf
+			if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+				add("must be a multiple of %s", formatSchemaNumber(*n.multipleOf))
+			}
+		}
+	case []interface{}:
+		if n.minItems != nil && len(typed) < *n.minItems {
+			add("must contain at least %d items", *n.minItems)
+		}
+		if n.maxItems != nil && len(typed) > *n.maxItems {
+			add("must contain at most %d items", *n.maxItems)
+		}
+		if n.uniqueItems {
+			for i := 0; i < len(typed); i++ {
+				for j := i + 1; j < len(typed); j++ {
+					if jsonEqual(typed[i], typed[j]) {
+						add("items %d and %d must be unique", i, j)
+					}
+				}
+			}
+		}
+		for index, item := range typed {
+			itemPath := path + "/" + strconv.Itoa(index)
+			if index < len(n.prefixItems) {
+				n.prefixItems[index].validate(item, itemPath, true, walk, depth+1)
+			} else if n.items != nil {
+				n.items.validate(item, itemPath, true, walk, depth+1)
+			}
+		}
+	case map[string]interface{}:
+		if n.minProperties != nil && len(typed) < *n.minProperties {
+			add("must have at least %d properties", *n.minProperties)
+		}
+		if n.maxProperties != nil && len(typed) > *n.maxProperties {
+			add("must have at most %d properties", *n.maxProperties)
+		}
+		required := make(map[string]bool, len(n.required))
+		for _, name := range n.required {
+			required[name] = true
+			if item, exists := typed[name]; !exists || (item == nil && !walk.strict) {
+				walk.errs = append(walk.errs, SchemaError{Path: path + "/" + escapePointer(name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(typed))
+		for name := range typed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			item := typed[name]
+			propertyPath := path + "/" + escapePointer(name)
+			if property, ok := n.properties[name]; ok {
+				if item == nil && !required[name] && !walk.strict {
+					// Local models send null for optional arguments they skip.
+					continue
+				}
+				property.validate(item, propertyPath, required[name], walk, depth+1)
+			} else if n.additional != nil {
+				n.additional.validate(item, propertyPath, false, walk, depth+1)
+			}
+		}
+	}
+
+	for _, child := range n.allOf {
+		child.validate(value, path, mustBeFilled, walk, depth+1)
+	}
+	if len(n.anyOf) > 0 && countMatches(n.anyOf, value, path, walk.strict, depth) == 0 {
+		add("must match at least one allowed schema")
+	}
+	if len(n.oneOf) > 0 {
+		if matches := countMatches(n.oneOf, value, path, walk.strict, depth); matches != 1 {
+			add("must match exactly one allowed schema (matched %d)", matches)
+		}
+	}
+	if n.not != nil && countMatches([]*schemaNode{n.not}, value, path, walk.strict, depth) == 1 {
+		add("must not match the excluded schema")
+	}
+}
+
+func countMatches(nodes []*schemaNode, value interface{}, path string, strict bool, depth int) int {
+	matches := 0
+	for _, node := range nodes {
+		branch := &schemaWalk{strict: strict}
+		node.validate(value, path, false, branch, depth+1)
+		if len(branch.errs) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func matchesAnyType(value interface{}, types []string) bool {
+	for _, name := range types {
+		switch name {
+		case "object":
+			if _, ok := value.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		case "number":
+			if _, ok := value.(float64); ok {
+				return true
+			}
+		case "integer":
+			if number, ok := value.(float64); ok && number == math.Trunc(number) && !math.IsInf(number, 0) {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "null":
+			if value == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func describeTypes(types []string) string {
+	articles := make([]string, 0, len(types))
+	for _, name := range types {
+		switch name {
+		case "object", "array", "integer":
+			articles = append(articles, "an "+name)
+		case "null":
+			articles = append(articles, "null")
+		default:
+			articles = append(articles, "a "+name)
+		}
+	}
+	return strings.Join(articles, " or ")
+}
+
+func describeEnum(values []interface{}) string {
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		encoded, _ := json.Marshal(value)
+		parts = append(parts, string(encoded))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatSchemaNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func jsonEqual(a, b interface{}) bool {
+	left, errLeft := json.Marshal(a)
+	right, errRight := json.Marshal(b)
+	return errLeft == nil && errRight == nil && bytes.Equal(left, right)
+}
+
+// escapePointer encodes one JSON Pointer reference token (RFC 6901).
+func escapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+func schemaPathLabel(path string) string {
+	if path == "" {
+		return "root"
+	}
+	return path
+}
@@ -0,0 +1,145 @@
+package toolruntime
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"dinkisstyle-chat/internal/mcp"
+)
+
+// schemaFixture mirrors the shape of tool schemas that providers and external
+// MCP servers hand us, so each keyword is exercised in a realistic position.
+const schemaFixture = `{
+	"type": "object",
+	"properties": {
+		"queries": {"type": "array", "items": {"type": "string"}, "minItems": 2, "maxItems": 3, "uniqueItems": true},
+		"mode": {"type": "string", "enum": ["fast", "deep"]},
+		"version": {"const": 2},
+		"limit": {"type": "integer", "minimum": 1, "maximum": 10},
+		"ratio": {"type": "number", "exclusiveMinimum": 0, "exclusiveMaximum": 1},
+		"step": {"type": "number", "multipleOf": 0.5},
+		"slug": {"type": "string", "minLength": 2, "maxLength": 8, "pattern": "^[a-z-]+$"},
+		"note": {"type": ["string", "null"], "minLength": 0},
+		"filter": {
+			"type": "object",
+			"properties": {"site": {"type": "string"}, "days": {"type": "integer"}},
+			"required": ["site"],
+			"additionalProperties": false
+		},
+		"labels": {"type": "object", "additionalProperties": {"type": "string"}, "maxProperties": 2},
+		"point": {"type": "array", "prefixItems": [{"type": "number"}, {"type": "number"}], "items": false},
+		"target": {"oneOf": [{"$ref": "#/$defs/url"}, {"$ref": "#/$defs/memoryID"}]},
+		"format": {"anyOf": [{"const": "text"}, {"const": "json"}]},
+		"range": {"allOf": [{"type": "object", "required": ["from"]}, {"type": "object", "required": ["to"]}]},
+		"locale": {"type": "string", "not": {"const": "xx"}}
+	},
+	"required": ["queries"],
+	"$defs": {
+		"url": {"type": "string", "pattern": "^https?://"},
+		"memoryID": {"type": "integer", "minimum": 1}
+	}
+}`
+
+func TestSchemaValidatorKeywords(t *testing.T) {
+	schema, err := compileSchema(json.RawMessage(schemaFixture))
+	if err != nil {
+		t.Fatalf("fixture schema rejected: %v", err)
+	}
+	base := `"queries":["one","two"]`
+	cases := []struct {
+		name      string
+		arguments string
+		want      string
+	}{
+		{"valid", `{` + base + `,"mode":"deep","limit":3,"ratio":0.5,"step":1.5,"slug":"go-doc","note":"","target":"https://go.dev","format":"json","locale":"ko"}`, ""},
+		{"null optional", `{` + base + `,"mode":null}`, ""},
+		{"root type", `[]`, "/: must be an object"},
+		{"required", `{}`, "/queries: is required"},
+		{"type", `{"queries":"one | two"}`, "/queries: must be an array"},
+		{"blank item", `{"queries":["one",""]}`, "/queries/1: must be non-empty"},
+		{"minItems", `{"queries":["one"]}`, "/queries: must contain at least 2 items"},
+		{"maxItems", `{"queries":["a","b","c","d"]}`, "/queries: must contain at most 3 items"},
+		{"uniqueItems", `{"queries":["a","a"]}`, "/queries: items 0 and 1 must be unique"},
+		{"items", `{"queries":["a",2]}`, "/queries/1: must be a string"},
+		{"enum", `{` + base + `,"mode":"slow"}`, `/mode: must be one of "fast", "deep"`},
+		{"const", `{` + base + `,"version":3}`, "/version: must be 2"},
+		{"integer", `{` + base + `,"limit":2.5}`, "/limit: must be an integer"},
+		{"minimum", `{` + base + `,"limit":0}`, "/limit: must be >= 1"},
+		{"maximum", `{` + base + `,"limit":11}`, "/limit: must be <= 10"},
+		{"exclusiveMinimum", `{` + base + `,"ratio":0}`, "/ratio: must be > 0"},
+		{"exclusiveMaximum", `{` + base + `,"ratio":1}`, "/ratio: must be < 1"},
+		{"multipleOf", `{` + base + `,"step":0.7}`, "/step: must be a multiple of 0.5"},
+		{"minLength", `{` + base + `,"slug":"a"}`, "/slug: must be at least 2 characters"},
+		{"maxLength", `{` + base + `,"slug":"abcdefghi"}`, "/slug: must be at most 8 characters"},
+		{"pattern", `{` + base + `,"slug":"Go_Doc"}`, "/slug: must match pattern ^[a-z-]+$"},
+		{"type array", `{` + base + `,"note":5}`, "/note: must be a string or null"},
+		{"nested required", `{` + base + `,"filter":{"days":3}}`, "/filter/site: is required"},
+		{"nested type", `{` + base + `,"filter":{"site":"go.dev","days":"3"}}`, "/filter/days: must be an integer"},
+		{"additionalProperties false", `{` + base + `,"filter":{"site":"go.dev","lang":"en"}}`, "/filter/lang: is not allowed"},
+		{"additionalProperties schema", `{` + base + `,"labels":{"a":1}}`, "/labels/a: must be a string"},
+		{"maxProperties", `{` + base + `,"labels":{"a":"1","b":"2","c":"3"}}`, "/labels: must have at most 2 properties"},
+		{"prefixItems", `{` + base + `,"point":[1,"2"]}`, "/point/1: must be a number"},
+		{"items false", `{` + base + `,"point":[1,2,3]}`, "/point/2: is not allowed"},
+		{"oneOf none", `{` + base + `,"target":"ftp://x"}`, "/target: must match exactly one allowed schema (matched 0)"},
+		{"oneOf ref", `{` + base + `,"target":42}`, ""},
+		{"anyOf", `{` + base + `,"format":"xml"}`, "/format: must match at least one allowed schema"},
+		{"allOf", `{` + base + `,"range":{"from":1}}`, "/range/to: is required"},
+		{"not", `{` + base + `,"locale":"xx"}`, "/locale: must not match the excluded schema"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var arguments interface{}
+			if err := json.Unmarshal([]byte(tc.arguments), &arguments); err != nil {
+				t.Fatal(err)
+			}
+			err := schema.check(arguments)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("valid arguments rejected: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegisterRejectsMalformedSchemas(t *testing.T) {
+	registry := NewRegistry()
+	handler := func(context.Context, ExecutionContext, json.RawMessage) (Result, error) { return Result{}, nil }
+	for _, schema := range []string{
+		`"object"`,
+		`{"type":"map"}`,
+		`{"type":"object","required":"query"}`,
+		`{"type":"object","properties":[]}`,
+		`{"type":"string","pattern":"("}`,
+		`{"type":"array","minItems":-1}`,
+		`{"type":"number","multipleOf":0}`,
+		`{"oneOf":[]}`,
+		`{"$ref":"#/$defs/missing"}`,
+		`{"$ref":"https://example.com/schema.json"}`,
+	} {
+		if err := registry.Register(Definition{Name: "tool", InputSchema: json.RawMessage(schema)}, handler); err == nil {
+			t.Fatalf("malformed schema %s was accepted", schema)
+		}
+	}
+}
+
+func TestDefaultRegistrySchemasAllCompile(t *testing.T) {
+	for _, legacy := range mcp.GetToolList() {
+		if !Default.Has(legacy.Name) {
+			t.Fatalf("default registry is missing %s; its built-in schema failed to compile", legacy.Name)
+		}
+	}
+}
+
+func TestRegistryCallReturnsArgumentPathToModel(t *testing.T) {
+	_, err := Default.Call(context.Background(), ExecutionContext{}, "search_web_multi", json.RawMessage(`{"queries":["go 1.25",""]}`))
+	if err == nil || !strings.Contains(err.Error(), "invalid arguments for search_web_multi: /queries/1: must be non-empty") {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+}
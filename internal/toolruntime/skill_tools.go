@@ -0,0 +1,99 @@
+package toolruntime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"dinkisstyle-chat/internal/mcp"
+	"dinkisstyle-chat/internal/skillkit"
+)
+
+// SkillTools registers the tools declared by selected skills for as long as a
+// request uses them. Registrations are reference counted so concurrent
+// requests share one entry, and Metadata.Skill hides each tool from requests
+// that did not select its skill.
+type SkillTools struct {
+	registry *Registry
+
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+func NewSkillTools(registry *Registry) *SkillTools {
+	return &SkillTools{registry: registry, refs: make(map[string]int)}
+}
+
+var DefaultSkillTools = NewSkillTools(Default)
+
+// Activate registers the tools of skills and returns their definitions. The
+// caller must add each skill's Namespace to ExecutionContext.ActiveSkills and
+// call release when the request finishes. Tools that fail to register are
+// reported in errs and left out.
+func (s *SkillTools) Activate(skills []skillkit.Skill) (definitions []Definition, release func(), errs []error) {
+	var acquired []string
+	s.mu.Lock()
+	for _, skill := range skills {
+		for _, manifest := range skill.Tools {
+			definition := skillToolDefinition(skill, manifest)
+			if len(definition.Name) > externalMaxToolName {
+				errs = append(errs, fmt.Errorf("skill %s tool %q: name %s is longer than %d characters", skill.Namespace, manifest.Name, definition.Name, externalMaxToolName))
+				continue
+			}
+			if s.refs[definition.Name] == 0 {
+				if err := s.registry.Register(definition, skillToolHandler(manifest)); err != nil {
+					errs = append(errs, fmt.Errorf("skill %s tool %q: %w", skill.Namespace, manifest.Name, err))
+					continue
+				}
+			}
+			s.refs[definition.Name]++
+			acquired = append(acquired, definition.Name)
+			definitions = append(definitions, definition)
+		}
+	}
+	s.mu.Unlock()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, name := range acquired {
+				if s.refs[name]--; s.refs[name] <= 0 {
+					delete(s.refs, name)
+					s.registry.Unregister(name)
+				}
+			}
+		})
+	}
+	return definitions, release, errs
+}
+
+func skillToolDefinition(skill skillkit.Skill, manifest skillkit.ToolManifest) Definition {
+	return Definition{
+		Name:        skillkit.QualifiedToolName(skill.Namespace, manifest.Name),
+		Description: "[" + skill.Namespace + "] " + manifest.Description,
+		InputSchema: manifest.InputSchema,
+		Metadata: Metadata{
+			Category:      "skill",
+			ReadOnly:      manifest.ReadOnly,
+			SideEffecting: !manifest.ReadOnly,
+			ParallelSafe:  manifest.ReadOnly,
+			Skill:         skill.Namespace,
+		},
+	}
+}
+
+// skillToolHandler runs the manifest's fixed command with the validated
+// arguments on stdin, under the same limits and jail as execute_command.
+func skillToolHandler(manifest skillkit.ToolManifest) Handler {
+	argv := append([]string(nil), manifest.Argv...)
+	dir := manifest.Dir
+	return func(ctx context.Context, execCtx ExecutionContext, arguments json.RawMessage) (Result, error) {
+		input := append(json.RawMessage(strings.TrimSpace(string(arguments))), '\n')
+		content, err := mcp.RunToolScript(ctx, argv, dir, input, execCtx.CommandJail)
+		return Result{Content: content, IsError: err != nil}, err
+	}
+}
@@ -0,0 +1,122 @@
+package toolruntime
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"dinkisstyle-chat/internal/skillkit"
+)
+
+// writeSkillWithTool builds a skill directory whose tool echoes its stdin
+// after prefix.
+func writeSkillWithTool(t *testing.T, root, prefix string) {
+	t.Helper()
+	dir := filepath.Join(root, "echo-kit")
+	for _, sub := range []string{"tools", "scripts"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"SKILL.md":        "---\nname: echo-kit\ndescription: Echo kit for stdin tool tests\n---\nUse skill_user_echo-kit__echo.\n",
+		"scripts/echo.sh": "read -r line\nprintf '" + prefix + "%s' \"$line\"\n",
+		"tools/echo.json": `{"name":"echo","description":"Echo the arguments","readOnly":true,"inputSchema":{"type":"object","properties":{"text":{"type":"string"}},"required":["text"]},"command":["sh","scripts/echo.sh"]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSkillToolsAreScopedToSelectingRequests(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skill tool script uses a POSIX shell")
+	}
+	root := t.TempDir()
+	writeSkillWithTool(t, root, "got:")
+	compiled := skillkit.LoadAndCompile(skillkit.Config{UserDir: root}, "$echo-kit please")
+	if len(compiled.Selected) != 1 || len(compiled.Selected[0].Tools) != 1 {
+		t.Fatalf("skill tool was not loaded: %#v %v", compiled.Selected, compiled.Diagnostics)
+	}
+
+	registry := NewRegistry()
+	skillTools := NewSkillTools(registry)
+	definitions, release, errs := skillTools.Activate(compiled.Selected)
+	if len(errs) != 0 || len(definitions) != 1 || definitions[0].Name != "skill_user_echo-kit__echo" {
+		t.Fatalf("unexpected activation: %#v %v", definitions, errs)
+	}
+	_, releaseSecond, _ := skillTools.Activate(compiled.Selected)
+
+	active := ExecutionContext{ActiveSkills: []string{compiled.Selected[0].Namespace}}
+	if len(registry.List(ExecutionContext{})) != 0 {
+		t.Fatal("skill tool leaked into a request that did not select the skill")
+	}
+	if _, err := registry.Call(context.Background(), ExecutionContext{}, "skill_user_echo-kit__echo", json.RawMessage(`{"text":"x"}`)); err == nil {
+		t.Fatal("skill tool was callable without its skill")
+	}
+	if len(registry.List(active)) != 1 {
+		t.Fatal("selected skill tool was not listed")
+	}
+
+	// Shell metacharacters stay inside the JSON document on stdin.
+	result, err := registry.Call(context.Background(), active, "skill_user_echo-kit__echo", json.RawMessage(`{"text":"a; rm -rf $HOME"}`))
+	if err != nil {
+		t.Fatalf("skill tool failed: %v", err)
+	}
+	if !strings.HasPrefix(result.Content, `got:{"text":"a; rm -rf $HOME"}`) || !strings.Contains(result.Content, "[exit code: 0") {
+		t.Fatalf("arguments did not arrive as JSON on stdin: %q", result.Content)
+	}
+	if _, err := registry.Call(context.Background(), active, "skill_user_echo-kit__echo", json.RawMessage(`{}`)); err == nil {
+		t.Fatal("manifest schema was not enforced")
+	}
+
+	release()
+	release()
+	if !registry.Has("skill_user_echo-kit__echo") {
+		t.Fatal("tool was unregistered while another request still used it")
+	}
+	releaseSecond()
+	if registry.Has("skill_user_echo-kit__echo") {
+		t.Fatal("tool stayed registered after the last request released it")
+	}
+}
+
+func TestSkillToolsKeepSkillsWithTheSameIDApart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skill tool script uses a POSIX shell")
+	}
+	builtinRoot, userRoot := t.TempDir(), t.TempDir()
+	writeSkillWithTool(t, builtinRoot, "builtin:")
+	writeSkillWithTool(t, userRoot, "user:")
+	var skills []skillkit.Skill
+	for _, config := range []skillkit.Config{{BuiltinDir: builtinRoot}, {UserDir: userRoot}} {
+		compiled := skillkit.LoadAndCompile(config, "$echo-kit please")
+		if len(compiled.Selected) != 1 {
+			t.Fatalf("skill was not selected: %v", compiled.Diagnostics)
+		}
+		skills = append(skills, compiled.Selected[0])
+	}
+
+	registry := NewRegistry()
+	definitions, release, errs := NewSkillTools(registry).Activate(skills)
+	defer release()
+	if len(errs) != 0 || len(definitions) != 2 {
+		t.Fatalf("unexpected activation: %#v %v", definitions, errs)
+	}
+	active := ExecutionContext{ActiveSkills: []string{skills[0].Namespace, skills[1].Namespace}}
+	for name, want := range map[string]string{
+		"skill_builtin_echo-kit__echo": "builtin:",
+		"skill_user_echo-kit__echo":    "user:",
+	} {
+		result, err := registry.Call(context.Background(), active, name, json.RawMessage(`{"text":"x"}`))
+		if err != nil || !strings.HasPrefix(result.Content, want) {
+			t.Errorf("%s = %q, %v; want output from the %s skill", name, result.Content, err, strings.TrimSuffix(want, ":"))
+		}
+	}
+}
@@ -96,7 +96,7 @@ func TestDefaultRegistryNonNetworkToolContracts(t *testing.T) {
 	}
 	callToolForContract(t, execCtx, "delete_user_fact", `{"fact_key":"codex_tool_contract_fact"}`)
 
-	if got := callToolForContract(t, execCtx, "execute_command", `{"command":"printf DKST_COMMAND_SENTINEL"}`); got != "DKST_COMMAND_SENTINEL" {
+	if got := callToolForContract(t, execCtx, "execute_command", `{"command":"printf DKST_COMMAND_SENTINEL"}`); !strings.HasPrefix(got, "DKST_COMMAND_SENTINEL\n[exit code: 0, duration: ") {
 		t.Fatalf("execute_command returned %q", got)
 	}
 
@@ -0,0 +1,404 @@
+// Package upstream routes chat and model requests across several named LLM
+// servers. Each upstream has its own wire mode, token and model allow-list;
+// the router picks the upstream serving a requested model id, keeps health
+// from periodic model-list probes, and orders failover candidates.
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dinkisstyle-chat/internal/chatharness"
+)
+
+// DefaultProbeInterval is how often Run re-lists every upstream's models.
+const DefaultProbeInterval = 30 * time.Second
+
+// Config is one named LLM server from config.json "upstreams".
+type Config struct {
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	// Mode is an llmMode value (standard, stateful, responses, ollama,
+	// anthropic); empty means standard.
+	Mode  string `json:"mode,omitempty"`
+	Token string `json:"token,omitempty"`
+	// Models restricts the upstream to these model ids. Empty serves every
+	// model the upstream lists.
+	Models []string `json:"models,omitempty"`
+	// Fallback names the upstream tried when this one fails before
+	// streaming, even if it does not serve the requested model.
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// Target is one routing candidate for a request.
+type Target struct {
+	Name     string
+	Endpoint string
+	Mode     string
+	Token    string
+	// Model is the model id to send; it differs from the requested id only
+	// for a Fallback upstream that does not serve it.
+	Model string
+}
+
+// Status is the health snapshot of one upstream.
+type Status struct {
+	Name      string    `json:"name"`
+	Endpoint  string    `json:"endpoint"`
+	Mode      string    `json:"mode"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	Models    []string  `json:"models"`
+}
+
+type upstreamState struct {
+	config    Config
+	healthy   bool
+	lastError string
+	checkedAt time.Time
+	// listed holds the model ids of the last successful probe; nil until
+	// the upstream answered once.
+	listed []string
+}
+
+// Router is safe for concurrent use. A nil or empty Router routes nothing,
+// so callers fall back to the single configured endpoint.
+type Router struct {
+	mu        sync.RWMutex
+	upstreams []*upstreamState
+	client    *http.Client
+}
+
+func NewRouter(configs []Config) *Router {
+	router := &Router{client: &http.Client{Timeout: 10 * time.Second}}
+	for index, config := range configs {
+		config.Endpoint = strings.TrimSuffix(strings.TrimRight(strings.TrimSpace(config.Endpoint), "/"), "/v1")
+		if config.Endpoint == "" {
+			continue
+		}
+		config.Name = strings.TrimSpace(config.Name)
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("upstream-%d", index+1)
+		}
+		config.Mode = strings.TrimSpace(strings.ToLower(config.Mode))
+		if config.Mode == "" {
+			config.Mode = "standard"
+		}
+		config.Token = strings.TrimSpace(config.Token)
+		if strings.HasPrefix(strings.ToLower(config.Token), "bearer ") {
+			config.Token = strings.TrimSpace(config.Token[7:])
+		}
+		config.Fallback = strings.TrimSpace(config.Fallback)
+		router.upstreams = append(router.upstreams, &upstreamState{config: config, healthy: true})
+	}
+	return router
+}
+
+func (r *Router) Enabled() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.upstreams) > 0
+}
+
+// Route returns the upstreams to try for model, best first: healthy
+// upstreams serving it, then unhealthy ones, then upstreams not probed yet,
+// then the first candidate's Fallback. A model no upstream serves goes to
+// the first healthy upstream so its error reaches the user.
+func (r *Router) Route(model string) []Target {
+	if r == nil {
+		return nil
+	}
+	model = strings.TrimSpace(model)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.upstreams) == 0 {
+		return nil
+	}
+
+	var serving, unknown []*upstreamState
+	for _, state := range r.upstreams {
+		switch {
+		case model == "" || state.serves(model):
+			serving = append(serving, state)
+		case len(state.config.Models) == 0 && state.listed == nil:
+			unknown = append(unknown, state)
+		}
+	}
+	sort.SliceStable(serving, func(i, j int) bool {
+		return serving[i].healthy && !serving[j].healthy
+	})
+	ordered := append(serving, unknown...)
+	if len(ordered) == 0 {
+		first := r.upstreams[0]
+		for _, state := range r.upstreams {
+			if state.healthy {
+				first = state
+				break
+			}
+		}
+		ordered = []*upstreamState{first}
+	}
+	if fallback := r.find(ordered[0].config.Fallback); fallback != nil && !containsState(ordered, fallback) {
+		ordered = append(ordered, fallback)
+	}
+
+	targets := make([]Target, 0, len(ordered))
+	for _, state := range ordered {
+		target := Target{
+			Name:     state.config.Name,
+			Endpoint: state.config.Endpoint,
+			Mode:     state.config.Mode,
+			Token:    state.config.Token,
+			Model:    model,
+		}
+		if model != "" && !state.serves(model) && !(len(state.config.Models) == 0 && state.listed == nil) {
+			target.Model = state.defaultModel(model)
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// MarkFailure records a failed request so Route prefers other upstreams
+// until the next successful probe.
+func (r *Router) MarkFailure(name string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if state := r.find(name); state != nil {
+		state.healthy = false
+		if err != nil {
+			state.lastError = err.Error()
+		}
+		state.checkedAt = time.Now()
+	}
+}
+
+func (r *Router) Statuses() []Status {
+	if r == nil {
+		return []Status{}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	statuses := make([]Status, 0, len(r.upstreams))
+	for _, state := range r.upstreams {
+		statuses = append(statuses, Status{
+			Name:      state.config.Name,
+			Endpoint:  state.config.Endpoint,
+			Mode:      state.config.Mode,
+			Healthy:   state.healthy,
+			LastError: state.lastError,
+			CheckedAt: state.checkedAt,
+			Models:    state.servedModels(),
+		})
+	}
+	return statuses
+}
+
+// Run probes every upstream immediately and then every interval until ctx
+// is cancelled.
+func (r *Router) Run(ctx context.Context, interval time.Duration) {
+	if !r.Enabled() {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+	r.Models(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Models(ctx)
+		}
+	}
+}
+
+// Models lists every upstream concurrently, updating health, and merges the
+// entries into one list de-duplicated by id. Each entry keeps the
+// upstream's own fields plus "upstream", the name it routes to. The error
+// is non-nil only when no upstream answered.
+func (r *Router) Models(ctx context.Context) ([]map[string]interface{}, error) {
+	if !r.Enabled() {
+		return nil, fmt.Errorf("no upstreams configured")
+	}
+	r.mu.RLock()
+	states := append([]*upstreamState(nil), r.upstreams...)
+	r.mu.RUnlock()
+
+	lists := make([][]map[string]interface{}, len(states))
+	errs := make([]error, len(states))
+	var wg sync.WaitGroup
+	for index, state := range states {
+		wg.Add(1)
+		go func(index int, config Config) {
+			defer wg.Done()
+			lists[index], errs[index] = r.fetchModels(ctx, config)
+		}(index, state.config)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	merged := make([]map[string]interface{}, 0)
+	seen := make(map[string]bool)
+	var failures []string
+	for index, state := range states {
+		state.checkedAt = time.Now()
+		if errs[index] != nil {
+			state.healthy = false
+			state.lastError = errs[index].Error()
+			failures = append(failures, fmt.Sprintf("%s: %v", state.config.Name, errs[index]))
+			continue
+		}
+		state.healthy = true
+		state.lastError = ""
+		state.listed = make([]string, 0, len(lists[index]))
+		for _, entry := range lists[index] {
+			state.listed = append(state.listed, entry["id"].(string))
+		}
+		entries := lists[index]
+		for _, id := range state.config.Models {
+			if !containsString(state.listed, id) {
+				entries = append(entries, map[string]interface{}{"id": id, "object": "model"})
+			}
+		}
+		for _, entry := range entries {
+			id := entry["id"].(string)
+			if seen[id] || !state.serves(id) {
+				continue
+			}
+			seen[id] = true
+			entry["upstream"] = state.config.Name
+			merged = append(merged, entry)
+		}
+	}
+	if len(failures) == len(states) {
+		return nil, fmt.Errorf("all upstreams failed: %s", strings.Join(failures, "; "))
+	}
+	return merged, nil
+}
+
+func (r *Router) fetchModels(ctx context.Context, config Config) ([]map[string]interface{}, error) {
+	modelsURL := config.Endpoint + "/v1/models"
+	if config.Mode == "stateful" {
+		modelsURL = config.Endpoint + "/api/v1/models"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, modelsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if adapter := chatharness.AdapterFor(config.Mode); adapter != nil {
+		adapter.SetHeaders(req.Header, config.Token)
+	} else if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	} else {
+		req.Header.Set("Authorization", "Bearer lm-studio")
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return parseModelList(body)
+}
+
+// parseModelList accepts OpenAI-style {"data":[{"id"}]} and LM Studio
+// {"models":[{"key"}]} listings and returns entries that all carry "id".
+func parseModelList(body []byte) ([]map[string]interface{}, error) {
+	var listing struct {
+		Data   []map[string]interface{} `json:"data"`
+		Models []map[string]interface{} `json:"models"`
+	}
+	if err := json.Unmarshal(body, &listing); err != nil {
+		return nil, fmt.Errorf("decode model list: %w", err)
+	}
+	entries := make([]map[string]interface{}, 0, len(listing.Data)+len(listing.Models))
+	for _, entry := range append(listing.Data, listing.Models...) {
+		id, _ := entry["id"].(string)
+		if strings.TrimSpace(id) == "" {
+			id, _ = entry["key"].(string)
+		}
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+		entry["id"] = strings.TrimSpace(id)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (r *Router) find(name string) *upstreamState {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil
+	}
+	for _, state := range r.upstreams {
+		if strings.EqualFold(state.config.Name, name) {
+			return state
+		}
+	}
+	return nil
+}
+
+func (s *upstreamState) serves(model string) bool {
+	if len(s.config.Models) > 0 {
+		return containsString(s.config.Models, model)
+	}
+	return containsString(s.listed, model)
+}
+
+func (s *upstreamState) servedModels() []string {
+	if len(s.config.Models) > 0 {
+		return append([]string(nil), s.config.Models...)
+	}
+	return append([]string{}, s.listed...)
+}
+
+func (s *upstreamState) defaultModel(requested string) string {
+	if served := s.servedModels(); len(served) > 0 {
+		return served[0]
+	}
+	return requested
+}
+
+func containsState(states []*upstreamState, wanted *upstreamState) bool {
+	for _, state := range states {
+		if state == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, wanted string) bool {
+	for _, value := range values {
+		if strings.TrimSpace(value) == wanted {
+			return true
+		}
+	}
+	return false
+}
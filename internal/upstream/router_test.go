@@ -0,0 +1,113 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func modelServer(t *testing.T, status int, body string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func targetNames(targets []Target) []string {
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.Name+":"+target.Model)
+	}
+	return names
+}
+
+func TestNilRouterRoutesNothing(t *testing.T) {
+	var router *Router
+	if router.Enabled() || router.Route("qwen") != nil {
+		t.Fatal("nil router must fall back to the single endpoint")
+	}
+	if NewRouter([]Config{{Name: "empty"}}).Enabled() {
+		t.Fatal("upstream without endpoint must be ignored")
+	}
+}
+
+func TestRouteByAllowListAndFallback(t *testing.T) {
+	router := NewRouter([]Config{
+		{Name: "gpu", Endpoint: "http://gpu:1234/v1/", Models: []string{"qwen", "llama"}, Fallback: "cpu"},
+		{Name: "cpu", Endpoint: "http://cpu:1234", Models: []string{"phi"}},
+		{Name: "backup", Endpoint: "http://backup:1234", Mode: "Ollama", Models: []string{"qwen"}},
+	})
+
+	targets := router.Route("qwen")
+	if got, want := targetNames(targets), []string{"gpu:qwen", "backup:qwen", "cpu:phi"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("route = %v, want %v", got, want)
+	}
+	if targets[0].Endpoint != "http://gpu:1234" || targets[0].Mode != "standard" || targets[1].Mode != "ollama" {
+		t.Fatalf("unexpected normalized target: %+v %+v", targets[0], targets[1])
+	}
+
+	router.MarkFailure("gpu", nil)
+	if got, want := targetNames(router.Route("qwen")), []string{"backup:qwen", "gpu:qwen"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("route after failure = %v, want %v", got, want)
+	}
+	if got, want := targetNames(router.Route("phi")), []string{"cpu:phi"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("route phi = %v, want %v", got, want)
+	}
+}
+
+func TestModelsMergesAndUpdatesHealth(t *testing.T) {
+	openai := modelServer(t, http.StatusOK, `{"object":"list","data":[{"id":"qwen","object":"model"},{"id":"llama","object":"model"}]}`)
+	lmstudio := modelServer(t, http.StatusOK, `{"models":[{"key":"qwen","type":"llm"},{"key":"gemma","type":"llm"}]}`)
+	broken := modelServer(t, http.StatusBadGateway, `down`)
+	router := NewRouter([]Config{
+		{Name: "a", Endpoint: openai.URL},
+		{Name: "b", Endpoint: lmstudio.URL, Mode: "stateful"},
+		{Name: "c", Endpoint: broken.URL},
+		{Name: "d", Endpoint: openai.URL, Models: []string{"llama", "mistral"}},
+	})
+
+	if got, want := targetNames(router.Route("gemma")), []string{"a:gemma", "b:gemma", "c:gemma"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("route before probe = %v, want %v", got, want)
+	}
+
+	models, err := router.Models(context.Background())
+	if err != nil {
+		t.Fatalf("Models: %v", err)
+	}
+	var ids, owners []string
+	for _, model := range models {
+		ids = append(ids, model["id"].(string))
+		owners = append(owners, model["upstream"].(string))
+	}
+	if want := []string{"qwen", "llama", "gemma", "mistral"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("merged ids = %v, want %v", ids, want)
+	}
+	if want := []string{"a", "a", "b", "d"}; !reflect.DeepEqual(owners, want) {
+		t.Fatalf("owners = %v, want %v", owners, want)
+	}
+
+	if got, want := targetNames(router.Route("gemma")), []string{"b:gemma", "c:gemma"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("route after probe = %v, want %v", got, want)
+	}
+	for _, status := range router.Statuses() {
+		if healthy := status.Name != "c"; status.Healthy != healthy {
+			t.Fatalf("status %s healthy = %v", status.Name, status.Healthy)
+		}
+	}
+}
+
+func TestModelsFailsWhenEveryUpstreamFails(t *testing.T) {
+	broken := modelServer(t, http.StatusInternalServerError, `boom`)
+	router := NewRouter([]Config{{Name: "only", Endpoint: broken.URL}})
+	if _, err := router.Models(context.Background()); err == nil {
+		t.Fatal("expected error when no upstream answers")
+	}
+	if got, want := targetNames(router.Route("anything")), []string{"only:anything"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unserved model route = %v, want %v", got, want)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 
 	"dinkisstyle-chat/internal/harness"
+	"dinkisstyle-chat/internal/mcp"
 )
 
 //go:embed build/darwin/trayicon.png
@@ -28,6 +29,9 @@ var windowIcon []byte
 var assets embed.FS
 
 func main() {
+	// Jailed execute_command runs re-execute this binary as a launcher.
+	mcp.RunCommandJailIfRequested()
+
 	desktop := harness.NewDesktop(harness.DesktopAssets{
 		Frontend:         assets,
 		TrayIconMacOSPNG: trayIconPng,